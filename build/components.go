@@ -0,0 +1,61 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshkit/models/oam/core/v1alpha1"
+	"github.com/layer5io/meshkit/utils/manifests"
+)
+
+// CreateComponentsFromManifest generates the components of an already fetched manifest and stores
+// them like adapter.CreateComponents does, which saves downloading the manifest again
+func CreateComponentsFromManifest(manifest string, scfg adapter.StaticCompConfig) error {
+	dir := filepath.Join(scfg.Path, scfg.DirName)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return adapter.ErrCreatingComponents(err)
+	}
+
+	comp, err := manifests.GenerateComponents(context.Background(), manifest, manifests.SERVICE_MESH, scfg.Config)
+	if err != nil {
+		return adapter.ErrCreatingComponents(err)
+	}
+	if comp == nil {
+		return adapter.ErrCreatingComponents(errors.New("no components found"))
+	}
+
+	for i, def := range comp.Definitions {
+		name := workloadName([]byte(def))
+		if err := writeComponentFile(filepath.Join(dir, name+"_definition.json"), []byte(def), scfg.Force); err != nil {
+			return adapter.ErrCreatingComponents(err)
+		}
+		if err := writeComponentFile(filepath.Join(dir, name+".meshery.layer5io.schema.json"), []byte(comp.Schemas[i]), scfg.Force); err != nil {
+			return adapter.ErrCreatingComponents(err)
+		}
+	}
+	return nil
+}
+
+// writeComponentFile writes data to path unless the file already exists and force is not set
+func writeComponentFile(path string, data []byte, force bool) error {
+	if _, err := os.Stat(path); err == nil && !force {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// workloadName returns the name of the workload defined by definition
+func workloadName(definition []byte) string {
+	var wd v1alpha1.WorkloadDefinition
+	if err := json.Unmarshal(definition, &wd); err != nil {
+		return ""
+	}
+	return wd.Spec.DefinitionRef.Name
+}
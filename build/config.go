@@ -1,17 +1,25 @@
 package build
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
 	"github.com/layer5io/meshkit/utils"
 	"github.com/layer5io/meshkit/utils/manifests"
-	walker "github.com/layer5io/meshkit/utils/walker"
+	"github.com/layer5io/meshkit/utils/walker"
 	smp "github.com/layer5io/service-mesh-performance/spec"
 )
 
+// crdPath is the directory holding the cilium CRDs in the cilium repository
+const crdPath = "pkg/k8s/apis/cilium.io/client/crds/v2"
+
+// maxCRDSize is the size above which a file in crdPath is not treated as a CRD
+const maxCRDSize = 5 << 20
+
 var DefaultVersion string
 var DefaultURL string
 var DefaultGenerationMethod string
@@ -19,7 +27,10 @@ var WorkloadPath string
 var AllVersions []string
 var CRDNames []string
 
-//NewConfig creates the configuration for creating components
+// CRDFiles holds the CRDs of DefaultVersion along with their contents
+var CRDFiles []walker.File
+
+// NewConfig creates the configuration for creating components
 func NewConfig(version string) manifests.Config {
 	return manifests.Config{
 		Name:        smp.ServiceMesh_Type_name[int32(smp.ServiceMesh_CILIUM_SERVICE_MESH)],
@@ -48,20 +59,14 @@ func init() {
 	DefaultVersion = AllVersions[len(AllVersions)-1]
 	DefaultGenerationMethod = adapter.Manifests
 
-	//Get all the crd names
-	w := walker.NewGithub()
-	err := w.Owner("cilium").
-		Repo("cilium").
-		Branch("master").
-		Root("pkg/k8s/apis/cilium.io/client/crds/v2/**").
-		RegisterFileInterceptor(func(gca walker.GithubContentAPI) error {
-			if gca.Content != "" {
-				CRDNames = append(CRDNames, gca.Name)
-			}
-			return nil
-		}).Walk()
+	//Get all the crd names at the release being generated for, the CRDs on master may not exist in it yet
+	var err error
+	CRDFiles, err = config.GetFiles(context.Background(), "cilium", "cilium", crdPath, DefaultVersion, config.FileOptions{Pattern: "*.yaml", MaxFileSize: maxCRDSize})
 	if err != nil {
 		fmt.Println("Could not find CRD names. Will fail component creation...", err.Error())
 	}
-	DefaultURL = "https://raw.githubusercontent.com/cilium/cilium/" + "master" + "/pkg/k8s/apis/cilium.io/client/crds/v2/"
+	for _, crd := range CRDFiles {
+		CRDNames = append(CRDNames, crd.Name)
+	}
+	DefaultURL = "https://raw.githubusercontent.com/cilium/cilium/" + DefaultVersion + "/" + crdPath + "/"
 }
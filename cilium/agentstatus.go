@@ -0,0 +1,132 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// agentState is the state an agent reports for its node in a field of its
+// status, like Encryption or Hubble
+type agentState struct {
+	Node   string
+	Pod    string
+	State  string
+	Active bool
+}
+
+// agentProbe tells the state of the agent pod, and whether it is active
+type agentProbe func(pod *corev1.Pod) (state string, active bool)
+
+// probeAgents returns the state probe finds on every agent of namespace
+func (h *Handler) probeAgents(ctx context.Context, namespace string, probe agentProbe) ([]agentState, error) {
+	pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]agentState, 0, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		state := agentState{Node: pod.Spec.NodeName, Pod: pod.Name}
+		if pod.Status.Phase != corev1.PodRunning {
+			state.State = fmt.Sprintf("agent %s", strings.ToLower(string(pod.Status.Phase)))
+		} else {
+			state.State, state.Active = probe(pod)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// agentStates returns the state every agent of namespace reports in field,
+// which is active if active says so
+func (h *Handler) agentStates(ctx context.Context, namespace, field string, active func(state string) bool) ([]agentState, error) {
+	return h.probeAgents(ctx, namespace, h.statusProbe(field, active))
+}
+
+// statusProbe probes the state an agent reports in field of its status
+func (h *Handler) statusProbe(field string, active func(state string) bool) agentProbe {
+	return func(pod *corev1.Pod) (string, bool) {
+		out, err := h.execPodCLI(pod, "status")
+		if err != nil {
+			return err.Error(), false
+		}
+		state := statusField(out, field)
+		return state, active(state)
+	}
+}
+
+// statusField returns the value of field in the output of the agent
+// status, or unknown if the agent does not report it
+func statusField(status, field string) string {
+	for _, line := range strings.Split(status, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, field+":"))
+		}
+	}
+	return "unknown"
+}
+
+// waitForAgentStates waits for every agent of namespace to report field
+// active, and returns the last state of every node
+func (h *Handler) waitForAgentStates(e *adapter.Event, namespace, field string, timeout time.Duration, active func(state string) bool) ([]agentState, error) {
+	return h.waitForAgentProbe(e, namespace, field, timeout, h.statusProbe(field, active))
+}
+
+// waitForAgentProbe waits for probe to find every agent of namespace
+// active, and returns the last state of every node. what is reported in
+// the progress events.
+func (h *Handler) waitForAgentProbe(e *adapter.Event, namespace, what string, timeout time.Duration, probe agentProbe) ([]agentState, error) {
+	var states []agentState
+	n := -1
+	err := wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		var err error
+		states, err = h.probeAgents(context.Background(), namespace, probe)
+		if err != nil {
+			return false, err
+		}
+		count := 0
+		for _, state := range states {
+			if state.Active {
+				count++
+			}
+		}
+		if count != n {
+			n = count
+			h.streamProgress(e, fmt.Sprintf("Waiting for the Cilium agents to report %s", what), fmt.Sprintf("%d of %d agents ready", count, len(states)))
+		}
+		return len(states) > 0 && count == len(states), nil
+	})
+	return states, err
+}
+
+// agentStateDetails describes the state of every node under title
+func agentStateDetails(title string, states []agentState) string {
+	lines := make([]string, 0, len(states))
+	for _, state := range states {
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", state.Node, state.Pod, state.State))
+	}
+	return fmt.Sprintf("%s:\n%s", title, strings.Join(lines, "\n"))
+}
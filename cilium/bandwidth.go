@@ -0,0 +1,209 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// bandwidthManagerSince is the first version running the bandwidth
+	// manager
+	bandwidthManagerSince = semver.MustParse("1.9.0")
+
+	// bbrSince is the first version of the chart taking the bandwidth
+	// manager as a map, with its bbr option
+	bbrSince = semver.MustParse("1.12.0")
+
+	// bbrKernel is the first kernel running BBR for the pods, the
+	// agents refuse to start on older ones
+	bbrKernel = semver.MustParse("5.18.0")
+
+	// kernelVersion matches the release of a kernel as the nodes report
+	// it, like 5.15.0-1034-azure
+	kernelVersion = regexp.MustCompile(`^\d+\.\d+(\.\d+)?`)
+)
+
+// bandwidthRequest holds the parameters of the cilium bandwidth manager
+// operation, read from the custom body of the request
+type bandwidthRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// BBR switches the pods to the BBR congestion control. It is turned
+	// off with a warning when a node runs a kernel older than 5.18.
+	BBR bool `yaml:"bbr"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the
+	// bandwidth manager fails to start, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// bandwidthValues returns the chart values of version enabling the
+// bandwidth manager, with bbr if set
+func bandwidthValues(version string, enabled, bbr bool) (map[string]interface{}, error) {
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if v.LessThan(bandwidthManagerSince) {
+		return nil, ErrInvalidBandwidthManager(fmt.Errorf("cilium %s is installed, the bandwidth manager requires %s", version, bandwidthManagerSince))
+	}
+	if v.LessThan(bbrSince) {
+		if bbr {
+			return nil, ErrInvalidBandwidthManager(fmt.Errorf("cilium %s is installed, BBR requires %s", version, bbrSince))
+		}
+		return map[string]interface{}{"bandwidthManager": enabled}, nil
+	}
+	return map[string]interface{}{
+		"bandwidthManager": map[string]interface{}{"enabled": enabled, "bbr": bbr},
+	}, nil
+}
+
+// oldKernels returns the nodes running a kernel older than min, with their
+// kernel. Nodes whose kernel cannot be parsed are counted as old.
+func (h *Handler) oldKernels(ctx context.Context, min *semver.Version) ([]string, error) {
+	nodes, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var old []string
+	for _, node := range nodes.Items {
+		kernel := node.Status.NodeInfo.KernelVersion
+		v, err := semver.NewVersion(kernelVersion.FindString(kernel))
+		if err != nil || v.LessThan(min) {
+			old = append(old, fmt.Sprintf("%s (%s)", node.Name, kernel))
+		}
+	}
+	return old, nil
+}
+
+// waitForBandwidthManager waits for every agent of namespace to run the
+// bandwidth manager, and returns the last state of every node
+func (h *Handler) waitForBandwidthManager(e *adapter.Event, namespace string, timeout time.Duration) ([]agentState, error) {
+	states, err := h.waitForAgentStates(e, namespace, "BandwidthManager", timeout, func(state string) bool {
+		return state != "unknown" && !strings.HasPrefix(state, "Disabled")
+	})
+	if err != nil {
+		return states, fmt.Errorf("the bandwidth manager does not run on every agent: %w", err)
+	}
+	return states, nil
+}
+
+// bandwidthManager enables, or disables if del is set, the bandwidth
+// manager on the installed release and reports whether it runs on every
+// node. BBR is left out when the kernel of a node cannot run it, or when
+// the agents do not come up with it, rather than leaving them crashing.
+func (h *Handler) bandwidthManager(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium bandwidth manager"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req bandwidthRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+
+	var warnings []string
+	bbr := req.BBR && !del
+	if bbr {
+		old, err := h.oldKernels(context.Background(), bbrKernel)
+		if err != nil {
+			fail(ErrConfigureBandwidthManager(err))
+			return
+		}
+		if len(old) > 0 {
+			bbr = false
+			warnings = append(warnings, fmt.Sprintf("Warning: BBR requires a %s kernel, it is left out for the nodes %s.", bbrKernel, strings.Join(old, ", ")))
+		}
+	}
+
+	version, rollback, err := h.reconfigure(e, namespace, timeout, func(version string) (map[string]interface{}, error) {
+		return bandwidthValues(version, !del, bbr)
+	})
+	if err != nil && bbr && rollback != nil {
+		// The agents exit when the kernel turns BBR down
+		warnings = append(warnings, fmt.Sprintf("Warning: the agents did not start with BBR (%s), it is left out.", err))
+		h.streamProgress(e, "Retrying the Cilium bandwidth manager without BBR", err.Error())
+		bbr = false
+		_, _, err = h.reconfigure(e, namespace, timeout, func(version string) (map[string]interface{}, error) {
+			return bandwidthValues(version, true, false)
+		})
+	}
+	if err == nil && !del {
+		var states []agentState
+		states, err = h.waitForBandwidthManager(e, namespace, timeout)
+		if err != nil && len(states) > 0 {
+			err = fmt.Errorf("%w\n%s", err, agentStateDetails("Bandwidth manager per node", states))
+		}
+		if err == nil {
+			mode := "without BBR"
+			if bbr {
+				mode = "with BBR"
+			}
+			e.Summary = "Cilium bandwidth manager enabled successfully"
+			e.Details = fmt.Sprintf("The bandwidth manager runs %s on the agents of Cilium %s.\n%s", mode, version, agentStateDetails("Bandwidth manager per node", states))
+		}
+	}
+	if err != nil {
+		fail(ErrConfigureBandwidthManager(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+	if del {
+		e.Summary = "Cilium bandwidth manager disabled successfully"
+		e.Details = fmt.Sprintf("The bandwidth manager no longer runs on the agents of Cilium %s.", version)
+	}
+	if len(warnings) > 0 {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, strings.Join(warnings, "\n"))
+	}
+	h.StreamInfo(e)
+}
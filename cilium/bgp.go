@@ -0,0 +1,308 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// bgpPolicyResource is the resource of the CiliumBGPPeeringPolicies
+var bgpPolicyResource = schema.GroupVersionResource{
+	Group:    ciliumGroup,
+	Version:  "v2alpha1",
+	Resource: "ciliumbgppeeringpolicies",
+}
+
+// bgpControlPlaneSince is the first version running the BGP control plane
+var bgpControlPlaneSince = semver.MustParse("1.12.0")
+
+// reservedASNs are the ASNs which cannot be used by a BGP speaker
+var reservedASNs = map[int64]bool{
+	0:          true,
+	23456:      true, // AS_TRANS
+	65535:      true,
+	4294967295: true,
+}
+
+// bgpPeer is a BGP neighbor of the virtual router of a policy
+type bgpPeer struct {
+	// Address is the IP of the peer
+	Address string `yaml:"address"`
+
+	// ASN is the autonomous system of the peer
+	ASN int64 `yaml:"asn"`
+}
+
+// bgpPolicy is a CiliumBGPPeeringPolicy built from the parameters of the
+// bgp operation
+type bgpPolicy struct {
+	// Name of the CiliumBGPPeeringPolicy
+	Name string `yaml:"name"`
+
+	// NodeSelector selects the nodes peering by their labels, every node
+	// if empty
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+
+	// LocalASN is the autonomous system of the selected nodes
+	LocalASN int64 `yaml:"localASN"`
+
+	// Peers are the neighbors of the selected nodes
+	Peers []bgpPeer `yaml:"peers"`
+
+	// ExportPodCIDR advertises the pod CIDR of the nodes
+	ExportPodCIDR bool `yaml:"exportPodCIDR"`
+
+	// AdvertiseLoadBalancerIPs advertises the IPs of every LoadBalancer
+	// service
+	AdvertiseLoadBalancerIPs bool `yaml:"advertiseLoadBalancerIPs"`
+}
+
+// bgpRequest holds the parameters of the cilium bgp operation, read from
+// the custom body of the request
+type bgpRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Policies are created, or replaced if they exist
+	Policies []bgpPolicy `yaml:"policies"`
+
+	// Remove are the names of the policies to delete
+	Remove []string `yaml:"remove"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+}
+
+func validateASN(asn int64) error {
+	if asn < 0 || asn > 4294967295 || reservedASNs[asn] {
+		return fmt.Errorf("%d is not a usable ASN", asn)
+	}
+	return nil
+}
+
+// peerAddress returns the address of a peer as the host CIDR the policies
+// take
+func peerAddress(address string) (string, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.To4() != nil {
+			return address + "/32", nil
+		}
+		return address + "/128", nil
+	}
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", fmt.Errorf("peer address %q is neither an IP nor a host CIDR", address)
+	}
+	if ones, bits := ipnet.Mask.Size(); ones != bits || !ip.Equal(ipnet.IP) {
+		return "", fmt.Errorf("peer address %q is not a host CIDR", address)
+	}
+	return address, nil
+}
+
+// object validates the policy and builds its CiliumBGPPeeringPolicy
+func (p bgpPolicy) object() (*unstructured.Unstructured, error) {
+	if errs := validation.IsDNS1123Subdomain(p.Name); len(errs) > 0 {
+		return nil, ErrInvalidBGP(fmt.Errorf("policy name %q: %s", p.Name, strings.Join(errs, ", ")))
+	}
+	if err := validateASN(p.LocalASN); err != nil {
+		return nil, ErrInvalidBGP(fmt.Errorf("local ASN of policy %s: %w", p.Name, err))
+	}
+	if len(p.Peers) == 0 {
+		return nil, ErrInvalidBGP(fmt.Errorf("policy %s has no peers", p.Name))
+	}
+	if err := validateLabels(p.NodeSelector); err != nil {
+		return nil, ErrInvalidBGP(fmt.Errorf("node selector of policy %s: %w", p.Name, err))
+	}
+
+	neighbors := make([]interface{}, 0, len(p.Peers))
+	for _, peer := range p.Peers {
+		address, err := peerAddress(peer.Address)
+		if err != nil {
+			return nil, ErrInvalidBGP(fmt.Errorf("policy %s: %w", p.Name, err))
+		}
+		if err := validateASN(peer.ASN); err != nil {
+			return nil, ErrInvalidBGP(fmt.Errorf("ASN of peer %s of policy %s: %w", peer.Address, p.Name, err))
+		}
+		neighbors = append(neighbors, map[string]interface{}{
+			"peerAddress": address,
+			"peerASN":     peer.ASN,
+		})
+	}
+
+	router := map[string]interface{}{
+		"localASN":      p.LocalASN,
+		"exportPodCIDR": p.ExportPodCIDR,
+		"neighbors":     neighbors,
+	}
+	if p.AdvertiseLoadBalancerIPs {
+		// An expression no service matches the negation of selects them all
+		router["serviceSelector"] = map[string]interface{}{
+			"matchExpressions": []interface{}{
+				map[string]interface{}{"key": "somekey", "operator": "NotIn", "values": []interface{}{"never-used-value"}},
+			},
+		}
+	}
+
+	spec := map[string]interface{}{"virtualRouters": []interface{}{router}}
+	if len(p.NodeSelector) > 0 {
+		spec["nodeSelector"] = labelSelector(p.NodeSelector)
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": bgpPolicyResource.GroupVersion().String(),
+		"kind":       "CiliumBGPPeeringPolicy",
+		"metadata":   map[string]interface{}{"name": p.Name},
+		"spec":       spec,
+	}}
+	return obj, nil
+}
+
+// bgpControlPlaneEnabled reports whether the release values enable the
+// BGP control plane
+func bgpControlPlaneEnabled(values map[string]interface{}) bool {
+	bgp, _ := values["bgpControlPlane"].(map[string]interface{})
+	enabled, _ := bgp["enabled"].(bool)
+	return enabled
+}
+
+// bgp enables the BGP control plane on the installed release and applies
+// the peering policies of the request, or removes the named ones. When
+// deleted, every policy of the request is removed and the control plane is
+// left enabled.
+func (h *Handler) bgp(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring Cilium BGP"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req bgpRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	remove := req.Remove
+	var objects []*unstructured.Unstructured
+	for _, policy := range req.Policies {
+		if del {
+			remove = append(remove, policy.Name)
+			continue
+		}
+		obj, err := policy.object()
+		if err != nil {
+			fail(err)
+			return
+		}
+		objects = append(objects, obj)
+	}
+	for _, name := range remove {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			fail(ErrInvalidBGP(fmt.Errorf("policy name %q: %s", name, strings.Join(errs, ", "))))
+			return
+		}
+	}
+	if len(objects) == 0 && len(remove) == 0 {
+		fail(ErrInvalidBGP(fmt.Errorf("the request neither has policies to apply nor to remove")))
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	var results []string
+	if len(objects) > 0 {
+		namespace := h.ciliumNamespace(req.Namespace)
+		if !h.releaseExists(namespace) {
+			fail(ErrCiliumNotInstalled(namespace))
+			return
+		}
+		version, values, err := h.releaseValues(namespace)
+		if err != nil {
+			fail(ErrConfigureBGP(err))
+			return
+		}
+		if v, err := config.ParseVersion(version); err != nil || v.LessThan(bgpControlPlaneSince) {
+			fail(ErrInvalidBGP(fmt.Errorf("cilium %s is installed, the BGP control plane requires %s", version, bgpControlPlaneSince)))
+			return
+		}
+		if !bgpControlPlaneEnabled(values) {
+			_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+				return map[string]interface{}{
+					"bgpControlPlane": map[string]interface{}{"enabled": true},
+				}, nil
+			})
+			if err != nil {
+				fail(ErrConfigureBGP(err))
+				if rollback != nil {
+					rollback()
+				}
+				return
+			}
+			results = append(results, "BGP control plane: enabled")
+		}
+		if err := h.waitForCRD(ctx, bgpPolicyResource, timeout); err != nil {
+			fail(ErrConfigureBGP(fmt.Errorf("the CiliumBGPPeeringPolicy CRD is not registered: %w", err)))
+			return
+		}
+
+		for _, obj := range objects {
+			stat, err := h.applyResource(ctx, bgpPolicyResource, obj)
+			if err != nil {
+				results = append(results, fmt.Sprintf("CiliumBGPPeeringPolicy %s: %s", obj.GetName(), err))
+				fail(ErrConfigureBGP(fmt.Errorf("%s\n%s", err, strings.Join(results, "\n"))))
+				return
+			}
+			results = append(results, fmt.Sprintf("CiliumBGPPeeringPolicy %s: %s", obj.GetName(), stat))
+		}
+	}
+
+	var failed bool
+	for _, name := range remove {
+		err := h.DynamicKubeClient.Resource(bgpPolicyResource).Delete(ctx, name, metav1.DeleteOptions{})
+		r := newUninstallResult("CiliumBGPPeeringPolicy", name, err)
+		failed = failed || r.Err != nil
+		results = append(results, r.String())
+	}
+	if failed {
+		fail(ErrConfigureBGP(fmt.Errorf("some policies could not be removed:\n%s", strings.Join(results, "\n"))))
+		return
+	}
+
+	e.Summary = "Cilium BGP configured successfully"
+	e.Details = strings.Join(results, "\n")
+	h.StreamInfo(e)
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	chainingAWSCNI      = "aws-cni"
+	chainingGenericVeth = "generic-veth"
+)
+
+var (
+	// chainingKubeProxySince is the first version replacing kube-proxy in
+	// chaining mode
+	chainingKubeProxySince = semver.MustParse("1.14.0")
+
+	// cniExclusiveSince is the first version removing the configurations
+	// of the other CNIs unless told otherwise
+	cniExclusiveSince = semver.MustParse("1.13.0")
+
+	// chainingTargetSince is the first version generating the chained
+	// configuration of the generic-veth mode itself
+	chainingTargetSince = semver.MustParse("1.14.0")
+)
+
+// chainingOptions runs cilium on top of another CNI, which allocates and
+// routes the pod IPs. They are part of the custom body of the install
+// requests.
+type chainingOptions struct {
+	// ChainingMode is aws-cni on top of the AWS VPC CNI, or generic-veth on
+	// top of any CNI creating veth pairs
+	ChainingMode string `yaml:"chainingMode"`
+
+	// ChainingTarget is the network of the primary CNI cilium is chained
+	// to in the generic-veth mode, since cilium 1.14
+	ChainingTarget string `yaml:"chainingTarget"`
+
+	// CNIConfigMap is the ConfigMap holding the chained CNI configuration
+	// of the generic-veth mode, required without a ChainingTarget
+	CNIConfigMap string `yaml:"cniConfigMap"`
+}
+
+// mode returns the requested chaining mode, lower cased
+func (o chainingOptions) mode() string {
+	return strings.ToLower(o.ChainingMode)
+}
+
+// enabled reports whether cilium is chained to another CNI
+func (o chainingOptions) enabled() bool {
+	return o.ChainingMode != ""
+}
+
+// check rejects the options of the request which make no sense in chaining
+// mode on version: the pods are addressed and routed by the primary CNI
+func (o chainingOptions) check(version string, kubeProxy kubeProxyOptions, routing routingOptions, ipam ipamOptions) error {
+	if !o.enabled() {
+		if o.ChainingTarget != "" || o.CNIConfigMap != "" {
+			return ErrInvalidChainingMode(fmt.Errorf("chainingTarget and cniConfigMap require a chainingMode"))
+		}
+		return nil
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return err
+	}
+	if kubeProxy.enabled() && v.LessThan(chainingKubeProxySince) {
+		return ErrInvalidChainingMode(fmt.Errorf("cilium %s cannot replace kube-proxy in chaining mode, which requires %s", version, chainingKubeProxySince))
+	}
+	if mode := strings.ToLower(routing.RoutingMode); mode != "" && mode != routingNative {
+		return ErrInvalidChainingMode(fmt.Errorf("the primary CNI routes the pods in chaining mode, %s routing is not possible", mode))
+	}
+	if ipam.IPAMMode != "" || len(ipam.ClusterPoolIPv4PodCIDRList) > 0 {
+		return ErrInvalidChainingMode(fmt.Errorf("the primary CNI allocates the pod IPs in chaining mode, drop the IPAM parameters"))
+	}
+	return nil
+}
+
+// values translates the options into the values of the chart of version
+func (o chainingOptions) values(version string) (map[string]interface{}, error) {
+	if !o.enabled() {
+		return nil, nil
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	cni := map[string]interface{}{"chainingMode": o.mode()}
+	switch o.mode() {
+	case chainingAWSCNI:
+		if o.ChainingTarget != "" || o.CNIConfigMap != "" {
+			return nil, ErrInvalidChainingMode(fmt.Errorf("chainingTarget and cniConfigMap only apply to the %s mode", chainingGenericVeth))
+		}
+	case chainingGenericVeth:
+		switch {
+		case o.ChainingTarget != "" && o.CNIConfigMap != "":
+			return nil, ErrInvalidChainingMode(fmt.Errorf("set either chainingTarget or cniConfigMap"))
+		case o.ChainingTarget != "":
+			if v.LessThan(chainingTargetSince) {
+				return nil, ErrInvalidChainingMode(fmt.Errorf("cilium %s does not take a chainingTarget, which requires %s, set cniConfigMap", version, chainingTargetSince))
+			}
+			cni["chainingTarget"] = o.ChainingTarget
+		case o.CNIConfigMap != "":
+			if errs := validation.IsDNS1123Subdomain(o.CNIConfigMap); len(errs) > 0 {
+				return nil, ErrInvalidChainingMode(fmt.Errorf("cniConfigMap %q: %s", o.CNIConfigMap, strings.Join(errs, ", ")))
+			}
+			cni["customConf"] = true
+			cni["configMap"] = o.CNIConfigMap
+		default:
+			return nil, ErrInvalidChainingMode(fmt.Errorf("the %s mode requires chainingTarget or cniConfigMap", chainingGenericVeth))
+		}
+	default:
+		return nil, ErrInvalidChainingMode(fmt.Errorf("unknown chaining mode %q, expected %s or %s", o.ChainingMode, chainingAWSCNI, chainingGenericVeth))
+	}
+	if !v.LessThan(cniExclusiveSince) {
+		// The configuration of the primary CNI must be kept
+		cni["exclusive"] = false
+	}
+
+	return map[string]interface{}{
+		"cni": cni,
+		// The primary CNI masquerades the traffic leaving the pods
+		"enableIPv4Masquerade": false,
+		"endpointRoutes":       map[string]interface{}{"enabled": true},
+	}, nil
+}
+
+// waitForChaining waits for every agent of namespace to run in the chaining
+// mode, and returns the last state of every node
+func (h *Handler) waitForChaining(e *adapter.Event, namespace, mode string, timeout time.Duration) ([]agentState, error) {
+	states, err := h.waitForAgentStates(e, namespace, "CNI Chaining", timeout, func(state string) bool {
+		return strings.HasPrefix(strings.ToLower(state), mode)
+	})
+	if err != nil {
+		return states, fmt.Errorf("not every agent runs in the %s chaining mode: %w", mode, err)
+	}
+	return states, nil
+}
@@ -17,6 +17,8 @@ package cilium
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/layer5io/meshery-adapter-library/adapter"
 	"github.com/layer5io/meshery-adapter-library/common"
@@ -26,11 +28,54 @@ import (
 	meshkitCfg "github.com/layer5io/meshkit/config"
 	"github.com/layer5io/meshkit/logger"
 	"github.com/layer5io/meshkit/models/oam/core/v1alpha1"
+	"helm.sh/helm/v3/pkg/action"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 )
 
 // Handler instance for this adapter
 type Handler struct {
 	adapter.Adapter
+
+	// cluster is the kubeconfig context the handler acts on, or empty for
+	// the current context
+	cluster string
+
+	// helmRepo is the repository the charts are fetched from, the one of
+	// the environment if nil
+	helmRepo *internalconfig.HelmRepository
+
+	// chartDigest is the digest the cilium chart must have, if set
+	chartDigest string
+
+	// statusCache serves the status reports collected recently
+	statusCache *statusCache
+
+	// sampleManifests holds the paths of the sample manifests found at
+	// every ref of the cilium repo
+	sampleManifests *sampleManifestCache
+
+	// sampleWaits are the health checks of the sample apps in progress
+	sampleWaits *sampleWaitRegistry
+
+	// clients are the clients of the other contexts used recently
+	clients *clientCache
+
+	// progress tracks the phases of the operation the handler runs, if
+	// it reports them
+	progress *operationProgress
+
+	// typedClient replaces the KubeClient of the adapter when set, as the
+	// tests do with a fake clientset
+	typedClient kubernetes.Interface
+
+	// helmConfig replaces the configuration of the helm actions when set,
+	// as the tests do with an in-memory release storage
+	helmConfig *action.Configuration
+
+	// poll replaces wait.PollImmediate in the waits for cilium to become
+	// ready when set, as the tests do to run past the timeouts at once
+	poll func(interval, timeout time.Duration, condition wait.ConditionFunc) error
 }
 
 // New initializes a new handler instance
@@ -41,7 +86,23 @@ func New(config meshkitCfg.Handler, log logger.Handler, kc meshkitCfg.Handler) a
 			Log:               log,
 			KubeconfigHandler: kc,
 		},
+		statusCache:     &statusCache{},
+		sampleManifests: &sampleManifestCache{},
+		sampleWaits:     &sampleWaitRegistry{},
+		clients:         newClientCache(),
+	}
+}
+
+// kubeClient returns the typed client of the cluster the handler acts on,
+// or nil if there is none
+func (h *Handler) kubeClient() kubernetes.Interface {
+	if h.typedClient != nil {
+		return h.typedClient
+	}
+	if h.KubeClient == nil {
+		return nil
 	}
+	return h.KubeClient
 }
 
 // ApplyOperation function contains the operation handlers
@@ -58,22 +119,133 @@ func (h *Handler) ApplyOperation(ctx context.Context, request adapter.OperationR
 		Details:     "Operation is not supported",
 	}
 
+	var target struct {
+		clusterTarget   `yaml:",inline"`
+		helmRepoOptions `yaml:",inline"`
+	}
+	if err := parseCustomBody(request.CustomBody, &target); err != nil {
+		h.StreamErr(e, err)
+		return nil
+	}
+	if target.Context != "" {
+		c, err := h.forContext(target.Context)
+		if err != nil {
+			h.StreamErr(e, err)
+			return nil
+		}
+		h = c
+	}
+	if target.helmRepoOptions.set() {
+		c, err := h.withHelmRepo(target.helmRepoOptions)
+		if err != nil {
+			h.StreamErr(e, err)
+			return nil
+		}
+		h = c
+	}
+
 	//deployment
 	switch request.OperationName {
 	case internalconfig.CiliumOperation:
-		go func(hh *Handler, ee *adapter.Event) {
-			version := string(operations[request.OperationName].Versions[len(operations[request.OperationName].Versions)-1])
-			stat, err := hh.installCilium(request.IsDeleteOperation, version, request.Namespace)
-			if err != nil {
-				e.Summary = fmt.Sprintf("Error while %s Cilium service mesh", stat)
-				e.Details = err.Error()
-				hh.StreamErr(e, err)
-				return
-			}
-			ee.Summary = fmt.Sprintf("Cilium service mesh %s successfully", stat)
-			ee.Details = fmt.Sprintf("Cilium service mesh is now %s.", stat)
-			hh.StreamInfo(e)
-		}(h, e)
+		versions := operations[request.OperationName].Versions
+		if len(versions) == 0 {
+			h.StreamErr(e, ErrNoVersions)
+			return nil
+		}
+		installReq, err := parseInstallRequest(request.CustomBody)
+		if err != nil {
+			h.StreamErr(e, err)
+			return nil
+		}
+		go h.install(versions, installReq, request.IsDeleteOperation, e)
+	case internalconfig.CiliumVersionsOperation:
+		go h.listVersions(request.CustomBody, e)
+	case internalconfig.CiliumUninstallOperation:
+		versions := operations[request.OperationName].Versions
+		if len(versions) == 0 {
+			h.StreamErr(e, ErrNoVersions)
+			return nil
+		}
+		go h.uninstall(string(versions[0]), request.CustomBody, e)
+	case internalconfig.CiliumUpgradeOperation:
+		versions := operations[request.OperationName].Versions
+		if len(versions) == 0 {
+			h.StreamErr(e, ErrNoVersions)
+			return nil
+		}
+		go h.upgrade(string(versions[0]), request.CustomBody, e)
+	case internalconfig.CiliumImagesOperation:
+		versions := operations[request.OperationName].Versions
+		if len(versions) == 0 {
+			h.StreamErr(e, ErrNoVersions)
+			return nil
+		}
+		go h.listImages(string(versions[0]), request.CustomBody, e)
+	case internalconfig.CiliumEncryptionOperation:
+		go h.encryption(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumRotateIPsecKeyOperation:
+		go h.rotateIPsecKey(request.CustomBody, e)
+	case internalconfig.CiliumHubbleOperation:
+		go h.hubble(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumHubbleRelayOperation:
+		go h.relay(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumHubbleUIOperation:
+		go h.ui(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumClusterMeshOperation:
+		go h.clusterMesh(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumBGPOperation:
+		go h.bgp(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumEgressGatewayOperation:
+		go h.egressGateway(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumBandwidthManagerOperation:
+		go h.bandwidthManager(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumHostFirewallOperation:
+		go h.hostFirewall(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumL2AnnouncementsOperation:
+		go h.l2Announcements(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumLBIPAMOperation:
+		go h.lbIPAM(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumTetragonOperation:
+		go h.tetragon(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumPreflightOperation:
+		versions := operations[request.OperationName].Versions
+		if len(versions) == 0 {
+			h.StreamErr(e, ErrNoVersions)
+			return nil
+		}
+		go h.preflight(string(versions[0]), request.CustomBody, e)
+	case internalconfig.CiliumConnectivityTestOperation:
+		go h.connectivityTest(request.CustomBody, e)
+	case internalconfig.CiliumStatusOperation:
+		go h.ciliumStatus(request.CustomBody, e)
+	case internalconfig.CiliumDetectOperation:
+		go h.detect(e)
+	case internalconfig.CiliumNodeCleanupOperation:
+		go h.nodeCleanup(request.CustomBody, e)
+	case internalconfig.CiliumIngressControllerOperation:
+		go h.ingressController(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumMutualAuthOperation:
+		go h.mutualAuth(request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumStarWarsOperation:
+		go h.starWarsApp(request.Namespace, request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumStarWarsPolicyOperation:
+		go h.starWarsPolicy(request.Namespace, request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumFQDNPolicyOperation:
+		go h.fqdnPolicyDemo(request.Namespace, request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumExportPoliciesOperation:
+		go h.exportPolicies(request.CustomBody, e)
+	case internalconfig.CiliumValidatePoliciesOperation:
+		go h.validatePolicies(request.CustomBody, e)
+	case internalconfig.CiliumSMIPoliciesOperation:
+		go h.smiPolicies(request.Namespace, request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumConvertNetworkPoliciesOperation:
+		go h.convertNetworkPolicies(request.Namespace, request.CustomBody, request.IsDeleteOperation, e)
+	case internalconfig.CiliumListEndpointsOperation:
+		go h.endpointList(request.CustomBody, e)
+	case internalconfig.CiliumNodeIPAMOperation:
+		go h.nodeIPAMInventory(request.CustomBody, e)
+	case internalconfig.CiliumIdentitiesOperation:
+		go h.identityLookup(request.CustomBody, e)
 	case
 		common.BookInfoOperation,
 		common.HTTPBinOperation,
@@ -81,15 +253,21 @@ func (h *Handler) ApplyOperation(ctx context.Context, request adapter.OperationR
 		common.EmojiVotoOperation:
 		go func(hh *Handler, ee *adapter.Event) {
 			appName := operations[request.OperationName].AdditionalProperties[common.ServiceName]
-			stat, err := hh.installSampleApp(request.IsDeleteOperation, request.Namespace, operations[request.OperationName].Templates)
+			stat, results, err := hh.installSampleApp(request.IsDeleteOperation, request.Namespace, request.OperationName, request.CustomBody, operations[request.OperationName].Templates)
 			if err != nil {
 				e.Summary = fmt.Sprintf("Error while %s %s application", stat, appName)
 				e.Details = err.Error()
+				if len(results) > 0 {
+					e.Details = fmt.Sprintf("%s\n%s", e.Details, strings.Join(results, "\n"))
+				}
 				hh.StreamErr(e, err)
 				return
 			}
 			ee.Summary = fmt.Sprintf("%s application %s successfully", appName, stat)
 			ee.Details = fmt.Sprintf("The %s application is now %s.", appName, stat)
+			if len(results) > 0 {
+				ee.Details = fmt.Sprintf("%s\n%s", ee.Details, strings.Join(results, "\n"))
+			}
 			hh.StreamInfo(e)
 		}(h, e)
 	case common.SmiConformanceOperation:
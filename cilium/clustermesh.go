@@ -0,0 +1,467 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// clusterMeshAPIServer is the Deployment and the service of the cluster
+	// mesh api server
+	clusterMeshAPIServer = "clustermesh-apiserver"
+
+	// caSecret is the CA the certificates of cilium are issued by, which
+	// the clusters of a mesh share
+	caSecret = "cilium-ca"
+
+	// maxClusterID is the highest cluster id of a mesh
+	maxClusterID = 255
+
+	// maxClusterName is the longest cluster name cilium accepts
+	maxClusterName = 32
+)
+
+// clusterMeshSince is the first version whose chart configures the peers
+// of the cluster mesh
+var clusterMeshSince = semver.MustParse("1.14.0")
+
+// invalidClusterNameChars are the characters replaced when deriving a
+// cluster name from a context name
+var invalidClusterNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// clusterMeshMember is a cluster of the mesh, read from the custom body of
+// the cluster mesh operation
+type clusterMeshMember struct {
+	// Context is the kubeconfig context of the cluster
+	Context string `yaml:"context"`
+
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Name and ID identify the cluster in the mesh. The ones the release
+	// was installed with are kept by default, or else derived from the
+	// context and assigned.
+	Name string `yaml:"name"`
+	ID   int    `yaml:"id"`
+}
+
+// clusterMeshRequest holds the parameters of the cluster mesh operation,
+// read from the custom body of the request
+type clusterMeshRequest struct {
+	// Clusters are the two clusters to connect
+	Clusters []clusterMeshMember `yaml:"clusters"`
+
+	// ServiceType exposes the api servers to the other cluster, either
+	// LoadBalancer, the default, or NodePort
+	ServiceType string `yaml:"serviceType"`
+
+	// Timeout bounds every wait of the operation, like 10m
+	Timeout string `yaml:"timeout"`
+}
+
+// meshCluster is a cluster of the mesh, as found in its kubeconfig context
+type meshCluster struct {
+	clusterMeshMember
+	h         *Handler
+	namespace string
+	version   string
+	values    map[string]interface{}
+
+	// address and port reach the api server from the other cluster, with
+	// address being either an IP or a host name
+	address string
+	port    int32
+}
+
+// clusterName derives a cluster name from a kubeconfig context name
+func clusterName(context string) string {
+	name := invalidClusterNameChars.ReplaceAllString(strings.ToLower(context), "-")
+	if len(name) > maxClusterName {
+		name = name[:maxClusterName]
+	}
+	name = strings.Trim(name, "-")
+	if name == "" {
+		return "cluster"
+	}
+	return name
+}
+
+// intValue converts a number of the helm values, decoded from JSON or
+// YAML, into an int
+func intValue(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// assignIdentities completes the names and ids of the clusters: the
+// requested ones, else the ones they were installed with, else new ones.
+// The names and ids of the clusters must be unique.
+func assignIdentities(clusters []*meshCluster) error {
+	used := make(map[int]bool)
+	for _, c := range clusters {
+		current, _ := c.values["cluster"].(map[string]interface{})
+		if c.Name == "" {
+			if name, _ := current["name"].(string); name != "" && name != "default" {
+				c.Name = name
+			} else {
+				c.Name = clusterName(c.Context)
+			}
+		}
+		if c.ID == 0 {
+			c.ID = intValue(current["id"])
+		}
+		if c.ID < 0 || c.ID > maxClusterID {
+			return fmt.Errorf("the id %d of cluster %s is not between 1 and %d", c.ID, c.Name, maxClusterID)
+		}
+		if c.ID != 0 && used[c.ID] {
+			c.ID = 0
+		}
+		used[c.ID] = true
+	}
+	for _, c := range clusters {
+		for id := 1; c.ID == 0 && id <= maxClusterID; id++ {
+			if !used[id] {
+				c.ID = id
+				used[id] = true
+			}
+		}
+	}
+
+	if clusters[0].Name == clusters[1].Name {
+		return fmt.Errorf("both clusters are named %s, set distinct names", clusters[0].Name)
+	}
+	for _, c := range clusters {
+		if len(c.Name) > maxClusterName || invalidClusterNameChars.MatchString(c.Name) {
+			return fmt.Errorf("the cluster name %q is not made of at most %d lower case letters, digits and dashes", c.Name, maxClusterName)
+		}
+	}
+	return nil
+}
+
+// shareCA copies the CA of the cluster from to the cluster to, so that the
+// certificates of both clusters are issued by the same CA
+func shareCA(ctx context.Context, from, to *meshCluster) error {
+	ca, err := from.h.KubeClient.CoreV1().Secrets(from.namespace).Get(ctx, caSecret, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("the CA of cluster %s cannot be shared, the chart must generate it as the %s secret: %w", from.Name, caSecret, err)
+	}
+
+	secrets := to.h.KubeClient.CoreV1().Secrets(to.namespace)
+	existing, err := secrets.Get(ctx, caSecret, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: caSecret, Namespace: to.namespace, Labels: ca.Labels, Annotations: ca.Annotations},
+			Type:       ca.Type,
+			Data:       ca.Data,
+		}, metav1.CreateOptions{})
+		return err
+	case err != nil:
+		return err
+	}
+	existing.Data = ca.Data
+	_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// apiServerAddress waits for the api server service of c to be reachable
+// from outside the cluster and records its address
+func (c *meshCluster) apiServerAddress(ctx context.Context, timeout time.Duration) error {
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		svc, err := c.h.KubeClient.CoreV1().Services(c.namespace).Get(ctx, clusterMeshAPIServer, metav1.GetOptions{})
+		if err != nil || len(svc.Spec.Ports) == 0 {
+			return false, nil
+		}
+		switch svc.Spec.Type {
+		case corev1.ServiceTypeLoadBalancer:
+			for _, ingress := range svc.Status.LoadBalancer.Ingress {
+				if ingress.IP != "" || ingress.Hostname != "" {
+					c.address = ingress.IP + ingress.Hostname
+					c.port = svc.Spec.Ports[0].Port
+					return true, nil
+				}
+			}
+			return false, nil
+		case corev1.ServiceTypeNodePort:
+			nodes, err := c.h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return false, nil
+			}
+			for _, node := range nodes.Items {
+				for _, addr := range node.Status.Addresses {
+					if addr.Type == corev1.NodeInternalIP {
+						c.address = addr.Address
+						c.port = svc.Spec.Ports[0].NodePort
+						return true, nil
+					}
+				}
+			}
+			return false, nil
+		}
+		return false, fmt.Errorf("the %s service is of type %s, which the other cluster cannot reach", clusterMeshAPIServer, svc.Spec.Type)
+	})
+}
+
+// peers returns the peers of the cluster mesh configuration in values,
+// without the one named without
+func peers(values map[string]interface{}, without string) []interface{} {
+	clustermesh, _ := values["clustermesh"].(map[string]interface{})
+	cfg, _ := clustermesh["config"].(map[string]interface{})
+	clusters, _ := cfg["clusters"].([]interface{})
+
+	kept := make([]interface{}, 0, len(clusters)+1)
+	for _, peer := range clusters {
+		if m, ok := peer.(map[string]interface{}); ok && m["name"] == without {
+			continue
+		}
+		kept = append(kept, peer)
+	}
+	return kept
+}
+
+// peerValue describes the cluster c as a peer in the cluster mesh
+// configuration of the chart
+func peerValue(c *meshCluster) map[string]interface{} {
+	peer := map[string]interface{}{"name": c.Name, "port": int(c.port)}
+	if net.ParseIP(c.address) != nil {
+		peer["ips"] = []interface{}{c.address}
+	} else {
+		peer["address"] = c.address
+	}
+	return peer
+}
+
+// clusterMeshReady reports whether an agent reports every remote cluster
+// of its mesh ready, like "1/1 remote clusters ready"
+func clusterMeshReady(state string) bool {
+	var ready, total int
+	if _, err := fmt.Sscanf(state, "%d/%d", &ready, &total); err != nil {
+		return false
+	}
+	return total > 0 && ready == total
+}
+
+// clusterMesh connects, or disconnects if del is set, two clusters with
+// cilium cluster mesh. Every step acts on the current state of the
+// clusters, so that the operation can be run again after a partial failure.
+func (h *Handler) clusterMesh(customBody string, del bool, e *adapter.Event) {
+	var done []string
+	fail := func(c *meshCluster, step string, err error) {
+		name := ""
+		if c != nil {
+			name = c.Context
+		}
+		err = ErrClusterMesh(name, step, err)
+		e.Summary = "Error while configuring Cilium cluster mesh"
+		e.Details = err.Error()
+		if len(done) > 0 {
+			e.Details = fmt.Sprintf("%s\nCompleted before the failure, kept when running the operation again:\n%s", e.Details, strings.Join(done, "\n"))
+		}
+		h.StreamErr(e, err)
+	}
+
+	var req clusterMeshRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(nil, "parse the request", err)
+		return
+	}
+	if len(req.Clusters) != 2 || req.Clusters[0].Context == "" || req.Clusters[1].Context == "" || req.Clusters[0].Context == req.Clusters[1].Context {
+		fail(nil, "parse the request", ErrInvalidClusterMesh(fmt.Errorf("two clusters of distinct contexts are required")))
+		return
+	}
+	serviceType := corev1.ServiceTypeLoadBalancer
+	switch corev1.ServiceType(req.ServiceType) {
+	case "", corev1.ServiceTypeLoadBalancer:
+	case corev1.ServiceTypeNodePort:
+		serviceType = corev1.ServiceTypeNodePort
+	default:
+		fail(nil, "parse the request", ErrInvalidClusterMesh(fmt.Errorf("unknown service type %q, expected LoadBalancer or NodePort", req.ServiceType)))
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(nil, "parse the request", err)
+		return
+	}
+
+	ctx := context.Background()
+	clusters := make([]*meshCluster, 0, len(req.Clusters))
+	for _, member := range req.Clusters {
+		c := &meshCluster{clusterMeshMember: member}
+		if err := validateNamespace(member.Namespace); err != nil {
+			fail(c, "connect to the cluster", err)
+			return
+		}
+		if c.h, err = h.forContext(member.Context); err != nil {
+			fail(c, "connect to the cluster", err)
+			return
+		}
+		c.namespace = c.h.ciliumNamespace(member.Namespace)
+		if !c.h.releaseExists(c.namespace) {
+			fail(c, "find cilium", ErrCiliumNotInstalled(c.namespace))
+			return
+		}
+		if c.version, c.values, err = c.h.releaseValues(c.namespace); err != nil {
+			fail(c, "find cilium", err)
+			return
+		}
+		if v, err := config.ParseVersion(c.version); err != nil || v.LessThan(clusterMeshSince) {
+			fail(c, "find cilium", ErrInvalidClusterMesh(fmt.Errorf("cilium %s is installed, the adapter configures cluster mesh from %s", c.version, clusterMeshSince)))
+			return
+		}
+		clusters = append(clusters, c)
+	}
+
+	if del {
+		h.disconnectClusters(e, clusters, timeout, fail, &done)
+		return
+	}
+
+	if err := assignIdentities(clusters); err != nil {
+		fail(nil, "assign the cluster identities", ErrInvalidClusterMesh(err))
+		return
+	}
+
+	h.streamProgress(e, "Sharing the CA of the clusters", fmt.Sprintf("Copying the CA of cluster %s to cluster %s", clusters[0].Name, clusters[1].Name))
+	if err := shareCA(ctx, clusters[0], clusters[1]); err != nil {
+		fail(clusters[1], "share the CA", err)
+		return
+	}
+	done = append(done, fmt.Sprintf("%s: uses the CA of %s", clusters[1].Context, clusters[0].Context))
+
+	for _, c := range clusters {
+		c := c
+		h.streamProgress(e, "Enabling the cluster mesh api server", fmt.Sprintf("Cluster %s (id %d) of context %s", c.Name, c.ID, c.Context))
+		_, _, err := c.h.reconfigure(e, c.namespace, timeout, func(string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"cluster": map[string]interface{}{"name": c.Name, "id": c.ID},
+				"clustermesh": map[string]interface{}{
+					"useAPIServer": true,
+					"apiserver": map[string]interface{}{
+						"service": map[string]interface{}{"type": string(serviceType)},
+						"tls": map[string]interface{}{
+							"auto": map[string]interface{}{"enabled": true, "method": relayTLSHelm},
+						},
+					},
+				},
+			}, nil
+		})
+		if err == nil {
+			err = c.h.waitForDeployment(c.namespace, clusterMeshAPIServer, timeout)
+		}
+		if err == nil {
+			err = c.apiServerAddress(ctx, timeout)
+		}
+		if err != nil {
+			fail(c, "enable the cluster mesh api server", err)
+			return
+		}
+		done = append(done, fmt.Sprintf("%s: cluster %s (id %d) serves its api server at %s:%d", c.Context, c.Name, c.ID, c.address, c.port))
+	}
+
+	for i, c := range clusters {
+		peer := clusters[1-i]
+		h.streamProgress(e, "Peering the clusters", fmt.Sprintf("Cluster %s connects to cluster %s", c.Name, peer.Name))
+		_, _, err := c.h.reconfigure(e, c.namespace, timeout, func(string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"clustermesh": map[string]interface{}{
+					"config": map[string]interface{}{
+						"enabled":  true,
+						"clusters": append(peers(c.values, peer.Name), peerValue(peer)),
+					},
+				},
+			}, nil
+		})
+		if err != nil {
+			fail(c, "peer with "+peer.Context, err)
+			return
+		}
+		done = append(done, fmt.Sprintf("%s: peers with %s", c.Context, peer.Context))
+	}
+
+	var details []string
+	for _, c := range clusters {
+		states, err := c.h.waitForAgentStates(e, c.namespace, "ClusterMesh", timeout, clusterMeshReady)
+		if len(states) > 0 {
+			details = append(details, agentStateDetails(fmt.Sprintf("Cluster mesh of %s per node", c.Context), states))
+		}
+		if err != nil {
+			done = append(done, details...)
+			fail(c, "verify the connectivity", fmt.Errorf("not every agent reaches the other cluster: %w", err))
+			return
+		}
+	}
+
+	e.Summary = "Cilium cluster mesh connected successfully"
+	e.Details = fmt.Sprintf("%s\n%s", strings.Join(done, "\n"), strings.Join(details, "\n"))
+	h.StreamInfo(e)
+}
+
+// disconnectClusters removes each cluster from the peers of the other, and
+// disables the api server of the clusters left without peers
+func (h *Handler) disconnectClusters(e *adapter.Event, clusters []*meshCluster, timeout time.Duration, fail func(*meshCluster, string, error), done *[]string) {
+	names := make([]string, len(clusters))
+	for i, c := range clusters {
+		current, _ := c.values["cluster"].(map[string]interface{})
+		names[i], _ = current["name"].(string)
+		if c.Name != "" {
+			names[i] = c.Name
+		}
+	}
+
+	for i, c := range clusters {
+		kept := peers(c.values, names[1-i])
+		h.streamProgress(e, "Disconnecting the clusters", fmt.Sprintf("Cluster %s no longer connects to cluster %s", names[i], names[1-i]))
+		_, _, err := c.h.reconfigure(e, c.namespace, timeout, func(string) (map[string]interface{}, error) {
+			clustermesh := map[string]interface{}{
+				"config": map[string]interface{}{"enabled": len(kept) > 0, "clusters": kept},
+			}
+			if len(kept) == 0 {
+				clustermesh["useAPIServer"] = false
+			}
+			return map[string]interface{}{"clustermesh": clustermesh}, nil
+		})
+		if err != nil {
+			fail(c, "disconnect from "+clusters[1-i].Context, err)
+			return
+		}
+		*done = append(*done, fmt.Sprintf("%s: no longer peers with %s", c.Context, clusters[1-i].Context))
+	}
+
+	e.Summary = "Cilium cluster mesh disconnected successfully"
+	e.Details = strings.Join(*done, "\n")
+	h.StreamInfo(e)
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	mesherykube "github.com/layer5io/meshkit/utils/kubernetes"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// maxClusterClients is the number of clusters whose clients are kept
+const maxClusterClients = 8
+
+// clusterTarget selects the cluster an operation acts on. It is part of
+// the custom body of every request.
+type clusterTarget struct {
+	// Context is the kubeconfig context of the cluster, the current
+	// context by default
+	Context string `yaml:"context"`
+}
+
+// clusterClients are the clients of a cluster
+type clusterClients struct {
+	kubeClient    *kubernetes.Clientset
+	dynamicClient dynamic.Interface
+	restConfig    *rest.Config
+	mesheryClient *mesherykube.Client
+}
+
+// clientCache keeps the clients of the clusters used last, so that the
+// operations do not build them again every time. It is shared by the
+// handlers of every cluster.
+type clientCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// clientEntry is an element of the order of a clientCache
+type clientEntry struct {
+	key     string
+	clients *clusterClients
+}
+
+func newClientCache() *clientCache {
+	return &clientCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the clients of key, marking them as used last
+func (c *clientCache) get(key string) *clusterClients {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*clientEntry).clients
+}
+
+// put records the clients of key, evicting those used least recently
+// beyond maxClusterClients
+func (c *clientCache) put(key string, clients *clusterClients) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*clientEntry).clients = clients
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&clientEntry{key: key, clients: clients})
+	for c.order.Len() > maxClusterClients {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*clientEntry).key)
+	}
+}
+
+// forContext returns a handler acting on the cluster of the kubeconfig
+// context. The kubeconfig uploaded to the adapter holds every context of
+// the user, only the current one of which the handler itself acts on. The
+// clients are cached by the content of the context, so that an updated
+// kubeconfig builds new ones.
+func (h *Handler) forContext(name string) (*Handler, error) {
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: name},
+	).RawConfig()
+	if err != nil {
+		return nil, ErrClusterClient(name, err)
+	}
+	if _, ok := raw.Contexts[name]; !ok {
+		return nil, ErrClusterClient(name, fmt.Errorf("the kubeconfig has no context %q", name))
+	}
+	raw.CurrentContext = name
+	if err := clientcmdapi.MinifyConfig(&raw); err != nil {
+		return nil, ErrClusterClient(name, err)
+	}
+	if err := clientcmdapi.FlattenConfig(&raw); err != nil {
+		return nil, ErrClusterClient(name, err)
+	}
+	kubeconfig, err := clientcmd.Write(raw)
+	if err != nil {
+		return nil, ErrClusterClient(name, err)
+	}
+	sum := sha256.Sum256(kubeconfig)
+	key := hex.EncodeToString(sum[:])
+
+	clients := h.clients.get(key)
+	if clients == nil {
+		if clients, err = newClusterClients(kubeconfig); err != nil {
+			return nil, ErrClusterClient(name, err)
+		}
+		h.clients.put(key, clients)
+	}
+
+	c := &Handler{Adapter: h.Adapter, cluster: name, helmRepo: h.helmRepo, chartDigest: h.chartDigest, statusCache: h.statusCache, sampleManifests: h.sampleManifests, sampleWaits: h.sampleWaits, clients: h.clients}
+	c.KubeClient = clients.kubeClient
+	c.DynamicKubeClient = clients.dynamicClient
+	c.RestConfig = *clients.restConfig
+	c.MesheryKubeclient = clients.mesheryClient
+	return c, nil
+}
+
+// newClusterClients builds the clients of the current context of
+// kubeconfig
+func newClusterClients(kubeconfig []byte) (*clusterClients, error) {
+	mesheryClient, err := mesherykube.New(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	restConfig := mesheryClient.RestConfig
+	kubeClient, err := kubernetes.NewForConfig(&restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterClients{
+		kubeClient:    kubeClient,
+		dynamicClient: mesheryClient.DynamicKubeClient,
+		restConfig:    &restConfig,
+		mesheryClient: mesheryClient,
+	}, nil
+}
+
+// StreamInfo streams an event of an operation, naming the context it
+// acted on unless it is the current one. Only the summary names it, the
+// details of some events being JSON.
+func (h *Handler) StreamInfo(e *adapter.Event) {
+	e.Summary = h.inContext(e.Summary)
+	h.Adapter.StreamInfo(e)
+}
+
+// StreamErr streams the error of an operation, naming the context it
+// acted on unless it is the current one
+func (h *Handler) StreamErr(e *adapter.Event, err error) {
+	e.Summary = h.inContext(e.Summary)
+	e.Details = h.inContext(e.Details)
+	// The phase in progress is the one which failed
+	e.Details = h.progress.annotate(e.Details)
+	h.Adapter.StreamErr(e, err)
+}
+
+// inContext prefixes s with the context the handler acts on, unless it is
+// the current one or s already names it
+func (h *Handler) inContext(s string) string {
+	if h.cluster == "" {
+		return s
+	}
+	prefix := fmt.Sprintf("context %s: ", h.cluster)
+	if strings.HasPrefix(s, prefix) {
+		return s
+	}
+	return prefix + s
+}
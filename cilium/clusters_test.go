@@ -0,0 +1,160 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+func TestClientCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newClientCache()
+	clients := make([]*clusterClients, maxClusterClients+1)
+	for i := 0; i < maxClusterClients; i++ {
+		clients[i] = &clusterClients{}
+		c.put(fmt.Sprint(i), clients[i])
+	}
+
+	// Using the oldest entry makes the second one the least recently used
+	if got := c.get("0"); got != clients[0] {
+		t.Fatalf("get(0) = %p, want %p", got, clients[0])
+	}
+	clients[maxClusterClients] = &clusterClients{}
+	c.put(fmt.Sprint(maxClusterClients), clients[maxClusterClients])
+
+	if got := c.get("1"); got != nil {
+		t.Errorf("get(1) = %p after exceeding the capacity, want it evicted", got)
+	}
+	for _, i := range []int{0, 2, maxClusterClients} {
+		if got := c.get(fmt.Sprint(i)); got != clients[i] {
+			t.Errorf("get(%d) = %p, want %p", i, got, clients[i])
+		}
+	}
+	if c.order.Len() != maxClusterClients || len(c.entries) != maxClusterClients {
+		t.Errorf("cache holds %d entries in order and %d by key, want %d", c.order.Len(), len(c.entries), maxClusterClients)
+	}
+}
+
+func TestClientCachePutReplaces(t *testing.T) {
+	c := newClientCache()
+	first, second := &clusterClients{}, &clusterClients{}
+	c.put("a", first)
+	c.put("a", second)
+	if got := c.get("a"); got != second {
+		t.Errorf("get(a) = %p, want the replacing clients %p", got, second)
+	}
+	if c.order.Len() != 1 {
+		t.Errorf("cache holds %d entries, want 1", c.order.Len())
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: east
+  cluster:
+    server: https://east.example.com:6443
+- name: west
+  cluster:
+    server: https://west.example.com:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: east
+  context:
+    cluster: east
+    user: admin
+- name: west
+  context:
+    cluster: west
+    user: admin
+current-context: east
+`
+
+func TestForContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", path)
+	h, _ := newTestHandler(t)
+	h.clients = newClientCache()
+
+	west, err := h.forContext("west")
+	if err != nil {
+		t.Fatalf("forContext(west): %v", err)
+	}
+	if west.cluster != "west" || west.RestConfig.Host != "https://west.example.com:6443" {
+		t.Errorf("handler acts on %s at %s, want west at https://west.example.com:6443", west.cluster, west.RestConfig.Host)
+	}
+	again, err := h.forContext("west")
+	if err != nil {
+		t.Fatalf("forContext(west): %v", err)
+	}
+	if again.KubeClient != west.KubeClient || again.DynamicKubeClient != west.DynamicKubeClient {
+		t.Error("the cached clients of west were built again")
+	}
+
+	east, err := h.forContext("east")
+	if err != nil {
+		t.Fatalf("forContext(east): %v", err)
+	}
+	if east.KubeClient == west.KubeClient {
+		t.Error("east shares the clients of west")
+	}
+
+	if _, err := h.forContext("north"); errorCode(err) != ErrClusterClientCode {
+		t.Errorf("forContext(north) error = %v, want %s", err, ErrClusterClientCode)
+	}
+}
+
+func TestForContextEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", path)
+	h, events := newTestHandler(t)
+	h.clients = newClientCache()
+	west, err := h.forContext("west")
+	if err != nil {
+		t.Fatalf("forContext(west): %v", err)
+	}
+
+	west.StreamInfo(&adapter.Event{Summary: "Cilium installed successfully", Details: "{}"})
+	if e := (<-events).(*adapter.Event); e.Summary != "context west: Cilium installed successfully" || e.Details != "{}" {
+		t.Errorf("info event %q: %q, want the summary naming west and the details untouched", e.Summary, e.Details)
+	}
+
+	e := &adapter.Event{Summary: "Error while installing Cilium", Details: "timed out"}
+	west.StreamErr(e, ErrNilClient)
+	west.StreamErr(e, ErrNilClient)
+	<-events
+	<-events
+	if e.Summary != "context west: Error while installing Cilium" || e.Details != "context west: timed out" {
+		t.Errorf("error event %q: %q, want the summary and details naming west once", e.Summary, e.Details)
+	}
+
+	h.StreamInfo(&adapter.Event{Summary: "Cilium installed successfully"})
+	if e := (<-events).(*adapter.Event); e.Summary != "Cilium installed successfully" {
+		t.Errorf("info event of the current context %q, want no context", e.Summary)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// resourceComponents are the paths of the resources values of the
+// components, keyed by the name used in the requests. Hubble UI runs a
+// backend and a frontend container which both get the resources.
+var resourceComponents = map[string][][]string{
+	"agent":        {{"resources"}},
+	"operator":     {{"operator", "resources"}},
+	"hubble-relay": {{"hubble", "relay", "resources"}},
+	"hubble-ui":    {{"hubble", "ui", "backend", "resources"}, {"hubble", "ui", "frontend", "resources"}},
+}
+
+// recommendedResources are set with recommendedResources. The agents get
+// enough memory for the BPF maps of a few thousand endpoints, and nothing
+// gets a CPU limit, whose throttling delays the datapath.
+var recommendedResources = map[string]componentResources{
+	"agent": {
+		Requests: map[string]string{"cpu": "100m", "memory": "512Mi"},
+		Limits:   map[string]string{"memory": "2Gi"},
+	},
+	"operator": {
+		Requests: map[string]string{"cpu": "50m", "memory": "128Mi"},
+		Limits:   map[string]string{"memory": "512Mi"},
+	},
+	"hubble-relay": {
+		Requests: map[string]string{"cpu": "50m", "memory": "64Mi"},
+		Limits:   map[string]string{"memory": "256Mi"},
+	},
+	"hubble-ui": {
+		Requests: map[string]string{"cpu": "50m", "memory": "64Mi"},
+		Limits:   map[string]string{"memory": "256Mi"},
+	},
+}
+
+// resourceOptions set the resource requests and limits of the cilium
+// components, which the chart leaves unset. They are part of the custom
+// body of the install and upgrade requests.
+type resourceOptions struct {
+	// Resources are keyed by component: agent, operator, hubble-relay or
+	// hubble-ui
+	Resources map[string]componentResources `yaml:"resources"`
+
+	// RecommendedResources sets recommendedResources for the components
+	// missing from Resources, and for the quantities they leave unset
+	RecommendedResources bool `yaml:"recommendedResources"`
+}
+
+// componentResources are the requests and limits of a component, cpu and
+// memory quantities like 100m or 512Mi
+type componentResources struct {
+	Requests map[string]string `yaml:"requests"`
+	Limits   map[string]string `yaml:"limits"`
+}
+
+// set reports whether the options change the resources of a component
+func (o resourceOptions) set() bool {
+	return len(o.Resources) > 0 || o.RecommendedResources
+}
+
+// values translates the options into chart values, the quantities being
+// validated so that a typo fails before anything is applied
+func (o resourceOptions) values() (map[string]interface{}, error) {
+	for name := range o.Resources {
+		if _, ok := resourceComponents[name]; !ok {
+			return nil, ErrInvalidResources(fmt.Errorf("unknown component %q, expected one of %s", name, strings.Join(resourceComponentNames(), ", ")))
+		}
+	}
+
+	values := make(map[string]interface{})
+	for name, paths := range resourceComponents {
+		res := o.Resources[name]
+		if o.RecommendedResources {
+			res = recommendedResources[name].merge(res)
+		}
+		value, err := res.value()
+		if err != nil {
+			return nil, ErrInvalidResources(fmt.Errorf("%s: %w", name, err))
+		}
+		if value == nil {
+			continue
+		}
+		for _, path := range paths {
+			setValue(values, path, value)
+		}
+	}
+	return values, nil
+}
+
+// merge returns r with the quantities set by overrides replaced
+func (r componentResources) merge(overrides componentResources) componentResources {
+	merged := componentResources{Requests: make(map[string]string), Limits: make(map[string]string)}
+	for _, m := range []struct{ base, overrides, into map[string]string }{
+		{r.Requests, overrides.Requests, merged.Requests},
+		{r.Limits, overrides.Limits, merged.Limits},
+	} {
+		for k, v := range m.base {
+			m.into[k] = v
+		}
+		for k, v := range m.overrides {
+			m.into[k] = v
+		}
+	}
+	return merged
+}
+
+// value validates the quantities and returns the resources value of the
+// chart, nil if none is set
+func (r componentResources) value() (map[string]interface{}, error) {
+	requests, err := parseQuantities("requests", r.Requests)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := parseQuantities("limits", r.Limits)
+	if err != nil {
+		return nil, err
+	}
+	for name, limit := range limits {
+		if request, ok := requests[name]; ok && request.Cmp(limit) > 0 {
+			return nil, fmt.Errorf("the %s request %s is above its limit %s", name, request.String(), limit.String())
+		}
+	}
+
+	value := make(map[string]interface{})
+	if len(r.Requests) > 0 {
+		value["requests"] = quantityValues(r.Requests)
+	}
+	if len(r.Limits) > 0 {
+		value["limits"] = quantityValues(r.Limits)
+	}
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// parseQuantities parses the cpu and memory quantities of field
+func parseQuantities(field string, quantities map[string]string) (map[string]resource.Quantity, error) {
+	parsed := make(map[string]resource.Quantity, len(quantities))
+	for name, quantity := range quantities {
+		if name != string(corev1.ResourceCPU) && name != string(corev1.ResourceMemory) {
+			return nil, fmt.Errorf("unknown resource %q in %s, expected cpu or memory", name, field)
+		}
+		q, err := resource.ParseQuantity(quantity)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %q: %w", field, name, quantity, err)
+		}
+		if q.Sign() <= 0 {
+			return nil, fmt.Errorf("%s %s %q is not positive", field, name, quantity)
+		}
+		parsed[name] = q
+	}
+	return parsed, nil
+}
+
+// quantityValues converts quantities into chart values
+func quantityValues(quantities map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(quantities))
+	for name, quantity := range quantities {
+		values[name] = quantity
+	}
+	return values
+}
+
+func resourceComponentNames() []string {
+	names := make([]string, 0, len(resourceComponents))
+	for name := range resourceComponents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
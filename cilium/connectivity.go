@@ -0,0 +1,433 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// defaultTestNamespace is where the connectivity test runs, it is
+	// created for the test and removed afterwards
+	defaultTestNamespace = "cilium-test"
+
+	// defaultConnectivityTimeout bounds the whole connectivity test
+	defaultConnectivityTimeout = 5 * time.Minute
+
+	// defaultClientImage and defaultEchoImage are the images of the
+	// client and echo pods, the ones of cilium connectivity test
+	defaultClientImage = "quay.io/cilium/alpine-curl:v1.9.0"
+	defaultEchoImage   = "quay.io/cilium/json-mock:v1.3.8"
+
+	// echoPort is the port the echo pods serve HTTP on
+	echoPort = 8080
+
+	// worldURL is reached by the pod-to-world check
+	worldURL = "https://one.one.one.one/"
+
+	// policyTimeout bounds the wait for a policy to be enforced
+	policyTimeout = 30 * time.Second
+
+	// managedByLabel set to managedByMeshery marks the test namespaces
+	// created here, the only ones freshNamespace removes
+	managedByLabel   = "app.kubernetes.io/managed-by"
+	managedByMeshery = "meshery"
+)
+
+// networkPolicyResource is the resource of the CiliumNetworkPolicies
+var networkPolicyResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2", Resource: "ciliumnetworkpolicies"}
+
+// connectivityRequest holds the parameters of the cilium connectivity test
+// operation, read from the custom body of the request
+type connectivityRequest struct {
+	// TestNamespace is created for the test and removed afterwards, it is
+	// replaced if it exists. cilium-test by default.
+	TestNamespace string `yaml:"testNamespace"`
+
+	// SkipWorld skips the checks reaching outside of the cluster, for the
+	// air-gapped clusters
+	SkipWorld bool `yaml:"skipWorld"`
+
+	// ClientImage and EchoImage replace the images of the client and echo
+	// pods, for the clusters which cannot pull from quay.io
+	ClientImage string `yaml:"clientImage"`
+	EchoImage   string `yaml:"echoImage"`
+
+	// Timeout bounds the whole test, like 5m
+	Timeout string `yaml:"timeout"`
+}
+
+// connectivityCheck is the outcome of a check of the connectivity test
+type connectivityCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// String describes the check as a line of the report
+func (c connectivityCheck) String() string {
+	verdict := "pass"
+	if !c.Passed {
+		verdict = "FAIL"
+	}
+	return fmt.Sprintf("%s: %s (%s)", c.Name, verdict, c.Detail)
+}
+
+// testDeployment returns the Deployment app of the connectivity test,
+// away from the pods of avoid if set
+func testDeployment(app, image string, command []string, avoid string) *appsv1.Deployment {
+	labels := map[string]string{"app": app}
+	replicas := int32(1)
+	grace := int64(0)
+	pod := corev1.PodSpec{
+		TerminationGracePeriodSeconds: &grace,
+		Containers: []corev1.Container{{
+			Name:    app,
+			Image:   image,
+			Command: command,
+			Ports:   []corev1.ContainerPort{{ContainerPort: echoPort}},
+		}},
+	}
+	if avoid != "" {
+		// A single node cluster still runs the test, on the same node
+		pod.Affinity = &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+				Weight: 100,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": avoid}},
+					TopologyKey:   corev1.LabelHostname,
+				},
+			}},
+		}}
+		pod.Containers[0].Ports = nil
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: app, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}, Spec: pod},
+		},
+	}
+}
+
+// echoPolicy returns the CiliumNetworkPolicy of the echo pods: only the
+// pods labelled app=nobody reach them when l7 is unset, the client only
+// reaches GET /public otherwise
+func echoPolicy(l7 bool) *unstructured.Unstructured {
+	name, from := "echo-l3", "nobody"
+	rule := map[string]interface{}{
+		"fromEndpoints": []interface{}{labelSelector(map[string]string{"app": from})},
+	}
+	if l7 {
+		name, from = "echo-l7", "client"
+		rule = map[string]interface{}{
+			"fromEndpoints": []interface{}{labelSelector(map[string]string{"app": from})},
+			"toPorts": []interface{}{map[string]interface{}{
+				"ports": []interface{}{map[string]interface{}{"port": fmt.Sprint(echoPort), "protocol": "TCP"}},
+				"rules": map[string]interface{}{
+					"http": []interface{}{map[string]interface{}{"method": "GET", "path": "/public"}},
+				},
+			}},
+		}
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": networkPolicyResource.GroupVersion().String(),
+		"kind":       "CiliumNetworkPolicy",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"endpointSelector": labelSelector(map[string]string{"app": "echo"}),
+			"ingress":          []interface{}{rule},
+		},
+	}}
+}
+
+// curl requests url from the client pod and returns the HTTP status, 000
+// when no response came back
+func (h *Handler) curl(client *corev1.Pod, url string) string {
+	return h.curlMethod(client, "client", "GET", url)
+}
+
+// curlMethod requests url with method from container of pod and returns
+// the HTTP status, 000 when no response came back
+func (h *Handler) curlMethod(pod *corev1.Pod, container, method, url string) string {
+	out, err := h.execContainer(pod, container, "sh", "-c", fmt.Sprintf("curl -s -o /dev/null -w '%%{http_code}' --max-time 5 -X %s %s || true", method, url))
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(out)
+}
+
+// expect checks that the status of url, requested from the client pod,
+// satisfies ok. It is retried until policyTimeout so that policies have
+// the time to be enforced.
+func (h *Handler) expect(ctx context.Context, name string, client *corev1.Pod, url string, ok func(status string) bool) connectivityCheck {
+	ctx, cancel := context.WithTimeout(ctx, policyTimeout)
+	defer cancel()
+	var status string
+	err := wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		status = h.curl(client, url)
+		return ok(status), nil
+	}, ctx.Done())
+	return connectivityCheck{Name: name, Passed: err == nil, Detail: fmt.Sprintf("GET %s: %s", url, status)}
+}
+
+// httpOK is the status of a successful request
+func httpOK(status string) bool {
+	return status == "200"
+}
+
+// httpDropped is the status of a request dropped by a policy, which gets
+// no response
+func httpDropped(status string) bool {
+	return status == "000"
+}
+
+// httpRefused is the status of a request refused by an L7 policy
+func httpRefused(status string) bool {
+	return status == "403"
+}
+
+// httpAnswered is the status of a request which got a response, whatever
+// it is, other than the refusal of a policy
+func httpAnswered(status string) bool {
+	return len(status) == 3 && status != "000" && status != "403"
+}
+
+// freshNamespace removes namespace if a previous test left it, waits for it
+// to be gone, and creates it again. A namespace without the managed-by label
+// set here is not ours to remove and fails the test
+func (h *Handler) freshNamespace(ctx context.Context, namespace string) error {
+	namespaces := h.kubeClient().CoreV1().Namespaces()
+	existing, err := namespaces.Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if existing.GetLabels()[managedByLabel] != managedByMeshery {
+			return fmt.Errorf("the namespace %s exists and is not managed by meshery, use another test namespace", namespace)
+		}
+		if err := namespaces.Delete(ctx, namespace, metav1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	err = wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		_, err := namespaces.Get(ctx, namespace, metav1.GetOptions{})
+		return kerrors.IsNotFound(err), nil
+	}, ctx.Done())
+	if err != nil {
+		return fmt.Errorf("the namespace %s left by a previous test is not gone: %w", namespace, err)
+	}
+	_, err = namespaces.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   namespace,
+		Labels: map[string]string{managedByLabel: managedByMeshery},
+	}}, metav1.CreateOptions{})
+	return err
+}
+
+// testPod returns the running pod of the Deployment app of namespace
+func (h *Handler) testPod(ctx context.Context, namespace, app string) (*corev1.Pod, error) {
+	pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "app=" + app})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no running %s pod", app)
+}
+
+// deployConnectivityTest deploys the echo pods behind a NodePort service
+// and the client pods, away from the echo pods, and waits for both
+func (h *Handler) deployConnectivityTest(ctx context.Context, e *adapter.Event, namespace string, req connectivityRequest) (client, echo *corev1.Pod, svc *corev1.Service, err error) {
+	clientImage, echoImage := req.ClientImage, req.EchoImage
+	if clientImage == "" {
+		clientImage = defaultClientImage
+	}
+	if echoImage == "" {
+		echoImage = defaultEchoImage
+	}
+
+	deployments := h.KubeClient.AppsV1().Deployments(namespace)
+	for _, deploy := range []*appsv1.Deployment{
+		testDeployment("echo", echoImage, nil, ""),
+		testDeployment("client", clientImage, []string{"sleep", "infinity"}, "echo"),
+	} {
+		if _, err := deployments.Create(ctx, deploy, metav1.CreateOptions{}); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	svc, err = h.KubeClient.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "echo"},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeNodePort,
+			Selector: map[string]string{"app": "echo"},
+			Ports:    []corev1.ServicePort{{Port: echoPort, TargetPort: intstr.FromInt(echoPort)}},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	h.streamProgress(e, "Waiting for the connectivity test pods", "")
+	deadline, _ := ctx.Deadline()
+	for _, app := range []string{"echo", "client"} {
+		if err := h.waitForDeployment(namespace, app, time.Until(deadline)); err != nil {
+			if problems := h.podProblems(namespace, "app="+app); len(problems) > 0 {
+				err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+			}
+			return nil, nil, nil, fmt.Errorf("the %s pods are not ready: %w", app, err)
+		}
+	}
+	if client, err = h.testPod(ctx, namespace, "client"); err != nil {
+		return nil, nil, nil, err
+	}
+	if echo, err = h.testPod(ctx, namespace, "echo"); err != nil {
+		return nil, nil, nil, err
+	}
+	return client, echo, svc, nil
+}
+
+// connectivityTest checks the datapath of cilium the way cilium
+// connectivity test does, in a namespace created for the test and removed
+// afterwards however the test ends. Every check is reported, the test
+// fails if any of them did.
+func (h *Handler) connectivityTest(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while testing the Cilium connectivity"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req connectivityRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout := defaultConnectivityTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = parseTimeout(req.Timeout); err != nil {
+			fail(err)
+			return
+		}
+	}
+	namespace := req.TestNamespace
+	if namespace == "" {
+		namespace = defaultTestNamespace
+	}
+	if err := validateNamespace(namespace); err != nil {
+		fail(err)
+		return
+	}
+	if systemNamespaces[namespace] {
+		fail(ErrInvalidNamespace(fmt.Errorf("the test namespace %s is removed after the test, use another one", namespace)))
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	h.streamProgress(e, "Preparing the Cilium connectivity test", fmt.Sprintf("Creating the namespace %s", namespace))
+	if err := h.freshNamespace(ctx, namespace); err != nil {
+		fail(ErrConnectivityTest(err))
+		return
+	}
+	defer func() {
+		// The context of the test may be done already
+		if err := h.KubeClient.CoreV1().Namespaces().Delete(context.Background(), namespace, metav1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+			h.Log.Error(ErrConnectivityTest(fmt.Errorf("the test namespace %s could not be removed: %w", namespace, err)))
+		}
+	}()
+
+	client, echo, svc, err := h.deployConnectivityTest(ctx, e, namespace, req)
+	if err != nil {
+		fail(ErrConnectivityTest(err))
+		return
+	}
+
+	placement := "same-node"
+	if client.Spec.NodeName != echo.Spec.NodeName {
+		placement = "cross-node"
+	}
+	h.streamProgress(e, "Running the Cilium connectivity checks", fmt.Sprintf("The client runs on %s, the echo pod on %s", client.Spec.NodeName, echo.Spec.NodeName))
+	echoURL := fmt.Sprintf("http://%s:%d/", echo.Status.PodIP, echoPort)
+	if strings.Contains(echo.Status.PodIP, ":") {
+		echoURL = fmt.Sprintf("http://[%s]:%d/", echo.Status.PodIP, echoPort)
+	}
+	checks := []connectivityCheck{
+		h.expect(ctx, fmt.Sprintf("pod-to-pod (%s)", placement), client, echoURL, httpOK),
+		h.expect(ctx, "pod-to-service", client, fmt.Sprintf("http://echo.%s.svc:%d/", namespace, echoPort), httpOK),
+		h.expect(ctx, "pod-to-nodeport", client, fmt.Sprintf("http://%s:%d/", echo.Status.HostIP, svc.Spec.Ports[0].NodePort), httpOK),
+	}
+	if !req.SkipWorld {
+		checks = append(checks, h.expect(ctx, "pod-to-world", client, worldURL, httpAnswered))
+	}
+
+	policies := h.DynamicKubeClient.Resource(networkPolicyResource).Namespace(namespace)
+	for _, l7 := range []bool{false, true} {
+		policy := echoPolicy(l7)
+		if _, err := policies.Create(ctx, policy, metav1.CreateOptions{}); err != nil {
+			checks = append(checks, connectivityCheck{Name: "policy " + policy.GetName(), Detail: err.Error()})
+			continue
+		}
+		if l7 {
+			checks = append(checks,
+				h.expect(ctx, "l7-policy-allow", client, echoURL+"public", httpAnswered),
+				h.expect(ctx, "l7-policy-deny", client, echoURL+"private", httpRefused),
+			)
+		} else {
+			checks = append(checks, h.expect(ctx, "l3-policy-deny", client, echoURL, httpDropped))
+		}
+		if err := policies.Delete(ctx, policy.GetName(), metav1.DeleteOptions{}); err != nil {
+			checks = append(checks, connectivityCheck{Name: "policy " + policy.GetName(), Detail: err.Error()})
+		}
+	}
+
+	passed := 0
+	lines := make([]string, 0, len(checks))
+	for _, check := range checks {
+		if check.Passed {
+			passed++
+		}
+		lines = append(lines, check.String())
+	}
+	report := strings.Join(lines, "\n")
+	if passed < len(checks) {
+		fail(ErrConnectivityTest(fmt.Errorf("%d of %d connectivity checks failed:\n%s", len(checks)-passed, len(checks), report)))
+		return
+	}
+	e.Summary = fmt.Sprintf("All %d Cilium connectivity checks passed", len(checks))
+	e.Details = report
+	h.StreamInfo(e)
+}
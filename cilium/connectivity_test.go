@@ -0,0 +1,72 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func namespaceObject(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestFreshNamespace(t *testing.T) {
+	managed := map[string]string{managedByLabel: managedByMeshery}
+	cases := []struct {
+		name     string
+		existing []runtime.Object
+	}{
+		{name: "absent"},
+		{name: "left by a previous test", existing: []runtime.Object{namespaceObject("cilium-test", map[string]string{managedByLabel: managedByMeshery, "stale": "true"})}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, c.existing...)
+			if err := h.freshNamespace(context.Background(), "cilium-test"); err != nil {
+				t.Fatalf("freshNamespace: %v", err)
+			}
+			ns, err := h.kubeClient().CoreV1().Namespaces().Get(context.Background(), "cilium-test", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get namespace: %v", err)
+			}
+			if len(ns.Labels) != len(managed) || ns.Labels[managedByLabel] != managedByMeshery {
+				t.Errorf("labels = %v, want %v", ns.Labels, managed)
+			}
+		})
+	}
+}
+
+func TestFreshNamespaceForeign(t *testing.T) {
+	for _, labels := range []map[string]string{nil, {managedByLabel: "helm"}} {
+		h, _ := newTestHandler(t, namespaceObject("payments", labels))
+		err := h.freshNamespace(context.Background(), "payments")
+		if err == nil || !strings.Contains(err.Error(), "not managed by meshery") {
+			t.Fatalf("labels %v: err = %v, want a refusal", labels, err)
+		}
+		ns, err := h.kubeClient().CoreV1().Namespaces().Get(context.Background(), "payments", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("labels %v: the namespace is gone: %v", labels, err)
+		}
+		if ns.Labels[managedByLabel] != labels[managedByLabel] {
+			t.Errorf("labels %v: the namespace was replaced, labels = %v", labels, ns.Labels)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	appsv1 "k8s.io/api/apps/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+)
+
+const (
+	// ciliumConfigMap is the ConfigMap holding the configuration of the
+	// agents, whatever installed them
+	ciliumConfigMap = "cilium-config"
+
+	// cliValuesConfigMap is the ConfigMap the cilium cli keeps the values
+	// of its installs in
+	cliValuesConfigMap = "cilium-cli-helm-values"
+
+	// gkeDataplaneDaemonSet runs cilium on the GKE clusters using
+	// Dataplane V2
+	gkeDataplaneDaemonSet = "anetd"
+
+	// aksManagedByLabel marks the resources AKS manages
+	aksManagedByLabel = "kubernetes.azure.com/managedby"
+)
+
+// The ways cilium may have been installed
+const (
+	methodHelm     = "helm"
+	methodCLI      = "cilium-cli"
+	methodManaged  = "managed"
+	methodManifest = "manifest"
+)
+
+// ciliumInstallation describes the cilium found in the cluster
+type ciliumInstallation struct {
+	Detected  bool   `json:"detected"`
+	Namespace string `json:"namespace,omitempty"`
+	Version   string `json:"version,omitempty"`
+
+	// Method is helm, cilium-cli, managed or manifest
+	Method string `json:"method,omitempty"`
+
+	// Distribution is the cloud distribution managing cilium, if any
+	Distribution string `json:"distribution,omitempty"`
+
+	// HelmRelease tells that the adapter can manage it as its release
+	HelmRelease bool `json:"helmRelease"`
+
+	// ConfigMap tells that the cilium-config ConfigMap exists
+	ConfigMap bool `json:"configMap"`
+
+	// Inventory tells that the adapter installed it from manifests, which
+	// it manages through their inventory
+	Inventory bool `json:"inventory"`
+}
+
+// String describes the installation like "Cilium v1.13.4 detected
+// (installed by cilium-cli)"
+func (c ciliumInstallation) String() string {
+	if !c.Detected {
+		return "Cilium is not installed"
+	}
+	by := c.Method
+	if c.Distribution != "" {
+		by = c.Distribution
+	}
+	version := c.Version
+	if version == "" {
+		version = "of an unknown version"
+	}
+	return fmt.Sprintf("Cilium %s detected in %s (installed by %s)", version, c.Namespace, by)
+}
+
+// detectCilium looks for the helm release, the agent DaemonSet and the
+// cilium-config ConfigMap of cilium in the cluster to tell its version and
+// how it was installed
+func (h *Handler) detectCilium(ctx context.Context) (ciliumInstallation, error) {
+	var found ciliumInstallation
+	if h.kubeClient() == nil {
+		return found, ErrNilClient
+	}
+
+	if ds, err := h.kubeClient().AppsV1().DaemonSets(metav1.NamespaceSystem).Get(ctx, gkeDataplaneDaemonSet, metav1.GetOptions{}); err == nil {
+		return ciliumInstallation{
+			Detected:     true,
+			Namespace:    ds.Namespace,
+			Version:      imageVersion(ds),
+			Method:       methodManaged,
+			Distribution: "GKE Dataplane V2",
+		}, nil
+	}
+
+	daemonSets, err := h.kubeClient().AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return found, err
+	}
+	var ds *appsv1.DaemonSet
+	for i := range daemonSets.Items {
+		if daemonSets.Items[i].Name == agentDaemonSet {
+			ds = &daemonSets.Items[i]
+			break
+		}
+	}
+	if ds == nil {
+		return found, nil
+	}
+
+	found.Detected = true
+	found.Namespace = ds.Namespace
+	found.Version = imageVersion(ds)
+	if _, err := h.kubeClient().CoreV1().ConfigMaps(ds.Namespace).Get(ctx, ciliumConfigMap, metav1.GetOptions{}); err == nil {
+		found.ConfigMap = true
+	}
+
+	switch {
+	case ds.Labels[aksManagedByLabel] != "":
+		found.Method = methodManaged
+		found.Distribution = "AKS"
+	case h.releaseExists(ds.Namespace):
+		found.Method = methodHelm
+		found.HelmRelease = true
+		if version, _, err := h.releaseValues(ds.Namespace); err == nil {
+			found.Version = "v" + strings.TrimPrefix(version, "v")
+		}
+	case h.cliInstalled(ctx, ds.Namespace):
+		found.Method = methodCLI
+	case h.inventoryExists(ctx, ds.Namespace):
+		found.Method = methodManifest
+		found.Inventory = true
+		if inventory, err := h.readInventory(ctx, ds.Namespace); err == nil && inventory != nil {
+			found.Version = "v" + strings.TrimPrefix(inventory.Version, "v")
+		}
+	default:
+		found.Method = methodManifest
+	}
+	// The cilium cli of v0.15 and later installs cilium as a helm release
+	if found.Method == methodHelm && h.cliInstalled(ctx, ds.Namespace) {
+		found.Method = methodCLI
+	}
+	return found, nil
+}
+
+// cliInstalled reports whether the cilium cli installed cilium in namespace
+func (h *Handler) cliInstalled(ctx context.Context, namespace string) bool {
+	_, err := h.kubeClient().CoreV1().ConfigMaps(namespace).Get(ctx, cliValuesConfigMap, metav1.GetOptions{})
+	return err == nil
+}
+
+// imageVersion returns the tag of the agent image of ds, which is the
+// cilium version, or nothing if it is not a version
+func imageVersion(ds *appsv1.DaemonSet) string {
+	for _, c := range ds.Spec.Template.Spec.Containers {
+		ref, err := reference.ParseNormalizedNamed(c.Image)
+		if err != nil {
+			continue
+		}
+		if tagged, ok := ref.(reference.Tagged); ok {
+			if _, err := config.ParseVersion(tagged.Tag()); err == nil {
+				return "v" + strings.TrimPrefix(tagged.Tag(), "v")
+			}
+		}
+	}
+	return ""
+}
+
+// checkExisting decides what installing version in namespace does to the
+// cilium found in the cluster: nothing if it is the same version already
+// installed by the adapter, as its release or from manifests, or the
+// install fails with the way forward. Another install is adopted if adopt
+// is set.
+func (h *Handler) checkExisting(found ciliumInstallation, version, namespace string, adopt bool) (noop bool, err error) {
+	if !found.Detected {
+		return false, nil
+	}
+	switch {
+	case found.Namespace != namespace:
+		return false, ErrCiliumAlreadyInstalled(found.String(), fmt.Sprintf("Install cilium in %s or remove the existing install first", found.Namespace))
+	case found.Method == methodManaged:
+		return false, ErrCiliumAlreadyInstalled(found.String(), fmt.Sprintf("Cilium is managed by %s, change it through the cloud provider", found.Distribution))
+	case !found.HelmRelease && !found.Inventory && !adopt:
+		return false, ErrCiliumAlreadyInstalled(found.String(), "Set adopt to true for the adapter to take over the install as its helm release")
+	case !found.HelmRelease && !found.Inventory:
+		return false, nil
+	}
+
+	installed, err := config.ParseVersion(found.Version)
+	if err != nil {
+		return false, ErrCiliumAlreadyInstalled(found.String(), "Run the upgrade operation to move it to a known version")
+	}
+	requested, err := config.ParseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case requested.Equal(installed):
+		return true, nil
+	case installed.LessThan(requested):
+		return false, ErrCiliumAlreadyInstalled(found.String(), fmt.Sprintf("Run the upgrade operation to move it to %s", version))
+	default:
+		return false, ErrCiliumAlreadyInstalled(found.String(), fmt.Sprintf("Run the upgrade operation with force to downgrade it to %s", version))
+	}
+}
+
+// adoptResources marks the resources of manifest which already exist in
+// the cluster as owned by the release of the adapter in namespace, for
+// helm to take them over on install instead of failing on them
+func (h *Handler) adoptResources(ctx context.Context, namespace, manifest string) (int, error) {
+	if h.DynamicKubeClient == nil {
+		return 0, ErrNilClient
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(h.KubeClient.Discovery()))
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{"app.kubernetes.io/managed-by": "Helm"},
+			"annotations": map[string]string{
+				"meta.helm.sh/release-name":      config.HelmChartName,
+				"meta.helm.sh/release-namespace": namespace,
+			},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	adopted := 0
+	for _, doc := range releaseutil.SplitManifests(manifest) {
+		var obj struct {
+			APIVersion string `yaml:"apiVersion"`
+			Kind       string `yaml:"kind"`
+			Metadata   struct {
+				Name      string `yaml:"name"`
+				Namespace string `yaml:"namespace"`
+			} `yaml:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil || obj.Kind == "" {
+			continue
+		}
+		gv, err := schema.ParseGroupVersion(obj.APIVersion)
+		if err != nil {
+			return adopted, err
+		}
+		mapping, err := mapper.RESTMapping(gv.WithKind(obj.Kind).GroupKind(), gv.Version)
+		if err != nil {
+			// The kind is not served, so nothing of it exists to adopt
+			continue
+		}
+		resource := h.DynamicKubeClient.Resource(mapping.Resource)
+		var patchErr error
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			ns := obj.Metadata.Namespace
+			if ns == "" {
+				ns = namespace
+			}
+			_, patchErr = resource.Namespace(ns).Patch(ctx, obj.Metadata.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		} else {
+			_, patchErr = resource.Patch(ctx, obj.Metadata.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		}
+		if patchErr != nil {
+			if kerrors.IsNotFound(patchErr) {
+				continue
+			}
+			return adopted, fmt.Errorf("%s %s: %w", obj.Kind, obj.Metadata.Name, patchErr)
+		}
+		adopted++
+	}
+	return adopted, nil
+}
+
+// detect reports the cilium found in the cluster, for the UI to show
+func (h *Handler) detect(e *adapter.Event) {
+	found, err := h.detectCilium(context.Background())
+	if err != nil {
+		err = ErrDetectCilium(err)
+		e.Summary = "Error while detecting Cilium"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+	byt, err := json.Marshal(found)
+	if err != nil {
+		err = ErrDetectCilium(err)
+		e.Summary = "Error while detecting Cilium"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+	e.Summary = found.String()
+	e.Details = string(byt)
+	h.StreamInfo(e)
+}
@@ -0,0 +1,392 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	// egressGatewaySince is the first version running the egress gateway
+	egressGatewaySince = semver.MustParse("1.10.0")
+
+	// egressGatewayPolicySince is the first version taking the stable
+	// CiliumEgressGatewayPolicy rather than the CiliumEgressNATPolicy
+	egressGatewayPolicySince = semver.MustParse("1.12.0")
+
+	// egressL7ProxySince is the first version running the egress gateway
+	// along with the L7 proxy
+	egressL7ProxySince = semver.MustParse("1.14.0")
+
+	// egressGatewayPolicyResource and egressNATPolicyResource are the
+	// resources of the egress policies, by cilium version
+	egressGatewayPolicyResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2", Resource: "ciliumegressgatewaypolicies"}
+	egressNATPolicyResource     = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2alpha1", Resource: "ciliumegressnatpolicies"}
+)
+
+// egressPolicy is an egress gateway policy built from the parameters of
+// the egress gateway operation
+type egressPolicy struct {
+	// Name of the policy
+	Name string `yaml:"name"`
+
+	// PodSelector selects the pods whose traffic leaves through the
+	// gateway by their labels, in PodNamespace if set
+	PodSelector  map[string]string `yaml:"podSelector"`
+	PodNamespace string            `yaml:"podNamespace"`
+
+	// DestinationCIDRs are the destinations reached through the gateway,
+	// except for ExcludedCIDRs
+	DestinationCIDRs []string `yaml:"destinationCIDRs"`
+	ExcludedCIDRs    []string `yaml:"excludedCIDRs"`
+
+	// EgressNodeSelector selects the gateway node by its labels
+	EgressNodeSelector map[string]string `yaml:"egressNodeSelector"`
+
+	// EgressIP is the source IP of the traffic leaving the gateway, which
+	// must be assigned to the gateway node. The IP of the first interface
+	// of the gateway node by default.
+	EgressIP string `yaml:"egressIP"`
+}
+
+// egressRequest holds the parameters of the egress gateway operation, read
+// from the custom body of the request
+type egressRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Policies are created, or replaced if they exist
+	Policies []egressPolicy `yaml:"policies"`
+
+	// Remove are the names of the policies to delete
+	Remove []string `yaml:"remove"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+}
+
+// egressPolicyResource returns the resource of the egress policies of
+// cilium version
+func egressPolicyResource(v *semver.Version) (schema.GroupVersionResource, string) {
+	if v.LessThan(egressGatewayPolicySince) {
+		return egressNATPolicyResource, "CiliumEgressNATPolicy"
+	}
+	return egressGatewayPolicyResource, "CiliumEgressGatewayPolicy"
+}
+
+// validate fails on the parameters of the policy which cannot be right,
+// before anything is applied
+func (p egressPolicy) validate() error {
+	if errs := validation.IsDNS1123Subdomain(p.Name); len(errs) > 0 {
+		return fmt.Errorf("policy name %q: %s", p.Name, strings.Join(errs, ", "))
+	}
+	if len(p.PodSelector) == 0 {
+		return fmt.Errorf("policy %s selects no pods", p.Name)
+	}
+	if err := validateLabels(p.PodSelector); err != nil {
+		return fmt.Errorf("pod selector of policy %s: %w", p.Name, err)
+	}
+	if err := validateNamespace(p.PodNamespace); err != nil {
+		return err
+	}
+	if err := validateLabels(p.EgressNodeSelector); err != nil {
+		return fmt.Errorf("egress node selector of policy %s: %w", p.Name, err)
+	}
+	if len(p.DestinationCIDRs) == 0 {
+		return fmt.Errorf("policy %s has no destination CIDRs", p.Name)
+	}
+	for _, cidr := range append(append([]string{}, p.DestinationCIDRs...), p.ExcludedCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+	}
+	if p.EgressIP != "" && net.ParseIP(p.EgressIP) == nil {
+		return fmt.Errorf("egress IP %q of policy %s is not an IP", p.EgressIP, p.Name)
+	}
+	return nil
+}
+
+// object builds the policy for cilium version: the CiliumEgressGatewayPolicy
+// since cilium 1.12, the CiliumEgressNATPolicy before
+func (p egressPolicy) object(v *semver.Version) (*unstructured.Unstructured, error) {
+	selector := map[string]interface{}{"podSelector": labelSelector(p.PodSelector)}
+	if p.PodNamespace != "" {
+		selector["namespaceSelector"] = labelSelector(map[string]string{"kubernetes.io/metadata.name": p.PodNamespace})
+	}
+	destinations := make([]interface{}, 0, len(p.DestinationCIDRs))
+	for _, cidr := range p.DestinationCIDRs {
+		destinations = append(destinations, cidr)
+	}
+
+	resource, kind := egressPolicyResource(v)
+	spec := map[string]interface{}{"destinationCIDRs": destinations}
+	if v.LessThan(egressGatewayPolicySince) {
+		if p.EgressIP == "" || len(p.EgressNodeSelector) > 0 || len(p.ExcludedCIDRs) > 0 {
+			return nil, fmt.Errorf("cilium %s only takes the egress IP of policy %s, which requires %s for egress node selectors and excluded CIDRs", v, p.Name, egressGatewayPolicySince)
+		}
+		spec["egress"] = []interface{}{selector}
+		spec["egressSourceIP"] = p.EgressIP
+	} else {
+		if len(p.EgressNodeSelector) == 0 {
+			return nil, fmt.Errorf("policy %s has no egress node selector", p.Name)
+		}
+		if len(p.ExcludedCIDRs) > 0 {
+			excluded := make([]interface{}, 0, len(p.ExcludedCIDRs))
+			for _, cidr := range p.ExcludedCIDRs {
+				excluded = append(excluded, cidr)
+			}
+			spec["excludedCIDRs"] = excluded
+		}
+		gateway := map[string]interface{}{"nodeSelector": labelSelector(p.EgressNodeSelector)}
+		if p.EgressIP != "" {
+			gateway["egressIP"] = p.EgressIP
+		}
+		spec["selectors"] = []interface{}{selector}
+		spec["egressGateway"] = gateway
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": resource.GroupVersion().String(),
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": p.Name},
+		"spec":       spec,
+	}}, nil
+}
+
+// kubeProxyReplaced reports whether the release values replace kube-proxy,
+// which the egress gateway requires
+func kubeProxyReplaced(values map[string]interface{}) bool {
+	switch mode := values["kubeProxyReplacement"].(type) {
+	case bool:
+		return mode
+	case string:
+		return mode == "true" || mode == "strict"
+	}
+	return false
+}
+
+// egressGatewayEnabled reports whether the release values enable the
+// egress gateway along with its BPF masquerading
+func egressGatewayEnabled(values map[string]interface{}) bool {
+	egress, _ := values["egressGateway"].(map[string]interface{})
+	bpf, _ := values["bpf"].(map[string]interface{})
+	enabled, _ := egress["enabled"].(bool)
+	masquerade, _ := bpf["masquerade"].(bool)
+	return enabled && masquerade
+}
+
+// checkEgressIP fails unless ip is assigned to one of the nodes selected
+// by nodeSelector, as seen by the agent running on the node
+func (h *Handler) checkEgressIP(ctx context.Context, namespace, ip string, nodeSelector map[string]string) error {
+	nodes, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(nodeSelector).String()})
+	if err != nil {
+		return err
+	}
+	if len(nodes.Items) == 0 {
+		return fmt.Errorf("no node matches the egress node selector %v", nodeSelector)
+	}
+
+	var checked []string
+	for _, node := range nodes.Items {
+		pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: agentSelector,
+			FieldSelector: "spec.nodeName=" + node.Name,
+		})
+		if err != nil || len(pods.Items) == 0 || pods.Items[0].Status.Phase != corev1.PodRunning {
+			checked = append(checked, fmt.Sprintf("%s: no running agent", node.Name))
+			continue
+		}
+		// The agents run in the network namespace of their node
+		out, err := h.execPod(&pods.Items[0], "ip", "-o", "addr", "show")
+		if err != nil {
+			checked = append(checked, fmt.Sprintf("%s: %s", node.Name, err))
+			continue
+		}
+		for _, field := range strings.Fields(out) {
+			if addr, _, err := net.ParseCIDR(field); err == nil && addr.Equal(net.ParseIP(ip)) {
+				return nil
+			}
+		}
+		checked = append(checked, fmt.Sprintf("%s: not assigned", node.Name))
+	}
+	return fmt.Errorf("the egress IP %s is not assigned to any egress node: %s", ip, strings.Join(checked, ", "))
+}
+
+// egressGateway enables the egress gateway on the installed release and
+// applies the egress policies of the request, or removes the named ones.
+// When deleted, every policy of the request is removed and the gateway is
+// left enabled.
+func (h *Handler) egressGateway(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium egress gateway"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req egressRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	remove := req.Remove
+	var policies []egressPolicy
+	for _, policy := range req.Policies {
+		if del {
+			remove = append(remove, policy.Name)
+			continue
+		}
+		if err := policy.validate(); err != nil {
+			fail(ErrInvalidEgressGateway(err))
+			return
+		}
+		policies = append(policies, policy)
+	}
+	for _, name := range remove {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			fail(ErrInvalidEgressGateway(fmt.Errorf("policy name %q: %s", name, strings.Join(errs, ", "))))
+			return
+		}
+	}
+	if len(policies) == 0 && len(remove) == 0 {
+		fail(ErrInvalidEgressGateway(fmt.Errorf("the request neither has policies to apply nor to remove")))
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	version, values, err := h.releaseValues(namespace)
+	if err != nil {
+		fail(ErrConfigureEgressGateway(err))
+		return
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		fail(ErrConfigureEgressGateway(err))
+		return
+	}
+	if v.LessThan(egressGatewaySince) {
+		fail(ErrInvalidEgressGateway(fmt.Errorf("cilium %s is installed, the egress gateway requires %s", version, egressGatewaySince)))
+		return
+	}
+	resource, kind := egressPolicyResource(v)
+
+	objects := make([]*unstructured.Unstructured, 0, len(policies))
+	for _, policy := range policies {
+		obj, err := policy.object(v)
+		if err != nil {
+			fail(ErrInvalidEgressGateway(err))
+			return
+		}
+		objects = append(objects, obj)
+	}
+
+	var results []string
+	if len(objects) > 0 {
+		if !kubeProxyReplaced(values) {
+			fail(ErrInvalidEgressGateway(fmt.Errorf("the egress gateway requires kube-proxy replacement, install cilium with kubeProxyReplacement first")))
+			return
+		}
+		if !egressGatewayEnabled(values) {
+			_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+				egress := map[string]interface{}{
+					"egressGateway": map[string]interface{}{"enabled": true},
+					"bpf":           map[string]interface{}{"masquerade": true},
+				}
+				if v.LessThan(egressL7ProxySince) {
+					egress["l7Proxy"] = false
+				}
+				return egress, nil
+			})
+			if err != nil {
+				fail(ErrConfigureEgressGateway(err))
+				if rollback != nil {
+					rollback()
+				}
+				return
+			}
+			results = append(results, "Egress gateway: enabled")
+		}
+		if err := h.waitForCRD(ctx, resource, timeout); err != nil {
+			fail(ErrConfigureEgressGateway(fmt.Errorf("the %s CRD is not registered: %w", kind, err)))
+			return
+		}
+
+		for _, policy := range policies {
+			if policy.EgressIP == "" || len(policy.EgressNodeSelector) == 0 {
+				continue
+			}
+			if err := h.checkEgressIP(ctx, namespace, policy.EgressIP, policy.EgressNodeSelector); err != nil {
+				fail(ErrInvalidEgressGateway(fmt.Errorf("policy %s: %w", policy.Name, err)))
+				return
+			}
+		}
+
+		for _, obj := range objects {
+			stat, err := h.applyResource(ctx, resource, obj)
+			if err != nil {
+				results = append(results, fmt.Sprintf("%s %s: %s", kind, obj.GetName(), err))
+				fail(ErrConfigureEgressGateway(fmt.Errorf("%s\n%s", err, strings.Join(results, "\n"))))
+				return
+			}
+			results = append(results, fmt.Sprintf("%s %s: %s", kind, obj.GetName(), stat))
+		}
+	}
+
+	var failed bool
+	for _, name := range remove {
+		err := h.DynamicKubeClient.Resource(resource).Delete(ctx, name, metav1.DeleteOptions{})
+		r := newUninstallResult(kind, name, err)
+		failed = failed || r.Err != nil
+		results = append(results, r.String())
+	}
+	if failed {
+		fail(ErrConfigureEgressGateway(fmt.Errorf("some policies could not be removed:\n%s", strings.Join(results, "\n"))))
+		return
+	}
+
+	e.Summary = "Cilium egress gateway configured successfully"
+	e.Details = strings.Join(results, "\n")
+	h.StreamInfo(e)
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+)
+
+// The transparent encryptions the adapter configures
+const (
+	encryptionWireGuard = "wireguard"
+	encryptionIPsec     = "ipsec"
+)
+
+var (
+	// wireGuardSince is the first version encrypting with WireGuard, and
+	// taking the type of the encryption
+	wireGuardSince = semver.MustParse("1.10.0")
+
+	// nodeEncryptionSince is the first version encrypting the traffic
+	// between the nodes with WireGuard
+	nodeEncryptionSince = semver.MustParse("1.14.0")
+)
+
+// encryptionOptions encrypts the traffic between the pods of different
+// nodes. They are part of the custom body of the install requests and of
+// the encryption operation.
+type encryptionOptions struct {
+	// Encryption is wireguard or ipsec to encrypt
+	Encryption string `yaml:"encryption"`
+
+	// NodeEncryption encrypts the traffic between the nodes themselves
+	// as well, with WireGuard only
+	NodeEncryption bool `yaml:"nodeEncryption"`
+
+	// IPsecAlgorithm is the algorithm of the generated IPsec keys, gcm-aes
+	// by default or cbc-aes-sha256
+	IPsecAlgorithm string `yaml:"ipsecAlgorithm"`
+}
+
+// enabled reports whether encryption is requested
+func (o encryptionOptions) enabled() bool {
+	return o.Encryption != ""
+}
+
+// encryptionType returns the requested encryption, lower cased
+func (o encryptionOptions) encryptionType() string {
+	return strings.ToLower(o.Encryption)
+}
+
+// ipsec reports whether IPsec encryption is requested, which requires the
+// IPsec keys
+func (o encryptionOptions) ipsec() bool {
+	return o.encryptionType() == encryptionIPsec
+}
+
+// encryptionName returns the name of the encryption typ as the agents
+// report it
+func encryptionName(typ string) string {
+	if typ == encryptionIPsec {
+		return "IPsec"
+	}
+	return "WireGuard"
+}
+
+// values translates the options into the values of the chart of version
+func (o encryptionOptions) values(version string) (map[string]interface{}, error) {
+	if !o.enabled() {
+		if o.NodeEncryption {
+			return nil, ErrInvalidEncryption(fmt.Errorf("nodeEncryption requires encryption to be set to %s", encryptionWireGuard))
+		}
+		return nil, nil
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption := map[string]interface{}{"enabled": true}
+	switch o.encryptionType() {
+	case encryptionWireGuard:
+		if v.LessThan(wireGuardSince) {
+			return nil, ErrInvalidEncryption(fmt.Errorf("cilium %s does not support WireGuard, which requires %s", version, wireGuardSince))
+		}
+		if o.NodeEncryption && v.LessThan(nodeEncryptionSince) {
+			return nil, ErrInvalidEncryption(fmt.Errorf("cilium %s does not encrypt the node traffic with WireGuard, which requires %s", version, nodeEncryptionSince))
+		}
+		encryption["type"] = encryptionWireGuard
+	case encryptionIPsec:
+		if o.NodeEncryption {
+			return nil, ErrInvalidEncryption(fmt.Errorf("nodeEncryption is only supported with %s", encryptionWireGuard))
+		}
+		if err := validateIPsecAlgorithm(o.IPsecAlgorithm); err != nil {
+			return nil, err
+		}
+		// The keys are read from the secret named as the chart defaults
+		if !v.LessThan(wireGuardSince) {
+			encryption["type"] = encryptionIPsec
+		}
+	default:
+		return nil, ErrInvalidEncryption(fmt.Errorf("unknown encryption %q, expected %s or %s", o.Encryption, encryptionWireGuard, encryptionIPsec))
+	}
+	if o.NodeEncryption {
+		encryption["nodeEncryption"] = true
+	}
+	return map[string]interface{}{"encryption": encryption}, nil
+}
+
+// encryptionRequest holds the parameters of the cilium encryption
+// operation, read from the custom body of the request
+type encryptionRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	encryptionOptions `yaml:",inline"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the
+	// agents fail to encrypt, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// waitForEncryption waits for every agent of namespace to report the
+// encryption typ active, and returns the last state of every node
+func (h *Handler) waitForEncryption(e *adapter.Event, namespace, typ string, timeout time.Duration) ([]agentState, error) {
+	states, err := h.waitForAgentStates(e, namespace, "Encryption", timeout, func(state string) bool {
+		return strings.HasPrefix(strings.ToLower(state), typ)
+	})
+	if err != nil {
+		return states, fmt.Errorf("not every agent reports %[1]s active, check that the kernels of the nodes support %[1]s: %[2]w", encryptionName(typ), err)
+	}
+	return states, nil
+}
+
+// encryption enables, or disables if del is set, the encryption of the
+// installed release, WireGuard by default, and reports the encryption state
+// of every node
+func (h *Handler) encryption(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring Cilium encryption"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req encryptionRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if req.Encryption == "" {
+		req.Encryption = encryptionWireGuard
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	if !del && req.ipsec() {
+		if err := h.ensureIPsecSecret(context.Background(), namespace, req.IPsecAlgorithm); err != nil {
+			fail(err)
+			return
+		}
+	}
+	version, rollback, err := h.reconfigure(e, namespace, timeout, func(version string) (map[string]interface{}, error) {
+		if del {
+			return map[string]interface{}{
+				"encryption": map[string]interface{}{"enabled": false, "nodeEncryption": false},
+			}, nil
+		}
+		return req.encryptionOptions.values(version)
+	})
+	if err == nil && !del {
+		var states []agentState
+		states, err = h.waitForEncryption(e, namespace, req.encryptionType(), timeout)
+		if err != nil && len(states) > 0 {
+			err = fmt.Errorf("%w\n%s", err, agentStateDetails("Encryption per node", states))
+		}
+		if err == nil {
+			e.Summary = "Cilium encryption enabled successfully"
+			e.Details = fmt.Sprintf("Cilium %s encrypts the pod traffic with %s.\n%s", version, encryptionName(req.encryptionType()), agentStateDetails("Encryption per node", states))
+		}
+	}
+	if err != nil {
+		fail(ErrConfigureEncryption(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+	if del {
+		e.Summary = "Cilium encryption disabled successfully"
+		e.Details = fmt.Sprintf("Cilium %s no longer encrypts the pod traffic.", version)
+	}
+	h.StreamInfo(e)
+}
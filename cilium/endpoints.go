@@ -0,0 +1,229 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// defaultEndpointPage and maxEndpointPage bound the number of
+	// endpoints of a page of the listing
+	defaultEndpointPage = 100
+	maxEndpointPage     = 500
+
+	// endpointReady is the state of the endpoints whose policy is
+	// computed and enforced
+	endpointReady = "ready"
+
+	// healthFailure is the health of the failing parts of an endpoint
+	healthFailure = "Failure"
+)
+
+// endpointListRequest holds the parameters of the endpoint listing, read
+// from the custom body of the request
+type endpointListRequest struct {
+	// Namespace restricts the listing to the endpoints of a namespace,
+	// every namespace by default
+	Namespace string `yaml:"namespace"`
+
+	// LabelSelector restricts the listing to the endpoints whose
+	// CiliumEndpoint bears the labels, the labels of their pod
+	LabelSelector string `yaml:"labelSelector"`
+
+	// Limit is the number of endpoints of a page, 100 by default
+	Limit int64 `yaml:"limit"`
+
+	// Continue is the token of the next page, as returned with the
+	// previous page
+	Continue string `yaml:"continue"`
+}
+
+// endpointInfo describes an endpoint of the listing
+type endpointInfo struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	ID        int64  `json:"id"`
+	Identity  int64  `json:"identity"`
+	State     string `json:"state"`
+
+	// Ingress and Egress are the policy enforcement of each direction:
+	// enforcing, non-enforcing or disabled
+	Ingress string `json:"ingress"`
+	Egress  string `json:"egress"`
+
+	// Health is the overall health of the endpoint: OK, Warning, Failure
+	// or Disabled
+	Health string `json:"health"`
+
+	// Flags point out the endpoints needing attention: not-ready and
+	// policy-failed
+	Flags []string `json:"flags,omitempty"`
+}
+
+// endpointListReport is a page of the endpoint listing
+type endpointListReport struct {
+	Endpoints []endpointInfo `json:"endpoints"`
+	Flagged   int            `json:"flagged"`
+
+	// Continue is the token of the next page, empty on the last one
+	Continue string `json:"continue,omitempty"`
+}
+
+// policyEnforcement returns the enforcement of the policy of direction of
+// endpoint. It is a state since cilium 1.14 and a flag before.
+func policyEnforcement(endpoint *unstructured.Unstructured, direction string) string {
+	if state, ok, _ := unstructured.NestedString(endpoint.Object, "status", "policy", direction, "state"); ok && state != "" {
+		return state
+	}
+	enforcing, ok, _ := unstructured.NestedBool(endpoint.Object, "status", "policy", direction, "enforcing")
+	switch {
+	case !ok:
+		return "unknown"
+	case enforcing:
+		return "enforcing"
+	}
+	return "non-enforcing"
+}
+
+// describeEndpoint describes endpoint, flagging it if it is not ready or
+// its policy could not be computed
+func describeEndpoint(endpoint *unstructured.Unstructured) endpointInfo {
+	info := endpointInfo{
+		Namespace: endpoint.GetNamespace(),
+		Pod:       endpoint.GetName(),
+		Ingress:   policyEnforcement(endpoint, "ingress"),
+		Egress:    policyEnforcement(endpoint, "egress"),
+	}
+	info.ID, _, _ = unstructured.NestedInt64(endpoint.Object, "status", "id")
+	info.Identity, _, _ = unstructured.NestedInt64(endpoint.Object, "status", "identity", "id")
+	info.State, _, _ = unstructured.NestedString(endpoint.Object, "status", "state")
+	info.Health, _, _ = unstructured.NestedString(endpoint.Object, "status", "health", "overallHealth")
+
+	if info.State != endpointReady {
+		info.Flags = append(info.Flags, "not-ready")
+	}
+	policyHealth, _, _ := unstructured.NestedString(endpoint.Object, "status", "health", "policy")
+	if policyHealth == healthFailure || lastLogFailed(endpoint) {
+		info.Flags = append(info.Flags, "policy-failed")
+	}
+	return info
+}
+
+// lastLogFailed reports whether the last change of state logged by
+// endpoint, its last regeneration, failed
+func lastLogFailed(endpoint *unstructured.Unstructured) bool {
+	entries, _, _ := unstructured.NestedSlice(endpoint.Object, "status", "log")
+	if len(entries) == 0 {
+		return false
+	}
+	last, ok := entries[len(entries)-1].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	code, _, _ := unstructured.NestedString(last, "code")
+	return code == healthFailure
+}
+
+// listEndpoints returns a page of the CiliumEndpoints matching req
+func (h *Handler) listEndpoints(ctx context.Context, req endpointListRequest) (*endpointListReport, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultEndpointPage
+	}
+	if limit > maxEndpointPage {
+		limit = maxEndpointPage
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceAll
+	}
+	list, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: req.LabelSelector,
+		Limit:         limit,
+		Continue:      req.Continue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &endpointListReport{Endpoints: make([]endpointInfo, 0, len(list.Items)), Continue: list.GetContinue()}
+	for i := range list.Items {
+		info := describeEndpoint(&list.Items[i])
+		if len(info.Flags) > 0 {
+			report.Flagged++
+		}
+		report.Endpoints = append(report.Endpoints, info)
+	}
+	// The pages come in the order of the API server, the flagged endpoints
+	// go first within a page
+	sort.SliceStable(report.Endpoints, func(i, j int) bool {
+		return len(report.Endpoints[i].Flags) > 0 && len(report.Endpoints[j].Flags) == 0
+	})
+	return report, nil
+}
+
+// endpointList streams a page of the CiliumEndpoints of the cluster with
+// their identity, policy enforcement and health, as JSON
+func (h *Handler) endpointList(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while listing the Cilium endpoints"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req endpointListRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if _, err := labels.Parse(req.LabelSelector); err != nil {
+		fail(ErrParseCustomBody(fmt.Errorf("labelSelector: %w", err)))
+		return
+	}
+	if h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	report, err := h.listEndpoints(context.Background(), req)
+	if err != nil {
+		fail(ErrListEndpoints(err))
+		return
+	}
+	byt, err := json.Marshal(report)
+	if err != nil {
+		fail(ErrListEndpoints(err))
+		return
+	}
+	e.Summary = fmt.Sprintf("%d Cilium endpoints listed, %d need attention", len(report.Endpoints), report.Flagged)
+	if report.Continue != "" {
+		e.Summary += ", more are left"
+	}
+	e.Details = string(byt)
+	h.StreamInfo(e)
+}
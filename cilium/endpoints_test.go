@@ -0,0 +1,165 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func ciliumEndpointObject(namespace, name string, labels map[string]string, status map[string]interface{}) *unstructured.Unstructured {
+	endpoint := &unstructured.Unstructured{Object: map[string]interface{}{"status": status}}
+	endpoint.SetAPIVersion(ciliumGroup + "/v2")
+	endpoint.SetKind("CiliumEndpoint")
+	endpoint.SetNamespace(namespace)
+	endpoint.SetName(name)
+	endpoint.SetLabels(labels)
+	return endpoint
+}
+
+// testEndpoints are a ready endpoint of cilium 1.14, a regenerating one of
+// cilium 1.13 and one whose policy failed
+func testEndpoints() []runtime.Object {
+	return []runtime.Object{
+		ciliumEndpointObject("default", "frontend", map[string]string{"app": "frontend"}, map[string]interface{}{
+			"id":       int64(101),
+			"identity": map[string]interface{}{"id": int64(20567)},
+			"state":    endpointReady,
+			"health":   map[string]interface{}{"overallHealth": "OK", "policy": "OK"},
+			"policy": map[string]interface{}{
+				"ingress": map[string]interface{}{"state": "enforcing"},
+				"egress":  map[string]interface{}{"state": "disabled"},
+			},
+		}),
+		ciliumEndpointObject("default", "backend", map[string]string{"app": "backend"}, map[string]interface{}{
+			"id":       int64(102),
+			"identity": map[string]interface{}{"id": int64(31044)},
+			"state":    "regenerating",
+			"health":   map[string]interface{}{"overallHealth": "Warning"},
+			"policy": map[string]interface{}{
+				"ingress": map[string]interface{}{"enforcing": true},
+				"egress":  map[string]interface{}{"enforcing": false},
+			},
+		}),
+		ciliumEndpointObject("payments", "ledger", map[string]string{"app": "ledger"}, map[string]interface{}{
+			"id":       int64(201),
+			"identity": map[string]interface{}{"id": int64(48211)},
+			"state":    endpointReady,
+			"health":   map[string]interface{}{"overallHealth": "OK", "policy": "OK"},
+			"log": []interface{}{
+				map[string]interface{}{"code": "OK", "state": endpointReady},
+				map[string]interface{}{"code": healthFailure, "message": "failed to compute the policy"},
+			},
+		}),
+	}
+}
+
+func newEndpointHandler(t *testing.T) (*Handler, chan interface{}) {
+	h, events := newTestHandler(t)
+	h.DynamicKubeClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ciliumEndpointResource: "CiliumEndpointList"}, testEndpoints()...)
+	return h, events
+}
+
+func TestListEndpoints(t *testing.T) {
+	h, _ := newEndpointHandler(t)
+	report, err := h.listEndpoints(context.Background(), endpointListRequest{})
+	if err != nil {
+		t.Fatalf("listEndpoints: %v", err)
+	}
+	want := map[string]endpointInfo{
+		"frontend": {Namespace: "default", Pod: "frontend", ID: 101, Identity: 20567, State: endpointReady, Ingress: "enforcing", Egress: "disabled", Health: "OK"},
+		"backend":  {Namespace: "default", Pod: "backend", ID: 102, Identity: 31044, State: "regenerating", Ingress: "enforcing", Egress: "non-enforcing", Health: "Warning", Flags: []string{"not-ready"}},
+		"ledger":   {Namespace: "payments", Pod: "ledger", ID: 201, Identity: 48211, State: endpointReady, Ingress: "unknown", Egress: "unknown", Health: "OK", Flags: []string{"policy-failed"}},
+	}
+	if len(report.Endpoints) != len(want) {
+		t.Fatalf("listed %d endpoints, want %d", len(report.Endpoints), len(want))
+	}
+	for i, info := range report.Endpoints {
+		if !reflect.DeepEqual(info, want[info.Pod]) {
+			t.Errorf("endpoint %s = %+v, want %+v", info.Pod, info, want[info.Pod])
+		}
+		if i == len(report.Endpoints)-1 && len(info.Flags) > 0 {
+			t.Errorf("flagged endpoint %s listed after the others", info.Pod)
+		}
+	}
+	if report.Flagged != 2 {
+		t.Errorf("flagged %d endpoints, want 2", report.Flagged)
+	}
+}
+
+func TestListEndpointsFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		req  endpointListRequest
+		want []string
+	}{
+		{name: "namespace", req: endpointListRequest{Namespace: "payments"}, want: []string{"ledger"}},
+		{name: "label selector", req: endpointListRequest{LabelSelector: "app in (frontend, ledger)"}, want: []string{"frontend", "ledger"}},
+		{name: "namespace and label selector", req: endpointListRequest{Namespace: "default", LabelSelector: "app=ledger"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newEndpointHandler(t)
+			report, err := h.listEndpoints(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("listEndpoints: %v", err)
+			}
+			pods := make(map[string]bool)
+			for _, info := range report.Endpoints {
+				pods[info.Pod] = true
+			}
+			wantPods := make(map[string]bool)
+			for _, pod := range tt.want {
+				wantPods[pod] = true
+			}
+			if !reflect.DeepEqual(pods, wantPods) {
+				t.Errorf("listed %v, want %v", pods, wantPods)
+			}
+		})
+	}
+}
+
+func TestEndpointList(t *testing.T) {
+	h, events := newEndpointHandler(t)
+	h.endpointList("namespace: default\n", &adapter.Event{})
+	e := (<-events).(*adapter.Event)
+	if e.EType != 0 {
+		t.Fatalf("event %q is an error: %s", e.Summary, e.Details)
+	}
+	if want := "2 Cilium endpoints listed, 1 need attention"; e.Summary != want {
+		t.Errorf("summary = %q, want %q", e.Summary, want)
+	}
+	var report endpointListReport
+	if err := json.Unmarshal([]byte(e.Details), &report); err != nil {
+		t.Fatalf("details are not a report: %v", err)
+	}
+	if len(report.Endpoints) != 2 || report.Endpoints[0].Pod != "backend" {
+		t.Errorf("endpoints = %+v, want backend first", report.Endpoints)
+	}
+
+	h.endpointList("labelSelector: \"app in (\"\n", &adapter.Event{})
+	if e := (<-events).(*adapter.Event); e.EType != 2 {
+		t.Errorf("event %q for an invalid label selector is not an error", e.Summary)
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// envCheckDaemonSet runs the checks on every node, it is removed once
+	// they reported
+	envCheckDaemonSet = "cilium-environment-check"
+
+	// envCheckSelector selects the pods of envCheckDaemonSet
+	envCheckSelector = "app.kubernetes.io/name=" + envCheckDaemonSet
+
+	// defaultEnvCheckImage is the image running the checks, which only
+	// needs a shell
+	defaultEnvCheckImage = "docker.io/library/busybox:1.36"
+
+	// defaultEnvCheckTimeout bounds the wait for the checks to report
+	defaultEnvCheckTimeout = 2 * time.Minute
+
+	// envCheckScript prints the state of the node as key=value lines. The
+	// pods share the PID namespace of the host, so that the mounts and the
+	// network of its init process are the ones of the host. mtu is the MTU
+	// of the interface of the default route.
+	envCheckScript = `m=/proc/1/mounts
+grep -q ' /sys/fs/bpf bpf ' $m && echo bpffs=yes || echo bpffs=no
+grep -q ' cgroup2 ' $m && echo cgroup2=yes || echo cgroup2=no
+echo cni=$(ls /host/etc/cni/net.d 2>/dev/null)
+[ -d /host/run/systemd/netif ] && echo networkd=running || echo networkd=absent
+grep -qs '^ManageForeignRoutes=no' /host/etc/systemd/networkd.conf /host/etc/systemd/networkd.conf.d/*.conf && echo foreignroutes=kept || echo foreignroutes=removed
+i=$(awk '$2=="00000000"{print $1; exit}' /proc/1/net/route)
+echo iface=$i
+echo mtu=$(nsenter -t 1 -n ip -o link show dev "$i" 2>/dev/null | sed -n 's/.* mtu \([0-9]*\).*/\1/p')
+echo preflight=done
+exec sleep 3600`
+)
+
+var (
+	// minKernels are the oldest kernels cilium runs on, from cilium 1.13
+	// and before
+	minKernel       = semver.MustParse("4.19.57")
+	minLegacyKernel = semver.MustParse("4.9.17")
+	minKernelSince  = semver.MustParse("1.13.0")
+)
+
+// preflightOptions run the preflight checks before an install. They are
+// part of the custom body of the install requests.
+type preflightOptions struct {
+	// Preflight runs the checks, which refuse the install when a critical
+	// check fails on a node
+	Preflight bool `yaml:"preflight"`
+
+	// Force installs despite the critical checks which failed
+	Force bool `yaml:"force"`
+
+	// PreflightImage runs the checks, busybox by default
+	PreflightImage string `yaml:"preflightImage"`
+}
+
+// preflightRequest holds the parameters of the cilium preflight operation,
+// read from the custom body of the request
+type preflightRequest struct {
+	// Namespace the checks run in, the one of cilium by default
+	Namespace string `yaml:"namespace"`
+
+	// Version of cilium the nodes are checked for, the latest supported
+	// one by default
+	Version string `yaml:"version"`
+
+	// ChainingMode tells that cilium is to be chained to the CNI already
+	// configured on the nodes, which is then not reported as a conflict
+	ChainingMode string `yaml:"chainingMode"`
+
+	// Image runs the checks, busybox by default
+	Image string `yaml:"image"`
+
+	// Timeout bounds the wait for the checks to report, like 2m
+	Timeout string `yaml:"timeout"`
+}
+
+// envCheck is the outcome of a check on a node
+type envCheck struct {
+	Name   string
+	Passed bool
+
+	// Critical failures refuse the install
+	Critical bool
+
+	Detail string
+	Hint   string
+}
+
+// nodeEnvChecks is the outcome of the checks of a node
+type nodeEnvChecks struct {
+	Node   string
+	Checks []envCheck
+}
+
+// critical reports whether a critical check failed on the node
+func (n nodeEnvChecks) critical() bool {
+	for _, check := range n.Checks {
+		if !check.Passed && check.Critical {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the checks of the node, with the hints of the failed
+// ones
+func (n nodeEnvChecks) String() string {
+	verdict := "pass"
+	lines := make([]string, 0, len(n.Checks)+1)
+	for _, check := range n.Checks {
+		switch {
+		case check.Passed:
+			lines = append(lines, fmt.Sprintf("  %s: pass (%s)", check.Name, check.Detail))
+		case check.Critical:
+			verdict = "fail"
+			lines = append(lines, fmt.Sprintf("  %s: FAIL (%s), %s", check.Name, check.Detail, check.Hint))
+		default:
+			if verdict == "pass" {
+				verdict = "warn"
+			}
+			lines = append(lines, fmt.Sprintf("  %s: warn (%s), %s", check.Name, check.Detail, check.Hint))
+		}
+	}
+	return fmt.Sprintf("%s: %s\n%s", n.Node, verdict, strings.Join(lines, "\n"))
+}
+
+// envCheckReport describes the checks of every node, and whether a
+// critical check failed
+func envCheckReport(nodes []nodeEnvChecks) (string, bool) {
+	critical := false
+	lines := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		critical = critical || node.critical()
+		lines = append(lines, node.String())
+	}
+	return strings.Join(lines, "\n"), critical
+}
+
+// kernelCheck checks the kernel the node reports against the oldest one
+// cilium version runs on
+func kernelCheck(kernel string, v *semver.Version) envCheck {
+	min := minKernel
+	if v.LessThan(minKernelSince) {
+		min = minLegacyKernel
+	}
+	check := envCheck{Name: "kernel", Critical: true, Detail: kernel}
+	k, err := semver.NewVersion(kernelVersion.FindString(kernel))
+	if err != nil {
+		check.Hint = "the kernel version cannot be read, make sure the nodes run a " + min.String() + " or newer kernel"
+		return check
+	}
+	check.Passed = !k.LessThan(min)
+	check.Hint = fmt.Sprintf("cilium %s requires a %s or newer kernel, upgrade the kernel of the node", v, min)
+	return check
+}
+
+// nodeChecks turns the output of the preflight script into the checks of
+// a node. Only the CNI configurations of other CNIs conflict, unless
+// cilium is to be chained to them.
+func nodeChecks(out map[string]string, chaining bool) []envCheck {
+	checks := []envCheck{
+		{
+			Name:   "bpffs",
+			Passed: out["bpffs"] == "yes",
+			Detail: "/sys/fs/bpf " + map[string]string{"yes": "mounted"}[out["bpffs"]],
+			Hint:   "mount the BPF filesystem on /sys/fs/bpf at boot, or the BPF maps do not survive restarts of the agents",
+		},
+		{
+			Name:   "cgroup v2",
+			Passed: out["cgroup2"] == "yes",
+			Detail: "cgroup2 " + map[string]string{"yes": "mounted"}[out["cgroup2"]],
+			Hint:   "boot the node with the unified cgroup hierarchy, or socket load balancing cannot attach to the cgroups",
+		},
+	}
+
+	var conflicts []string
+	for _, file := range strings.Fields(out["cni"]) {
+		switch path.Ext(file) {
+		case ".conf", ".conflist", ".json":
+		default:
+			continue
+		}
+		if !strings.Contains(file, "cilium") {
+			conflicts = append(conflicts, file)
+		}
+	}
+	cni := envCheck{Name: "cni config", Passed: len(conflicts) == 0, Critical: !chaining, Detail: "no other CNI in /etc/cni/net.d"}
+	if len(conflicts) > 0 {
+		cni.Detail = strings.Join(conflicts, " ")
+		cni.Hint = "remove the other CNI and its configuration from /etc/cni/net.d, or install cilium in chaining mode"
+		if chaining {
+			cni.Hint = "cilium will be chained to this configuration"
+		}
+	}
+	checks = append(checks, cni)
+
+	networkd := envCheck{Name: "systemd-networkd", Passed: true, Detail: "not running"}
+	if out["networkd"] == "running" {
+		networkd.Detail = "running, ManageForeignRoutes=no"
+		if out["foreignroutes"] != "kept" {
+			networkd.Passed = false
+			networkd.Detail = "running, manages the foreign routes"
+			networkd.Hint = "set ManageForeignRoutes=no and ManageForeignRoutingPolicyRules=no in networkd.conf, or networkd removes the routes of cilium"
+		}
+	}
+	checks = append(checks, networkd)
+	if out["mtu"] != "" {
+		checks = append(checks, envCheck{Name: "mtu", Passed: true, Detail: fmt.Sprintf("%s on %s", out["mtu"], out["iface"])})
+	}
+	return checks
+}
+
+// parseEnvCheckOutput reads the key=value lines of the preflight script,
+// and reports whether it ran to its end
+func parseEnvCheckOutput(logs string) (map[string]string, bool) {
+	out := make(map[string]string)
+	for _, line := range strings.Split(logs, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			out[parts[0]] = parts[1]
+		}
+	}
+	return out, out["preflight"] == "done"
+}
+
+// envCheckDaemonSetSpec returns the privileged DaemonSet running the
+// preflight script on every node, with the host filesystems it reads
+func envCheckDaemonSetSpec(image string) *appsv1.DaemonSet {
+	labels := map[string]string{"app.kubernetes.io/name": envCheckDaemonSet, "app.kubernetes.io/managed-by": "meshery"}
+	privileged := true
+	grace := int64(0)
+	hostPath := func(name, p string) (corev1.Volume, corev1.VolumeMount) {
+		return corev1.Volume{Name: name, VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: p}}},
+			corev1.VolumeMount{Name: name, MountPath: "/host" + p, ReadOnly: true}
+	}
+	etcVolume, etcMount := hostPath("etc", "/etc")
+	runVolume, runMount := hostPath("run", "/run")
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: envCheckDaemonSet, Labels: labels},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					HostPID:                       true,
+					TerminationGracePeriodSeconds: &grace,
+					Tolerations:                   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+					Containers: []corev1.Container{{
+						Name:            "check",
+						Image:           image,
+						Command:         []string{"sh", "-c", envCheckScript},
+						SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+						VolumeMounts:    []corev1.VolumeMount{etcMount, runMount},
+					}},
+					Volumes: []corev1.Volume{etcVolume, runVolume},
+				},
+			},
+		},
+	}
+}
+
+// deleteDaemonSet removes the DaemonSet name of namespace along with its
+// pods, and waits for it to be gone
+func (h *Handler) deleteDaemonSet(ctx context.Context, namespace, name string) error {
+	background := metav1.DeletePropagationBackground
+	err := h.KubeClient.AppsV1().DaemonSets(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &background})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		_, err := h.KubeClient.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		return kerrors.IsNotFound(err), nil
+	}, ctx.Done())
+}
+
+// runEnvChecks checks every node for cilium version: its kernel from the
+// API, then its mounts, CNI configurations and systemd-networkd from a
+// short-lived privileged DaemonSet of namespace. The DaemonSet is removed
+// however the checks end. The nodes whose pod did not report in time are
+// reported as not checked. Unlike the pre-flight check of the upgrades,
+// nothing of cilium has to run on the nodes.
+func (h *Handler) runEnvChecks(e *adapter.Event, version, namespace, image string, chaining bool, timeout time.Duration) ([]nodeEnvChecks, error) {
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if image == "" {
+		image = defaultEnvCheckImage
+	}
+
+	nodes, outputs, err := h.runEnvCheckPods(e, namespace, image, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := h.podProblems(namespace, envCheckSelector)
+	results := make([]nodeEnvChecks, 0, len(nodes))
+	for _, node := range nodes {
+		result := nodeEnvChecks{Node: node.Name, Checks: []envCheck{kernelCheck(node.Status.NodeInfo.KernelVersion, v)}}
+		if out, ok := outputs[node.Name]; ok {
+			result.Checks = append(result.Checks, nodeChecks(out, chaining)...)
+		} else {
+			detail := "the preflight pod did not report in time"
+			if len(problems) > 0 {
+				detail = fmt.Sprintf("%s: %s", detail, strings.Join(problems, "; "))
+			}
+			result.Checks = append(result.Checks, envCheck{Name: "node checks", Detail: detail, Hint: "make sure the node can pull " + image + " or give another image"})
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// runEnvCheckPods runs the preflight script on every node from the
+// short-lived DaemonSet of namespace, and returns the nodes along with the
+// output of the script by node. The nodes whose pod did not report within
+// timeout have no output.
+func (h *Handler) runEnvCheckPods(e *adapter.Event, namespace, image string, timeout time.Duration) ([]corev1.Node, map[string]map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	nodes, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A DaemonSet left behind by an adapter which stopped mid-check is
+	// replaced
+	if err := h.deleteDaemonSet(ctx, namespace, envCheckDaemonSet); err != nil {
+		return nil, nil, err
+	}
+	h.streamProgress(e, "Running the Cilium preflight checks", fmt.Sprintf("Checking %d nodes", len(nodes.Items)))
+	if _, err := h.KubeClient.AppsV1().DaemonSets(namespace).Create(ctx, envCheckDaemonSetSpec(image), metav1.CreateOptions{}); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		// The context of the checks may be done already
+		cleanup, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := h.deleteDaemonSet(cleanup, namespace, envCheckDaemonSet); err != nil {
+			h.Log.Error(ErrEnvCheck(fmt.Errorf("the %s DaemonSet of namespace %s could not be removed: %w", envCheckDaemonSet, namespace, err)))
+		}
+	}()
+
+	outputs := make(map[string]map[string]string)
+	_ = wait.PollImmediateUntil(rolloutPollInterval, func() (bool, error) {
+		pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: envCheckSelector})
+		if err != nil {
+			return false, nil
+		}
+		for _, pod := range pods.Items {
+			if _, ok := outputs[pod.Spec.NodeName]; ok || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			logs, err := h.KubeClient.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+			if err != nil {
+				continue
+			}
+			if out, done := parseEnvCheckOutput(string(logs)); done {
+				outputs[pod.Spec.NodeName] = out
+			}
+		}
+		return len(outputs) >= len(nodes.Items), nil
+	}, ctx.Done())
+	return nodes.Items, outputs, nil
+}
+
+// preflight runs the preflight checks for the cilium version of the
+// request, or version, and reports them per node
+func (h *Handler) preflight(version, customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while running the Cilium preflight checks"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req preflightRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if req.Version != "" {
+		version = req.Version
+	}
+	timeout := defaultEnvCheckTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = parseTimeout(req.Timeout); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	results, err := h.runEnvChecks(e, version, namespace, req.Image, req.ChainingMode != "", timeout)
+	if err != nil {
+		fail(ErrEnvCheck(err))
+		return
+	}
+	report, critical := envCheckReport(results)
+	e.Summary = fmt.Sprintf("Every node is ready for Cilium %s", version)
+	if critical {
+		e.Summary = fmt.Sprintf("Some nodes are not ready for Cilium %s", version)
+	}
+	e.Details = report
+	h.StreamInfo(e)
+}
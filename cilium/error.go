@@ -2,6 +2,8 @@
 package cilium
 
 import (
+	"fmt"
+
 	"github.com/layer5io/meshkit/errors"
 )
 
@@ -124,6 +126,337 @@ var (
 
 	// ErrGettingReleaseCode implies error while fetching latest release for cilium cli
 	ErrGettingReleaseCode = "1030"
+
+	// ErrNoVersionsCode represents the error which is generated when
+	// no cilium version is available for installation
+	ErrNoVersionsCode = "1035"
+
+	// ErrParseCustomBodyCode represents the error which is generated when
+	// the custom body of an operation request cannot be parsed
+	ErrParseCustomBodyCode = "1051"
+
+	// ErrParseHelmValuesCode represents the error which is generated when
+	// the helm values overrides of an install request are malformed
+	ErrParseHelmValuesCode = "1054"
+
+	// ErrUninstallCiliumCode represents the error which is generated when
+	// some of the cilium resources could not be removed
+	ErrUninstallCiliumCode = "1055"
+
+	// ErrUpgradeCiliumCode represents the error which is generated when
+	// cilium cannot be upgraded
+	ErrUpgradeCiliumCode = "1056"
+
+	// ErrDowngradeCiliumCode represents the error which is generated when
+	// an upgrade would install an older cilium version
+	ErrDowngradeCiliumCode = "1057"
+
+	// ErrPreflightCheckCode represents the error which is generated when
+	// the pre-flight checks of an upgrade fail
+	ErrPreflightCheckCode = "1058"
+
+	// ErrRollbackCiliumCode represents the error which is generated when
+	// a failed install or upgrade cannot be rolled back
+	ErrRollbackCiliumCode = "1059"
+
+	// ErrRenderChartCode represents the error which is generated when
+	// the cilium chart cannot be rendered for a dry run
+	ErrRenderChartCode = "1060"
+
+	// ErrInvalidNamespaceCode represents the error which is generated when
+	// the requested cilium namespace is not a valid namespace name
+	ErrInvalidNamespaceCode = "1061"
+
+	// ErrInvalidImageCode represents the error which is generated when
+	// the image overrides of a request are malformed
+	ErrInvalidImageCode = "1062"
+
+	// ErrInvalidKubeProxyReplacementCode represents the error which is
+	// generated when the kube-proxy replacement parameters are invalid
+	ErrInvalidKubeProxyReplacementCode = "1063"
+
+	// ErrKubeProxyReplacementCode represents the error which is generated
+	// when the agents do not replace kube-proxy as requested
+	ErrKubeProxyReplacementCode = "1064"
+
+	// ErrInvalidRoutingModeCode represents the error which is generated
+	// when the routing parameters of an install are invalid
+	ErrInvalidRoutingModeCode = "1065"
+
+	// ErrInvalidIPAMModeCode represents the error which is generated
+	// when the IPAM parameters of an install are invalid
+	ErrInvalidIPAMModeCode = "1066"
+
+	// ErrChangeIPAMModeCode represents the error which is generated
+	// when an upgrade would change the IPAM mode of cilium
+	ErrChangeIPAMModeCode = "1067"
+
+	// ErrInvalidEncryptionCode represents the error which is generated
+	// when the encryption parameters of a request are invalid
+	ErrInvalidEncryptionCode = "1068"
+
+	// ErrConfigureEncryptionCode represents the error which is generated
+	// when the encryption of cilium cannot be configured
+	ErrConfigureEncryptionCode = "1069"
+
+	// ErrIPsecKeysCode represents the error which is generated when the
+	// IPsec keys of cilium cannot be created
+	ErrIPsecKeysCode = "1070"
+
+	// ErrRotateIPsecKeyCode represents the error which is generated when
+	// the IPsec key of cilium cannot be rotated
+	ErrRotateIPsecKeyCode = "1071"
+
+	// ErrCiliumNotInstalledCode represents the error which is generated
+	// when an operation configures cilium which is not installed
+	ErrCiliumNotInstalledCode = "1072"
+
+	// ErrInvalidHubbleCode represents the error which is generated when
+	// the hubble parameters of a request are invalid
+	ErrInvalidHubbleCode = "1073"
+
+	// ErrConfigureHubbleCode represents the error which is generated when
+	// hubble cannot be configured
+	ErrConfigureHubbleCode = "1074"
+
+	// ErrConfigureHubbleRelayCode represents the error which is generated
+	// when hubble relay cannot be configured
+	ErrConfigureHubbleRelayCode = "1075"
+
+	// ErrConfigureHubbleUICode represents the error which is generated
+	// when the hubble ui cannot be configured
+	ErrConfigureHubbleUICode = "1076"
+
+	// ErrInvalidClusterMeshCode represents the error which is generated
+	// when the clusters of a cluster mesh request are invalid
+	ErrInvalidClusterMeshCode = "1077"
+
+	// ErrClusterMeshCode represents the error which is generated when a
+	// step of the cluster mesh configuration fails
+	ErrClusterMeshCode = "1078"
+
+	// ErrInvalidChainingModeCode represents the error which is generated
+	// when the chaining parameters of an install are invalid
+	ErrInvalidChainingModeCode = "1079"
+
+	// ErrInvalidBGPCode represents the error which is generated when the
+	// BGP parameters of a request are invalid
+	ErrInvalidBGPCode = "1080"
+
+	// ErrConfigureBGPCode represents the error which is generated when the
+	// BGP control plane or its peering policies cannot be configured
+	ErrConfigureBGPCode = "1081"
+
+	// ErrInvalidEgressGatewayCode represents the error which is generated
+	// when the egress gateway parameters of a request are invalid
+	ErrInvalidEgressGatewayCode = "1082"
+
+	// ErrConfigureEgressGatewayCode represents the error which is
+	// generated when the egress gateway or its policies cannot be
+	// configured
+	ErrConfigureEgressGatewayCode = "1083"
+
+	// ErrInvalidBandwidthManagerCode represents the error which is
+	// generated when the installed cilium cannot run the requested
+	// bandwidth manager
+	ErrInvalidBandwidthManagerCode = "1084"
+
+	// ErrConfigureBandwidthManagerCode represents the error which is
+	// generated when the bandwidth manager cannot be configured
+	ErrConfigureBandwidthManagerCode = "1085"
+
+	// ErrInvalidHostFirewallCode represents the error which is generated
+	// when the host firewall parameters of a request are invalid
+	ErrInvalidHostFirewallCode = "1086"
+
+	// ErrConfigureHostFirewallCode represents the error which is generated
+	// when the host firewall or its policy cannot be configured
+	ErrConfigureHostFirewallCode = "1087"
+
+	// ErrInvalidL2AnnouncementsCode represents the error which is
+	// generated when the L2 announcements parameters of a request are
+	// invalid
+	ErrInvalidL2AnnouncementsCode = "1088"
+
+	// ErrConfigureL2AnnouncementsCode represents the error which is
+	// generated when the L2 announcements or their policies cannot be
+	// configured
+	ErrConfigureL2AnnouncementsCode = "1089"
+
+	// ErrInvalidLBIPAMCode represents the error which is generated when
+	// the load balancer IP pools of a request are invalid
+	ErrInvalidLBIPAMCode = "1090"
+
+	// ErrConfigureLBIPAMCode represents the error which is generated when
+	// the load balancer IP pools cannot be configured
+	ErrConfigureLBIPAMCode = "1091"
+
+	// ErrInvalidTetragonCode represents the error which is generated when
+	// the tetragon parameters of a request are invalid
+	ErrInvalidTetragonCode = "1092"
+
+	// ErrInstallTetragonCode represents the error which is generated when
+	// tetragon cannot be installed or uninstalled
+	ErrInstallTetragonCode = "1093"
+
+	// ErrEnvCheckCode represents the error which is generated when the
+	// preflight checks cannot run
+	ErrEnvCheckCode = "1094"
+
+	// ErrEnvCheckFailedCode represents the error which is generated when
+	// a critical preflight check failed before an install
+	ErrEnvCheckFailedCode = "1095"
+
+	// ErrConnectivityTestCode represents the error which is generated
+	// when the connectivity test cannot run or a check failed
+	ErrConnectivityTestCode = "1096"
+
+	// ErrCollectStatusCode represents the error which is generated when
+	// the status of cilium cannot be collected
+	ErrCollectStatusCode = "1097"
+
+	// ErrInvalidPlacementCode represents the error which is generated when
+	// the node selector, tolerations or affinity of a component are invalid
+	ErrInvalidPlacementCode = "1100"
+
+	// ErrInvalidResourcesCode represents the error which is generated when
+	// the resource requests or limits of a component are invalid
+	ErrInvalidResourcesCode = "1101"
+
+	// ErrInvalidOperatorOptionsCode represents the error which is generated
+	// when the high availability options of the operator are invalid
+	ErrInvalidOperatorOptionsCode = "1102"
+
+	// ErrCiliumAlreadyInstalledCode represents the error which is generated
+	// when cilium is already installed in a way the install cannot proceed
+	ErrCiliumAlreadyInstalledCode = "1103"
+
+	// ErrDetectCiliumCode represents the error which is generated when the
+	// cilium of the cluster cannot be detected
+	ErrDetectCiliumCode = "1104"
+
+	// ErrAdoptCiliumCode represents the error which is generated when an
+	// existing install cannot be taken over as a helm release
+	ErrAdoptCiliumCode = "1105"
+
+	// ErrClusterClientCode represents the error which is generated when the
+	// clients of the cluster of a kubeconfig context cannot be built
+	ErrClusterClientCode = "1106"
+
+	// ErrFetchValuesRefCode represents the error which is generated when
+	// the values referenced by a request cannot be read
+	ErrFetchValuesRefCode = "1109"
+
+	// ErrNodeCleanupCode represents the error which is generated when the
+	// state of cilium cannot be cleared from the nodes
+	ErrNodeCleanupCode = "1110"
+
+	// ErrCiliumStillInstalledCode represents the error which is generated
+	// when the nodes are to be cleaned up while cilium still runs
+	ErrCiliumStillInstalledCode = "1111"
+
+	// ErrInvalidPolicyEnforcementCode represents the error which is
+	// generated when the requested policy enforcement mode is invalid
+	ErrInvalidPolicyEnforcementCode = "1115"
+
+	// ErrApplyBaselinePolicyCode represents the error which is generated
+	// when the baseline policy of the always enforcement mode cannot be
+	// applied
+	ErrApplyBaselinePolicyCode = "1116"
+
+	// ErrDiscoverAPIServerCode represents the error which is generated
+	// when the address of the API server cannot be discovered
+	ErrDiscoverAPIServerCode = "1117"
+
+	// ErrServiceHandlingCode represents the error which is generated when
+	// the services are not handled once kube-proxy is replaced
+	ErrServiceHandlingCode = "1118"
+
+	// ErrInvalidInstallMethodCode represents the error which is generated
+	// when the requested install method or manifest source is unknown
+	ErrInvalidInstallMethodCode = "1119"
+
+	// ErrApplyManifestsCode represents the error which is generated when
+	// the manifests of a manifest install cannot be applied
+	ErrApplyManifestsCode = "1120"
+
+	// ErrManifestInventoryCode represents the error which is generated
+	// when the inventory of a manifest install cannot be read or written
+	ErrManifestInventoryCode = "1121"
+
+	// ErrCertManagerNotFoundCode represents the error which is generated
+	// when the certmanager TLS mode is requested without cert-manager
+	ErrCertManagerNotFoundCode = "1122"
+
+	// ErrHubbleIssuerCode represents the error which is generated when the
+	// cert-manager issuer of the certificates of hubble is not usable
+	ErrHubbleIssuerCode = "1123"
+
+	// ErrInvalidIngressControllerCode represents the error which is
+	// generated when the ingress controller cannot be enabled as requested
+	ErrInvalidIngressControllerCode = "1124"
+
+	// ErrConfigureIngressControllerCode represents the error which is
+	// generated when the ingress controller cannot be configured
+	ErrConfigureIngressControllerCode = "1125"
+
+	// ErrInvalidMutualAuthCode represents the error which is generated
+	// when the parameters of the mutual authentication are invalid
+	ErrInvalidMutualAuthCode = "1126"
+
+	// ErrConfigureMutualAuthCode represents the error which is generated
+	// when the mutual authentication cannot be configured
+	ErrConfigureMutualAuthCode = "1127"
+
+	// ErrSpireResourcesCode represents the error which is generated when
+	// the cluster lacks the resources of the SPIRE components
+	ErrSpireResourcesCode = "1128"
+
+	// ErrInvalidMTUCode represents the error which is generated when the
+	// requested MTU is out of range or does not fit the nodes
+	ErrInvalidMTUCode = "1129"
+
+	// ErrInvalidLoadBalancerCode represents the error which is generated
+	// when the load balancing parameters are invalid or conflict
+	ErrInvalidLoadBalancerCode = "1130"
+
+	// ErrPolicyNotEnforcedCode represents the error which is generated
+	// when the requests of a policy demo are not allowed and denied as
+	// the policy says
+	ErrPolicyNotEnforcedCode = "1131"
+
+	// ErrSampleAppUnhealthyCode represents the error which is generated
+	// when the pods of a sample app do not become ready or its services
+	// do not answer once it is applied
+	ErrSampleAppUnhealthyCode = "1132"
+
+	// ErrCiliumPolicyCode represents the error which is generated when
+	// cilium policies of a design are invalid or cannot be applied
+	ErrCiliumPolicyCode = "1133"
+
+	// ErrConvertSMICode represents the error which is generated when SMI
+	// resources cannot be converted into cilium policies
+	ErrConvertSMICode = "1134"
+
+	// ErrConvertNetworkPolicyCode represents the error which is generated
+	// when NetworkPolicies cannot be converted into cilium policies
+	ErrConvertNetworkPolicyCode = "1135"
+
+	// ErrListEndpointsCode represents the error which is generated when the
+	// CiliumEndpoints cannot be listed
+	ErrListEndpointsCode = "1136"
+
+	// ErrNodeIPAMCode represents the error which is generated when the IPAM
+	// of the CiliumNodes cannot be reported
+	ErrNodeIPAMCode = "1137"
+
+	// ErrLookupIdentityCode represents the error which is generated when a
+	// cilium identity cannot be looked up
+	ErrLookupIdentityCode = "1138"
+
+	// ErrNoVersions represents the error which is generated when
+	// no cilium version is available for installation
+	ErrNoVersions = errors.New(ErrNoVersionsCode, errors.Alert, []string{"No cilium version available"}, []string{"The adapter could not discover any stable cilium version to install"}, []string{"Github is unreachable or rate limiting the adapter"}, []string{"Verify network connectivity to github and restart the adapter"})
 )
 
 // ErrInstallCilium is the error for install mesh
@@ -238,3 +571,401 @@ func ErrGettingRelease(err error) error {
 	return errors.New(ErrGettingReleaseCode, errors.Alert, []string{"Could not get latest version"}, []string{err.Error()}, []string{"Latest version could not be found at the specified url"}, []string{"Verify network connectivity.", "Ensure github.com is reachable.", "Try retrying the operation."})
 }
 
+// ErrParseCustomBody is the error when the custom body of an operation request cannot be parsed
+func ErrParseCustomBody(err error) error {
+	return errors.New(ErrParseCustomBodyCode, errors.Alert, []string{"Error parsing the operation parameters"}, []string{err.Error()}, []string{"The custom body of the request is not valid YAML or JSON"}, []string{"Fix the syntax of the operation parameters"})
+}
+
+// ErrParseHelmValues is the error when the helm values overrides cannot be parsed
+func ErrParseHelmValues(err error) error {
+	return errors.New(ErrParseHelmValuesCode, errors.Alert, []string{"Error parsing the helm values"}, []string{err.Error()}, []string{"The values overrides are not a YAML or JSON document of chart values"}, []string{"Pass values as a map or as a YAML string, like the values.yaml of the cilium chart"})
+}
+
+// ErrUninstallCilium is the error when some of the cilium resources could not be removed
+func ErrUninstallCilium(err error) error {
+	return errors.New(ErrUninstallCiliumCode, errors.Alert, []string{"Error while uninstalling Cilium"}, []string{err.Error()}, []string{"The adapter is not allowed to delete the resources", "The cluster is unreachable"}, []string{"Check the permissions of the adapter", "Retry the uninstall, the resources already removed are skipped"})
+}
+
+// ErrUpgradeCilium is the error when cilium cannot be upgraded
+func ErrUpgradeCilium(err error) error {
+	return errors.New(ErrUpgradeCiliumCode, errors.Alert, []string{"Error while upgrading Cilium"}, []string{err.Error()}, []string{"Cilium was not installed through its helm chart", "The chart of the target version cannot be downloaded", "The agents did not become ready in time"}, []string{"Install Cilium through the adapter before upgrading it", "Check the logs of the cilium pods in kube-system"})
+}
+
+// ErrDowngradeCilium is the error when an upgrade would install an older cilium version
+func ErrDowngradeCilium(current, target string) error {
+	return errors.New(ErrDowngradeCiliumCode, errors.Alert, []string{"Refusing to downgrade Cilium"}, []string{fmt.Sprintf("Cilium %s is installed, which is newer than %s", current, target)}, []string{"The requested version is older than the installed one"}, []string{"Pick a newer version", "Set force to true to downgrade anyway"})
+}
+
+// ErrPreflightCheck is the error when the pre-flight checks of an upgrade fail
+func ErrPreflightCheck(err error) error {
+	return errors.New(ErrPreflightCheckCode, errors.Alert, []string{"Cilium pre-flight checks failed"}, []string{err.Error()}, []string{"The cluster is not ready for the target version, for example CRD versions are missing", "The images of the target version cannot be pulled"}, []string{"Check the logs of the cilium-pre-flight-check pods", "Follow the upgrade notes of the target version"})
+}
+
+// ErrRollbackCilium is the error when a failed install or upgrade cannot be rolled back
+func ErrRollbackCilium(err error) error {
+	return errors.New(ErrRollbackCiliumCode, errors.Alert, []string{"Error while rolling back Cilium"}, []string{err.Error()}, []string{"The previous revision of the release cannot be restored", "The agents of the previous version did not recover in time"}, []string{"Check the cilium pods in kube-system", "Roll back manually with helm rollback cilium -n kube-system"})
+}
+
+// ErrRenderChart is the error when the cilium chart cannot be rendered for a dry run
+func ErrRenderChart(err error) error {
+	return errors.New(ErrRenderChartCode, errors.Alert, []string{"Error while rendering the Cilium chart"}, []string{err.Error()}, []string{"The chart of the version cannot be downloaded", "The values are rejected by the chart templates"}, []string{"Ensure https://helm.cilium.io is reachable", "Check the values against the values.yaml of the chart"})
+}
+
+// ErrInvalidNamespace is the error when the requested cilium namespace is not a valid namespace name
+func ErrInvalidNamespace(err error) error {
+	return errors.New(ErrInvalidNamespaceCode, errors.Alert, []string{"Invalid namespace"}, []string{err.Error()}, []string{"The namespace is not a valid RFC 1123 label"}, []string{"Use at most 63 lowercase alphanumeric characters or '-', starting and ending with an alphanumeric character"})
+}
+
+// ErrInvalidImage is the error when the image overrides of a request are malformed
+func ErrInvalidImage(err error) error {
+	return errors.New(ErrInvalidImageCode, errors.Alert, []string{"Invalid image override"}, []string{err.Error()}, []string{"The registry, repository or tag does not form a valid image reference"}, []string{"Use references like registry.internal:5000/cilium/cilium:v1.14.3"})
+}
+
+// ErrInvalidKubeProxyReplacement is the error when the kube-proxy replacement parameters are invalid
+func ErrInvalidKubeProxyReplacement(err error) error {
+	return errors.New(ErrInvalidKubeProxyReplacementCode, errors.Alert, []string{"Invalid kube-proxy replacement parameters"}, []string{err.Error()}, []string{"The mode is not accepted by the cilium version", "The address of the API server is missing or malformed"}, []string{"Set kubeProxyReplacement to true or false, or to a mode of the cilium version", "Set k8sServiceHost and k8sServicePort to the address of the API server"})
+}
+
+// ErrKubeProxyReplacement is the error when the agents do not replace kube-proxy as requested
+func ErrKubeProxyReplacement(err error) error {
+	return errors.New(ErrKubeProxyReplacementCode, errors.Alert, []string{"Cilium does not replace kube-proxy"}, []string{err.Error()}, []string{"The kernel of the nodes lacks the features kube-proxy replacement needs", "The agents cannot reach the API server at k8sServiceHost"}, []string{"Run cilium status in an agent pod for the details", "Check the system requirements of kube-proxy replacement"})
+}
+
+// ErrInvalidRoutingMode is the error when the routing parameters of an install are invalid
+func ErrInvalidRoutingMode(err error) error {
+	return errors.New(ErrInvalidRoutingModeCode, errors.Alert, []string{"Invalid routing parameters"}, []string{err.Error()}, []string{"The routing mode is unknown", "Native routing misses the CIDR it routes in"}, []string{"Set routingMode to vxlan, geneve or native", "Set nativeRoutingCIDR or autoDirectNodeRoutes along with native routing"})
+}
+
+// ErrInvalidIPAMMode is the error when the IPAM parameters of an install are invalid
+func ErrInvalidIPAMMode(err error) error {
+	return errors.New(ErrInvalidIPAMModeCode, errors.Alert, []string{"Invalid IPAM parameters"}, []string{err.Error()}, []string{"The IPAM mode is unknown", "The parameters do not apply to the IPAM mode", "The cloud IPAM modes are combined with tunneling"}, []string{"Set ipamMode to cluster-pool, kubernetes, eni or azure", "Set the azure credentials along with the azure mode", "Use native routing with the eni and azure modes"})
+}
+
+// ErrChangeIPAMMode is the error when an upgrade would change the IPAM mode of cilium
+func ErrChangeIPAMMode(current, target string) error {
+	return errors.New(ErrChangeIPAMModeCode, errors.Alert, []string{"Cannot change the IPAM mode in place"}, []string{fmt.Sprintf("The upgrade would change the IPAM mode from %s to %s", current, target)}, []string{"Changing the IPAM mode reallocates the pod IPs, disrupting every running pod"}, []string{"Keep the IPAM mode of the installed release", "Set force to change it anyway, recreating the pods afterwards"})
+}
+
+// ErrInvalidEncryption is the error when the encryption parameters of a request are invalid
+func ErrInvalidEncryption(err error) error {
+	return errors.New(ErrInvalidEncryptionCode, errors.Alert, []string{"Invalid encryption parameters"}, []string{err.Error()}, []string{"The encryption type is neither wireguard nor ipsec", "The IPsec algorithm is unknown", "The cilium version does not support the requested encryption"}, []string{"Set encryption to wireguard or ipsec", "Set ipsecAlgorithm to gcm-aes or cbc-aes-sha256", "Use cilium 1.10 or later for WireGuard, 1.14 or later for node encryption"})
+}
+
+// ErrConfigureEncryption is the error when the encryption of cilium cannot be configured
+func ErrConfigureEncryption(err error) error {
+	return errors.New(ErrConfigureEncryptionCode, errors.Alert, []string{"Error while configuring the Cilium encryption"}, []string{err.Error()}, []string{"Cilium is not installed as a helm release", "The kernels of some nodes do not support the encryption", "The agents did not roll out in time"}, []string{"Install Cilium through the adapter first", "Run kernels with WireGuard support, 5.6 or later, or with the IPsec modules", "Check the per node encryption state and the logs of the agents"})
+}
+
+// ErrIPsecKeys is the error when the IPsec keys of cilium cannot be created
+func ErrIPsecKeys(err error) error {
+	return errors.New(ErrIPsecKeysCode, errors.Alert, []string{"Error while creating the Cilium IPsec keys"}, []string{err.Error()}, []string{"The adapter is not allowed to manage secrets in the namespace", "Random key material is not available"}, []string{"Grant the adapter the rights to create secrets in the namespace of cilium"})
+}
+
+// ErrRotateIPsecKey is the error when the IPsec key of cilium cannot be rotated
+func ErrRotateIPsecKey(err error) error {
+	return errors.New(ErrRotateIPsecKeyCode, errors.Alert, []string{"Error while rotating the Cilium IPsec key"}, []string{err.Error()}, []string{"Cilium does not encrypt with IPsec", "The keys of the secret are malformed or use an algorithm the adapter cannot generate", "The agents did not restart in time"}, []string{"Install Cilium with IPsec encryption first", "Check the cilium-ipsec-keys secret", "Check the logs of the agents"})
+}
+
+// ErrCiliumNotInstalled is the error when an operation configures cilium which is not installed in namespace
+func ErrCiliumNotInstalled(namespace string) error {
+	return errors.New(ErrCiliumNotInstalledCode, errors.Alert, []string{"Cilium is not installed, install cilium first"}, []string{fmt.Sprintf("There is no cilium helm release in namespace %s", namespace)}, []string{"Cilium was not installed yet", "Cilium was installed in another namespace", "Cilium was installed without helm"}, []string{"Install Cilium through the adapter first", "Set the namespace cilium was installed in"})
+}
+
+// ErrInvalidHubble is the error when the hubble parameters of a request are invalid
+func ErrInvalidHubble(err error) error {
+	return errors.New(ErrInvalidHubbleCode, errors.Alert, []string{"Invalid Hubble parameters"}, []string{err.Error()}, []string{"A Hubble metric is unknown", "Hubble metrics are requested without Hubble", "The TLS mode of Hubble Relay is unknown or misses its certificates"}, []string{"Use the metrics documented by cilium, like dns, drop, tcp, flow, icmp or http", "Set tlsMode to helm, certmanager along with the issuer, or secret after creating the certificate secrets"})
+}
+
+// ErrConfigureHubble is the error when hubble cannot be configured
+func ErrConfigureHubble(err error) error {
+	return errors.New(ErrConfigureHubbleCode, errors.Alert, []string{"Error while configuring Hubble"}, []string{err.Error()}, []string{"The agents did not roll out in time", "The Hubble server did not start on some nodes"}, []string{"Check the per node Hubble state and the logs of the agents"})
+}
+
+// ErrConfigureHubbleRelay is the error when hubble relay cannot be configured
+func ErrConfigureHubbleRelay(err error) error {
+	return errors.New(ErrConfigureHubbleRelayCode, errors.Alert, []string{"Error while configuring Hubble Relay"}, []string{err.Error()}, []string{"The relay did not become ready in time", "The certificates of the relay were not issued"}, []string{"Check the events and logs of the hubble-relay pods", "Check the issuer when using cert-manager"})
+}
+
+// ErrConfigureHubbleUI is the error when the hubble ui cannot be configured
+func ErrConfigureHubbleUI(err error) error {
+	return errors.New(ErrConfigureHubbleUICode, errors.Alert, []string{"Error while configuring Hubble UI"}, []string{err.Error()}, []string{"Hubble Relay is not enabled", "The ui did not become ready in time"}, []string{"Install Hubble Relay through the adapter first", "Check the events and logs of the hubble-ui pods"})
+}
+
+// ErrInvalidClusterMesh is the error when the clusters of a cluster mesh request are invalid
+func ErrInvalidClusterMesh(err error) error {
+	return errors.New(ErrInvalidClusterMeshCode, errors.Alert, []string{"Invalid cluster mesh parameters"}, []string{err.Error()}, []string{"The request does not name two distinct contexts", "The names or ids of the clusters collide", "The installed cilium is too old"}, []string{"Set the contexts of two clusters of the uploaded kubeconfig", "Set distinct names and ids between 1 and 255", "Upgrade cilium on both clusters"})
+}
+
+// ErrClusterMesh is the error when a step of the cluster mesh configuration fails on the cluster of context
+func ErrClusterMesh(context, step string, err error) error {
+	short := fmt.Sprintf("Cilium cluster mesh failed to %s", step)
+	if context != "" {
+		short = fmt.Sprintf("%s on context %s", short, context)
+	}
+	return errors.New(ErrClusterMeshCode, errors.Alert, []string{short}, []string{err.Error()}, []string{"The context is not part of the uploaded kubeconfig", "The api server is not reachable from the other cluster", "The clusters do not share their CA"}, []string{"Fix the failed step and run the operation again, the completed steps are kept"})
+}
+
+// ErrInvalidChainingMode is the error when the chaining parameters of an install are invalid
+func ErrInvalidChainingMode(err error) error {
+	return errors.New(ErrInvalidChainingModeCode, errors.Alert, []string{"Invalid CNI chaining parameters"}, []string{err.Error()}, []string{"The chaining mode is unknown", "The parameters conflict with the primary CNI addressing and routing the pods", "The cilium version does not support the combination"}, []string{"Set chainingMode to aws-cni or generic-veth", "Drop the IPAM and tunnel parameters in chaining mode", "Set chainingTarget or cniConfigMap with generic-veth"})
+}
+
+// ErrInvalidBGP is the error when the BGP parameters of a request are invalid
+func ErrInvalidBGP(err error) error {
+	return errors.New(ErrInvalidBGPCode, errors.Alert, []string{"Invalid BGP parameters"}, []string{err.Error()}, []string{"An ASN is reserved or out of range", "A peer address is not an IP", "The installed cilium has no BGP control plane"}, []string{"Use ASNs between 1 and 4294967294 other than 23456 and 65535", "Set the IP of every peer", "Upgrade cilium to 1.12 or later"})
+}
+
+// ErrConfigureBGP is the error when the BGP control plane or its peering policies cannot be configured
+func ErrConfigureBGP(err error) error {
+	return errors.New(ErrConfigureBGPCode, errors.Alert, []string{"Error while configuring the Cilium BGP control plane"}, []string{err.Error()}, []string{"The agents did not roll out in time", "The operator did not register the CiliumBGPPeeringPolicy CRD", "The adapter is not allowed to manage the peering policies"}, []string{"Check the logs of the cilium operator and agents", "Grant the adapter the rights on the ciliumbgppeeringpolicies"})
+}
+
+// ErrInvalidEgressGateway is the error when the egress gateway parameters of a request are invalid
+func ErrInvalidEgressGateway(err error) error {
+	return errors.New(ErrInvalidEgressGatewayCode, errors.Alert, []string{"Invalid egress gateway parameters"}, []string{err.Error()}, []string{"A selector, CIDR or IP of a policy is malformed", "The egress IP is not assigned to the egress node", "The installed cilium does not support the policy or does not replace kube-proxy"}, []string{"Check the policies of the request", "Assign the egress IP to an interface of the egress node", "Install cilium 1.12 or later with kube-proxy replacement"})
+}
+
+// ErrConfigureEgressGateway is the error when the egress gateway or its policies cannot be configured
+func ErrConfigureEgressGateway(err error) error {
+	return errors.New(ErrConfigureEgressGatewayCode, errors.Alert, []string{"Error while configuring the Cilium egress gateway"}, []string{err.Error()}, []string{"The agents did not roll out in time", "The operator did not register the egress policy CRD", "The adapter is not allowed to manage the egress policies"}, []string{"Check the logs of the cilium operator and agents", "Grant the adapter the rights on the cilium egress policies"})
+}
+
+// ErrInvalidBandwidthManager is the error when the installed cilium cannot run the requested bandwidth manager
+func ErrInvalidBandwidthManager(err error) error {
+	return errors.New(ErrInvalidBandwidthManagerCode, errors.Alert, []string{"Invalid bandwidth manager parameters"}, []string{err.Error()}, []string{"The installed cilium predates the bandwidth manager or its BBR option"}, []string{"Upgrade cilium to 1.12 or later"})
+}
+
+// ErrConfigureBandwidthManager is the error when the bandwidth manager cannot be configured
+func ErrConfigureBandwidthManager(err error) error {
+	return errors.New(ErrConfigureBandwidthManagerCode, errors.Alert, []string{"Error while configuring the Cilium bandwidth manager"}, []string{err.Error()}, []string{"The agents did not roll out in time", "The kernel of the nodes cannot run the bandwidth manager"}, []string{"Check the logs of the cilium agents", "Run a 5.1 or later kernel on the nodes"})
+}
+
+// ErrInvalidHostFirewall is the error when the host firewall parameters of a request are invalid
+func ErrInvalidHostFirewall(err error) error {
+	return errors.New(ErrInvalidHostFirewallCode, errors.Alert, []string{"Invalid host firewall parameters"}, []string{err.Error()}, []string{"A port or the node selector of the request is malformed", "The installed cilium predates the host firewall", "Enforce was requested before the host policy was applied"}, []string{"Check the allowed ports and the node selector of the request", "Upgrade cilium to 1.11 or later", "Enable the host firewall in audit mode first"})
+}
+
+// ErrConfigureHostFirewall is the error when the host firewall or its policy cannot be configured
+func ErrConfigureHostFirewall(err error) error {
+	return errors.New(ErrConfigureHostFirewallCode, errors.Alert, []string{"Error while configuring the Cilium host firewall"}, []string{err.Error()}, []string{"The agents did not roll out in time", "The host endpoints did not regenerate with the host policy", "The adapter is not allowed to manage the clusterwide network policies"}, []string{"Check the logs of the cilium agents", "Grant the adapter the rights on the cilium clusterwide network policies"})
+}
+
+// ErrInvalidL2Announcements is the error when the L2 announcements parameters of a request are invalid
+func ErrInvalidL2Announcements(err error) error {
+	return errors.New(ErrInvalidL2AnnouncementsCode, errors.Alert, []string{"Invalid L2 announcements parameters"}, []string{err.Error()}, []string{"A selector, interface or lease setting of the request is malformed", "The installed cilium predates the L2 announcements or does not replace kube-proxy"}, []string{"Check the policies and lease settings of the request", "Install cilium 1.14 or later with kube-proxy replacement"})
+}
+
+// ErrConfigureL2Announcements is the error when the L2 announcements or their policies cannot be configured
+func ErrConfigureL2Announcements(err error) error {
+	return errors.New(ErrConfigureL2AnnouncementsCode, errors.Alert, []string{"Error while configuring the Cilium L2 announcements"}, []string{err.Error()}, []string{"The agents did not roll out in time", "The operator did not register the announcement policy CRD", "The adapter is not allowed to manage the announcement policies"}, []string{"Check the logs of the cilium operator and agents", "Grant the adapter the rights on the cilium announcement policies"})
+}
+
+// ErrInvalidLBIPAM is the error when the load balancer IP pools of a request are invalid
+func ErrInvalidLBIPAM(err error) error {
+	return errors.New(ErrInvalidLBIPAMCode, errors.Alert, []string{"Invalid load balancer IP pools"}, []string{err.Error()}, []string{"A CIDR, range or selector of a pool is malformed", "The ranges of a pool overlap the ones of another pool", "The installed cilium predates the load balancer IP pools"}, []string{"Check the pools of the request against the pools of the cluster", "Upgrade cilium to 1.13 or later, or to 1.15 for start and stop ranges"})
+}
+
+// ErrConfigureLBIPAM is the error when the load balancer IP pools cannot be configured
+func ErrConfigureLBIPAM(err error) error {
+	return errors.New(ErrConfigureLBIPAMCode, errors.Alert, []string{"Error while configuring the Cilium load balancer IP pools"}, []string{err.Error()}, []string{"The CiliumLoadBalancerIPPool CRD is not registered", "The adapter is not allowed to manage the load balancer IP pools"}, []string{"Check the logs of the cilium operator", "Grant the adapter the rights on the cilium load balancer IP pools"})
+}
+
+// ErrInvalidTetragon is the error when the tetragon parameters of a request are invalid
+func ErrInvalidTetragon(err error) error {
+	return errors.New(ErrInvalidTetragonCode, errors.Alert, []string{"Invalid Tetragon parameters"}, []string{err.Error()}, []string{"The export, gRPC address or version of the request is malformed"}, []string{"Export the events to stdout or grpc, and give the gRPC address as host:port"})
+}
+
+// ErrInstallTetragon is the error when tetragon cannot be installed or uninstalled
+func ErrInstallTetragon(err error) error {
+	return errors.New(ErrInstallTetragonCode, errors.Alert, []string{"Error while installing Tetragon"}, []string{err.Error()}, []string{"The tetragon releases or chart cannot be fetched", "The tetragon agents did not roll out in time", "The tracing policy CRDs were not established"}, []string{"Verify network connectivity to github and to the cilium helm repository", "Check the logs of the tetragon agents and operator"})
+}
+
+// ErrEnvCheck is the error when the preflight checks cannot run
+func ErrEnvCheck(err error) error {
+	return errors.New(ErrEnvCheckCode, errors.Alert, []string{"Error while running the Cilium preflight checks"}, []string{err.Error()}, []string{"The adapter is not allowed to run privileged DaemonSets", "The nodes cannot be listed"}, []string{"Grant the adapter the rights on the DaemonSets and the pod logs of the cilium namespace", "Allow privileged pods in the cilium namespace"})
+}
+
+// ErrEnvCheckFailed is the error when a critical preflight check failed before an install
+func ErrEnvCheckFailed(report string) error {
+	return errors.New(ErrEnvCheckFailedCode, errors.Alert, []string{"Some nodes are not ready for Cilium"}, []string{report}, []string{"The kernel of a node is too old", "Another CNI is configured on a node"}, []string{"Follow the hints of the failed checks", "Install with force to ignore the preflight checks"})
+}
+
+// ErrConnectivityTest is the error when the connectivity test cannot run or a check failed
+func ErrConnectivityTest(err error) error {
+	return errors.New(ErrConnectivityTestCode, errors.Alert, []string{"Cilium connectivity test failed"}, []string{err.Error()}, []string{"The test pods cannot pull their images or be scheduled", "The datapath of cilium does not forward the traffic of a check", "The policies are not enforced"}, []string{"Check the report of every check and the status of cilium", "Give mirrored client and echo images, or skip the world checks on air-gapped clusters"})
+}
+
+// ErrCollectStatus is the error when the status of cilium cannot be collected
+func ErrCollectStatus(err error) error {
+	return errors.New(ErrCollectStatusCode, errors.Alert, []string{"Error while collecting the Cilium status"}, []string{err.Error()}, []string{"Cilium is not installed in the namespace", "The adapter is not allowed to list the agent pods"}, []string{"Check the namespace of the request", "Grant the adapter the rights on the pods of the cilium namespace"})
+}
+
+// ErrInvalidPlacement is the error when the placement of the cilium components is invalid
+func ErrInvalidPlacement(err error) error {
+	return errors.New(ErrInvalidPlacementCode, errors.Alert, []string{"Invalid placement of the Cilium components"}, []string{err.Error()}, []string{"The node selector, tolerations or affinity are misspelled or not valid kubernetes objects"}, []string{"Write the tolerations and the affinity as in a pod spec", "Check the operators and the effects against the kubernetes documentation"})
+}
+
+// ErrInvalidResources is the error when the resource requests or limits of the cilium components are invalid
+func ErrInvalidResources(err error) error {
+	return errors.New(ErrInvalidResourcesCode, errors.Alert, []string{"Invalid resources of the Cilium components"}, []string{err.Error()}, []string{"A component or a resource is misspelled, or a quantity is malformed or above its limit"}, []string{"Use cpu and memory quantities like 100m or 512Mi", "Keep the requests at or below the limits"})
+}
+
+// ErrInvalidOperatorOptions is the error when the high availability options of the operator are invalid
+func ErrInvalidOperatorOptions(err error) error {
+	return errors.New(ErrInvalidOperatorOptionsCode, errors.Alert, []string{"Invalid Cilium operator options"}, []string{err.Error()}, []string{"The replicas, anti-affinity or priority class of the operator are invalid or not supported by the cilium version"}, []string{"Set operatorAntiAffinity to hard or soft", "Use the name of an existing priority class"})
+}
+
+// ErrCiliumAlreadyInstalled is the error when the cilium found, described by detected, prevents the install, remedy being the way forward
+func ErrCiliumAlreadyInstalled(detected, remedy string) error {
+	return errors.New(ErrCiliumAlreadyInstalledCode, errors.Alert, []string{"Cilium is already installed"}, []string{detected}, []string{"Cilium was installed by another tool or in another version"}, []string{remedy})
+}
+
+// ErrDetectCilium is the error when the cilium of the cluster cannot be detected
+func ErrDetectCilium(err error) error {
+	return errors.New(ErrDetectCiliumCode, errors.Alert, []string{"Error while detecting Cilium"}, []string{err.Error()}, []string{"The adapter is not allowed to list the DaemonSets or the ConfigMaps"}, []string{"Grant the adapter the rights to read the DaemonSets and the ConfigMaps"})
+}
+
+// ErrAdoptCilium is the error when an existing install cannot be taken over as a helm release
+func ErrAdoptCilium(err error) error {
+	return errors.New(ErrAdoptCiliumCode, errors.Alert, []string{"Error while adopting the existing Cilium install"}, []string{err.Error()}, []string{"The adapter is not allowed to patch the resources of the existing install"}, []string{"Grant the adapter the rights to patch the cilium resources", "Remove the existing install and install cilium again"})
+}
+
+// ErrClusterClient is the error when the clients of the cluster of the kubeconfig context name cannot be built
+func ErrClusterClient(name string, err error) error {
+	return errors.New(ErrClusterClientCode, errors.Alert, []string{fmt.Sprintf("Unable to connect to the cluster of context %s", name)}, []string{err.Error()}, []string{"The context is missing from the kubeconfig uploaded to meshery", "The credentials of the context are invalid"}, []string{"Upload a kubeconfig holding the context", "Check the context with kubectl --context"})
+}
+
+// ErrFetchValuesRef is the error when the values referenced by ref cannot be read or parsed
+func ErrFetchValuesRef(ref string, err error) error {
+	return errors.New(ErrFetchValuesRefCode, errors.Alert, []string{"Unable to read the referenced Cilium values"}, []string{fmt.Sprintf("Could not read the values of %s", ref), err.Error()}, []string{"The url or the ConfigMap cannot be reached", "The values are not valid YAML"}, []string{"Check the valuesRef of the request", "Validate the values file with helm lint"})
+}
+
+// ErrNodeCleanup is the error when the state of cilium cannot be cleared from the nodes
+func ErrNodeCleanup(err error) error {
+	return errors.New(ErrNodeCleanupCode, errors.Alert, []string{"Error while cleaning up the nodes"}, []string{err.Error()}, []string{"The cleanup pods could not run on some nodes", "The adapter is not allowed to create privileged DaemonSets"}, []string{"Make sure the nodes can pull the cleanup image or give another image", "Run the cleanup again for the nodes which failed"})
+}
+
+// ErrCiliumStillInstalled is the error when the nodes are to be cleaned up while the agents still run in namespace
+func ErrCiliumStillInstalled(namespace string) error {
+	return errors.New(ErrCiliumStillInstalledCode, errors.Alert, []string{"Cilium is still installed"}, []string{fmt.Sprintf("The cilium agents still run in namespace %s", namespace)}, []string{"Cleaning up the nodes under running agents breaks their network"}, []string{"Uninstall cilium first", "Set force to true to clean up anyway"})
+}
+
+// ErrInvalidPolicyEnforcement is the error when the requested policy enforcement mode is invalid
+func ErrInvalidPolicyEnforcement(err error) error {
+	return errors.New(ErrInvalidPolicyEnforcementCode, errors.Alert, []string{"Invalid policy enforcement mode"}, []string{err.Error()}, []string{"The policyEnforcementMode of the request is not a mode of cilium"}, []string{"Use default, always or never", "Only set baselinePolicy along with the always mode"})
+}
+
+// ErrApplyBaselinePolicy is the error when the baseline policy of the always enforcement mode cannot be applied
+func ErrApplyBaselinePolicy(err error) error {
+	return errors.New(ErrApplyBaselinePolicyCode, errors.Alert, []string{"Error while applying the baseline policy"}, []string{err.Error()}, []string{"The Cilium CRDs are not registered yet", "The adapter is not allowed to create CiliumClusterwideNetworkPolicies"}, []string{"Apply a policy allowing the DNS of kube-system, the cluster cannot resolve names until then"})
+}
+
+// ErrDiscoverAPIServer is the error when the address of the API server cannot be discovered
+func ErrDiscoverAPIServer(err error) error {
+	return errors.New(ErrDiscoverAPIServerCode, errors.Alert, []string{"Unable to discover the address of the API server"}, []string{err.Error()}, []string{"The cluster does not publish the cluster-info ConfigMap", "The adapter reaches the API server through a loopback address"}, []string{"Set k8sServiceHost and k8sServicePort to the address the nodes reach the API server at"})
+}
+
+// ErrServiceHandling is the error when the services are not handled once kube-proxy is replaced
+func ErrServiceHandling(err error) error {
+	return errors.New(ErrServiceHandlingCode, errors.Alert, []string{"Cilium does not handle the services"}, []string{err.Error()}, []string{"The socket load balancer is not supported by the kernel of the nodes", "The agents cannot reach the API server at k8sServiceHost"}, []string{"Run cilium status --verbose in an agent pod for the details", "Keep kube-proxy until the services are handled"})
+}
+
+// ErrInvalidInstallMethod is the error when the requested install method or manifest source is unknown
+func ErrInvalidInstallMethod(err error) error {
+	return errors.New(ErrInvalidInstallMethodCode, errors.Alert, []string{"Invalid install method"}, []string{err.Error()}, []string{"The installMethod or manifestSource of the request is not known to the adapter"}, []string{"Set installMethod to helm or manifests", "Set manifestSource to render or repo, along with the manifests install method"})
+}
+
+// ErrApplyManifests is the error when the manifests of a manifest install cannot be applied
+func ErrApplyManifests(err error) error {
+	return errors.New(ErrApplyManifestsCode, errors.Alert, []string{"Error while applying the Cilium manifests"}, []string{err.Error()}, []string{"The adapter is not allowed to apply some of the resources", "A resource is owned by another field manager", "The pre-rendered manifests do not exist for the version"}, []string{"Grant the adapter the rights to create the resources of the chart", "Retry the operation, the resources already applied are recorded in the inventory"})
+}
+
+// ErrManifestInventory is the error when the inventory of a manifest install cannot be read or written
+func ErrManifestInventory(err error) error {
+	return errors.New(ErrManifestInventoryCode, errors.Alert, []string{"Error with the inventory of the Cilium manifests"}, []string{err.Error()}, []string{"The cilium-manifest-inventory ConfigMap was modified by hand", "The adapter is not allowed to manage ConfigMaps"}, []string{"Restore the ConfigMap, or remove the resources of cilium by hand and delete it"})
+}
+
+// ErrCertManagerNotFound is the error when the certmanager TLS mode is requested without cert-manager in the cluster
+func ErrCertManagerNotFound(err error) error {
+	return errors.New(ErrCertManagerNotFoundCode, errors.Alert, []string{"cert-manager is not installed"}, []string{err.Error()}, []string{"The CRDs of cert-manager are not registered in the cluster"}, []string{"Install cert-manager first", "Use the helm TLS mode to have the chart generate the certificates"})
+}
+
+// ErrHubbleIssuer is the error when the cert-manager issuer of the certificates of hubble is not usable
+func ErrHubbleIssuer(err error) error {
+	return errors.New(ErrHubbleIssuerCode, errors.Alert, []string{"Error with the issuer of the Hubble certificates"}, []string{err.Error()}, []string{"The issuer does not exist, or not in the namespace of cilium for an Issuer", "The adapter is not allowed to create cert-manager resources"}, []string{"Create the issuer or set issuerKind to match it", "Leave the issuer unset for the adapter to create a self-signed CA issuer"})
+}
+
+// ErrInvalidIngressController is the error when the ingress controller cannot be enabled as requested
+func ErrInvalidIngressController(err error) error {
+	return errors.New(ErrInvalidIngressControllerCode, errors.Alert, []string{"Invalid Cilium ingress controller parameters"}, []string{err.Error()}, []string{"The installed cilium version lacks the ingress controller or the requested mode", "The release does not replace kube-proxy or disables the L7 proxy"}, []string{"Upgrade cilium to 1.12 or later, 1.14 or later for the shared mode and the default class", "Install cilium with kubeProxyReplacement and the L7 proxy"})
+}
+
+// ErrConfigureIngressController is the error when the ingress controller cannot be configured
+func ErrConfigureIngressController(err error) error {
+	return errors.New(ErrConfigureIngressControllerCode, errors.Alert, []string{"Error while configuring the Cilium ingress controller"}, []string{err.Error()}, []string{"The agents or the Envoy proxies did not become ready", "No load balancer provider gives the shared ingress service an address"}, []string{"Check the cilium-envoy and agent pods", "Run a load balancer provider, like the LB IPAM of cilium or the one of the cloud"})
+}
+
+// ErrInvalidMutualAuth is the error when the parameters of the mutual authentication are invalid
+func ErrInvalidMutualAuth(err error) error {
+	return errors.New(ErrInvalidMutualAuthCode, errors.Alert, []string{"Invalid Cilium mutual authentication parameters"}, []string{err.Error()}, []string{"The installed cilium version lacks the mutual authentication", "The parameters of the SPIRE install are mixed with those of an existing server"}, []string{"Upgrade cilium to 1.14 or later", "Either give the serverAddress of an existing SPIRE server or configure the SPIRE install of the chart"})
+}
+
+// ErrConfigureMutualAuth is the error when the mutual authentication cannot be configured
+func ErrConfigureMutualAuth(err error) error {
+	return errors.New(ErrConfigureMutualAuthCode, errors.Alert, []string{"Error while configuring the Cilium mutual authentication"}, []string{err.Error()}, []string{"The agents cannot reach the SPIRE server", "The SPIRE agents do not expose their sockets at the configured paths"}, []string{"Check the logs of the cilium agents and of the SPIRE components", "Run cilium status --verbose in an agent pod"})
+}
+
+// ErrSpireResources is the error when the cluster lacks the resources of the SPIRE components
+func ErrSpireResources(err error) error {
+	return errors.New(ErrSpireResourcesCode, errors.Alert, []string{"The cluster cannot run SPIRE"}, []string{err.Error()}, []string{"The SPIRE server volume has no StorageClass to be provisioned from", "The nodes lack the resources to schedule the SPIRE pods"}, []string{"Set storageClass, create a default StorageClass or set dataStorage to false", "Add capacity to the cluster or point at an existing SPIRE server with serverAddress"})
+}
+
+// ErrInvalidMTU is the error when the requested MTU is out of range or does not fit the MTU of the nodes
+func ErrInvalidMTU(err error) error {
+	return errors.New(ErrInvalidMTUCode, errors.Alert, []string{"Invalid MTU"}, []string{err.Error()}, []string{"The MTU is out of the range the nodes support", "The MTU leaves no room for the tunnel headers on the node interfaces"}, []string{"Set mtu between 1280 and 9216, or leave it unset for cilium to detect it", "Set mtu at least 50 bytes below the MTU of the node interfaces, or use native routing"})
+}
+
+// ErrInvalidLoadBalancer is the error when the load balancing parameters are invalid or conflict with the routing
+func ErrInvalidLoadBalancer(err error) error {
+	return errors.New(ErrInvalidLoadBalancerCode, errors.Alert, []string{"Invalid load balancing parameters"}, []string{err.Error()}, []string{"The algorithm or the mode is unknown", "DSR is requested along with tunneling or without kube-proxy replacement", "The maglev table size is not one of the primes cilium accepts"}, []string{"Set loadBalancerAlgorithm to random or maglev and loadBalancerMode to snat, dsr or hybrid", "Use native routing and kubeProxyReplacement with dsr, hybrid and maglev", "Set maglevTableSize to a prime like 16381 or 65521"})
+}
+
+// ErrPolicyNotEnforced is the error when the requests of a policy demo show that the policy is not enforced
+func ErrPolicyNotEnforced(err error) error {
+	return errors.New(ErrPolicyNotEnforcedCode, errors.Alert, []string{"The policy is not enforced"}, []string{err.Error()}, []string{"The agents have not realized the policy yet", "The L7 proxy is disabled", "The pods of the demo are not managed by cilium"}, []string{"Run the operation again with a longer timeout", "Enable l7Proxy in the cilium values", "Restart the pods of the demo so that cilium manages them"})
+}
+
+// ErrSampleAppUnhealthy is the error when a sample app is applied but does not become healthy
+func ErrSampleAppUnhealthy(err error) error {
+	return errors.New(ErrSampleAppUnhealthyCode, errors.Alert, []string{"The sample app did not become healthy"}, []string{err.Error()}, []string{"The images of the sample app cannot be pulled from the cluster", "The containers of the sample app keep crashing", "The nodes lack the resources to schedule the sample app"}, []string{"Set registry to a mirror of the images of the sample app", "Look at the events of the pods, the sample app is left in place unless cleanup is set", "Run the operation again with a longer timeout"})
+}
+
+// ErrCiliumPolicy is the error when some cilium policies of a design are not applied or deleted
+func ErrCiliumPolicy(err error) error {
+	return errors.New(ErrCiliumPolicyCode, errors.Alert, []string{"Some Cilium policies were not applied"}, []string{err.Error()}, []string{"A policy sets fields the installed Cilium version does not know", "A policy is rejected by the API server", "Cilium is not installed"}, []string{"Fix the fields named in the error, the other policies were applied", "Install Cilium before applying its policies"})
+}
+
+// ErrConvertSMI is the error when SMI resources cannot be converted into cilium policies
+func ErrConvertSMI(err error) error {
+	return errors.New(ErrConvertSMICode, errors.Alert, []string{"The SMI resources could not be converted into Cilium policies"}, []string{err.Error()}, []string{"The resources are not valid SMI resources", "The resources use SMI constructs Cilium does not support"}, []string{"Provide the TrafficTargets along with the routes they refer to", "Look at the unsupported constructs reported, they are left out of the policies"})
+}
+
+// ErrConvertNetworkPolicy is the error when NetworkPolicies cannot be converted into cilium policies
+func ErrConvertNetworkPolicy(err error) error {
+	return errors.New(ErrConvertNetworkPolicyCode, errors.Alert, []string{"The NetworkPolicies could not be converted into Cilium policies"}, []string{err.Error()}, []string{"The manifest holds other resources than NetworkPolicies", "The NetworkPolicies are not valid", "The NetworkPolicies could not be listed"}, []string{"Provide NetworkPolicies only", "Make sure the adapter may list the NetworkPolicies of the namespace"})
+}
+
+// ErrListEndpoints is the error when the CiliumEndpoints cannot be listed
+func ErrListEndpoints(err error) error {
+	return errors.New(ErrListEndpointsCode, errors.Alert, []string{"The Cilium endpoints could not be listed"}, []string{err.Error()}, []string{"Cilium is not installed", "The adapter may not list the CiliumEndpoints", "The continue token expired"}, []string{"Make sure Cilium is installed and its CRDs are present", "Make sure the adapter may list the ciliumendpoints of the cilium.io group", "List again from the first page"})
+}
+
+// ErrNodeIPAM is the error when the IPAM of the CiliumNodes cannot be reported
+func ErrNodeIPAM(err error) error {
+	return errors.New(ErrNodeIPAMCode, errors.Alert, []string{"The IPAM of the Cilium nodes could not be reported"}, []string{err.Error()}, []string{"Cilium is not installed", "The adapter may not list the CiliumNodes or the CiliumEndpoints"}, []string{"Make sure Cilium is installed and its CRDs are present", "Make sure the adapter may list the ciliumnodes and ciliumendpoints of the cilium.io group"})
+}
+
+// ErrLookupIdentity is the error when a cilium identity cannot be looked up
+func ErrLookupIdentity(err error) error {
+	return errors.New(ErrLookupIdentityCode, errors.Alert, []string{"The Cilium identity could not be looked up"}, []string{err.Error()}, []string{"The identity or the pod does not exist", "Cilium allocates the identities in the kvstore rather than in CRDs", "The adapter may not read the CiliumIdentities or the CiliumEndpoints"}, []string{"Check the identity or the pod looked up", "Make sure the adapter may read the ciliumidentities and ciliumendpoints of the cilium.io group"})
+}
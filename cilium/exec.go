@@ -0,0 +1,99 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// agentContainer is the container of the agent pods running the cilium
+// daemon and its debug cli
+const agentContainer = "cilium-agent"
+
+// agentCLI runs the debug cli of the agent, which is cilium-dbg since
+// cilium 1.15 and cilium before
+const agentCLI = "cilium-dbg %[1]s 2>/dev/null || cilium %[1]s"
+
+// agentPod returns a running agent pod of namespace
+func (h *Handler) agentPod(ctx context.Context, namespace string) (*corev1.Pod, error) {
+	pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no running cilium agent in namespace %s", namespace)
+}
+
+// execAgentCLI runs the debug cli of a running agent of namespace with args,
+// like "status --brief", and returns its output
+func (h *Handler) execAgentCLI(ctx context.Context, namespace, args string) (string, error) {
+	if h.KubeClient == nil {
+		return "", ErrNilClient
+	}
+	pod, err := h.agentPod(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	return h.execPodCLI(pod, args)
+}
+
+// execPodCLI runs the debug cli of the agent pod with args
+func (h *Handler) execPodCLI(pod *corev1.Pod, args string) (string, error) {
+	return h.execPod(pod, "sh", "-c", fmt.Sprintf(agentCLI, args))
+}
+
+// execPod runs command in the agent container of pod and returns its output
+func (h *Handler) execPod(pod *corev1.Pod, command ...string) (string, error) {
+	return h.execContainer(pod, agentContainer, command...)
+}
+
+// execContainer runs command in container of pod and returns its output
+func (h *Handler) execContainer(pod *corev1.Pod, container string, command ...string) (string, error) {
+	req := h.KubeClient.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	restConfig := h.RestConfig
+	executor, err := remotecommand.NewSPDYExecutor(&restConfig, "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := executor.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr}); err != nil {
+		return "", fmt.Errorf("%s on pod %s: %w: %s", command[len(command)-1], pod.Name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
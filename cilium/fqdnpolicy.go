@@ -0,0 +1,300 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// fqdnDemoPod is the pod the requests of the DNS-aware policy demo
+	// are sent from, and fqdnDemoPolicy the policy restricting its egress
+	fqdnDemoPod    = "mediabot"
+	fqdnDemoPolicy = "fqdn"
+
+	// defaultFQDN is the name the demo pod may reach by default, and
+	// defaultControlFQDN the one it may not
+	defaultFQDN        = "api.github.com"
+	defaultControlFQDN = "cilium.io"
+)
+
+// fqdnPolicyRequest holds the parameters of the DNS-aware policy demo,
+// read from the custom body of the request
+type fqdnPolicyRequest struct {
+	// Namespace the demo runs in, the one of the request by default
+	Namespace string `yaml:"namespace"`
+
+	// FQDNs the demo pod may reach, api.github.com by default. Names
+	// starting with *. allow their subdomains.
+	FQDNs []string `yaml:"fqdns"`
+
+	// ControlFQDN is a name outside of FQDNs, which the demo pod must not
+	// reach once the policy is enforced
+	ControlFQDN string `yaml:"controlFQDN"`
+
+	// Image of the demo pod, which has to ship curl
+	Image string `yaml:"image"`
+
+	// Timeout bounds the wait for the pod and for the policy, like 2m
+	Timeout string `yaml:"timeout"`
+}
+
+// check fills the defaults of the request and fails if its names are not
+// valid or if the control name is allowed
+func (r *fqdnPolicyRequest) check() error {
+	if len(r.FQDNs) == 0 {
+		r.FQDNs = []string{defaultFQDN}
+	}
+	if r.ControlFQDN == "" {
+		r.ControlFQDN = defaultControlFQDN
+	}
+	if r.Image == "" {
+		r.Image = defaultClientImage
+	}
+	for _, name := range append(append([]string{}, r.FQDNs...), r.ControlFQDN) {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(name, "*.")); len(errs) > 0 {
+			return ErrSampleApp(fmt.Errorf("%q is not a DNS name: %s", name, strings.Join(errs, ", ")))
+		}
+	}
+	if strings.HasPrefix(r.ControlFQDN, "*.") {
+		return ErrSampleApp(fmt.Errorf("the control name %q has to be a single name", r.ControlFQDN))
+	}
+	for _, name := range r.FQDNs {
+		if name == r.ControlFQDN || (strings.HasPrefix(name, "*.") && strings.HasSuffix(r.ControlFQDN, name[1:])) {
+			return ErrSampleApp(fmt.Errorf("the control name %s is allowed by %s, choose a name outside of fqdns", r.ControlFQDN, name))
+		}
+	}
+	return nil
+}
+
+// fqdnPolicy returns the policy letting the pods labelled app=mediabot
+// resolve any name through kube-dns but only reach fqdns. It is built
+// rather than fetched, so the demo needs no embedded manifest offline.
+func fqdnPolicy(fqdns []string) *unstructured.Unstructured {
+	selectors := make([]interface{}, 0, len(fqdns))
+	for _, name := range fqdns {
+		if strings.HasPrefix(name, "*.") {
+			selectors = append(selectors, map[string]interface{}{"matchPattern": name})
+		} else {
+			selectors = append(selectors, map[string]interface{}{"matchName": name})
+		}
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": networkPolicyResource.GroupVersion().String(),
+		"kind":       "CiliumNetworkPolicy",
+		"metadata":   map[string]interface{}{"name": fqdnDemoPolicy},
+		"spec": map[string]interface{}{
+			"endpointSelector": labelSelector(map[string]string{"app": fqdnDemoPod}),
+			"egress": []interface{}{
+				map[string]interface{}{"toFQDNs": selectors},
+				map[string]interface{}{
+					"toEndpoints": []interface{}{labelSelector(map[string]string{
+						"k8s:io.kubernetes.pod.namespace": metav1.NamespaceSystem,
+						"k8s:k8s-app":                     "kube-dns",
+					})},
+					"toPorts": []interface{}{map[string]interface{}{
+						"ports": []interface{}{map[string]interface{}{"port": "53", "protocol": "ANY"}},
+						"rules": map[string]interface{}{
+							"dns": []interface{}{map[string]interface{}{"matchPattern": "*"}},
+						},
+					}},
+				},
+			},
+		},
+	}}
+}
+
+// fqdnDemoPodSpec returns the demo pod running image, labelled as the
+// sample app of namespace
+func fqdnDemoPodSpec(namespace, image string) *corev1.Pod {
+	labels := sampleAppLabels(config.CiliumFQDNPolicyOperation, namespace)
+	labels["app"] = fqdnDemoPod
+	grace := int64(0)
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: fqdnDemoPod, Namespace: namespace, Labels: labels},
+		Spec: corev1.PodSpec{
+			TerminationGracePeriodSeconds: &grace,
+			Containers: []corev1.Container{{
+				Name:    fqdnDemoPod,
+				Image:   image,
+				Command: []string{"sleep", "infinity"},
+			}},
+		},
+	}
+}
+
+// fqdnChecks requests every name of fqdns which is not a pattern, and the
+// control name, from pod until the names are answered and the control
+// name is not, or until timeout
+func (h *Handler) fqdnChecks(pod *corev1.Pod, fqdns []string, control string, timeout time.Duration) []connectivityCheck {
+	type probe struct {
+		name    string
+		allowed bool
+	}
+	var probes []probe
+	for _, name := range fqdns {
+		if !strings.HasPrefix(name, "*.") {
+			probes = append(probes, probe{name, true})
+		}
+	}
+	probes = append(probes, probe{control, false})
+
+	checks := make([]connectivityCheck, len(probes))
+	_ = wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		done := true
+		for i, p := range probes {
+			status := h.curlMethod(pod, fqdnDemoPod, "GET", "https://"+p.name)
+			verdict := "connected"
+			if httpDropped(status) {
+				verdict = "blocked"
+			}
+			passed := !httpDropped(status) && len(status) == 3
+			if !p.allowed {
+				passed = httpDropped(status)
+			}
+			checks[i] = connectivityCheck{Name: p.name, Passed: passed, Detail: fmt.Sprintf("%s (%s)", verdict, status)}
+			done = done && passed
+		}
+		return done, nil
+	})
+	return checks
+}
+
+// fqdnPolicyDemo deploys the demo pod along with the DNS-aware policy
+// letting it reach the names of the request only, and checks from the pod
+// which names it reaches. The pod and the policy are removed if del is
+// set.
+func (h *Handler) fqdnPolicyDemo(namespace, customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while running the DNS-aware policy demo"
+		if del {
+			e.Summary = "Error while removing the DNS-aware policy demo"
+		}
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req fqdnPolicyRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := req.check(); err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if req.Namespace != "" {
+		namespace = req.Namespace
+	}
+	if err := validateNamespace(namespace); err != nil {
+		fail(err)
+		return
+	}
+	if namespace == "" {
+		namespace = defaultSampleNamespace
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	if del {
+		results, err := h.removeSampleApp(ctx, namespace, config.CiliumFQDNPolicyOperation)
+		if err != nil {
+			fail(ErrSampleApp(err))
+			return
+		}
+		lines := make([]string, 0, len(results))
+		var failed []string
+		for _, r := range results {
+			lines = append(lines, r.String())
+			if r.Err != nil {
+				failed = append(failed, r.String())
+			}
+		}
+		if len(failed) > 0 {
+			fail(ErrSampleApp(fmt.Errorf("%s", strings.Join(failed, "; "))))
+			return
+		}
+		e.Summary = "DNS-aware policy demo removed successfully"
+		e.Details = fmt.Sprintf("Removed from namespace %s:\n%s", namespace, strings.Join(lines, "\n"))
+		if len(lines) == 0 {
+			e.Details = fmt.Sprintf("Nothing of the demo was found in namespace %s.", namespace)
+		}
+		h.StreamInfo(e)
+		return
+	}
+
+	h.streamProgress(e, "Applying the DNS-aware policy", fmt.Sprintf("%s may only reach %s", fqdnDemoPod, strings.Join(req.FQDNs, ", ")))
+	policy := fqdnPolicy(req.FQDNs)
+	policy.SetNamespace(namespace)
+	policy.SetLabels(sampleAppLabels(config.CiliumFQDNPolicyOperation, namespace))
+	if _, err := h.applyResource(ctx, networkPolicyResource, policy); err != nil {
+		fail(ErrSampleApp(fmt.Errorf("CiliumNetworkPolicy %s: %w", fqdnDemoPolicy, err)))
+		return
+	}
+
+	h.streamProgress(e, "Deploying the DNS-aware policy demo pod", fmt.Sprintf("Pod %s/%s running %s", namespace, fqdnDemoPod, req.Image))
+	if _, err := h.KubeClient.CoreV1().Pods(namespace).Create(ctx, fqdnDemoPodSpec(namespace, req.Image), metav1.CreateOptions{}); err != nil && !kerrors.IsAlreadyExists(err) {
+		fail(ErrSampleApp(err))
+		return
+	}
+	if err := h.waitForPodReady(namespace, fqdnDemoPod, timeout); err != nil {
+		if problems := h.podProblems(namespace, "app="+fqdnDemoPod); len(problems) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+		}
+		fail(ErrSampleApp(fmt.Errorf("the %s pod is not ready: %w", fqdnDemoPod, err)))
+		return
+	}
+	pod, err := h.KubeClient.CoreV1().Pods(namespace).Get(ctx, fqdnDemoPod, metav1.GetOptions{})
+	if err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+
+	h.streamProgress(e, "Checking the names the demo pod reaches", "")
+	checks := h.fqdnChecks(pod, req.FQDNs, req.ControlFQDN, timeout)
+	lines := make([]string, 0, len(checks))
+	passed := true
+	for _, c := range checks {
+		lines = append(lines, c.String())
+		passed = passed && c.Passed
+	}
+	if !passed {
+		fail(ErrPolicyNotEnforced(fmt.Errorf("%s", strings.Join(lines, "\n"))))
+		return
+	}
+	e.Summary = "DNS-aware policy enforced"
+	e.Details = fmt.Sprintf("%s/%s reaches %s but not %s:\n%s", namespace, fqdnDemoPod, strings.Join(req.FQDNs, ", "), req.ControlFQDN, strings.Join(lines, "\n"))
+	h.StreamInfo(e)
+}
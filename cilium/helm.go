@@ -0,0 +1,177 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+// helmDriver is the storage backend of the helm releases, the default of
+// both helm and meshkit
+const helmDriver = "secret"
+
+// downloadedCharts maps the repository, name and version of the charts
+// downloaded already to their downloadedChart, so that an operation
+// checking out a chart before applying it downloads it once
+var downloadedCharts sync.Map
+
+// downloadedChart is the archive of a chart downloaded already, along with
+// its digest
+type downloadedChart struct {
+	path   string
+	digest string
+}
+
+// helmActionConfig returns the configuration of the helm actions on the
+// releases of namespace, from installing them to reading their values. The
+// cluster is reached the same way as meshkit does.
+func (h *Handler) helmActionConfig(namespace string) (*action.Configuration, error) {
+	if h.helmConfig != nil {
+		return h.helmConfig, nil
+	}
+	settings := cli.New()
+	settings.KubeAPIServer = h.RestConfig.Host
+	settings.KubeToken = h.RestConfig.BearerToken
+	settings.KubeCaFile = h.RestConfig.CAFile
+	settings.SetNamespace(namespace)
+
+	actionConfig := new(action.Configuration)
+	err := actionConfig.Init(settings.RESTClientGetter(), namespace, helmDriver, func(format string, v ...interface{}) {
+		h.Log.Debug(fmt.Sprintf(format, v...))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return actionConfig, nil
+}
+
+// loadChart downloads, unless already cached, and loads the cilium chart
+// matching the given cilium version
+func (h *Handler) loadChart(version string) (*chart.Chart, error) {
+	chartPath, err := h.locateChart(config.HelmChartName, version)
+	if err != nil {
+		return nil, err
+	}
+	return loader.Load(chartPath)
+}
+
+// locateChart downloads, unless already cached, the chart of the given
+// cilium version from the helm repository of the handler and returns its
+// path. The repository is checked to publish the version first, so that a
+// mirror missing it is named in the error. The chart is pulled from an OCI
+// registry when the url of the repository is an oci:// one. The cilium
+// chart must have the digest of the request, if one is set.
+func (h *Handler) locateChart(name, version string) (string, error) {
+	repo := h.chartRepository()
+	if err := config.CheckChartVersion(context.Background(), repo, name, version); err != nil {
+		return "", err
+	}
+	digest := ""
+	if name == config.HelmChartName {
+		digest = h.chartDigest
+	}
+
+	key := fmt.Sprintf("%s/%s@%s", strings.TrimSuffix(repo.URL, "/"), name, config.ChartVersion(version))
+	ch, ok := downloadedCharts.Load(key)
+	if ok {
+		if _, err := os.Stat(ch.(downloadedChart).path); err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		var err error
+		if ch, err = downloadChart(repo, name, version, digest); err != nil {
+			return "", err
+		}
+		downloadedCharts.Store(key, ch)
+	}
+
+	if digest != "" && ch.(downloadedChart).digest != digest {
+		return "", config.ErrChartDigestMismatch(key, digest, ch.(downloadedChart).digest)
+	}
+	return ch.(downloadedChart).path, nil
+}
+
+// downloadChart downloads version of the chart name from repo. The digest
+// of a chart of an OCI registry is the one of its manifest, which must be
+// digest if set, else the one of its archive.
+func downloadChart(repo config.HelmRepository, name, version, digest string) (downloadedChart, error) {
+	settings := cli.New()
+	if repo.IsOCI() {
+		// The archives of the registries are kept apart from the ones
+		// of the helm repositories, which are named the same
+		path, manifestDigest, err := config.PullOCIChart(repo, name, version, digest, filepath.Join(settings.RepositoryCache, "oci"))
+		if err != nil {
+			return downloadedChart{}, err
+		}
+		return downloadedChart{path: path, digest: manifestDigest}, nil
+	}
+
+	opts := action.ChartPathOptions{
+		RepoURL:  repo.URL,
+		Username: repo.Username,
+		Password: repo.Password,
+		Version:  config.ChartVersion(version),
+	}
+	path, err := opts.LocateChart(name, settings)
+	if err != nil {
+		return downloadedChart{}, err
+	}
+	archiveDigest, err := fileDigest(path)
+	if err != nil {
+		return downloadedChart{}, err
+	}
+	return downloadedChart{path: path, digest: archiveDigest}, nil
+}
+
+// fileDigest returns the sha256 digest of the file at path, like
+// sha256:6d3f...
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// chartRepository returns the helm repository the charts are fetched from:
+// the one of the request, else the one of the environment
+func (h *Handler) chartRepository() config.HelmRepository {
+	if h.helmRepo != nil {
+		return *h.helmRepo
+	}
+	return config.DefaultHelmRepository()
+}
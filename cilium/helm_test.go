@@ -0,0 +1,104 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"github.com/layer5io/meshkit/config/provider"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// testChartTemplate renders the values the tests read back
+const testChartTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cilium-config
+data:
+  operator-replicas: "{{ .Values.operator.replicas }}"
+`
+
+// useTestHelm points h at a helm repository publishing a cilium chart of
+// every version, and keeps the releases of namespace in memory
+func useTestHelm(t *testing.T, h *Handler, namespace string, versions ...string) {
+	t.Helper()
+	for _, env := range []string{"HELM_CACHE_HOME", "HELM_CONFIG_HOME", "HELM_DATA_HOME"} {
+		t.Setenv(env, t.TempDir())
+	}
+
+	dir := t.TempDir()
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+	index := repo.NewIndexFile()
+	for _, version := range versions {
+		ch := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: config.HelmChartName, Version: config.ChartVersion(version), AppVersion: version},
+			Values:   map[string]interface{}{"operator": map[string]interface{}{"replicas": 2}},
+			Templates: []*chart.File{
+				{Name: "templates/config.yaml", Data: []byte(testChartTemplate)},
+			},
+		}
+		path, err := chartutil.Save(ch, dir)
+		if err != nil {
+			t.Fatalf("saving the chart: %v", err)
+		}
+		digest, err := provenance.DigestFile(path)
+		if err != nil {
+			t.Fatalf("digest of the chart: %v", err)
+		}
+		if err := index.MustAdd(ch.Metadata, filepath.Base(path), srv.URL, digest); err != nil {
+			t.Fatalf("indexing the chart: %v", err)
+		}
+	}
+	if err := index.WriteFile(filepath.Join(dir, "index.yaml"), 0600); err != nil {
+		t.Fatalf("writing the index: %v", err)
+	}
+	h.helmRepo = &config.HelmRepository{URL: srv.URL}
+
+	releases := driver.NewMemory()
+	releases.SetNamespace(namespace)
+	h.helmConfig = &action.Configuration{
+		Releases:     storage.Init(releases),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: ioutil.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(string, ...interface{}) {},
+	}
+}
+
+// useMeshConfig gives h the in memory config of the mesh the installs read
+func useMeshConfig(t *testing.T, h *Handler) {
+	t.Helper()
+	cfg, err := provider.NewInMem(provider.Options{})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if err := cfg.SetObject(adapter.MeshSpecKey, map[string]interface{}{}); err != nil {
+		t.Fatalf("mesh spec: %v", err)
+	}
+	h.Config = cfg
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// helmRepoOptions point an operation to a mirror of the helm repository.
+// They are part of the custom body of every request.
+type helmRepoOptions struct {
+	// HelmRepo is the url of the mirror, the repository of the
+	// environment by default. An oci:// url pulls the charts from an OCI
+	// registry, like oci://registry.internal/charts.
+	HelmRepo string `yaml:"helmRepo"`
+
+	// HelmRepoSecret is the Secret holding the username and the password
+	// of the mirror, as namespace/name. An image pull secret, of type
+	// kubernetes.io/dockerconfigjson, is read for the host of the mirror.
+	HelmRepoSecret string `yaml:"helmRepoSecret"`
+
+	// ChartDigest is the digest the cilium chart must have, like
+	// sha256:6d3f...: the digest of its manifest in an OCI registry, else
+	// the digest of its archive
+	ChartDigest string `yaml:"chartDigest"`
+}
+
+// set reports whether the options override the repository
+func (o helmRepoOptions) set() bool {
+	return o.HelmRepo != "" || o.HelmRepoSecret != "" || o.ChartDigest != ""
+}
+
+// dockerConfigCredentials returns the username and the password of host
+// in the .dockerconfigjson of an image pull secret
+func dockerConfigCredentials(data []byte, host string) (string, string, error) {
+	var config struct {
+		Auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", err
+	}
+	for key, auth := range config.Auths {
+		// The hosts are keyed with or without a scheme and a path
+		if u, err := url.Parse(key); err == nil && u.Host != "" {
+			key = u.Host
+		}
+		if strings.SplitN(key, "/", 2)[0] != host {
+			continue
+		}
+		if auth.Username != "" || auth.Password != "" {
+			return auth.Username, auth.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("the auth of %s is not base64: %w", key, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("the auth of %s is not of the form username:password", key)
+		}
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("no credentials for %s", host)
+}
+
+// withHelmRepo returns a handler fetching the charts from the repository
+// of the options, whose credentials are read from the cluster of h
+func (h *Handler) withHelmRepo(o helmRepoOptions) (*Handler, error) {
+	repo := config.DefaultHelmRepository()
+	if o.HelmRepo != "" && o.HelmRepo != repo.URL {
+		// The credentials of the environment belong to its repository
+		repo = config.HelmRepository{URL: o.HelmRepo}
+	}
+	if err := repo.Validate(); err != nil {
+		return nil, err
+	}
+
+	if o.HelmRepoSecret != "" {
+		parts := strings.Split(o.HelmRepoSecret, "/")
+		if len(parts) != 2 || validateNamespace(parts[0]) != nil || parts[1] == "" {
+			return nil, config.ErrInvalidHelmRepo(repo.URL, fmt.Errorf("helmRepoSecret %q is not of the form namespace/name", o.HelmRepoSecret))
+		}
+		if h.KubeClient == nil {
+			return nil, ErrNilClient
+		}
+		secret, err := h.KubeClient.CoreV1().Secrets(parts[0]).Get(context.Background(), parts[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, config.ErrInvalidHelmRepo(repo.URL, fmt.Errorf("reading helmRepoSecret: %w", err))
+		}
+		if secret.Type == corev1.SecretTypeDockerConfigJson {
+			u, _ := url.Parse(repo.URL)
+			if repo.Username, repo.Password, err = dockerConfigCredentials(secret.Data[corev1.DockerConfigJsonKey], u.Host); err != nil {
+				return nil, config.ErrInvalidHelmRepo(repo.URL, fmt.Errorf("reading helmRepoSecret: %w", err))
+			}
+		} else {
+			repo.Username = string(secret.Data["username"])
+			repo.Password = string(secret.Data["password"])
+		}
+		if repo.Username == "" && repo.Password == "" {
+			return nil, config.ErrInvalidHelmRepo(repo.URL, fmt.Errorf("the secret %s holds neither a username nor a password", o.HelmRepoSecret))
+		}
+	}
+
+	if o.ChartDigest != "" {
+		if err := config.ValidateDigest(o.ChartDigest); err != nil {
+			return nil, err
+		}
+	}
+
+	c := *h
+	c.helmRepo = &repo
+	c.chartDigest = o.ChartDigest
+	return &c, nil
+}
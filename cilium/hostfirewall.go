@@ -0,0 +1,323 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// hostPolicyName is the name of the baseline host policy applied along
+// with the host firewall
+const hostPolicyName = "meshery-host-firewall"
+
+var (
+	// hostFirewallSince is the first version of the chart taking the host
+	// firewall as a map
+	hostFirewallSince = semver.MustParse("1.11.0")
+
+	// clusterwidePolicyResource is the resource of the
+	// CiliumClusterwideNetworkPolicies
+	clusterwidePolicyResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2", Resource: "ciliumclusterwidenetworkpolicies"}
+
+	// hostEssentialPorts are the ports the baseline host policy always
+	// allows from anywhere: ssh, the API server and the kubelet
+	hostEssentialPorts = []string{"22/TCP", "6443/TCP", "10250/TCP"}
+)
+
+// hostFirewallRequest holds the parameters of the cilium host firewall
+// operation, read from the custom body of the request
+type hostFirewallRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Audit turns the policy audit mode on, so that the flows the host
+	// policy would deny are only reported. The audit mode applies to every
+	// endpoint, not only to the hosts.
+	Audit bool `yaml:"audit"`
+
+	// Enforce turns the policy audit mode off once the flows were
+	// reviewed, leaving the host policy as it is
+	Enforce bool `yaml:"enforce"`
+
+	// NodeSelector selects the nodes the host policy applies to, every
+	// node by default
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+
+	// AllowedPorts are allowed from anywhere along with ssh, the API
+	// server and the kubelet, like 30000-32767/TCP or 53/UDP
+	AllowedPorts []string `yaml:"allowedPorts"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the host
+	// endpoints fail to regenerate, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// hostPort parses a port of the host policy, like 22/TCP or
+// 30000-32767/TCP, into its cilium port rule
+func hostPort(port string) (map[string]interface{}, error) {
+	parts := strings.SplitN(port, "/", 2)
+	protocol := "TCP"
+	if len(parts) == 2 {
+		protocol = strings.ToUpper(parts[1])
+	}
+	switch protocol {
+	case "TCP", "UDP", "SCTP", "ANY":
+	default:
+		return nil, fmt.Errorf("port %q: unknown protocol %q", port, protocol)
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	rule := map[string]interface{}{"protocol": protocol}
+	for i, bound := range bounds {
+		n, err := strconv.Atoi(bound)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("port %q is not a port or a port range", port)
+		}
+		if i == 0 {
+			rule["port"] = bound
+		} else {
+			rule["endPort"] = int64(n)
+		}
+	}
+	return rule, nil
+}
+
+// hostPolicy builds the baseline host policy: the nodes, the health
+// checks and the tunnels reach the hosts, the essential ports and the
+// allowed ports of the request are open to everyone. Egress is not
+// restricted.
+func (r hostFirewallRequest) hostPolicy() (*unstructured.Unstructured, error) {
+	if err := validateLabels(r.NodeSelector); err != nil {
+		return nil, ErrInvalidHostFirewall(fmt.Errorf("node selector: %w", err))
+	}
+	ports := make([]interface{}, 0, len(hostEssentialPorts)+len(r.AllowedPorts))
+	for _, port := range append(append([]string{}, hostEssentialPorts...), r.AllowedPorts...) {
+		rule, err := hostPort(port)
+		if err != nil {
+			return nil, ErrInvalidHostFirewall(err)
+		}
+		ports = append(ports, rule)
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": clusterwidePolicyResource.GroupVersion().String(),
+		"kind":       "CiliumClusterwideNetworkPolicy",
+		"metadata":   map[string]interface{}{"name": hostPolicyName},
+		"spec": map[string]interface{}{
+			"description":  "Baseline host policy applied by Meshery along with the host firewall",
+			"nodeSelector": labelSelector(r.NodeSelector),
+			"ingress": []interface{}{
+				map[string]interface{}{"fromEntities": []interface{}{"remote-node", "health"}},
+				map[string]interface{}{
+					"fromEntities": []interface{}{"all"},
+					"toPorts":      []interface{}{map[string]interface{}{"ports": ports}},
+				},
+			},
+		},
+	}}, nil
+}
+
+// hostFirewallValues returns the chart values of version enabling the host
+// firewall, in policy audit mode if audit is set
+func hostFirewallValues(version string, enabled, audit bool) (map[string]interface{}, error) {
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if v.LessThan(hostFirewallSince) {
+		return nil, ErrInvalidHostFirewall(fmt.Errorf("cilium %s is installed, the host firewall requires %s", version, hostFirewallSince))
+	}
+	return map[string]interface{}{
+		"hostFirewall":    map[string]interface{}{"enabled": enabled},
+		"policyAuditMode": audit,
+	}, nil
+}
+
+// hostEndpointProbe probes whether the agent has regenerated its host
+// endpoint with the host policy
+func (h *Handler) hostEndpointProbe(pod *corev1.Pod) (string, bool) {
+	out, err := h.execPodCLI(pod, "endpoint list -o json")
+	if err != nil {
+		return err.Error(), false
+	}
+	var endpoints []struct {
+		Status struct {
+			State    string `json:"state"`
+			Identity struct {
+				Labels []string `json:"labels"`
+			} `json:"identity"`
+			Policy struct {
+				Realized struct {
+					PolicyEnabled string `json:"policy-enabled"`
+				} `json:"realized"`
+			} `json:"policy"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(out), &endpoints); err != nil {
+		return fmt.Sprintf("unreadable endpoint list: %s", err), false
+	}
+	for _, ep := range endpoints {
+		for _, label := range ep.Status.Identity.Labels {
+			if label != "reserved:host" {
+				continue
+			}
+			enforced := ep.Status.Policy.Realized.PolicyEnabled
+			state := fmt.Sprintf("host endpoint %s, policy enforcement %s", ep.Status.State, enforced)
+			return state, ep.Status.State == "ready" && enforced != "" && enforced != "none"
+		}
+	}
+	return "no host endpoint", false
+}
+
+// waitForHostEndpoints waits for the host endpoint of every agent of
+// namespace to regenerate with the host policy, and returns the last state
+// of every node
+func (h *Handler) waitForHostEndpoints(e *adapter.Event, namespace string, timeout time.Duration) ([]agentState, error) {
+	states, err := h.waitForAgentProbe(e, namespace, "their host endpoint", timeout, h.hostEndpointProbe)
+	if err != nil {
+		return states, fmt.Errorf("the host endpoints did not regenerate on every agent: %w", err)
+	}
+	return states, nil
+}
+
+// hostFirewall applies the baseline host policy then enables the host
+// firewall on the installed release, optionally in policy audit mode, and
+// waits for the host endpoints to regenerate on every node. Enforce turns
+// the audit mode off afterwards. When deleted, the host firewall is
+// disabled along with the audit mode and the baseline host policy removed.
+func (h *Handler) hostFirewall(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium host firewall"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req hostFirewallRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if req.Audit && req.Enforce {
+		fail(ErrInvalidHostFirewall(fmt.Errorf("audit and enforce are exclusive")))
+		return
+	}
+	policy, err := req.hostPolicy()
+	if err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+
+	if del {
+		version, _, err := h.reconfigure(e, namespace, timeout, func(version string) (map[string]interface{}, error) {
+			return hostFirewallValues(version, false, false)
+		})
+		if err != nil {
+			fail(ErrConfigureHostFirewall(err))
+			return
+		}
+		r := newUninstallResult("CiliumClusterwideNetworkPolicy", hostPolicyName, h.DynamicKubeClient.Resource(clusterwidePolicyResource).Delete(ctx, hostPolicyName, metav1.DeleteOptions{}))
+		if r.Err != nil {
+			fail(ErrConfigureHostFirewall(fmt.Errorf("the host firewall is disabled but its policy could not be removed: %w", r.Err)))
+			return
+		}
+		e.Summary = "Cilium host firewall disabled successfully"
+		e.Details = fmt.Sprintf("The host firewall no longer runs on the agents of Cilium %s.\n%s", version, r)
+		h.StreamInfo(e)
+		return
+	}
+
+	var results []string
+	if req.Enforce {
+		if _, err := h.DynamicKubeClient.Resource(clusterwidePolicyResource).Get(ctx, hostPolicyName, metav1.GetOptions{}); err != nil {
+			fail(ErrInvalidHostFirewall(fmt.Errorf("the host policy %s is not applied, enable the host firewall in audit mode first: %w", hostPolicyName, err)))
+			return
+		}
+	} else {
+		// The policy goes first, so that the hosts are never firewalled
+		// without it
+		stat, err := h.applyResource(ctx, clusterwidePolicyResource, policy)
+		if err != nil {
+			fail(ErrConfigureHostFirewall(err))
+			return
+		}
+		results = append(results, fmt.Sprintf("CiliumClusterwideNetworkPolicy %s: %s", hostPolicyName, stat))
+	}
+
+	version, rollback, err := h.reconfigure(e, namespace, timeout, func(version string) (map[string]interface{}, error) {
+		return hostFirewallValues(version, true, req.Audit)
+	})
+	if err == nil {
+		var states []agentState
+		states, err = h.waitForHostEndpoints(e, namespace, timeout)
+		results = append(results, agentStateDetails("Host endpoint per node", states))
+		if err != nil && len(states) > 0 {
+			err = fmt.Errorf("%w\n%s", err, strings.Join(results, "\n"))
+		}
+	}
+	if err != nil {
+		fail(ErrConfigureHostFirewall(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+
+	switch {
+	case req.Audit:
+		e.Summary = "Cilium host firewall enabled in audit mode"
+		results = append(results, "The flows the host policy denies are only reported, review them then run the operation again with enforce.")
+	case req.Enforce:
+		e.Summary = "Cilium host firewall now enforces the host policy"
+	default:
+		e.Summary = "Cilium host firewall enabled successfully"
+	}
+	e.Details = fmt.Sprintf("The host firewall runs on the agents of Cilium %s.\n%s", version, strings.Join(results, "\n"))
+	h.StreamInfo(e)
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+// hubbleMetrics are the metrics hubble exports, which may be followed by
+// their options like dns:query;ignoreAAAA
+var hubbleMetrics = map[string]bool{
+	"dns":               true,
+	"drop":              true,
+	"tcp":               true,
+	"flow":              true,
+	"flows-to-world":    true,
+	"port-distribution": true,
+	"icmp":              true,
+	"http":              true,
+	"httpV2":            true,
+	"kafka":             true,
+	"policy":            true,
+}
+
+// hubbleOptions enables hubble, the observability layer of cilium. They
+// are part of the custom body of the install requests and of the hubble
+// operation.
+type hubbleOptions struct {
+	// Hubble enables hubble on every agent
+	Hubble bool `yaml:"hubble"`
+
+	// HubbleMetrics are the metrics hubble exports, like dns or
+	// http:sourceContext=pod
+	HubbleMetrics []string `yaml:"hubbleMetrics"`
+}
+
+// values translates the options into chart values
+func (o hubbleOptions) values() (map[string]interface{}, error) {
+	if !o.Hubble {
+		if len(o.HubbleMetrics) > 0 {
+			return nil, ErrInvalidHubble(fmt.Errorf("hubbleMetrics require hubble to be enabled"))
+		}
+		return nil, nil
+	}
+
+	hubble := map[string]interface{}{"enabled": true}
+	if len(o.HubbleMetrics) > 0 {
+		metrics := make([]interface{}, 0, len(o.HubbleMetrics))
+		for _, metric := range o.HubbleMetrics {
+			name := strings.SplitN(metric, ":", 2)[0]
+			if !hubbleMetrics[name] {
+				return nil, ErrInvalidHubble(fmt.Errorf("unknown hubble metric %q", name))
+			}
+			metrics = append(metrics, metric)
+		}
+		hubble["metrics"] = map[string]interface{}{"enabled": metrics}
+	}
+	return map[string]interface{}{"hubble": hubble}, nil
+}
+
+// hubbleRequest holds the parameters of the cilium hubble operation, read
+// from the custom body of the request
+type hubbleRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// HubbleMetrics are the metrics hubble exports
+	HubbleMetrics []string `yaml:"hubbleMetrics"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if hubble
+	// fails to start, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+
+	hubbleTLSOptions `yaml:",inline"`
+}
+
+// waitForHubble waits for the hubble server of every agent of namespace to
+// be up, and returns the last state of every node
+func (h *Handler) waitForHubble(e *adapter.Event, namespace string, timeout time.Duration) ([]agentState, error) {
+	states, err := h.waitForAgentStates(e, namespace, "Hubble", timeout, func(state string) bool {
+		return strings.HasPrefix(state, "Ok")
+	})
+	if err != nil {
+		return states, fmt.Errorf("the Hubble server is not up on every agent: %w", err)
+	}
+	return states, nil
+}
+
+// hubble enables, or disables if del is set, hubble on the installed
+// release and reports whether its server came up on every node
+func (h *Handler) hubble(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring Hubble"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req hubbleRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	opts := hubbleOptions{Hubble: true, HubbleMetrics: req.HubbleMetrics}
+	hubbleValues, err := opts.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if req.hubbleTLSOptions.set() {
+		tls, err := req.hubbleTLSOptions.values()
+		if err != nil {
+			fail(err)
+			return
+		}
+		hubbleValues = mergeValues(hubbleValues, map[string]interface{}{
+			"hubble": map[string]interface{}{"tls": tls},
+		})
+	}
+	if del {
+		hubbleValues = map[string]interface{}{
+			"hubble": map[string]interface{}{"enabled": false},
+		}
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	var tlsDetails string
+	if !del && req.hubbleTLSOptions.set() {
+		if tlsDetails, err = h.prepareHubbleTLS(context.Background(), namespace, req.hubbleTLSOptions, hubbleServerSecret); err != nil {
+			fail(err)
+			return
+		}
+	}
+	version, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+		return hubbleValues, nil
+	})
+	if err == nil && !del {
+		var states []agentState
+		states, err = h.waitForHubble(e, namespace, timeout)
+		if err != nil && len(states) > 0 {
+			err = fmt.Errorf("%w\n%s", err, agentStateDetails("Hubble per node", states))
+		}
+		if err == nil {
+			e.Summary = "Hubble enabled successfully"
+			e.Details = fmt.Sprintf("Hubble runs on the agents of Cilium %s.\n%s", version, agentStateDetails("Hubble per node", states))
+			if tlsDetails != "" {
+				e.Details = fmt.Sprintf("%s\n%s", e.Details, tlsDetails)
+			}
+		}
+	}
+	if err != nil {
+		fail(ErrConfigureHubble(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+	if del {
+		e.Summary = "Hubble disabled successfully"
+		e.Details = fmt.Sprintf("Hubble no longer runs on the agents of Cilium %s.", version)
+	}
+	h.StreamInfo(e)
+}
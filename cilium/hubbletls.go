@@ -0,0 +1,295 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// hubbleSelfSignedIssuer and hubbleCAIssuer are the cert-manager
+	// issuers the adapter creates in the namespace of cilium when the
+	// certmanager TLS mode is given no issuer: a self-signed CA, kept in
+	// hubbleCASecret, signing the certificates of hubble
+	hubbleSelfSignedIssuer = "meshery-hubble-selfsigned"
+	hubbleCAIssuer         = "meshery-hubble-ca"
+	hubbleCASecret         = "meshery-hubble-ca"
+
+	// certExpiryWarning is how long before their expiry the certificates
+	// of hubble are reported by the status
+	certExpiryWarning = 30 * 24 * time.Hour
+)
+
+var (
+	certManagerIssuerResource = schema.GroupVersionResource{
+		Group:    "cert-manager.io",
+		Version:  "v1",
+		Resource: "issuers",
+	}
+	certManagerClusterIssuerResource = schema.GroupVersionResource{
+		Group:    "cert-manager.io",
+		Version:  "v1",
+		Resource: "clusterissuers",
+	}
+	certManagerCertificateResource = schema.GroupVersionResource{
+		Group:    "cert-manager.io",
+		Version:  "v1",
+		Resource: "certificates",
+	}
+)
+
+// hubbleCertSecrets are the secrets holding the certificates of hubble,
+// whatever issued them, along with the key of the certificate. cilium-ca is
+// the CA the chart generates in the helm TLS mode.
+var hubbleCertSecrets = []struct{ name, key string }{
+	{hubbleServerSecret, "tls.crt"},
+	{relayClientSecret, "tls.crt"},
+	{"hubble-relay-server-certs", "tls.crt"},
+	{"hubble-metrics-server-certs", "tls.crt"},
+	{"cilium-ca", "ca.crt"},
+	{hubbleCASecret, "tls.crt"},
+}
+
+// hubbleTLSOptions selects how the certificates of hubble are provided.
+// They are part of the custom body of the hubble, relay and ui operations.
+type hubbleTLSOptions struct {
+	// TLSMode is helm to have the chart generate the certificates,
+	// certmanager to have cert-manager issue and rotate them, or secret to
+	// use the hubble-server-certs and hubble-relay-client-certs secrets
+	// created beforehand. The relay defaults to helm, the other
+	// operations keep the mode of the release.
+	TLSMode string `yaml:"tlsMode"`
+
+	// Issuer is the existing cert-manager issuer of the certmanager mode.
+	// The adapter creates a self-signed CA issuer in the namespace of
+	// cilium if unset.
+	Issuer string `yaml:"issuer"`
+
+	// IssuerKind is ClusterIssuer, the default, or Issuer
+	IssuerKind string `yaml:"issuerKind"`
+}
+
+// set reports whether a TLS mode is requested
+func (o hubbleTLSOptions) set() bool {
+	return o.TLSMode != ""
+}
+
+// mode returns the requested TLS mode, helm by default
+func (o hubbleTLSOptions) mode() string {
+	if o.TLSMode == "" {
+		return relayTLSHelm
+	}
+	return strings.ToLower(o.TLSMode)
+}
+
+// issuerKind returns the kind of the issuer, ClusterIssuer by default, or
+// the Issuer the adapter creates if none is given
+func (o hubbleTLSOptions) issuerKind() string {
+	switch {
+	case o.Issuer == "":
+		return "Issuer"
+	case o.IssuerKind == "":
+		return "ClusterIssuer"
+	}
+	return o.IssuerKind
+}
+
+// issuer returns the name of the issuer of the certmanager mode
+func (o hubbleTLSOptions) issuer() string {
+	if o.Issuer == "" {
+		return hubbleCAIssuer
+	}
+	return o.Issuer
+}
+
+// values translates the options into the hubble.tls values of the chart
+func (o hubbleTLSOptions) values() (map[string]interface{}, error) {
+	auto := make(map[string]interface{})
+	switch o.mode() {
+	case relayTLSHelm:
+		auto["enabled"] = true
+		auto["method"] = relayTLSHelm
+	case relayTLSCertManager:
+		if o.Issuer == "" && o.IssuerKind != "" {
+			return nil, ErrInvalidHubble(fmt.Errorf("issuerKind requires the issuer"))
+		}
+		kind := o.issuerKind()
+		if kind != "ClusterIssuer" && kind != "Issuer" {
+			return nil, ErrInvalidHubble(fmt.Errorf("unknown issuer kind %q, expected ClusterIssuer or Issuer", kind))
+		}
+		auto["enabled"] = true
+		auto["method"] = relayTLSCertManager
+		auto["certManagerIssuerRef"] = map[string]interface{}{
+			"group": certManagerIssuerResource.Group,
+			"kind":  kind,
+			"name":  o.issuer(),
+		}
+	case relayTLSSecret:
+		auto["enabled"] = false
+	default:
+		return nil, ErrInvalidHubble(fmt.Errorf("unknown TLS mode %q, expected %s, %s or %s", o.TLSMode, relayTLSHelm, relayTLSCertManager, relayTLSSecret))
+	}
+	return map[string]interface{}{"enabled": true, "auto": auto}, nil
+}
+
+// prepareHubbleTLS makes sure the certificates of the TLS mode can be
+// provided in namespace: the secrets exist in the secret mode, and in the
+// certmanager mode cert-manager runs and the issuer exists, the issuer of
+// the adapter being created if none is given. It describes what it did.
+func (h *Handler) prepareHubbleTLS(ctx context.Context, namespace string, o hubbleTLSOptions, secrets ...string) (string, error) {
+	switch o.mode() {
+	case relayTLSSecret:
+		for _, name := range secrets {
+			if _, err := h.KubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+				return "", ErrInvalidHubble(fmt.Errorf("the %s TLS mode requires the secret %s/%s: %w", relayTLSSecret, namespace, name, err))
+			}
+		}
+		return "", nil
+	case relayTLSCertManager:
+	default:
+		return "", nil
+	}
+
+	if h.DynamicKubeClient == nil {
+		return "", ErrNilClient
+	}
+	for _, resource := range []schema.GroupVersionResource{certManagerCertificateResource, certManagerIssuerResource, certManagerClusterIssuerResource} {
+		name := fmt.Sprintf("%s.%s", resource.Resource, resource.Group)
+		if _, err := h.DynamicKubeClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return "", ErrCertManagerNotFound(fmt.Errorf("the CRD %s: %w", name, err))
+		}
+	}
+
+	if o.Issuer != "" {
+		var err error
+		if o.issuerKind() == "ClusterIssuer" {
+			_, err = h.DynamicKubeClient.Resource(certManagerClusterIssuerResource).Get(ctx, o.Issuer, metav1.GetOptions{})
+		} else {
+			_, err = h.DynamicKubeClient.Resource(certManagerIssuerResource).Namespace(namespace).Get(ctx, o.Issuer, metav1.GetOptions{})
+		}
+		if err != nil {
+			return "", ErrHubbleIssuer(fmt.Errorf("%s %s: %w", o.issuerKind(), o.Issuer, err))
+		}
+		return fmt.Sprintf("The certificates of hubble are issued by the %s %s.", o.issuerKind(), o.Issuer), nil
+	}
+
+	var lines []string
+	for _, obj := range hubbleIssuerObjects(namespace) {
+		resource := certManagerIssuerResource
+		if obj.GetKind() == "Certificate" {
+			resource = certManagerCertificateResource
+		}
+		stat, err := h.applyResource(ctx, resource, obj)
+		if err != nil {
+			return "", ErrHubbleIssuer(fmt.Errorf("%s %s/%s: %w", obj.GetKind(), namespace, obj.GetName(), err))
+		}
+		lines = append(lines, fmt.Sprintf("%s %s/%s: %s", obj.GetKind(), namespace, obj.GetName(), stat))
+	}
+	return fmt.Sprintf("The certificates of hubble are issued by the self-signed CA of the Issuer %s/%s:\n%s", namespace, hubbleCAIssuer, strings.Join(lines, "\n")), nil
+}
+
+// hubbleIssuerObjects returns the cert-manager resources of the issuer of
+// the adapter in namespace, in the order they are applied: a self-signed
+// issuer, the CA certificate it signs and the CA issuer using it
+func hubbleIssuerObjects(namespace string) []*unstructured.Unstructured {
+	object := func(kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": certManagerIssuerResource.GroupVersion().String(),
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels":    map[string]interface{}{"app.kubernetes.io/managed-by": manifestFieldManager},
+			},
+			"spec": spec,
+		}}
+	}
+	return []*unstructured.Unstructured{
+		object("Issuer", hubbleSelfSignedIssuer, map[string]interface{}{"selfSigned": map[string]interface{}{}}),
+		object("Certificate", hubbleCASecret, map[string]interface{}{
+			"isCA":       true,
+			"commonName": "hubble-ca.cilium.io",
+			"secretName": hubbleCASecret,
+			"duration":   "87600h",
+			"privateKey": map[string]interface{}{"algorithm": "ECDSA", "size": int64(256)},
+			"issuerRef": map[string]interface{}{
+				"group": certManagerIssuerResource.Group,
+				"kind":  "Issuer",
+				"name":  hubbleSelfSignedIssuer,
+			},
+		}),
+		object("Issuer", hubbleCAIssuer, map[string]interface{}{"ca": map[string]interface{}{"secretName": hubbleCASecret}}),
+	}
+}
+
+// certificateStatus is the validity of a certificate of hubble
+type certificateStatus struct {
+	Secret   string    `json:"secret"`
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// hubbleCertificates returns the validity of the certificates of hubble
+// found in namespace, along with warnings for those which expire within
+// certExpiryWarning. The missing secrets are skipped.
+func (h *Handler) hubbleCertificates(ctx context.Context, namespace string) ([]certificateStatus, []string) {
+	var certs []certificateStatus
+	var warnings []string
+	for _, s := range hubbleCertSecrets {
+		secret, err := h.KubeClient.CoreV1().Secrets(namespace).Get(ctx, s.name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("certificate %s: %s", s.name, err))
+			continue
+		}
+		block, _ := pem.Decode(secret.Data[s.key])
+		if block == nil {
+			warnings = append(warnings, fmt.Sprintf("certificate %s: no PEM certificate in %s", s.name, s.key))
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("certificate %s: %s", s.name, err))
+			continue
+		}
+
+		certs = append(certs, certificateStatus{
+			Secret:   s.name,
+			Subject:  cert.Subject.CommonName,
+			Issuer:   cert.Issuer.CommonName,
+			NotAfter: cert.NotAfter,
+		})
+		switch left := time.Until(cert.NotAfter); {
+		case left <= 0:
+			warnings = append(warnings, fmt.Sprintf("certificate %s expired on %s", s.name, cert.NotAfter.Format(time.RFC3339)))
+		case left < certExpiryWarning:
+			warnings = append(warnings, fmt.Sprintf("certificate %s expires on %s", s.name, cert.NotAfter.Format(time.RFC3339)))
+		}
+	}
+	return certs, warnings
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ciliumIdentityResource is the resource of the CiliumIdentities, named
+// after their numeric identity
+var ciliumIdentityResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2", Resource: "ciliumidentities"}
+
+// reservedIdentities are the names of the identities cilium reserves, by
+// numeric identity. They have no CiliumIdentity.
+var reservedIdentities = map[int64]string{
+	1:  "host",
+	2:  "world",
+	3:  "unmanaged",
+	4:  "health",
+	5:  "init",
+	6:  "remote-node",
+	7:  "kube-apiserver",
+	8:  "ingress",
+	9:  "world-ipv4",
+	10: "world-ipv6",
+}
+
+// identityLookupRequest holds the parameters of the identity lookup, read
+// from the custom body of the request. Without any, every identity is
+// listed.
+type identityLookupRequest struct {
+	// ID looks up the labels of a numeric identity, as shown by hubble
+	ID int64 `yaml:"id"`
+
+	// Labels look up the identities bearing them all, their source, like
+	// k8s:, being optional
+	Labels map[string]string `yaml:"labels"`
+
+	// Namespace and Pod look up the identity of a pod. Namespace alone
+	// restricts the other lookups to the identities of its pods.
+	Namespace string `yaml:"namespace"`
+	Pod       string `yaml:"pod"`
+}
+
+// identityInfo describes an identity
+type identityInfo struct {
+	ID int64 `json:"id"`
+
+	// Reserved is the name of the reserved identities
+	Reserved string `json:"reserved,omitempty"`
+
+	Labels map[string]string `json:"labels"`
+
+	// Endpoints is the number of endpoints having the identity
+	Endpoints int `json:"endpoints"`
+}
+
+// identityReport is the outcome of an identity lookup
+type identityReport struct {
+	Identities []identityInfo `json:"identities"`
+}
+
+// reservedIdentity describes the reserved identity id, if it is one
+func reservedIdentity(id int64) (identityInfo, bool) {
+	name, ok := reservedIdentities[id]
+	if !ok {
+		return identityInfo{}, false
+	}
+	return identityInfo{ID: id, Reserved: name, Labels: map[string]string{"reserved:" + name: ""}}, true
+}
+
+// describeIdentity describes the CiliumIdentity obj
+func describeIdentity(obj *unstructured.Unstructured) (identityInfo, error) {
+	id, err := strconv.ParseInt(obj.GetName(), 10, 64)
+	if err != nil {
+		return identityInfo{}, fmt.Errorf("CiliumIdentity %s is not named after a numeric identity", obj.GetName())
+	}
+	labels, _, _ := unstructured.NestedStringMap(obj.Object, "security-labels")
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	return identityInfo{ID: id, Labels: labels}, nil
+}
+
+// matchesLabels reports whether the identity bears every label of want
+func (i identityInfo) matchesLabels(want map[string]string) bool {
+	labels := make([]string, 0, len(i.Labels))
+	for key, value := range i.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	indexed := identityLabels(labels)
+	for key, value := range want {
+		if got, ok := indexed[selectorKey(key)]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// identityEndpoints counts the CiliumEndpoints by numeric identity
+func (h *Handler) identityEndpoints(ctx context.Context) (map[int64]int, error) {
+	endpoints, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int)
+	for _, ep := range endpoints.Items {
+		if id, ok, _ := unstructured.NestedInt64(ep.Object, "status", "identity", "id"); ok {
+			counts[id]++
+		}
+	}
+	return counts, nil
+}
+
+// lookupIdentity returns the identity id, reserved or not
+func (h *Handler) lookupIdentity(ctx context.Context, id int64) (identityInfo, error) {
+	if info, ok := reservedIdentity(id); ok {
+		return info, nil
+	}
+	obj, err := h.DynamicKubeClient.Resource(ciliumIdentityResource).Get(ctx, strconv.FormatInt(id, 10), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return identityInfo{}, fmt.Errorf("no identity %d, it may have been released or belong to another cluster of the mesh", id)
+	}
+	if err != nil {
+		return identityInfo{}, err
+	}
+	return describeIdentity(obj)
+}
+
+// lookupIdentities returns the identities req asks for, along with the
+// number of endpoints having each of them
+func (h *Handler) lookupIdentities(ctx context.Context, req identityLookupRequest) (*identityReport, error) {
+	report := &identityReport{Identities: []identityInfo{}}
+	id := req.ID
+	if req.Pod != "" {
+		namespace := req.Namespace
+		if namespace == "" {
+			namespace = defaultSampleNamespace
+		}
+		ep, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(namespace).Get(ctx, req.Pod, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			return nil, fmt.Errorf("pod %s/%s has no CiliumEndpoint, it may not be managed by cilium", namespace, req.Pod)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if id, ok, _ = unstructured.NestedInt64(ep.Object, "status", "identity", "id"); !ok {
+			return nil, fmt.Errorf("pod %s/%s has no identity yet", namespace, req.Pod)
+		}
+	}
+
+	if id != 0 {
+		info, err := h.lookupIdentity(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		report.Identities = append(report.Identities, info)
+	} else {
+		want := make(map[string]string, len(req.Labels)+1)
+		for key, value := range req.Labels {
+			want[key] = value
+		}
+		if req.Namespace != "" {
+			want[podNamespaceLabel] = req.Namespace
+		}
+		list, err := h.DynamicKubeClient.Resource(ciliumIdentityResource).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			info, err := describeIdentity(&list.Items[i])
+			if err != nil {
+				h.Log.Warn(err)
+				continue
+			}
+			if info.matchesLabels(want) {
+				report.Identities = append(report.Identities, info)
+			}
+		}
+		sort.Slice(report.Identities, func(i, j int) bool { return report.Identities[i].ID < report.Identities[j].ID })
+	}
+
+	counts, err := h.identityEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Identities {
+		report.Identities[i].Endpoints = counts[report.Identities[i].ID]
+	}
+	return report, nil
+}
+
+// identityLookup streams the identities the custom body looks up, as JSON
+func (h *Handler) identityLookup(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while looking up the Cilium identities"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req identityLookupRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	lookups := 0
+	for _, set := range []bool{req.ID != 0, len(req.Labels) > 0, req.Pod != ""} {
+		if set {
+			lookups++
+		}
+	}
+	if lookups > 1 {
+		fail(ErrParseCustomBody(fmt.Errorf("id, labels and pod are exclusive lookups")))
+		return
+	}
+	if req.ID < 0 {
+		fail(ErrParseCustomBody(fmt.Errorf("id %d is not a numeric identity", req.ID)))
+		return
+	}
+	if h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	report, err := h.lookupIdentities(context.Background(), req)
+	if err != nil {
+		fail(ErrLookupIdentity(err))
+		return
+	}
+	byt, err := json.Marshal(report)
+	if err != nil {
+		fail(ErrLookupIdentity(err))
+		return
+	}
+	e.Summary = fmt.Sprintf("%d Cilium identities found", len(report.Identities))
+	if len(report.Identities) == 1 {
+		info := report.Identities[0]
+		e.Summary = fmt.Sprintf("Cilium identity %d found, used by %d endpoints", info.ID, info.Endpoints)
+		if info.Reserved != "" {
+			e.Summary = fmt.Sprintf("Cilium identity %d is the reserved identity %s", info.ID, info.Reserved)
+		}
+	}
+	e.Details = string(byt)
+	h.StreamInfo(e)
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// chartImage is an image of the cilium chart which can be mirrored
+type chartImage struct {
+	// path of the image values in the chart
+	path []string
+
+	// repository of the image on quay.io
+	repository string
+}
+
+// chartImages are the images which are overridable, keyed by the name used
+// in the requests
+var chartImages = map[string]chartImage{
+	"agent":        {path: []string{"image"}, repository: "quay.io/cilium/cilium"},
+	"operator":     {path: []string{"operator", "image"}, repository: "quay.io/cilium/operator"},
+	"hubble-relay": {path: []string{"hubble", "relay", "image"}, repository: "quay.io/cilium/hubble-relay"},
+	"certgen":      {path: []string{"certgen", "image"}, repository: "quay.io/cilium/certgen"},
+}
+
+// imageOverride replaces the repository and tag of an image
+type imageOverride struct {
+	Repository string `yaml:"repository"`
+	Tag        string `yaml:"tag"`
+}
+
+// imageOptions points the chart at mirrored images, for clusters which
+// cannot pull from quay.io. They are part of the custom body of the install
+// and upgrade requests.
+type imageOptions struct {
+	// Registry replaces quay.io in the repository of every image, like
+	// registry.internal:5000
+	Registry string `yaml:"registry"`
+
+	// Images overrides the repository or tag of single images, by name:
+	// agent, operator, hubble-relay or certgen
+	Images map[string]imageOverride `yaml:"images"`
+
+	// ImagePullSecret is the name of the secret used to pull the images
+	ImagePullSecret string `yaml:"imagePullSecret"`
+}
+
+// values translates the options into chart values. The images are
+// validated so that a typo fails before anything is applied.
+func (o imageOptions) values() (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for name := range o.Images {
+		if _, ok := chartImages[name]; !ok {
+			return nil, ErrInvalidImage(fmt.Errorf("unknown image %q, expected one of %s", name, strings.Join(chartImageNames(), ", ")))
+		}
+	}
+
+	for name, img := range chartImages {
+		override := o.Images[name]
+		repository := override.Repository
+		if repository == "" && o.Registry != "" {
+			repository = strings.TrimSuffix(o.Registry, "/") + strings.TrimPrefix(img.repository, "quay.io")
+		}
+		if repository == "" && override.Tag == "" {
+			continue
+		}
+
+		image := make(map[string]interface{})
+		ref := img.repository
+		if repository != "" {
+			image["repository"] = repository
+			ref = repository
+		}
+		if override.Tag != "" {
+			image["tag"] = override.Tag
+			// The digests of the chart belong to the default tag
+			image["useDigest"] = false
+			ref = ref + ":" + override.Tag
+		}
+		if _, err := reference.ParseNormalizedNamed(ref); err != nil {
+			return nil, ErrInvalidImage(fmt.Errorf("%s image %q: %w", name, ref, err))
+		}
+		setValue(values, img.path, image)
+	}
+
+	if o.ImagePullSecret != "" {
+		if errs := validation.IsDNS1123Subdomain(o.ImagePullSecret); len(errs) > 0 {
+			return nil, ErrInvalidImage(fmt.Errorf("image pull secret %q: %s", o.ImagePullSecret, strings.Join(errs, ", ")))
+		}
+		values["imagePullSecrets"] = []interface{}{
+			map[string]interface{}{"name": o.ImagePullSecret},
+		}
+	}
+	return values, nil
+}
+
+// setValue sets the value at path, creating the intermediate maps
+func setValue(values map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := values[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			values[key] = next
+		}
+		values = next
+	}
+	values[path[len(path)-1]] = value
+}
+
+func chartImageNames() []string {
+	names := make([]string, 0, len(chartImages))
+	for name := range chartImages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// manifestImages returns the images referenced by the containers of a
+// multi-document manifest, sorted and without duplicates
+func manifestImages(manifest string) []string {
+	seen := make(map[string]bool)
+	for _, doc := range releaseutil.SplitManifests(manifest) {
+		var obj interface{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			continue
+		}
+		collectImages(obj, seen)
+	}
+
+	images := make([]string, 0, len(seen))
+	for image := range seen {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// collectImages adds the image of every container found in obj to seen
+func collectImages(obj interface{}, seen map[string]bool) {
+	switch v := obj.(type) {
+	case map[interface{}]interface{}:
+		for key, val := range v {
+			if key == "containers" || key == "initContainers" || key == "ephemeralContainers" {
+				if containers, ok := val.([]interface{}); ok {
+					for _, c := range containers {
+						if container, ok := c.(map[interface{}]interface{}); ok {
+							if image, ok := container["image"].(string); ok && image != "" {
+								seen[image] = true
+							}
+						}
+					}
+				}
+				continue
+			}
+			collectImages(val, seen)
+		}
+	case []interface{}:
+		for _, val := range v {
+			collectImages(val, seen)
+		}
+	}
+}
+
+// listImages streams the images the cilium chart of version pulls with
+// the options of the custom body, for mirroring them ahead of an install
+func (h *Handler) listImages(version, customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while listing the Cilium images"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	req, err := parseInstallRequest(customBody)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if req.refValues, err = h.fetchValuesRef(context.Background(), req.valuesRefOptions); err != nil {
+		fail(err)
+		return
+	}
+	values, err := req.helmValues(version)
+	if err != nil {
+		fail(err)
+		return
+	}
+	namespace := h.ciliumNamespace(req.Namespace)
+	manifest, err := h.renderChart(version, namespace, values)
+	if err != nil {
+		fail(ErrRenderChart(err))
+		return
+	}
+
+	images := manifestImages(manifest)
+	e.Summary = fmt.Sprintf("Cilium %s pulls %d images", version, len(images))
+	e.Details = strings.Join(images, "\n")
+	h.StreamInfo(e)
+}
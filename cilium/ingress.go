@@ -0,0 +1,319 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// ingressClassName is the class of the Ingress resources cilium serves
+	ingressClassName = "cilium"
+
+	// sharedIngressService is the load balancer service of the shared
+	// mode, serving every Ingress of the class
+	sharedIngressService = "cilium-ingress"
+
+	// envoyDaemonSet runs the L7 proxy apart from the agents
+	envoyDaemonSet = "cilium-envoy"
+)
+
+// The load balancer modes of the ingress controller
+const (
+	ingressModeShared    = "shared"
+	ingressModeDedicated = "dedicated"
+)
+
+var (
+	// ingressControllerSince is the first version serving the Ingress
+	// resources
+	ingressControllerSince = semver.MustParse("1.12.0")
+
+	// sharedIngressSince is the first version sharing a load balancer
+	// between the Ingress resources, and able to be the default class
+	sharedIngressSince = semver.MustParse("1.14.0")
+
+	// envoyDaemonSetSince is the first version running the L7 proxy in the
+	// cilium-envoy DaemonSet by default
+	envoyDaemonSetSince = semver.MustParse("1.16.0")
+)
+
+// ingressRequest holds the parameters of the cilium ingress controller
+// operation, read from the custom body of the request
+type ingressRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// LoadBalancerMode is shared, one load balancer serving every Ingress
+	// of the class, or dedicated, a load balancer per Ingress. Shared by
+	// default from cilium 1.14, which is the first version offering it.
+	LoadBalancerMode string `yaml:"loadbalancerMode"`
+
+	// Default makes cilium the default ingress class, serving the Ingress
+	// resources which have none, from cilium 1.14
+	Default bool `yaml:"default"`
+
+	// Timeout bounds the rollout of the agents and the wait for the
+	// address of the shared load balancer, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the
+	// ingress controller does not come up, which it does unless set to
+	// false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// values translates the request into the chart values of version
+func (r ingressRequest) values(version *semver.Version) (map[string]interface{}, error) {
+	ingress := map[string]interface{}{"enabled": true}
+	mode := strings.ToLower(r.LoadBalancerMode)
+	switch mode {
+	case "":
+	case ingressModeShared, ingressModeDedicated:
+		if version.LessThan(sharedIngressSince) {
+			if mode == ingressModeShared {
+				return nil, ErrInvalidIngressController(fmt.Errorf("cilium %s only offers the dedicated load balancer mode, the shared mode requires %s", version, sharedIngressSince))
+			}
+			break
+		}
+		ingress["loadbalancerMode"] = mode
+	default:
+		return nil, ErrInvalidIngressController(fmt.Errorf("unknown load balancer mode %q, expected %s or %s", r.LoadBalancerMode, ingressModeShared, ingressModeDedicated))
+	}
+	if r.Default {
+		if version.LessThan(sharedIngressSince) {
+			return nil, ErrInvalidIngressController(fmt.Errorf("cilium %s cannot be the default ingress class, which requires %s", version, sharedIngressSince))
+		}
+		ingress["default"] = true
+	}
+	return map[string]interface{}{"ingressController": ingress}, nil
+}
+
+// mode returns the load balancer mode the controller of version runs in
+func (r ingressRequest) mode(version *semver.Version) string {
+	if version.LessThan(sharedIngressSince) {
+		return ingressModeDedicated
+	}
+	if r.LoadBalancerMode == "" {
+		return ingressModeShared
+	}
+	return strings.ToLower(r.LoadBalancerMode)
+}
+
+// checkIngressPrerequisites fails unless the release values let the
+// ingress controller run: kube-proxy is replaced, at least partially, and
+// the L7 proxy is not disabled. The proxy of the versions running it in the
+// cilium-envoy DaemonSet is waited for once enabled.
+func checkIngressPrerequisites(values map[string]interface{}) error {
+	replaced := kubeProxyReplaced(values)
+	if mode, ok := values["kubeProxyReplacement"].(string); ok && mode == "partial" {
+		replaced = true
+	}
+	if !replaced {
+		return ErrInvalidIngressController(fmt.Errorf("the ingress controller requires kube-proxy replacement, install cilium with kubeProxyReplacement first"))
+	}
+	if l7Proxy, ok := values["l7Proxy"].(bool); ok && !l7Proxy {
+		return ErrInvalidIngressController(fmt.Errorf("the ingress controller requires the L7 proxy, which the release disables with l7Proxy false"))
+	}
+	return nil
+}
+
+// envoyDaemonSetEnabled reports whether the release values of version run
+// the L7 proxy in the cilium-envoy DaemonSet
+func envoyDaemonSetEnabled(version *semver.Version, values map[string]interface{}) bool {
+	envoy, _ := values["envoy"].(map[string]interface{})
+	enabled, ok := envoy["enabled"].(bool)
+	if !ok {
+		return !version.LessThan(envoyDaemonSetSince)
+	}
+	return enabled
+}
+
+// waitForIngressAddress waits for the shared load balancer of namespace to
+// get an address, and returns it
+func (h *Handler) waitForIngressAddress(ctx context.Context, namespace string, timeout time.Duration) (string, error) {
+	var address string
+	err := wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		svc, err := h.KubeClient.CoreV1().Services(namespace).Get(ctx, sharedIngressService, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				address = ingress.IP
+				return true, nil
+			}
+			if ingress.Hostname != "" {
+				address = ingress.Hostname
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("the %s/%s service got no load balancer address, is a load balancer provider, like LB IPAM, running? %w", namespace, sharedIngressService, err)
+	}
+	return address, nil
+}
+
+// ciliumIngresses returns the Ingress resources of the cilium class, by
+// their class name or their legacy class annotation
+func (h *Handler) ciliumIngresses(ctx context.Context) ([]string, error) {
+	ingresses, err := h.KubeClient.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ingress := range ingresses.Items {
+		class := ingress.Annotations["kubernetes.io/ingress.class"]
+		if ingress.Spec.IngressClassName != nil {
+			class = *ingress.Spec.IngressClassName
+		}
+		if class == ingressClassName {
+			names = append(names, ingress.Namespace+"/"+ingress.Name)
+		}
+	}
+	return names, nil
+}
+
+// ingressController enables, or disables if del is set, the ingress
+// controller of cilium on the installed release and reports the ingress
+// class the Ingress resources are to use
+func (h *Handler) ingressController(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium ingress controller"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req ingressRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	version, values, err := h.releaseValues(namespace)
+	if err != nil {
+		fail(ErrConfigureIngressController(err))
+		return
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		fail(ErrConfigureIngressController(err))
+		return
+	}
+	if v.LessThan(ingressControllerSince) {
+		fail(ErrInvalidIngressController(fmt.Errorf("cilium %s is installed, the ingress controller requires %s", version, ingressControllerSince)))
+		return
+	}
+
+	if del {
+		var warning string
+		if ingresses, err := h.ciliumIngresses(ctx); err != nil {
+			warning = fmt.Sprintf("Warning: the Ingress resources could not be listed: %s", err)
+		} else if len(ingresses) > 0 {
+			warning = fmt.Sprintf("Warning: %d Ingress resources of the %s class are no longer served: %s", len(ingresses), ingressClassName, strings.Join(ingresses, ", "))
+			h.streamProgress(e, "Disabling the Cilium ingress controller", warning)
+		}
+		_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"ingressController": map[string]interface{}{"enabled": false},
+			}, nil
+		})
+		if err != nil {
+			fail(ErrConfigureIngressController(err))
+			if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+				rollback()
+			}
+			return
+		}
+		e.Summary = "Cilium ingress controller disabled successfully"
+		e.Details = fmt.Sprintf("Cilium %s no longer serves the Ingress resources of the %s class.", version, ingressClassName)
+		if warning != "" {
+			e.Details = fmt.Sprintf("%s\n%s", e.Details, warning)
+		}
+		h.StreamInfo(e)
+		return
+	}
+
+	ingressValues, err := req.values(v)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := checkIngressPrerequisites(values); err != nil {
+		fail(err)
+		return
+	}
+	_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+		return ingressValues, nil
+	})
+	if err == nil && envoyDaemonSetEnabled(v, mergeValues(values, ingressValues)) {
+		err = h.waitForDaemonSet(e, namespace, envoyDaemonSet, "Cilium Envoy proxies", timeout)
+	}
+	mode := req.mode(v)
+	var address string
+	if err == nil && mode == ingressModeShared {
+		h.streamProgress(e, "Waiting for the address of the shared Cilium ingress", "")
+		address, err = h.waitForIngressAddress(ctx, namespace, timeout)
+	}
+	if err != nil {
+		fail(ErrConfigureIngressController(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+
+	e.Summary = "Cilium ingress controller enabled successfully"
+	e.Details = fmt.Sprintf("Set ingressClassName: %s on the Ingress resources for cilium %s to serve them.", ingressClassName, version)
+	if req.Default {
+		e.Details = fmt.Sprintf("%s The Ingress resources without a class are served too, %s is the default class.", e.Details, ingressClassName)
+	}
+	if mode == ingressModeShared {
+		e.Details = fmt.Sprintf("%s\nEvery Ingress is served at %s by the %s/%s service.", e.Details, address, namespace, sharedIngressService)
+	} else {
+		e.Details = fmt.Sprintf("%s\nEvery Ingress gets a load balancer service of its own, named cilium-ingress-<name> in its namespace.", e.Details)
+	}
+	h.StreamInfo(e)
+}
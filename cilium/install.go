@@ -29,20 +29,591 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/layer5io/meshery-adapter-library/adapter"
 	"github.com/layer5io/meshery-adapter-library/status"
 	"github.com/layer5io/meshery-cilium/internal/config"
-	mesherykube "github.com/layer5io/meshkit/utils/kubernetes"
+	"gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/storage/driver"
 )
 
 const (
 	platform = runtime.GOOS
-	arch = runtime.GOARCH
+	arch     = runtime.GOARCH
+
+	// defaultOperationTimeout bounds the waits of the long running
+	// operations, like every phase of an upgrade
+	defaultOperationTimeout = 10 * time.Minute
 )
 
-func (h *Handler) installCilium(del bool, version, ns string) (string, error) {
+// installRequest holds the parameters of the cilium install operation,
+// read from the custom body of the request
+type installRequest struct {
+	// Namespace to install cilium in, created if missing. The namespace
+	// of an existing install, or else kube-system, by default.
+	Namespace string `yaml:"namespace"`
+
+	// Version to install, like 1.14.5 or v1.14.5, which may be missing
+	// from the supported versions. The latest supported version by default.
+	Version string `yaml:"version"`
+
+	// SkipCompatibilityCheck installs cilium even if the version does not
+	// support the kubernetes version of the cluster
+	SkipCompatibilityCheck bool `yaml:"skipCompatibilityCheck"`
+
+	// Values overrides the values of the cilium chart, either as a map or
+	// as a YAML string. Keys unknown to the adapter are passed to the chart.
+	Values interface{} `yaml:"values"`
+
+	// Rollback uninstalls the release if the agents do not become ready
+	// after a fresh install. Off by default.
+	Rollback bool `yaml:"rollback"`
+
+	// Timeout bounds the wait for the agents to become ready, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// DryRun returns the manifests the install would apply instead of
+	// applying them
+	DryRun bool `yaml:"dryRun"`
+
+	// Adopt takes over a cilium installed without helm, by the cilium cli
+	// or from manifests, as the helm release of the adapter
+	Adopt bool `yaml:"adopt"`
+
+	imageOptions        `yaml:",inline"`
+	kubeProxyOptions    `yaml:",inline"`
+	routingOptions      `yaml:",inline"`
+	ipamOptions         `yaml:",inline"`
+	encryptionOptions   `yaml:",inline"`
+	hubbleOptions       `yaml:",inline"`
+	chainingOptions     `yaml:",inline"`
+	policyOptions       `yaml:",inline"`
+	preflightOptions    `yaml:",inline"`
+	readinessOptions    `yaml:",inline"`
+	valuesRefOptions    `yaml:",inline"`
+	restartOptions      `yaml:",inline"`
+	placementOptions    `yaml:",inline"`
+	resourceOptions     `yaml:",inline"`
+	operatorOptions     `yaml:",inline"`
+	manifestOptions     `yaml:",inline"`
+	mtuOptions          `yaml:",inline"`
+	loadBalancerOptions `yaml:",inline"`
+
+	// values are the parsed Values
+	values map[string]interface{}
+
+	// refValues are the values of ValuesRef, once fetched
+	refValues referencedValues
+
+	// imageValues are the chart values of imageOptions
+	imageValues map[string]interface{}
+
+	// timeout is the parsed Timeout
+	timeout time.Duration
+}
+
+// parseCustomBody reads the parameters of an operation from the custom
+// body of the request, which is YAML or JSON, into req. An empty body
+// leaves req untouched.
+func parseCustomBody(customBody string, req interface{}) error {
+	if strings.TrimSpace(customBody) == "" {
+		return nil
+	}
+	if err := yaml.Unmarshal([]byte(customBody), req); err != nil {
+		return ErrParseCustomBody(err)
+	}
+	return nil
+}
+
+// parseInstallRequest reads the install parameters from the custom body
+// of the request
+func parseInstallRequest(customBody string) (installRequest, error) {
+	var req installRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		return req, err
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		return req, err
+	}
+	values, err := parseHelmValues(req.Values)
+	if err != nil {
+		return req, err
+	}
+	req.values = values
+	if req.imageValues, err = req.imageOptions.values(); err != nil {
+		return req, err
+	}
+	if req.timeout, err = parseTimeout(req.Timeout); err != nil {
+		return req, err
+	}
+	if err := req.manifestOptions.check(); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// parseTimeout parses the timeout of an operation, which is
+// defaultOperationTimeout if unset
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return defaultOperationTimeout, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 {
+		return 0, ErrParseCustomBody(fmt.Errorf("timeout %q is not a positive duration", timeout))
+	}
+	return d, nil
+}
+
+// routing returns the routing options of the request. The cloud IPAM modes
+// and the chained CNIs route natively unless asked otherwise, which
+// checkIPAM and check then reject.
+func (r installRequest) routing() routingOptions {
+	routing := r.routingOptions
+	routing.cloudRouted = r.ipamOptions.cloudRouted() || r.chainingOptions.enabled()
+	if routing.cloudRouted && routing.RoutingMode == "" {
+		routing.RoutingMode = routingNative
+	}
+	return routing
+}
+
+// helmValues returns the values the chart of version is installed with: the
+// defaults of the adapter, then the options of the request and its overrides
+func (r installRequest) helmValues(version string) (map[string]interface{}, error) {
+	requested, err := r.requestValues(version)
+	if err != nil {
+		return nil, err
+	}
+	return withDefaultValues(requested)
+}
+
+// withDefaultValues merges the requested values over the defaults of the
+// adapter and checks the outcome
+func withDefaultValues(requested map[string]interface{}) (map[string]interface{}, error) {
+	values := mergeValues(defaultHelmValues(), requested)
+	if err := checkIPAM(values); err != nil {
+		return nil, err
+	}
+	if err := checkLoadBalancer(values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// requestValues returns the values the options of the request, its
+// valuesRef and its overrides set on the chart of version, without the
+// defaults of the adapter
+func (r installRequest) requestValues(version string) (map[string]interface{}, error) {
+	kubeProxyValues, err := r.kubeProxyOptions.values(version)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.chainingOptions.check(version, r.kubeProxyOptions, r.routingOptions, r.ipamOptions); err != nil {
+		return nil, err
+	}
+
+	routingValues, err := r.routing().values(version)
+	if err != nil {
+		return nil, err
+	}
+	ipamValues, err := r.ipamOptions.values(version)
+	if err != nil {
+		return nil, err
+	}
+	encryptionValues, err := r.encryptionOptions.values(version)
+	if err != nil {
+		return nil, err
+	}
+	hubbleValues, err := r.hubbleOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	chainingValues, err := r.chainingOptions.values(version)
+	if err != nil {
+		return nil, err
+	}
+	policyValues, err := r.policyOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	placementValues, err := r.placementOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	resourceValues, err := r.resourceOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	operatorValues, err := r.operatorOptions.values(version, r.OperatorPlacement)
+	if err != nil {
+		return nil, err
+	}
+	mtuValues, err := r.mtuOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	loadBalancerValues, err := r.loadBalancerOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	values := mergeValues(r.refValues.values, r.imageValues)
+	values = mergeValues(values, kubeProxyValues)
+	values = mergeValues(values, routingValues)
+	values = mergeValues(values, ipamValues)
+	values = mergeValues(values, encryptionValues)
+	values = mergeValues(values, hubbleValues)
+	values = mergeValues(values, chainingValues)
+	values = mergeValues(values, policyValues)
+	values = mergeValues(values, placementValues)
+	values = mergeValues(values, resourceValues)
+	values = mergeValues(values, operatorValues)
+	values = mergeValues(values, mtuValues)
+	values = mergeValues(values, loadBalancerValues)
+	return mergeValues(values, r.values), nil
+}
+
+// install installs, or removes if del is set, the requested cilium
+// version, else the latest of versions, and waits for its agents to become
+// ready. Versions are sorted latest first. The phases of an install are
+// streamed along the way.
+func (h *Handler) install(versions []adapter.Version, req installRequest, del bool, e *adapter.Event) {
+	if !del {
+		h = h.withProgress(installPhases)
+	}
+	fail := func(summary string, err error) {
+		e.Summary = summary
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	// warnings and the per node states of the requested features are
+	// appended to the details of the result
+	var warnings, nodeDetails []string
+
+	version := string(versions[0])
+	if req.Version != "" && !del {
+		resolved, verified, err := config.ResolveVersion(context.Background(), req.Version, versions)
+		if err != nil {
+			fail("Invalid Cilium version", err)
+			return
+		}
+		if !verified {
+			warnings = append(warnings, fmt.Sprintf("Warning: github could not be reached to verify that %s is released.", resolved))
+		}
+		version = resolved
+	}
+	h.completePhase(e, phaseVersionResolved, fmt.Sprintf("Installing Cilium %s", version))
+
+	var err error
+	preRendered := req.manifests() && req.source() == manifestSourceRepo
+	if !del && preRendered {
+		// The manifests are fetched when applied, nothing needs the chart
+		h.completePhase(e, phaseChartDownloaded, fmt.Sprintf("Pre-rendered manifests of cilium/cilium v%s", strings.TrimPrefix(version, "v")))
+		warnings = append(warnings, "Warning: the pre-rendered manifests of the cilium repo ignore the values and the options of the request.")
+	} else if !del {
+		if _, err := h.locateChart(config.HelmChartName, version); err != nil {
+			fail("Error while downloading the Cilium chart", ErrInstallCilium(err))
+			return
+		}
+		h.completePhase(e, phaseChartDownloaded, fmt.Sprintf("Chart %s %s of %s", config.HelmChartName, config.ChartVersion(version), h.chartRepository().URL))
+		if req.refValues, err = h.fetchValuesRef(context.Background(), req.valuesRefOptions); err != nil {
+			fail("Error while reading the Cilium values", err)
+			return
+		}
+		if req.KubeProxyFree {
+			if err := h.discoverAPIServer(context.Background(), &req.kubeProxyOptions); err != nil {
+				fail("Error while discovering the API server", err)
+				return
+			}
+		}
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !del && preRendered && namespace != defaultCiliumNamespace {
+		fail("Invalid install method", ErrInvalidInstallMethod(fmt.Errorf("the pre-rendered manifests install cilium in %s, not %s", defaultCiliumNamespace, namespace)))
+		return
+	}
+	requested, err := req.requestValues(version)
+	if err != nil {
+		fail("Error while installing Cilium service mesh", err)
+		return
+	}
+	values, err := withDefaultValues(requested)
+	if err != nil {
+		fail("Error while installing Cilium service mesh", err)
+		return
+	}
+	if !del {
+		warning, err := h.checkNativeRouting(context.Background(), req.routing(), req.ipamOptions)
+		if err != nil {
+			fail("Invalid Cilium routing", err)
+			return
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	h.completePhase(e, phaseValuesMerged, fmt.Sprintf("Installing in namespace %s with %d top level values", namespace, len(values)))
+	if req.DryRun && !del && req.manifests() {
+		manifest, err := h.manifestsFor(context.Background(), version, namespace, req.source(), values)
+		if err != nil {
+			fail("Error while rendering the Cilium manifests", err)
+			return
+		}
+		h.streamManifest(e, version, values, manifest)
+		return
+	}
+	if req.DryRun && !del {
+		h.streamDryRun(e, version, namespace, values)
+		return
+	}
+	if !del && !req.SkipCompatibilityCheck {
+		if err := h.checkCompatibility(version); err != nil {
+			fail("Cilium is not compatible with the cluster", err)
+			return
+		}
+	}
+
+	var found ciliumInstallation
+	if !del {
+		if found, err = h.detectCilium(context.Background()); err != nil {
+			fail("Error while detecting Cilium", ErrDetectCilium(err))
+			return
+		}
+		if (found.HelmRelease && req.manifests()) || (found.Inventory && !req.manifests()) {
+			fail("Cilium is already installed", ErrCiliumAlreadyInstalled(found.String(), "Install it with the method it was installed with, or uninstall it first"))
+			return
+		}
+		noop, err := h.checkExisting(found, version, namespace, req.Adopt)
+		if err != nil {
+			fail("Cilium is already installed", err)
+			return
+		}
+		if noop && req.policyOptions.set() {
+			fail("Cilium is already installed", ErrCiliumAlreadyInstalled(found.String(), "Run the upgrade operation to change its policy enforcement mode"))
+			return
+		}
+		if noop {
+			e.Summary = "Cilium service mesh is already installed"
+			e.Details = fmt.Sprintf("%s, nothing to do.", found)
+			h.StreamInfo(e)
+			return
+		}
+	}
+
+	if !del && req.Preflight {
+		results, err := h.runEnvChecks(e, version, namespace, req.PreflightImage, req.chainingOptions.enabled(), defaultEnvCheckTimeout)
+		if err != nil {
+			fail("Error while running the Cilium preflight checks", ErrEnvCheck(err))
+			return
+		}
+		report, critical := envCheckReport(results)
+		if critical && !req.Force {
+			fail("Some nodes are not ready for Cilium", ErrEnvCheckFailed(report))
+			return
+		}
+		nodeDetails = append(nodeDetails, "Preflight checks:\n"+report)
+	}
+	if !del && req.mtuOptions.detect(tunnelEnabled(values)) {
+		mtuWarnings, err := h.checkNodeMTUs(e, namespace, req.PreflightImage, req.mtuOptions, tunnelEnabled(values), defaultEnvCheckTimeout)
+		if err != nil {
+			fail("Invalid Cilium MTU", err)
+			return
+		}
+		warnings = append(warnings, mtuWarnings...)
+	}
+	if !del && req.kubeProxyOptions.enabled() && !req.RemoveKubeProxy && h.kubeProxyRunning(context.Background()) {
+		warnings = append(warnings, fmt.Sprintf("Warning: kube-proxy still runs in the cluster, remove it for cilium to fully replace it: set removeKubeProxy along with kubeProxyFree, or delete the %s DaemonSet of kube-system.", kubeProxyDaemonSet))
+	}
+	if !del {
+		if warning := h.operatorWarning(context.Background(), req.operatorOptions); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	if !del && req.ipsec() {
+		if err := h.ensureIPsecSecret(context.Background(), namespace, req.IPsecAlgorithm); err != nil {
+			fail("Error while installing Cilium service mesh", err)
+			return
+		}
+	}
+
+	// The manifests are applied over the resources of the existing install
+	if found.Detected && !found.HelmRelease && !req.manifests() {
+		h.streamProgress(e, "Adopting the existing Cilium install", found.String())
+		manifest, err := h.renderChart(version, namespace, values)
+		if err != nil {
+			fail("Error while adopting the existing Cilium install", ErrRenderChart(err))
+			return
+		}
+		adopted, err := h.adoptResources(context.Background(), namespace, manifest)
+		if err != nil {
+			fail("Error while adopting the existing Cilium install", ErrAdoptCilium(err))
+			return
+		}
+		warnings = append(warnings, fmt.Sprintf("Adopted %d resources of the existing install (%s).", adopted, found.Method))
+	}
+
+	// An adopted install is not rolled back since it did not start with
+	// the adapter
+	existed := found.Detected || h.releaseExists(namespace)
+	var inventory *manifestInventory
+	if del {
+		if inventory, err = h.readInventory(context.Background(), namespace); err != nil {
+			fail("Error while removing Cilium service mesh", err)
+			return
+		}
+	}
+	var stat string
+	switch {
+	case inventory != nil:
+		stat = status.Removing
+		if err = h.removeManifests(context.Background(), namespace, inventory); err == nil {
+			stat = status.Removed
+		}
+	case req.manifests() && !del:
+		stat = status.Installing
+		result, err := h.applyManifests(context.Background(), version, namespace, req.source(), values, nil)
+		if err != nil {
+			fail("Error while installing Cilium service mesh from manifests", err)
+			if req.Rollback && !existed {
+				h.rollbackInstall(e, version, namespace)
+			}
+			return
+		}
+		stat = status.Installed
+		nodeDetails = append(nodeDetails, result.String())
+	default:
+		stat, err = h.installCilium(del, version, namespace, values, len(requested) > 0)
+	}
+	if err != nil {
+		fail(fmt.Sprintf("Error while %s Cilium service mesh", stat), err)
+		return
+	}
+	if !del && req.manifests() {
+		h.completePhase(e, phaseManifestsApplied, fmt.Sprintf("The manifests are applied in namespace %s", namespace))
+	} else if !del {
+		h.completePhase(e, phaseManifestsApplied, fmt.Sprintf("The %s helm release is applied in namespace %s", config.HelmChartName, namespace))
+		h.streamProgress(e, "Waiting for Cilium to become ready", "")
+		err := h.waitForCilium(e, namespace, req.timeout, req.WaitForNodes)
+		if err == nil {
+			h.completePhase(e, phaseAgentsReady, "The agents and the operator are ready")
+		}
+		if err == nil && req.kubeProxyOptions.enabled() {
+			err = h.checkKubeProxyReplacement(context.Background(), namespace)
+		}
+		if err == nil && req.KubeProxyFree {
+			var result string
+			result, err = h.kubeProxyFreeCheck(e, namespace, req.kubeProxyOptions, req.timeout)
+			if err == nil {
+				nodeDetails = append(nodeDetails, result)
+			}
+		}
+		if err == nil && req.encryptionOptions.enabled() {
+			var states []agentState
+			states, err = h.waitForEncryption(e, namespace, req.encryptionType(), req.timeout)
+			if len(states) > 0 {
+				nodeDetails = append(nodeDetails, agentStateDetails("Encryption per node", states))
+			}
+		}
+		if err == nil && req.chainingOptions.enabled() {
+			var states []agentState
+			states, err = h.waitForChaining(e, namespace, req.chainingOptions.mode(), req.timeout)
+			if len(states) > 0 {
+				nodeDetails = append(nodeDetails, agentStateDetails("CNI chaining per node", states))
+			}
+		}
+		if err == nil && req.hubbleOptions.Hubble {
+			var states []agentState
+			states, err = h.waitForHubble(e, namespace, req.timeout)
+			if len(states) > 0 {
+				nodeDetails = append(nodeDetails, agentStateDetails("Hubble per node", states))
+			}
+		}
+		if err == nil && req.loadBalancerOptions.set() {
+			var states []agentState
+			states, err = h.waitForLoadBalancer(e, namespace, req.loadBalancerOptions, req.timeout)
+			if len(states) > 0 {
+				nodeDetails = append(nodeDetails, agentStateDetails("Load balancing per node", states))
+			}
+		}
+		if err != nil {
+			if len(nodeDetails) > 0 {
+				err = fmt.Errorf("%w\n%s", err, strings.Join(nodeDetails, "\n"))
+			}
+			fail("Cilium agents did not become ready", ErrInstallCilium(err))
+			if req.Rollback && !existed {
+				h.rollbackInstall(e, version, namespace)
+			}
+			return
+		}
+		if req.BaselinePolicy {
+			result, err := h.applyBaselinePolicy(context.Background())
+			if err != nil {
+				fail("Error while applying the Cilium baseline policy", err)
+				return
+			}
+			nodeDetails = append(nodeDetails, result)
+		}
+		if req.RestartUnmanagedPods {
+			result, err := h.restartUnmanagedPods(e, namespace, req.restartOptions)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("Warning: the pods unmanaged by cilium could not be restarted: %s", err))
+			} else {
+				nodeDetails = append(nodeDetails, result.String())
+			}
+		}
+		h.completePhase(e, phasePostChecks, "")
+	}
+
+	e.Summary = fmt.Sprintf("Cilium service mesh %s successfully", stat)
+	e.Details = fmt.Sprintf("Cilium service mesh is now %s.", stat)
+	if !del {
+		e.Details = fmt.Sprintf("%s %s", e.Details, installDetails(version, values))
+	}
+	if len(nodeDetails) > 0 {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, strings.Join(nodeDetails, "\n"))
+	}
+	if len(warnings) > 0 {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, strings.Join(warnings, "\n"))
+	}
+	if source := req.refValues.String(); source != "" && !del {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, source)
+	}
+	h.StreamInfo(e)
+}
+
+// installDetails describes the chart version and values cilium was
+// installed with, secrets redacted
+func installDetails(version string, values map[string]interface{}) string {
+	details := fmt.Sprintf("Installed version %s of the %s chart", config.ChartVersion(version), config.HelmChartName)
+	byt, err := yaml.Marshal(redactValues(values))
+	if err != nil {
+		return details
+	}
+	return fmt.Sprintf("%s with values:\n%s", details, byt)
+}
+
+// checkCompatibility fails if the cilium version does not support the
+// kubernetes version of the cluster
+func (h *Handler) checkCompatibility(version string) error {
+	if h.kubeClient() == nil {
+		return ErrNilClient
+	}
+	serverVersion, err := h.kubeClient().Discovery().ServerVersion()
+	if err != nil {
+		return ErrInstallCilium(err)
+	}
+	return config.CheckCompatibility(version, serverVersion.GitVersion)
+}
+
+// installCilium installs or removes the cilium helm release of ns. The
+// cilium cli takes over when helm fails, unless custom is set: the values
+// of the chart were then set for the install, which the cli cannot honor.
+func (h *Handler) installCilium(del bool, version, ns string, values map[string]interface{}, custom bool) (string, error) {
 	h.Log.Debug(fmt.Sprintf("Requested install of version: %s", version))
 	h.Log.Debug(fmt.Sprintf("Requested action is delete: %v", del))
 	h.Log.Debug(fmt.Sprintf("Requested action is in namespace: %s", ns))
@@ -58,10 +629,14 @@ func (h *Handler) installCilium(del bool, version, ns string) (string, error) {
 	}
 
 	h.Log.Info("Installing...")
-	err = h.applyHelmChart(del, version, ns)
+	err = h.applyHelmChart(del, version, ns, values)
 	if err != nil {
 		h.Log.Error(ErrInstallCilium((err)))
-		
+
+		if !del && custom {
+			return st, ErrInstallCilium(err)
+		}
+
 		err = h.runCiliumCliCmd(ns, del)
 		if err != nil {
 			return st, ErrInstallCilium(err)
@@ -76,28 +651,39 @@ func (h *Handler) installCilium(del bool, version, ns string) (string, error) {
 	return st, nil
 }
 
-func (h *Handler) applyHelmChart(del bool, version, namespace string) error {
-	kClient := h.MesheryKubeclient
-
-	repo := "https://helm.cilium.io/"
-	chart := "cilium"
-	var act mesherykube.HelmChartAction
+// applyHelmChart installs the cilium release of namespace with values, or
+// upgrades it if it exists already so that installing again succeeds, or
+// uninstalls it if del is set
+func (h *Handler) applyHelmChart(del bool, version, namespace string, values map[string]interface{}) error {
+	actionConfig, err := h.helmActionConfig(namespace)
+	if err != nil {
+		return err
+	}
 	if del {
-		act = mesherykube.UNINSTALL
-	} else {
-		act = mesherykube.INSTALL
-	}
-	return kClient.ApplyHelmChart(mesherykube.ApplyHelmChartConfig{
-		ChartLocation: mesherykube.HelmChartLocation{
-			Repository: repo,
-			Chart:      chart,
-			Version:    version,
-		},
-		Namespace:       "kube-system",
-		Action:          act,
-		CreateNamespace: true,
-		ReleaseName:     chart,
-	})
+		_, err := action.NewUninstall(actionConfig).Run(config.HelmChartName)
+		return err
+	}
+
+	ch, err := h.loadChart(version)
+	if err != nil {
+		return err
+	}
+	_, err = action.NewGet(actionConfig).Run(config.HelmChartName)
+	if err == nil {
+		upgrade := action.NewUpgrade(actionConfig)
+		upgrade.Namespace = namespace
+		_, err = upgrade.Run(config.HelmChartName, ch, values)
+		return err
+	}
+	if !strings.Contains(err.Error(), driver.ErrReleaseNotFound.Error()) {
+		return err
+	}
+	install := action.NewInstall(actionConfig)
+	install.ReleaseName = config.HelmChartName
+	install.Namespace = namespace
+	install.CreateNamespace = true
+	_, err = install.Run(ch, values)
+	return err
 }
 
 func (h *Handler) runCiliumCliCmd(namespace string, isDeleteOp bool) error {
@@ -107,7 +693,7 @@ func (h *Handler) runCiliumCliCmd(namespace string, isDeleteOp bool) error {
 	)
 
 	version, err := getReleaseTag()
-	if (err != nil) {
+	if err != nil {
 		return ErrGettingRelease(err)
 	}
 
@@ -126,7 +712,7 @@ func (h *Handler) runCiliumCliCmd(namespace string, isDeleteOp bool) error {
 	command.Stdout = &out
 	command.Stderr = &er
 	err = command.Run()
-	if err != nil {        
+	if err != nil {
 		return ErrRunExecutable(err)
 	}
 
@@ -142,7 +728,7 @@ func (h *Handler) runCiliumCliCmd(namespace string, isDeleteOp bool) error {
 // in the root config path
 func (h *Handler) getExecutable(release string) (string, error) {
 	const binaryName = "cilium"
-	alternateBinaryName := generatePlatformSpecificBinaryName("cilium-" , platform)
+	alternateBinaryName := generatePlatformSpecificBinaryName("cilium-", platform)
 
 	// Look for the executable in the path
 	h.Log.Info("Looking for cilium in the path...")
@@ -171,10 +757,10 @@ func (h *Handler) getExecutable(release string) (string, error) {
 		return "", ErrDownloadingTar(err)
 	}
 	err = extractTar(res, binPath)
-	
+
 	// Install the binary
 	h.Log.Info("Installing...")
-	
+
 	// Move binary to the right location
 	// err = os.Rename(path.Join(downloadLocation, binaryName), path.Join(binPath, "cilium"))
 	if err != nil {
@@ -199,7 +785,7 @@ func downloadTar(release string) (*http.Response, error) {
 		url = fmt.Sprintf("%s/%s/cilium-%s-%s.tar.gz", url, release, platform, arch)
 	}
 
-	resp, err := http.Get(url)
+	resp, err := config.HTTPClient().Get(url)
 	if err != nil {
 		return nil, ErrDownloadingTar(err)
 	}
@@ -207,16 +793,15 @@ func downloadTar(release string) (*http.Response, error) {
 	if resp.StatusCode != http.StatusOK {
 		return nil, ErrDownloadingTar(fmt.Errorf("bad status: %s", resp.Status))
 	}
-	
 
 	return resp, nil
 }
 
 func getReleaseTag() (string, error) {
-	client := github.NewClient(nil)
+	client := github.NewClient(config.HTTPClient())
 
 	tags, _, err := client.Repositories.ListTags(context.Background(), "cilium", "cilium-cli", nil)
-	
+
 	if err != nil {
 		return "", err
 	}
@@ -244,7 +829,6 @@ func extractTar(res *http.Response, location string) error {
 			return ErrUnpackingTar(err)
 		}
 	}
-	
 
 	return nil
 }
@@ -298,7 +882,6 @@ func tarxzf(location string, stream io.Reader) error {
 					return ErrInstallBinary(err)
 				}
 			}
-			
 
 		default:
 			return ErrTarXZF(err)
@@ -308,7 +891,6 @@ func tarxzf(location string, stream io.Reader) error {
 	return nil
 }
 
-
 func unzip(location string, zippedContent io.Reader) error {
 	// Keep file in memory: Approx size ~ 50MB
 	// TODO: Find a better approach
@@ -373,7 +955,6 @@ func unzip(location string, zippedContent io.Reader) error {
 	return nil
 }
 
-
 func generatePlatformSpecificBinaryName(binName, platform string) string {
 	if platform == "windows" && !strings.HasSuffix(binName, ".exe") {
 		return binName + platform + ".exe"
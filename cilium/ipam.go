@@ -0,0 +1,194 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-cilium/internal/config"
+)
+
+const (
+	ipamClusterPool = "cluster-pool"
+	ipamKubernetes  = "kubernetes"
+	ipamENI         = "eni"
+	ipamAzure       = "azure"
+)
+
+// podCIDRListSince is the first version taking a list of cluster pool CIDRs
+// rather than a single one
+var podCIDRListSince = semver.MustParse("1.11.0")
+
+// azureOptions are the credentials the operator allocates the IPs of the
+// Azure network with
+type azureOptions struct {
+	ResourceGroup  string `yaml:"resourceGroup"`
+	SubscriptionID string `yaml:"subscriptionID"`
+	TenantID       string `yaml:"tenantID"`
+
+	// ClientID and ClientSecret are the service principal of the operator,
+	// which uses the managed identity of the nodes if unset
+	ClientID     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+}
+
+// ipamOptions selects how the pod IPs are allocated. They are part of the
+// custom body of the install requests.
+type ipamOptions struct {
+	// IPAMMode is cluster-pool, the default of the chart, kubernetes to use
+	// the pod CIDRs of the nodes, or eni and azure to allocate the IPs of
+	// the cloud network
+	IPAMMode string `yaml:"ipamMode"`
+
+	// ClusterPoolIPv4PodCIDRList and ClusterPoolIPv4MaskSize are the CIDRs
+	// the cluster pool allocates from and the size of the CIDR of a node
+	ClusterPoolIPv4PodCIDRList []string `yaml:"clusterPoolIPv4PodCIDRList"`
+	ClusterPoolIPv4MaskSize    int      `yaml:"clusterPoolIPv4MaskSize"`
+
+	// Azure is required by the azure mode
+	Azure azureOptions `yaml:"azure"`
+}
+
+// mode returns the requested IPAM mode, lower cased
+func (o ipamOptions) mode() string {
+	return strings.ToLower(o.IPAMMode)
+}
+
+// cloudRouted reports whether the pods are routed by the cloud network,
+// which requires native routing
+func (o ipamOptions) cloudRouted() bool {
+	return o.mode() == ipamENI || o.mode() == ipamAzure
+}
+
+// values translates the options into the values of the chart of version
+func (o ipamOptions) values(version string) (map[string]interface{}, error) {
+	mode := o.mode()
+	pool := len(o.ClusterPoolIPv4PodCIDRList) > 0 || o.ClusterPoolIPv4MaskSize != 0
+	if mode == "" && !pool && o.Azure == (azureOptions{}) {
+		return nil, nil
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case "", ipamClusterPool, ipamKubernetes, ipamENI, ipamAzure:
+	default:
+		return nil, ErrInvalidIPAMMode(fmt.Errorf("unknown IPAM mode %q, expected %s, %s, %s or %s", o.IPAMMode, ipamClusterPool, ipamKubernetes, ipamENI, ipamAzure))
+	}
+	if pool && mode != "" && mode != ipamClusterPool {
+		return nil, ErrInvalidIPAMMode(fmt.Errorf("the cluster pool CIDRs only apply to the %s mode, not %s", ipamClusterPool, mode))
+	}
+	if o.Azure != (azureOptions{}) && mode != ipamAzure {
+		return nil, ErrInvalidIPAMMode(fmt.Errorf("the azure credentials only apply to the %s mode", ipamAzure))
+	}
+
+	ipam := make(map[string]interface{})
+	values := map[string]interface{}{"ipam": ipam}
+	if mode != "" {
+		ipam["mode"] = mode
+	}
+
+	switch mode {
+	case "", ipamClusterPool:
+		operator := make(map[string]interface{})
+		for _, cidr := range o.ClusterPoolIPv4PodCIDRList {
+			if ip, _, err := net.ParseCIDR(cidr); err != nil || ip.To4() == nil {
+				return nil, ErrInvalidIPAMMode(fmt.Errorf("%q is not an IPv4 CIDR", cidr))
+			}
+		}
+		switch {
+		case len(o.ClusterPoolIPv4PodCIDRList) == 0:
+		case !v.LessThan(podCIDRListSince):
+			cidrs := make([]interface{}, 0, len(o.ClusterPoolIPv4PodCIDRList))
+			for _, cidr := range o.ClusterPoolIPv4PodCIDRList {
+				cidrs = append(cidrs, cidr)
+			}
+			operator["clusterPoolIPv4PodCIDRList"] = cidrs
+		case len(o.ClusterPoolIPv4PodCIDRList) == 1:
+			operator["clusterPoolIPv4PodCIDR"] = o.ClusterPoolIPv4PodCIDRList[0]
+		default:
+			return nil, ErrInvalidIPAMMode(fmt.Errorf("cilium %s only takes a single cluster pool CIDR", version))
+		}
+		if o.ClusterPoolIPv4MaskSize != 0 {
+			if o.ClusterPoolIPv4MaskSize < 1 || o.ClusterPoolIPv4MaskSize > 32 {
+				return nil, ErrInvalidIPAMMode(fmt.Errorf("clusterPoolIPv4MaskSize %d is not between 1 and 32", o.ClusterPoolIPv4MaskSize))
+			}
+			operator["clusterPoolIPv4MaskSize"] = o.ClusterPoolIPv4MaskSize
+		}
+		if len(operator) > 0 {
+			ipam["operator"] = operator
+		}
+	case ipamENI:
+		values["eni"] = map[string]interface{}{"enabled": true}
+		// The traffic leaving the VPC is masqueraded on the primary ENI
+		values["egressMasqueradeInterfaces"] = "eth0"
+	case ipamAzure:
+		if o.Azure.ResourceGroup == "" || o.Azure.SubscriptionID == "" || o.Azure.TenantID == "" {
+			return nil, ErrInvalidIPAMMode(fmt.Errorf("the %s mode requires azure.resourceGroup, azure.subscriptionID and azure.tenantID", ipamAzure))
+		}
+		if (o.Azure.ClientID == "") != (o.Azure.ClientSecret == "") {
+			return nil, ErrInvalidIPAMMode(fmt.Errorf("azure.clientID and azure.clientSecret are set together"))
+		}
+		azure := map[string]interface{}{
+			"enabled":        true,
+			"resourceGroup":  o.Azure.ResourceGroup,
+			"subscriptionID": o.Azure.SubscriptionID,
+			"tenantID":       o.Azure.TenantID,
+		}
+		if o.Azure.ClientID != "" {
+			azure["clientID"] = o.Azure.ClientID
+			azure["clientSecret"] = o.Azure.ClientSecret
+		}
+		values["azure"] = azure
+	}
+	return values, nil
+}
+
+// ipamMode returns the IPAM mode of the chart values, cluster-pool unless
+// set otherwise
+func ipamMode(values map[string]interface{}) string {
+	if ipam, ok := values["ipam"].(map[string]interface{}); ok {
+		if mode, ok := ipam["mode"].(string); ok && mode != "" {
+			return mode
+		}
+	}
+	return ipamClusterPool
+}
+
+// tunnelEnabled reports whether the chart values encapsulate the traffic
+// between the nodes, which the chart does by default. The tunnel value of
+// the releases installed before cilium 1.14 is still honored by 1.14.
+func tunnelEnabled(values map[string]interface{}) bool {
+	if mode, ok := values["routingMode"].(string); ok && mode != "" {
+		return mode != routingNative
+	}
+	tunnel, _ := values["tunnel"].(string)
+	return tunnel != "disabled"
+}
+
+// checkIPAM rejects the chart values combining a cloud IPAM mode with
+// tunneling, whose pod IPs the cloud network would not route
+func checkIPAM(values map[string]interface{}) error {
+	mode := ipamMode(values)
+	if (mode == ipamENI || mode == ipamAzure) && tunnelEnabled(values) {
+		return ErrInvalidIPAMMode(fmt.Errorf("the %s IPAM mode requires native routing, set routingMode to %s", mode, routingNative))
+	}
+	return nil
+}
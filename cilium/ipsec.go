@@ -0,0 +1,263 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// ipsecSecret is the secret the agents read the IPsec keys from, the
+	// default of the chart
+	ipsecSecret = "cilium-ipsec-keys"
+
+	// ipsecSecretKey is the key of the IPsec keys in ipsecSecret
+	ipsecSecretKey = "keys"
+
+	// defaultIPsecAlgorithm is the algorithm of the generated keys unless
+	// the request asks for another one
+	defaultIPsecAlgorithm = "gcm-aes"
+
+	// maxIPsecSPI is the highest SPI of the keys, they wrap around to 1
+	maxIPsecSPI = 15
+
+	// restartedAtAnnotation restarts the pods of a DaemonSet when changed,
+	// like kubectl rollout restart
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+)
+
+// ipsecAlgorithm generates the keys of an algorithm cilium supports
+type ipsecAlgorithm struct {
+	// marker is the first field after the SPI in the keys of the algorithm
+	marker string
+
+	// keys formats the keys of the SPI with random key material
+	keys func(spi string) (string, error)
+}
+
+// ipsecAlgorithms are the algorithms of the generated keys, by the name
+// used in the requests
+var ipsecAlgorithms = map[string]ipsecAlgorithm{
+	"gcm-aes": {
+		marker: "rfc4106(gcm(aes))",
+		keys: func(spi string) (string, error) {
+			// A 128 bit key followed by a 32 bit salt
+			key, err := randomHex(20)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s rfc4106(gcm(aes)) %s 128", spi, key), nil
+		},
+	},
+	"cbc-aes-sha256": {
+		marker: "hmac(sha256)",
+		keys: func(spi string) (string, error) {
+			auth, err := randomHex(32)
+			if err != nil {
+				return "", err
+			}
+			enc, err := randomHex(16)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s hmac(sha256) %s cbc(aes) %s", spi, auth, enc), nil
+		},
+	},
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validateIPsecAlgorithm fails unless algorithm is empty, standing for the
+// default, or one of ipsecAlgorithms
+func validateIPsecAlgorithm(algorithm string) error {
+	if _, ok := ipsecAlgorithms[strings.ToLower(algorithm)]; !ok && algorithm != "" {
+		return ErrInvalidEncryption(fmt.Errorf("unknown IPsec algorithm %q, expected gcm-aes or cbc-aes-sha256", algorithm))
+	}
+	return nil
+}
+
+// ensureIPsecSecret creates the IPsec keys of namespace with algorithm, and
+// the namespace itself, if missing. Existing keys are kept, they are
+// replaced through a rotation only.
+func (h *Handler) ensureIPsecSecret(ctx context.Context, namespace, algorithm string) error {
+	if h.KubeClient == nil {
+		return ErrNilClient
+	}
+	if algorithm == "" {
+		algorithm = defaultIPsecAlgorithm
+	}
+	alg, ok := ipsecAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		return validateIPsecAlgorithm(algorithm)
+	}
+
+	_, err := h.KubeClient.CoreV1().Secrets(namespace).Get(ctx, ipsecSecret, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !kerrors.IsNotFound(err) {
+		return ErrIPsecKeys(err)
+	}
+
+	_, err = h.KubeClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}, metav1.CreateOptions{})
+	if err != nil && !kerrors.IsAlreadyExists(err) {
+		return ErrIPsecKeys(err)
+	}
+
+	keys, err := alg.keys("3")
+	if err != nil {
+		return ErrIPsecKeys(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: ipsecSecret, Namespace: namespace},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{ipsecSecretKey: keys},
+	}
+	if _, err := h.KubeClient.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return ErrIPsecKeys(err)
+	}
+	h.Log.Info(fmt.Sprintf("Created the IPsec keys %s/%s", namespace, ipsecSecret))
+	return nil
+}
+
+// nextIPsecKeys returns new keys of the same algorithm as keys, with the
+// SPI bumped, along with the old and new SPIs. The errors never mention
+// the keys themselves.
+func nextIPsecKeys(keys string) (string, int, int, error) {
+	fields := strings.Fields(keys)
+	if len(fields) < 2 {
+		return "", 0, 0, fmt.Errorf("the keys are not of the form <spi> <algorithm> <key>...")
+	}
+	plus := strings.HasSuffix(fields[0], "+")
+	spi, err := strconv.Atoi(strings.TrimSuffix(fields[0], "+"))
+	if err != nil || spi < 1 || spi > maxIPsecSPI {
+		return "", 0, 0, fmt.Errorf("the SPI of the keys is not between 1 and %d", maxIPsecSPI)
+	}
+
+	for _, alg := range ipsecAlgorithms {
+		if alg.marker != fields[1] {
+			continue
+		}
+		next := spi%maxIPsecSPI + 1
+		nextSPI := strconv.Itoa(next)
+		if plus {
+			nextSPI += "+"
+		}
+		newKeys, err := alg.keys(nextSPI)
+		return newKeys, spi, next, err
+	}
+	return "", 0, 0, fmt.Errorf("the keys use the algorithm %s, which the adapter cannot generate", fields[1])
+}
+
+// rotateKeyRequest holds the parameters of the IPsec key rotation
+// operation, read from the custom body of the request
+type rotateKeyRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Timeout bounds the restart of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+}
+
+// rotateIPsecKey replaces the IPsec keys with new ones of the next SPI and
+// restarts the agents one node at a time for them to use the new keys,
+// following the documented rotation procedure
+func (h *Handler) rotateIPsecKey(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while rotating the Cilium IPsec key"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req rotateKeyRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	secrets := h.KubeClient.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, ipsecSecret, metav1.GetOptions{})
+	if err != nil {
+		fail(ErrRotateIPsecKey(err))
+		return
+	}
+	keys, spi, next, err := nextIPsecKeys(string(secret.Data[ipsecSecretKey]))
+	if err != nil {
+		fail(ErrRotateIPsecKey(err))
+		return
+	}
+
+	h.streamProgress(e, "Rotating the Cilium IPsec key", fmt.Sprintf("Replacing the key of SPI %d with a key of SPI %d", spi, next))
+	secret.Data = map[string][]byte{ipsecSecretKey: []byte(keys)}
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		fail(ErrRotateIPsecKey(err))
+		return
+	}
+
+	h.streamProgress(e, "Restarting the Cilium agents", "The agents are restarted one node at a time to use the new key")
+	if err := h.restartAgents(ctx, namespace); err != nil {
+		fail(ErrRotateIPsecKey(err))
+		return
+	}
+	if err := h.waitForAgents(e, namespace, timeout); err != nil {
+		fail(ErrRotateIPsecKey(err))
+		return
+	}
+
+	e.Summary = "Cilium IPsec key rotated successfully"
+	e.Details = fmt.Sprintf("The agents of namespace %s encrypt with the key of SPI %d", namespace, next)
+	h.StreamInfo(e)
+}
+
+// restartAgents rolls the agent DaemonSet of namespace, which restarts the
+// agents within the limits of its update strategy
+func (h *Handler) restartAgents(ctx context.Context, namespace string) error {
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, restartedAtAnnotation, time.Now().Format(time.RFC3339))
+	_, err := h.KubeClient.AppsV1().DaemonSets(namespace).Patch(ctx, agentDaemonSet, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
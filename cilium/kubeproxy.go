@@ -0,0 +1,180 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// kubeProxyDaemonSet is the DaemonSet of kube-proxy on most distributions
+const kubeProxyDaemonSet = "kube-proxy"
+
+var (
+	// boolReplacementSince is the first version accepting true and false
+	// as kubeProxyReplacement
+	boolReplacementSince = semver.MustParse("1.14.0")
+
+	// legacyReplacementUntil is the first version no longer accepting the
+	// disabled, partial, probe and strict modes
+	legacyReplacementUntil = semver.MustParse("1.15.0")
+
+	// socketLBSince is the first version of the chart naming the socket
+	// load balancer socketLB, which was hostServices before
+	socketLBSince = semver.MustParse("1.13.0")
+)
+
+// kubeProxyOptions runs cilium in place of kube-proxy. They are part of the
+// custom body of the install requests.
+type kubeProxyOptions struct {
+	// KubeProxyReplacement is true or false, or, up to cilium 1.14,
+	// disabled, partial, probe or strict
+	KubeProxyReplacement string `yaml:"kubeProxyReplacement"`
+
+	// K8sServiceHost and K8sServicePort are the address of the API server,
+	// which cilium cannot reach through its service without kube-proxy
+	K8sServiceHost string `yaml:"k8sServiceHost"`
+	K8sServicePort int    `yaml:"k8sServicePort"`
+
+	// KubeProxyFree is the preset replacing kube-proxy entirely: the
+	// strict replacement along with the socket load balancer, the address
+	// of the API server being discovered unless given. The services are
+	// checked to be handled once cilium is ready.
+	KubeProxyFree bool `yaml:"kubeProxyFree"`
+
+	// RemoveKubeProxy stops the kube-proxy DaemonSet once cilium handles
+	// the services, along with the preset. It is restored if the services
+	// are not handled without it.
+	RemoveKubeProxy bool `yaml:"removeKubeProxy"`
+
+	// ServiceCheckImage runs the check of the services of the preset,
+	// the curl image of the connectivity test by default
+	ServiceCheckImage string `yaml:"serviceCheckImage"`
+}
+
+// enabled reports whether kube-proxy is replaced, at least partially
+func (o kubeProxyOptions) enabled() bool {
+	if o.KubeProxyFree {
+		return true
+	}
+	switch strings.ToLower(o.KubeProxyReplacement) {
+	case "", "false", "disabled":
+		return false
+	}
+	return true
+}
+
+// values translates the options into the values of the chart of version,
+// converting the mode to the ones the chart accepts
+func (o kubeProxyOptions) values(version string) (map[string]interface{}, error) {
+	if o.RemoveKubeProxy && !o.KubeProxyFree {
+		return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("removeKubeProxy requires the kubeProxyFree preset"))
+	}
+	if o.KubeProxyReplacement == "" && !o.KubeProxyFree {
+		return nil, nil
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := strings.ToLower(o.KubeProxyReplacement)
+	if o.KubeProxyFree {
+		switch mode {
+		case "", "true", "strict":
+			mode = "true"
+		default:
+			return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("the kubeProxyFree preset replaces kube-proxy entirely, kubeProxyReplacement %q conflicts with it", o.KubeProxyReplacement))
+		}
+	}
+	switch mode {
+	case "true", "false":
+		if v.LessThan(boolReplacementSince) {
+			// strict is the mode later renamed to true
+			mode = map[string]string{"true": "strict", "false": "disabled"}[mode]
+		}
+	case "disabled", "partial", "probe", "strict":
+		if !v.LessThan(legacyReplacementUntil) {
+			return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("cilium %s only accepts true or false, got %q", version, o.KubeProxyReplacement))
+		}
+	default:
+		return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("unknown kube-proxy replacement mode %q", o.KubeProxyReplacement))
+	}
+
+	values := map[string]interface{}{"kubeProxyReplacement": mode}
+	if !o.enabled() {
+		return values, nil
+	}
+
+	if o.K8sServiceHost == "" || o.K8sServicePort == 0 {
+		return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("k8sServiceHost and k8sServicePort are required to replace kube-proxy"))
+	}
+	if errs := validation.IsValidPortNum(o.K8sServicePort); len(errs) > 0 {
+		return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("k8sServicePort %d: %s", o.K8sServicePort, strings.Join(errs, ", ")))
+	}
+	if len(validation.IsDNS1123Subdomain(o.K8sServiceHost)) > 0 && len(validation.IsValidIP(o.K8sServiceHost)) > 0 {
+		return nil, ErrInvalidKubeProxyReplacement(fmt.Errorf("k8sServiceHost %q is neither a host name nor an IP address", o.K8sServiceHost))
+	}
+	values["k8sServiceHost"] = o.K8sServiceHost
+	values["k8sServicePort"] = o.K8sServicePort
+	if o.KubeProxyFree {
+		socketLB := "socketLB"
+		if v.LessThan(socketLBSince) {
+			socketLB = "hostServices"
+		}
+		values[socketLB] = map[string]interface{}{"enabled": true}
+	}
+	return values, nil
+}
+
+// kubeProxyRunning reports whether kube-proxy still runs in the cluster,
+// in which case it keeps programming the services next to cilium
+func (h *Handler) kubeProxyRunning(ctx context.Context) bool {
+	if h.KubeClient == nil {
+		return false
+	}
+	_, err := h.KubeClient.AppsV1().DaemonSets(metav1.NamespaceSystem).Get(ctx, kubeProxyDaemonSet, metav1.GetOptions{})
+	return err == nil
+}
+
+// checkKubeProxyReplacement fails unless an agent of namespace reports that
+// it replaces kube-proxy
+func (h *Handler) checkKubeProxyReplacement(ctx context.Context, namespace string) error {
+	out, err := h.execAgentCLI(ctx, namespace, "status")
+	if err != nil {
+		return ErrKubeProxyReplacement(err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "KubeProxyReplacement:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "KubeProxyReplacement:"))
+		if len(fields) > 0 {
+			switch strings.ToLower(fields[0]) {
+			case "true", "strict", "partial", "probe":
+				return nil
+			}
+		}
+		return ErrKubeProxyReplacement(fmt.Errorf("the agent reports %q", line))
+	}
+	return ErrKubeProxyReplacement(fmt.Errorf("the agent status does not mention KubeProxyReplacement"))
+}
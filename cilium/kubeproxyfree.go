@@ -0,0 +1,243 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// clusterInfoConfigMap is the ConfigMap of kube-public publishing the
+	// address of the API server, created by kubeadm and most distributions
+	clusterInfoConfigMap = "cluster-info"
+
+	// kubeProxyDisabledLabel is the node selector keeping the kube-proxy
+	// pods off every node once cilium handles the services
+	kubeProxyDisabledLabel = "meshery.io/kube-proxy-disabled"
+
+	// serviceCheckPod is the pod checking that the services are handled
+	serviceCheckPod = "cilium-service-check"
+
+	// serviceCheckTimeout bounds the attempts of the service check, the
+	// services being programmed shortly after the agents are ready
+	serviceCheckTimeout = time.Minute
+)
+
+// discoverAPIServer fills the address of the API server the agents reach
+// when kube-proxy is replaced, unless the request gives it: the one the
+// cluster-info ConfigMap publishes, else the one of the kubeconfig. A
+// loopback address, like the one of a port forward, is never used as the
+// agents cannot reach it.
+func (h *Handler) discoverAPIServer(ctx context.Context, o *kubeProxyOptions) error {
+	if o.K8sServiceHost != "" || o.K8sServicePort != 0 {
+		return nil
+	}
+
+	var candidates []string
+	if h.KubeClient != nil {
+		if cm, err := h.KubeClient.CoreV1().ConfigMaps(metav1.NamespacePublic).Get(ctx, clusterInfoConfigMap, metav1.GetOptions{}); err == nil {
+			if kubeconfig, err := clientcmd.Load([]byte(cm.Data["kubeconfig"])); err == nil {
+				for _, cluster := range kubeconfig.Clusters {
+					candidates = append(candidates, cluster.Server)
+				}
+			}
+		}
+	}
+	candidates = append(candidates, h.RestConfig.Host)
+
+	var rejected []string
+	for _, server := range candidates {
+		host, port, err := apiServerEndpoint(server)
+		if err != nil {
+			if server != "" {
+				rejected = append(rejected, fmt.Sprintf("%s: %s", server, err))
+			}
+			continue
+		}
+		o.K8sServiceHost, o.K8sServicePort = host, port
+		return nil
+	}
+	return ErrDiscoverAPIServer(fmt.Errorf("no usable address of the API server: %s", strings.Join(rejected, "; ")))
+}
+
+// apiServerEndpoint returns the host and the port of the server url of a
+// kubeconfig, which must not be a loopback address
+func apiServerEndpoint(server string) (string, int, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", 0, err
+	}
+	host := u.Hostname()
+	if host == "" {
+		return "", 0, fmt.Errorf("no host")
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return "", 0, fmt.Errorf("loopback address")
+	}
+	port := 443
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return "", 0, err
+		}
+	} else if u.Scheme == "http" {
+		port = 80
+	}
+	return host, port, nil
+}
+
+// disableKubeProxy keeps the kube-proxy pods off every node with a node
+// selector no node has, and waits for them to be gone. The rules kube-proxy
+// programmed stay on the nodes, cilium handling the services before them.
+func (h *Handler) disableKubeProxy(ctx context.Context, timeout time.Duration) error {
+	patch := fmt.Sprintf(`{"spec":{"template":{"spec":{"nodeSelector":{%q:"true"}}}}}`, kubeProxyDisabledLabel)
+	if _, err := h.KubeClient.AppsV1().DaemonSets(metav1.NamespaceSystem).Patch(ctx, kubeProxyDaemonSet, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		ds, err := h.KubeClient.AppsV1().DaemonSets(metav1.NamespaceSystem).Get(ctx, kubeProxyDaemonSet, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return ds.Status.ObservedGeneration >= ds.Generation && ds.Status.CurrentNumberScheduled == 0 && ds.Status.NumberReady == 0, nil
+	})
+}
+
+// restoreKubeProxy removes the node selector of disableKubeProxy, for the
+// kube-proxy pods to run again on every node
+func (h *Handler) restoreKubeProxy(ctx context.Context) error {
+	patch := fmt.Sprintf(`{"spec":{"template":{"spec":{"nodeSelector":{%q:null}}}}}`, kubeProxyDisabledLabel)
+	_, err := h.KubeClient.AppsV1().DaemonSets(metav1.NamespaceSystem).Patch(ctx, kubeProxyDaemonSet, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
+
+// kubeProxyFreeCheck stops kube-proxy if asked to then checks that cilium
+// handles the services of the cluster in its place. A stopped kube-proxy is
+// restored when the services are not handled.
+func (h *Handler) kubeProxyFreeCheck(e *adapter.Event, namespace string, o kubeProxyOptions, timeout time.Duration) (string, error) {
+	ctx := context.Background()
+	disabled := false
+	if o.RemoveKubeProxy && h.kubeProxyRunning(ctx) {
+		h.streamProgress(e, "Stopping kube-proxy", fmt.Sprintf("Keeping the pods of the %s DaemonSet off every node", kubeProxyDaemonSet))
+		disabled = true
+		if err := h.disableKubeProxy(ctx, timeout); err != nil {
+			if rerr := h.restoreKubeProxy(ctx); rerr != nil {
+				err = fmt.Errorf("%w, and kube-proxy could not be restored: %v", err, rerr)
+			}
+			return "", ErrServiceHandling(fmt.Errorf("stopping kube-proxy: %w", err))
+		}
+	}
+
+	h.streamProgress(e, "Checking that Cilium handles the services", "")
+	result, err := h.checkServiceHandling(ctx, namespace, o.ServiceCheckImage)
+	if err != nil {
+		if disabled {
+			if rerr := h.restoreKubeProxy(ctx); rerr != nil {
+				err = fmt.Errorf("%w, and kube-proxy could not be restored: %v", err, rerr)
+			} else {
+				err = fmt.Errorf("%w, kube-proxy was restored", err)
+			}
+		}
+		return "", ErrServiceHandling(err)
+	}
+	if disabled {
+		result = fmt.Sprintf("%s\nkube-proxy: stopped, its %s DaemonSet selects the nodes labelled %s", result, kubeProxyDaemonSet, kubeProxyDisabledLabel)
+	}
+	return result, nil
+}
+
+// checkServiceHandling checks that the services are handled, by reaching
+// the ClusterIP of the kubernetes service from a pod of namespace running
+// image. The pod is removed however the check ends.
+func (h *Handler) checkServiceHandling(ctx context.Context, namespace, image string) (string, error) {
+	if image == "" {
+		image = defaultClientImage
+	}
+	svc, err := h.KubeClient.CoreV1().Services(metav1.NamespaceDefault).Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return "", fmt.Errorf("the kubernetes service has no port")
+	}
+	target := fmt.Sprintf("https://%s/version", net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(svc.Spec.Ports[0].Port))))
+
+	grace := int64(0)
+	pods := h.KubeClient.CoreV1().Pods(namespace)
+	_ = pods.Delete(ctx, serviceCheckPod, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	var lastErr error
+	if err := wait.PollImmediate(rolloutPollInterval, serviceCheckTimeout, func() (bool, error) {
+		_, lastErr = pods.Create(ctx, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: serviceCheckPod, Labels: map[string]string{"app.kubernetes.io/name": serviceCheckPod}},
+			Spec: corev1.PodSpec{
+				TerminationGracePeriodSeconds: &grace,
+				RestartPolicy:                 corev1.RestartPolicyNever,
+				Containers: []corev1.Container{{
+					Name:    "check",
+					Image:   image,
+					Command: []string{"sleep", "300"},
+				}},
+			},
+		}, metav1.CreateOptions{})
+		// The previous check pod may still be terminating
+		return lastErr == nil, nil
+	}); err != nil {
+		return "", fmt.Errorf("creating the %s pod: %v", serviceCheckPod, lastErr)
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_ = h.KubeClient.CoreV1().Pods(namespace).Delete(cleanup, serviceCheckPod, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	}()
+
+	var pod *corev1.Pod
+	err = wait.PollImmediate(rolloutPollInterval, serviceCheckTimeout, func() (bool, error) {
+		pod, err = pods.Get(ctx, serviceCheckPod, metav1.GetOptions{})
+		return err == nil && pod.Status.Phase == corev1.PodRunning, nil
+	})
+	if err != nil {
+		if problems := h.podProblems(namespace, "app.kubernetes.io/name="+serviceCheckPod); len(problems) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+		}
+		return "", fmt.Errorf("the %s pod is not running: %w", serviceCheckPod, err)
+	}
+
+	// Any status code proves the ClusterIP reached the API server
+	var out string
+	lastErr = nil
+	err = wait.PollImmediate(rolloutPollInterval, serviceCheckTimeout, func() (bool, error) {
+		out, lastErr = h.execContainer(pod, "check", "curl", "-sk", "-o", "/dev/null", "-w", "%{http_code}", "--max-time", "5", target)
+		return lastErr == nil && strings.TrimSpace(out) != "000", nil
+	})
+	if err != nil {
+		if lastErr != nil {
+			err = lastErr
+		}
+		return "", fmt.Errorf("%s is not reachable from the pods: %w", target, err)
+	}
+	return fmt.Sprintf("Services: the ClusterIP %s of the kubernetes service answered with status %s", svc.Spec.ClusterIP, strings.TrimSpace(out)), nil
+}
@@ -0,0 +1,328 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	// l2AnnouncementsSince is the first version answering ARP for the
+	// service IPs
+	l2AnnouncementsSince = semver.MustParse("1.14.0")
+
+	// l2PolicyResource is the resource of the CiliumL2AnnouncementPolicies
+	l2PolicyResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2alpha1", Resource: "ciliuml2announcementpolicies"}
+)
+
+// l2Policy is an announcement policy built from the parameters of the L2
+// announcements operation
+type l2Policy struct {
+	// Name of the policy
+	Name string `yaml:"name"`
+
+	// Interfaces are regular expressions of the interfaces the IPs are
+	// announced on, like ^eth[0-9]+, every interface by default
+	Interfaces []string `yaml:"interfaces"`
+
+	// ServiceSelector selects the announced services by their labels,
+	// every service by default
+	ServiceSelector map[string]string `yaml:"serviceSelector"`
+
+	// NodeSelector selects the nodes announcing the IPs by their labels,
+	// every node by default
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+
+	// ExternalIPs announces the external IPs of the services, and
+	// LoadBalancerIPs their load balancer IPs, which it does unless set to
+	// false
+	ExternalIPs     bool  `yaml:"externalIPs"`
+	LoadBalancerIPs *bool `yaml:"loadBalancerIPs"`
+}
+
+// l2Request holds the parameters of the cilium L2 announcements operation,
+// read from the custom body of the request
+type l2Request struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Policies are created, or replaced if they exist
+	Policies []l2Policy `yaml:"policies"`
+
+	// Remove are the names of the policies to delete
+	Remove []string `yaml:"remove"`
+
+	// LeaseDuration, LeaseRenewDeadline and LeaseRetryPeriod tune the
+	// leases electing the node announcing each service, like 15s, 5s and
+	// 2s which are the defaults of cilium
+	LeaseDuration      string `yaml:"leaseDuration"`
+	LeaseRenewDeadline string `yaml:"leaseRenewDeadline"`
+	LeaseRetryPeriod   string `yaml:"leaseRetryPeriod"`
+
+	// ClientQPS and ClientBurst raise the rate limit of the agents on the
+	// API server, which renew a lease per announced service
+	ClientQPS   int `yaml:"clientQPS"`
+	ClientBurst int `yaml:"clientBurst"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+}
+
+// validate fails on the parameters of the policy which cannot be right,
+// before anything is applied
+func (p l2Policy) validate() error {
+	if errs := validation.IsDNS1123Subdomain(p.Name); len(errs) > 0 {
+		return fmt.Errorf("policy name %q: %s", p.Name, strings.Join(errs, ", "))
+	}
+	for _, iface := range p.Interfaces {
+		if _, err := regexp.Compile(iface); err != nil {
+			return fmt.Errorf("interface of policy %s: %w", p.Name, err)
+		}
+	}
+	if err := validateLabels(p.ServiceSelector); err != nil {
+		return fmt.Errorf("service selector of policy %s: %w", p.Name, err)
+	}
+	if err := validateLabels(p.NodeSelector); err != nil {
+		return fmt.Errorf("node selector of policy %s: %w", p.Name, err)
+	}
+	if !p.ExternalIPs && p.LoadBalancerIPs != nil && !*p.LoadBalancerIPs {
+		return fmt.Errorf("policy %s announces neither external nor load balancer IPs", p.Name)
+	}
+	return nil
+}
+
+// object builds the CiliumL2AnnouncementPolicy of the policy
+func (p l2Policy) object() *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"externalIPs":     p.ExternalIPs,
+		"loadBalancerIPs": p.LoadBalancerIPs == nil || *p.LoadBalancerIPs,
+	}
+	if len(p.Interfaces) > 0 {
+		interfaces := make([]interface{}, 0, len(p.Interfaces))
+		for _, iface := range p.Interfaces {
+			interfaces = append(interfaces, iface)
+		}
+		spec["interfaces"] = interfaces
+	}
+	if len(p.ServiceSelector) > 0 {
+		spec["serviceSelector"] = labelSelector(p.ServiceSelector)
+	}
+	if len(p.NodeSelector) > 0 {
+		spec["nodeSelector"] = labelSelector(p.NodeSelector)
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": l2PolicyResource.GroupVersion().String(),
+		"kind":       "CiliumL2AnnouncementPolicy",
+		"metadata":   map[string]interface{}{"name": p.Name},
+		"spec":       spec,
+	}}
+}
+
+// values returns the chart values enabling the L2 announcements with the
+// leasing settings of the request. The lease must outlast its renew
+// deadline, which must outlast the retry period.
+func (r l2Request) values() (map[string]interface{}, error) {
+	l2 := map[string]interface{}{"enabled": true}
+	var leases []time.Duration
+	for _, lease := range []struct{ key, value string }{
+		{"leaseDuration", r.LeaseDuration},
+		{"leaseRenewDeadline", r.LeaseRenewDeadline},
+		{"leaseRetryPeriod", r.LeaseRetryPeriod},
+	} {
+		if lease.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(lease.value)
+		if err != nil || d <= 0 {
+			return nil, ErrInvalidL2Announcements(fmt.Errorf("%s %q is not a positive duration", lease.key, lease.value))
+		}
+		l2[lease.key] = lease.value
+		leases = append(leases, d)
+	}
+	if len(leases) > 0 && len(leases) < 3 {
+		return nil, ErrInvalidL2Announcements(fmt.Errorf("leaseDuration, leaseRenewDeadline and leaseRetryPeriod are set together"))
+	}
+	if len(leases) == 3 && (leases[0] <= leases[1] || leases[1] <= leases[2]) {
+		return nil, ErrInvalidL2Announcements(fmt.Errorf("leaseDuration must exceed leaseRenewDeadline, which must exceed leaseRetryPeriod"))
+	}
+	values := map[string]interface{}{"l2announcements": l2}
+
+	if r.ClientQPS < 0 || r.ClientBurst < 0 || (r.ClientBurst > 0 && r.ClientBurst < r.ClientQPS) {
+		return nil, ErrInvalidL2Announcements(fmt.Errorf("clientBurst must be positive and at least clientQPS"))
+	}
+	limit := make(map[string]interface{})
+	if r.ClientQPS > 0 {
+		limit["qps"] = r.ClientQPS
+	}
+	if r.ClientBurst > 0 {
+		limit["burst"] = r.ClientBurst
+	}
+	if len(limit) > 0 {
+		values["k8sClientRateLimit"] = limit
+	}
+	return values, nil
+}
+
+// l2AnnouncementsEnabled reports whether the release values enable the L2
+// announcements
+func l2AnnouncementsEnabled(values map[string]interface{}) bool {
+	l2, _ := values["l2announcements"].(map[string]interface{})
+	enabled, _ := l2["enabled"].(bool)
+	return enabled
+}
+
+// l2Announcements enables the L2 announcements on the installed release
+// and applies the announcement policies of the request, or removes the
+// named ones. When deleted, every policy of the request is removed and the
+// announcements are left enabled.
+func (h *Handler) l2Announcements(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium L2 announcements"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req l2Request
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	remove := req.Remove
+	var policies []l2Policy
+	for _, policy := range req.Policies {
+		if del {
+			remove = append(remove, policy.Name)
+			continue
+		}
+		if err := policy.validate(); err != nil {
+			fail(ErrInvalidL2Announcements(err))
+			return
+		}
+		policies = append(policies, policy)
+	}
+	for _, name := range remove {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			fail(ErrInvalidL2Announcements(fmt.Errorf("policy name %q: %s", name, strings.Join(errs, ", "))))
+			return
+		}
+	}
+	if len(policies) == 0 && len(remove) == 0 {
+		fail(ErrInvalidL2Announcements(fmt.Errorf("the request neither has policies to apply nor to remove")))
+		return
+	}
+	l2Values, err := req.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	version, values, err := h.releaseValues(namespace)
+	if err != nil {
+		fail(ErrConfigureL2Announcements(err))
+		return
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		fail(ErrConfigureL2Announcements(err))
+		return
+	}
+	if v.LessThan(l2AnnouncementsSince) {
+		fail(ErrInvalidL2Announcements(fmt.Errorf("cilium %s is installed, the L2 announcements require %s", version, l2AnnouncementsSince)))
+		return
+	}
+
+	var results []string
+	if len(policies) > 0 {
+		if !kubeProxyReplaced(values) {
+			fail(ErrInvalidL2Announcements(fmt.Errorf("the L2 announcements require kube-proxy replacement, install cilium with kubeProxyReplacement first")))
+			return
+		}
+		leasing := req.LeaseDuration != "" || req.ClientQPS > 0 || req.ClientBurst > 0
+		if !l2AnnouncementsEnabled(values) || leasing {
+			_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+				return l2Values, nil
+			})
+			if err != nil {
+				fail(ErrConfigureL2Announcements(err))
+				if rollback != nil {
+					rollback()
+				}
+				return
+			}
+			results = append(results, "L2 announcements: enabled")
+		}
+		if err := h.waitForCRD(ctx, l2PolicyResource, timeout); err != nil {
+			fail(ErrConfigureL2Announcements(fmt.Errorf("the CiliumL2AnnouncementPolicy CRD is not registered: %w", err)))
+			return
+		}
+
+		for _, policy := range policies {
+			stat, err := h.applyResource(ctx, l2PolicyResource, policy.object())
+			if err != nil {
+				results = append(results, fmt.Sprintf("CiliumL2AnnouncementPolicy %s: %s", policy.Name, err))
+				fail(ErrConfigureL2Announcements(fmt.Errorf("%s\n%s", err, strings.Join(results, "\n"))))
+				return
+			}
+			results = append(results, fmt.Sprintf("CiliumL2AnnouncementPolicy %s: %s", policy.Name, stat))
+		}
+	}
+
+	var failed bool
+	for _, name := range remove {
+		err := h.DynamicKubeClient.Resource(l2PolicyResource).Delete(ctx, name, metav1.DeleteOptions{})
+		r := newUninstallResult("CiliumL2AnnouncementPolicy", name, err)
+		failed = failed || r.Err != nil
+		results = append(results, r.String())
+	}
+	if failed {
+		fail(ErrConfigureL2Announcements(fmt.Errorf("some policies could not be removed:\n%s", strings.Join(results, "\n"))))
+		return
+	}
+
+	e.Summary = "Cilium L2 announcements configured successfully"
+	e.Details = strings.Join(results, "\n")
+	h.StreamInfo(e)
+}
@@ -0,0 +1,389 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	// lbIPAMSince is the first version handing out the load balancer IPs
+	lbIPAMSince = semver.MustParse("1.13.0")
+
+	// lbBlocksSince is the first version taking the ranges of a pool as
+	// blocks, which may be start and stop ranges, rather than as cidrs
+	lbBlocksSince = semver.MustParse("1.15.0")
+
+	// lbPoolResource is the resource of the CiliumLoadBalancerIPPools
+	lbPoolResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2alpha1", Resource: "ciliumloadbalancerippools"}
+)
+
+// ipRange is a range of IPs, both ends included
+type ipRange struct {
+	Start string `yaml:"start"`
+	Stop  string `yaml:"stop"`
+
+	// first and last are the parsed ends, in their 16 bytes form
+	first, last net.IP
+}
+
+// String returns the range as the requests write it
+func (r ipRange) String() string {
+	return fmt.Sprintf("%s-%s", r.first, r.last)
+}
+
+// overlaps reports whether both ranges share an IP
+func (r ipRange) overlaps(o ipRange) bool {
+	return bytes.Compare(r.first, o.last) <= 0 && bytes.Compare(o.first, r.last) <= 0
+}
+
+// size returns the number of IPs of the range
+func (r ipRange) size() *big.Int {
+	n := new(big.Int).Sub(new(big.Int).SetBytes(r.last), new(big.Int).SetBytes(r.first))
+	return n.Add(n, big.NewInt(1))
+}
+
+// parseIPRange parses the start and stop of a range
+func parseIPRange(start, stop string) (ipRange, error) {
+	first, last := net.ParseIP(start), net.ParseIP(stop)
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("range %s-%s: not an IP", start, stop)
+	}
+	if (first.To4() == nil) != (last.To4() == nil) || bytes.Compare(first.To16(), last.To16()) > 0 {
+		return ipRange{}, fmt.Errorf("range %s-%s: the start must precede the stop, in the same family", start, stop)
+	}
+	return ipRange{Start: start, Stop: stop, first: first.To16(), last: last.To16()}, nil
+}
+
+// cidrRange returns the range of the IPs of cidr
+func cidrRange(cidr string) (ipRange, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ipRange{}, err
+	}
+	last := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ipRange{Start: network.IP.String(), Stop: last.String(), first: network.IP.To16(), last: last.To16()}, nil
+}
+
+// lbPool is a load balancer IP pool built from the parameters of the LB
+// IPAM operation
+type lbPool struct {
+	// Name of the pool
+	Name string `yaml:"name"`
+
+	// CIDRs and Ranges are the IPs of the pool, the start and stop ranges
+	// require cilium 1.15
+	CIDRs  []string  `yaml:"cidrs"`
+	Ranges []ipRange `yaml:"ranges"`
+
+	// ServiceSelector selects the services the pool hands out IPs to by
+	// their labels, every service by default
+	ServiceSelector map[string]string `yaml:"serviceSelector"`
+}
+
+// ranges parses every range of the pool, the CIDRs first
+func (p lbPool) ranges() ([]ipRange, error) {
+	ranges := make([]ipRange, 0, len(p.CIDRs)+len(p.Ranges))
+	for _, cidr := range p.CIDRs {
+		r, err := cidrRange(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", p.Name, err)
+		}
+		ranges = append(ranges, r)
+	}
+	for _, rng := range p.Ranges {
+		r, err := parseIPRange(rng.Start, rng.Stop)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", p.Name, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// validate fails on the parameters of the pool which cannot be right,
+// including ranges overlapping each other, before anything is applied
+func (p lbPool) validate(v *semver.Version) error {
+	if errs := validation.IsDNS1123Subdomain(p.Name); len(errs) > 0 {
+		return fmt.Errorf("pool name %q: %s", p.Name, strings.Join(errs, ", "))
+	}
+	if len(p.CIDRs) == 0 && len(p.Ranges) == 0 {
+		return fmt.Errorf("pool %s has neither CIDRs nor ranges", p.Name)
+	}
+	if len(p.Ranges) > 0 && v.LessThan(lbBlocksSince) {
+		return fmt.Errorf("cilium %s only takes the CIDRs of pool %s, start and stop ranges require %s", v, p.Name, lbBlocksSince)
+	}
+	if err := validateLabels(p.ServiceSelector); err != nil {
+		return fmt.Errorf("service selector of pool %s: %w", p.Name, err)
+	}
+	ranges, err := p.ranges()
+	if err != nil {
+		return err
+	}
+	for i := range ranges {
+		for j := i + 1; j < len(ranges); j++ {
+			if ranges[i].overlaps(ranges[j]) {
+				return fmt.Errorf("pool %s: %s overlaps %s", p.Name, ranges[i], ranges[j])
+			}
+		}
+	}
+	return nil
+}
+
+// object builds the CiliumLoadBalancerIPPool of the pool for cilium
+// version, with blocks since cilium 1.15 and cidrs before
+func (p lbPool) object(v *semver.Version) *unstructured.Unstructured {
+	blocks := make([]interface{}, 0, len(p.CIDRs)+len(p.Ranges))
+	for _, cidr := range p.CIDRs {
+		blocks = append(blocks, map[string]interface{}{"cidr": cidr})
+	}
+	for _, r := range p.Ranges {
+		blocks = append(blocks, map[string]interface{}{"start": r.Start, "stop": r.Stop})
+	}
+	spec := map[string]interface{}{"blocks": blocks}
+	if v.LessThan(lbBlocksSince) {
+		spec = map[string]interface{}{"cidrs": blocks}
+	}
+	if len(p.ServiceSelector) > 0 {
+		spec["serviceSelector"] = labelSelector(p.ServiceSelector)
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": lbPoolResource.GroupVersion().String(),
+		"kind":       "CiliumLoadBalancerIPPool",
+		"metadata":   map[string]interface{}{"name": p.Name},
+		"spec":       spec,
+	}}
+}
+
+// existingPoolRanges returns the ranges of the pool obj found in the
+// cluster, read from its blocks or cidrs
+func existingPoolRanges(obj unstructured.Unstructured) []ipRange {
+	var ranges []ipRange
+	for _, key := range []string{"blocks", "cidrs"} {
+		blocks, _, _ := unstructured.NestedSlice(obj.Object, "spec", key)
+		for _, b := range blocks {
+			block, _ := b.(map[string]interface{})
+			cidr, _ := block["cidr"].(string)
+			start, _ := block["start"].(string)
+			stop, _ := block["stop"].(string)
+			var r ipRange
+			var err error
+			if cidr != "" {
+				r, err = cidrRange(cidr)
+			} else {
+				r, err = parseIPRange(start, stop)
+			}
+			if err == nil {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	return ranges
+}
+
+// poolUtilization describes how many IPs of the pool obj are allocated,
+// as its status reports them
+func poolUtilization(obj unstructured.Unstructured) string {
+	counts := map[string]string{}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		typ, _ := condition["type"].(string)
+		message, _ := condition["message"].(string)
+		counts[strings.TrimPrefix(typ, "cilium.io/")] = message
+	}
+	if disabled, _, _ := unstructured.NestedBool(obj.Object, "spec", "disabled"); disabled {
+		return fmt.Sprintf("%s: disabled", obj.GetName())
+	}
+	if counts["IPsUsed"] == "" {
+		total := new(big.Int)
+		for _, r := range existingPoolRanges(obj) {
+			total.Add(total, r.size())
+		}
+		return fmt.Sprintf("%s: %s IPs, allocation not reported yet", obj.GetName(), total)
+	}
+	return fmt.Sprintf("%s: %s allocated, %s available of %s IPs", obj.GetName(), counts["IPsUsed"], counts["IPsAvailable"], counts["IPsTotal"])
+}
+
+// lbIPAMRequest holds the parameters of the cilium LB IPAM operation, read
+// from the custom body of the request. Without pools to apply or remove,
+// the operation reports the utilization of the pools of the cluster.
+type lbIPAMRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Pools are created, or replaced if they exist
+	Pools []lbPool `yaml:"pools"`
+
+	// Remove are the names of the pools to delete
+	Remove []string `yaml:"remove"`
+}
+
+// lbIPAM applies the load balancer IP pools of the request, or removes the
+// named ones, then reports the utilization of every pool. The ranges of a
+// pool may not overlap the ones of the other pools of the cluster. When
+// deleted, every pool of the request is removed.
+func (h *Handler) lbIPAM(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium load balancer IP pools"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req lbIPAMRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	remove := req.Remove
+	var pools []lbPool
+	for _, pool := range req.Pools {
+		if del {
+			remove = append(remove, pool.Name)
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	for _, name := range remove {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			fail(ErrInvalidLBIPAM(fmt.Errorf("pool name %q: %s", name, strings.Join(errs, ", "))))
+			return
+		}
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	version, _, err := h.releaseValues(namespace)
+	if err != nil {
+		fail(ErrConfigureLBIPAM(err))
+		return
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		fail(ErrConfigureLBIPAM(err))
+		return
+	}
+	if v.LessThan(lbIPAMSince) {
+		fail(ErrInvalidLBIPAM(fmt.Errorf("cilium %s is installed, the load balancer IP pools require %s", version, lbIPAMSince)))
+		return
+	}
+
+	client := h.DynamicKubeClient.Resource(lbPoolResource)
+	existing, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		fail(ErrConfigureLBIPAM(fmt.Errorf("the CiliumLoadBalancerIPPool CRD is not registered: %w", err)))
+		return
+	}
+
+	// Every pool is checked against the others of the request and the
+	// ones of the cluster it neither replaces nor removes
+	owners := make(map[string][]ipRange)
+	for _, obj := range existing.Items {
+		owners[obj.GetName()] = existingPoolRanges(obj)
+	}
+	for _, name := range remove {
+		delete(owners, name)
+	}
+	for _, pool := range pools {
+		if err := pool.validate(v); err != nil {
+			fail(ErrInvalidLBIPAM(err))
+			return
+		}
+		ranges, _ := pool.ranges()
+		owners[pool.Name] = ranges
+	}
+	for _, pool := range pools {
+		for _, r := range owners[pool.Name] {
+			for name, others := range owners {
+				if name == pool.Name {
+					continue
+				}
+				for _, o := range others {
+					if r.overlaps(o) {
+						fail(ErrInvalidLBIPAM(fmt.Errorf("pool %s: %s overlaps %s of pool %s", pool.Name, r, o, name)))
+						return
+					}
+				}
+			}
+		}
+	}
+
+	var results []string
+	for _, pool := range pools {
+		stat, err := h.applyResource(ctx, lbPoolResource, pool.object(v))
+		if err != nil {
+			results = append(results, fmt.Sprintf("CiliumLoadBalancerIPPool %s: %s", pool.Name, err))
+			fail(ErrConfigureLBIPAM(fmt.Errorf("%s\n%s", err, strings.Join(results, "\n"))))
+			return
+		}
+		results = append(results, fmt.Sprintf("CiliumLoadBalancerIPPool %s: %s", pool.Name, stat))
+	}
+	var failed bool
+	for _, name := range remove {
+		r := newUninstallResult("CiliumLoadBalancerIPPool", name, client.Delete(ctx, name, metav1.DeleteOptions{}))
+		failed = failed || r.Err != nil
+		results = append(results, r.String())
+	}
+	if failed {
+		fail(ErrConfigureLBIPAM(fmt.Errorf("some pools could not be removed:\n%s", strings.Join(results, "\n"))))
+		return
+	}
+
+	if current, err := client.List(ctx, metav1.ListOptions{}); err == nil {
+		utilization := make([]string, 0, len(current.Items))
+		for _, obj := range current.Items {
+			utilization = append(utilization, poolUtilization(obj))
+		}
+		if len(utilization) == 0 {
+			utilization = append(utilization, "no pool")
+		}
+		results = append(results, fmt.Sprintf("Utilization:\n%s", strings.Join(utilization, "\n")))
+	}
+
+	e.Summary = "Cilium load balancer IP pools configured successfully"
+	if len(pools) == 0 && len(remove) == 0 {
+		e.Summary = "Cilium load balancer IP pools"
+	}
+	e.Details = strings.Join(results, "\n")
+	h.StreamInfo(e)
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	lbModeSNAT   = "snat"
+	lbModeDSR    = "dsr"
+	lbModeHybrid = "hybrid"
+
+	lbAlgorithmRandom = "random"
+	lbAlgorithmMaglev = "maglev"
+)
+
+// maglevTableSizes are the sizes of the maglev lookup table cilium accepts,
+// the primes it was tuned for
+var maglevTableSizes = []int{251, 509, 1021, 2039, 4093, 8191, 16381, 32749, 65521, 131071}
+
+// loadBalancerOptions select how cilium balances the services it handles in
+// place of kube-proxy. They are part of the custom body of the install and
+// upgrade requests.
+type loadBalancerOptions struct {
+	// LoadBalancerAlgorithm selects the backends, random or maglev for a
+	// consistent selection across the nodes
+	LoadBalancerAlgorithm string `yaml:"loadBalancerAlgorithm"`
+
+	// LoadBalancerMode forwards the traffic to remote backends with snat,
+	// dsr to preserve the client IP, or hybrid using dsr for TCP only
+	LoadBalancerMode string `yaml:"loadBalancerMode"`
+
+	// MaglevTableSize is the size of the maglev lookup table of every
+	// service, 16381 by default
+	MaglevTableSize int `yaml:"maglevTableSize"`
+}
+
+// set reports whether the options change the load balancing
+func (o loadBalancerOptions) set() bool {
+	return o.LoadBalancerAlgorithm != "" || o.LoadBalancerMode != "" || o.MaglevTableSize != 0
+}
+
+// values translates the options into chart values
+func (o loadBalancerOptions) values() (map[string]interface{}, error) {
+	if !o.set() {
+		return nil, nil
+	}
+	algorithm := strings.ToLower(o.LoadBalancerAlgorithm)
+	switch algorithm {
+	case "", lbAlgorithmRandom, lbAlgorithmMaglev:
+	default:
+		return nil, ErrInvalidLoadBalancer(fmt.Errorf("unknown load balancing algorithm %q, expected %s or %s", o.LoadBalancerAlgorithm, lbAlgorithmRandom, lbAlgorithmMaglev))
+	}
+	mode := strings.ToLower(o.LoadBalancerMode)
+	switch mode {
+	case "", lbModeSNAT, lbModeDSR, lbModeHybrid:
+	default:
+		return nil, ErrInvalidLoadBalancer(fmt.Errorf("unknown load balancing mode %q, expected %s, %s or %s", o.LoadBalancerMode, lbModeSNAT, lbModeDSR, lbModeHybrid))
+	}
+
+	lb := make(map[string]interface{})
+	if algorithm != "" {
+		lb["algorithm"] = algorithm
+	}
+	if mode != "" {
+		lb["mode"] = mode
+	}
+	values := map[string]interface{}{"loadBalancer": lb}
+	if o.MaglevTableSize != 0 {
+		if algorithm != lbAlgorithmMaglev {
+			return nil, ErrInvalidLoadBalancer(fmt.Errorf("maglevTableSize only applies to the %s algorithm, set loadBalancerAlgorithm to %s", lbAlgorithmMaglev, lbAlgorithmMaglev))
+		}
+		values["maglev"] = map[string]interface{}{"tableSize": o.MaglevTableSize}
+	}
+	return values, nil
+}
+
+// checkLoadBalancer rejects the chart values the agents would crashloop on:
+// dsr without native routing or kube-proxy replacement, maglev without
+// kube-proxy replacement and the maglev table sizes cilium does not accept
+func checkLoadBalancer(values map[string]interface{}) error {
+	lb, _ := values["loadBalancer"].(map[string]interface{})
+	mode, _ := lb["mode"].(string)
+	algorithm, _ := lb["algorithm"].(string)
+	if mode == lbModeDSR || mode == lbModeHybrid {
+		if tunnelEnabled(values) {
+			return ErrInvalidLoadBalancer(fmt.Errorf("the %s load balancing mode requires native routing, set routingMode to %s", mode, routingNative))
+		}
+		if !kubeProxyReplaced(values) {
+			return ErrInvalidLoadBalancer(fmt.Errorf("the %s load balancing mode requires kube-proxy replacement, set kubeProxyReplacement to true", mode))
+		}
+	}
+	if algorithm == lbAlgorithmMaglev && !kubeProxyReplaced(values) {
+		return ErrInvalidLoadBalancer(fmt.Errorf("the %s algorithm requires kube-proxy replacement, set kubeProxyReplacement to true", lbAlgorithmMaglev))
+	}
+
+	maglev, _ := values["maglev"].(map[string]interface{})
+	if size, ok := maglev["tableSize"]; ok {
+		n, err := strconv.Atoi(fmt.Sprint(size))
+		if err != nil || !maglevTableSize(n) {
+			return ErrInvalidLoadBalancer(fmt.Errorf("maglev table size %v is not one of the primes cilium accepts: %s", size, strings.Trim(fmt.Sprint(maglevTableSizes), "[]")))
+		}
+	}
+	return nil
+}
+
+// maglevTableSize reports whether n is a maglev table size cilium accepts
+func maglevTableSize(n int) bool {
+	for _, size := range maglevTableSizes {
+		if n == size {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBalancerProbe probes whether an agent forwards the services with the
+// mode and algorithm of o, as the load balancing features of its status
+// report them
+func (h *Handler) loadBalancerProbe(o loadBalancerOptions) agentProbe {
+	return func(pod *corev1.Pod) (string, bool) {
+		out, err := h.execPodCLI(pod, "status -o json")
+		if err != nil {
+			return err.Error(), false
+		}
+		var s struct {
+			KubeProxyReplacement *struct {
+				Features struct {
+					NodePort struct {
+						Mode      string `json:"mode"`
+						Algorithm string `json:"algorithm"`
+						LutSize   int    `json:"lutSize"`
+					} `json:"nodePort"`
+				} `json:"features"`
+			} `json:"kube-proxy-replacement"`
+		}
+		if err := json.Unmarshal([]byte(out), &s); err != nil {
+			return fmt.Sprintf("unreadable status: %s", err), false
+		}
+		if s.KubeProxyReplacement == nil {
+			return "no kube-proxy replacement", false
+		}
+		np := s.KubeProxyReplacement.Features.NodePort
+		state := fmt.Sprintf("mode %s, algorithm %s", np.Mode, np.Algorithm)
+		if np.LutSize != 0 {
+			state = fmt.Sprintf("%s, table size %d", state, np.LutSize)
+		}
+		active := (o.LoadBalancerMode == "" || strings.EqualFold(np.Mode, o.LoadBalancerMode)) &&
+			(o.LoadBalancerAlgorithm == "" || strings.EqualFold(np.Algorithm, o.LoadBalancerAlgorithm)) &&
+			(o.MaglevTableSize == 0 || np.LutSize == o.MaglevTableSize)
+		return state, active
+	}
+}
+
+// waitForLoadBalancer waits for every agent of namespace to forward the
+// services as o requests, and returns the last state of every node
+func (h *Handler) waitForLoadBalancer(e *adapter.Event, namespace string, o loadBalancerOptions, timeout time.Duration) ([]agentState, error) {
+	states, err := h.waitForAgentProbe(e, namespace, "Load balancing", timeout, h.loadBalancerProbe(o))
+	if err != nil {
+		return states, fmt.Errorf("not every agent reports the requested load balancing: %w", err)
+	}
+	return states, nil
+}
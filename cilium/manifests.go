@@ -0,0 +1,546 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+)
+
+const (
+	// manifestInventoryConfigMap records the resources a manifest install
+	// applied, in the namespace of cilium
+	manifestInventoryConfigMap = "cilium-manifest-inventory"
+
+	// manifestFieldManager is the field manager of the server-side applies
+	// of the manifest installs
+	manifestFieldManager = "meshery-cilium"
+
+	// preRenderedManifestPath is the directory of the cilium repo holding
+	// the pre-rendered manifests of a release
+	preRenderedManifestPath = "install/kubernetes"
+
+	// preRenderedManifestPattern selects the pre-rendered manifests in
+	// preRenderedManifestPath
+	preRenderedManifestPattern = "quick-install.yaml"
+)
+
+// The ways cilium is installed by the adapter
+const (
+	installMethodHelm      = "helm"
+	installMethodManifests = "manifests"
+)
+
+// The sources of the manifests of a manifest install
+const (
+	manifestSourceRender = "render"
+	manifestSourceRepo   = "repo"
+)
+
+// manifestOptions installs cilium from its manifests instead of a helm
+// release, for the clusters where helm cannot be used. They are part of
+// the custom body of the install requests.
+type manifestOptions struct {
+	// InstallMethod is helm, the default, or manifests to apply the
+	// manifests with server-side apply. The resources applied are recorded
+	// in an inventory ConfigMap, which the upgrades and the uninstall
+	// follow. A helm install never falls back to the manifests.
+	InstallMethod string `yaml:"installMethod"`
+
+	// ManifestSource is render, the default, rendering the chart locally
+	// with the values of the request, or repo fetching the pre-rendered
+	// manifests of the version from the cilium repo, which ignore the
+	// values
+	ManifestSource string `yaml:"manifestSource"`
+}
+
+// manifests reports whether cilium is installed from its manifests
+func (o manifestOptions) manifests() bool {
+	return o.InstallMethod == installMethodManifests
+}
+
+// source returns the source of the manifests, render by default
+func (o manifestOptions) source() string {
+	if o.ManifestSource == "" {
+		return manifestSourceRender
+	}
+	return o.ManifestSource
+}
+
+// check fails on an unknown install method or manifest source
+func (o manifestOptions) check() error {
+	switch o.InstallMethod {
+	case "", installMethodHelm, installMethodManifests:
+	default:
+		return ErrInvalidInstallMethod(fmt.Errorf("unknown install method %q", o.InstallMethod))
+	}
+	switch o.ManifestSource {
+	case "":
+		return nil
+	case manifestSourceRender, manifestSourceRepo:
+		if !o.manifests() {
+			return ErrInvalidInstallMethod(fmt.Errorf("manifestSource requires the %s install method", installMethodManifests))
+		}
+		return nil
+	}
+	return ErrInvalidInstallMethod(fmt.Errorf("unknown manifest source %q", o.ManifestSource))
+}
+
+// inventoryEntry is a resource applied by a manifest install
+type inventoryEntry struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+func (e inventoryEntry) String() string {
+	if e.Namespace == "" {
+		return fmt.Sprintf("%s %s", e.Kind, e.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", e.Kind, e.Namespace, e.Name)
+}
+
+// manifestInventory is what a manifest install applied, kept in the
+// manifestInventoryConfigMap of its namespace
+type manifestInventory struct {
+	Version   string
+	Source    string
+	Values    map[string]interface{}
+	Resources []inventoryEntry
+}
+
+// readInventory returns the inventory of the manifest install of
+// namespace, or nil if cilium was not installed from manifests there
+func (h *Handler) readInventory(ctx context.Context, namespace string) (*manifestInventory, error) {
+	if h.kubeClient() == nil {
+		return nil, ErrNilClient
+	}
+	cm, err := h.kubeClient().CoreV1().ConfigMaps(namespace).Get(ctx, manifestInventoryConfigMap, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ErrManifestInventory(err)
+	}
+
+	inventory := &manifestInventory{Version: cm.Data["version"], Source: cm.Data["source"]}
+	if err := json.Unmarshal([]byte(cm.Data["resources"]), &inventory.Resources); err != nil {
+		return nil, ErrManifestInventory(fmt.Errorf("resources of %s/%s: %w", namespace, manifestInventoryConfigMap, err))
+	}
+	if values := cm.Data["values"]; values != "" {
+		if err := json.Unmarshal([]byte(values), &inventory.Values); err != nil {
+			return nil, ErrManifestInventory(fmt.Errorf("values of %s/%s: %w", namespace, manifestInventoryConfigMap, err))
+		}
+	}
+	return inventory, nil
+}
+
+// inventoryExists reports whether cilium was installed from manifests in
+// namespace
+func (h *Handler) inventoryExists(ctx context.Context, namespace string) bool {
+	_, err := h.kubeClient().CoreV1().ConfigMaps(namespace).Get(ctx, manifestInventoryConfigMap, metav1.GetOptions{})
+	return err == nil
+}
+
+// writeInventory records inventory as the manifest install of namespace
+func (h *Handler) writeInventory(ctx context.Context, namespace string, inventory *manifestInventory) error {
+	resources, err := json.Marshal(inventory.Resources)
+	if err != nil {
+		return ErrManifestInventory(err)
+	}
+	values, err := json.Marshal(inventory.Values)
+	if err != nil {
+		return ErrManifestInventory(err)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      manifestInventoryConfigMap,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": manifestFieldManager},
+		},
+		Data: map[string]string{
+			"version":   inventory.Version,
+			"source":    inventory.Source,
+			"values":    string(values),
+			"resources": string(resources),
+		},
+	}
+
+	client := h.KubeClient.CoreV1().ConfigMaps(namespace)
+	existing, err := client.Get(ctx, manifestInventoryConfigMap, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	case err == nil:
+		existing.Labels = cm.Labels
+		existing.Data = cm.Data
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return ErrManifestInventory(err)
+	}
+	return nil
+}
+
+// manifestsFor returns the manifests of version from source: the chart
+// rendered with values, or the pre-rendered manifests of the cilium repo
+func (h *Handler) manifestsFor(ctx context.Context, version, namespace, source string, values map[string]interface{}) (string, error) {
+	if source != manifestSourceRepo {
+		manifest, err := h.renderChart(version, namespace, values)
+		if err != nil {
+			return "", ErrRenderChart(err)
+		}
+		return manifest, nil
+	}
+
+	ref := "v" + strings.TrimPrefix(version, "v")
+	files, err := config.GetFiles(ctx, "cilium", "cilium", preRenderedManifestPath, ref, config.FileOptions{Pattern: preRenderedManifestPattern})
+	if err != nil {
+		return "", ErrApplyManifests(err)
+	}
+	if len(files) == 0 {
+		return "", ErrApplyManifests(fmt.Errorf("cilium %s has no pre-rendered manifests at %s/%s", ref, preRenderedManifestPath, preRenderedManifestPattern))
+	}
+	docs := make([]string, 0, len(files))
+	for _, f := range files {
+		docs = append(docs, f.Content)
+	}
+	return strings.Join(docs, "\n---\n"), nil
+}
+
+// manifestObjects parses the documents of manifest, in the order they are
+// to be installed. The namespaced objects without a namespace go to
+// namespace.
+func manifestObjects(manifest string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	for name, doc := range releaseutil.SplitManifests(manifest) {
+		obj := &unstructured.Unstructured{}
+		if err := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(doc), 4096).Decode(&obj.Object); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if len(obj.Object) == 0 || obj.GetKind() == "" {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	sortByKind(objs, releaseutil.InstallOrder)
+	return objs, nil
+}
+
+// sortByKind sorts objs by the order of their kinds, the unknown kinds
+// last and then by name
+func sortByKind(objs []*unstructured.Unstructured, order releaseutil.KindSortOrder) {
+	index := make(map[string]int, len(order))
+	for i, kind := range order {
+		index[kind] = i
+	}
+	rank := func(kind string) int {
+		if i, ok := index[kind]; ok {
+			return i
+		}
+		return len(order)
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		if ri, rj := rank(objs[i].GetKind()), rank(objs[j].GetKind()); ri != rj {
+			return ri < rj
+		}
+		return objs[i].GetName() < objs[j].GetName()
+	})
+}
+
+// manifestMapper maps the kinds of the manifests to their resources
+type manifestMapper struct {
+	*restmapper.DeferredDiscoveryRESTMapper
+}
+
+func (h *Handler) newManifestMapper() manifestMapper {
+	return manifestMapper{restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(h.KubeClient.Discovery()))}
+}
+
+// mapping returns the mapping of the kind of apiVersion, discovering the
+// resources again when it is unknown, as the CRDs applied before it
+// register new kinds
+func (m manifestMapper) mapping(apiVersion, kind string) (*meta.RESTMapping, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := m.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	if meta.IsNoMatchError(err) {
+		m.Reset()
+		mapping, err = m.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	}
+	return mapping, err
+}
+
+// manifestResult is the outcome of applying the manifests of a manifest
+// install
+type manifestResult struct {
+	Applied int
+	Pruned  []uninstallResult
+}
+
+func (r manifestResult) String() string {
+	lines := []string{fmt.Sprintf("Applied %d resources from manifests, recorded in %s", r.Applied, manifestInventoryConfigMap)}
+	if len(r.Pruned) > 0 {
+		lines = append(lines, "Pruned:")
+		for _, p := range r.Pruned {
+			lines = append(lines, p.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// applyManifests applies the manifests of version from source with
+// server-side apply and records them in the inventory of namespace. The
+// resources of previous, the inventory of the install being upgraded, which
+// are no longer part of the manifests are deleted once the others are
+// applied. The resources applied so far are recorded on failure too, for
+// the uninstall to find them.
+func (h *Handler) applyManifests(ctx context.Context, version, namespace, source string, values map[string]interface{}, previous *manifestInventory) (manifestResult, error) {
+	var result manifestResult
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		return result, ErrNilClient
+	}
+	manifest, err := h.manifestsFor(ctx, version, namespace, source, values)
+	if err != nil {
+		return result, err
+	}
+	objs, err := manifestObjects(manifest)
+	if err != nil {
+		return result, ErrApplyManifests(err)
+	}
+
+	inventory := &manifestInventory{Version: version, Source: source, Values: values}
+	if previous != nil {
+		for _, entry := range previous.Resources {
+			// The namespace created by the install stays with it
+			if entry.Kind == "Namespace" && entry.Name == namespace {
+				inventory.Resources = append(inventory.Resources, entry)
+			}
+		}
+	}
+	if _, err := h.KubeClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{}); kerrors.IsNotFound(err) {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+		if _, err := h.KubeClient.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil {
+			return result, ErrApplyManifests(err)
+		}
+		inventory.Resources = append(inventory.Resources, inventoryEntry{APIVersion: "v1", Kind: "Namespace", Name: namespace})
+	}
+
+	mapper := h.newManifestMapper()
+	for _, obj := range objs {
+		entry, err := h.applyObject(ctx, mapper, namespace, obj)
+		if err == nil {
+			inventory.Resources = append(inventory.Resources, entry)
+			result.Applied++
+			continue
+		}
+
+		err = fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)
+		if previous != nil {
+			// The install keeps the version it runs until all is applied
+			inventory.Version, inventory.Source, inventory.Values = previous.Version, previous.Source, previous.Values
+			inventory.Resources = unionEntries(inventory.Resources, previous.Resources)
+		}
+		if werr := h.writeInventory(ctx, namespace, inventory); werr != nil {
+			err = fmt.Errorf("%w, %s", err, werr)
+		}
+		return result, ErrApplyManifests(err)
+	}
+
+	if previous != nil {
+		stale := subtractEntries(previous.Resources, inventory.Resources)
+		result.Pruned = h.deleteEntries(ctx, mapper, stale)
+		for i, r := range result.Pruned {
+			// What could not be pruned is kept for the next upgrade
+			if r.Err != nil {
+				inventory.Resources = append(inventory.Resources, stale[i])
+			}
+		}
+	}
+	if err := h.writeInventory(ctx, namespace, inventory); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// applyObject applies obj with a server-side apply, in namespace if it is
+// namespaced and does not name one, and returns its inventory entry
+func (h *Handler) applyObject(ctx context.Context, mapper manifestMapper, namespace string, obj *unstructured.Unstructured) (inventoryEntry, error) {
+	entry := inventoryEntry{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Name: obj.GetName()}
+	mapping, err := mapper.mapping(obj.GetAPIVersion(), obj.GetKind())
+	if err != nil {
+		return entry, err
+	}
+	resource := h.DynamicKubeClient.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		entry.Namespace = obj.GetNamespace()
+	}
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return entry, err
+	}
+	force := true
+	opts := metav1.PatchOptions{FieldManager: manifestFieldManager, Force: &force}
+	if entry.Namespace != "" {
+		_, err = resource.Namespace(entry.Namespace).Patch(ctx, entry.Name, types.ApplyPatchType, data, opts)
+	} else {
+		_, err = resource.Patch(ctx, entry.Name, types.ApplyPatchType, data, opts)
+	}
+	return entry, err
+}
+
+// unionEntries returns the entries of a followed by those of b missing
+// from it
+func unionEntries(a, b []inventoryEntry) []inventoryEntry {
+	return append(append([]inventoryEntry{}, a...), subtractEntries(b, a)...)
+}
+
+// key identifies the resource of the entry whatever the version of its
+// API, as a kind moving to a new version keeps its resources
+func (e inventoryEntry) key() string {
+	group := ""
+	if gv, err := schema.ParseGroupVersion(e.APIVersion); err == nil {
+		group = gv.Group
+	}
+	return strings.Join([]string{group, e.Kind, e.Namespace, e.Name}, "/")
+}
+
+// subtractEntries returns the entries of a missing from b
+func subtractEntries(a, b []inventoryEntry) []inventoryEntry {
+	seen := make(map[string]bool, len(b))
+	for _, entry := range b {
+		seen[entry.key()] = true
+	}
+	var missing []inventoryEntry
+	for _, entry := range a {
+		if !seen[entry.key()] {
+			missing = append(missing, entry)
+		}
+	}
+	return missing
+}
+
+// deleteEntries deletes the resources of entries in the order of an
+// uninstall, returning an outcome per entry in the order of entries. The
+// system namespaces are never deleted.
+func (h *Handler) deleteEntries(ctx context.Context, mapper manifestMapper, entries []inventoryEntry) []uninstallResult {
+	order := make(map[string]int, len(releaseutil.UninstallOrder))
+	for i, kind := range releaseutil.UninstallOrder {
+		order[kind] = i
+	}
+	indexes := make([]int, len(entries))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		oi, iok := order[entries[indexes[i]].Kind]
+		oj, jok := order[entries[indexes[j]].Kind]
+		if iok != jok {
+			// The unknown kinds, like the custom resources, go first
+			return !iok
+		}
+		return oi < oj
+	})
+
+	results := make([]uninstallResult, len(entries))
+	propagation := metav1.DeletePropagationBackground
+	for _, i := range indexes {
+		entry := entries[i]
+		name := entry.Name
+		if entry.Namespace != "" {
+			name = entry.Namespace + "/" + entry.Name
+		}
+		if entry.Kind == "Namespace" && systemNamespaces[entry.Name] {
+			results[i] = uninstallResult{Kind: entry.Kind, Name: name, NotFound: true}
+			continue
+		}
+		mapping, err := mapper.mapping(entry.APIVersion, entry.Kind)
+		if meta.IsNoMatchError(err) {
+			// The kind is no longer served, so nothing of it is left
+			results[i] = uninstallResult{Kind: entry.Kind, Name: name, NotFound: true}
+			continue
+		}
+		if err == nil {
+			resource := h.DynamicKubeClient.Resource(mapping.Resource)
+			opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+			if entry.Namespace != "" {
+				err = resource.Namespace(entry.Namespace).Delete(ctx, entry.Name, opts)
+			} else {
+				err = resource.Delete(ctx, entry.Name, opts)
+			}
+		}
+		results[i] = newUninstallResult(entry.Kind, name, err)
+	}
+	return results
+}
+
+// uninstallManifests deletes the resources of the manifest install of
+// namespace, then its inventory unless some of them are left
+func (h *Handler) uninstallManifests(ctx context.Context, namespace string, inventory *manifestInventory) []uninstallResult {
+	results := h.deleteEntries(ctx, h.newManifestMapper(), inventory.Resources)
+
+	var left []inventoryEntry
+	for i, r := range results {
+		if r.Err != nil {
+			left = append(left, inventory.Resources[i])
+		}
+	}
+	if len(left) > 0 {
+		inventory.Resources = left
+		if err := h.writeInventory(ctx, namespace, inventory); err != nil {
+			results = append(results, uninstallResult{Kind: "ConfigMap", Name: namespace + "/" + manifestInventoryConfigMap, Err: err})
+		}
+		return results
+	}
+	err := h.KubeClient.CoreV1().ConfigMaps(namespace).Delete(ctx, manifestInventoryConfigMap, metav1.DeleteOptions{})
+	return append(results, newUninstallResult("ConfigMap", namespace+"/"+manifestInventoryConfigMap, err))
+}
+
+// removeManifests deletes the manifest install of namespace, failing with
+// the resources left
+func (h *Handler) removeManifests(ctx context.Context, namespace string, inventory *manifestInventory) error {
+	var failed []string
+	for _, r := range h.uninstallManifests(ctx, namespace, inventory) {
+		if r.Err != nil {
+			failed = append(failed, r.String())
+		}
+	}
+	if len(failed) > 0 {
+		return ErrUninstallCilium(fmt.Errorf("%s", strings.Join(failed, "; ")))
+	}
+	return nil
+}
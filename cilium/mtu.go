@@ -0,0 +1,136 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// minMTU is the smallest MTU accepted, the minimum of IPv6
+	minMTU = 1280
+
+	// maxMTU is the largest MTU accepted, the jumbo frames of most NICs
+	maxMTU = 9216
+
+	// tunnelOverhead is the room the VXLAN and Geneve headers take out of
+	// the MTU of the node interfaces
+	tunnelOverhead = 50
+
+	// mtuScript prints the MTU of the routes of cilium_host, which accounts
+	// for the tunnel headers, then the one of the device
+	mtuScript = "ip -o route show dev cilium_host 2>/dev/null | sed -n 's/.* mtu \\([0-9]*\\).*/\\1/p'; cat /sys/class/net/cilium_host/mtu"
+)
+
+// mtuOptions overrides the MTU cilium detects on the nodes. They are part of
+// the custom body of the install requests.
+type mtuOptions struct {
+	// MTU of the pod network, detected by cilium when unset
+	MTU int `yaml:"mtu"`
+
+	// DetectMTU reads the MTU of the default route interface of every node
+	// with the preflight pods before installing, warning when they differ.
+	// It is implied by an MTU along with tunneling, which is checked to
+	// leave room for the tunnel headers.
+	DetectMTU bool `yaml:"detectMTU"`
+}
+
+// values translates the options into chart values
+func (o mtuOptions) values() (map[string]interface{}, error) {
+	if o.MTU == 0 {
+		return nil, nil
+	}
+	if o.MTU < minMTU || o.MTU > maxMTU {
+		return nil, ErrInvalidMTU(fmt.Errorf("mtu %d is out of the %d-%d range", o.MTU, minMTU, maxMTU))
+	}
+	return map[string]interface{}{"MTU": o.MTU}, nil
+}
+
+// detect reports whether the node MTUs are to be read before installing
+// with tunnel set if the values encapsulate the traffic between the nodes
+func (o mtuOptions) detect(tunnel bool) bool {
+	return o.DetectMTU || (o.MTU != 0 && tunnel)
+}
+
+// checkNodeMTUs reads the MTU of every node with the preflight pods of
+// namespace running image, and fails if the MTU of o leaves no room for
+// the tunnel headers on one of them when tunnel is set. Differing MTUs and
+// nodes which did not report are returned as warnings.
+func (h *Handler) checkNodeMTUs(e *adapter.Event, namespace, image string, o mtuOptions, tunnel bool, timeout time.Duration) ([]string, error) {
+	if image == "" {
+		image = defaultEnvCheckImage
+	}
+	nodes, outputs, err := h.runEnvCheckPods(e, namespace, image, timeout)
+	if err != nil {
+		return nil, ErrEnvCheck(err)
+	}
+
+	var warnings, missing []string
+	mtus := make(map[int][]string)
+	for _, node := range nodes {
+		mtu, err := strconv.Atoi(outputs[node.Name]["mtu"])
+		if err != nil || mtu == 0 {
+			missing = append(missing, node.Name)
+			continue
+		}
+		mtus[mtu] = append(mtus[mtu], node.Name)
+	}
+	if len(missing) > 0 {
+		warnings = append(warnings, fmt.Sprintf("Warning: the MTU of %s could not be read", strings.Join(missing, ", ")))
+	}
+	if len(mtus) == 0 {
+		return warnings, nil
+	}
+
+	detected := make([]int, 0, len(mtus))
+	for mtu := range mtus {
+		detected = append(detected, mtu)
+	}
+	sort.Ints(detected)
+	if len(detected) > 1 {
+		groups := make([]string, 0, len(detected))
+		for _, mtu := range detected {
+			groups = append(groups, fmt.Sprintf("%d on %s", mtu, strings.Join(mtus[mtu], ", ")))
+		}
+		warnings = append(warnings, fmt.Sprintf("Warning: the nodes have different MTUs (%s), cilium uses the MTU of each node unless mtu is set, which is then to fit the smallest", strings.Join(groups, "; ")))
+	}
+
+	if o.MTU != 0 && tunnel && o.MTU > detected[0]-tunnelOverhead {
+		return warnings, ErrInvalidMTU(fmt.Errorf("mtu %d leaves no room for the tunnel headers on %s, whose MTU is %d: set it to %d or less, or use native routing", o.MTU, strings.Join(mtus[detected[0]], ", "), detected[0], detected[0]-tunnelOverhead))
+	}
+	return warnings, nil
+}
+
+// agentMTU returns the MTU the agent pod set up for the pods, empty if it
+// cannot be read
+func (h *Handler) agentMTU(pod *corev1.Pod) string {
+	out, err := h.execPod(pod, "sh", "-c", mtuScript)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if _, err := strconv.Atoi(strings.TrimSpace(line)); err == nil {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,383 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// defaultSpireNamespace is where the chart installs SPIRE
+	defaultSpireNamespace = "cilium-spire"
+
+	// spireServerStatefulSet and spireAgentDaemonSet are the SPIRE
+	// components the chart installs
+	spireServerStatefulSet = "spire-server"
+	spireAgentDaemonSet    = "spire-agent"
+
+	// defaultStorageClassAnnotation marks the default StorageClass of the
+	// cluster
+	defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+)
+
+// mutualAuthSince is the first version authenticating the workloads
+// mutually with SPIFFE identities
+var mutualAuthSince = semver.MustParse("1.14.0")
+
+// mutualAuthRequest holds the parameters of the cilium mutual
+// authentication operation, read from the custom body of the request
+type mutualAuthRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// SpireNamespace is where the chart installs SPIRE, cilium-spire by
+	// default
+	SpireNamespace string `yaml:"spireNamespace"`
+
+	// TrustDomain of the SPIFFE identities, spiffe.cilium by default
+	TrustDomain string `yaml:"trustDomain"`
+
+	// ServerAddress is the address of an existing SPIRE server, like
+	// spire-server.spire.svc:8081, which is used in place of installing
+	// one. Its agents are to expose their sockets at AgentSocketPath and
+	// AdminSocketPath on the nodes, the paths of the chart by default.
+	ServerAddress   string `yaml:"serverAddress"`
+	AgentSocketPath string `yaml:"agentSocketPath"`
+	AdminSocketPath string `yaml:"adminSocketPath"`
+
+	// DataStorage keeps the data of the installed SPIRE server on a
+	// persistent volume, which it does unless set to false, of
+	// StorageClass or else of the default class of the cluster
+	DataStorage  *bool  `yaml:"dataStorage"`
+	StorageClass string `yaml:"storageClass"`
+
+	// Timeout bounds the rollout of SPIRE and of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the
+	// agents do not register with SPIRE, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// external reports whether an existing SPIRE server is used
+func (r mutualAuthRequest) external() bool {
+	return r.ServerAddress != ""
+}
+
+// spireNamespace returns the namespace of the SPIRE install of the chart
+func (r mutualAuthRequest) spireNamespace() string {
+	if r.SpireNamespace == "" {
+		return defaultSpireNamespace
+	}
+	return r.SpireNamespace
+}
+
+// dataStorage reports whether the installed SPIRE server keeps its data
+// on a persistent volume
+func (r mutualAuthRequest) dataStorage() bool {
+	return r.DataStorage == nil || *r.DataStorage
+}
+
+// values translates the request into chart values, installing SPIRE
+// unless an existing server is given
+func (r mutualAuthRequest) values() (map[string]interface{}, error) {
+	spire := map[string]interface{}{"enabled": true}
+	if r.TrustDomain != "" {
+		if errs := validation.IsDNS1123Subdomain(r.TrustDomain); len(errs) > 0 {
+			return nil, ErrInvalidMutualAuth(fmt.Errorf("trust domain %q: %s", r.TrustDomain, strings.Join(errs, ", ")))
+		}
+		spire["trustDomain"] = r.TrustDomain
+	}
+
+	if r.external() {
+		host, port, err := net.SplitHostPort(r.ServerAddress)
+		if err != nil {
+			return nil, ErrInvalidMutualAuth(fmt.Errorf("server address %q: %w", r.ServerAddress, err))
+		}
+		if n, err := strconv.Atoi(port); err != nil || len(validation.IsValidPortNum(n)) > 0 || host == "" {
+			return nil, ErrInvalidMutualAuth(fmt.Errorf("server address %q is not a host and a port", r.ServerAddress))
+		}
+		if r.SpireNamespace != "" || r.DataStorage != nil || r.StorageClass != "" {
+			return nil, ErrInvalidMutualAuth(fmt.Errorf("spireNamespace, dataStorage and storageClass configure the SPIRE install, not an existing server"))
+		}
+		spire["install"] = map[string]interface{}{"enabled": false}
+		spire["serverAddress"] = r.ServerAddress
+		for key, path := range map[string]string{"agentSocketPath": r.AgentSocketPath, "adminSocketPath": r.AdminSocketPath} {
+			if path == "" {
+				continue
+			}
+			if !strings.HasPrefix(path, "/") {
+				return nil, ErrInvalidMutualAuth(fmt.Errorf("%s %q is not an absolute path", key, path))
+			}
+			spire[key] = path
+		}
+	} else {
+		if r.AgentSocketPath != "" || r.AdminSocketPath != "" {
+			return nil, ErrInvalidMutualAuth(fmt.Errorf("agentSocketPath and adminSocketPath require the serverAddress of an existing server"))
+		}
+		if err := validateNamespace(r.SpireNamespace); err != nil {
+			return nil, err
+		}
+		dataStorage := map[string]interface{}{"enabled": r.dataStorage()}
+		if r.StorageClass != "" {
+			if !r.dataStorage() {
+				return nil, ErrInvalidMutualAuth(fmt.Errorf("storageClass requires the data storage"))
+			}
+			dataStorage["storageClass"] = r.StorageClass
+		}
+		spire["install"] = map[string]interface{}{
+			"enabled":   true,
+			"namespace": r.spireNamespace(),
+			"server":    map[string]interface{}{"dataStorage": dataStorage},
+		}
+	}
+
+	return map[string]interface{}{
+		"authentication": map[string]interface{}{
+			"mutual": map[string]interface{}{"spire": spire},
+		},
+	}, nil
+}
+
+// checkSpireResources fails unless the cluster can run the SPIRE install
+// of the request: the volume of the server needs its StorageClass, or a
+// default class
+func (h *Handler) checkSpireResources(ctx context.Context, req mutualAuthRequest) error {
+	if req.external() || !req.dataStorage() {
+		return nil
+	}
+	if req.StorageClass != "" {
+		if _, err := h.KubeClient.StorageV1().StorageClasses().Get(ctx, req.StorageClass, metav1.GetOptions{}); err != nil {
+			return ErrSpireResources(fmt.Errorf("the StorageClass %s of the SPIRE server: %w", req.StorageClass, err))
+		}
+		return nil
+	}
+	classes, err := h.KubeClient.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return ErrSpireResources(err)
+	}
+	for _, class := range classes.Items {
+		if class.Annotations[defaultStorageClassAnnotation] == "true" {
+			return nil
+		}
+	}
+	return ErrSpireResources(fmt.Errorf("the SPIRE server keeps its data on a persistent volume and the cluster has no default StorageClass"))
+}
+
+// spireProblems describes why the SPIRE components of namespace are not
+// ready, along with the volume claims left pending
+func (h *Handler) spireProblems(ctx context.Context, namespace string) []string {
+	var problems []string
+	for _, selector := range []string{"app=" + spireServerStatefulSet, "app=" + spireAgentDaemonSet} {
+		problems = append(problems, h.podProblems(namespace, selector)...)
+		pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			continue
+		}
+		for _, pod := range pods.Items {
+			for _, cond := range pod.Status.Conditions {
+				if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse {
+					problems = append(problems, fmt.Sprintf("%s: %s %s", pod.Name, cond.Reason, cond.Message))
+				}
+			}
+		}
+	}
+	claims, err := h.KubeClient.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+	if err == nil {
+		for _, claim := range claims.Items {
+			if claim.Status.Phase == corev1.ClaimPending {
+				problems = append(problems, fmt.Sprintf("PersistentVolumeClaim %s is pending", claim.Name))
+			}
+		}
+	}
+	return problems
+}
+
+// waitForStatefulSet waits for every replica of the StatefulSet name of
+// namespace to be updated and ready
+func (h *Handler) waitForStatefulSet(namespace, name string, timeout time.Duration) error {
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		sts, err := h.KubeClient.AppsV1().StatefulSets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		desired := int32(1)
+		if sts.Spec.Replicas != nil {
+			desired = *sts.Spec.Replicas
+		}
+		return sts.Status.ObservedGeneration >= sts.Generation &&
+			sts.Status.UpdatedReplicas == desired &&
+			sts.Status.ReadyReplicas == desired, nil
+	})
+}
+
+// waitForSpire waits for the SPIRE server and agents of namespace to be
+// ready, describing what holds them on failure
+func (h *Handler) waitForSpire(e *adapter.Event, namespace string, timeout time.Duration) error {
+	h.streamProgress(e, "Waiting for the SPIRE server to become ready", "")
+	err := h.waitForStatefulSet(namespace, spireServerStatefulSet, timeout)
+	if err == nil {
+		err = h.waitForDaemonSet(e, namespace, spireAgentDaemonSet, "SPIRE agents", timeout)
+	}
+	if err != nil {
+		if problems := h.spireProblems(context.Background(), namespace); len(problems) > 0 {
+			return ErrSpireResources(fmt.Errorf("%w: %s", err, strings.Join(problems, "; ")))
+		}
+		return err
+	}
+	return nil
+}
+
+// spireProbe tells whether the agent reports its connection to SPIRE in
+// its verbose status
+func (h *Handler) spireProbe(pod *corev1.Pod) (string, bool) {
+	out, err := h.execPodCLI(pod, "status --verbose")
+	if err != nil {
+		return err.Error(), false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+		if !strings.Contains(lower, "spire") && !strings.Contains(lower, "mutual auth") {
+			continue
+		}
+		failed := strings.Contains(lower, "fail") || strings.Contains(lower, "error") || strings.Contains(lower, "disabled")
+		return line, !failed
+	}
+	return "SPIRE not reported", false
+}
+
+// mutualAuth enables, or disables if del is set, the mutual authentication
+// of cilium on the installed release, with the SPIRE install of the chart
+// or an existing SPIRE server, and waits for every agent to register with
+// SPIRE
+func (h *Handler) mutualAuth(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring the Cilium mutual authentication"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req mutualAuthRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	authValues, err := req.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if del {
+		authValues = map[string]interface{}{
+			"authentication": map[string]interface{}{
+				"mutual": map[string]interface{}{
+					"spire": map[string]interface{}{
+						"enabled": false,
+						"install": map[string]interface{}{"enabled": false},
+					},
+				},
+			},
+		}
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	version, _, err := h.releaseValues(namespace)
+	if err != nil {
+		fail(ErrConfigureMutualAuth(err))
+		return
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		fail(ErrConfigureMutualAuth(err))
+		return
+	}
+	if v.LessThan(mutualAuthSince) {
+		fail(ErrInvalidMutualAuth(fmt.Errorf("cilium %s is installed, the mutual authentication requires %s", version, mutualAuthSince)))
+		return
+	}
+	if !del {
+		if err := h.checkSpireResources(ctx, req); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+		return authValues, nil
+	})
+	if err == nil && !del && !req.external() {
+		err = h.waitForSpire(e, req.spireNamespace(), timeout)
+	}
+	var states []agentState
+	if err == nil && !del {
+		states, err = h.waitForAgentProbe(e, namespace, "their registration with SPIRE", timeout, h.spireProbe)
+		if err != nil {
+			err = fmt.Errorf("the agents did not register with SPIRE: %w\n%s", err, agentStateDetails("SPIRE per node", states))
+		}
+	}
+	if err != nil {
+		fail(ErrConfigureMutualAuth(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+
+	if del {
+		e.Summary = "Cilium mutual authentication disabled successfully"
+		e.Details = fmt.Sprintf("Cilium %s no longer authenticates the workloads, the policies requiring authentication drop their traffic.", version)
+		h.StreamInfo(e)
+		return
+	}
+	e.Summary = "Cilium mutual authentication enabled successfully"
+	server := fmt.Sprintf("the SPIRE server installed in %s", req.spireNamespace())
+	if req.external() {
+		server = fmt.Sprintf("the SPIRE server at %s", req.ServerAddress)
+	}
+	e.Details = fmt.Sprintf("The agents of Cilium %s are registered with %s. Set authentication.mode: required on the rules of the policies to authenticate their traffic.\n%s", version, server, agentStateDetails("SPIRE per node", states))
+	h.StreamInfo(e)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// defaultCiliumNamespace is where cilium is installed unless the
+	// request asks for another namespace
+	defaultCiliumNamespace = "kube-system"
+
+	// agentSelector selects the DaemonSet of the cilium agents
+	agentSelector = "k8s-app=cilium"
+)
+
+// systemNamespaces are never deleted along with cilium, even when it was
+// installed in one of them
+var systemNamespaces = map[string]bool{
+	"default":         true,
+	"kube-system":     true,
+	"kube-public":     true,
+	"kube-node-lease": true,
+}
+
+// validateNamespace fails if namespace is not a valid namespace name. An
+// empty namespace is valid and stands for the namespace cilium runs in.
+func validateNamespace(namespace string) error {
+	if namespace == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return ErrInvalidNamespace(fmt.Errorf("%q: %s", namespace, strings.Join(errs, ", ")))
+	}
+	return nil
+}
+
+// ciliumNamespace returns the namespace the operations act on: the
+// requested one if set, else the namespace of the installed cilium agents,
+// else the default namespace
+func (h *Handler) ciliumNamespace(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if h.KubeClient == nil {
+		return defaultCiliumNamespace
+	}
+	daemonSets, err := h.KubeClient.AppsV1().DaemonSets(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil || len(daemonSets.Items) == 0 {
+		return defaultCiliumNamespace
+	}
+	return daemonSets.Items[0].Namespace
+}
@@ -0,0 +1,416 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// namespaceLabelPrefix prefixes the labels of the namespace in the
+	// labels of the endpoints
+	namespaceLabelPrefix = "io.cilium.k8s.namespace.labels."
+
+	// netpolSourceAnnotation names the NetworkPolicy a policy was
+	// converted from
+	netpolSourceAnnotation = "meshery.io/source-network-policy"
+)
+
+// netpolConversion is the policy converted from a NetworkPolicy, along with
+// the differences of semantics the conversion dealt with
+type netpolConversion struct {
+	Source string
+	Policy *unstructured.Unstructured
+	Notes  []string
+}
+
+// note records a difference of semantics once
+func (c *netpolConversion) note(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	for _, n := range c.Notes {
+		if n == msg {
+			return
+		}
+	}
+	c.Notes = append(c.Notes, msg)
+}
+
+// networkPolicies decodes the NetworkPolicies of manifest, the namespace
+// of those setting none being namespace
+func networkPolicies(manifest, namespace string) ([]networkingv1.NetworkPolicy, error) {
+	objs, err := manifestObjects(manifest)
+	if err != nil {
+		return nil, ErrConvertNetworkPolicy(err)
+	}
+	var policies []networkingv1.NetworkPolicy
+	for _, obj := range objs {
+		if obj.GetKind() != "NetworkPolicy" {
+			return nil, ErrConvertNetworkPolicy(fmt.Errorf("%s %s is not a NetworkPolicy", obj.GetKind(), obj.GetName()))
+		}
+		var policy networkingv1.NetworkPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+			return nil, ErrConvertNetworkPolicy(fmt.Errorf("NetworkPolicy %s: %w", obj.GetName(), err))
+		}
+		if policy.Namespace == "" {
+			policy.Namespace = namespace
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// convertNetworkPolicy converts policy into the CiliumNetworkPolicy of the
+// same name and namespace, allowing the same traffic. The source policy is
+// named in an annotation if annotate is set.
+func convertNetworkPolicy(policy networkingv1.NetworkPolicy, annotate bool) netpolConversion {
+	c := netpolConversion{Source: fmt.Sprintf("NetworkPolicy %s/%s", policy.Namespace, policy.Name)}
+
+	if len(policy.Spec.PodSelector.MatchLabels) == 0 && len(policy.Spec.PodSelector.MatchExpressions) == 0 {
+		c.note("the empty podSelector selects every pod of %s, so does the empty endpointSelector", policy.Namespace)
+	}
+	spec := map[string]interface{}{
+		"endpointSelector": endpointSelector(&policy.Spec.PodSelector, ""),
+	}
+
+	ingress, egress := len(policy.Spec.PolicyTypes) == 0, len(policy.Spec.Egress) > 0 && len(policy.Spec.PolicyTypes) == 0
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	if ingress {
+		rules := make([]interface{}, 0, len(policy.Spec.Ingress))
+		for _, rule := range policy.Spec.Ingress {
+			rules = append(rules, peerRules(&c, "from", rule.From, rule.Ports, policy.Namespace)...)
+		}
+		if len(rules) == 0 {
+			// An empty rule enforces the policy on the endpoints, denying
+			// everything as no peer is allowed
+			rules = append(rules, map[string]interface{}{})
+			c.note("no ingress rule denies every ingress, as the empty ingress rule does")
+		}
+		spec["ingress"] = rules
+	}
+	if egress {
+		rules := make([]interface{}, 0, len(policy.Spec.Egress))
+		for _, rule := range policy.Spec.Egress {
+			rules = append(rules, peerRules(&c, "to", rule.To, rule.Ports, policy.Namespace)...)
+		}
+		if len(rules) == 0 {
+			rules = append(rules, map[string]interface{}{})
+			c.note("no egress rule denies every egress, as the empty egress rule does")
+		} else {
+			c.note("the egress rules allow DNS only when a rule allows it, L7 DNS rules can be added to restrict the names resolved")
+		}
+		spec["egress"] = rules
+	}
+
+	metadata := map[string]interface{}{
+		"name":      policy.Name,
+		"namespace": policy.Namespace,
+		"labels":    map[string]interface{}{"app.kubernetes.io/managed-by": manifestFieldManager},
+	}
+	if annotate {
+		metadata["annotations"] = map[string]interface{}{netpolSourceAnnotation: policy.Namespace + "/" + policy.Name}
+	}
+	c.Policy = &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": policyAPIVersion,
+		"kind":       "CiliumNetworkPolicy",
+		"metadata":   metadata,
+		"spec":       spec,
+	}}
+	return c
+}
+
+// peerRules converts a rule of a NetworkPolicy of namespace, from or to
+// peers through ports, into cilium rules. direction is from for ingress
+// and to for egress. The peers of a NetworkPolicy rule are alternatives,
+// each kind of peer gets a rule of its own.
+func peerRules(c *netpolConversion, direction string, peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort, namespace string) []interface{} {
+	withPorts := func(rule map[string]interface{}) map[string]interface{} {
+		if len(ports) > 0 {
+			rule["toPorts"] = []interface{}{map[string]interface{}{"ports": policyPorts(c, ports)}}
+		}
+		return rule
+	}
+
+	if len(peers) == 0 {
+		c.note("a rule without peers allows every peer, inside the cluster or out of it, as the %sEntities all rule does", direction)
+		return []interface{}{withPorts(map[string]interface{}{direction + "Entities": []interface{}{"all"}})}
+	}
+
+	var endpoints, cidrs []interface{}
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			cidr := map[string]interface{}{"cidr": peer.IPBlock.CIDR}
+			if len(peer.IPBlock.Except) > 0 {
+				except := make([]interface{}, 0, len(peer.IPBlock.Except))
+				for _, e := range peer.IPBlock.Except {
+					except = append(except, e)
+				}
+				cidr["except"] = except
+				c.note("the except clauses of the ipBlocks are kept as except of the %sCIDRSet rules", direction)
+			}
+			cidrs = append(cidrs, cidr)
+			continue
+		}
+		endpoints = append(endpoints, peerSelector(c, peer, namespace))
+	}
+	if len(cidrs) > 0 {
+		c.note("the ipBlocks only match the addresses out of the cluster, the pods being matched by their identity and not by their address")
+	}
+
+	var rules []interface{}
+	if len(endpoints) > 0 {
+		rules = append(rules, withPorts(map[string]interface{}{direction + "Endpoints": endpoints}))
+	}
+	if len(cidrs) > 0 {
+		rules = append(rules, withPorts(map[string]interface{}{direction + "CIDRSet": cidrs}))
+	}
+	return rules
+}
+
+// peerSelector converts the pod and namespace selectors of peer into an
+// endpoint selector. The selectors of a namespaced cilium policy only
+// select the endpoints of its namespace unless they mention the namespace
+// label, which they do to select other namespaces.
+func peerSelector(c *netpolConversion, peer networkingv1.NetworkPolicyPeer, namespace string) map[string]interface{} {
+	if peer.NamespaceSelector == nil {
+		return endpointSelector(peer.PodSelector, "")
+	}
+	selector := endpointSelector(peer.PodSelector, "")
+	namespaces := endpointSelector(peer.NamespaceSelector, namespaceLabelPrefix)
+	if labels, ok := namespaces["matchLabels"].(map[string]interface{}); ok {
+		matchLabels, _ := selector["matchLabels"].(map[string]interface{})
+		if matchLabels == nil {
+			matchLabels = make(map[string]interface{})
+		}
+		for key, value := range labels {
+			matchLabels[key] = value
+		}
+		selector["matchLabels"] = matchLabels
+	}
+	expressions, _ := selector["matchExpressions"].([]interface{})
+	if nsExpressions, ok := namespaces["matchExpressions"].([]interface{}); ok {
+		expressions = append(expressions, nsExpressions...)
+	}
+	// Any namespace the namespace selector matches, not only the one of
+	// the policy
+	expressions = append(expressions, map[string]interface{}{"key": "k8s:" + podNamespaceLabel, "operator": string(metav1.LabelSelectorOpExists)})
+	selector["matchExpressions"] = expressions
+	if len(peer.NamespaceSelector.MatchLabels) == 0 && len(peer.NamespaceSelector.MatchExpressions) == 0 {
+		c.note("the empty namespaceSelector selects every namespace, not only %s", namespace)
+	}
+	return selector
+}
+
+// endpointSelector converts a label selector into an endpoint selector,
+// prefixing the label keys with prefix. A nil selector selects everything.
+func endpointSelector(selector *metav1.LabelSelector, prefix string) map[string]interface{} {
+	converted := make(map[string]interface{})
+	if selector == nil {
+		return converted
+	}
+	if len(selector.MatchLabels) > 0 {
+		labels := make(map[string]interface{}, len(selector.MatchLabels))
+		for key, value := range selector.MatchLabels {
+			labels[prefix+key] = value
+		}
+		converted["matchLabels"] = labels
+	}
+	if len(selector.MatchExpressions) > 0 {
+		expressions := make([]interface{}, 0, len(selector.MatchExpressions))
+		for _, expr := range selector.MatchExpressions {
+			entry := map[string]interface{}{"key": prefix + expr.Key, "operator": string(expr.Operator)}
+			if len(expr.Values) > 0 {
+				values := make([]interface{}, 0, len(expr.Values))
+				for _, v := range expr.Values {
+					values = append(values, v)
+				}
+				entry["values"] = values
+			}
+			expressions = append(expressions, entry)
+		}
+		converted["matchExpressions"] = expressions
+	}
+	return converted
+}
+
+// policyPorts converts the ports of a NetworkPolicy rule into the ports of
+// a cilium port rule
+func policyPorts(c *netpolConversion, ports []networkingv1.NetworkPolicyPort) []interface{} {
+	converted := make([]interface{}, 0, len(ports))
+	for _, port := range ports {
+		protocol := corev1.ProtocolTCP
+		if port.Protocol != nil {
+			protocol = *port.Protocol
+		}
+		entry := map[string]interface{}{"protocol": string(protocol)}
+		if port.Port != nil {
+			entry["port"] = port.Port.String()
+			if port.Port.IntVal == 0 && port.Port.StrVal != "" {
+				c.note("the named port %s is resolved by cilium from the ports of the selected pods", port.Port.StrVal)
+			}
+		} else {
+			entry["port"] = "0"
+			c.note("a rule without port number allows every port of its protocol, as port 0 does")
+		}
+		if port.EndPort != nil {
+			entry["endPort"] = int64(*port.EndPort)
+			c.note("the port ranges need cilium 1.13 or later")
+		}
+		converted = append(converted, entry)
+	}
+	return converted
+}
+
+// netpolConvertRequest holds the parameters of the conversion operation,
+// read from the custom body of the request
+type netpolConvertRequest struct {
+	// Manifest holds the NetworkPolicies to convert as YAML documents.
+	// The NetworkPolicies of the namespace of the request are converted
+	// if it is empty.
+	Manifest string `yaml:"manifest"`
+
+	// Apply applies the converted policies, which are only reported by
+	// default
+	Apply bool `yaml:"apply"`
+
+	// Annotate names the source NetworkPolicy in an annotation of the
+	// converted policies
+	Annotate bool `yaml:"annotate"`
+}
+
+// convertNetworkPolicies converts NetworkPolicies into CiliumNetworkPolicies
+// and reports them, or applies them if asked to. Deleting removes the
+// converted policies.
+func (h *Handler) convertNetworkPolicies(namespace, customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while converting the NetworkPolicies"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req netpolConvertRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(namespace); err != nil {
+		fail(err)
+		return
+	}
+	if namespace == "" {
+		namespace = defaultSampleNamespace
+	}
+
+	ctx := context.Background()
+	var policies []networkingv1.NetworkPolicy
+	if strings.TrimSpace(req.Manifest) != "" {
+		var err error
+		if policies, err = networkPolicies(req.Manifest, namespace); err != nil {
+			fail(err)
+			return
+		}
+	} else {
+		if h.KubeClient == nil {
+			fail(ErrNilClient)
+			return
+		}
+		list, err := h.KubeClient.NetworkingV1().NetworkPolicies(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			fail(ErrConvertNetworkPolicy(err))
+			return
+		}
+		policies = list.Items
+	}
+	if len(policies) == 0 {
+		fail(ErrConvertNetworkPolicy(fmt.Errorf("no NetworkPolicy found in %s", namespace)))
+		return
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Namespace != policies[j].Namespace {
+			return policies[i].Namespace < policies[j].Namespace
+		}
+		return policies[i].Name < policies[j].Name
+	})
+
+	var report []string
+	objs := make([]*unstructured.Unstructured, 0, len(policies))
+	for _, policy := range policies {
+		c := convertNetworkPolicy(policy, req.Annotate)
+		objs = append(objs, c.Policy)
+		report = append(report, c.Source+":")
+		for _, n := range c.Notes {
+			report = append(report, "  "+n)
+		}
+	}
+
+	if !req.Apply && !del {
+		docs := make([]string, 0, len(objs))
+		for _, obj := range objs {
+			doc, err := yaml.Marshal(obj.Object)
+			if err != nil {
+				fail(ErrConvertNetworkPolicy(err))
+				return
+			}
+			docs = append(docs, string(doc))
+		}
+		e.Summary = fmt.Sprintf("%d NetworkPolicies converted into CiliumNetworkPolicies", len(objs))
+		e.Details = fmt.Sprintf("%s\n---\n%s", strings.Join(report, "\n"), strings.Join(docs, "---\n"))
+		h.StreamInfo(e)
+		return
+	}
+
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+	var lines, failed []string
+	for _, r := range h.applyPolicyObjects(ctx, namespace, objs, del) {
+		lines = append(lines, r.String())
+		if r.Err != nil {
+			failed = append(failed, r.String())
+		}
+	}
+	lines = append(lines, report...)
+	if len(failed) > 0 {
+		err := ErrCiliumPolicy(fmt.Errorf("%s", strings.Join(failed, "; ")))
+		e.Summary = "Error while applying the converted NetworkPolicies"
+		e.Details = fmt.Sprintf("%s\n%s", err, strings.Join(lines, "\n"))
+		h.StreamErr(e, err)
+		return
+	}
+	e.Summary = "Converted NetworkPolicies applied successfully"
+	if del {
+		e.Summary = "Converted NetworkPolicies removed successfully"
+	}
+	e.Details = strings.Join(lines, "\n")
+	h.StreamInfo(e)
+}
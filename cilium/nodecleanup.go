@@ -0,0 +1,264 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// nodeCleanupDaemonSet clears what cilium left on every node, it is
+	// removed once the nodes reported
+	nodeCleanupDaemonSet = "cilium-node-cleanup"
+
+	// nodeCleanupSelector selects the pods of nodeCleanupDaemonSet
+	nodeCleanupSelector = "app.kubernetes.io/name=" + nodeCleanupDaemonSet
+
+	// defaultNodeCleanupTimeout bounds the wait for the nodes to report
+	defaultNodeCleanupTimeout = 5 * time.Minute
+
+	// nodeCleanupScript runs the steps of the cleanup of the cilium agent
+	// in the namespaces of the host, printing a step=ok or step=failed
+	// line for each of them
+	nodeCleanupScript = `step() { name=$1; shift; if nsenter -t 1 -m -n -- sh -c "$*" >/dev/null 2>&1; then echo $name=ok; else echo $name=failed; fi; }
+step cni 'rm -f /etc/cni/net.d/*cilium*'
+step interfaces 'for l in $(ls /sys/class/net); do case $l in cilium_*|lxc*) ip link delete $l || [ ! -e /sys/class/net/$l ] || exit 1;; esac; done'
+step state 'rm -rf /var/run/cilium /run/cilium'
+step bpf 'rm -rf /sys/fs/bpf/cilium /sys/fs/bpf/tc/globals/cilium_* /sys/fs/bpf/tc/globals/cilium'
+step iptables 'command -v iptables-save >/dev/null || exit 0; for t in filter nat mangle raw; do iptables-save -t $t | grep -v CILIUM | iptables-restore -T $t || exit 1; done'
+echo cleanup=done
+exec sleep 3600`
+)
+
+// nodeCleanupSteps are the steps of nodeCleanupScript, in order
+var nodeCleanupSteps = []string{"cni", "interfaces", "state", "bpf", "iptables"}
+
+// nodeCleanupRequest holds the parameters of the node cleanup operation,
+// read from the custom body of the request
+type nodeCleanupRequest struct {
+	// Namespace the cleanup runs in, kube-system by default
+	Namespace string `yaml:"namespace"`
+
+	// Force cleans up even though the cilium agents still run, which
+	// breaks the network of their nodes
+	Force bool `yaml:"force"`
+
+	// Image runs the cleanup, busybox by default
+	Image string `yaml:"image"`
+
+	// Timeout bounds the wait for the nodes to report, like 5m
+	Timeout string `yaml:"timeout"`
+}
+
+// nodeCleanupResult is the outcome of the cleanup of a node
+type nodeCleanupResult struct {
+	node   string
+	failed []string
+	err    string
+}
+
+// String describes the result in a line
+func (r nodeCleanupResult) String() string {
+	switch {
+	case r.err != "":
+		return fmt.Sprintf("%s: not cleaned up, %s", r.node, r.err)
+	case len(r.failed) > 0:
+		return fmt.Sprintf("%s: failed to clean up %s", r.node, strings.Join(r.failed, ", "))
+	}
+	return fmt.Sprintf("%s: cleaned up", r.node)
+}
+
+// nodeCleanupDaemonSetSpec returns the privileged DaemonSet running the
+// cleanup script on every node, in the namespaces of the host
+func nodeCleanupDaemonSetSpec(image string) *appsv1.DaemonSet {
+	labels := map[string]string{"app.kubernetes.io/name": nodeCleanupDaemonSet, "app.kubernetes.io/managed-by": "meshery"}
+	privileged := true
+	grace := int64(0)
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeCleanupDaemonSet, Labels: labels},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					HostPID:                       true,
+					HostNetwork:                   true,
+					TerminationGracePeriodSeconds: &grace,
+					Tolerations:                   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+					Containers: []corev1.Container{{
+						Name:            "cleanup",
+						Image:           image,
+						Command:         []string{"sh", "-c", nodeCleanupScript},
+						SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// runNodeCleanup clears the state of cilium from every node through a
+// short-lived privileged DaemonSet of namespace, which is removed however
+// the cleanup ends. The nodes whose pod did not report in time are
+// reported as not cleaned up.
+func (h *Handler) runNodeCleanup(e *adapter.Event, namespace, image string, timeout time.Duration) ([]nodeCleanupResult, error) {
+	if image == "" {
+		image = defaultEnvCheckImage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	nodes, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.deleteDaemonSet(ctx, namespace, nodeCleanupDaemonSet); err != nil {
+		return nil, err
+	}
+	h.streamProgress(e, "Cleaning up the Cilium state of the nodes", fmt.Sprintf("Cleaning up %d nodes", len(nodes.Items)))
+	if _, err := h.KubeClient.AppsV1().DaemonSets(namespace).Create(ctx, nodeCleanupDaemonSetSpec(image), metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := h.deleteDaemonSet(cleanup, namespace, nodeCleanupDaemonSet); err != nil {
+			h.Log.Error(ErrNodeCleanup(fmt.Errorf("the %s DaemonSet of namespace %s could not be removed: %w", nodeCleanupDaemonSet, namespace, err)))
+		}
+	}()
+
+	outputs := make(map[string]map[string]string)
+	_ = wait.PollImmediateUntil(rolloutPollInterval, func() (bool, error) {
+		pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: nodeCleanupSelector})
+		if err != nil {
+			return false, nil
+		}
+		for _, pod := range pods.Items {
+			if _, ok := outputs[pod.Spec.NodeName]; ok || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			logs, err := h.KubeClient.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+			if err != nil {
+				continue
+			}
+			if out, _ := parseEnvCheckOutput(string(logs)); out["cleanup"] == "done" {
+				outputs[pod.Spec.NodeName] = out
+			}
+		}
+		return len(outputs) >= len(nodes.Items), nil
+	}, ctx.Done())
+
+	problems := h.podProblems(namespace, nodeCleanupSelector)
+	results := make([]nodeCleanupResult, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		result := nodeCleanupResult{node: node.Name}
+		out, ok := outputs[node.Name]
+		if !ok {
+			result.err = "the cleanup pod did not report in time"
+			if len(problems) > 0 {
+				result.err = fmt.Sprintf("%s: %s", result.err, strings.Join(problems, "; "))
+			}
+		}
+		for _, step := range nodeCleanupSteps {
+			if ok && out[step] != "ok" {
+				result.failed = append(result.failed, step)
+			}
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].node < results[j].node })
+	return results, nil
+}
+
+// nodeCleanup clears the interfaces, the BPF maps, the state and the CNI
+// configuration cilium left on the nodes, so that cilium can be installed
+// again or another CNI can take over. It refuses to run while agents are
+// still present unless forced.
+func (h *Handler) nodeCleanup(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while cleaning up the nodes"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req nodeCleanupRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout := defaultNodeCleanupTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = parseTimeout(req.Timeout); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	daemonSets, err := h.KubeClient.AppsV1().DaemonSets(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		fail(ErrNodeCleanup(err))
+		return
+	}
+	if len(daemonSets.Items) > 0 && !req.Force {
+		fail(ErrCiliumStillInstalled(daemonSets.Items[0].Namespace))
+		return
+	}
+
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = defaultCiliumNamespace
+	}
+	results, err := h.runNodeCleanup(e, namespace, req.Image, timeout)
+	if err != nil {
+		fail(ErrNodeCleanup(err))
+		return
+	}
+
+	lines := make([]string, 0, len(results))
+	cleaned := 0
+	for _, r := range results {
+		if r.err == "" && len(r.failed) == 0 {
+			cleaned++
+		}
+		lines = append(lines, r.String())
+	}
+	details := strings.Join(lines, "\n")
+	if cleaned < len(results) {
+		fail(ErrNodeCleanup(fmt.Errorf("%d of %d nodes were cleaned up:\n%s", cleaned, len(results), details)))
+		return
+	}
+	e.Summary = fmt.Sprintf("%d nodes cleaned up", cleaned)
+	e.Details = details
+	h.StreamInfo(e)
+}
@@ -0,0 +1,312 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// defaultIPAMThreshold is the utilization, in percent, above which a
+	// node is flagged unless the request sets another one
+	defaultIPAMThreshold = 80
+
+	// ipamMultiPool is the mode allocating from several pools of CIDRs
+	ipamMultiPool = "multi-pool"
+
+	// ipamCRD is the mode allocating from the pool of the CiliumNode, as
+	// filled by an external operator
+	ipamCRD = "crd"
+
+	// ciliumInternalIP is the type of the addresses of a CiliumNode the
+	// agent routes its own traffic from
+	ciliumInternalIP = "CiliumInternalIP"
+)
+
+// nodeIPAMRequest holds the parameters of the IPAM report, read from the
+// custom body of the request
+type nodeIPAMRequest struct {
+	// Threshold is the utilization of the IPs of a node, in percent,
+	// above which it is flagged. It is 80 by default.
+	Threshold int `yaml:"threshold"`
+}
+
+// eniIPAM are the fields of a node whose IPs are allocated from AWS ENIs
+type eniIPAM struct {
+	InstanceID   string `json:"instanceID,omitempty"`
+	InstanceType string `json:"instanceType,omitempty"`
+	VPCID        string `json:"vpcID,omitempty"`
+	Interfaces   int    `json:"interfaces"`
+	PreAllocate  int64  `json:"preAllocate,omitempty"`
+	MinAllocate  int64  `json:"minAllocate,omitempty"`
+}
+
+// azureIPAM are the fields of a node whose IPs are allocated from Azure
+// network interfaces
+type azureIPAM struct {
+	InstanceID    string `json:"instanceID,omitempty"`
+	InterfaceName string `json:"interfaceName,omitempty"`
+	Interfaces    int    `json:"interfaces"`
+}
+
+// nodeIPAM is the IPAM of a node
+type nodeIPAM struct {
+	Node string `json:"node"`
+	Mode string `json:"mode"`
+
+	// PodCIDRs are the CIDRs allocated to the node, from every pool in
+	// the multi-pool mode
+	PodCIDRs []string `json:"podCIDRs,omitempty"`
+
+	// Used IPs out of the Capacity of the node. Capacity is a string as
+	// the IPv6 CIDRs overflow integers. The IPs used in the CIDR modes
+	// are the endpoints of the node, the operator only tracking them in
+	// the pool modes.
+	Used        int     `json:"used"`
+	Capacity    string  `json:"capacity"`
+	Utilization float64 `json:"utilization"`
+
+	InternalIPs []string `json:"ciliumInternalIPs,omitempty"`
+
+	// EncryptionKey is the IPsec key index the node encrypts with, 0 if
+	// it does not
+	EncryptionKey int64 `json:"encryptionKey"`
+
+	ENI   *eniIPAM   `json:"eni,omitempty"`
+	Azure *azureIPAM `json:"azure,omitempty"`
+
+	// Flagged nodes use more of their IPs than the threshold
+	Flagged bool `json:"flagged"`
+
+	capacity *big.Int
+	addrs    []string
+	pooled   bool
+}
+
+// nodeIPAMReport is the IPAM of the nodes along with the whole cluster
+type nodeIPAMReport struct {
+	Nodes       []nodeIPAM `json:"nodes"`
+	Used        int        `json:"used"`
+	Capacity    string     `json:"capacity"`
+	Utilization float64    `json:"utilization"`
+	Threshold   int        `json:"threshold"`
+	Flagged     int        `json:"flagged"`
+}
+
+// utilization returns used out of capacity in percent, 0 without capacity
+func utilization(used int, capacity *big.Int) float64 {
+	if capacity.Sign() == 0 {
+		return 0
+	}
+	ratio, _ := new(big.Float).Quo(new(big.Float).SetInt64(int64(used)*100), new(big.Float).SetInt(capacity)).Float64()
+	return ratio
+}
+
+// describeNodeIPAM describes the IPAM of the CiliumNode node, its mode
+// being found from the fields it sets
+func describeNodeIPAM(node *unstructured.Unstructured) nodeIPAM {
+	info := nodeIPAM{Node: node.GetName(), capacity: new(big.Int)}
+	info.PodCIDRs, _, _ = unstructured.NestedStringSlice(node.Object, "spec", "ipam", "podCIDRs")
+	info.EncryptionKey, _, _ = unstructured.NestedInt64(node.Object, "spec", "encryption", "key")
+	addresses, _, _ := unstructured.NestedSlice(node.Object, "spec", "addresses")
+	for _, a := range addresses {
+		addr, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ip, _, _ := unstructured.NestedString(addr, "ip")
+		kind, _, _ := unstructured.NestedString(addr, "type")
+		if kind == ciliumInternalIP {
+			info.InternalIPs = append(info.InternalIPs, ip)
+		} else {
+			info.addrs = append(info.addrs, ip)
+		}
+	}
+
+	pool, _, _ := unstructured.NestedMap(node.Object, "spec", "ipam", "pool")
+	used, _, _ := unstructured.NestedMap(node.Object, "status", "ipam", "used")
+	instanceID, _, _ := unstructured.NestedString(node.Object, "spec", "instance-id")
+	eni, hasENI, _ := unstructured.NestedMap(node.Object, "spec", "eni")
+	azure, hasAzure, _ := unstructured.NestedMap(node.Object, "spec", "azure")
+	allocated, _, _ := unstructured.NestedSlice(node.Object, "spec", "ipam", "pools", "allocated")
+
+	switch {
+	case hasENI && len(eni) > 0:
+		info.Mode = ipamENI
+		interfaces, _, _ := unstructured.NestedMap(node.Object, "status", "eni", "enis")
+		info.ENI = &eniIPAM{InstanceID: instanceID, Interfaces: len(interfaces)}
+		info.ENI.InstanceType, _, _ = unstructured.NestedString(eni, "instance-type")
+		info.ENI.VPCID, _, _ = unstructured.NestedString(eni, "vpc-id")
+		info.ENI.PreAllocate, _, _ = unstructured.NestedInt64(eni, "pre-allocate")
+		info.ENI.MinAllocate, _, _ = unstructured.NestedInt64(eni, "min-allocate")
+	case hasAzure && len(azure) > 0:
+		info.Mode = ipamAzure
+		interfaces, _, _ := unstructured.NestedSlice(node.Object, "status", "azure", "interfaces")
+		info.Azure = &azureIPAM{InstanceID: instanceID, Interfaces: len(interfaces)}
+		info.Azure.InterfaceName, _, _ = unstructured.NestedString(azure, "interface-name")
+	case len(allocated) > 0:
+		info.Mode = ipamMultiPool
+		info.PodCIDRs = nil
+		for _, a := range allocated {
+			if entry, ok := a.(map[string]interface{}); ok {
+				cidrs, _, _ := unstructured.NestedStringSlice(entry, "cidrs")
+				info.PodCIDRs = append(info.PodCIDRs, cidrs...)
+			}
+		}
+	case len(pool) > 0:
+		info.Mode = ipamCRD
+	default:
+		info.Mode = ipamClusterPool
+	}
+
+	if info.pooled = len(pool) > 0; info.pooled {
+		// The pool modes allocate single IPs, the pool holding them all
+		info.capacity.SetInt64(int64(len(pool)))
+		info.Used = len(used)
+	} else {
+		for _, cidr := range info.PodCIDRs {
+			if r, err := cidrRange(cidr); err == nil {
+				info.capacity.Add(info.capacity, r.size())
+			}
+		}
+	}
+	return info
+}
+
+// nodeIPAMUsage returns the IPAM of every CiliumNode, the IPs used in the
+// CIDR modes being counted from the CiliumEndpoints of the node. The
+// nodes above threshold percent are flagged.
+func (h *Handler) nodeIPAMUsage(ctx context.Context, threshold int) (*nodeIPAMReport, error) {
+	nodes, err := h.DynamicKubeClient.Resource(ciliumNodeResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	report := &nodeIPAMReport{Nodes: make([]nodeIPAM, 0, len(nodes.Items)), Threshold: threshold}
+
+	var endpointsByAddr map[string]int
+	configured := h.configuredIPAMMode(ctx)
+	for i := range nodes.Items {
+		info := describeNodeIPAM(&nodes.Items[i])
+		if info.Mode == ipamClusterPool && configured == ipamKubernetes {
+			// The CiliumNodes look the same in both modes, the CIDRs
+			// coming from the nodes in the kubernetes mode
+			info.Mode = ipamKubernetes
+		}
+		if !info.pooled {
+			if endpointsByAddr == nil {
+				if endpointsByAddr, err = h.endpointsByNode(ctx); err != nil {
+					return nil, err
+				}
+			}
+			for _, addr := range info.addrs {
+				info.Used += endpointsByAddr[addr]
+			}
+		}
+		report.Nodes = append(report.Nodes, info)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool { return report.Nodes[i].Node < report.Nodes[j].Node })
+
+	capacity := new(big.Int)
+	for i := range report.Nodes {
+		n := &report.Nodes[i]
+		n.Capacity = n.capacity.String()
+		n.Utilization = utilization(n.Used, n.capacity)
+		n.Flagged = n.Utilization > float64(threshold)
+		if n.Flagged {
+			report.Flagged++
+		}
+		report.Used += n.Used
+		capacity.Add(capacity, n.capacity)
+	}
+	report.Capacity = capacity.String()
+	report.Utilization = utilization(report.Used, capacity)
+	return report, nil
+}
+
+// configuredIPAMMode returns the IPAM mode the agents are configured
+// with, empty if it cannot be read
+func (h *Handler) configuredIPAMMode(ctx context.Context) string {
+	if h.KubeClient == nil {
+		return ""
+	}
+	cm, err := h.KubeClient.CoreV1().ConfigMaps(h.ciliumNamespace("")).Get(ctx, ciliumConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	return cm.Data["ipam"]
+}
+
+// endpointsByNode counts the CiliumEndpoints by the address of their node
+func (h *Handler) endpointsByNode(ctx context.Context) (map[string]int, error) {
+	endpoints, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, ep := range endpoints.Items {
+		if node, _, _ := unstructured.NestedString(ep.Object, "status", "networking", "node"); node != "" {
+			counts[node]++
+		}
+	}
+	return counts, nil
+}
+
+// nodeIPAMInventory streams the IPAM of the CiliumNodes, as JSON
+func (h *Handler) nodeIPAMInventory(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while reporting the IPAM of the Cilium nodes"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req nodeIPAMRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if req.Threshold < 0 || req.Threshold > 100 {
+		fail(ErrParseCustomBody(fmt.Errorf("threshold %d is not a percentage", req.Threshold)))
+		return
+	}
+	if req.Threshold == 0 {
+		req.Threshold = defaultIPAMThreshold
+	}
+	if h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	report, err := h.nodeIPAMUsage(context.Background(), req.Threshold)
+	if err != nil {
+		fail(ErrNodeIPAM(err))
+		return
+	}
+	byt, err := json.Marshal(report)
+	if err != nil {
+		fail(ErrNodeIPAM(err))
+		return
+	}
+	e.Summary = fmt.Sprintf("%d Cilium nodes use %.1f%% of their IPs, %d above %d%%", len(report.Nodes), report.Utilization, report.Flagged, report.Threshold)
+	e.Details = string(byt)
+	h.StreamInfo(e)
+}
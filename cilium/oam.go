@@ -1,11 +1,13 @@
 package cilium
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/layer5io/meshkit/models/oam/core/v1alpha1"
 	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 // CompHandler is the type for functions which can handle OAM components
@@ -17,10 +19,18 @@ func (h *Handler) HandleComponents(comps []v1alpha1.Component, isDel bool) (stri
 	var msgs []string
 
 	compFuncMap := map[string]CompHandler{
-		"CiliumMesh": handleComponentCiliumMesh,
+		"CiliumMesh":                     handleComponentCiliumMesh,
+		"CiliumNetworkPolicy":            handleComponentCiliumPolicy,
+		"CiliumClusterwideNetworkPolicy": handleComponentCiliumPolicy,
 	}
 
+	// The SMI resources refer to each other, they are converted together
+	var smiComps []v1alpha1.Component
 	for _, comp := range comps {
+		if smiKinds[comp.Spec.Type] {
+			smiComps = append(smiComps, comp)
+			continue
+		}
 		fnc, ok := compFuncMap[comp.Spec.Type]
 		if !ok {
 			msg, err := handleCiliumCoreComponent(h, comp, isDel, "", "")
@@ -41,6 +51,13 @@ func (h *Handler) HandleComponents(comps []v1alpha1.Component, isDel bool) (stri
 
 		msgs = append(msgs, msg)
 	}
+	if len(smiComps) > 0 {
+		msg, err := handleComponentsSMI(h, smiComps, isDel)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		msgs = append(msgs, msg)
+	}
 
 	if err := mergeErrors(errs); err != nil {
 		return mergeMsgs(msgs), err
@@ -73,7 +90,32 @@ func handleComponentCiliumMesh(h *Handler, comp v1alpha1.Component, isDel bool)
 	// because the configuration is already validated against the schema
 	version := comp.Spec.Settings["version"].(string)
 
-	msg, err := h.installCilium(isDel, version, comp.Namespace)
+	// The chart values can be overridden through the settings as well
+	overrides, err := parseHelmValues(comp.Spec.Settings["values"])
+	if err != nil {
+		return fmt.Sprintf("%s: invalid values", comp.Name), err
+	}
+
+	// The namespace of the settings, unlike the one of the component,
+	// defaults to where cilium runs
+	namespace, _ := comp.Spec.Settings["namespace"].(string)
+	if err := validateNamespace(namespace); err != nil {
+		return fmt.Sprintf("%s: invalid namespace", comp.Name), err
+	}
+
+	// The routing settings are translated for the chart of version
+	routing := routingOptions{}
+	routing.RoutingMode, _ = comp.Spec.Settings["routingMode"].(string)
+	routing.NativeRoutingCIDR, _ = comp.Spec.Settings["nativeRoutingCIDR"].(string)
+	routing.AutoDirectNodeRoutes, _ = comp.Spec.Settings["autoDirectNodeRoutes"].(bool)
+	routingValues, err := routing.values(version)
+	if err != nil {
+		return fmt.Sprintf("%s: invalid routing", comp.Name), err
+	}
+
+	values := mergeValues(defaultHelmValues(), routingValues)
+	custom := len(routingValues) > 0 || len(overrides) > 0
+	msg, err := h.installCilium(isDel, version, h.ciliumNamespace(namespace), mergeValues(values, overrides), custom)
 	if err != nil {
 		return fmt.Sprintf("%s: %s", comp.Name, msg), err
 	}
@@ -81,6 +123,83 @@ func handleComponentCiliumMesh(h *Handler, comp v1alpha1.Component, isDel bool)
 	return fmt.Sprintf("%s: %s", comp.Name, msg), nil
 }
 
+// handleComponentCiliumPolicy applies the cilium policy of the component,
+// or deletes it, its settings being the spec of the policy. A component
+// may hold several rules as specs.
+func handleComponentCiliumPolicy(h *Handler, comp v1alpha1.Component, isDel bool) (string, error) {
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		return fmt.Sprintf("%s: no cluster", comp.Name), ErrCiliumPolicy(ErrNilClient)
+	}
+	apiVersion := getAPIVersionFromComponent(comp)
+	if apiVersion == "" {
+		apiVersion = policyAPIVersion
+	}
+	metadata := map[string]interface{}{"name": comp.Name}
+	if comp.Spec.Type == "CiliumNetworkPolicy" && comp.Namespace != "" {
+		metadata["namespace"] = comp.Namespace
+	}
+	if len(comp.Labels) > 0 {
+		metadata["labels"] = comp.Labels
+	}
+	policy := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       comp.Spec.Type,
+		"metadata":   metadata,
+	}
+	if specs, ok := comp.Spec.Settings["specs"]; ok && len(comp.Spec.Settings) == 1 {
+		policy["specs"] = specs
+	} else {
+		policy["spec"] = comp.Spec.Settings
+	}
+
+	manifest, err := yaml.Marshal(policy)
+	if err != nil {
+		return fmt.Sprintf("%s: invalid settings", comp.Name), ErrParseCiliumCoreComponent(err)
+	}
+	namespace := comp.Namespace
+	if namespace == "" {
+		namespace = defaultSampleNamespace
+	}
+
+	var msgs []string
+	var failed []string
+	for _, r := range h.applyPolicyManifest(context.Background(), namespace, string(manifest), isDel) {
+		msgs = append(msgs, r.String())
+		if r.Warning != "" {
+			msgs = append(msgs, r.Warning)
+		}
+		if r.Err != nil {
+			failed = append(failed, r.String())
+		}
+	}
+	if len(failed) > 0 {
+		return mergeMsgs(msgs), ErrCiliumPolicy(fmt.Errorf("%s", strings.Join(failed, "\n")))
+	}
+	return mergeMsgs(msgs), nil
+}
+
+// handleComponentsSMI converts the SMI components, TrafficTargets along
+// with the routes they refer to, into CiliumNetworkPolicies and applies
+// them, or deletes them. The settings of the components are their spec.
+func handleComponentsSMI(h *Handler, comps []v1alpha1.Component, isDel bool) (string, error) {
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		return "SMI: no cluster", ErrCiliumPolicy(ErrNilClient)
+	}
+	objs := make([]*unstructured.Unstructured, 0, len(comps))
+	for _, comp := range comps {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": getAPIVersionFromComponent(comp),
+			"kind":       comp.Spec.Type,
+			"metadata":   map[string]interface{}{"name": comp.Name},
+			"spec":       comp.Spec.Settings,
+		}}
+		obj.SetNamespace(comp.Namespace)
+		objs = append(objs, obj)
+	}
+	lines, err := h.applySMI(context.Background(), defaultSampleNamespace, objs, isDel)
+	return mergeMsgs(lines), err
+}
+
 func handleCiliumCoreComponent(
 	h *Handler,
 	comp v1alpha1.Component,
@@ -13,11 +13,10 @@ import (
 var (
 	//WorkloadPath will be used by both static and component generation
 	WorkloadPath = filepath.Join(basePath, "templates", "oam", "workloads")
-	basePath, _  = os.Getwd()	
+	basePath, _  = os.Getwd()
 	traitPath    = filepath.Join(basePath, "templates", "oam", "traits")
 )
 
-
 // AvailableVersions denote the component versions available statically
 var AvailableVersions = map[string]bool{}
 
@@ -129,3 +128,8 @@ func init() {
 	_, _ = load(WorkloadPath)
 }
 
+// WorkloadSchema returns the schema of the workload name, like
+// ciliumnetworkpolicy.meshery.layer5.io, of the components of version
+func WorkloadSchema(version, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(WorkloadPath, version, name+".meshery.layer5io.schema.json"))
+}
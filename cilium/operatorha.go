@@ -0,0 +1,156 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// operatorAntiAffinityHard never schedules two operator replicas on
+	// the same node, as the chart does
+	operatorAntiAffinityHard = "hard"
+
+	// operatorAntiAffinitySoft prefers spreading the operator replicas
+	// across the nodes
+	operatorAntiAffinitySoft = "soft"
+
+	// zoneTopologyKey is the label of the nodes holding their zone
+	zoneTopologyKey = "topology.kubernetes.io/zone"
+
+	// hostnameTopologyKey is the label of the nodes holding their name
+	hostnameTopologyKey = "kubernetes.io/hostname"
+)
+
+// operatorSpreadSince is the first version whose chart takes topology
+// spread constraints for the operator
+var operatorSpreadSince = semver.MustParse("1.13.0")
+
+// operatorLabels select the pods of the operator
+var operatorLabels = map[string]string{"io.cilium/app": "operator"}
+
+// operatorOptions make the operator highly available. The replicas elect
+// a leader among themselves, which the operator always does. They are part
+// of the custom body of the install requests.
+type operatorOptions struct {
+	// OperatorReplicas is the number of operator replicas, one by default
+	OperatorReplicas int `yaml:"operatorReplicas"`
+
+	// OperatorAntiAffinity is hard, keeping the replicas on distinct
+	// nodes as the chart does, or soft, only preferring so
+	OperatorAntiAffinity string `yaml:"operatorAntiAffinity"`
+
+	// OperatorSpreadZones spreads the replicas evenly across the zones of
+	// the nodes, as far as they can be scheduled
+	OperatorSpreadZones bool `yaml:"operatorSpreadZones"`
+
+	// OperatorPriorityClassName is the priority class of the operator pods
+	OperatorPriorityClassName string `yaml:"operatorPriorityClassName"`
+}
+
+// replicas returns the requested number of replicas
+func (o operatorOptions) replicas() int {
+	if o.OperatorReplicas == 0 {
+		return 1
+	}
+	return o.OperatorReplicas
+}
+
+// values translates the options into the values of the chart of version.
+// A soft anti-affinity replaces the affinity of the operator, which then
+// cannot be set through its placement.
+func (o operatorOptions) values(version string, placement componentPlacement) (map[string]interface{}, error) {
+	if o.OperatorReplicas < 0 {
+		return nil, ErrInvalidOperatorOptions(fmt.Errorf("operatorReplicas %d is negative", o.OperatorReplicas))
+	}
+	operator := make(map[string]interface{})
+	if o.OperatorReplicas > 0 {
+		operator["replicas"] = o.OperatorReplicas
+	}
+
+	switch o.OperatorAntiAffinity {
+	case "", operatorAntiAffinityHard:
+	case operatorAntiAffinitySoft:
+		if placement.Affinity != nil {
+			return nil, ErrInvalidOperatorOptions(fmt.Errorf("operatorAntiAffinity cannot be combined with operatorPlacement.affinity"))
+		}
+		operator["affinity"] = map[string]interface{}{
+			"podAntiAffinity": map[string]interface{}{
+				"preferredDuringSchedulingIgnoredDuringExecution": []interface{}{
+					map[string]interface{}{
+						"weight": 100,
+						"podAffinityTerm": map[string]interface{}{
+							"labelSelector": labelSelector(operatorLabels),
+							"topologyKey":   hostnameTopologyKey,
+						},
+					},
+				},
+			},
+		}
+	default:
+		return nil, ErrInvalidOperatorOptions(fmt.Errorf("unknown operatorAntiAffinity %q, expected hard or soft", o.OperatorAntiAffinity))
+	}
+
+	if o.OperatorSpreadZones {
+		v, err := config.ParseVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		if v.LessThan(operatorSpreadSince) {
+			return nil, ErrInvalidOperatorOptions(fmt.Errorf("operatorSpreadZones requires cilium %s or later, got %s", operatorSpreadSince, version))
+		}
+		operator["topologySpreadConstraints"] = []interface{}{
+			map[string]interface{}{
+				"maxSkew":           1,
+				"topologyKey":       zoneTopologyKey,
+				"whenUnsatisfiable": "ScheduleAnyway",
+				"labelSelector":     labelSelector(operatorLabels),
+			},
+		}
+	}
+
+	if o.OperatorPriorityClassName != "" {
+		if errs := validation.IsDNS1123Subdomain(o.OperatorPriorityClassName); len(errs) > 0 {
+			return nil, ErrInvalidOperatorOptions(fmt.Errorf("operatorPriorityClassName %q: %s", o.OperatorPriorityClassName, strings.Join(errs, ", ")))
+		}
+		operator["priorityClassName"] = o.OperatorPriorityClassName
+	}
+
+	if len(operator) == 0 {
+		return nil, nil
+	}
+	return map[string]interface{}{"operator": operator}, nil
+}
+
+// operatorWarning warns when more operator replicas are requested than
+// there are nodes to keep them apart, in which case the extra replicas stay
+// pending and the install does not become ready
+func (h *Handler) operatorWarning(ctx context.Context, o operatorOptions) string {
+	if o.replicas() <= 1 || o.OperatorAntiAffinity == operatorAntiAffinitySoft || h.kubeClient() == nil {
+		return ""
+	}
+	nodes, err := h.kubeClient().CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil || len(nodes.Items) >= o.replicas() {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %d operator replicas are requested but the cluster has %d nodes, the replicas beyond one per node cannot be scheduled. Set operatorAntiAffinity to soft to run them anyway.", o.replicas(), len(nodes.Items))
+}
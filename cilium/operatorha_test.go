@@ -0,0 +1,160 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/layer5io/meshkit/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func errorCode(err error) string {
+	if e, ok := errors.Is(err); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func TestOperatorOptionsValues(t *testing.T) {
+	spread := []interface{}{
+		map[string]interface{}{
+			"maxSkew":           1,
+			"topologyKey":       zoneTopologyKey,
+			"whenUnsatisfiable": "ScheduleAnyway",
+			"labelSelector":     labelSelector(operatorLabels),
+		},
+	}
+	tests := []struct {
+		name      string
+		opts      operatorOptions
+		version   string
+		placement componentPlacement
+		want      map[string]interface{}
+		wantCode  string
+	}{
+		{name: "defaults"},
+		{name: "hard anti-affinity", opts: operatorOptions{OperatorAntiAffinity: operatorAntiAffinityHard}},
+		{
+			name: "replicas",
+			opts: operatorOptions{OperatorReplicas: 3},
+			want: map[string]interface{}{"operator": map[string]interface{}{"replicas": 3}},
+		},
+		{name: "negative replicas", opts: operatorOptions{OperatorReplicas: -1}, wantCode: ErrInvalidOperatorOptionsCode},
+		{name: "unknown anti-affinity", opts: operatorOptions{OperatorAntiAffinity: "strict"}, wantCode: ErrInvalidOperatorOptionsCode},
+		{
+			name:      "soft anti-affinity with an affinity",
+			opts:      operatorOptions{OperatorAntiAffinity: operatorAntiAffinitySoft},
+			placement: componentPlacement{Affinity: map[string]interface{}{"nodeAffinity": map[string]interface{}{}}},
+			wantCode:  ErrInvalidOperatorOptionsCode,
+		},
+		{
+			name:    "spread zones",
+			opts:    operatorOptions{OperatorReplicas: 2, OperatorSpreadZones: true},
+			version: "1.14.5",
+			want:    map[string]interface{}{"operator": map[string]interface{}{"replicas": 2, "topologySpreadConstraints": spread}},
+		},
+		{name: "spread zones before 1.13", opts: operatorOptions{OperatorSpreadZones: true}, version: "1.12.9", wantCode: ErrInvalidOperatorOptionsCode},
+		{
+			name: "priority class",
+			opts: operatorOptions{OperatorPriorityClassName: "system-cluster-critical"},
+			want: map[string]interface{}{"operator": map[string]interface{}{"priorityClassName": "system-cluster-critical"}},
+		},
+		{name: "invalid priority class", opts: operatorOptions{OperatorPriorityClassName: "System Critical"}, wantCode: ErrInvalidOperatorOptionsCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := tt.version
+			if version == "" {
+				version = "1.14.5"
+			}
+			got, err := tt.opts.values(version, tt.placement)
+			if tt.wantCode != "" {
+				if errorCode(err) != tt.wantCode {
+					t.Fatalf("error = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("values: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOperatorOptionsSoftAntiAffinity(t *testing.T) {
+	got, err := operatorOptions{OperatorReplicas: 2, OperatorAntiAffinity: operatorAntiAffinitySoft}.values("1.14.5", componentPlacement{})
+	if err != nil {
+		t.Fatalf("values: %v", err)
+	}
+	operator := got["operator"].(map[string]interface{})
+	antiAffinity := operator["affinity"].(map[string]interface{})["podAntiAffinity"].(map[string]interface{})
+	if _, ok := antiAffinity["requiredDuringSchedulingIgnoredDuringExecution"]; ok {
+		t.Error("soft anti-affinity requires distinct nodes")
+	}
+	terms := antiAffinity["preferredDuringSchedulingIgnoredDuringExecution"].([]interface{})
+	term := terms[0].(map[string]interface{})["podAffinityTerm"].(map[string]interface{})
+	if term["topologyKey"] != hostnameTopologyKey || !reflect.DeepEqual(term["labelSelector"], labelSelector(operatorLabels)) {
+		t.Errorf("preferred term = %v, want the operator pods spread by %s", term, hostnameTopologyKey)
+	}
+}
+
+func TestOperatorReplicas(t *testing.T) {
+	if n := (operatorOptions{}).replicas(); n != 1 {
+		t.Errorf("default replicas = %d, want 1", n)
+	}
+	if n := (operatorOptions{OperatorReplicas: 3}).replicas(); n != 3 {
+		t.Errorf("replicas = %d, want 3", n)
+	}
+}
+
+func TestOperatorWarning(t *testing.T) {
+	twoNodes := []runtime.Object{nodeObject("node-a", false), nodeObject("node-b", false)}
+	tests := []struct {
+		name  string
+		opts  operatorOptions
+		nodes []runtime.Object
+		warn  bool
+	}{
+		{name: "single replica", opts: operatorOptions{}, nodes: twoNodes[:1]},
+		{name: "enough nodes", opts: operatorOptions{OperatorReplicas: 2}, nodes: twoNodes},
+		{name: "too few nodes", opts: operatorOptions{OperatorReplicas: 3}, nodes: twoNodes, warn: true},
+		{name: "soft anti-affinity", opts: operatorOptions{OperatorReplicas: 3, OperatorAntiAffinity: operatorAntiAffinitySoft}, nodes: twoNodes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, tt.nodes...)
+			warning := h.operatorWarning(context.Background(), tt.opts)
+			if (warning != "") != tt.warn {
+				t.Fatalf("warning = %q, want a warning %v", warning, tt.warn)
+			}
+			if tt.warn && !strings.Contains(warning, "3 operator replicas are requested but the cluster has 2 nodes") {
+				t.Errorf("warning = %q, want the replicas and nodes counted", warning)
+			}
+		})
+	}
+
+	h, _ := newTestHandler(t)
+	h.typedClient = nil
+	if warning := h.operatorWarning(context.Background(), operatorOptions{OperatorReplicas: 3}); warning != "" {
+		t.Errorf("warning = %q without a client, want none", warning)
+	}
+}
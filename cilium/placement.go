@@ -0,0 +1,253 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// placementOptions control the nodes the agents and the operator are
+// scheduled on, like excluding the windows nodes or tolerating the taints
+// of infrastructure nodes. They are part of the custom body of the install
+// requests.
+type placementOptions struct {
+	// AgentPlacement applies to the pods of the agent DaemonSet
+	AgentPlacement componentPlacement `yaml:"agentPlacement"`
+
+	// OperatorPlacement applies to the pods of the operator Deployment
+	OperatorPlacement componentPlacement `yaml:"operatorPlacement"`
+}
+
+// componentPlacement is the scheduling of the pods of a component. The
+// tolerations and the affinity are given as in a pod spec, either as YAML
+// fragments or as strings holding them.
+type componentPlacement struct {
+	// NodeSelector is merged into the nodeSelector of the chart, which
+	// selects the linux nodes
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+
+	// Tolerations replace those of the chart
+	Tolerations interface{} `yaml:"tolerations"`
+
+	// Affinity replaces the affinity of the chart
+	Affinity interface{} `yaml:"affinity"`
+}
+
+// tolerationOperators and taintEffects are the operators and the effects
+// a toleration accepts, an empty effect matching them all
+var (
+	tolerationOperators = map[corev1.TolerationOperator]bool{corev1.TolerationOpExists: true, corev1.TolerationOpEqual: true, "": true}
+	taintEffects        = map[corev1.TaintEffect]bool{corev1.TaintEffectNoSchedule: true, corev1.TaintEffectPreferNoSchedule: true, corev1.TaintEffectNoExecute: true, "": true}
+)
+
+// values translates the options into chart values
+func (o placementOptions) values() (map[string]interface{}, error) {
+	agent, err := o.AgentPlacement.values("agentPlacement")
+	if err != nil {
+		return nil, err
+	}
+	operator, err := o.OperatorPlacement.values("operatorPlacement")
+	if err != nil {
+		return nil, err
+	}
+	if len(operator) > 0 {
+		agent = mergeValues(agent, map[string]interface{}{"operator": operator})
+	}
+	return agent, nil
+}
+
+// values validates the placement and returns the values setting it, name
+// being the option it was read from
+func (p componentPlacement) values(name string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if len(p.NodeSelector) > 0 {
+		if err := validateLabels(p.NodeSelector); err != nil {
+			return nil, ErrInvalidPlacement(fmt.Errorf("%s.nodeSelector: %w", name, err))
+		}
+		selector := make(map[string]interface{}, len(p.NodeSelector))
+		for key, value := range p.NodeSelector {
+			selector[key] = value
+		}
+		values["nodeSelector"] = selector
+	}
+
+	if p.Tolerations != nil {
+		var tolerations []corev1.Toleration
+		if err := decodeFragment(p.Tolerations, &tolerations); err != nil {
+			return nil, ErrInvalidPlacement(fmt.Errorf("%s.tolerations: %w", name, err))
+		}
+		for i, t := range tolerations {
+			if err := validateToleration(t); err != nil {
+				return nil, ErrInvalidPlacement(fmt.Errorf("%s.tolerations[%d]: %w", name, i, err))
+			}
+		}
+		value, err := fragmentValue(tolerations)
+		if err != nil {
+			return nil, ErrInvalidPlacement(err)
+		}
+		values["tolerations"] = value
+	}
+
+	if p.Affinity != nil {
+		var affinity corev1.Affinity
+		if err := decodeFragment(p.Affinity, &affinity); err != nil {
+			return nil, ErrInvalidPlacement(fmt.Errorf("%s.affinity: %w", name, err))
+		}
+		if err := validateNodeAffinity(affinity.NodeAffinity); err != nil {
+			return nil, ErrInvalidPlacement(fmt.Errorf("%s.affinity.nodeAffinity: %w", name, err))
+		}
+		value, err := fragmentValue(affinity)
+		if err != nil {
+			return nil, ErrInvalidPlacement(err)
+		}
+		values["affinity"] = value
+	}
+	return values, nil
+}
+
+// decodeFragment decodes a YAML fragment, or a string holding one, into
+// the kubernetes type out. Unknown fields are rejected so that a typo
+// fails instead of being dropped.
+func decodeFragment(fragment, out interface{}) error {
+	if s, ok := fragment.(string); ok {
+		if err := yaml.Unmarshal([]byte(s), &fragment); err != nil {
+			return err
+		}
+	}
+	normalized, err := normalizeValue(fragment, "")
+	if err != nil {
+		return err
+	}
+	byt, err := json.Marshal(normalized)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(byt))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// fragmentValue converts a decoded kubernetes object back into chart
+// values, without its empty fields
+func fragmentValue(obj interface{}) (interface{}, error) {
+	byt, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(byt, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// validateToleration fails if the toleration would be rejected by the API
+// server
+func validateToleration(t corev1.Toleration) error {
+	if !tolerationOperators[t.Operator] {
+		return fmt.Errorf("unknown operator %q, expected Exists or Equal", t.Operator)
+	}
+	if !taintEffects[t.Effect] {
+		return fmt.Errorf("unknown effect %q, expected NoSchedule, PreferNoSchedule or NoExecute", t.Effect)
+	}
+	if t.Operator == corev1.TolerationOpExists && t.Value != "" {
+		return fmt.Errorf("the Exists operator does not take a value")
+	}
+	if t.Key == "" && t.Operator != corev1.TolerationOpExists {
+		return fmt.Errorf("a toleration without key requires the Exists operator")
+	}
+	if t.TolerationSeconds != nil && t.Effect != corev1.TaintEffectNoExecute {
+		return fmt.Errorf("tolerationSeconds requires the NoExecute effect")
+	}
+	return nil
+}
+
+// validateNodeAffinity fails if a node selector requirement of affinity
+// has an unknown operator or values not matching it
+func validateNodeAffinity(affinity *corev1.NodeAffinity) error {
+	if affinity == nil {
+		return nil
+	}
+	var terms []corev1.NodeSelectorTerm
+	if affinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		terms = append(terms, affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms...)
+	}
+	for _, preferred := range affinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		terms = append(terms, preferred.Preference)
+	}
+	for _, term := range terms {
+		for _, req := range append(term.MatchExpressions, term.MatchFields...) {
+			switch req.Operator {
+			case corev1.NodeSelectorOpIn, corev1.NodeSelectorOpNotIn:
+				if len(req.Values) == 0 {
+					return fmt.Errorf("%s %s requires values", req.Key, req.Operator)
+				}
+			case corev1.NodeSelectorOpExists, corev1.NodeSelectorOpDoesNotExist:
+				if len(req.Values) > 0 {
+					return fmt.Errorf("%s %s does not take values", req.Key, req.Operator)
+				}
+			case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+				if len(req.Values) != 1 {
+					return fmt.Errorf("%s %s requires a single value", req.Key, req.Operator)
+				}
+			default:
+				return fmt.Errorf("unknown operator %q of %s", req.Operator, req.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// manifestPlacement describes the scheduling of the pods of the agent
+// DaemonSet and of the operator Deployment of a manifest
+func manifestPlacement(manifest string) string {
+	var placement []string
+	for _, doc := range releaseutil.SplitManifests(manifest) {
+		var obj struct {
+			Kind     string `yaml:"kind"`
+			Metadata struct {
+				Name string `yaml:"name"`
+			} `yaml:"metadata"`
+			Spec struct {
+				Template struct {
+					Spec struct {
+						NodeSelector interface{} `yaml:"nodeSelector,omitempty"`
+						Tolerations  interface{} `yaml:"tolerations,omitempty"`
+						Affinity     interface{} `yaml:"affinity,omitempty"`
+					} `yaml:"spec"`
+				} `yaml:"template"`
+			} `yaml:"spec"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			continue
+		}
+		if !(obj.Kind == "DaemonSet" && obj.Metadata.Name == agentDaemonSet) && !(obj.Kind == "Deployment" && obj.Metadata.Name == operatorDeployment) {
+			continue
+		}
+		byt, err := yaml.Marshal(obj.Spec.Template.Spec)
+		if err != nil {
+			continue
+		}
+		placement = append(placement, fmt.Sprintf("%s %s:\n%s", obj.Kind, obj.Metadata.Name, byt))
+	}
+	return strings.Join(placement, "\n")
+}
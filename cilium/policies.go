@@ -0,0 +1,546 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+)
+
+// policyAPIVersion is the API version of the cilium policies
+const policyAPIVersion = ciliumGroup + "/v2"
+
+// policyKind is a kind of cilium policy the designs apply
+type policyKind struct {
+	resource   schema.GroupVersionResource
+	namespaced bool
+}
+
+// policyKinds are the kinds of cilium policies, by kind
+var policyKinds = map[string]policyKind{
+	"CiliumNetworkPolicy":            {networkPolicyResource, true},
+	"CiliumClusterwideNetworkPolicy": {clusterwidePolicyResource, false},
+}
+
+// policyEntities are the entities the rules may allow traffic from or to
+var policyEntities = map[string]bool{
+	"all":            true,
+	"world":          true,
+	"cluster":        true,
+	"host":           true,
+	"remote-node":    true,
+	"kube-apiserver": true,
+	"init":           true,
+	"health":         true,
+	"unmanaged":      true,
+	"ingress":        true,
+}
+
+// hostLabel is the label of the endpoint standing for the host of a node
+const hostLabel = "reserved:host"
+
+// policyResult is the outcome of applying or deleting one policy
+type policyResult struct {
+	Kind      string
+	Namespace string
+	Name      string
+
+	// Action is what happened to the policy: created, configured,
+	// unchanged, deleted or not found
+	Action string
+	Err    error
+
+	// Warning tells about the risks of the policy once applied
+	Warning string
+}
+
+func (r policyResult) String() string {
+	name := r.Name
+	if r.Namespace != "" {
+		name = r.Namespace + "/" + r.Name
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("%s %s: %s", r.Kind, name, r.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", r.Kind, name, r.Action)
+}
+
+// policyObjects decodes the documents of manifest in their order, the
+// documents which cannot be decoded being returned as failed results
+// instead of failing the others
+func policyObjects(manifest string) ([]*unstructured.Unstructured, []policyResult) {
+	docs := releaseutil.SplitManifests(manifest)
+	names := make([]string, 0, len(docs))
+	for name := range docs {
+		names = append(names, name)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(names))
+
+	var objs []*unstructured.Unstructured
+	var failed []policyResult
+	for i, name := range names {
+		obj := &unstructured.Unstructured{}
+		if err := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(docs[name]), 4096).Decode(&obj.Object); err != nil {
+			failed = append(failed, policyResult{Kind: "document", Name: fmt.Sprint(i + 1), Err: err})
+			continue
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, failed
+}
+
+// policySchema returns the OpenAPI schema of the v2 resources of the
+// installed CRD of kind
+func (h *Handler) policySchema(ctx context.Context, kind policyKind) (map[string]interface{}, error) {
+	name := kind.resource.Resource + "." + ciliumGroup
+	crd, err := h.DynamicKubeClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, fmt.Errorf("the %s CRD is not installed, install cilium first", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok || version["name"] != kind.resource.Version {
+			continue
+		}
+		if served, _ := version["served"].(bool); !served {
+			break
+		}
+		s, _, _ := unstructured.NestedMap(version, "schema", "openAPIV3Schema")
+		return s, nil
+	}
+	return nil, fmt.Errorf("the installed %s CRD does not serve %s", name, kind.resource.Version)
+}
+
+// unknownFields returns the fields of value, found at path, which the
+// OpenAPI schema s does not declare. The API server prunes them without a
+// word, which hides typos like ingres for ingress.
+func unknownFields(s map[string]interface{}, value interface{}, path string) []string {
+	if s == nil {
+		return nil
+	}
+	if preserve, _ := s["x-kubernetes-preserve-unknown-fields"].(bool); preserve {
+		return nil
+	}
+	var unknown []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := s["properties"].(map[string]interface{})
+		additional := s["additionalProperties"]
+		if properties == nil && additional == nil {
+			// A free-form object
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := path + "." + key
+			if p, ok := properties[key].(map[string]interface{}); ok {
+				unknown = append(unknown, unknownFields(p, v[key], fieldPath)...)
+				continue
+			}
+			switch a := additional.(type) {
+			case map[string]interface{}:
+				unknown = append(unknown, unknownFields(a, v[key], fieldPath)...)
+			case bool:
+				if !a {
+					unknown = append(unknown, fieldPath)
+				}
+			default:
+				unknown = append(unknown, fieldPath)
+			}
+		}
+	case []interface{}:
+		items, _ := s["items"].(map[string]interface{})
+		for i, item := range v {
+			unknown = append(unknown, unknownFields(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+// validatePolicy fails if obj is not a cilium policy the installed CRD
+// accepts, naming the offending fields. The namespace of the namespaced
+// policies defaults to namespace.
+func validatePolicy(obj *unstructured.Unstructured, kind policyKind, s map[string]interface{}, namespace string) error {
+	if obj.GetAPIVersion() != policyAPIVersion {
+		return fmt.Errorf("apiVersion: %q is not supported, expected %s", obj.GetAPIVersion(), policyAPIVersion)
+	}
+	if errs := validation.IsDNS1123Subdomain(obj.GetName()); len(errs) > 0 {
+		return fmt.Errorf("metadata.name: %q: %s", obj.GetName(), strings.Join(errs, ", "))
+	}
+	if kind.namespaced && obj.GetNamespace() == "" {
+		obj.SetNamespace(namespace)
+	}
+	if !kind.namespaced && obj.GetNamespace() != "" {
+		return fmt.Errorf("metadata.namespace: %s is cluster scoped, it has no namespace", obj.GetKind())
+	}
+	_, hasSpec := obj.Object["spec"]
+	_, hasSpecs := obj.Object["specs"]
+	if !hasSpec && !hasSpecs {
+		return fmt.Errorf("spec: either spec or specs is required")
+	}
+
+	if err := validateRules(obj, kind); err != nil {
+		return err
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	if properties == nil {
+		// Without a schema, the fields are left to the API server
+		return nil
+	}
+	var unknown []string
+	for _, field := range []string{"spec", "specs"} {
+		if value, ok := obj.Object[field]; ok {
+			fieldSchema, _ := properties[field].(map[string]interface{})
+			if fieldSchema == nil {
+				unknown = append(unknown, field)
+				continue
+			}
+			unknown = append(unknown, unknownFields(fieldSchema, value, field)...)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown fields of %s: %s", obj.GetKind(), strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// policyRules returns the rules of obj, its spec and its specs, by path
+func policyRules(obj *unstructured.Unstructured) map[string]map[string]interface{} {
+	rules := make(map[string]map[string]interface{})
+	if spec, ok := obj.Object["spec"].(map[string]interface{}); ok {
+		rules["spec"] = spec
+	}
+	specs, _ := obj.Object["specs"].([]interface{})
+	for i, s := range specs {
+		if spec, ok := s.(map[string]interface{}); ok {
+			rules[fmt.Sprintf("specs[%d]", i)] = spec
+		}
+	}
+	return rules
+}
+
+// rulePaths returns the paths of rules, sorted
+func rulePaths(rules map[string]map[string]interface{}) []string {
+	paths := make([]string, 0, len(rules))
+	for path := range rules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// validateRules fails if a rule of obj selects both or neither endpoints
+// and nodes, selects nodes from a namespaced policy, as the host policies
+// are cluster wide only, or allows unknown entities
+func validateRules(obj *unstructured.Unstructured, kind policyKind) error {
+	rules := policyRules(obj)
+	var problems []string
+	for _, path := range rulePaths(rules) {
+		rule := rules[path]
+		_, endpoints := rule["endpointSelector"]
+		_, nodes := rule["nodeSelector"]
+		switch {
+		case endpoints && nodes:
+			problems = append(problems, fmt.Sprintf("%s: endpointSelector and nodeSelector are exclusive", path))
+		case !endpoints && !nodes:
+			problems = append(problems, fmt.Sprintf("%s: either endpointSelector or nodeSelector is required", path))
+		case nodes && kind.namespaced:
+			problems = append(problems, fmt.Sprintf("%s.nodeSelector: host policies are cluster wide, use a CiliumClusterwideNetworkPolicy", path))
+		}
+
+		for _, direction := range []struct{ section, field string }{
+			{"ingress", "fromEntities"}, {"ingressDeny", "fromEntities"},
+			{"egress", "toEntities"}, {"egressDeny", "toEntities"},
+		} {
+			sections, _ := rule[direction.section].([]interface{})
+			for i, s := range sections {
+				section, _ := s.(map[string]interface{})
+				entities, _ := section[direction.field].([]interface{})
+				for j, entity := range entities {
+					if name, _ := entity.(string); !policyEntities[name] {
+						problems = append(problems, fmt.Sprintf("%s.%s[%d].%s[%d]: unknown entity %v", path, direction.section, i, direction.field, j, entity))
+					}
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// hostPolicyWarning warns if obj selects the hosts of the nodes, as a
+// policy denying their traffic locks the nodes out
+func hostPolicyWarning(obj *unstructured.Unstructured) string {
+	rules := policyRules(obj)
+	for _, path := range rulePaths(rules) {
+		rule := rules[path]
+		_, nodes := rule["nodeSelector"]
+		labels, _, _ := unstructured.NestedStringMap(rule, "endpointSelector", "matchLabels")
+		if _, host := labels[hostLabel]; !nodes && !host {
+			continue
+		}
+		return fmt.Sprintf("Warning: %s %s selects the hosts of the nodes at %s, make sure it allows ssh, the API server and the kubelet or the nodes may be locked out. The host firewall enforces it once enabled.", obj.GetKind(), obj.GetName(), path)
+	}
+	return ""
+}
+
+// fieldErrors describes the rejection of a policy by the API server by
+// the fields it names, falling back to its message
+func fieldErrors(err error) error {
+	status, ok := err.(kerrors.APIStatus)
+	if !ok || status.Status().Details == nil || len(status.Status().Details.Causes) == 0 {
+		return err
+	}
+	causes := status.Status().Details.Causes
+	lines := make([]string, 0, len(causes))
+	for _, cause := range causes {
+		if cause.Field == "" {
+			lines = append(lines, cause.Message)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", cause.Field, cause.Message))
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "; "))
+}
+
+// applyPolicyManifest validates the cilium policies of manifest and
+// applies them with server-side apply, the documents being handled one by
+// one so that a bad one does not stop the others. The policies are
+// deleted if del is set. The outcome of every document is returned.
+func (h *Handler) applyPolicyManifest(ctx context.Context, namespace, manifest string, del bool) []policyResult {
+	objs, results := policyObjects(manifest)
+	return append(results, h.applyPolicyObjects(ctx, namespace, objs, del)...)
+}
+
+// applyPolicyObjects validates and applies the cilium policies objs, or
+// deletes them if del is set, and returns the outcome of every one
+func (h *Handler) applyPolicyObjects(ctx context.Context, namespace string, objs []*unstructured.Unstructured, del bool) []policyResult {
+	var results []policyResult
+	schemas := make(map[string]map[string]interface{})
+	for _, obj := range objs {
+		result := policyResult{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		kind, ok := policyKinds[obj.GetKind()]
+		if !ok {
+			result.Err = fmt.Errorf("kind: %q is not a cilium policy", obj.GetKind())
+			results = append(results, result)
+			continue
+		}
+		if kind.namespaced && result.Namespace == "" {
+			result.Namespace = namespace
+		}
+		var client dynamic.ResourceInterface = h.DynamicKubeClient.Resource(kind.resource)
+		if kind.namespaced {
+			client = h.DynamicKubeClient.Resource(kind.resource).Namespace(result.Namespace)
+		}
+
+		if del {
+			err := client.Delete(ctx, obj.GetName(), metav1.DeleteOptions{})
+			switch {
+			case kerrors.IsNotFound(err):
+				result.Action = "not found"
+			case err != nil:
+				result.Err = err
+			default:
+				result.Action = "deleted"
+			}
+			results = append(results, result)
+			continue
+		}
+
+		s, ok := schemas[obj.GetKind()]
+		if !ok {
+			var err error
+			if s, err = h.policySchema(ctx, kind); err != nil {
+				result.Err = err
+				results = append(results, result)
+				continue
+			}
+			schemas[obj.GetKind()] = s
+		}
+		if err := validatePolicy(obj, kind, s, namespace); err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+
+		result.Action, result.Err = applyPolicy(ctx, client, obj)
+		if result.Err == nil {
+			result.Warning = hostPolicyWarning(obj)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// applyPolicy applies obj through client, a dry run first so that the
+// rejections of the API server are reported by field, and returns whether
+// it was created, configured or left unchanged
+func applyPolicy(ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured) (string, error) {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	previous := ""
+	existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	switch {
+	case err == nil:
+		previous = existing.GetResourceVersion()
+	case !kerrors.IsNotFound(err):
+		return "", err
+	}
+
+	force := true
+	opts := metav1.PatchOptions{FieldManager: manifestFieldManager, Force: &force, DryRun: []string{metav1.DryRunAll}}
+	if _, err := client.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, opts); err != nil {
+		return "", fieldErrors(err)
+	}
+	opts.DryRun = nil
+	applied, err := client.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, opts)
+	if err != nil {
+		return "", fieldErrors(err)
+	}
+	switch {
+	case previous == "":
+		return "created", nil
+	case applied.GetResourceVersion() == previous:
+		return "unchanged", nil
+	}
+	return "configured", nil
+}
+
+// policyExportRequest holds the parameters of the policy export operation,
+// read from the custom body of the request
+type policyExportRequest struct {
+	// Namespace the CiliumNetworkPolicies are exported from, every
+	// namespace by default. The cluster wide policies are always exported.
+	Namespace string `yaml:"namespace"`
+}
+
+// exportedPolicy strips obj of what the cluster sets, for the manifest to
+// be applied again as it is
+func exportedPolicy(obj unstructured.Unstructured) map[string]interface{} {
+	exported := obj.DeepCopy().Object
+	delete(exported, "status")
+	for _, field := range []string{"managedFields", "resourceVersion", "uid", "creationTimestamp", "generation", "selfLink"} {
+		unstructured.RemoveNestedField(exported, "metadata", field)
+	}
+	unstructured.RemoveNestedField(exported, "metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration")
+	if annotations, ok, _ := unstructured.NestedMap(exported, "metadata", "annotations"); ok && len(annotations) == 0 {
+		unstructured.RemoveNestedField(exported, "metadata", "annotations")
+	}
+	return exported
+}
+
+// exportPolicies streams the cilium policies of the cluster, both the
+// namespaced and the cluster wide ones, as a multi-document manifest
+func (h *Handler) exportPolicies(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while exporting the Cilium policies"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req policyExportRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	kinds := make([]string, 0, len(policyKinds))
+	for kind := range policyKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var docs, counts []string
+	for _, kind := range kinds {
+		resource := h.DynamicKubeClient.Resource(policyKinds[kind].resource)
+		var client dynamic.ResourceInterface = resource
+		if policyKinds[kind].namespaced {
+			client = resource.Namespace(req.Namespace)
+		}
+		list, err := client.List(ctx, metav1.ListOptions{})
+		if kerrors.IsNotFound(err) {
+			// The CRD is not installed
+			counts = append(counts, fmt.Sprintf("%s: none, the CRD is not installed", kind))
+			continue
+		}
+		if err != nil {
+			fail(ErrCiliumPolicy(fmt.Errorf("listing the %s resources: %w", kind, err)))
+			return
+		}
+		items := list.Items
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].GetNamespace() != items[j].GetNamespace() {
+				return items[i].GetNamespace() < items[j].GetNamespace()
+			}
+			return items[i].GetName() < items[j].GetName()
+		})
+		for _, item := range items {
+			doc, err := yaml.Marshal(exportedPolicy(item))
+			if err != nil {
+				fail(ErrCiliumPolicy(err))
+				return
+			}
+			docs = append(docs, string(doc))
+		}
+		counts = append(counts, fmt.Sprintf("%s: %d", kind, len(items)))
+	}
+
+	where := "every namespace"
+	if req.Namespace != "" {
+		where = "namespace " + req.Namespace
+	}
+	e.Summary = fmt.Sprintf("Exported %d Cilium policies", len(docs))
+	e.Details = fmt.Sprintf("The CiliumNetworkPolicies of %s and the CiliumClusterwideNetworkPolicies:\n%s\n\n---\n%s", where, strings.Join(counts, "\n"), strings.Join(docs, "---\n"))
+	h.StreamInfo(e)
+}
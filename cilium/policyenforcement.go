@@ -0,0 +1,170 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// The policy enforcement modes of the agents: default enforces the
+	// policies on the endpoints some policy selects, always on every
+	// endpoint, denying what no policy allows, and never on none
+	policyEnforcementDefault = "default"
+	policyEnforcementAlways  = "always"
+	policyEnforcementNever   = "never"
+
+	// baselinePolicyName is the name of the clusterwide policy letting
+	// every endpoint resolve names when the policies are always enforced
+	baselinePolicyName = "meshery-allow-dns"
+)
+
+// policyOptions choose how the agents enforce the network policies. They
+// are part of the custom body of the install and upgrade requests.
+type policyOptions struct {
+	// PolicyEnforcementMode is default, always or never. The mode of the
+	// chart, default, is kept if unset.
+	PolicyEnforcementMode string `yaml:"policyEnforcementMode"`
+
+	// BaselinePolicy applies, along with the always mode, a clusterwide
+	// policy allowing every endpoint to reach the DNS of kube-system, so
+	// that the cluster keeps resolving names once everything is denied
+	BaselinePolicy bool `yaml:"baselinePolicy"`
+}
+
+// set reports whether the options change the policy enforcement mode
+func (o policyOptions) set() bool {
+	return o.PolicyEnforcementMode != ""
+}
+
+// values translates the options into chart values
+func (o policyOptions) values() (map[string]interface{}, error) {
+	switch o.PolicyEnforcementMode {
+	case "":
+		if o.BaselinePolicy {
+			return nil, ErrInvalidPolicyEnforcement(fmt.Errorf("baselinePolicy requires the %s policy enforcement mode", policyEnforcementAlways))
+		}
+		return nil, nil
+	case policyEnforcementDefault, policyEnforcementNever:
+		if o.BaselinePolicy {
+			return nil, ErrInvalidPolicyEnforcement(fmt.Errorf("baselinePolicy requires the %s policy enforcement mode, got %s", policyEnforcementAlways, o.PolicyEnforcementMode))
+		}
+	case policyEnforcementAlways:
+	default:
+		return nil, ErrInvalidPolicyEnforcement(fmt.Errorf("unknown policy enforcement mode %q, expected %s, %s or %s", o.PolicyEnforcementMode, policyEnforcementDefault, policyEnforcementAlways, policyEnforcementNever))
+	}
+	return map[string]interface{}{"policyEnforcementMode": o.PolicyEnforcementMode}, nil
+}
+
+// policyEnforcementMode returns the policy enforcement mode of the chart
+// values, which is default unless set
+func policyEnforcementMode(values map[string]interface{}) string {
+	if mode, ok := values["policyEnforcementMode"].(string); ok && mode != "" {
+		return mode
+	}
+	return policyEnforcementDefault
+}
+
+// baselinePolicy builds the clusterwide policy allowing every endpoint to
+// query the DNS of kube-system, and the DNS to be queried from the cluster
+// and to reach its upstream servers
+func baselinePolicy() *unstructured.Unstructured {
+	dnsSelector := map[string]interface{}{
+		"matchLabels": map[string]interface{}{
+			"k8s:io.kubernetes.pod.namespace": metav1.NamespaceSystem,
+			"k8s:k8s-app":                     "kube-dns",
+		},
+	}
+	dnsPorts := []interface{}{map[string]interface{}{
+		"ports": []interface{}{
+			map[string]interface{}{"port": "53", "protocol": "UDP"},
+			map[string]interface{}{"port": "53", "protocol": "TCP"},
+		},
+	}}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": clusterwidePolicyResource.GroupVersion().String(),
+		"kind":       "CiliumClusterwideNetworkPolicy",
+		"metadata":   map[string]interface{}{"name": baselinePolicyName},
+		"specs": []interface{}{
+			map[string]interface{}{
+				"description":      "Every endpoint resolves names through the DNS of kube-system",
+				"endpointSelector": map[string]interface{}{},
+				"egress": []interface{}{map[string]interface{}{
+					"toEndpoints": []interface{}{dnsSelector},
+					"toPorts":     dnsPorts,
+				}},
+			},
+			map[string]interface{}{
+				"description":      "The DNS of kube-system serves the cluster and reaches its upstream servers",
+				"endpointSelector": dnsSelector,
+				"ingress": []interface{}{map[string]interface{}{
+					"fromEntities": []interface{}{"cluster"},
+					"toPorts":      dnsPorts,
+				}},
+				"egress": []interface{}{map[string]interface{}{
+					"toEntities": []interface{}{"all"},
+				}},
+			},
+		},
+	}}
+}
+
+// applyBaselinePolicy applies the baseline policy and describes the result
+func (h *Handler) applyBaselinePolicy(ctx context.Context) (string, error) {
+	if h.DynamicKubeClient == nil {
+		return "", ErrNilClient
+	}
+	stat, err := h.applyResource(ctx, clusterwidePolicyResource, baselinePolicy())
+	if err != nil {
+		return "", ErrApplyBaselinePolicy(err)
+	}
+	return fmt.Sprintf("CiliumClusterwideNetworkPolicy %s: %s", baselinePolicyName, stat), nil
+}
+
+// alwaysEnforcementWarning describes the endpoints which lose the traffic
+// no policy allows once the policies are always enforced
+func (h *Handler) alwaysEnforcementWarning(ctx context.Context, baseline bool) string {
+	warning := "Warning: the always policy enforcement mode denies every flow no policy allows, on every endpoint of the cluster"
+	if h.DynamicKubeClient != nil {
+		if endpoints, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{}); err == nil {
+			namespaces := make(map[string]bool)
+			for _, ep := range endpoints.Items {
+				namespaces[ep.GetNamespace()] = true
+			}
+			warning = fmt.Sprintf("%s: %d endpoints in %d namespaces", warning, len(endpoints.Items), len(namespaces))
+		}
+	}
+	if !baseline {
+		warning += ", the DNS included unless a policy allows it (see baselinePolicy)"
+	}
+	return warning + "."
+}
+
+// policyEnforcementStatus returns the policy enforcement mode the agents
+// of namespace are configured with
+func (h *Handler) policyEnforcementStatus(ctx context.Context, namespace string) string {
+	cm, err := h.KubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, ciliumConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	if mode := cm.Data["enable-policy"]; mode != "" {
+		return mode
+	}
+	return policyEnforcementDefault
+}
@@ -0,0 +1,586 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/cilium/oam"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// podNamespaceLabel is the label of the endpoints holding the namespace
+// of their pod
+const podNamespaceLabel = "io.kubernetes.pod.namespace"
+
+// policyWorkloads are the names of the component schemas of the policy
+// kinds, the schemas of their spec
+var policyWorkloads = map[string]string{
+	"CiliumNetworkPolicy":            "ciliumnetworkpolicy.meshery.layer5.io",
+	"CiliumClusterwideNetworkPolicy": "ciliumclusterwidenetworkpolicy.meshery.layer5.io",
+}
+
+// policyValidateRequest holds the parameters of the policy validation
+// operation, read from the custom body of the request
+type policyValidateRequest struct {
+	// Manifest holds the policies to validate, as YAML documents
+	Manifest string `yaml:"manifest"`
+
+	// Namespace of the namespaced policies which set none, default by
+	// default
+	Namespace string `yaml:"namespace"`
+
+	// Version of cilium whose schemas the policies are validated against,
+	// the installed one by default, else the newest one known
+	Version string `yaml:"version"`
+}
+
+// endpointRef is an endpoint a policy selects
+type endpointRef struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Identity  int64  `json:"identity,omitempty"`
+}
+
+// ruleSummary describes what a rule of a policy allows or denies
+type ruleSummary struct {
+	// Direction is ingress, ingressDeny, egress or egressDeny
+	Direction string `json:"direction"`
+	Index     int    `json:"index"`
+
+	// Peers describe the peers of the rule, like entity world, and
+	// PeerEndpoints are the existing endpoints its selectors match
+	Peers         []string      `json:"peers"`
+	PeerEndpoints []endpointRef `json:"peerEndpoints,omitempty"`
+
+	// Ports are the ports of the rule, like 80/TCP, every port if empty
+	Ports []string `json:"ports,omitempty"`
+
+	// L7 are the application rules on the ports
+	L7 []string `json:"l7,omitempty"`
+
+	Summary string `json:"summary"`
+}
+
+// specValidation is what one rule set of a policy, its spec or one of its
+// specs, selects
+type specValidation struct {
+	Path string `json:"path"`
+
+	// Selects is endpoints or nodes
+	Selects   string        `json:"selects"`
+	Endpoints []endpointRef `json:"endpoints,omitempty"`
+	Nodes     []string      `json:"nodes,omitempty"`
+	Rules     []ruleSummary `json:"rules"`
+}
+
+// policyValidation is the validation of one policy
+type policyValidation struct {
+	Kind      string           `json:"kind"`
+	Namespace string           `json:"namespace,omitempty"`
+	Name      string           `json:"name"`
+	Valid     bool             `json:"valid"`
+	Errors    []string         `json:"errors,omitempty"`
+	Warning   string           `json:"warning,omitempty"`
+	Specs     []specValidation `json:"specs,omitempty"`
+}
+
+// policyValidationReport is the outcome of the validation operation
+type policyValidationReport struct {
+	Summary string `json:"summary"`
+
+	// Schema is the version of the schemas the policies were validated
+	// against
+	Schema string `json:"schema"`
+
+	// Note tells why the endpoints were not matched, if they were not
+	Note     string             `json:"note,omitempty"`
+	Policies []policyValidation `json:"policies"`
+}
+
+// schemaVersion returns the newest version of the component schemas up to
+// version, the oldest one if version is older than all of them, or the
+// newest one if version is empty
+func schemaVersion(version string) (string, error) {
+	var known []*semver.Version
+	originals := make(map[*semver.Version]string)
+	for name := range oam.AvailableVersions {
+		if v, err := semver.NewVersion(name); err == nil {
+			known = append(known, v)
+			originals[v] = name
+		}
+	}
+	if len(known) == 0 {
+		return "", fmt.Errorf("no component schemas found in %s", oam.WorkloadPath)
+	}
+	sort.Sort(semver.Collection(known))
+	picked := known[len(known)-1]
+	if version != "" {
+		target, err := semver.NewVersion(version)
+		if err != nil {
+			return "", ErrParseCustomBody(fmt.Errorf("version %q: %w", version, err))
+		}
+		picked = known[0]
+		for _, v := range known {
+			if !v.GreaterThan(target) {
+				picked = v
+			}
+		}
+	}
+	return originals[picked], nil
+}
+
+// offlinePolicySchema returns the schema of kind of the components of
+// version, shaped like the schema of the CRD
+func offlinePolicySchema(version, kind string) (map[string]interface{}, error) {
+	content, err := oam.WorkloadSchema(version, policyWorkloads[kind])
+	if err != nil {
+		return nil, err
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return nil, fmt.Errorf("schema of %s %s: %w", kind, version, err)
+	}
+	return map[string]interface{}{"properties": map[string]interface{}{
+		"spec":  spec,
+		"specs": map[string]interface{}{"items": spec},
+	}}, nil
+}
+
+// identityLabels indexes the identity labels of an endpoint, like
+// k8s:app=web, by their key with their source and, but for the reserved
+// ones, without it
+func identityLabels(labels []string) map[string]string {
+	indexed := make(map[string]string, 2*len(labels))
+	for _, label := range labels {
+		key, value := label, ""
+		if i := strings.Index(label, "="); i >= 0 {
+			key, value = label[:i], label[i+1:]
+		}
+		indexed[key] = value
+		if i := strings.Index(key, ":"); i >= 0 && key[:i] != "reserved" {
+			indexed[key[i+1:]] = value
+		}
+	}
+	return indexed
+}
+
+// selectorKey returns the key labels are looked up with for the key of a
+// selector, the any source being the same as none
+func selectorKey(key string) string {
+	return strings.TrimPrefix(key, "any:")
+}
+
+// selectorMatches reports whether the label selector sel matches labels,
+// indexed by identityLabels
+func selectorMatches(sel map[string]interface{}, labels map[string]string) bool {
+	matchLabels, _, _ := unstructured.NestedStringMap(sel, "matchLabels")
+	for key, value := range matchLabels {
+		if v, ok := labels[selectorKey(key)]; !ok || v != value {
+			return false
+		}
+	}
+	expressions, _, _ := unstructured.NestedSlice(sel, "matchExpressions")
+	for _, e := range expressions {
+		expression, _ := e.(map[string]interface{})
+		key, _ := expression["key"].(string)
+		operator, _ := expression["operator"].(string)
+		values, _, _ := unstructured.NestedStringSlice(expression, "values")
+		v, ok := labels[selectorKey(key)]
+		in := false
+		for _, value := range values {
+			in = in || (ok && v == value)
+		}
+		switch operator {
+		case "In":
+			if !in {
+				return false
+			}
+		case "NotIn":
+			if in {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// selectsNamespace reports whether sel names the namespace of the pods,
+// which lifts the implicit namespace of the selectors of the namespaced
+// policies
+func selectsNamespace(sel map[string]interface{}) bool {
+	matchLabels, _, _ := unstructured.NestedStringMap(sel, "matchLabels")
+	for key := range matchLabels {
+		if strings.HasSuffix(key, podNamespaceLabel) {
+			return true
+		}
+	}
+	expressions, _, _ := unstructured.NestedSlice(sel, "matchExpressions")
+	for _, e := range expressions {
+		expression, _ := e.(map[string]interface{})
+		if key, _ := expression["key"].(string); strings.HasSuffix(key, podNamespaceLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeSelector describes sel like app=web,tier in (a,b)
+func describeSelector(sel map[string]interface{}) string {
+	var terms []string
+	matchLabels, _, _ := unstructured.NestedStringMap(sel, "matchLabels")
+	for key, value := range matchLabels {
+		terms = append(terms, key+"="+value)
+	}
+	sort.Strings(terms)
+	expressions, _, _ := unstructured.NestedSlice(sel, "matchExpressions")
+	for _, e := range expressions {
+		expression, _ := e.(map[string]interface{})
+		values, _, _ := unstructured.NestedStringSlice(expression, "values")
+		term := fmt.Sprintf("%v %v", expression["key"], expression["operator"])
+		if len(values) > 0 {
+			term += " (" + strings.Join(values, ",") + ")"
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return "all"
+	}
+	return strings.Join(terms, ",")
+}
+
+// policyEndpoint is an existing endpoint with its identity labels
+type policyEndpoint struct {
+	ref    endpointRef
+	labels map[string]string
+}
+
+// listPolicyEndpoints returns the CiliumEndpoints of the cluster
+func (h *Handler) listPolicyEndpoints(ctx context.Context) ([]policyEndpoint, error) {
+	list, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]policyEndpoint, 0, len(list.Items))
+	for _, item := range list.Items {
+		labels, _, _ := unstructured.NestedStringSlice(item.Object, "status", "identity", "labels")
+		id, _, _ := unstructured.NestedInt64(item.Object, "status", "identity", "id")
+		endpoints = append(endpoints, policyEndpoint{
+			ref:    endpointRef{Namespace: item.GetNamespace(), Pod: item.GetName(), Identity: id},
+			labels: identityLabels(labels),
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].ref.Namespace != endpoints[j].ref.Namespace {
+			return endpoints[i].ref.Namespace < endpoints[j].ref.Namespace
+		}
+		return endpoints[i].ref.Pod < endpoints[j].ref.Pod
+	})
+	return endpoints, nil
+}
+
+// matchEndpoints returns the endpoints sel matches, only those of
+// namespace unless it is empty or sel names the namespace
+func matchEndpoints(endpoints []policyEndpoint, sel map[string]interface{}, namespace string) []endpointRef {
+	if namespace != "" && selectsNamespace(sel) {
+		namespace = ""
+	}
+	var matched []endpointRef
+	for _, ep := range endpoints {
+		if namespace != "" && ep.ref.Namespace != namespace {
+			continue
+		}
+		if selectorMatches(sel, ep.labels) {
+			matched = append(matched, ep.ref)
+		}
+	}
+	return matched
+}
+
+// summarizeRule describes the rule of direction at index, matching its
+// peer selectors against endpoints, only those of namespace unless it is
+// empty
+func summarizeRule(direction string, index int, rule map[string]interface{}, endpoints []policyEndpoint, namespace string) ruleSummary {
+	summary := ruleSummary{Direction: direction, Index: index}
+	prefix := "to"
+	if strings.HasPrefix(direction, "ingress") {
+		prefix = "from"
+	}
+
+	selectors, _, _ := unstructured.NestedSlice(rule, prefix+"Endpoints")
+	seen := make(map[endpointRef]bool)
+	for _, s := range selectors {
+		sel, _ := s.(map[string]interface{})
+		summary.Peers = append(summary.Peers, "endpoints "+describeSelector(sel))
+		for _, ref := range matchEndpoints(endpoints, sel, namespace) {
+			if !seen[ref] {
+				seen[ref] = true
+				summary.PeerEndpoints = append(summary.PeerEndpoints, ref)
+			}
+		}
+	}
+	entities, _, _ := unstructured.NestedStringSlice(rule, prefix+"Entities")
+	for _, entity := range entities {
+		summary.Peers = append(summary.Peers, "entity "+entity)
+	}
+	cidrs, _, _ := unstructured.NestedStringSlice(rule, prefix+"CIDR")
+	for _, cidr := range cidrs {
+		summary.Peers = append(summary.Peers, "cidr "+cidr)
+	}
+	cidrSets, _, _ := unstructured.NestedSlice(rule, prefix+"CIDRSet")
+	for _, c := range cidrSets {
+		set, _ := c.(map[string]interface{})
+		if cidr, _ := set["cidr"].(string); cidr != "" {
+			summary.Peers = append(summary.Peers, "cidr "+cidr)
+		}
+	}
+	fqdns, _, _ := unstructured.NestedSlice(rule, "toFQDNs")
+	for _, f := range fqdns {
+		fqdn, _ := f.(map[string]interface{})
+		if name, _ := fqdn["matchName"].(string); name != "" {
+			summary.Peers = append(summary.Peers, "fqdn "+name)
+		}
+		if pattern, _ := fqdn["matchPattern"].(string); pattern != "" {
+			summary.Peers = append(summary.Peers, "fqdn "+pattern)
+		}
+	}
+	if services, _, _ := unstructured.NestedSlice(rule, "toServices"); len(services) > 0 {
+		summary.Peers = append(summary.Peers, fmt.Sprintf("%d services", len(services)))
+	}
+	if len(summary.Peers) == 0 {
+		summary.Peers = []string{"any peer"}
+	}
+
+	portRules, _, _ := unstructured.NestedSlice(rule, "toPorts")
+	if len(portRules) == 0 {
+		portRules, _, _ = unstructured.NestedSlice(rule, "toPortsDeny")
+	}
+	for _, p := range portRules {
+		portRule, _ := p.(map[string]interface{})
+		ports, _, _ := unstructured.NestedSlice(portRule, "ports")
+		for _, pp := range ports {
+			port, _ := pp.(map[string]interface{})
+			protocol, _ := port["protocol"].(string)
+			if protocol == "" {
+				protocol = "ANY"
+			}
+			number := fmt.Sprint(port["port"])
+			if end, ok := port["endPort"]; ok {
+				number = fmt.Sprintf("%s-%v", number, end)
+			}
+			summary.Ports = append(summary.Ports, number+"/"+protocol)
+		}
+		l7, _, _ := unstructured.NestedMap(portRule, "rules")
+		for _, protocol := range []string{"http", "kafka", "dns"} {
+			if rules, ok := l7[protocol].([]interface{}); ok {
+				summary.L7 = append(summary.L7, describeL7(protocol, rules)...)
+			}
+		}
+	}
+
+	verb := "allows"
+	if strings.HasSuffix(direction, "Deny") {
+		verb = "denies"
+	}
+	ports := "every port"
+	if len(summary.Ports) > 0 {
+		ports = strings.Join(summary.Ports, ", ")
+	}
+	summary.Summary = fmt.Sprintf("%s[%d] %s %s %s (%d existing endpoints) on %s", direction, index, verb, prefix, strings.Join(summary.Peers, ", "), len(summary.PeerEndpoints), ports)
+	if len(summary.L7) > 0 {
+		summary.Summary += fmt.Sprintf(" restricted to %d L7 rules", len(summary.L7))
+	}
+	return summary
+}
+
+// describeL7 describes the application rules of protocol, like GET /v1
+func describeL7(protocol string, rules []interface{}) []string {
+	lines := make([]string, 0, len(rules))
+	for _, r := range rules {
+		rule, _ := r.(map[string]interface{})
+		var terms []string
+		for _, field := range []string{"method", "path", "host", "topic", "matchName", "matchPattern"} {
+			if value, _ := rule[field].(string); value != "" {
+				terms = append(terms, value)
+			}
+		}
+		if len(terms) == 0 {
+			terms = []string{"any"}
+		}
+		lines = append(lines, protocol+" "+strings.Join(terms, " "))
+	}
+	return lines
+}
+
+// validatePolicyOffline validates obj against schema and reports what its
+// rules select among endpoints, and nodes, if they could be listed
+func validatePolicyOffline(obj *unstructured.Unstructured, schema map[string]interface{}, namespace string, endpoints []policyEndpoint, nodes map[string]map[string]string) policyValidation {
+	result := policyValidation{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	kind, ok := policyKinds[obj.GetKind()]
+	if !ok {
+		result.Errors = []string{fmt.Sprintf("kind: %q is not a cilium policy", obj.GetKind())}
+		return result
+	}
+	if err := validatePolicy(obj, kind, schema, namespace); err != nil {
+		result.Errors = strings.Split(err.Error(), "; ")
+		return result
+	}
+	result.Valid = true
+	result.Namespace = obj.GetNamespace()
+	result.Warning = hostPolicyWarning(obj)
+
+	scope := ""
+	if kind.namespaced {
+		scope = obj.GetNamespace()
+	}
+	rules := policyRules(obj)
+	for _, path := range rulePaths(rules) {
+		rule := rules[path]
+		spec := specValidation{Path: path, Selects: "endpoints", Rules: []ruleSummary{}}
+		if sel, ok := rule["nodeSelector"].(map[string]interface{}); ok {
+			spec.Selects = "nodes"
+			for name, labels := range nodes {
+				if selectorMatches(sel, labels) {
+					spec.Nodes = append(spec.Nodes, name)
+				}
+			}
+			sort.Strings(spec.Nodes)
+		} else if sel, ok := rule["endpointSelector"].(map[string]interface{}); ok {
+			spec.Endpoints = matchEndpoints(endpoints, sel, scope)
+		}
+		for _, direction := range []string{"ingress", "ingressDeny", "egress", "egressDeny"} {
+			sections, _ := rule[direction].([]interface{})
+			for i, s := range sections {
+				section, _ := s.(map[string]interface{})
+				spec.Rules = append(spec.Rules, summarizeRule(direction, i, section, endpoints, scope))
+			}
+		}
+		result.Specs = append(result.Specs, spec)
+	}
+	return result
+}
+
+// validatePolicies streams the validation of the policies of the custom
+// body against the schemas of the cilium version, offline, along with the
+// existing endpoints and nodes they select. Nothing is created or
+// modified.
+func (h *Handler) validatePolicies(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while validating the Cilium policies"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req policyValidateRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if strings.TrimSpace(req.Manifest) == "" {
+		fail(ErrParseCustomBody(fmt.Errorf("manifest holds no policy")))
+		return
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = defaultSampleNamespace
+	}
+
+	ctx := context.Background()
+	version := req.Version
+	if version == "" && h.KubeClient != nil {
+		if found, err := h.detectCilium(ctx); err == nil && found.Detected {
+			version = found.Version
+		}
+	}
+	schemaVer, err := schemaVersion(version)
+	if err != nil {
+		fail(err)
+		return
+	}
+	report := policyValidationReport{Schema: schemaVer, Policies: []policyValidation{}}
+
+	var endpoints []policyEndpoint
+	nodes := make(map[string]map[string]string)
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		report.Note = "The cluster cannot be reached, the endpoints were not matched."
+	} else if endpoints, err = h.listPolicyEndpoints(ctx); err != nil {
+		report.Note = fmt.Sprintf("The CiliumEndpoints could not be listed, the endpoints were not matched: %s", err)
+		if kerrors.IsNotFound(err) {
+			report.Note = "Cilium is not installed, the endpoints were not matched."
+		}
+	} else if list, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{}); err == nil {
+		for _, node := range list.Items {
+			nodes[node.Name] = node.Labels
+		}
+	}
+
+	objs, failed := policyObjects(req.Manifest)
+	for _, r := range failed {
+		report.Policies = append(report.Policies, policyValidation{Kind: r.Kind, Name: r.Name, Errors: []string{r.Err.Error()}})
+	}
+	schemas := make(map[string]map[string]interface{})
+	for _, obj := range objs {
+		s, ok := schemas[obj.GetKind()]
+		if _, known := policyKinds[obj.GetKind()]; known && !ok {
+			if s, err = offlinePolicySchema(schemaVer, obj.GetKind()); err != nil {
+				fail(err)
+				return
+			}
+			schemas[obj.GetKind()] = s
+		}
+		report.Policies = append(report.Policies, validatePolicyOffline(obj, s, namespace, endpoints, nodes))
+	}
+
+	valid, selected := 0, 0
+	for _, p := range report.Policies {
+		if p.Valid {
+			valid++
+		}
+		for _, spec := range p.Specs {
+			selected += len(spec.Endpoints) + len(spec.Nodes)
+		}
+	}
+	report.Summary = fmt.Sprintf("%d of %d Cilium policies are valid for %s, selecting %d endpoints and nodes", valid, len(report.Policies), schemaVer, selected)
+	byt, err := json.Marshal(report)
+	if err != nil {
+		fail(err)
+		return
+	}
+	e.Summary = report.Summary
+	e.Details = string(byt)
+	h.StreamInfo(e)
+}
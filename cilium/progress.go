@@ -0,0 +1,124 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+// progressPhase is a phase of a long running operation, along with an
+// estimate of how far along the operation is once the phase is done
+type progressPhase struct {
+	name    string
+	summary string
+	percent int
+}
+
+var (
+	phaseVersionResolved  = progressPhase{name: "version-resolved", summary: "Cilium version resolved", percent: 10}
+	phaseChartDownloaded  = progressPhase{name: "chart-downloaded", summary: "Cilium chart downloaded", percent: 20}
+	phaseValuesMerged     = progressPhase{name: "values-merged", summary: "Cilium values merged", percent: 30}
+	phaseManifestsApplied = progressPhase{name: "manifests-applied", summary: "Cilium manifests applied", percent: 60}
+	phaseAgentsReady      = progressPhase{name: "agents-ready", summary: "Cilium agents ready", percent: 85}
+	phasePostChecks       = progressPhase{name: "post-checks", summary: "Cilium post checks done", percent: 100}
+)
+
+// installPhases are the phases of the installs and upgrades, in order
+var installPhases = []progressPhase{
+	phaseVersionResolved,
+	phaseChartDownloaded,
+	phaseValuesMerged,
+	phaseManifestsApplied,
+	phaseAgentsReady,
+	phasePostChecks,
+}
+
+// operationProgress tracks the phases an operation went through, so that
+// its events tell which phase they belong to and how far along it is.
+// A nil operationProgress tracks nothing.
+type operationProgress struct {
+	phases []progressPhase
+
+	// next is the index of the phase in progress, len(phases) once every
+	// phase is done
+	next int
+}
+
+// current returns the phase in progress, the last one once all are done
+func (p *operationProgress) current() progressPhase {
+	if p.next >= len(p.phases) {
+		return p.phases[len(p.phases)-1]
+	}
+	return p.phases[p.next]
+}
+
+// percent returns the estimate of the phases done
+func (p *operationProgress) percent() int {
+	if p.next == 0 {
+		return 0
+	}
+	return p.phases[p.next-1].percent
+}
+
+// complete marks phase, and the phases before it, as done
+func (p *operationProgress) complete(phase progressPhase) {
+	for i := p.next; i < len(p.phases); i++ {
+		if p.phases[i].name == phase.name {
+			p.next = i + 1
+			return
+		}
+	}
+}
+
+// annotate prefixes details with the phase in progress and the percentage
+// done, as a phase=<name> percent=<n> line read by the server to display a
+// timeline of the operation
+func (p *operationProgress) annotate(details string) string {
+	if p == nil {
+		return details
+	}
+	label := fmt.Sprintf("phase=%s percent=%d", p.current().name, p.percent())
+	if details == "" {
+		return label
+	}
+	return label + "\n" + details
+}
+
+// withProgress returns a copy of the handler whose events carry the phase
+// of phases they belong to
+func (h *Handler) withProgress(phases []progressPhase) *Handler {
+	c := *h
+	c.progress = &operationProgress{phases: phases}
+	return &c
+}
+
+// completePhase marks phase as done and streams it, along with details
+func (h *Handler) completePhase(e *adapter.Event, phase progressPhase, details string) {
+	if h.progress == nil {
+		return
+	}
+	h.progress.complete(phase)
+	label := fmt.Sprintf("phase=%s percent=%d", phase.name, phase.percent)
+	if details != "" {
+		label = label + "\n" + details
+	}
+	h.StreamInfo(&adapter.Event{
+		Operationid: e.Operationid,
+		Summary:     fmt.Sprintf("%s (%d%%)", phase.summary, phase.percent),
+		Details:     label,
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	appsv1 "k8s.io/api/apps/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// useChartAgents makes the cilium DaemonSet of h appear once the chart is
+// installed, with as many of its 2 agents ready as ready tells for the
+// release running
+func useChartAgents(h *Handler, ready func(rel *release.Release) int32) {
+	agents := func(a k8stesting.Action) (bool, runtime.Object, error) {
+		rel, err := action.NewGet(h.helmConfig).Run(config.HelmChartName)
+		if err != nil {
+			if a.GetVerb() == "list" {
+				return true, &appsv1.DaemonSetList{}, nil
+			}
+			return true, nil, kerrors.NewNotFound(appsv1.Resource("daemonsets"), agentDaemonSet)
+		}
+		ds := agentDaemonSetObject(2, ready(rel))
+		if a.GetVerb() == "list" {
+			return true, &appsv1.DaemonSetList{Items: []appsv1.DaemonSet{*ds}}, nil
+		}
+		return true, ds, nil
+	}
+	client := h.typedClient.(*fake.Clientset)
+	client.PrependReactor("get", "daemonsets", agents)
+	client.PrependReactor("list", "daemonsets", agents)
+}
+
+// newChartHandler returns a handler installing the charts of versions on
+// a fake cluster whose agents become ready as ready tells, along with the
+// clock of its readiness checks and the channel of its events
+func newChartHandler(t *testing.T, ready func(rel *release.Release) int32, versions ...string) (*Handler, *fakeClock, chan interface{}) {
+	t.Helper()
+	h, events := newTestHandler(t, operatorDeploymentObject(1, 1))
+	useTestHelm(t, h, "kube-system", versions...)
+	useMeshConfig(t, h)
+	useChartAgents(h, ready)
+	clock := &fakeClock{}
+	h.poll = clock.poll
+	return h, clock, events
+}
+
+// installWithChart runs the install of request on a cluster whose agents
+// become ready as ready tells, and returns the events streamed along the way
+func installWithChart(t *testing.T, request string, ready int32) []*adapter.Event {
+	t.Helper()
+	h, _, events := newChartHandler(t, func(*release.Release) int32 { return ready }, "1.14.5")
+	runInstall(t, h, request)
+	return streamedEvents(events)
+}
+
+// runInstall runs the install of request with h
+func runInstall(t *testing.T, h *Handler, request string) {
+	t.Helper()
+	req, err := parseInstallRequest(request)
+	if err != nil {
+		t.Fatalf("parseInstallRequest: %v", err)
+	}
+	h.install([]adapter.Version{"1.14.5"}, req, false, &adapter.Event{Operationid: "install"})
+}
+
+// streamedEvents returns the events streamed so far
+func streamedEvents(events chan interface{}) []*adapter.Event {
+	var streamed []*adapter.Event
+	for {
+		select {
+		case e := <-events:
+			streamed = append(streamed, e.(*adapter.Event))
+		default:
+			return streamed
+		}
+	}
+}
+
+// completedPhases returns the phase=<name> percent=<n> labels of the events
+// which mark a phase as done
+func completedPhases(events []*adapter.Event) []string {
+	var labels []string
+	for _, e := range events {
+		if strings.HasSuffix(e.Summary, "%)") {
+			labels = append(labels, strings.SplitN(e.Details, "\n", 2)[0])
+		}
+	}
+	return labels
+}
+
+func phaseLabels(phases ...progressPhase) []string {
+	labels := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		labels = append(labels, fmt.Sprintf("phase=%s percent=%d", phase.name, phase.percent))
+	}
+	return labels
+}
+
+func TestInstallProgress(t *testing.T) {
+	events := installWithChart(t, "namespace: kube-system\nskipCompatibilityCheck: true\ntimeout: 1s\n", 2)
+
+	got, want := completedPhases(events), phaseLabels(installPhases...)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("completed phases:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	last := events[len(events)-1]
+	if last.EType != 0 || !strings.Contains(last.Summary, "successfully") {
+		t.Errorf("the install ends with %q (type %d), want a success", last.Summary, last.EType)
+	}
+}
+
+func TestInstallProgressFailingPhase(t *testing.T) {
+	events := installWithChart(t, "namespace: kube-system\nskipCompatibilityCheck: true\ntimeout: 10m\n", 0)
+
+	got, want := completedPhases(events), phaseLabels(phaseVersionResolved, phaseChartDownloaded, phaseValuesMerged, phaseManifestsApplied)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("completed phases:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	last := events[len(events)-1]
+	if last.EType != 2 {
+		t.Fatalf("the install ends with %q (type %d), want an error", last.Summary, last.EType)
+	}
+	// The error belongs to the phase in progress, after the last one done
+	label := fmt.Sprintf("phase=%s percent=%d", phaseAgentsReady.name, phaseManifestsApplied.percent)
+	if !strings.HasPrefix(last.Details, label+"\n") {
+		t.Errorf("the error details %q are not annotated with %q", last.Details, label)
+	}
+}
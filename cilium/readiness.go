@@ -0,0 +1,195 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// operatorDeployment is the Deployment of the cilium operator
+	operatorDeployment = "cilium-operator"
+
+	// agentLogLines is how many of the last log lines of a non-ready agent
+	// are reported when cilium does not become ready
+	agentLogLines = 20
+)
+
+// ciliumNodeResource is the resource of the CiliumNodes, one per node
+// managed by cilium
+var ciliumNodeResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2", Resource: "ciliumnodes"}
+
+// readinessOptions tune what the install and upgrade wait for before
+// reporting success. They are part of the custom body of the install and
+// upgrade requests.
+type readinessOptions struct {
+	// WaitForNodes also waits for every node to be managed by cilium: to
+	// have its CiliumNode and to report its network as available
+	WaitForNodes bool `yaml:"waitForNodes"`
+}
+
+// waitForCilium waits for cilium to be functional in namespace: every
+// agent updated and ready, the operator available and, if nodes is set,
+// every node managed by cilium. The progress is streamed as events. When
+// cilium does not become ready, the problems of the agent pods and the
+// last log lines of a non-ready agent are added to the error.
+func (h *Handler) waitForCilium(e *adapter.Event, namespace string, timeout time.Duration, nodes bool) error {
+	if h.kubeClient() == nil {
+		return ErrNilClient
+	}
+	err := h.waitForAgents(e, namespace, timeout)
+	if err == nil {
+		if err = h.waitForOperator(e, namespace, timeout); err != nil {
+			err = fmt.Errorf("the %s Deployment is not available: %w", operatorDeployment, err)
+			if problems := h.podProblems(namespace, "io.cilium/app=operator"); len(problems) > 0 {
+				err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+			}
+		}
+	}
+	if err == nil && nodes {
+		err = h.waitForCiliumNodes(e, timeout)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if problems := h.podProblems(namespace, agentSelector); len(problems) > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+	}
+	if logs := h.agentLogs(namespace); logs != "" {
+		err = fmt.Errorf("%w\n%s", err, logs)
+	}
+	return err
+}
+
+// pollReady is wait.PollImmediate for the waits for cilium to become ready,
+// through the poll hook of the handler if it is set
+func (h *Handler) pollReady(interval, timeout time.Duration, condition wait.ConditionFunc) error {
+	if h.poll != nil {
+		return h.poll(interval, timeout, condition)
+	}
+	return wait.PollImmediate(interval, timeout, condition)
+}
+
+// waitForCiliumNodes waits for every node to have its CiliumNode and to
+// report that cilium made its network available
+func (h *Handler) waitForCiliumNodes(e *adapter.Event, timeout time.Duration) error {
+	if h.DynamicKubeClient == nil {
+		return ErrNilClient
+	}
+	n := -1
+	var pending []string
+	err := h.pollReady(rolloutPollInterval, timeout, func() (bool, error) {
+		ctx := context.Background()
+		nodes, err := h.kubeClient().CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		ciliumNodes, err := h.DynamicKubeClient.Resource(ciliumNodeResource).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, nil
+		}
+		managed := make(map[string]bool, len(ciliumNodes.Items))
+		for _, cn := range ciliumNodes.Items {
+			managed[cn.GetName()] = true
+		}
+
+		pending = pending[:0]
+		for _, node := range nodes.Items {
+			if !managed[node.Name] || !networkAvailable(node) {
+				pending = append(pending, node.Name)
+			}
+		}
+		if ready := len(nodes.Items) - len(pending); ready != n {
+			n = ready
+			h.streamProgress(e, "Waiting for the nodes to be managed by Cilium", fmt.Sprintf("%d/%d nodes ready", ready, len(nodes.Items)))
+		}
+		return len(pending) == 0, nil
+	})
+	if err != nil {
+		return fmt.Errorf("the nodes %s are not ready: %w", strings.Join(pending, ", "), err)
+	}
+	return nil
+}
+
+// networkAvailable reports whether the network of node is not reported as
+// unavailable, which cilium clears once its agent runs on the node
+func networkAvailable(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeNetworkUnavailable {
+			return condition.Status == corev1.ConditionFalse
+		}
+	}
+	return true
+}
+
+// agentLogs returns the last log lines of the first non-ready agent of
+// namespace, from its previous run if it restarted, or nothing if every
+// agent is ready
+func (h *Handler) agentLogs(namespace string) string {
+	ctx := context.Background()
+	pods, err := h.kubeClient().CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return ""
+	}
+	lines := int64(agentLogLines)
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != agentContainer || status.Ready {
+				continue
+			}
+			opts := &corev1.PodLogOptions{Container: agentContainer, TailLines: &lines, Previous: status.RestartCount > 0}
+			logs, err := h.kubeClient().CoreV1().Pods(namespace).GetLogs(pod.Name, opts).DoRaw(ctx)
+			if err != nil || len(logs) == 0 {
+				continue
+			}
+			return fmt.Sprintf("Last logs of %s:\n%s", pod.Name, strings.TrimRight(string(logs), "\n"))
+		}
+	}
+	return ""
+}
+
+// waitForOperator waits for every replica the operator Deployment of
+// namespace requests to be updated and available, streaming how many are
+func (h *Handler) waitForOperator(e *adapter.Event, namespace string, timeout time.Duration) error {
+	available := int32(-1)
+	h.streamProgress(e, "Waiting for the Cilium operator to become available", "")
+	return h.pollReady(rolloutPollInterval, timeout, func() (bool, error) {
+		deploy, err := h.kubeClient().AppsV1().Deployments(namespace).Get(context.Background(), operatorDeployment, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		desired := int32(1)
+		if deploy.Spec.Replicas != nil {
+			desired = *deploy.Spec.Replicas
+		}
+		if deploy.Status.AvailableReplicas != available {
+			available = deploy.Status.AvailableReplicas
+			h.streamProgress(e, "Waiting for the Cilium operator to become available", fmt.Sprintf("%d/%d replicas available", available, desired))
+		}
+		return deploy.Status.ObservedGeneration >= deploy.Generation &&
+			deploy.Status.UpdatedReplicas == desired &&
+			deploy.Status.AvailableReplicas == desired, nil
+	})
+}
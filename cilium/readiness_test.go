@@ -0,0 +1,251 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshkit/logger"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestHandler returns a handler acting on a fake cluster holding objs,
+// and the channel its events are streamed to
+func newTestHandler(t *testing.T, objs ...runtime.Object) (*Handler, chan interface{}) {
+	t.Helper()
+	log, err := logger.New("test", logger.Options{Output: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("logger: %v", err)
+	}
+	events := make(chan interface{}, 100)
+	h := &Handler{
+		Adapter:     adapter.Adapter{Log: log, Channel: &events},
+		typedClient: fake.NewSimpleClientset(objs...),
+	}
+	return h, events
+}
+
+// eventDetails returns the details of the events streamed so far
+func eventDetails(events chan interface{}) []string {
+	var details []string
+	for {
+		select {
+		case e := <-events:
+			details = append(details, e.(*adapter.Event).Details)
+		default:
+			return details
+		}
+	}
+}
+
+// fakeClock runs the readiness polls without sleeping, its time moving by
+// the poll interval at every check
+type fakeClock struct {
+	elapsed time.Duration
+}
+
+func (c *fakeClock) poll(interval, timeout time.Duration, condition wait.ConditionFunc) error {
+	for start := c.elapsed; c.elapsed-start <= timeout; c.elapsed += interval {
+		if done, err := condition(); err != nil || done {
+			return err
+		}
+	}
+	return wait.ErrWaitTimeout
+}
+
+func agentDaemonSetObject(desired, ready int32) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: agentDaemonSet, Namespace: "kube-system"},
+		Status: appsv1.DaemonSetStatus{
+			DesiredNumberScheduled: desired,
+			UpdatedNumberScheduled: desired,
+			NumberReady:            ready,
+			NumberAvailable:        ready,
+		},
+	}
+}
+
+func operatorDeploymentObject(replicas, available int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: operatorDeployment, Namespace: "kube-system"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{UpdatedReplicas: replicas, AvailableReplicas: available},
+	}
+}
+
+func podObject(name string, labels map[string]string, container string, status corev1.ContainerStatus) *corev1.Pod {
+	status.Name = container
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kube-system", Labels: labels},
+		Status:     corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{status}},
+	}
+}
+
+func nodeObject(name string, networkUnavailable bool) *corev1.Node {
+	status := corev1.ConditionFalse
+	if networkUnavailable {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeNetworkUnavailable, Status: status}}},
+	}
+}
+
+func ciliumNodeObject(name string) *unstructured.Unstructured {
+	cn := &unstructured.Unstructured{}
+	cn.SetAPIVersion(ciliumGroup + "/v2")
+	cn.SetKind("CiliumNode")
+	cn.SetName(name)
+	return cn
+}
+
+func TestWaitForCilium(t *testing.T) {
+	h, events := newTestHandler(t, agentDaemonSetObject(2, 2), operatorDeploymentObject(1, 1))
+	if err := h.waitForCilium(&adapter.Event{}, "kube-system", time.Second, false); err != nil {
+		t.Fatalf("waitForCilium: %v", err)
+	}
+	details := strings.Join(eventDetails(events), "\n")
+	for _, want := range []string{"2/2 agents ready, 2 updated", "1/1 replicas available"} {
+		if !strings.Contains(details, want) {
+			t.Errorf("progress %q does not report %q", details, want)
+		}
+	}
+}
+
+func TestWaitForCiliumAgentsNotReady(t *testing.T) {
+	crashing := corev1.ContainerStatus{
+		RestartCount: 3,
+		State:        corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off restarting"}},
+	}
+	h, _ := newTestHandler(t,
+		agentDaemonSetObject(2, 1),
+		operatorDeploymentObject(1, 1),
+		podObject("cilium-x7k2p", map[string]string{"k8s-app": "cilium"}, agentContainer, corev1.ContainerStatus{Ready: true}),
+		podObject("cilium-q9r4m", map[string]string{"k8s-app": "cilium"}, agentContainer, crashing),
+	)
+	err := h.waitForCilium(&adapter.Event{}, "kube-system", 10*time.Millisecond, false)
+	if err == nil {
+		t.Fatal("waitForCilium succeeded with an agent not ready")
+	}
+	for _, want := range []string{"cilium-q9r4m/cilium-agent: CrashLoopBackOff back-off restarting", "Last logs of cilium-q9r4m:\nfake logs"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "cilium-x7k2p") {
+		t.Errorf("error %q reports the ready agent", err)
+	}
+}
+
+func TestWaitForCiliumOperatorNotAvailable(t *testing.T) {
+	pending := corev1.ContainerStatus{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}
+	h, events := newTestHandler(t,
+		agentDaemonSetObject(1, 1),
+		operatorDeploymentObject(2, 1),
+		podObject("cilium-operator-a", operatorLabels, "cilium-operator", pending),
+	)
+	err := h.waitForCilium(&adapter.Event{}, "kube-system", 10*time.Millisecond, false)
+	if err == nil {
+		t.Fatal("waitForCilium succeeded with the operator not available")
+	}
+	for _, want := range []string{"the cilium-operator Deployment is not available", "cilium-operator-a/cilium-operator: ImagePullBackOff"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+	if details := strings.Join(eventDetails(events), "\n"); !strings.Contains(details, "1/2 replicas available") {
+		t.Errorf("progress %q does not report the available replicas", details)
+	}
+}
+
+func TestWaitForCiliumNodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		nodes       []runtime.Object
+		ciliumNodes []runtime.Object
+		pending     string
+	}{
+		{
+			name:        "managed",
+			nodes:       []runtime.Object{nodeObject("node-a", false), nodeObject("node-b", false)},
+			ciliumNodes: []runtime.Object{ciliumNodeObject("node-a"), ciliumNodeObject("node-b")},
+		},
+		{
+			name:        "missing CiliumNode",
+			nodes:       []runtime.Object{nodeObject("node-a", false), nodeObject("node-b", false)},
+			ciliumNodes: []runtime.Object{ciliumNodeObject("node-a")},
+			pending:     "node-b",
+		},
+		{
+			name:        "network unavailable",
+			nodes:       []runtime.Object{nodeObject("node-a", true), nodeObject("node-b", false)},
+			ciliumNodes: []runtime.Object{ciliumNodeObject("node-a"), ciliumNodeObject("node-b")},
+			pending:     "node-a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := append([]runtime.Object{agentDaemonSetObject(2, 2), operatorDeploymentObject(1, 1)}, tt.nodes...)
+			h, _ := newTestHandler(t, objs...)
+			h.DynamicKubeClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{ciliumNodeResource: "CiliumNodeList"}, tt.ciliumNodes...)
+
+			err := h.waitForCilium(&adapter.Event{}, "kube-system", 10*time.Millisecond, true)
+			if tt.pending == "" {
+				if err != nil {
+					t.Fatalf("waitForCilium: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "the nodes "+tt.pending+" are not ready") {
+				t.Errorf("error = %v, want %s not ready", err, tt.pending)
+			}
+		})
+	}
+}
+
+func TestWaitForCiliumNilClient(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.typedClient = nil
+	if err := h.waitForCilium(&adapter.Event{}, "kube-system", time.Second, false); err != ErrNilClient {
+		t.Errorf("error = %v, want ErrNilClient", err)
+	}
+}
+
+func TestWaitForCiliumTimeout(t *testing.T) {
+	h, _ := newTestHandler(t, agentDaemonSetObject(2, 1), operatorDeploymentObject(1, 1))
+	clock := &fakeClock{}
+	h.poll = clock.poll
+	err := h.waitForCilium(&adapter.Event{}, "kube-system", 10*time.Minute, false)
+	if err == nil || !strings.Contains(err.Error(), wait.ErrWaitTimeout.Error()) {
+		t.Fatalf("error = %v, want a timeout", err)
+	}
+	if clock.elapsed <= 10*time.Minute {
+		t.Errorf("gave up after %s, before the timeout", clock.elapsed)
+	}
+}
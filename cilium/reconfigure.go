@@ -0,0 +1,90 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+)
+
+// reconfigure upgrades the cilium release of namespace in place, keeping
+// its version and merging the values valuesFor returns for that version
+// over the values it was installed with, then waits for cilium to become
+// ready. It returns the version of the release, and once the release was
+// modified, rollback moving it back to its previous revision for when the
+// new configuration fails, including the checks of the caller.
+func (h *Handler) reconfigure(e *adapter.Event, namespace string, timeout time.Duration, valuesFor func(version string) (map[string]interface{}, error)) (version string, rollback func(), err error) {
+	actionConfig, err := h.helmActionConfig(namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	rel, err := action.NewGet(actionConfig).Run(config.HelmChartName)
+	if err != nil {
+		return "", nil, fmt.Errorf("cilium is not installed as the %q helm release: %w", config.HelmChartName, err)
+	}
+	version = rel.Chart.Metadata.Version
+
+	previous, err := action.NewGetValues(actionConfig).Run(config.HelmChartName)
+	if err != nil {
+		return version, nil, err
+	}
+	values, err := valuesFor(version)
+	if err != nil {
+		return version, nil, err
+	}
+	values = mergeValues(previous, values)
+	if err := checkIPAM(values); err != nil {
+		return version, nil, err
+	}
+	ch, err := h.loadChart(version)
+	if err != nil {
+		return version, nil, err
+	}
+
+	rollback = func() {
+		h.rollbackUpgrade(e, actionConfig, rel.Version, version, namespace, timeout)
+	}
+	h.streamProgress(e, "Reconfiguring the Cilium helm release", fmt.Sprintf("Upgrading Cilium %s in place", version))
+	upgrade := action.NewUpgrade(actionConfig)
+	upgrade.Namespace = namespace
+	upgrade.Timeout = timeout
+	if _, err := upgrade.Run(config.HelmChartName, ch, values); err != nil {
+		return version, rollback, err
+	}
+
+	h.streamProgress(e, "Waiting for Cilium to become ready", "")
+	if err := h.waitForCilium(e, namespace, timeout, false); err != nil {
+		return version, rollback, err
+	}
+	return version, rollback, nil
+}
+
+// releaseValues returns the version of the cilium release of namespace and
+// the values it was installed with
+func (h *Handler) releaseValues(namespace string) (string, map[string]interface{}, error) {
+	actionConfig, err := h.helmActionConfig(namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	rel, err := action.NewGet(actionConfig).Run(config.HelmChartName)
+	if err != nil {
+		return "", nil, fmt.Errorf("cilium is not installed as the %q helm release: %w", config.HelmChartName, err)
+	}
+	return rel.Chart.Metadata.Version, rel.Config, nil
+}
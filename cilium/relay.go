@@ -0,0 +1,180 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// relayDeployment is the Deployment and the service of hubble relay
+	relayDeployment = "hubble-relay"
+
+	// hubbleServerSecret and relayClientSecret are the certificates of the
+	// hubble servers and of the relay connecting to them
+	hubbleServerSecret = "hubble-server-certs"
+	relayClientSecret  = "hubble-relay-client-certs"
+)
+
+// The ways the certificates of hubble are provided
+const (
+	relayTLSHelm        = "helm"
+	relayTLSCertManager = "certmanager"
+	relayTLSSecret      = "secret"
+)
+
+// relayRequest holds the parameters of the hubble relay operation, read
+// from the custom body of the request
+type relayRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	hubbleTLSOptions `yaml:",inline"`
+
+	// Timeout bounds the rollout of the relay, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the
+	// relay does not become ready, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// values translates the request into chart values, relying on the
+// certificates of the TLS mode
+func (r relayRequest) values() (map[string]interface{}, error) {
+	tls, err := r.hubbleTLSOptions.values()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"hubble": map[string]interface{}{
+			"enabled": true,
+			"relay":   map[string]interface{}{"enabled": true},
+			"tls":     tls,
+		},
+	}, nil
+}
+
+// waitForRelay waits for the relay Deployment of namespace to be available
+// and for its service to have ready endpoints. The readiness probe of the
+// relay is a gRPC health check, so an available relay serves gRPC.
+func (h *Handler) waitForRelay(e *adapter.Event, namespace string, timeout time.Duration) error {
+	err := h.waitForDeployment(namespace, relayDeployment, timeout)
+	if err != nil {
+		if problems := h.podProblems(namespace, "k8s-app="+relayDeployment); len(problems) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+		}
+		return fmt.Errorf("the %s Deployment is not available: %w", relayDeployment, err)
+	}
+
+	h.streamProgress(e, "Checking the Hubble Relay service", "")
+	endpoints, err := h.KubeClient.CoreV1().Endpoints(namespace).Get(context.Background(), relayDeployment, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("the %s service has no ready endpoints", relayDeployment)
+}
+
+// relay installs, or removes if del is set, hubble relay on top of the
+// installed release. Removing the relay keeps hubble and cilium running.
+func (h *Handler) relay(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring Hubble Relay"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req relayRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	relayValues, err := req.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if del {
+		relayValues = map[string]interface{}{
+			"hubble": map[string]interface{}{
+				"relay": map[string]interface{}{"enabled": false},
+			},
+		}
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	var tlsDetails string
+	if !del {
+		if tlsDetails, err = h.prepareHubbleTLS(context.Background(), namespace, req.hubbleTLSOptions, hubbleServerSecret, relayClientSecret); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	version, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+		return relayValues, nil
+	})
+	if err == nil && !del {
+		h.streamProgress(e, "Waiting for Hubble Relay to become ready", "")
+		err = h.waitForRelay(e, namespace, timeout)
+	}
+	if err != nil {
+		fail(ErrConfigureHubbleRelay(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+
+	if del {
+		e.Summary = "Hubble Relay removed successfully"
+		e.Details = fmt.Sprintf("Hubble Relay no longer runs, Cilium %s and Hubble are untouched.", version)
+	} else {
+		e.Summary = "Hubble Relay installed successfully"
+		e.Details = fmt.Sprintf("Hubble Relay serves the flows of every node through the %s/%s service.", namespace, relayDeployment)
+		if tlsDetails != "" {
+			e.Details = fmt.Sprintf("%s\n%s", e.Details, tlsDetails)
+		}
+	}
+	h.StreamInfo(e)
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/releaseutil"
+)
+
+// clusterScope stands for the namespace of cluster scoped resources in the
+// summary of a render
+const clusterScope = "(cluster)"
+
+// renderChart renders the manifests the cilium chart of version would
+// apply with values, without touching the cluster. The chart is resolved and
+// named the same way as for a real install. The cluster is only asked for
+// its kubernetes version, the default capabilities of helm are used when
+// it cannot be reached.
+func (h *Handler) renderChart(version, namespace string, values map[string]interface{}) (string, error) {
+	ch, err := h.loadChart(version)
+	if err != nil {
+		return "", err
+	}
+
+	install := action.NewInstall(&action.Configuration{
+		Log: func(format string, v ...interface{}) {
+			h.Log.Debug(fmt.Sprintf(format, v...))
+		},
+	})
+	install.ReleaseName = config.HelmChartName
+	install.Namespace = namespace
+	install.DryRun = true
+	install.ClientOnly = true
+	install.Replace = true
+	install.IncludeCRDs = true
+	if h.KubeClient != nil {
+		if serverVersion, err := h.KubeClient.Discovery().ServerVersion(); err == nil {
+			if kubeVersion, err := chartutil.ParseKubeVersion(serverVersion.GitVersion); err == nil {
+				install.KubeVersion = kubeVersion
+			}
+		}
+	}
+
+	rel, err := install.Run(ch, values)
+	if err != nil {
+		return "", err
+	}
+	return rel.Manifest, nil
+}
+
+// summarizeManifest counts the resources of a multi-document manifest by
+// kind and namespace, one line per kind and namespace, along with their total
+func summarizeManifest(manifest string) ([]string, int) {
+	type key struct{ kind, namespace string }
+	counts := make(map[key]int)
+	for _, doc := range releaseutil.SplitManifests(manifest) {
+		var obj struct {
+			Kind     string `yaml:"kind"`
+			Metadata struct {
+				Namespace string `yaml:"namespace"`
+			} `yaml:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil || obj.Kind == "" {
+			continue
+		}
+		namespace := obj.Metadata.Namespace
+		if namespace == "" {
+			namespace = clusterScope
+		}
+		counts[key{obj.Kind, namespace}]++
+	}
+
+	lines := make([]string, 0, len(counts))
+	total := 0
+	for k, n := range counts {
+		lines = append(lines, fmt.Sprintf("%s in %s: %d", k.kind, k.namespace, n))
+		total += n
+	}
+	sort.Strings(lines)
+	return lines, total
+}
+
+// streamDryRun reports the manifests which would have been applied, along
+// with a summary of their resources
+func (h *Handler) streamDryRun(e *adapter.Event, version, namespace string, values map[string]interface{}) {
+	manifest, err := h.renderChart(version, namespace, values)
+	if err != nil {
+		err = ErrRenderChart(err)
+		e.Summary = "Error while rendering the Cilium chart"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+	h.streamManifest(e, version, values, manifest)
+}
+
+// streamManifest reports manifest, rendered for version with values,
+// along with a summary of its resources
+func (h *Handler) streamManifest(e *adapter.Event, version string, values map[string]interface{}, manifest string) {
+	summary, total := summarizeManifest(manifest)
+	e.Summary = fmt.Sprintf("Dry run: Cilium %s would apply %d resources", version, total)
+	e.Details = fmt.Sprintf("IPAM mode: %s\n\n%s\n\nRouting:\n%s\nImages:\n%s\n\nPlacement:\n%s\n%s", ipamMode(values), strings.Join(summary, "\n"), routingValues(values), strings.Join(manifestImages(manifest), "\n"), manifestPlacement(manifest), manifest)
+	h.StreamInfo(e)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// validateLabels fails unless labels are valid label keys and values
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("label key %q: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("label value %q: %s", value, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// labelSelector returns the selector matching labels, as found in the
+// specs of the cilium resources
+func labelSelector(labels map[string]string) map[string]interface{} {
+	matchLabels := make(map[string]interface{}, len(labels))
+	for key, value := range labels {
+		matchLabels[key] = value
+	}
+	return map[string]interface{}{"matchLabels": matchLabels}
+}
+
+// waitForCRD waits for the operator to register the CRD of resource
+func (h *Handler) waitForCRD(ctx context.Context, resource schema.GroupVersionResource, timeout time.Duration) error {
+	name := fmt.Sprintf("%s.%s", resource.Resource, resource.Group)
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		_, err := h.DynamicKubeClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{})
+		return err == nil, nil
+	})
+}
+
+// applyResource creates obj of resource, in its namespace if it has one, or
+// replaces the spec of the existing one, and tells which one it did
+func (h *Handler) applyResource(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured) (string, error) {
+	var client dynamic.ResourceInterface = h.DynamicKubeClient.Resource(resource)
+	if namespace := obj.GetNamespace(); namespace != "" {
+		client = h.DynamicKubeClient.Resource(resource).Namespace(namespace)
+	}
+	existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		_, err = client.Create(ctx, obj, metav1.CreateOptions{})
+		return "created", err
+	case err != nil:
+		return "", err
+	}
+	existing.Object["spec"] = obj.Object["spec"]
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return "updated", err
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+)
+
+// releaseExists reports whether the cilium helm release is installed, so
+// that a failed install only rolls back a release it created itself
+func (h *Handler) releaseExists(namespace string) bool {
+	actionConfig, err := h.helmActionConfig(namespace)
+	if err != nil {
+		return false
+	}
+	_, err = action.NewGet(actionConfig).Run(config.HelmChartName)
+	return err == nil
+}
+
+// rollbackInstall removes the release of a failed install. Its outcome is
+// reported on its own, after the failure of the install.
+func (h *Handler) rollbackInstall(e *adapter.Event, version, namespace string) {
+	h.streamProgress(e, "Rolling back the Cilium install", "Uninstalling the release whose agents did not become ready")
+	inventory, err := h.readInventory(context.Background(), namespace)
+	if err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	if inventory != nil {
+		err = h.removeManifests(context.Background(), namespace, inventory)
+	} else {
+		err = h.applyHelmChart(true, version, namespace, nil)
+	}
+	if err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	h.streamProgress(e, "Cilium install rolled back", "The release was uninstalled, the cluster is back to its state before the install")
+}
+
+// rollbackUpgrade moves the release of a failed upgrade back to revision
+// and waits for the agents of the version they ran before to recover. Its
+// outcome is reported on its own, after the failure of the upgrade.
+func (h *Handler) rollbackUpgrade(e *adapter.Event, actionConfig *action.Configuration, revision int, version, namespace string, timeout time.Duration) {
+	h.streamProgress(e, "Rolling back the Cilium upgrade", fmt.Sprintf("Rolling back to revision %d running %s", revision, version))
+	rollback := action.NewRollback(actionConfig)
+	rollback.Version = revision
+	rollback.Timeout = timeout
+	if err := rollback.Run(config.HelmChartName); err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	if err := h.waitForAgents(e, namespace, timeout); err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	h.streamProgress(e, "Cilium upgrade rolled back", fmt.Sprintf("Cilium %s is running again", version))
+}
+
+// rollbackManifestUpgrade applies the manifests of the manifest install
+// recorded in previous again, pruning what the failed upgrade added, and
+// waits for the agents of the version they ran before to recover
+func (h *Handler) rollbackManifestUpgrade(e *adapter.Event, previous *manifestInventory, namespace string, timeout time.Duration) {
+	h.streamProgress(e, "Rolling back the Cilium upgrade", fmt.Sprintf("Applying the manifests of %s again", previous.Version))
+	ctx := context.Background()
+	applied, err := h.readInventory(ctx, namespace)
+	if err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	if applied == nil {
+		applied = previous
+	}
+	if _, err := h.applyManifests(ctx, previous.Version, namespace, previous.Source, previous.Values, applied); err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	if err := h.waitForAgents(e, namespace, timeout); err != nil {
+		h.streamRollbackErr(e, err)
+		return
+	}
+	h.streamProgress(e, "Cilium upgrade rolled back", fmt.Sprintf("Cilium %s is running again", previous.Version))
+}
+
+func (h *Handler) streamRollbackErr(e *adapter.Event, err error) {
+	err = ErrRollbackCilium(err)
+	h.StreamErr(&adapter.Event{
+		Operationid: e.Operationid,
+		Summary:     "Error while rolling back Cilium",
+		Details:     err.Error(),
+	}, err)
+}
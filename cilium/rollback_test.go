@@ -0,0 +1,98 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// summaries returns the summaries of events
+func summaries(events []*adapter.Event) string {
+	var s []string
+	for _, e := range events {
+		s = append(s, e.Summary)
+	}
+	return strings.Join(s, "\n")
+}
+
+func TestInstallRollback(t *testing.T) {
+	h, clock, events := newChartHandler(t, func(*release.Release) int32 { return 0 }, "1.14.5")
+	runInstall(t, h, "namespace: kube-system\nskipCompatibilityCheck: true\nrollback: true\ntimeout: 10m\n")
+
+	if clock.elapsed <= 10*time.Minute {
+		t.Errorf("the agents were waited for %s, less than the timeout", clock.elapsed)
+	}
+	streamed := summaries(streamedEvents(events))
+	for _, want := range []string{"Cilium agents did not become ready", "Cilium install rolled back"} {
+		if !strings.Contains(streamed, want) {
+			t.Errorf("events %q do not report %q", streamed, want)
+		}
+	}
+	if h.releaseExists("kube-system") {
+		t.Error("the release of the failed install is still installed")
+	}
+}
+
+func TestUpgradeRollback(t *testing.T) {
+	// The agents of 1.14.6 never become ready, the ones of 1.14.5 do
+	h, clock, events := newChartHandler(t, func(rel *release.Release) int32 {
+		if rel.Chart.Metadata.Version == config.ChartVersion("1.14.6") {
+			return 0
+		}
+		return 2
+	}, "1.14.5", "1.14.6")
+	values, err := withDefaultValues(nil)
+	if err != nil {
+		t.Fatalf("withDefaultValues: %v", err)
+	}
+	if err := h.applyHelmChart(false, "1.14.5", "kube-system", values); err != nil {
+		t.Fatalf("installing 1.14.5: %v", err)
+	}
+
+	h.upgrade("1.14.6", "version: 1.14.6\nnamespace: kube-system\nskipCompatibilityCheck: true\ntimeout: 10m\n", &adapter.Event{Operationid: "upgrade"})
+
+	if clock.elapsed <= 10*time.Minute {
+		t.Errorf("the agents were waited for %s, less than the timeout", clock.elapsed)
+	}
+	upgraded := streamedEvents(events)
+	streamed := summaries(upgraded)
+	for _, want := range []string{"Error while upgrading Cilium", "Cilium upgrade rolled back"} {
+		if !strings.Contains(streamed, want) {
+			t.Errorf("events %q do not report %q", streamed, want)
+		}
+	}
+	// The rollback goes to the revision installed before the upgrade
+	rolledBack := false
+	for _, e := range upgraded {
+		rolledBack = rolledBack || strings.Contains(e.Details, "Rolling back to revision 1 running 1.14.5")
+	}
+	if !rolledBack {
+		t.Error("the upgrade was not rolled back to revision 1")
+	}
+	rel, err := action.NewGet(h.helmConfig).Run(config.HelmChartName)
+	if err != nil {
+		t.Fatalf("getting the release: %v", err)
+	}
+	if version := rel.Chart.Metadata.Version; version != config.ChartVersion("1.14.5") || rel.Version != 3 {
+		t.Errorf("revision %d runs %s, want revision 3 rolled back to 1.14.5", rel.Version, version)
+	}
+}
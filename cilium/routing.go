@@ -0,0 +1,320 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	routingVXLAN  = "vxlan"
+	routingGeneve = "geneve"
+	routingNative = "native"
+
+	// defaultClusterPoolCIDR is the CIDR the cluster pool allocates from
+	// unless the request gives others
+	defaultClusterPoolCIDR = "10.0.0.0/8"
+)
+
+var (
+	// routingModeSince is the first version splitting tunnel into
+	// routingMode and tunnelProtocol
+	routingModeSince = semver.MustParse("1.14.0")
+
+	// ipv4NativeRoutingCIDRSince is the first version naming the native
+	// routing CIDR ipv4NativeRoutingCIDR rather than nativeRoutingCIDR
+	ipv4NativeRoutingCIDRSince = semver.MustParse("1.10.0")
+
+	// ipv6NativeRoutingCIDRSince is the first version taking an IPv6
+	// native routing CIDR
+	ipv6NativeRoutingCIDRSince = semver.MustParse("1.11.0")
+)
+
+// routingValueKeys are the chart values the routing options set, shown in
+// the dry runs
+var routingValueKeys = []string{
+	"routingMode", "tunnel", "tunnelProtocol",
+	"nativeRoutingCIDR", "ipv4NativeRoutingCIDR", "ipv6NativeRoutingCIDR",
+	"autoDirectNodeRoutes", "enableIPv4Masquerade", "enableIPv6Masquerade",
+}
+
+// routingOptions selects how the traffic between the nodes is carried.
+// They are part of the custom body of the install requests.
+type routingOptions struct {
+	// RoutingMode is vxlan or geneve to encapsulate the traffic, or native
+	// to route it through the network of the nodes
+	RoutingMode string `yaml:"routingMode"`
+
+	// NativeRoutingCIDR is the IPv4 CIDR in which native routing is done,
+	// which must contain the pod CIDRs. IPv4NativeRoutingCIDR is the same
+	// under the name of the chart.
+	NativeRoutingCIDR     string `yaml:"nativeRoutingCIDR"`
+	IPv4NativeRoutingCIDR string `yaml:"ipv4NativeRoutingCIDR"`
+
+	// IPv6NativeRoutingCIDR is the IPv6 CIDR in which native routing is
+	// done
+	IPv6NativeRoutingCIDR string `yaml:"ipv6NativeRoutingCIDR"`
+
+	// AutoDirectNodeRoutes installs routes to the pod CIDRs of the other
+	// nodes, for nodes sharing an L2 network
+	AutoDirectNodeRoutes bool `yaml:"autoDirectNodeRoutes"`
+
+	// Masquerade and IPv6Masquerade masquerade the traffic of the pods
+	// leaving the native routing CIDR, which the chart does for IPv4 by
+	// default. BPFMasquerade masquerades in eBPF rather than iptables.
+	Masquerade     *bool `yaml:"masquerade"`
+	IPv6Masquerade *bool `yaml:"ipv6Masquerade"`
+	BPFMasquerade  bool  `yaml:"bpfMasquerade"`
+
+	// cloudRouted is set when the cloud network or a chained CNI routes
+	// the pods, in which case native routing needs neither a CIDR nor
+	// node routes
+	cloudRouted bool
+}
+
+// values translates the options into the values of the chart of version:
+// tunnel up to cilium 1.13, routingMode and tunnelProtocol since 1.14
+func (o routingOptions) values(version string) (map[string]interface{}, error) {
+	ipv4CIDR, err := o.ipv4CIDR()
+	if err != nil {
+		return nil, err
+	}
+	if o.RoutingMode == "" && ipv4CIDR == "" && o.IPv6NativeRoutingCIDR == "" && !o.AutoDirectNodeRoutes &&
+		o.Masquerade == nil && o.IPv6Masquerade == nil && !o.BPFMasquerade {
+		return nil, nil
+	}
+	v, err := config.ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := strings.ToLower(o.RoutingMode)
+	switch mode {
+	case "", routingVXLAN, routingGeneve:
+	case routingNative:
+		// The agents refuse to masquerade without knowing what not to
+		// masquerade
+		if ipv4CIDR == "" && (o.Masquerade == nil || *o.Masquerade) && !o.cloudRouted {
+			return nil, ErrInvalidRoutingMode(fmt.Errorf("native routing with masquerading requires nativeRoutingCIDR, or masquerade set to false"))
+		}
+	default:
+		return nil, ErrInvalidRoutingMode(fmt.Errorf("unknown routing mode %q, expected %s, %s or %s", o.RoutingMode, routingVXLAN, routingGeneve, routingNative))
+	}
+
+	values := make(map[string]interface{})
+	switch {
+	case mode == "":
+	case !v.LessThan(routingModeSince) && mode == routingNative:
+		values["routingMode"] = routingNative
+	case !v.LessThan(routingModeSince):
+		values["routingMode"] = "tunnel"
+		values["tunnelProtocol"] = mode
+	case mode == routingNative:
+		values["tunnel"] = "disabled"
+	default:
+		values["tunnel"] = mode
+	}
+
+	if ipv4CIDR != "" {
+		if ip, _, err := net.ParseCIDR(ipv4CIDR); err != nil || ip.To4() == nil {
+			return nil, ErrInvalidRoutingMode(fmt.Errorf("nativeRoutingCIDR %q is not an IPv4 CIDR", ipv4CIDR))
+		}
+		if v.LessThan(ipv4NativeRoutingCIDRSince) {
+			values["nativeRoutingCIDR"] = ipv4CIDR
+		} else {
+			values["ipv4NativeRoutingCIDR"] = ipv4CIDR
+		}
+	}
+	if o.IPv6NativeRoutingCIDR != "" {
+		if ip, _, err := net.ParseCIDR(o.IPv6NativeRoutingCIDR); err != nil || ip.To4() != nil {
+			return nil, ErrInvalidRoutingMode(fmt.Errorf("ipv6NativeRoutingCIDR %q is not an IPv6 CIDR", o.IPv6NativeRoutingCIDR))
+		}
+		if v.LessThan(ipv6NativeRoutingCIDRSince) {
+			return nil, ErrInvalidRoutingMode(fmt.Errorf("cilium %s does not take an IPv6 native routing CIDR, it requires %s", version, ipv6NativeRoutingCIDRSince))
+		}
+		values["ipv6NativeRoutingCIDR"] = o.IPv6NativeRoutingCIDR
+	}
+	if o.AutoDirectNodeRoutes {
+		values["autoDirectNodeRoutes"] = true
+	}
+	if o.Masquerade != nil {
+		values["enableIPv4Masquerade"] = *o.Masquerade
+	}
+	if o.IPv6Masquerade != nil {
+		values["enableIPv6Masquerade"] = *o.IPv6Masquerade
+	}
+	if o.BPFMasquerade {
+		if (o.Masquerade != nil && !*o.Masquerade) && (o.IPv6Masquerade == nil || !*o.IPv6Masquerade) {
+			return nil, ErrInvalidRoutingMode(fmt.Errorf("bpfMasquerade requires masquerading"))
+		}
+		values["bpf"] = map[string]interface{}{"masquerade": true}
+	}
+	return values, nil
+}
+
+// ipv4CIDR returns the IPv4 native routing CIDR, given under either name
+func (o routingOptions) ipv4CIDR() (string, error) {
+	if o.NativeRoutingCIDR != "" && o.IPv4NativeRoutingCIDR != "" && o.NativeRoutingCIDR != o.IPv4NativeRoutingCIDR {
+		return "", ErrInvalidRoutingMode(fmt.Errorf("nativeRoutingCIDR %s and ipv4NativeRoutingCIDR %s differ", o.NativeRoutingCIDR, o.IPv4NativeRoutingCIDR))
+	}
+	if o.NativeRoutingCIDR != "" {
+		return o.NativeRoutingCIDR, nil
+	}
+	return o.IPv4NativeRoutingCIDR, nil
+}
+
+// podCIDRs returns the pod CIDRs of the cluster the native routing CIDRs
+// must contain: the ones of the cluster pool, or the ones the nodes report
+// in the kubernetes mode. The cloud modes route the pods themselves.
+func (h *Handler) podCIDRs(ctx context.Context, ipam ipamOptions) ([]string, error) {
+	switch ipam.mode() {
+	case "", ipamClusterPool:
+		if len(ipam.ClusterPoolIPv4PodCIDRList) > 0 {
+			return ipam.ClusterPoolIPv4PodCIDRList, nil
+		}
+		return []string{defaultClusterPoolCIDR}, nil
+	case ipamKubernetes:
+		nodes, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		var cidrs []string
+		for _, node := range nodes.Items {
+			cidrs = append(cidrs, node.Spec.PodCIDRs...)
+			if len(node.Spec.PodCIDRs) == 0 && node.Spec.PodCIDR != "" {
+				cidrs = append(cidrs, node.Spec.PodCIDR)
+			}
+		}
+		return cidrs, nil
+	}
+	return nil, nil
+}
+
+// checkNativeRouting fails unless the native routing CIDRs contain the pod
+// CIDRs of their family. When the routes to the nodes are installed, the
+// nodes are expected to share an L2 segment, which is only guessed from
+// the /24 or /64 of their InternalIP: a warning is returned when they do
+// not share one.
+func (h *Handler) checkNativeRouting(ctx context.Context, o routingOptions, ipam ipamOptions) (string, error) {
+	if strings.ToLower(o.RoutingMode) != routingNative || o.cloudRouted || h.KubeClient == nil {
+		return "", nil
+	}
+	ipv4CIDR, err := o.ipv4CIDR()
+	if err != nil {
+		return "", err
+	}
+
+	podCIDRs, err := h.podCIDRs(ctx, ipam)
+	if err != nil {
+		return "", ErrInvalidRoutingMode(fmt.Errorf("listing the pod CIDRs of the nodes: %w", err))
+	}
+	var outside []string
+	for _, podCIDR := range podCIDRs {
+		ip, pod, err := net.ParseCIDR(podCIDR)
+		if err != nil {
+			continue
+		}
+		routing := ipv4CIDR
+		if ip.To4() == nil {
+			routing = o.IPv6NativeRoutingCIDR
+		}
+		if routing == "" {
+			continue
+		}
+		if _, native, err := net.ParseCIDR(routing); err == nil && !cidrContains(native, pod) {
+			outside = append(outside, podCIDR)
+		}
+	}
+	if len(outside) > 0 {
+		return "", ErrInvalidRoutingMode(fmt.Errorf("the native routing CIDR does not contain the pod CIDRs %s, observed pod CIDRs: %s", strings.Join(outside, ", "), strings.Join(podCIDRs, ", ")))
+	}
+
+	if !o.AutoDirectNodeRoutes {
+		return "", nil
+	}
+	nodes, err := h.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", nil
+	}
+	segments := make(map[string][]string)
+	families := make(map[bool]int)
+	for _, node := range nodes.Items {
+		for _, addr := range node.Status.Addresses {
+			ip := net.ParseIP(addr.Address)
+			if addr.Type != corev1.NodeInternalIP || ip == nil {
+				continue
+			}
+			mask := net.CIDRMask(64, 128)
+			if ip.To4() != nil {
+				ip, mask = ip.To4(), net.CIDRMask(24, 32)
+			}
+			segment := (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+			if _, ok := segments[segment]; !ok {
+				families[ip.To4() != nil]++
+			}
+			segments[segment] = append(segments[segment], node.Name)
+		}
+	}
+	// Dual stack nodes have a segment of each family
+	if families[true] <= 1 && families[false] <= 1 {
+		return "", nil
+	}
+	described := make([]string, 0, len(segments))
+	for segment, names := range segments {
+		described = append(described, fmt.Sprintf("%s (%s)", segment, strings.Join(names, ", ")))
+	}
+	sort.Strings(described)
+	return fmt.Sprintf("Warning: autoDirectNodeRoutes only routes between nodes of an L2 segment, the InternalIPs of the nodes are spread over %s.", strings.Join(described, ", ")), nil
+}
+
+// cidrContains reports whether outer contains inner entirely
+func cidrContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// routingValues renders the routing related chart values as YAML
+func routingValues(values map[string]interface{}) string {
+	routing := make(map[string]interface{})
+	for _, key := range routingValueKeys {
+		if value, ok := values[key]; ok {
+			routing[key] = value
+		}
+	}
+	if bpf, ok := values["bpf"].(map[string]interface{}); ok {
+		if masquerade, ok := bpf["masquerade"]; ok {
+			routing["bpf"] = map[string]interface{}{"masquerade": masquerade}
+		}
+	}
+	if len(routing) == 0 {
+		return "defaults of the chart\n"
+	}
+	byt, err := yaml.Marshal(routing)
+	if err != nil {
+		return fmt.Sprintf("%v\n", routing)
+	}
+	return string(byt)
+}
@@ -1,23 +1,396 @@
 package cilium
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
 	"github.com/layer5io/meshery-adapter-library/adapter"
 	"github.com/layer5io/meshery-adapter-library/status"
 	mesherykube "github.com/layer5io/meshkit/utils/kubernetes"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
-func (h *Handler) installSampleApp(del bool, namespace string, templates []adapter.Template) (string, error) {
+const (
+	// sampleAppLabel labels the resources of a sample app with the
+	// operation which deployed it
+	sampleAppLabel = "meshery.io/sample-app"
+
+	// sampleNamespaceLabel labels the resources of a sample app with the
+	// namespace it was deployed in
+	sampleNamespaceLabel = "meshery.io/sample-namespace"
+
+	// defaultSampleNamespace is where the sample apps are deployed unless
+	// the request names a namespace
+	defaultSampleNamespace = "default"
+)
+
+// sampleAppOptions adapt the manifests of the sample apps to the cluster.
+// They are part of the custom body of the sample app requests, the
+// manifests are applied as they are without them.
+type sampleAppOptions struct {
+	// Namespace the sample app is deployed in, replacing the namespace of
+	// the request and the namespaces the manifests set
+	Namespace string `yaml:"namespace"`
+
+	// Replicas of the Deployments of the sample app, by name
+	Replicas map[string]int `yaml:"replicas"`
+
+	// Registry replaces the registry of every container image, like
+	// registry.internal:5000
+	Registry string `yaml:"registry"`
+}
+
+// sampleAppRequest holds the parameters of the sample app operations,
+// read from the custom body of the request
+type sampleAppRequest struct {
+	sampleAppOptions    `yaml:",inline"`
+	sampleHealthOptions `yaml:",inline"`
+}
+
+// check fails if the options are invalid
+func (o sampleAppOptions) check() error {
+	if err := validateNamespace(o.Namespace); err != nil {
+		return err
+	}
+	for name, n := range o.Replicas {
+		if n < 0 {
+			return ErrSampleApp(fmt.Errorf("replicas of %s: %d is negative", name, n))
+		}
+	}
+	if o.Registry != "" {
+		if _, err := reference.ParseNormalizedNamed(strings.TrimSuffix(o.Registry, "/") + "/image"); err != nil {
+			return ErrSampleApp(fmt.Errorf("registry %q: %w", o.Registry, err))
+		}
+	}
+	return nil
+}
+
+// namespace returns the namespace the sample app is deployed in: the one
+// of the options, else requested, else the default one
+func (o sampleAppOptions) namespace(requested string) string {
+	switch {
+	case o.Namespace != "":
+		return o.Namespace
+	case requested != "":
+		return requested
+	}
+	return defaultSampleNamespace
+}
+
+// rewrite adapts objs to the options: their namespace becomes namespace,
+// along with the one of the service accounts they bind, the Deployments
+// get their replicas and the images are pulled from the registry. The
+// Deployments named in the replicas have to be found in objs.
+func (o sampleAppOptions) rewrite(objs []*unstructured.Unstructured, namespace string) error {
+	found := make(map[string]bool)
+	for _, obj := range objs {
+		if o.Namespace != "" {
+			if obj.GetNamespace() != "" {
+				obj.SetNamespace(namespace)
+			}
+			if err := rewriteSubjects(obj, namespace); err != nil {
+				return ErrSampleApp(fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err))
+			}
+		}
+		if n, ok := o.Replicas[obj.GetName()]; ok && obj.GetKind() == "Deployment" {
+			if err := unstructured.SetNestedField(obj.Object, int64(n), "spec", "replicas"); err != nil {
+				return ErrSampleApp(fmt.Errorf("Deployment %s: %w", obj.GetName(), err))
+			}
+			found[obj.GetName()] = true
+		}
+		if o.Registry != "" {
+			if err := rewriteImages(obj.Object, o.Registry); err != nil {
+				return ErrSampleApp(fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err))
+			}
+		}
+	}
+
+	var unknown []string
+	for name := range o.Replicas {
+		if !found[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return ErrSampleApp(fmt.Errorf("the sample app has no Deployment %s", strings.Join(unknown, ", ")))
+	}
+	return nil
+}
+
+// rewriteSubjects moves the service accounts bound by obj, if it is a
+// binding, to namespace
+func rewriteSubjects(obj *unstructured.Unstructured, namespace string) error {
+	if obj.GetKind() != "RoleBinding" && obj.GetKind() != "ClusterRoleBinding" {
+		return nil
+	}
+	subjects, ok, err := unstructured.NestedSlice(obj.Object, "subjects")
+	if err != nil || !ok {
+		return err
+	}
+	for _, s := range subjects {
+		if subject, ok := s.(map[string]interface{}); ok && subject["kind"] == "ServiceAccount" {
+			subject["namespace"] = namespace
+		}
+	}
+	return unstructured.SetNestedSlice(obj.Object, subjects, "subjects")
+}
+
+// rewriteImages replaces the registry of the image of every container
+// found in obj with registry, keeping the repository path, the tag and
+// the digest
+func rewriteImages(obj interface{}, registry string) error {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if key != "containers" && key != "initContainers" && key != "ephemeralContainers" {
+				if err := rewriteImages(val, registry); err != nil {
+					return err
+				}
+				continue
+			}
+			containers, _ := val.([]interface{})
+			for _, c := range containers {
+				container, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				image, _ := container["image"].(string)
+				if image == "" {
+					continue
+				}
+				rewritten, err := rewriteImage(image, registry)
+				if err != nil {
+					return err
+				}
+				container["image"] = rewritten
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if err := rewriteImages(val, registry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteImage replaces the registry of image with registry, keeping the
+// repository path, the tag and the digest
+func rewriteImage(image, registry string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("image %q: %w", image, err)
+	}
+	rewritten := strings.TrimSuffix(registry, "/") + "/" + reference.Path(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		rewritten += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		rewritten += "@" + digested.Digest().String()
+	}
+	return rewritten, nil
+}
+
+// sampleAppResource is a kind of resource the sample apps create
+type sampleAppResource struct {
+	kind       string
+	resource   schema.GroupVersionResource
+	namespaced bool
+}
+
+// sampleAppResources are the kinds of resources searched for when a
+// sample app is removed, the dependents first
+var sampleAppResources = []sampleAppResource{
+	{"CiliumNetworkPolicy", networkPolicyResource, true},
+	{"CiliumClusterwideNetworkPolicy", clusterwidePolicyResource, false},
+	{"NetworkPolicy", schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}, true},
+	{"Ingress", schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}, true},
+	{"Service", schema.GroupVersionResource{Version: "v1", Resource: "services"}, true},
+	{"Deployment", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, true},
+	{"StatefulSet", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}, true},
+	{"DaemonSet", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}, true},
+	{"Job", schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}, true},
+	{"Pod", schema.GroupVersionResource{Version: "v1", Resource: "pods"}, true},
+	{"ConfigMap", schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, true},
+	{"Secret", schema.GroupVersionResource{Version: "v1", Resource: "secrets"}, true},
+	{"PersistentVolumeClaim", schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}, true},
+	{"RoleBinding", schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings"}, true},
+	{"Role", schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles"}, true},
+	{"ServiceAccount", schema.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}, true},
+	{"ClusterRoleBinding", schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings"}, false},
+	{"ClusterRole", schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}, false},
+}
+
+// sampleAppLabels are the labels of the resources of app in namespace
+func sampleAppLabels(app, namespace string) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/managed-by": manifestFieldManager,
+		sampleAppLabel:                 app,
+		sampleNamespaceLabel:           namespace,
+	}
+}
+
+// labelSampleObject adds the labels of app in namespace to obj
+func labelSampleObject(obj *unstructured.Unstructured, app, namespace string) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range sampleAppLabels(app, namespace) {
+		labels[k] = v
+	}
+	obj.SetLabels(labels)
+}
+
+// sampleAppSelector selects the resources of app in namespace
+func sampleAppSelector(app, namespace string) string {
+	return fmt.Sprintf("app.kubernetes.io/managed-by=%s,%s=%s,%s=%s", manifestFieldManager, sampleAppLabel, app, sampleNamespaceLabel, namespace)
+}
+
+// installSampleApp applies the templates of the sample app operation app in
+// namespace, adapted with the options of the custom body and labeling
+// every resource for their removal, and waits for it to be healthy, or
+// removes the resources so labeled if del is set. The outcome of every
+// probe or removed resource is returned.
+func (h *Handler) installSampleApp(del bool, namespace, app, customBody string, templates []adapter.Template) (string, []string, error) {
 	st := status.Installing
 	if del {
 		st = status.Removing
 	}
+	var req sampleAppRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		return st, nil, err
+	}
+	opts := req.sampleAppOptions
+	if err := opts.check(); err != nil {
+		return st, nil, err
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		return st, nil, err
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		return st, nil, ErrSampleApp(ErrNilClient)
+	}
+	namespace = opts.namespace(namespace)
+	ctx := context.Background()
+	if del {
+		// An install still checking the health of the app gives up
+		h.sampleWaits.cancel(app, namespace)
+		results, err := h.removeSampleApp(ctx, namespace, app)
+		if err != nil {
+			return st, nil, ErrSampleApp(err)
+		}
+		if len(results) == 0 {
+			return status.Removed, []string{fmt.Sprintf("No resource of %s was found in namespace %s", app, namespace)}, nil
+		}
+		lines := make([]string, 0, len(results))
+		var failed []string
+		for _, r := range results {
+			lines = append(lines, r.String())
+			if r.Err != nil {
+				failed = append(failed, r.String())
+			}
+		}
+		if len(failed) > 0 {
+			return st, lines, ErrSampleApp(fmt.Errorf("%s", strings.Join(failed, "; ")))
+		}
+		return status.Removed, lines, nil
+	}
+
+	var objs []*unstructured.Unstructured
 	for _, template := range templates {
-		err := h.applyManifest([]byte(template.String()), del, namespace)
+		templateObjs, err := manifestObjects(template.String())
 		if err != nil {
-			return st, ErrSampleApp(err)
+			return st, nil, ErrSampleApp(err)
+		}
+		objs = append(objs, templateObjs...)
+	}
+	if err := opts.rewrite(objs, namespace); err != nil {
+		return st, nil, err
+	}
+
+	mapper := h.newManifestMapper()
+	for _, obj := range objs {
+		labelSampleObject(obj, app, namespace)
+		if _, err := h.applyObject(ctx, mapper, namespace, obj); err != nil {
+			return st, nil, ErrSampleApp(fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err))
+		}
+	}
+
+	waitCtx, cancel := h.sampleWaits.start(app, namespace, timeout)
+	defer cancel()
+	lines, err := h.verifySampleApp(waitCtx, namespace, app, objs, req.sampleHealthOptions, opts.Registry)
+	if err == nil {
+		return status.Installed, lines, nil
+	}
+	if !req.Cleanup {
+		lines = append(lines, fmt.Sprintf("The resources of %s are left in namespace %s for debugging, remove them with the delete operation.", app, namespace))
+		return st, lines, ErrSampleAppUnhealthy(err)
+	}
+	results, rmErr := h.removeSampleApp(ctx, namespace, app)
+	if rmErr != nil {
+		lines = append(lines, fmt.Sprintf("The resources of %s could not be removed: %s", app, rmErr))
+	}
+	for _, r := range results {
+		lines = append(lines, r.String())
+	}
+	return st, lines, ErrSampleAppUnhealthy(err)
+}
+
+// removeSampleApp deletes the resources labeled as app of namespace, the
+// cluster scoped ones included. It refuses to delete anything when the
+// labels select namespaced resources of another namespace, which the
+// sample app did not create there. The resources already gone are
+// reported as not found.
+func (h *Handler) removeSampleApp(ctx context.Context, namespace, app string) ([]uninstallResult, error) {
+	selector := sampleAppSelector(app, namespace)
+	type found struct {
+		kind, namespace, name string
+		resource              schema.GroupVersionResource
+	}
+	var matches []found
+	var outside []string
+	for _, r := range sampleAppResources {
+		list, err := h.DynamicKubeClient.Resource(r.resource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if kerrors.IsNotFound(err) {
+			// The kind is not served, like the cilium policies without cilium
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing the %s resources: %w", r.kind, err)
+		}
+		for _, item := range list.Items {
+			if r.namespaced && item.GetNamespace() != namespace {
+				outside = append(outside, fmt.Sprintf("%s %s/%s", r.kind, item.GetNamespace(), item.GetName()))
+				continue
+			}
+			matches = append(matches, found{kind: r.kind, namespace: item.GetNamespace(), name: item.GetName(), resource: r.resource})
+		}
+	}
+	if len(outside) > 0 {
+		return nil, fmt.Errorf("%s selects resources outside namespace %s, nothing was removed: %s", selector, namespace, strings.Join(outside, ", "))
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	results := make([]uninstallResult, 0, len(matches))
+	for _, m := range matches {
+		err := h.DynamicKubeClient.Resource(m.resource).Namespace(m.namespace).Delete(ctx, m.name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		name := m.name
+		if m.namespace != "" {
+			name = m.namespace + "/" + m.name
 		}
+		results = append(results, newUninstallResult(m.kind, name, err))
 	}
-	return status.Installed, nil
+	return results, nil
 }
 
 func (h *Handler) applyManifest(contents []byte, isDel bool, namespace string) error {
@@ -0,0 +1,131 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// sampleObject returns a resource of the kind r labeled as the sample app app of
+// appNamespace, living in namespace unless it is cluster scoped
+func sampleObject(r sampleAppResource, namespace, name, app, appNamespace string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(schema.GroupVersion{Group: r.resource.Group, Version: r.resource.Version}.String())
+	obj.SetKind(r.kind)
+	obj.SetName(name)
+	if r.namespaced {
+		obj.SetNamespace(namespace)
+	}
+	labelSampleObject(obj, app, appNamespace)
+	return obj
+}
+
+func sampleResource(kind string) sampleAppResource {
+	for _, r := range sampleAppResources {
+		if r.kind == kind {
+			return r
+		}
+	}
+	panic("no sample app resource " + kind)
+}
+
+func newSampleAppHandler(t *testing.T, objs ...runtime.Object) *Handler {
+	listKinds := make(map[schema.GroupVersionResource]string, len(sampleAppResources))
+	for _, r := range sampleAppResources {
+		listKinds[r.resource] = r.kind + "List"
+	}
+	h, _ := newTestHandler(t)
+	h.DynamicKubeClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objs...)
+	return h
+}
+
+func TestRemoveSampleApp(t *testing.T) {
+	h := newSampleAppHandler(t,
+		sampleObject(sampleResource("Deployment"), "demo", "deathstar", "starwars", "demo"),
+		sampleObject(sampleResource("CiliumClusterwideNetworkPolicy"), "", "starwars-empire", "starwars", "demo"),
+		sampleObject(sampleResource("ClusterRole"), "", "starwars-reader", "starwars", "demo"),
+		sampleObject(sampleResource("ClusterRoleBinding"), "", "starwars-reader", "starwars", "demo"),
+		// The same app in another namespace is left alone
+		sampleObject(sampleResource("ClusterRole"), "", "starwars-reader-prod", "starwars", "prod"),
+		sampleObject(sampleResource("Deployment"), "prod", "deathstar", "starwars", "prod"),
+	)
+
+	results, err := h.removeSampleApp(context.Background(), "demo", "starwars")
+	if err != nil {
+		t.Fatalf("removeSampleApp: %v", err)
+	}
+	var removed []string
+	for _, r := range results {
+		if r.Err != nil || r.NotFound {
+			t.Errorf("%s", r)
+		}
+		removed = append(removed, r.Kind+" "+r.Name)
+	}
+	sort.Strings(removed)
+	want := []string{
+		"CiliumClusterwideNetworkPolicy starwars-empire",
+		"ClusterRole starwars-reader",
+		"ClusterRoleBinding starwars-reader",
+		"Deployment demo/deathstar",
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+
+	for _, kind := range []string{"ClusterRole", "Deployment"} {
+		left, err := h.DynamicKubeClient.Resource(sampleResource(kind).resource).Namespace(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(left.Items) != 1 || left.Items[0].GetLabels()[sampleNamespaceLabel] != "prod" {
+			t.Errorf("%d %s resources left, want the one of prod", len(left.Items), kind)
+		}
+	}
+}
+
+func TestRemoveSampleAppOutsideNamespace(t *testing.T) {
+	// A resource of the app moved to another namespace, which it did not
+	// create there
+	moved := sampleObject(sampleResource("Service"), "default", "deathstar", "starwars", "demo")
+	h := newSampleAppHandler(t,
+		sampleObject(sampleResource("Deployment"), "demo", "deathstar", "starwars", "demo"),
+		sampleObject(sampleResource("ClusterRole"), "", "starwars-reader", "starwars", "demo"),
+		moved,
+	)
+
+	_, err := h.removeSampleApp(context.Background(), "demo", "starwars")
+	if err == nil || !strings.Contains(err.Error(), "nothing was removed: Service default/deathstar") {
+		t.Fatalf("error = %v, want the Service of default reported", err)
+	}
+	if strings.Contains(err.Error(), "ClusterRole") {
+		t.Errorf("error %q reports the cluster scoped resources", err)
+	}
+	for _, kind := range []string{"Deployment", "ClusterRole"} {
+		left, _ := h.DynamicKubeClient.Resource(sampleResource(kind).resource).Namespace(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+		if len(left.Items) != 1 {
+			t.Errorf("%d %s resources left, want nothing removed", len(left.Items), kind)
+		}
+	}
+}
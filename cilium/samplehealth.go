@@ -0,0 +1,374 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// sampleProbePod is the pod the services of a sample app are probed
+	// from, labeled as the sample app so that it is removed along with it
+	sampleProbePod = "meshery-sample-probe"
+
+	// sampleEventsPerPod is how many of the recent warnings of every pod
+	// are reported when a sample app is unhealthy
+	sampleEventsPerPod = 5
+)
+
+// sampleHealthOptions tune the health check following a sample app
+// install. They are part of the custom body of the sample app requests.
+type sampleHealthOptions struct {
+	// Timeout bounds the wait for the pods to be ready and the services
+	// to answer, like 5m
+	Timeout string `yaml:"timeout"`
+
+	// Cleanup removes the sample app if it does not become healthy. It is
+	// left in place for debugging otherwise.
+	Cleanup bool `yaml:"cleanup"`
+
+	// ProbeImage runs the probe of the services, the curl image of the
+	// connectivity test by default. The registry of the sample app
+	// applies to it as well.
+	ProbeImage string `yaml:"probeImage"`
+}
+
+// sampleWaitRegistry holds the health checks in progress, so that
+// removing a sample app stops the check of its install
+type sampleWaitRegistry struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[string]map[int]context.CancelFunc
+}
+
+// start returns the context of the health check of app in namespace,
+// done after timeout or once the app is removed, and its cancel func
+func (r *sampleWaitRegistry) start(app, namespace string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if r == nil {
+		return ctx, cancel
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := namespace + "/" + app
+	if r.cancels == nil {
+		r.cancels = make(map[string]map[int]context.CancelFunc)
+	}
+	if r.cancels[key] == nil {
+		r.cancels[key] = make(map[int]context.CancelFunc)
+	}
+	id := r.next
+	r.next++
+	r.cancels[key][id] = cancel
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.cancels[key], id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel stops the health checks of app in namespace and returns how many
+// were in progress
+func (r *sampleWaitRegistry) cancel(app, namespace string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := namespace + "/" + app
+	n := len(r.cancels[key])
+	for _, cancel := range r.cancels[key] {
+		cancel()
+	}
+	delete(r.cancels, key)
+	return n
+}
+
+// samplePods returns the pods of the Deployments and the Pods of objs in
+// namespace
+func (h *Handler) samplePods(ctx context.Context, namespace string, objs []*unstructured.Unstructured) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	for _, obj := range objs {
+		switch obj.GetKind() {
+		case "Deployment":
+			deploy, err := h.KubeClient.AppsV1().Deployments(namespace).Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			selector, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+			if err != nil {
+				return nil, err
+			}
+			list, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+			if err != nil {
+				return nil, err
+			}
+			pods = append(pods, list.Items...)
+		case "Pod":
+			pod, err := h.KubeClient.CoreV1().Pods(namespace).Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			pods = append(pods, *pod)
+		}
+	}
+	return pods, nil
+}
+
+// sampleReady reports whether the Deployments of objs in namespace run
+// every replica and the Pods of objs are ready
+func (h *Handler) sampleReady(ctx context.Context, namespace string, objs []*unstructured.Unstructured) (bool, error) {
+	for _, obj := range objs {
+		switch obj.GetKind() {
+		case "Deployment":
+			deploy, err := h.KubeClient.AppsV1().Deployments(namespace).Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			if !deploymentReady(deploy) {
+				return false, nil
+			}
+		case "Pod":
+			pod, err := h.KubeClient.CoreV1().Pods(namespace).Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			if !podReady(pod) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// podWarnings returns the recent warning events of pod, the oldest first
+func (h *Handler) podWarnings(ctx context.Context, pod *corev1.Pod) []string {
+	events, err := h.KubeClient.CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s,type=%s", pod.Name, corev1.EventTypeWarning),
+	})
+	if err != nil {
+		return nil
+	}
+	items := events.Items
+	sort.Slice(items, func(i, j int) bool {
+		return eventTime(&items[i]).Before(eventTime(&items[j]))
+	})
+	if len(items) > sampleEventsPerPod {
+		items = items[len(items)-sampleEventsPerPod:]
+	}
+	warnings := make([]string, 0, len(items))
+	for _, event := range items {
+		line := fmt.Sprintf("%s: %s %s", pod.Name, event.Reason, event.Message)
+		if event.Count > 1 {
+			line = fmt.Sprintf("%s (x%d)", line, event.Count)
+		}
+		warnings = append(warnings, line)
+	}
+	return warnings
+}
+
+// eventTime returns the last time event occurred
+func eventTime(event *corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// sampleProblems describes why the pods of objs in namespace are not
+// ready, with their recent warnings
+func (h *Handler) sampleProblems(namespace string, objs []*unstructured.Unstructured) []string {
+	// The context of the check is done by now
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pods, err := h.samplePods(ctx, namespace, objs)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	for i := range pods {
+		if podReady(&pods[i]) || pods[i].Status.Phase == corev1.PodSucceeded {
+			continue
+		}
+		problems = append(problems, containerProblems(&pods[i])...)
+		problems = append(problems, h.podWarnings(ctx, &pods[i])...)
+	}
+	return problems
+}
+
+// sampleProbeTargets returns the URLs of the HTTP ports of the Services of
+// objs in namespace, the ports named http or http-something or declaring
+// the http protocol. The other ports may not speak HTTP and are not probed.
+func sampleProbeTargets(namespace string, objs []*unstructured.Unstructured) ([]string, error) {
+	var targets []string
+	for _, obj := range objs {
+		if obj.GetKind() != "Service" {
+			continue
+		}
+		var svc corev1.Service
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &svc); err != nil {
+			return nil, fmt.Errorf("Service %s: %w", obj.GetName(), err)
+		}
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+		for _, port := range svc.Spec.Ports {
+			http := port.Name == "http" || strings.HasPrefix(port.Name, "http-") ||
+				(port.AppProtocol != nil && strings.EqualFold(*port.AppProtocol, "http"))
+			if http && (port.Protocol == "" || port.Protocol == corev1.ProtocolTCP) {
+				targets = append(targets, fmt.Sprintf("http://%s.%s.svc.cluster.local:%d/", svc.Name, namespace, port.Port))
+			}
+		}
+	}
+	return targets, nil
+}
+
+// probeSampleServices requests every target from a probe pod of app in
+// namespace running image, until each of them answers or ctx is done. The
+// probe pod is removed afterwards.
+func (h *Handler) probeSampleServices(ctx context.Context, namespace, app, image string, targets []string) ([]connectivityCheck, error) {
+	grace := int64(0)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: sampleProbePod, Namespace: namespace, Labels: sampleAppLabels(app, namespace)},
+		Spec: corev1.PodSpec{
+			TerminationGracePeriodSeconds: &grace,
+			Containers: []corev1.Container{{
+				Name:    sampleProbePod,
+				Image:   image,
+				Command: []string{"sleep", "infinity"},
+			}},
+		},
+	}
+
+	pods := h.KubeClient.CoreV1().Pods(namespace)
+	if err := pods.Delete(ctx, sampleProbePod, metav1.DeleteOptions{GracePeriodSeconds: &grace}); err != nil && !kerrors.IsNotFound(err) {
+		return nil, err
+	}
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		// The probe pod of a previous check may still be terminating
+		_, err := pods.Create(ctx, pod, metav1.CreateOptions{})
+		if kerrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}, ctx.Done())
+	if err != nil {
+		return nil, fmt.Errorf("creating the probe pod: %w", err)
+	}
+	defer func() {
+		_ = pods.Delete(context.Background(), sampleProbePod, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	}()
+
+	err = wait.PollImmediateUntil(rolloutPollInterval, func() (bool, error) {
+		p, err := pods.Get(ctx, sampleProbePod, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		pod = p
+		return podReady(p), nil
+	}, ctx.Done())
+	if err != nil {
+		problems := append(containerProblems(pod), h.podWarnings(context.Background(), pod)...)
+		return nil, fmt.Errorf("the probe pod is not ready: %w: %s", err, strings.Join(problems, "; "))
+	}
+
+	checks := make([]connectivityCheck, 0, len(targets))
+	for _, url := range targets {
+		var status string
+		err := wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+			status = h.curlMethod(pod, sampleProbePod, "GET", url)
+			return httpAnswered(status) || httpRefused(status), nil
+		}, ctx.Done())
+		checks = append(checks, connectivityCheck{Name: "probe", Passed: err == nil, Detail: fmt.Sprintf("GET %s: %s", url, status)})
+	}
+	return checks, nil
+}
+
+// verifySampleApp waits for the pods of objs, applied as app in namespace,
+// to become ready and for their HTTP services to answer, until ctx is
+// done. The outcome of every probe is returned.
+func (h *Handler) verifySampleApp(ctx context.Context, namespace, app string, objs []*unstructured.Unstructured, opts sampleHealthOptions, registry string) ([]string, error) {
+	err := wait.PollImmediateUntil(rolloutPollInterval, func() (bool, error) {
+		ready, err := h.sampleReady(ctx, namespace, objs)
+		return ready, ignoreNotFound(err)
+	}, ctx.Done())
+	if err != nil {
+		return h.sampleProblems(namespace, objs), fmt.Errorf("the pods of %s are not ready: %w", app, waitErr(ctx, err))
+	}
+
+	targets, err := sampleProbeTargets(namespace, objs)
+	if err != nil || len(targets) == 0 {
+		return nil, err
+	}
+	image := opts.ProbeImage
+	if image == "" {
+		image = defaultClientImage
+	}
+	if registry != "" {
+		if image, err = rewriteImage(image, registry); err != nil {
+			return nil, err
+		}
+	}
+	checks, err := h.probeSampleServices(ctx, namespace, app, image, targets)
+	if err != nil {
+		return nil, waitErr(ctx, err)
+	}
+	lines := make([]string, 0, len(checks))
+	var failed []string
+	for _, c := range checks {
+		lines = append(lines, c.String())
+		if !c.Passed {
+			failed = append(failed, c.Detail)
+		}
+	}
+	if len(failed) > 0 {
+		return lines, waitErr(ctx, fmt.Errorf("the services of %s do not answer: %s", app, strings.Join(failed, "; ")))
+	}
+	return lines, nil
+}
+
+// ignoreNotFound returns nil if err is a not found error, the resources
+// of a sample app being listed while they are created
+func ignoreNotFound(err error) error {
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// waitErr tells whether the wait ending with err was canceled rather
+// than timed out
+func waitErr(ctx context.Context, err error) error {
+	if ctx.Err() == context.Canceled {
+		return fmt.Errorf("the check was canceled: %w", err)
+	}
+	return err
+}
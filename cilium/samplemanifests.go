@@ -0,0 +1,135 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"github.com/layer5io/meshkit/utils/walker"
+)
+
+const (
+	sampleStarWars           = config.SampleStarWars
+	sampleStarWarsL3L4Policy = config.SampleStarWarsL3L4Policy
+	sampleStarWarsL7Policy   = config.SampleStarWarsL7Policy
+)
+
+// sampleManifestCache holds the paths of the samples found at every ref of
+// the cilium repo
+type sampleManifestCache struct {
+	mu    sync.Mutex
+	paths map[string]map[string]string
+}
+
+// get returns the paths of the samples at ref, by sample
+func (c *sampleManifestCache) get(ref string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths, ok := c.paths[ref]
+	return paths, ok
+}
+
+// put records the paths of the samples at ref
+func (c *sampleManifestCache) put(ref string, paths map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths == nil {
+		c.paths = make(map[string]map[string]string)
+	}
+	c.paths[ref] = paths
+}
+
+// resolveSampleManifests returns the path in the cilium repo at ref of
+// every sample found there, by sample. The directories which do not exist
+// at ref are skipped. The paths are cached by ref, the refs being tags
+// which never move.
+func (h *Handler) resolveSampleManifests(ctx context.Context, ref string) (map[string]string, error) {
+	if h.sampleManifests != nil {
+		if paths, ok := h.sampleManifests.get(ref); ok {
+			return paths, nil
+		}
+	}
+
+	paths, err := config.ResolveSampleManifests(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if h.sampleManifests != nil {
+		h.sampleManifests.put(ref, paths)
+	}
+	return paths, nil
+}
+
+// sampleManifest returns the manifest of sample in the cilium repo at ref,
+// failing with the samples found at ref if sample is not one of them. The
+// copy embedded in the adapter for the minor of ref is returned instead if
+// offline is set or if github cannot be reached, its path starting with
+// config.EmbeddedSamplePrefix.
+func (h *Handler) sampleManifest(ctx context.Context, ref, sample string, offline bool) (walker.File, error) {
+	if offline {
+		return embeddedSample(sample, ref)
+	}
+	paths, err := h.resolveSampleManifests(ctx, ref)
+	if err != nil {
+		h.Log.Warn(ErrSampleApp(err))
+		return embeddedSample(sample, ref)
+	}
+	p, ok := paths[sample]
+	if !ok {
+		available := make([]string, 0, len(paths))
+		for name := range paths {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		if len(available) == 0 {
+			return walker.File{}, ErrSampleApp(fmt.Errorf("cilium/cilium has no sample manifest at %s", ref))
+		}
+		return walker.File{}, ErrSampleApp(fmt.Errorf("cilium/cilium has no %s manifest at %s, the samples available there are %s", sample, ref, strings.Join(available, ", ")))
+	}
+
+	files, err := config.GetFiles(ctx, "cilium", "cilium", path.Dir(p), ref, config.FileOptions{Pattern: path.Base(p)})
+	if err != nil {
+		h.Log.Warn(ErrSampleApp(err))
+		return embeddedSample(sample, ref)
+	}
+	if len(files) == 0 {
+		return walker.File{}, ErrSampleApp(fmt.Errorf("cilium/cilium has no %s at %s", p, ref))
+	}
+	return files[0], nil
+}
+
+// embeddedSample returns the copy of sample embedded for the minor of ref
+func embeddedSample(sample, ref string) (walker.File, error) {
+	file, err := config.EmbeddedSample(sample, ref)
+	if err != nil {
+		return walker.File{}, ErrSampleApp(err)
+	}
+	return file, nil
+}
+
+// embeddedSampleWarning tells that file is the embedded copy of a sample,
+// or returns an empty string if it was fetched from github
+func embeddedSampleWarning(file walker.File, ref string) string {
+	if !strings.HasPrefix(file.Path, config.EmbeddedSamplePrefix) {
+		return ""
+	}
+	return fmt.Sprintf("Warning: the copy of %s embedded in the adapter was applied in place of the one at %s, which may differ.", file.Name, ref)
+}
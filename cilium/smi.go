@@ -0,0 +1,471 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// serviceAccountLabel is the label of the endpoints holding the
+	// service account of their pod
+	serviceAccountLabel = "io.cilium.k8s.policy.serviceaccount"
+
+	// smiTargetLabel and smiNamespaceLabel label the policies converted
+	// from a TrafficTarget with its name and namespace, smiSourceAnnotation
+	// names it in full
+	smiTargetLabel      = "meshery.io/smi-traffic-target"
+	smiNamespaceLabel   = "meshery.io/smi-namespace"
+	smiSourceAnnotation = "meshery.io/smi-source"
+
+	// smiPolicyPrefix prefixes the name of the converted policies
+	smiPolicyPrefix = "smi-"
+)
+
+// smiKinds are the SMI kinds the converter reads
+var smiKinds = map[string]bool{
+	"TrafficTarget":  true,
+	"HTTPRouteGroup": true,
+	"TCPRoute":       true,
+}
+
+// smiIdentity is a source or the destination of a TrafficTarget
+type smiIdentity struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Port is the port of the destination, up to access v1alpha3
+	Port int `json:"port"`
+}
+
+// smiRule points a TrafficTarget at the matches of a route
+type smiRule struct {
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Matches []string `json:"matches"`
+}
+
+// smiTrafficTarget is the spec of a TrafficTarget
+type smiTrafficTarget struct {
+	Destination smiIdentity   `json:"destination"`
+	Sources     []smiIdentity `json:"sources"`
+	Rules       []smiRule     `json:"rules"`
+}
+
+// smiHTTPMatch is a match of a HTTPRouteGroup
+type smiHTTPMatch struct {
+	Name      string            `json:"name"`
+	PathRegex string            `json:"pathRegex"`
+	Methods   []string          `json:"methods"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// smiRoutes are the spec of a HTTPRouteGroup or a TCPRoute
+type smiRoutes struct {
+	// Matches of a HTTPRouteGroup
+	HTTP []smiHTTPMatch `json:"-"`
+
+	// Ports of a TCPRoute, every port if empty
+	Ports []int `json:"-"`
+}
+
+// smiSpec decodes the spec of obj into spec
+func smiSpec(obj *unstructured.Unstructured, spec interface{}) error {
+	raw, ok := obj.Object["spec"]
+	if !ok {
+		return fmt.Errorf("%s %s has no spec, only the v1alpha2 and later versions of SMI are supported", obj.GetKind(), obj.GetName())
+	}
+	byt, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(byt, spec); err != nil {
+		return fmt.Errorf("spec of %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+	return nil
+}
+
+// smiConversion is the outcome of converting SMI resources
+type smiConversion struct {
+	Policies []*unstructured.Unstructured
+
+	// Unsupported are the SMI constructs left out of the policies. They
+	// are left out so that the policies allow less than the SMI
+	// resources, never more.
+	Unsupported []string
+}
+
+// leaveOut records an unsupported construct of the SMI resource what
+func (c *smiConversion) leaveOut(what, format string, args ...interface{}) {
+	c.Unsupported = append(c.Unsupported, fmt.Sprintf("%s: %s", what, fmt.Sprintf(format, args...)))
+}
+
+// smiRef names an SMI resource in the reports
+func smiRef(kind, namespace, name string) string {
+	return fmt.Sprintf("%s %s/%s", kind, namespace, name)
+}
+
+// hasRegexp reports whether value uses regular expression syntax, which
+// the header matches of cilium do not support
+func hasRegexp(value string) bool {
+	return strings.ContainsAny(value, `\.+*?()|[]{}^$`)
+}
+
+// convertSMI converts the TrafficTargets of objs, with the HTTPRouteGroups
+// and TCPRoutes they refer to, into CiliumNetworkPolicies allowing the
+// sources of every TrafficTarget to reach its destination through its
+// routes. The namespaces default to namespace.
+func convertSMI(objs []*unstructured.Unstructured, namespace string) (smiConversion, error) {
+	var conversion smiConversion
+	routes := make(map[string]smiRoutes)
+	var targets []*unstructured.Unstructured
+	for _, obj := range objs {
+		ns := obj.GetNamespace()
+		if ns == "" {
+			ns = namespace
+		}
+		key := smiRef(obj.GetKind(), ns, obj.GetName())
+		switch obj.GetKind() {
+		case "TrafficTarget":
+			targets = append(targets, obj)
+		case "HTTPRouteGroup":
+			var spec struct {
+				Matches []smiHTTPMatch `json:"matches"`
+			}
+			if err := smiSpec(obj, &spec); err != nil {
+				return conversion, ErrConvertSMI(err)
+			}
+			routes[key] = smiRoutes{HTTP: spec.Matches}
+		case "TCPRoute":
+			var spec struct {
+				Matches struct {
+					Ports []int `json:"ports"`
+				} `json:"matches"`
+			}
+			if err := smiSpec(obj, &spec); err != nil {
+				return conversion, ErrConvertSMI(err)
+			}
+			routes[key] = smiRoutes{Ports: spec.Matches.Ports}
+		default:
+			conversion.leaveOut(smiRef(obj.GetKind(), ns, obj.GetName()), "the kind is not supported")
+		}
+	}
+	if len(targets) == 0 {
+		return conversion, ErrConvertSMI(fmt.Errorf("no TrafficTarget found"))
+	}
+
+	for _, obj := range targets {
+		var target smiTrafficTarget
+		if err := smiSpec(obj, &target); err != nil {
+			return conversion, ErrConvertSMI(err)
+		}
+		ns := obj.GetNamespace()
+		if ns == "" {
+			ns = namespace
+		}
+		if policy := convertTrafficTarget(obj.GetName(), ns, target, routes, &conversion); policy != nil {
+			conversion.Policies = append(conversion.Policies, policy)
+		}
+	}
+	return conversion, nil
+}
+
+// convertTrafficTarget converts the TrafficTarget name of namespace, or
+// returns nil if nothing of it could be converted
+func convertTrafficTarget(name, namespace string, target smiTrafficTarget, routes map[string]smiRoutes, conversion *smiConversion) *unstructured.Unstructured {
+	ref := smiRef("TrafficTarget", namespace, name)
+	dest := target.Destination
+	if dest.Kind != "ServiceAccount" {
+		conversion.leaveOut(ref, "destination kind %q is not supported, only ServiceAccount is, the TrafficTarget is left out", dest.Kind)
+		return nil
+	}
+	destNamespace := dest.Namespace
+	if destNamespace == "" {
+		destNamespace = namespace
+	}
+
+	var peers []interface{}
+	for _, source := range target.Sources {
+		if source.Kind != "ServiceAccount" {
+			conversion.leaveOut(ref, "source kind %q is not supported, only ServiceAccount is, the source %s is left out", source.Kind, source.Name)
+			continue
+		}
+		sourceNamespace := source.Namespace
+		if sourceNamespace == "" {
+			sourceNamespace = namespace
+		}
+		peers = append(peers, map[string]interface{}{"matchLabels": map[string]interface{}{
+			"k8s:" + serviceAccountLabel: source.Name,
+			"k8s:" + podNamespaceLabel:   sourceNamespace,
+		}})
+	}
+	if len(peers) == 0 {
+		conversion.leaveOut(ref, "no source is supported, the TrafficTarget is left out")
+		return nil
+	}
+
+	var ingress []interface{}
+	for _, rule := range target.Rules {
+		routeRef := smiRef(rule.Kind, namespace, rule.Name)
+		route, ok := routes[routeRef]
+		if !ok {
+			conversion.leaveOut(ref, "%s is not part of the resources, its rule is left out", routeRef)
+			continue
+		}
+		switch rule.Kind {
+		case "HTTPRouteGroup":
+			if portRules := httpPortRules(ref, routeRef, rule, route, dest.Port, conversion); portRules != nil {
+				ingress = append(ingress, map[string]interface{}{"fromEndpoints": peers, "toPorts": portRules})
+			}
+		case "TCPRoute":
+			ports := route.Ports
+			if len(ports) == 0 && dest.Port != 0 {
+				ports = []int{dest.Port}
+			}
+			entry := map[string]interface{}{"fromEndpoints": peers}
+			if len(ports) > 0 {
+				entry["toPorts"] = []interface{}{map[string]interface{}{"ports": tcpPorts(ports)}}
+			}
+			ingress = append(ingress, entry)
+		}
+	}
+	if len(ingress) == 0 {
+		conversion.leaveOut(ref, "no rule could be converted, the TrafficTarget is left out")
+		return nil
+	}
+
+	labels := map[string]interface{}{"app.kubernetes.io/managed-by": manifestFieldManager}
+	for key, value := range map[string]string{smiTargetLabel: name, smiNamespaceLabel: namespace} {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": policyAPIVersion,
+		"kind":       "CiliumNetworkPolicy",
+		"metadata": map[string]interface{}{
+			"name":        smiPolicyPrefix + name,
+			"namespace":   destNamespace,
+			"labels":      labels,
+			"annotations": map[string]interface{}{smiSourceAnnotation: ref},
+		},
+		"spec": map[string]interface{}{
+			"description": fmt.Sprintf("Converted from the SMI %s", ref),
+			"endpointSelector": map[string]interface{}{"matchLabels": map[string]interface{}{
+				"k8s:" + serviceAccountLabel: dest.Name,
+			}},
+			"ingress": ingress,
+		},
+	}}
+}
+
+// httpPortRules converts the matches of the HTTPRouteGroup route selected
+// by rule into the L7 rules of port, or returns nil if none could be
+func httpPortRules(ref, routeRef string, rule smiRule, route smiRoutes, port int, conversion *smiConversion) []interface{} {
+	if port == 0 {
+		conversion.leaveOut(ref, "%s needs the port of the destination, which cilium enforces HTTP rules on, its rule is left out", routeRef)
+		return nil
+	}
+	selected := make(map[string]bool, len(rule.Matches))
+	for _, name := range rule.Matches {
+		selected[name] = true
+	}
+	found := make(map[string]bool)
+	var http []interface{}
+	for _, match := range route.HTTP {
+		if len(selected) > 0 && !selected[match.Name] {
+			continue
+		}
+		found[match.Name] = true
+		var headers []interface{}
+		var regexps []string
+		names := make([]string, 0, len(match.Headers))
+		for header := range match.Headers {
+			names = append(names, header)
+		}
+		sort.Strings(names)
+		for _, header := range names {
+			if value := match.Headers[header]; hasRegexp(value) {
+				regexps = append(regexps, header)
+			} else {
+				headers = append(headers, fmt.Sprintf("%s: %s", header, value))
+			}
+		}
+		if len(regexps) > 0 {
+			conversion.leaveOut(routeRef, "match %s matches the headers %s with regular expressions, which cilium does not support, the match is left out", match.Name, strings.Join(regexps, ", "))
+			continue
+		}
+		methods := match.Methods
+		if len(methods) == 0 {
+			methods = []string{"*"}
+		}
+		for _, method := range methods {
+			entry := make(map[string]interface{})
+			if method != "*" {
+				entry["method"] = strings.ToUpper(method)
+			}
+			if match.PathRegex != "" {
+				entry["path"] = match.PathRegex
+			}
+			if len(headers) > 0 {
+				entry["headers"] = headers
+			}
+			http = append(http, entry)
+		}
+	}
+	for name := range selected {
+		if !found[name] {
+			conversion.leaveOut(ref, "%s has no match %s", routeRef, name)
+		}
+	}
+	if len(http) == 0 {
+		conversion.leaveOut(ref, "no match of %s could be converted, its rule is left out", routeRef)
+		return nil
+	}
+	return []interface{}{map[string]interface{}{
+		"ports": tcpPorts([]int{port}),
+		"rules": map[string]interface{}{"http": http},
+	}}
+}
+
+// tcpPorts returns the TCP ports of a port rule
+func tcpPorts(ports []int) []interface{} {
+	entries := make([]interface{}, 0, len(ports))
+	for _, port := range ports {
+		entries = append(entries, map[string]interface{}{"port": fmt.Sprint(port), "protocol": "TCP"})
+	}
+	return entries
+}
+
+// applySMI converts the SMI resources objs into CiliumNetworkPolicies and
+// applies them, or deletes them if del is set. The outcome of every policy
+// is returned along with the constructs left out.
+func (h *Handler) applySMI(ctx context.Context, namespace string, objs []*unstructured.Unstructured, del bool) ([]string, error) {
+	conversion, err := convertSMI(objs, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var lines, failed []string
+	for _, r := range h.applyPolicyObjects(ctx, namespace, conversion.Policies, del) {
+		lines = append(lines, r.String())
+		if r.Err != nil {
+			failed = append(failed, r.String())
+		}
+	}
+	for _, unsupported := range conversion.Unsupported {
+		lines = append(lines, "Unsupported: "+unsupported)
+	}
+	if len(failed) > 0 {
+		return lines, ErrCiliumPolicy(fmt.Errorf("%s", strings.Join(failed, "; ")))
+	}
+	if len(conversion.Policies) == 0 {
+		return lines, ErrConvertSMI(fmt.Errorf("no TrafficTarget could be converted"))
+	}
+	return lines, nil
+}
+
+// smiRequest holds the parameters of the SMI conversion operation, read
+// from the custom body of the request
+type smiRequest struct {
+	// Manifest holds the TrafficTargets along with the HTTPRouteGroups
+	// and TCPRoutes they refer to, as YAML documents
+	Manifest string `yaml:"manifest"`
+
+	// DryRun reports the policies the resources convert to, without
+	// applying them
+	DryRun bool `yaml:"dryRun"`
+}
+
+// smiPolicies converts the SMI resources of the custom body into
+// CiliumNetworkPolicies and applies them, or deletes them if del is set.
+// The resources which set no namespace belong to namespace.
+func (h *Handler) smiPolicies(namespace, customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while converting the SMI resources"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req smiRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(namespace); err != nil {
+		fail(err)
+		return
+	}
+	if namespace == "" {
+		namespace = defaultSampleNamespace
+	}
+	objs, err := manifestObjects(req.Manifest)
+	if err != nil {
+		fail(ErrConvertSMI(err))
+		return
+	}
+
+	if req.DryRun {
+		conversion, err := convertSMI(objs, namespace)
+		if err != nil {
+			fail(err)
+			return
+		}
+		docs := make([]string, 0, len(conversion.Policies))
+		for _, policy := range conversion.Policies {
+			doc, err := yaml.Marshal(policy.Object)
+			if err != nil {
+				fail(ErrConvertSMI(err))
+				return
+			}
+			docs = append(docs, string(doc))
+		}
+		lines := make([]string, 0, len(conversion.Unsupported))
+		for _, unsupported := range conversion.Unsupported {
+			lines = append(lines, "Unsupported: "+unsupported)
+		}
+		e.Summary = fmt.Sprintf("The SMI resources convert to %d CiliumNetworkPolicies", len(conversion.Policies))
+		e.Details = fmt.Sprintf("%s\n---\n%s", strings.Join(lines, "\n"), strings.Join(docs, "---\n"))
+		h.StreamInfo(e)
+		return
+	}
+
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+	lines, err := h.applySMI(context.Background(), namespace, objs, del)
+	if err != nil {
+		e.Summary = "Error while applying the policies converted from SMI"
+		e.Details = fmt.Sprintf("%s\n%s", err, strings.Join(lines, "\n"))
+		h.StreamErr(e, err)
+		return
+	}
+	e.Summary = "Policies converted from SMI applied successfully"
+	if del {
+		e.Summary = "Policies converted from SMI removed successfully"
+	}
+	e.Details = strings.Join(lines, "\n")
+	h.StreamInfo(e)
+}
@@ -0,0 +1,303 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const smiHTTPRoutes = `apiVersion: specs.smi-spec.io/v1alpha4
+kind: HTTPRouteGroup
+metadata:
+  name: api
+spec:
+  matches:
+  - name: metrics
+    pathRegex: /metrics
+    methods: [GET]
+    headers:
+      x-tenant: acme
+  - name: everything
+    methods: ["*"]
+  - name: writes
+    pathRegex: /api/.*
+    methods: [put, post]
+  - name: android
+    headers:
+      user-agent: ".*Android.*"
+  - name: unselected
+    pathRegex: /admin
+`
+
+const smiTCPRoutes = `apiVersion: specs.smi-spec.io/v1alpha4
+kind: TCPRoute
+metadata:
+  name: redis
+spec:
+  matches:
+    ports: [6379, 26379]
+---
+apiVersion: specs.smi-spec.io/v1alpha4
+kind: TCPRoute
+metadata:
+  name: any
+spec: {}
+`
+
+// smiTarget returns a TrafficTarget of the default namespace from the
+// service account api to the given destination, sources and rules
+func smiTarget(destination, sources, rules string) string {
+	return `apiVersion: access.smi-spec.io/v1alpha3
+kind: TrafficTarget
+metadata:
+  name: api
+spec:
+  destination:
+    kind: ServiceAccount
+    name: api
+` + destination + `
+  sources:
+` + sources + `
+  rules:
+` + rules + "\n"
+}
+
+const smiFrontend = `  - kind: ServiceAccount
+    name: frontend`
+
+// smiPeer returns the endpoint selector of the service account name of
+// namespace
+func smiPeer(name, namespace string) interface{} {
+	return map[string]interface{}{"matchLabels": map[string]interface{}{
+		"k8s:" + serviceAccountLabel: name,
+		"k8s:" + podNamespaceLabel:   namespace,
+	}}
+}
+
+func convertSMIManifest(t *testing.T, manifest string) smiConversion {
+	t.Helper()
+	objs, err := manifestObjects(manifest)
+	if err != nil {
+		t.Fatalf("manifestObjects: %v", err)
+	}
+	conversion, err := convertSMI(objs, "default")
+	if err != nil {
+		t.Fatalf("convertSMI: %v", err)
+	}
+	return conversion
+}
+
+// ingressOf returns the ingress rules of the only policy of conversion
+func ingressOf(t *testing.T, conversion smiConversion) []interface{} {
+	t.Helper()
+	if len(conversion.Policies) != 1 {
+		t.Fatalf("converted %d policies, want 1, left out %q", len(conversion.Policies), conversion.Unsupported)
+	}
+	return conversion.Policies[0].Object["spec"].(map[string]interface{})["ingress"].([]interface{})
+}
+
+func hasUnsupported(conversion smiConversion, want string) bool {
+	for _, unsupported := range conversion.Unsupported {
+		if strings.Contains(unsupported, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConvertSMIHTTPRouteGroup(t *testing.T) {
+	rules := `  - kind: HTTPRouteGroup
+    name: api
+    matches: [metrics, everything, writes, android, missing]`
+	manifest := smiTarget("    port: 8080", smiFrontend, rules) + "---\n" + smiHTTPRoutes
+	conversion := convertSMIManifest(t, manifest)
+	ingress := ingressOf(t, conversion)
+
+	policy := conversion.Policies[0]
+	if policy.GetName() != smiPolicyPrefix+"api" || policy.GetNamespace() != "default" {
+		t.Errorf("policy %s/%s, want default/%sapi", policy.GetNamespace(), policy.GetName(), smiPolicyPrefix)
+	}
+	want := []interface{}{map[string]interface{}{
+		"fromEndpoints": []interface{}{smiPeer("frontend", "default")},
+		"toPorts": []interface{}{map[string]interface{}{
+			"ports": []interface{}{map[string]interface{}{"port": "8080", "protocol": "TCP"}},
+			"rules": map[string]interface{}{"http": []interface{}{
+				map[string]interface{}{"method": "GET", "path": "/metrics", "headers": []interface{}{"x-tenant: acme"}},
+				map[string]interface{}{},
+				map[string]interface{}{"method": "PUT", "path": "/api/.*"},
+				map[string]interface{}{"method": "POST", "path": "/api/.*"},
+			}},
+		}},
+	}}
+	if !reflect.DeepEqual(ingress, want) {
+		t.Errorf("ingress = %v, want %v", ingress, want)
+	}
+	if !hasUnsupported(conversion, "match android matches the headers user-agent with regular expressions") {
+		t.Errorf("left out %q, want the android match for its header regex", conversion.Unsupported)
+	}
+	if !hasUnsupported(conversion, "HTTPRouteGroup default/api has no match missing") {
+		t.Errorf("left out %q, want the missing match", conversion.Unsupported)
+	}
+}
+
+func TestConvertSMIHTTPRouteGroupLeftOut(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		matches     string
+		unsupported string
+	}{
+		{
+			name:        "destination without port",
+			matches:     "[metrics]",
+			unsupported: "needs the port of the destination",
+		},
+		{
+			name:        "header regex",
+			destination: "    port: 8080",
+			matches:     "[android]",
+			unsupported: "no match of HTTPRouteGroup default/api could be converted",
+		},
+		{
+			name:        "missing match",
+			destination: "    port: 8080",
+			matches:     "[missing]",
+			unsupported: "has no match missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := "  - kind: HTTPRouteGroup\n    name: api\n    matches: " + tt.matches
+			conversion := convertSMIManifest(t, smiTarget(tt.destination, smiFrontend, rules)+"---\n"+smiHTTPRoutes)
+			if len(conversion.Policies) != 0 {
+				t.Errorf("converted %d policies, want the TrafficTarget left out", len(conversion.Policies))
+			}
+			for _, want := range []string{tt.unsupported, "no rule could be converted"} {
+				if !hasUnsupported(conversion, want) {
+					t.Errorf("left out %q, want %q", conversion.Unsupported, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertSMIAllMatches(t *testing.T) {
+	rules := "  - kind: HTTPRouteGroup\n    name: api"
+	conversion := convertSMIManifest(t, smiTarget("    port: 8080", smiFrontend, rules)+"---\n"+smiHTTPRoutes)
+	toPorts := ingressOf(t, conversion)[0].(map[string]interface{})["toPorts"].([]interface{})
+	http := toPorts[0].(map[string]interface{})["rules"].(map[string]interface{})["http"].([]interface{})
+	if last := http[len(http)-1]; !reflect.DeepEqual(last, map[string]interface{}{"path": "/admin"}) {
+		t.Errorf("last rule = %v, want the unselected match once no match is named", last)
+	}
+}
+
+func TestConvertSMITCPRoute(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		route       string
+		toPorts     interface{}
+	}{
+		{
+			name:  "ports",
+			route: "redis",
+			toPorts: []interface{}{map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": "6379", "protocol": "TCP"},
+				map[string]interface{}{"port": "26379", "protocol": "TCP"},
+			}}},
+		},
+		{
+			name:        "destination port",
+			destination: "    port: 9090",
+			route:       "any",
+			toPorts: []interface{}{map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": "9090", "protocol": "TCP"},
+			}}},
+		},
+		{name: "any port", route: "any"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := "  - kind: TCPRoute\n    name: " + tt.route
+			conversion := convertSMIManifest(t, smiTarget(tt.destination, smiFrontend, rules)+"---\n"+smiTCPRoutes)
+			want := map[string]interface{}{"fromEndpoints": []interface{}{smiPeer("frontend", "default")}}
+			if tt.toPorts != nil {
+				want["toPorts"] = tt.toPorts
+			}
+			if got := ingressOf(t, conversion); !reflect.DeepEqual(got, []interface{}{want}) {
+				t.Errorf("ingress = %v, want %v", got, []interface{}{want})
+			}
+		})
+	}
+}
+
+func TestConvertSMISources(t *testing.T) {
+	sources := `  - kind: ServiceAccount
+    name: frontend
+    namespace: web
+  - kind: Group
+    name: admins`
+	rules := "  - kind: TCPRoute\n    name: redis"
+	conversion := convertSMIManifest(t, smiTarget("", sources, rules)+"---\n"+smiTCPRoutes)
+	peers := ingressOf(t, conversion)[0].(map[string]interface{})["fromEndpoints"]
+	if want := []interface{}{smiPeer("frontend", "web")}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("peers = %v, want %v", peers, want)
+	}
+	if !hasUnsupported(conversion, `source kind "Group" is not supported, only ServiceAccount is, the source admins is left out`) {
+		t.Errorf("left out %q, want the Group source", conversion.Unsupported)
+	}
+
+	conversion = convertSMIManifest(t, smiTarget("", "  - kind: Group\n    name: admins", rules)+"---\n"+smiTCPRoutes)
+	if len(conversion.Policies) != 0 || !hasUnsupported(conversion, "no source is supported") {
+		t.Errorf("converted %d policies and left out %q, want the TrafficTarget left out", len(conversion.Policies), conversion.Unsupported)
+	}
+}
+
+func TestConvertSMIMissingRoute(t *testing.T) {
+	rules := `  - kind: TCPRoute
+    name: redis
+  - kind: HTTPRouteGroup
+    name: missing`
+	conversion := convertSMIManifest(t, smiTarget("    port: 8080", smiFrontend, rules)+"---\n"+smiTCPRoutes)
+	if ingress := ingressOf(t, conversion); len(ingress) != 1 {
+		t.Errorf("converted %d rules, want only the TCPRoute one", len(ingress))
+	}
+	if !hasUnsupported(conversion, "HTTPRouteGroup default/missing is not part of the resources, its rule is left out") {
+		t.Errorf("left out %q, want the missing route", conversion.Unsupported)
+	}
+}
+
+func TestConvertSMIErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{name: "no TrafficTarget", manifest: smiTCPRoutes},
+		{name: "v1alpha1 TrafficTarget", manifest: "apiVersion: access.smi-spec.io/v1alpha1\nkind: TrafficTarget\nmetadata:\n  name: api\ndestination:\n  kind: ServiceAccount\n  name: api\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs, err := manifestObjects(tt.manifest)
+			if err != nil {
+				t.Fatalf("manifestObjects: %v", err)
+			}
+			if _, err := convertSMI(objs, "default"); errorCode(err) != ErrConvertSMICode {
+				t.Errorf("error = %v, want %s", err, ErrConvertSMICode)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// starWarsRecordConfigMap records, in the namespace of the demo, the
+// revision of the manifest applied and the resources it created
+const starWarsRecordConfigMap = "cilium-starwars-demo"
+
+// starWarsRequest holds the parameters of the Star Wars demo operation,
+// read from the custom body of the request
+type starWarsRequest struct {
+	// Ref of the cilium repo the manifest is read at. It defaults to the
+	// one of the previous run, else to the tag of the installed cilium.
+	Ref string `yaml:"ref"`
+
+	// Timeout bounds the wait for the demo pods, like 5m
+	Timeout string `yaml:"timeout"`
+
+	// Offline applies the manifest embedded in the adapter for the minor
+	// of ref, without reaching github. It is applied as well when github
+	// cannot be reached.
+	Offline bool `yaml:"offline"`
+
+	sampleAppOptions `yaml:",inline"`
+}
+
+// starWarsRecord is what a run of the demo applied
+type starWarsRecord struct {
+	Ref       string
+	Path      string
+	Digest    string
+	Resources []inventoryEntry
+}
+
+// readStarWarsRecord returns the record of the demo in namespace, or nil
+// if it was not deployed there
+func (h *Handler) readStarWarsRecord(ctx context.Context, namespace string) (*starWarsRecord, error) {
+	cm, err := h.KubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, starWarsRecordConfigMap, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &starWarsRecord{Ref: cm.Data["ref"], Path: cm.Data["path"], Digest: cm.Data["digest"]}
+	if err := json.Unmarshal([]byte(cm.Data["resources"]), &record.Resources); err != nil {
+		return nil, fmt.Errorf("resources of %s/%s: %w", namespace, starWarsRecordConfigMap, err)
+	}
+	return record, nil
+}
+
+// writeStarWarsRecord records record as the demo of namespace
+func (h *Handler) writeStarWarsRecord(ctx context.Context, namespace string, record *starWarsRecord) error {
+	resources, err := json.Marshal(record.Resources)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      starWarsRecordConfigMap,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": manifestFieldManager},
+		},
+		Data: map[string]string{
+			"ref":       record.Ref,
+			"path":      record.Path,
+			"digest":    record.Digest,
+			"resources": string(resources),
+		},
+	}
+
+	client := h.KubeClient.CoreV1().ConfigMaps(namespace)
+	existing, err := client.Get(ctx, starWarsRecordConfigMap, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	case err == nil:
+		existing.Labels = cm.Labels
+		existing.Data = cm.Data
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// starWarsRef returns the ref of the cilium repo the demo is read at: the
+// requested one, else the one of the previous run, else the tag of the
+// installed cilium, which never moves unlike its branch
+func (h *Handler) starWarsRef(ctx context.Context, requested string, record *starWarsRecord) (string, error) {
+	switch {
+	case requested != "":
+		return requested, nil
+	case record != nil && record.Ref != "":
+		return record.Ref, nil
+	}
+	found, err := h.detectCilium(ctx)
+	if err != nil {
+		return "", ErrDetectCilium(err)
+	}
+	if !found.Detected || found.Version == "" {
+		return "", ErrCiliumNotInstalled(h.ciliumNamespace(""))
+	}
+	return "v" + strings.TrimPrefix(found.Version, "v"), nil
+}
+
+// starWarsApp deploys the Star Wars demo of the cilium tutorials in
+// namespace, or removes what it deployed there if del is set, and waits
+// for its pods to become ready
+func (h *Handler) starWarsApp(namespace, customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while deploying the Star Wars demo"
+		if del {
+			e.Summary = "Error while removing the Star Wars demo"
+		}
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req starWarsRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(namespace); err != nil {
+		fail(err)
+		return
+	}
+	if err := req.sampleAppOptions.check(); err != nil {
+		fail(err)
+		return
+	}
+	namespace = req.sampleAppOptions.namespace(namespace)
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	record, err := h.readStarWarsRecord(ctx, namespace)
+	if err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+	if del {
+		if record == nil {
+			fail(ErrSampleApp(fmt.Errorf("the Star Wars demo was not deployed in namespace %s", namespace)))
+			return
+		}
+		if err := h.removeStarWarsApp(ctx, namespace, record); err != nil {
+			fail(ErrSampleApp(err))
+			return
+		}
+		e.Summary = "Star Wars demo removed successfully"
+		e.Details = fmt.Sprintf("The %d resources of %s at %s were removed from namespace %s.", len(record.Resources), record.Path, record.Ref, namespace)
+		h.StreamInfo(e)
+		return
+	}
+
+	ref, err := h.starWarsRef(ctx, req.Ref, record)
+	if err != nil {
+		fail(err)
+		return
+	}
+	h.streamProgress(e, "Fetching the Star Wars demo", fmt.Sprintf("The %s sample of cilium/cilium at %s", sampleStarWars, ref))
+	file, err := h.sampleManifest(ctx, ref, sampleStarWars, req.Offline)
+	if err != nil {
+		fail(err)
+		return
+	}
+	sum := sha256.Sum256([]byte(file.Content))
+	digest := hex.EncodeToString(sum[:])
+	var warnings []string
+	if warning := embeddedSampleWarning(file, ref); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	if record != nil && record.Ref == ref && record.Digest != digest {
+		warnings = append(warnings, fmt.Sprintf("Warning: %s at %s changed since the previous run, set ref to a tag or a commit for the runs to apply the same manifest.", file.Path, ref))
+	}
+	objs, err := manifestObjects(file.Content)
+	if err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+	if err := req.sampleAppOptions.rewrite(objs, namespace); err != nil {
+		fail(err)
+		return
+	}
+
+	applied := &starWarsRecord{Ref: ref, Path: file.Path, Digest: digest}
+	if record != nil {
+		for _, entry := range record.Resources {
+			// The namespace created by the first run stays with the demo,
+			// so does the policy applied by the L7 policy operation
+			if (entry.Kind == "Namespace" && entry.Name == namespace) || entry.Kind == "CiliumNetworkPolicy" {
+				applied.Resources = append(applied.Resources, entry)
+			}
+		}
+	}
+	if _, err := h.KubeClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{}); kerrors.IsNotFound(err) {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+		if _, err := h.KubeClient.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil {
+			fail(ErrSampleApp(err))
+			return
+		}
+		applied.Resources = append(applied.Resources, inventoryEntry{APIVersion: "v1", Kind: "Namespace", Name: namespace})
+	}
+
+	h.streamProgress(e, "Applying the Star Wars demo", fmt.Sprintf("Applying %d resources in namespace %s", len(objs), namespace))
+	mapper := h.newManifestMapper()
+	for _, obj := range objs {
+		labelSampleObject(obj, config.CiliumStarWarsOperation, namespace)
+		entry, err := h.applyObject(ctx, mapper, namespace, obj)
+		if err != nil {
+			// What was applied is recorded for the delete to remove it
+			if record != nil {
+				applied.Resources = unionEntries(applied.Resources, record.Resources)
+			}
+			err = fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)
+			if werr := h.writeStarWarsRecord(ctx, namespace, applied); werr != nil {
+				err = fmt.Errorf("%w, %s", err, werr)
+			}
+			fail(ErrSampleApp(err))
+			return
+		}
+		applied.Resources = append(applied.Resources, entry)
+	}
+	if record != nil {
+		stale := subtractEntries(record.Resources, applied.Resources)
+		for i, r := range h.deleteEntries(ctx, mapper, stale) {
+			if r.Err != nil {
+				applied.Resources = append(applied.Resources, stale[i])
+				warnings = append(warnings, fmt.Sprintf("Warning: %s of the previous run could not be removed: %s", stale[i], r.Err))
+			}
+		}
+	}
+	if err := h.writeStarWarsRecord(ctx, namespace, applied); err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+
+	h.streamProgress(e, "Waiting for the Star Wars demo", "")
+	if err := h.waitForStarWarsApp(namespace, applied.Resources, timeout); err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+
+	e.Summary = "Star Wars demo deployed successfully"
+	e.Details = fmt.Sprintf("%s of cilium/cilium at %s (sha256 %s) runs in namespace %s, the next runs apply it again unless ref is set. Land the xwing with:\nkubectl -n %[4]s exec xwing -- curl -s -XPOST deathstar.%[4]s.svc.cluster.local/v1/request-landing", applied.Path, ref, digest, namespace)
+	if len(warnings) > 0 {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, strings.Join(warnings, "\n"))
+	}
+	h.StreamInfo(e)
+}
+
+// waitForStarWarsApp waits for the Deployments and the Pods of entries in
+// namespace to become ready
+func (h *Handler) waitForStarWarsApp(namespace string, entries []inventoryEntry, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, entry := range entries {
+		var err error
+		switch entry.Kind {
+		case "Deployment":
+			err = h.waitForDeployment(namespace, entry.Name, time.Until(deadline))
+		case "Pod":
+			err = h.waitForPodReady(namespace, entry.Name, time.Until(deadline))
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not ready: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+// waitForPodReady waits for the pod name of namespace to be ready
+func (h *Handler) waitForPodReady(namespace, name string, timeout time.Duration) error {
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		pod, err := h.KubeClient.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return podReady(pod), nil
+	})
+}
+
+// podReady reports whether pod is ready
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// removeStarWarsApp deletes the resources record lists, then the record
+// unless some of them are left
+func (h *Handler) removeStarWarsApp(ctx context.Context, namespace string, record *starWarsRecord) error {
+	var left []inventoryEntry
+	var failed []string
+	for i, r := range h.deleteEntries(ctx, h.newManifestMapper(), record.Resources) {
+		if r.Err != nil {
+			left = append(left, record.Resources[i])
+			failed = append(failed, r.String())
+		}
+	}
+	if len(left) > 0 {
+		record.Resources = left
+		if err := h.writeStarWarsRecord(ctx, namespace, record); err != nil {
+			failed = append(failed, err.Error())
+		}
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+
+	err := h.KubeClient.CoreV1().ConfigMaps(namespace).Delete(ctx, starWarsRecordConfigMap, metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
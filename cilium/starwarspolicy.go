@@ -0,0 +1,241 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// starWarsClient is the pod of the demo the requests are sent from, which
+// the policy lets land but not reach the exhaust port
+const starWarsClient = "tiefighter"
+
+// starWarsPolicyRequest holds the parameters of the Star Wars L7 policy
+// operation, read from the custom body of the request
+type starWarsPolicyRequest struct {
+	// Namespace the Star Wars demo runs in, the one of the request by
+	// default
+	Namespace string `yaml:"namespace"`
+
+	// Timeout bounds the wait for the policy to be enforced, like 1m
+	Timeout string `yaml:"timeout"`
+
+	// Offline applies the policy embedded in the adapter, like the demo
+	Offline bool `yaml:"offline"`
+}
+
+// starWarsChecks requests the landing and the exhaust port of the
+// deathstar of namespace from the tiefighter, until the landing is allowed
+// and the exhaust port refused if enforced is set, or answered otherwise,
+// or until timeout
+func (h *Handler) starWarsChecks(ctx context.Context, namespace string, enforced bool, timeout time.Duration) ([]connectivityCheck, error) {
+	pod, err := h.KubeClient.CoreV1().Pods(namespace).Get(ctx, starWarsClient, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pod.Status.Phase != corev1.PodRunning || len(pod.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("the %s pod of namespace %s is not running", starWarsClient, namespace)
+	}
+	deathstar := fmt.Sprintf("deathstar.%s.svc.cluster.local", namespace)
+	exhaustPort := httpAnswered
+	if enforced {
+		exhaustPort = httpRefused
+	}
+	requests := []struct {
+		name, method, url string
+		ok                func(string) bool
+	}{
+		{"landing", "POST", deathstar + "/v1/request-landing", httpOK},
+		{"exhaust port", "PUT", deathstar + "/v1/exhaust-port", exhaustPort},
+	}
+
+	checks := make([]connectivityCheck, len(requests))
+	_ = wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		done := true
+		for i, r := range requests {
+			status := h.curlMethod(pod, pod.Spec.Containers[0].Name, r.method, r.url)
+			verdict := "allowed"
+			if httpRefused(status) || httpDropped(status) {
+				verdict = "denied"
+			}
+			checks[i] = connectivityCheck{Name: r.name, Passed: r.ok(status), Detail: fmt.Sprintf("%s %s: %s (%s)", r.method, r.url, verdict, status)}
+			done = done && checks[i].Passed
+		}
+		return done, nil
+	})
+	return checks, nil
+}
+
+// starWarsPolicy applies the L7 policy of the Star Wars demo deployed in
+// namespace, or removes it if del is set, and checks from the tiefighter
+// which requests the deathstar answers
+func (h *Handler) starWarsPolicy(namespace, customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while applying the Star Wars L7 policy"
+		if del {
+			e.Summary = "Error while removing the Star Wars L7 policy"
+		}
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req starWarsPolicyRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	timeout := policyTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = parseTimeout(req.Timeout); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if req.Namespace != "" {
+		namespace = req.Namespace
+	}
+	if err := validateNamespace(namespace); err != nil {
+		fail(err)
+		return
+	}
+	if namespace == "" {
+		namespace = defaultSampleNamespace
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	record, err := h.readStarWarsRecord(ctx, namespace)
+	if err == nil && record == nil {
+		err = fmt.Errorf("the Star Wars demo is not deployed in namespace %s, run the %s operation first", namespace, config.CiliumStarWarsOperation)
+	}
+	if err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+
+	var policies []inventoryEntry
+	var warning string
+	if del {
+		var kept []inventoryEntry
+		for _, entry := range record.Resources {
+			if entry.Kind == "CiliumNetworkPolicy" {
+				policies = append(policies, entry)
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		if len(policies) == 0 {
+			fail(ErrSampleApp(fmt.Errorf("the Star Wars L7 policy is not applied in namespace %s", namespace)))
+			return
+		}
+		var failed []string
+		for i, r := range h.deleteEntries(ctx, h.newManifestMapper(), policies) {
+			if r.Err != nil {
+				kept = append(kept, policies[i])
+				failed = append(failed, r.String())
+			}
+		}
+		record.Resources = kept
+		if err := h.writeStarWarsRecord(ctx, namespace, record); err != nil {
+			failed = append(failed, err.Error())
+		}
+		if len(failed) > 0 {
+			fail(ErrSampleApp(fmt.Errorf("%s", strings.Join(failed, "; "))))
+			return
+		}
+	} else {
+		h.streamProgress(e, "Applying the Star Wars L7 policy", fmt.Sprintf("The %s sample of cilium/cilium at %s", sampleStarWarsL7Policy, record.Ref))
+		file, err := h.sampleManifest(ctx, record.Ref, sampleStarWarsL7Policy, req.Offline)
+		if err != nil {
+			fail(err)
+			return
+		}
+		warning = embeddedSampleWarning(file, record.Ref)
+		objs, err := manifestObjects(file.Content)
+		if err != nil {
+			fail(ErrSampleApp(err))
+			return
+		}
+		mapper := h.newManifestMapper()
+		for _, obj := range objs {
+			if obj.GetNamespace() != "" {
+				obj.SetNamespace(namespace)
+			}
+			labelSampleObject(obj, config.CiliumStarWarsOperation, namespace)
+			entry, err := h.applyObject(ctx, mapper, namespace, obj)
+			if meta.IsNoMatchError(err) {
+				err = fmt.Errorf("the CiliumNetworkPolicy CRD is not installed, install cilium first: %w", err)
+			}
+			if err != nil {
+				fail(ErrSampleApp(fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)))
+				return
+			}
+			policies = append(policies, entry)
+		}
+		// The policy goes along with the demo when it is removed
+		record.Resources = unionEntries(record.Resources, policies)
+		if err := h.writeStarWarsRecord(ctx, namespace, record); err != nil {
+			fail(ErrSampleApp(err))
+			return
+		}
+	}
+
+	h.streamProgress(e, "Checking the requests of the tiefighter", "")
+	checks, err := h.starWarsChecks(ctx, namespace, !del, timeout)
+	if err != nil {
+		fail(ErrSampleApp(err))
+		return
+	}
+	lines := make([]string, 0, len(checks))
+	passed := true
+	for _, c := range checks {
+		lines = append(lines, c.String())
+		passed = passed && c.Passed
+	}
+
+	switch {
+	case !del && !passed:
+		err := ErrPolicyNotEnforced(fmt.Errorf("%s", strings.Join(lines, "\n")))
+		fail(err)
+		return
+	case !del:
+		e.Summary = "Star Wars L7 policy enforced"
+		e.Details = fmt.Sprintf("The tiefighter may land but not reach the exhaust port of the deathstar of namespace %s:\n%s", namespace, strings.Join(lines, "\n"))
+		if warning != "" {
+			e.Details = fmt.Sprintf("%s\n%s", e.Details, warning)
+		}
+	case !passed:
+		e.Summary = "Star Wars L7 policy removed"
+		e.Details = fmt.Sprintf("The policy was removed but the requests are not all answered yet:\n%s", strings.Join(lines, "\n"))
+	default:
+		e.Summary = "Star Wars L7 policy removed"
+		e.Details = fmt.Sprintf("Without the policy, the deathstar of namespace %s answers every request of the tiefighter:\n%s", namespace, strings.Join(lines, "\n"))
+	}
+	h.StreamInfo(e)
+}
@@ -0,0 +1,416 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// statusCacheTTL is how long a status report is served again, so that
+	// the polls of the UI do not exec into every agent
+	statusCacheTTL = 15 * time.Second
+
+	// statusConcurrency bounds the agents queried at once
+	statusConcurrency = 8
+)
+
+// agentStatusJSON is the part of the output of cilium status -o json the
+// report is made of
+type agentStatusJSON struct {
+	Cilium               *componentStatus `json:"cilium"`
+	Kubernetes           *componentStatus `json:"kubernetes"`
+	KubeProxyReplacement *struct {
+		Mode string `json:"mode"`
+	} `json:"kube-proxy-replacement"`
+	Encryption *struct {
+		Mode string `json:"mode"`
+	} `json:"encryption"`
+	Hubble *componentStatus `json:"hubble"`
+	IPAM   *struct {
+		IPv4        []string          `json:"ipv4"`
+		Allocations map[string]string `json:"allocations"`
+	} `json:"ipam"`
+	Controllers []struct {
+		Name   string `json:"name"`
+		Status struct {
+			ConsecutiveFailureCount int    `json:"consecutive-failure-count"`
+			LastFailureMsg          string `json:"last-failure-msg"`
+		} `json:"status"`
+	} `json:"controllers"`
+}
+
+// componentStatus is the state of a component of an agent
+type componentStatus struct {
+	State string `json:"state"`
+	Msg   string `json:"msg"`
+}
+
+// ok reports whether the component is up
+func (c *componentStatus) ok() bool {
+	return c != nil && strings.EqualFold(c.State, "Ok")
+}
+
+// nodeStatus is the status of the agent of a node
+type nodeStatus struct {
+	Node    string `json:"node"`
+	Pod     string `json:"pod"`
+	Healthy bool   `json:"healthy"`
+
+	// State of the agent, or why it could not be queried
+	State string `json:"state"`
+
+	KubeProxyReplacement string `json:"kubeProxyReplacement,omitempty"`
+	Encryption           string `json:"encryption,omitempty"`
+	Hubble               string `json:"hubble,omitempty"`
+
+	// MTU is the MTU the agent set up for the pods
+	MTU string `json:"mtu,omitempty"`
+
+	// IPsAllocated are the pod IPs the agent allocated, out of the
+	// IPCapacity of the pod CIDRs of its CiliumNode
+	IPsAllocated int    `json:"ipsAllocated"`
+	IPCapacity   string `json:"ipCapacity,omitempty"`
+
+	// Reachable is unset when the agent could not be queried
+	Reachable bool `json:"reachable"`
+}
+
+// statusReport aggregates the status of the agents and of the operator
+type statusReport struct {
+	Namespace string `json:"namespace"`
+	Version   string `json:"version,omitempty"`
+
+	Agents struct {
+		Total       int `json:"total"`
+		Healthy     int `json:"healthy"`
+		Unhealthy   int `json:"unhealthy"`
+		Unreachable int `json:"unreachable"`
+	} `json:"agents"`
+
+	Operator struct {
+		Ready   int32 `json:"ready"`
+		Desired int32 `json:"desired"`
+	} `json:"operator"`
+
+	// Features are the modes the agents report, joined when they differ
+	Features struct {
+		KubeProxyReplacement string `json:"kubeProxyReplacement"`
+		Encryption           string `json:"encryption"`
+		Hubble               string `json:"hubble"`
+		PolicyEnforcement    string `json:"policyEnforcement"`
+		MTU                  string `json:"mtu"`
+	} `json:"features"`
+
+	IPAM struct {
+		Allocated int    `json:"allocated"`
+		Capacity  string `json:"capacity,omitempty"`
+	} `json:"ipam"`
+
+	// Certificates are the certificates of hubble found in the namespace
+	Certificates []certificateStatus `json:"certificates,omitempty"`
+
+	Nodes    []nodeStatus `json:"nodes"`
+	Warnings []string     `json:"warnings,omitempty"`
+
+	// Summary is the report in one line, for the logs
+	Summary     string    `json:"summary"`
+	CollectedAt time.Time `json:"collectedAt"`
+}
+
+// statusCache holds the last status report of every namespace, keyed by
+// context and namespace
+type statusCache struct {
+	mu      sync.Mutex
+	reports map[string]*statusReport
+}
+
+// get returns the report of key if it is younger than statusCacheTTL
+func (c *statusCache) get(key string) *statusReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.reports[key]; ok && time.Since(r.CollectedAt) < statusCacheTTL {
+		return r
+	}
+	return nil
+}
+
+// put records the report of key
+func (c *statusCache) put(key string, r *statusReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reports == nil {
+		c.reports = make(map[string]*statusReport)
+	}
+	c.reports[key] = r
+}
+
+// statusRequest holds the parameters of the cilium status operation, read
+// from the custom body of the request
+type statusRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Refresh queries the agents even if a report was collected recently
+	Refresh bool `yaml:"refresh"`
+}
+
+// podCIDRCapacity returns the number of IPs of the pod CIDRs of every
+// CiliumNode, by node
+func (h *Handler) podCIDRCapacity(ctx context.Context) map[string]*big.Int {
+	capacity := make(map[string]*big.Int)
+	if h.DynamicKubeClient == nil {
+		return capacity
+	}
+	nodes, err := h.DynamicKubeClient.Resource(ciliumNodeResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return capacity
+	}
+	for _, node := range nodes.Items {
+		cidrs, _, _ := unstructured.NestedStringSlice(node.Object, "spec", "ipam", "podCIDRs")
+		total := new(big.Int)
+		for _, cidr := range cidrs {
+			if r, err := cidrRange(cidr); err == nil {
+				total.Add(total, r.size())
+			}
+		}
+		if total.Sign() > 0 {
+			capacity[node.GetName()] = total
+		}
+	}
+	return capacity
+}
+
+// queryAgent returns the status of the agent pod, which is unreachable if
+// it cannot be queried
+func (h *Handler) queryAgent(pod *corev1.Pod) (nodeStatus, []string) {
+	status := nodeStatus{Node: pod.Spec.NodeName, Pod: pod.Name}
+	if pod.Status.Phase != corev1.PodRunning {
+		status.State = fmt.Sprintf("agent %s", strings.ToLower(string(pod.Status.Phase)))
+		return status, nil
+	}
+	out, err := h.execPodCLI(pod, "status -o json")
+	if err != nil {
+		status.State = err.Error()
+		return status, nil
+	}
+	var s agentStatusJSON
+	if err := json.Unmarshal([]byte(out), &s); err != nil {
+		status.State = fmt.Sprintf("unreadable status: %s", err)
+		return status, nil
+	}
+
+	status.Reachable = true
+	status.Healthy = s.Cilium.ok() && s.Kubernetes.ok()
+	status.State = "Ok"
+	if s.Cilium != nil && !status.Healthy {
+		status.State = strings.TrimSpace(fmt.Sprintf("%s %s", s.Cilium.State, s.Cilium.Msg))
+	}
+	if s.KubeProxyReplacement != nil {
+		status.KubeProxyReplacement = s.KubeProxyReplacement.Mode
+	}
+	if s.Encryption != nil {
+		status.Encryption = s.Encryption.Mode
+	}
+	if s.Hubble != nil {
+		status.Hubble = s.Hubble.State
+	}
+	status.MTU = h.agentMTU(pod)
+	if s.IPAM != nil {
+		status.IPsAllocated = len(s.IPAM.IPv4)
+		if len(s.IPAM.Allocations) > status.IPsAllocated {
+			status.IPsAllocated = len(s.IPAM.Allocations)
+		}
+	}
+
+	var warnings []string
+	if s.Kubernetes != nil && !s.Kubernetes.ok() {
+		warnings = append(warnings, fmt.Sprintf("%s: kubernetes %s %s", status.Node, s.Kubernetes.State, s.Kubernetes.Msg))
+	}
+	for _, c := range s.Controllers {
+		if c.Status.ConsecutiveFailureCount > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: controller %s failing: %s", status.Node, c.Name, c.Status.LastFailureMsg))
+		}
+	}
+	return status, warnings
+}
+
+// joinModes joins the distinct non-empty modes, sorted
+func joinModes(modes []string) string {
+	seen := make(map[string]bool)
+	var distinct []string
+	for _, mode := range modes {
+		if mode != "" && !seen[mode] {
+			seen[mode] = true
+			distinct = append(distinct, mode)
+		}
+	}
+	sort.Strings(distinct)
+	return strings.Join(distinct, ", ")
+}
+
+// collectStatus queries every agent of namespace and the operator into a
+// report. The agents which cannot be queried are reported as unreachable
+// rather than failing the report.
+func (h *Handler) collectStatus(ctx context.Context, namespace string) (*statusReport, error) {
+	pods, err := h.KubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: agentSelector})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, ErrCiliumNotInstalled(namespace)
+	}
+
+	report := &statusReport{Namespace: namespace, CollectedAt: time.Now()}
+	if version, _, err := h.releaseValues(namespace); err == nil {
+		report.Version = version
+	}
+
+	statuses := make([]nodeStatus, len(pods.Items))
+	warnings := make([][]string, len(pods.Items))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, statusConcurrency)
+	for i := range pods.Items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			statuses[i], warnings[i] = h.queryAgent(&pods.Items[i])
+		}(i)
+	}
+	wg.Wait()
+
+	capacity := h.podCIDRCapacity(ctx)
+	total := new(big.Int)
+	var kpr, encryption, hubble, mtu []string
+	for i, status := range statuses {
+		if c, ok := capacity[status.Node]; ok {
+			status.IPCapacity = c.String()
+			total.Add(total, c)
+		}
+		report.Agents.Total++
+		switch {
+		case !status.Reachable:
+			report.Agents.Unreachable++
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: agent %s unreachable: %s", status.Node, status.Pod, status.State))
+		case status.Healthy:
+			report.Agents.Healthy++
+		default:
+			report.Agents.Unhealthy++
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: agent %s unhealthy: %s", status.Node, status.Pod, status.State))
+		}
+		report.IPAM.Allocated += status.IPsAllocated
+		kpr = append(kpr, status.KubeProxyReplacement)
+		encryption = append(encryption, status.Encryption)
+		hubble = append(hubble, status.Hubble)
+		mtu = append(mtu, status.MTU)
+		report.Warnings = append(report.Warnings, warnings[i]...)
+		statuses[i] = status
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Node < statuses[j].Node })
+	report.Nodes = statuses
+	if total.Sign() > 0 {
+		report.IPAM.Capacity = total.String()
+	}
+	report.Features.KubeProxyReplacement = joinModes(kpr)
+	report.Features.Encryption = joinModes(encryption)
+	report.Features.Hubble = joinModes(hubble)
+	report.Features.MTU = joinModes(mtu)
+	report.Features.PolicyEnforcement = h.policyEnforcementStatus(ctx, namespace)
+	certs, certWarnings := h.hubbleCertificates(ctx, namespace)
+	report.Certificates = certs
+	report.Warnings = append(report.Warnings, certWarnings...)
+
+	if deploy, err := h.KubeClient.AppsV1().Deployments(namespace).Get(ctx, operatorDeployment, metav1.GetOptions{}); err == nil {
+		report.Operator.Desired = 1
+		if deploy.Spec.Replicas != nil {
+			report.Operator.Desired = *deploy.Spec.Replicas
+		}
+		report.Operator.Ready = deploy.Status.ReadyReplicas
+	}
+	if report.Operator.Ready < report.Operator.Desired || report.Operator.Desired == 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("operator: %d/%d replicas ready", report.Operator.Ready, report.Operator.Desired))
+	}
+
+	ipam := fmt.Sprintf("%d IPs allocated", report.IPAM.Allocated)
+	if report.IPAM.Capacity != "" {
+		ipam = fmt.Sprintf("%d/%s IPs allocated", report.IPAM.Allocated, report.IPAM.Capacity)
+	}
+	report.Summary = fmt.Sprintf("Cilium %s in %s: %d/%d agents healthy, %d unreachable, operator %d/%d ready, %s, %d warnings",
+		report.Version, namespace, report.Agents.Healthy, report.Agents.Total, report.Agents.Unreachable,
+		report.Operator.Ready, report.Operator.Desired, ipam, len(report.Warnings))
+	return report, nil
+}
+
+// ciliumStatus reports the status of cilium as JSON, for the UI to render,
+// with its summary as the summary of the event. A report collected less
+// than statusCacheTTL ago is served again unless refresh is requested.
+func (h *Handler) ciliumStatus(customBody string, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while collecting the Cilium status"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req statusRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	key := h.cluster + "/" + namespace
+	report := h.statusCache.get(key)
+	if report == nil || req.Refresh {
+		var err error
+		report, err = h.collectStatus(context.Background(), namespace)
+		if err != nil {
+			fail(ErrCollectStatus(err))
+			return
+		}
+		h.statusCache.put(key, report)
+	}
+
+	byt, err := json.Marshal(report)
+	if err != nil {
+		fail(ErrCollectStatus(err))
+		return
+	}
+	h.Log.Info(report.Summary)
+	e.Summary = report.Summary
+	e.Details = string(byt)
+	h.StreamInfo(e)
+}
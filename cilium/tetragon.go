@@ -0,0 +1,241 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	mesherykube "github.com/layer5io/meshkit/utils/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// tetragonDaemonSet is the DaemonSet of the tetragon agents
+	tetragonDaemonSet = "tetragon"
+
+	// tetragonExportStdout prints the events in the export-stdout
+	// container of the agents, tetragonExportGRPC only serves them on the
+	// gRPC endpoint
+	tetragonExportStdout = "stdout"
+	tetragonExportGRPC   = "grpc"
+)
+
+// tracingPolicyCRDs are the CRDs of the tracing policies, either of which
+// tells that tetragon can be given policies
+var tracingPolicyCRDs = []string{
+	"tracingpolicies.cilium.io",
+	"tracingpoliciesnamespaced.cilium.io",
+}
+
+// tetragonRequest holds the parameters of the tetragon addon operation,
+// read from the custom body of the request
+type tetragonRequest struct {
+	// Namespace tetragon is installed in, kube-system by default
+	Namespace string `yaml:"namespace"`
+
+	// Version of tetragon, the latest one by default
+	Version string `yaml:"version"`
+
+	// Export is where the events go: stdout, the default, or grpc
+	Export string `yaml:"export"`
+
+	// GRPCAddress is the address the agents serve the events on, like
+	// localhost:54321 which is the default of the chart
+	GRPCAddress string `yaml:"grpcAddress"`
+
+	// Operator runs the tetragon operator, which the chart does unless set
+	// to false
+	Operator *bool `yaml:"operator"`
+
+	// Timeout bounds the rollout of the agents, like 10m
+	Timeout string `yaml:"timeout"`
+}
+
+// values translates the request into the values of the tetragon chart
+func (r tetragonRequest) values() (map[string]interface{}, error) {
+	tetragon := make(map[string]interface{})
+	values := map[string]interface{}{"tetragon": tetragon}
+	switch r.Export {
+	case "", tetragonExportStdout:
+		values["export"] = map[string]interface{}{"mode": "stdout"}
+	case tetragonExportGRPC:
+		values["export"] = map[string]interface{}{"mode": ""}
+		tetragon["grpc"] = map[string]interface{}{"enabled": true}
+	default:
+		return nil, ErrInvalidTetragon(fmt.Errorf("unknown export %q, expected %s or %s", r.Export, tetragonExportStdout, tetragonExportGRPC))
+	}
+	if r.GRPCAddress != "" {
+		if _, _, err := net.SplitHostPort(r.GRPCAddress); err != nil {
+			return nil, ErrInvalidTetragon(fmt.Errorf("gRPC address %q: %w", r.GRPCAddress, err))
+		}
+		tetragon["grpc"] = map[string]interface{}{"enabled": true, "address": r.GRPCAddress}
+	}
+	if r.Operator != nil {
+		values["tetragonOperator"] = map[string]interface{}{"enabled": *r.Operator}
+	}
+	return values, nil
+}
+
+// crdEstablished reports whether the CRD name is established
+func (h *Handler) crdEstablished(ctx context.Context, name string) bool {
+	crd, err := h.DynamicKubeClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		if condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForTetragon waits for the tetragon agents of namespace to roll out
+// and for a CRD of the tracing policies to be established
+func (h *Handler) waitForTetragon(e *adapter.Event, namespace string, timeout time.Duration) error {
+	if err := h.waitForDaemonSet(e, namespace, tetragonDaemonSet, "Tetragon agents", timeout); err != nil {
+		if problems := h.podProblems(namespace, "app.kubernetes.io/name=tetragon"); len(problems) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+		}
+		return err
+	}
+	h.streamProgress(e, "Waiting for the Tetragon CRDs", strings.Join(tracingPolicyCRDs, ", "))
+	err := wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		for _, name := range tracingPolicyCRDs {
+			if h.crdEstablished(context.Background(), name) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("no tracing policy CRD is established: %w", err)
+	}
+	return nil
+}
+
+// tetragon installs the tetragon chart, or uninstalls it if del is set, and
+// waits for its agents and CRDs. The versions are discovered from the
+// cilium/tetragon releases.
+func (h *Handler) tetragon(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while installing Tetragon"
+		if del {
+			e.Summary = "Error while uninstalling Tetragon"
+		}
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req tetragonRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	values, err := req.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil || h.MesheryKubeclient == nil {
+		fail(ErrNilClient)
+		return
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = defaultCiliumNamespace
+	}
+
+	version := req.Version
+	if version == "" && !del {
+		versions, err := config.GetTetragonVersions(context.Background(), 1)
+		if err != nil {
+			fail(ErrInstallTetragon(err))
+			return
+		}
+		if len(versions) == 0 {
+			fail(ErrInstallTetragon(fmt.Errorf("no tetragon release was found")))
+			return
+		}
+		version = string(versions[0])
+	}
+	if version != "" {
+		if _, err := config.ParseVersion(version); err != nil {
+			fail(ErrInvalidTetragon(err))
+			return
+		}
+	}
+
+	act := mesherykube.INSTALL
+	if del {
+		act = mesherykube.UNINSTALL
+	} else {
+		h.streamProgress(e, "Installing Tetragon", fmt.Sprintf("Installing version %s in namespace %s", version, namespace))
+	}
+	chartPath, err := h.locateChart(config.TetragonChartName, version)
+	if err != nil {
+		fail(ErrInstallTetragon(err))
+		return
+	}
+	err = h.MesheryKubeclient.ApplyHelmChart(mesherykube.ApplyHelmChartConfig{
+		LocalPath:       chartPath,
+		Namespace:       namespace,
+		Action:          act,
+		CreateNamespace: true,
+		ReleaseName:     config.TetragonChartName,
+		OverrideValues:  values,
+	})
+	if err != nil {
+		fail(ErrInstallTetragon(err))
+		return
+	}
+	if del {
+		e.Summary = "Tetragon uninstalled successfully"
+		e.Details = fmt.Sprintf("The %s release was removed from namespace %s.", config.TetragonChartName, namespace)
+		h.StreamInfo(e)
+		return
+	}
+
+	if err := h.waitForTetragon(e, namespace, timeout); err != nil {
+		fail(ErrInstallTetragon(err))
+		return
+	}
+	export := req.Export
+	if export == "" {
+		export = tetragonExportStdout
+	}
+	e.Summary = "Tetragon installed successfully"
+	e.Details = fmt.Sprintf("Tetragon %s runs in namespace %s, exporting its events to %s.", version, namespace, export)
+	h.StreamInfo(e)
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// uiDeployment is the Deployment and the service of the hubble ui
+const uiDeployment = "hubble-ui"
+
+// uiRequest holds the parameters of the hubble ui operation, read from the
+// custom body of the request
+type uiRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// IngressHost exposes the ui through an ingress of the chart on this
+	// host. The ui is only reachable through its ClusterIP service, by
+	// port-forwarding, if unset.
+	IngressHost string `yaml:"ingressHost"`
+
+	// IngressClassName is the class of the ingress, the default class of
+	// the cluster if unset
+	IngressClassName string `yaml:"ingressClassName"`
+
+	// Timeout bounds the rollout of the ui, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// Rollback moves the release back to its previous revision if the ui
+	// does not become ready, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+
+	hubbleTLSOptions `yaml:",inline"`
+}
+
+// values translates the request into chart values. The ingress is part of
+// the release, so that disabling the ui removes it as well.
+func (r uiRequest) values() (map[string]interface{}, error) {
+	ingress := map[string]interface{}{"enabled": false}
+	if r.IngressHost != "" {
+		if errs := validation.IsDNS1123Subdomain(r.IngressHost); len(errs) > 0 {
+			return nil, ErrInvalidHubble(fmt.Errorf("ingress host %q: %s", r.IngressHost, strings.Join(errs, ", ")))
+		}
+		ingress["enabled"] = true
+		ingress["hosts"] = []interface{}{r.IngressHost}
+		if r.IngressClassName != "" {
+			ingress["className"] = r.IngressClassName
+		}
+	}
+	hubble := map[string]interface{}{
+		"ui": map[string]interface{}{"enabled": true, "ingress": ingress},
+	}
+	if r.hubbleTLSOptions.set() {
+		tls, err := r.hubbleTLSOptions.values()
+		if err != nil {
+			return nil, err
+		}
+		hubble["tls"] = tls
+	}
+	return map[string]interface{}{"hubble": hubble}, nil
+}
+
+// uiAddress describes how the ui of namespace is reached: the URL of its
+// ingress, or the coordinates of its service to port-forward to
+func (h *Handler) uiAddress(ctx context.Context, namespace, host string) (string, error) {
+	if host != "" {
+		return fmt.Sprintf("Hubble UI is served at http://%s", host), nil
+	}
+	svc, err := h.KubeClient.CoreV1().Services(namespace).Get(ctx, uiDeployment, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return "", fmt.Errorf("the %s service exposes no port", uiDeployment)
+	}
+	port := svc.Spec.Ports[0].Port
+	return fmt.Sprintf("Hubble UI is served by the service %s/%s at %s:%d, reach it with: kubectl -n %s port-forward svc/%s 12000:%d",
+		namespace, uiDeployment, svc.Spec.ClusterIP, port, namespace, uiDeployment, port), nil
+}
+
+// ui deploys, or removes if del is set, the hubble ui on top of the
+// installed release, which requires hubble relay
+func (h *Handler) ui(customBody string, del bool, e *adapter.Event) {
+	fail := func(err error) {
+		e.Summary = "Error while configuring Hubble UI"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req uiRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	uiValues, err := req.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if del {
+		uiValues = map[string]interface{}{
+			"hubble": map[string]interface{}{
+				"ui": map[string]interface{}{
+					"enabled": false,
+					"ingress": map[string]interface{}{"enabled": false},
+				},
+			},
+		}
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.KubeClient == nil {
+		fail(ErrNilClient)
+		return
+	}
+
+	ctx := context.Background()
+	namespace := h.ciliumNamespace(req.Namespace)
+	if !h.releaseExists(namespace) {
+		fail(ErrCiliumNotInstalled(namespace))
+		return
+	}
+	var tlsDetails string
+	if !del {
+		if _, err := h.KubeClient.AppsV1().Deployments(namespace).Get(ctx, relayDeployment, metav1.GetOptions{}); err != nil {
+			fail(ErrConfigureHubbleUI(fmt.Errorf("the ui requires Hubble Relay, enable it first: %w", err)))
+			return
+		}
+		if req.hubbleTLSOptions.set() {
+			if tlsDetails, err = h.prepareHubbleTLS(ctx, namespace, req.hubbleTLSOptions, hubbleServerSecret, relayClientSecret); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+
+	_, rollback, err := h.reconfigure(e, namespace, timeout, func(string) (map[string]interface{}, error) {
+		return uiValues, nil
+	})
+	var address string
+	if err == nil && !del {
+		h.streamProgress(e, "Waiting for Hubble UI to become ready", "")
+		if err = h.waitForDeployment(namespace, uiDeployment, timeout); err != nil {
+			if problems := h.podProblems(namespace, "k8s-app="+uiDeployment); len(problems) > 0 {
+				err = fmt.Errorf("%w: %s", err, strings.Join(problems, "; "))
+			}
+			err = fmt.Errorf("the %s Deployment is not available: %w", uiDeployment, err)
+		}
+		if err == nil {
+			address, err = h.uiAddress(ctx, namespace, req.IngressHost)
+		}
+	}
+	if err != nil {
+		fail(ErrConfigureHubbleUI(err))
+		if rollback != nil && (req.Rollback == nil || *req.Rollback) {
+			rollback()
+		}
+		return
+	}
+
+	if del {
+		e.Summary = "Hubble UI removed successfully"
+		e.Details = "Hubble UI and its ingress no longer run, Hubble Relay is untouched."
+	} else {
+		e.Summary = "Hubble UI deployed successfully"
+		e.Details = address
+		if tlsDetails != "" {
+			e.Details = fmt.Sprintf("%s\n%s", e.Details, tlsDetails)
+		}
+	}
+	h.StreamInfo(e)
+}
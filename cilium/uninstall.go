@@ -0,0 +1,229 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ciliumGroup is the API group of the cilium CRDs
+const ciliumGroup = "cilium.io"
+
+// crdResource is the resource of the CustomResourceDefinitions
+var crdResource = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1",
+	Resource: "customresourcedefinitions",
+}
+
+// uninstallRequest holds the parameters of the cilium uninstall operation,
+// read from the custom body of the request. Only the helm release is
+// removed unless asked otherwise.
+type uninstallRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// RemoveCRDs deletes the cilium CRDs, and with them every cilium
+	// resource like the CiliumNetworkPolicies
+	RemoveCRDs bool `yaml:"removeCRDs"`
+
+	// RemoveConfigMaps deletes the cilium ConfigMaps left in the cilium
+	// namespace
+	RemoveConfigMaps bool `yaml:"removeConfigMaps"`
+
+	// RemoveNamespaces deletes the leftover cilium-* namespaces, like
+	// cilium-secrets, and the cilium namespace unless it is a system one
+	RemoveNamespaces bool `yaml:"removeNamespaces"`
+}
+
+// uninstallResult is the outcome of removing a single resource
+type uninstallResult struct {
+	Kind string
+	Name string
+	Err  error
+
+	// NotFound is set when the resource was already gone
+	NotFound bool
+}
+
+func (r uninstallResult) String() string {
+	switch {
+	case r.NotFound:
+		return fmt.Sprintf("%s %s: not found", r.Kind, r.Name)
+	case r.Err != nil:
+		return fmt.Sprintf("%s %s: %s", r.Kind, r.Name, r.Err)
+	default:
+		return fmt.Sprintf("%s %s: deleted", r.Kind, r.Name)
+	}
+}
+
+// newUninstallResult records the outcome of a deletion, treating missing
+// resources as already removed
+func newUninstallResult(kind, name string, err error) uninstallResult {
+	if kerrors.IsNotFound(err) {
+		return uninstallResult{Kind: kind, Name: name, NotFound: true}
+	}
+	return uninstallResult{Kind: kind, Name: name, Err: err}
+}
+
+// uninstall removes cilium along with the resources selected by the custom
+// body, reporting the outcome of every resource. A partially removed
+// installation is not an error, the resources already gone are skipped.
+func (h *Handler) uninstall(version, customBody string, e *adapter.Event) {
+	var req uninstallRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		e.Summary = "Error while uninstalling Cilium"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		e.Summary = "Error while uninstalling Cilium"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+	if h.KubeClient == nil || h.DynamicKubeClient == nil {
+		h.StreamErr(e, ErrNilClient)
+		return
+	}
+	namespace := h.ciliumNamespace(req.Namespace)
+
+	if req.RemoveCRDs {
+		h.streamProgress(e, "Removing the Cilium CRDs", "All of the CiliumNetworkPolicies and other Cilium resources of the cluster will be lost.")
+	}
+
+	ctx := context.Background()
+	inventory, err := h.readInventory(ctx, namespace)
+	if err != nil {
+		e.Summary = "Error while uninstalling Cilium"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+	var results []uninstallResult
+	if inventory != nil {
+		results = h.uninstallManifests(ctx, namespace, inventory)
+	} else {
+		results = append(results, h.uninstallRelease(version, namespace))
+	}
+	if req.RemoveCRDs {
+		results = append(results, h.removeCRDs(ctx)...)
+	}
+	if req.RemoveConfigMaps {
+		results = append(results, h.removeConfigMaps(ctx, namespace)...)
+	}
+	if req.RemoveNamespaces {
+		results = append(results, h.removeNamespaces(ctx, namespace)...)
+	}
+
+	lines := make([]string, 0, len(results))
+	var failed []string
+	for _, r := range results {
+		lines = append(lines, r.String())
+		if r.Err != nil {
+			failed = append(failed, r.String())
+		}
+	}
+	e.Details = strings.Join(lines, "\n")
+
+	if len(failed) > 0 {
+		e.Summary = "Cilium was partially uninstalled"
+		h.StreamErr(e, ErrUninstallCilium(fmt.Errorf("%s", strings.Join(failed, "; "))))
+		return
+	}
+	e.Summary = "Cilium uninstalled successfully"
+	h.StreamInfo(e)
+}
+
+// uninstallRelease deletes the cilium helm release of namespace
+func (h *Handler) uninstallRelease(version, namespace string) uninstallResult {
+	result := uninstallResult{Kind: "HelmRelease", Name: namespace + "/" + config.HelmChartName}
+	if err := h.applyHelmChart(true, version, namespace, nil); err != nil {
+		if strings.Contains(err.Error(), driver.ErrReleaseNotFound.Error()) {
+			result.NotFound = true
+			return result
+		}
+		result.Err = err
+	}
+	return result
+}
+
+// removeCRDs deletes the CRDs of the cilium API group
+func (h *Handler) removeCRDs(ctx context.Context) []uninstallResult {
+	crds, err := h.DynamicKubeClient.Resource(crdResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []uninstallResult{{Kind: "CustomResourceDefinition", Name: "*." + ciliumGroup, Err: err}}
+	}
+
+	var results []uninstallResult
+	for _, crd := range crds.Items {
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		if group != ciliumGroup {
+			continue
+		}
+		err := h.DynamicKubeClient.Resource(crdResource).Delete(ctx, crd.GetName(), metav1.DeleteOptions{})
+		results = append(results, newUninstallResult("CustomResourceDefinition", crd.GetName(), err))
+	}
+	return results
+}
+
+// removeConfigMaps deletes the cilium and hubble ConfigMaps of namespace,
+// which the agents and operator create outside of the chart
+func (h *Handler) removeConfigMaps(ctx context.Context, namespace string) []uninstallResult {
+	configMaps, err := h.KubeClient.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []uninstallResult{{Kind: "ConfigMap", Name: namespace + "/cilium-*", Err: err}}
+	}
+
+	var results []uninstallResult
+	for _, cm := range configMaps.Items {
+		if !strings.HasPrefix(cm.Name, "cilium-") && !strings.HasPrefix(cm.Name, "hubble-") {
+			continue
+		}
+		err := h.KubeClient.CoreV1().ConfigMaps(namespace).Delete(ctx, cm.Name, metav1.DeleteOptions{})
+		results = append(results, newUninstallResult("ConfigMap", namespace+"/"+cm.Name, err))
+	}
+	return results
+}
+
+// removeNamespaces deletes the cilium-* namespaces, along with the
+// namespace cilium was installed in unless it is a system namespace
+func (h *Handler) removeNamespaces(ctx context.Context, namespace string) []uninstallResult {
+	namespaces, err := h.KubeClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []uninstallResult{{Kind: "Namespace", Name: "cilium-*", Err: err}}
+	}
+
+	var results []uninstallResult
+	for _, ns := range namespaces.Items {
+		if !strings.HasPrefix(ns.Name, "cilium-") && (ns.Name != namespace || systemNamespaces[ns.Name]) {
+			continue
+		}
+		err := h.KubeClient.CoreV1().Namespaces().Delete(ctx, ns.Name, metav1.DeleteOptions{})
+		results = append(results, newUninstallResult("Namespace", ns.Name, err))
+	}
+	return results
+}
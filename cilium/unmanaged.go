@@ -0,0 +1,198 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// evictionRetryInterval is how often an eviction refused by a
+	// PodDisruptionBudget is retried
+	evictionRetryInterval = 5 * time.Second
+
+	// evictionTimeout bounds the retries of the eviction of a pod, after
+	// which it is skipped, and then the wait for it to be gone
+	evictionTimeout = 2 * time.Minute
+)
+
+// ciliumEndpointResource is the resource of the CiliumEndpoints, one per
+// pod networked by cilium
+var ciliumEndpointResource = schema.GroupVersionResource{Group: ciliumGroup, Version: "v2", Resource: "ciliumendpoints"}
+
+// restartOptions restart the pods started before cilium, which keep the
+// network of the previous CNI until they are recreated. They are part of
+// the custom body of the install requests.
+type restartOptions struct {
+	// RestartUnmanagedPods evicts, one at a time, the pods without a
+	// CiliumEndpoint once cilium is ready. Off by default.
+	RestartUnmanagedPods bool `yaml:"restartUnmanagedPods"`
+
+	// RestartExcludeNamespaces are the namespaces whose pods are never
+	// restarted
+	RestartExcludeNamespaces []string `yaml:"restartExcludeNamespaces"`
+}
+
+// skippedPod is an unmanaged pod which was not restarted
+type skippedPod struct {
+	pod    string
+	reason string
+}
+
+// restartResult lists the unmanaged pods restarted and skipped
+type restartResult struct {
+	restarted []string
+	skipped   []skippedPod
+}
+
+// String lists the pods, one per line
+func (r restartResult) String() string {
+	if len(r.restarted) == 0 && len(r.skipped) == 0 {
+		return "Unmanaged pods: none"
+	}
+	lines := []string{fmt.Sprintf("Unmanaged pods restarted: %d", len(r.restarted))}
+	for _, pod := range r.restarted {
+		lines = append(lines, "  "+pod)
+	}
+	lines = append(lines, fmt.Sprintf("Unmanaged pods skipped: %d", len(r.skipped)))
+	for _, s := range r.skipped {
+		lines = append(lines, fmt.Sprintf("  %s: %s", s.pod, s.reason))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// restartUnmanagedPods evicts the running pods which have no
+// CiliumEndpoint, one at a time, for their controller to recreate them on
+// cilium. The pods of the host network, of the excluded namespaces and of
+// namespace are left alone, as are those without a controller, which
+// would not come back.
+func (h *Handler) restartUnmanagedPods(e *adapter.Event, namespace string, o restartOptions) (restartResult, error) {
+	var result restartResult
+	if h.DynamicKubeClient == nil {
+		return result, ErrNilClient
+	}
+	ctx := context.Background()
+	endpoints, err := h.DynamicKubeClient.Resource(ciliumEndpointResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return result, err
+	}
+	managed := make(map[string]bool, len(endpoints.Items))
+	for _, ep := range endpoints.Items {
+		managed[ep.GetNamespace()+"/"+ep.GetName()] = true
+	}
+	excluded := map[string]bool{namespace: true}
+	for _, ns := range o.RestartExcludeNamespaces {
+		excluded[ns] = true
+	}
+
+	pods, err := h.KubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return result, err
+	}
+	var unmanaged []corev1.Pod
+	for _, pod := range pods.Items {
+		name := pod.Namespace + "/" + pod.Name
+		switch {
+		case pod.Spec.HostNetwork, pod.Status.Phase != corev1.PodRunning, pod.DeletionTimestamp != nil, managed[name]:
+		case excluded[pod.Namespace]:
+			result.skipped = append(result.skipped, skippedPod{name, "excluded namespace"})
+		case metav1.GetControllerOf(&pod) == nil:
+			result.skipped = append(result.skipped, skippedPod{name, "not managed by a controller"})
+		default:
+			unmanaged = append(unmanaged, pod)
+		}
+	}
+
+	for i := range unmanaged {
+		pod := &unmanaged[i]
+		name := pod.Namespace + "/" + pod.Name
+		h.streamProgress(e, "Restarting the pods unmanaged by Cilium", fmt.Sprintf("Evicting %s (%d/%d)", name, i+1, len(unmanaged)))
+		if err := h.evictPod(ctx, pod); err != nil {
+			result.skipped = append(result.skipped, skippedPod{name, err.Error()})
+			continue
+		}
+		if err := h.waitForPodGone(ctx, pod); err != nil {
+			result.skipped = append(result.skipped, skippedPod{name, fmt.Sprintf("evicted but not gone: %s", err)})
+			continue
+		}
+		result.restarted = append(result.restarted, name)
+	}
+	return result, nil
+}
+
+// evictPod evicts pod, retrying while a PodDisruptionBudget refuses it.
+// The pod is deleted instead if the cluster does not serve evictions.
+func (h *Handler) evictPod(ctx context.Context, pod *corev1.Pod) error {
+	pods := h.KubeClient.CoreV1().Pods(pod.Namespace)
+	meta := metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}
+	evict := func() error {
+		err := pods.EvictV1(ctx, &policyv1.Eviction{ObjectMeta: meta})
+		if kerrors.IsNotFound(err) {
+			// Clusters before kubernetes 1.22 only serve policy/v1beta1
+			if _, getErr := pods.Get(ctx, pod.Name, metav1.GetOptions{}); getErr == nil {
+				err = pods.EvictV1beta1(ctx, &policyv1beta1.Eviction{ObjectMeta: meta})
+			}
+		}
+		return err
+	}
+
+	var last error
+	err := wait.PollImmediate(evictionRetryInterval, evictionTimeout, func() (bool, error) {
+		last = evict()
+		switch {
+		case last == nil, kerrors.IsNotFound(last):
+			return true, nil
+		case kerrors.IsTooManyRequests(last):
+			// A PodDisruptionBudget does not allow the eviction yet
+			return false, nil
+		case kerrors.IsMethodNotSupported(last):
+			last = pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			return last == nil || kerrors.IsNotFound(last), last
+		default:
+			return false, last
+		}
+	})
+	if err == wait.ErrWaitTimeout && last != nil {
+		return fmt.Errorf("eviction blocked by a PodDisruptionBudget: %s", last)
+	}
+	return err
+}
+
+// waitForPodGone waits for pod to be deleted, which a pod recreated under
+// the same name shows by its new uid
+func (h *Handler) waitForPodGone(ctx context.Context, pod *corev1.Pod) error {
+	return wait.PollImmediate(time.Second, evictionTimeout, func() (bool, error) {
+		current, err := h.KubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, nil
+		}
+		return current.UID != pod.UID, nil
+	})
+}
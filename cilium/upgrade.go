@@ -0,0 +1,511 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// preflightRelease is the release of the cilium chart running the
+	// pre-flight checks of an upgrade
+	preflightRelease = "cilium-preflight"
+
+	// preflightSelector selects the pods of the pre-flight check
+	preflightSelector = "k8s-app=cilium-pre-flight-check"
+
+	// agentDaemonSet is the DaemonSet of the cilium agents
+	agentDaemonSet = "cilium"
+
+	// rolloutPollInterval is how often the agent rollout is checked
+	rolloutPollInterval = 5 * time.Second
+)
+
+// upgradeRequest holds the parameters of the cilium upgrade operation,
+// read from the custom body of the request
+type upgradeRequest struct {
+	// Namespace cilium was installed in, found from its agents by default
+	Namespace string `yaml:"namespace"`
+
+	// Version to upgrade to, the latest supported version by default, or
+	// the installed version when only the resources, the policy
+	// enforcement mode or the load balancing are changed
+	Version string `yaml:"version"`
+
+	// Force allows upgrading to an older version or changing the IPAM mode
+	Force bool `yaml:"force"`
+
+	// SkipCompatibilityCheck upgrades even if the version does not support
+	// the kubernetes version of the cluster
+	SkipCompatibilityCheck bool `yaml:"skipCompatibilityCheck"`
+
+	// Values are merged over the values the release was installed with
+	Values interface{} `yaml:"values"`
+
+	// Timeout bounds every phase of the upgrade, like 10m
+	Timeout string `yaml:"timeout"`
+
+	// DryRun returns the manifests the upgrade would apply instead of
+	// applying them
+	DryRun bool `yaml:"dryRun"`
+
+	imageOptions        `yaml:",inline"`
+	encryptionOptions   `yaml:",inline"`
+	readinessOptions    `yaml:",inline"`
+	resourceOptions     `yaml:",inline"`
+	valuesRefOptions    `yaml:",inline"`
+	policyOptions       `yaml:",inline"`
+	loadBalancerOptions `yaml:",inline"`
+
+	// Rollback moves the release back to its previous revision if the
+	// upgrade fails, which it does unless set to false
+	Rollback *bool `yaml:"rollback"`
+}
+
+// rollback reports whether a failed upgrade is rolled back
+func (r upgradeRequest) rollback() bool {
+	return r.Rollback == nil || *r.Rollback
+}
+
+// upgrade moves the cilium release to another version in place: the
+// pre-flight checks of the target version run first, then the release is
+// upgraded keeping its values and the agents are waited for. Nothing is
+// modified unless the pre-flight checks pass. The phases of the upgrade
+// are streamed along the way.
+func (h *Handler) upgrade(latest, customBody string, e *adapter.Event) {
+	h = h.withProgress(installPhases)
+	fail := func(err error) {
+		e.Summary = "Error while upgrading Cilium"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+	}
+
+	var req upgradeRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		fail(err)
+		return
+	}
+	overrides, err := parseHelmValues(req.Values)
+	if err != nil {
+		fail(err)
+		return
+	}
+	imageValues, err := req.imageOptions.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	resourceValues, err := req.resourceOptions.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	policyValues, err := req.policyOptions.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	loadBalancerValues, err := req.loadBalancerOptions.values()
+	if err != nil {
+		fail(err)
+		return
+	}
+	timeout, err := parseTimeout(req.Timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := validateNamespace(req.Namespace); err != nil {
+		fail(err)
+		return
+	}
+	if h.kubeClient() == nil {
+		fail(ErrNilClient)
+		return
+	}
+	refValues, err := h.fetchValuesRef(context.Background(), req.valuesRefOptions)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	target := req.Version
+	// Changing the resources, the policy enforcement mode or the load
+	// balancing alone keeps the installed version
+	inPlace := req.resourceOptions.set() || req.policyOptions.set() || req.loadBalancerOptions.set()
+	if target == "" && !inPlace {
+		target = latest
+	}
+	var targetVersion *semver.Version
+	if target != "" {
+		if targetVersion, err = config.ParseVersion(target); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	namespace := h.ciliumNamespace(req.Namespace)
+	actionConfig, err := h.helmActionConfig(namespace)
+	if err != nil {
+		fail(ErrUpgradeCilium(err))
+		return
+	}
+
+	// A manifest install is upgraded from its inventory
+	inventory, err := h.readInventory(context.Background(), namespace)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	h.streamProgress(e, "Checking the installed Cilium version", "")
+	var (
+		rel      *release.Release
+		current  string
+		previous map[string]interface{}
+	)
+	if inventory != nil {
+		current, previous = inventory.Version, inventory.Values
+	} else {
+		rel, err = action.NewGet(actionConfig).Run(config.HelmChartName)
+		if err != nil {
+			fail(ErrUpgradeCilium(fmt.Errorf("cilium is not installed as the %q helm release: %w", config.HelmChartName, err)))
+			return
+		}
+		current = rel.Chart.Metadata.Version
+		if previous, err = action.NewGetValues(actionConfig).Run(config.HelmChartName); err != nil {
+			fail(ErrUpgradeCilium(err))
+			return
+		}
+	}
+	currentVersion, err := config.ParseVersion(current)
+	if err != nil {
+		fail(ErrUpgradeCilium(err))
+		return
+	}
+	if targetVersion == nil {
+		target, targetVersion = current, currentVersion
+	}
+	switch {
+	case targetVersion.Equal(currentVersion) && !inPlace:
+		e.Summary = "Cilium is already up to date"
+		e.Details = fmt.Sprintf("Cilium %s is installed", current)
+		h.StreamInfo(e)
+		return
+	case targetVersion.LessThan(currentVersion) && !req.Force:
+		fail(ErrDowngradeCilium(current, target))
+		return
+	}
+
+	if !req.SkipCompatibilityCheck {
+		if err := h.checkCompatibility(target); err != nil {
+			fail(err)
+			return
+		}
+	}
+	h.completePhase(e, phaseVersionResolved, fmt.Sprintf("Upgrading from %s to %s", current, target))
+
+	var results []string
+	var ch *chart.Chart
+	if inventory != nil && inventory.Source == manifestSourceRepo {
+		h.completePhase(e, phaseChartDownloaded, fmt.Sprintf("Pre-rendered manifests of cilium/cilium v%s", strings.TrimPrefix(target, "v")))
+		results = append(results, "Warning: the pre-rendered manifests of the cilium repo ignore the values and the options of the request.")
+	} else {
+		if ch, err = h.loadChart(target); err != nil {
+			fail(ErrUpgradeCilium(err))
+			return
+		}
+		h.completePhase(e, phaseChartDownloaded, fmt.Sprintf("Chart %s %s of %s", config.HelmChartName, config.ChartVersion(target), h.chartRepository().URL))
+	}
+	encryptionValues, err := req.encryptionOptions.values(target)
+	if err != nil {
+		fail(err)
+		return
+	}
+	values := mergeValues(mergeValues(previous, refValues.values), imageValues)
+	values = mergeValues(values, encryptionValues)
+	values = mergeValues(values, resourceValues)
+	values = mergeValues(values, policyValues)
+	values = mergeValues(values, loadBalancerValues)
+	values = mergeValues(values, overrides)
+	if current, next := ipamMode(previous), ipamMode(values); current != next && !req.Force {
+		fail(ErrChangeIPAMMode(current, next))
+		return
+	}
+	if err := checkIPAM(values); err != nil {
+		fail(err)
+		return
+	}
+	if err := checkLoadBalancer(values); err != nil {
+		fail(err)
+		return
+	}
+	h.completePhase(e, phaseValuesMerged, fmt.Sprintf("Upgrading in namespace %s with %d top level values", namespace, len(values)))
+	if req.DryRun && inventory != nil {
+		manifest, err := h.manifestsFor(context.Background(), target, namespace, inventory.Source, values)
+		if err != nil {
+			fail(err)
+			return
+		}
+		h.streamManifest(e, target, values, manifest)
+		return
+	}
+	if req.DryRun {
+		h.streamDryRun(e, target, namespace, values)
+		return
+	}
+
+	if req.ipsec() {
+		if err := h.ensureIPsecSecret(context.Background(), namespace, req.IPsecAlgorithm); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	if current, next := policyEnforcementMode(previous), policyEnforcementMode(values); current != policyEnforcementAlways && next == policyEnforcementAlways {
+		warning := h.alwaysEnforcementWarning(context.Background(), req.BaselinePolicy)
+		h.streamProgress(e, "Moving Cilium to the always policy enforcement mode", warning)
+		results = append(results, warning)
+	}
+	if req.BaselinePolicy {
+		// The policy goes first, so that the DNS is never denied
+		result, err := h.applyBaselinePolicy(context.Background())
+		if err != nil {
+			fail(err)
+			return
+		}
+		results = append(results, result)
+	}
+
+	rollback := func() {
+		switch {
+		case !req.rollback():
+		case inventory != nil:
+			h.rollbackManifestUpgrade(e, inventory, namespace, timeout)
+		default:
+			h.rollbackUpgrade(e, actionConfig, rel.Version, current, namespace, timeout)
+		}
+	}
+	if inventory != nil {
+		// The pre-flight checks run as a helm release of their own
+		results = append(results, "Warning: the pre-flight checks were skipped, the manifest installs cannot run them.")
+
+		h.streamProgress(e, "Applying the Cilium manifests", fmt.Sprintf("Upgrading from %s to %s", current, target))
+		result, err := h.applyManifests(context.Background(), target, namespace, inventory.Source, values, inventory)
+		if err != nil {
+			fail(ErrUpgradeCilium(err))
+			rollback()
+			return
+		}
+		results = append(results, result.String())
+		h.completePhase(e, phaseManifestsApplied, fmt.Sprintf("The manifests of %s are applied in namespace %s", target, namespace))
+	} else {
+		h.streamProgress(e, "Running the Cilium pre-flight checks", fmt.Sprintf("Waiting for the pre-flight checks of %s to pass on every node", target))
+		if err := h.runPreflight(actionConfig, target, namespace, timeout); err != nil {
+			fail(ErrPreflightCheck(err))
+			return
+		}
+
+		h.streamProgress(e, "Upgrading the Cilium helm release", fmt.Sprintf("Upgrading from %s to %s", current, target))
+		upgrade := action.NewUpgrade(actionConfig)
+		upgrade.Namespace = namespace
+		upgrade.Timeout = timeout
+		if _, err := upgrade.Run(config.HelmChartName, ch, values); err != nil {
+			fail(ErrUpgradeCilium(err))
+			rollback()
+			return
+		}
+		h.completePhase(e, phaseManifestsApplied, fmt.Sprintf("The %s helm release runs %s", config.HelmChartName, target))
+	}
+
+	h.streamProgress(e, "Waiting for Cilium to become ready", "")
+	if err := h.waitForCilium(e, namespace, timeout, req.WaitForNodes); err != nil {
+		fail(ErrUpgradeCilium(err))
+		rollback()
+		return
+	}
+	if req.loadBalancerOptions.set() {
+		states, err := h.waitForLoadBalancer(e, namespace, req.loadBalancerOptions, timeout)
+		if err != nil {
+			if len(states) > 0 {
+				err = fmt.Errorf("%w\n%s", err, agentStateDetails("Load balancing per node", states))
+			}
+			fail(ErrUpgradeCilium(err))
+			rollback()
+			return
+		}
+		results = append(results, agentStateDetails("Load balancing per node", states))
+	}
+	h.completePhase(e, phaseAgentsReady, "The agents and the operator are ready")
+	h.completePhase(e, phasePostChecks, "")
+
+	e.Summary = "Cilium upgraded successfully"
+	e.Details = fmt.Sprintf("Cilium was upgraded from %s to %s", current, target)
+	if len(results) > 0 {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, strings.Join(results, "\n"))
+	}
+	if source := refValues.String(); source != "" {
+		e.Details = fmt.Sprintf("%s\n%s", e.Details, source)
+	}
+	h.StreamInfo(e)
+}
+
+// runPreflight installs the pre-flight check of the target version, waits
+// for it to be ready on every node and removes it again
+func (h *Handler) runPreflight(actionConfig *action.Configuration, version, namespace string, timeout time.Duration) error {
+	ch, err := h.loadChart(version)
+	if err != nil {
+		return err
+	}
+
+	// A pre-flight release left over by an interrupted upgrade is replaced
+	uninstall := action.NewUninstall(actionConfig)
+	if _, err := uninstall.Run(preflightRelease); err != nil && !strings.Contains(err.Error(), driver.ErrReleaseNotFound.Error()) {
+		return err
+	}
+
+	install := action.NewInstall(actionConfig)
+	install.ReleaseName = preflightRelease
+	install.Namespace = namespace
+	install.Wait = true
+	install.Timeout = timeout
+	_, installErr := install.Run(ch, map[string]interface{}{
+		"preflight": map[string]interface{}{"enabled": true},
+		"agent":     false,
+		"operator":  map[string]interface{}{"enabled": false},
+	})
+	if installErr != nil {
+		if problems := h.podProblems(namespace, preflightSelector); len(problems) > 0 {
+			installErr = fmt.Errorf("%w: %s", installErr, strings.Join(problems, "; "))
+		}
+	}
+
+	if _, err := uninstall.Run(preflightRelease); err != nil && installErr == nil {
+		return err
+	}
+	return installErr
+}
+
+// podProblems describes why the selected pods of namespace are not ready
+func (h *Handler) podProblems(namespace, selector string) []string {
+	pods, err := h.kubeClient().CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil
+	}
+
+	var problems []string
+	for i := range pods.Items {
+		problems = append(problems, containerProblems(&pods.Items[i])...)
+	}
+	return problems
+}
+
+// containerProblems describes why the containers of pod are not ready
+func containerProblems(pod *corev1.Pod) []string {
+	var problems []string
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Ready {
+			continue
+		}
+		switch {
+		case status.State.Waiting != nil:
+			problems = append(problems, fmt.Sprintf("%s/%s: %s %s", pod.Name, status.Name, status.State.Waiting.Reason, status.State.Waiting.Message))
+		case status.LastTerminationState.Terminated != nil:
+			problems = append(problems, fmt.Sprintf("%s/%s: %s", pod.Name, status.Name, status.LastTerminationState.Terminated.Message))
+		default:
+			problems = append(problems, fmt.Sprintf("%s/%s: not ready", pod.Name, status.Name))
+		}
+	}
+	return problems
+}
+
+// waitForAgents waits for every cilium agent to run the upgraded DaemonSet,
+// reporting the progress of the rollout
+func (h *Handler) waitForAgents(e *adapter.Event, namespace string, timeout time.Duration) error {
+	return h.waitForDaemonSet(e, namespace, agentDaemonSet, "Cilium agents", timeout)
+}
+
+// waitForDaemonSet waits for every pod of the DaemonSet name of namespace
+// to be updated and available, reporting the progress of what is rolled out
+func (h *Handler) waitForDaemonSet(e *adapter.Event, namespace, name, what string, timeout time.Duration) error {
+	if h.kubeClient() == nil {
+		return ErrNilClient
+	}
+	updated, ready := int32(-1), int32(-1)
+	return h.pollReady(rolloutPollInterval, timeout, func() (bool, error) {
+		ds, err := h.kubeClient().AppsV1().DaemonSets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		desired := ds.Status.DesiredNumberScheduled
+		if ds.Status.UpdatedNumberScheduled != updated || ds.Status.NumberReady != ready {
+			updated, ready = ds.Status.UpdatedNumberScheduled, ds.Status.NumberReady
+			h.streamProgress(e, fmt.Sprintf("Waiting for the %s to roll out", what), fmt.Sprintf("%d/%d agents ready, %d updated", ready, desired, updated))
+		}
+		return ds.Status.ObservedGeneration >= ds.Generation &&
+			ds.Status.UpdatedNumberScheduled == desired &&
+			ds.Status.NumberReady == desired &&
+			ds.Status.NumberAvailable == desired, nil
+	})
+}
+
+// waitForDeployment waits for every replica of the Deployment name of
+// namespace to be updated and available
+func (h *Handler) waitForDeployment(namespace, name string, timeout time.Duration) error {
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		deploy, err := h.KubeClient.AppsV1().Deployments(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return deploymentReady(deploy), nil
+	})
+}
+
+// deploymentReady reports whether every replica of deploy runs its
+// current revision and is available
+func deploymentReady(deploy *appsv1.Deployment) bool {
+	desired := int32(1)
+	if deploy.Spec.Replicas != nil {
+		desired = *deploy.Spec.Replicas
+	}
+	return deploy.Status.ObservedGeneration >= deploy.Generation &&
+		deploy.Status.UpdatedReplicas == desired &&
+		deploy.Status.AvailableReplicas == desired
+}
+
+// streamProgress reports a phase of a long running operation, along with
+// the phase it belongs to if the handler tracks them
+func (h *Handler) streamProgress(e *adapter.Event, summary, details string) {
+	h.StreamInfo(&adapter.Event{
+		Operationid: e.Operationid,
+		Summary:     summary,
+		Details:     h.progress.annotate(details),
+	})
+}
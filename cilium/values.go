@@ -0,0 +1,166 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces the secret values shown back to the user
+const redacted = "<redacted>"
+
+// defaultHelmValues returns the values the adapter installs the cilium chart
+// with, before the overrides of the request are applied
+func defaultHelmValues() map[string]interface{} {
+	return map[string]interface{}{
+		"operator": map[string]interface{}{
+			// The chart defaults to two replicas which cannot be scheduled
+			// on the single node clusters meshery is commonly used with
+			"replicas": 1,
+		},
+	}
+}
+
+// parseHelmValues reads the values overrides of a request, given either as
+// a map or as a YAML string. Nil is returned if there are no overrides.
+func parseHelmValues(raw interface{}) (map[string]interface{}, error) {
+	if s, ok := raw.(string); ok {
+		if strings.TrimSpace(s) == "" {
+			return nil, nil
+		}
+		if err := yaml.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, ErrParseHelmValues(err)
+		}
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	values, err := normalizeValue(raw, "")
+	if err != nil {
+		return nil, ErrParseHelmValues(err)
+	}
+	m, ok := values.(map[string]interface{})
+	if !ok {
+		return nil, ErrParseHelmValues(fmt.Errorf("values must be a map, got %T", values))
+	}
+	return m, nil
+}
+
+// normalizeValue converts the maps decoded by yaml, which are keyed by
+// interface{}, into the string keyed maps helm expects
+func normalizeValue(value interface{}, path string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v of %q is not a string", key, path)
+			}
+			normalized, err := normalizeValue(val, joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			m[k] = normalized
+		}
+		return m, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			normalized, err := normalizeValue(val, joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			m[k] = normalized
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, 0, len(v))
+		for i, val := range v {
+			normalized, err := normalizeValue(val, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, normalized)
+		}
+		return l, nil
+	default:
+		return value, nil
+	}
+}
+
+// mergeValues deep merges overrides over base, into a new map. Nested maps
+// are merged key by key while any other value of overrides, lists included,
+// replaces the one of base.
+func mergeValues(base, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		if override, ok := v.(map[string]interface{}); ok {
+			if current, ok := merged[k].(map[string]interface{}); ok {
+				merged[k] = mergeValues(current, override)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// redactValues returns a copy of values in which the values of the keys
+// holding secrets, like passwords, tokens and private keys, are hidden
+func redactValues(values map[string]interface{}) map[string]interface{} {
+	redactedValues := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			redactedValues[k] = redactValues(val)
+		default:
+			if isSecretKey(k) && v != nil && v != "" {
+				redactedValues[k] = redacted
+				continue
+			}
+			redactedValues[k] = v
+		}
+	}
+	return redactedValues
+}
+
+// isSecretKey reports whether the value of the chart key is a secret. The
+// names of secrets, like encryption.ipsec.secretName, are not secrets.
+func isSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	if strings.HasSuffix(k, "name") || strings.HasSuffix(k, "namespace") {
+		return false
+	}
+	return k == "key" ||
+		strings.Contains(k, "password") ||
+		strings.Contains(k, "token") ||
+		strings.Contains(k, "secret") ||
+		strings.HasSuffix(k, "privatekey")
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
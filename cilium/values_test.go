@@ -0,0 +1,257 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+	"helm.sh/helm/v3/pkg/action"
+)
+
+func TestDefaultHelmValuesMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]interface{}
+		want      map[string]interface{}
+	}{
+		{
+			name: "defaults",
+			want: map[string]interface{}{"operator": map[string]interface{}{"replicas": 1}},
+		},
+		{
+			name:      "replicas override",
+			overrides: map[string]interface{}{"operator": map[string]interface{}{"replicas": 2}},
+			want:      map[string]interface{}{"operator": map[string]interface{}{"replicas": 2}},
+		},
+		{
+			name:      "sibling key",
+			overrides: map[string]interface{}{"operator": map[string]interface{}{"prometheus": map[string]interface{}{"enabled": true}}},
+			want: map[string]interface{}{"operator": map[string]interface{}{
+				"replicas":   1,
+				"prometheus": map[string]interface{}{"enabled": true},
+			}},
+		},
+		{
+			name:      "other section",
+			overrides: map[string]interface{}{"hubble": map[string]interface{}{"enabled": true}},
+			want: map[string]interface{}{
+				"operator": map[string]interface{}{"replicas": 1},
+				"hubble":   map[string]interface{}{"enabled": true},
+			},
+		},
+		{
+			name:      "operator replaced",
+			overrides: map[string]interface{}{"operator": false},
+			want:      map[string]interface{}{"operator": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeValues(defaultHelmValues(), tt.overrides); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallHelmValuesOperatorReplicas(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want interface{}
+	}{
+		{name: "default", want: 1},
+		{name: "values", body: "values:\n  operator:\n    replicas: 3\n", want: 3},
+		{name: "values string", body: "values: \"operator:\\n  replicas: 3\\n\"\n", want: 3},
+		{name: "operator options", body: "operatorReplicas: 2\n", want: 2},
+		{name: "values over operator options", body: "operatorReplicas: 2\nvalues:\n  operator:\n    replicas: 3\n", want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseInstallRequest(tt.body)
+			if err != nil {
+				t.Fatalf("parseInstallRequest: %v", err)
+			}
+			values, err := req.helmValues("1.14.5")
+			if err != nil {
+				t.Fatalf("helmValues: %v", err)
+			}
+			operator, _ := values["operator"].(map[string]interface{})
+			if operator["replicas"] != tt.want {
+				t.Errorf("operator.replicas = %v, want %v", operator["replicas"], tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallValuesRoundTrip(t *testing.T) {
+	h, _ := newTestHandler(t)
+	useTestHelm(t, h, "kube-system", "1.14.5")
+
+	req, err := parseInstallRequest("operatorReplicas: 2\nvalues:\n  hubble:\n    enabled: true\n")
+	if err != nil {
+		t.Fatalf("parseInstallRequest: %v", err)
+	}
+	values, err := req.helmValues("1.14.5")
+	if err != nil {
+		t.Fatalf("helmValues: %v", err)
+	}
+	if err := h.applyHelmChart(false, "1.14.5", "kube-system", values); err != nil {
+		t.Fatalf("applyHelmChart: %v", err)
+	}
+	version, released, err := h.releaseValues("kube-system")
+	if err != nil {
+		t.Fatalf("releaseValues: %v", err)
+	}
+	if version != "1.14.5" || !reflect.DeepEqual(released, values) {
+		t.Errorf("release of %s with values %v, want 1.14.5 with %v", version, released, values)
+	}
+
+	// Installing again upgrades the release with the new values
+	values = mergeValues(values, map[string]interface{}{"operator": map[string]interface{}{"replicas": 3}})
+	if err := h.applyHelmChart(false, "1.14.5", "kube-system", values); err != nil {
+		t.Fatalf("applyHelmChart again: %v", err)
+	}
+	rel, err := action.NewGet(h.helmConfig).Run(config.HelmChartName)
+	if err != nil {
+		t.Fatalf("getting the release: %v", err)
+	}
+	if rel.Version != 2 || !strings.Contains(rel.Manifest, `operator-replicas: "3"`) {
+		t.Errorf("revision %d renders %q, want revision 2 with 3 operator replicas", rel.Version, rel.Manifest)
+	}
+
+	if err := h.applyHelmChart(true, "1.14.5", "kube-system", nil); err != nil {
+		t.Fatalf("uninstalling: %v", err)
+	}
+	if h.releaseExists("kube-system") {
+		t.Error("the release exists after uninstalling")
+	}
+}
+
+func TestInstallCiliumCustomValuesFail(t *testing.T) {
+	h, _ := newTestHandler(t)
+	useTestHelm(t, h, "kube-system", "1.14.5")
+	useMeshConfig(t, h)
+
+	// 1.13.0 is missing from the repository, and the cilium cli would
+	// install without the values
+	_, err := h.installCilium(false, "1.13.0", "kube-system", map[string]interface{}{"hubble": true}, true)
+	if errorCode(err) != ErrInstallCiliumCode || h.releaseExists("kube-system") {
+		t.Errorf("error = %v, want %s without falling back to the cilium cli", err, ErrInstallCiliumCode)
+	}
+}
+
+func TestRequestValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		custom bool
+	}{
+		{name: "defaults"},
+		{name: "options", body: "operatorReplicas: 2\n", custom: true},
+		{name: "values", body: "values:\n  hubble:\n    enabled: true\n", custom: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseInstallRequest(tt.body)
+			if err != nil {
+				t.Fatalf("parseInstallRequest: %v", err)
+			}
+			requested, err := req.requestValues("1.14.5")
+			if err != nil {
+				t.Fatalf("requestValues: %v", err)
+			}
+			if custom := len(requested) > 0; custom != tt.custom {
+				t.Errorf("requested values %v, want custom values %v", requested, tt.custom)
+			}
+		})
+	}
+
+	req, _ := parseInstallRequest("")
+	req.refValues.values = map[string]interface{}{"ipam": map[string]interface{}{"mode": "kubernetes"}}
+	if requested, err := req.requestValues("1.14.5"); err != nil || len(requested) == 0 {
+		t.Errorf("requested values %v, %v, want the values of the valuesRef", requested, err)
+	}
+}
+
+func TestMergeValuesKeepsBase(t *testing.T) {
+	base := defaultHelmValues()
+	mergeValues(base, map[string]interface{}{"operator": map[string]interface{}{"replicas": 3}})
+	if want := defaultHelmValues(); !reflect.DeepEqual(base, want) {
+		t.Errorf("base = %v after merging, want %v", base, want)
+	}
+}
+
+func TestParseHelmValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     interface{}
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "blank", raw: "  \n"},
+		{
+			name: "yaml",
+			raw:  "operator:\n  replicas: 2\ntolerations:\n- operator: Exists\n",
+			want: map[string]interface{}{
+				"operator":    map[string]interface{}{"replicas": 2},
+				"tolerations": []interface{}{map[string]interface{}{"operator": "Exists"}},
+			},
+		},
+		{
+			name: "map",
+			raw:  map[string]interface{}{"ipam": map[interface{}]interface{}{"mode": "kubernetes"}},
+			want: map[string]interface{}{"ipam": map[string]interface{}{"mode": "kubernetes"}},
+		},
+		{name: "not a map", raw: "- a\n- b\n", wantErr: true},
+		{name: "invalid yaml", raw: "operator: [", wantErr: true},
+		{name: "non string key", raw: "operator:\n  1: a\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHelmValues(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHelmValues error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactValues(t *testing.T) {
+	values := map[string]interface{}{
+		"encryption": map[string]interface{}{"ipsec": map[string]interface{}{"secretName": "cilium-ipsec-keys"}},
+		"clustermesh": map[string]interface{}{"apiserver": map[string]interface{}{"tls": map[string]interface{}{
+			"ca": map[string]interface{}{"key": "LS0t", "cert": "LS0u"},
+		}}},
+		"hubble": map[string]interface{}{"relay": map[string]interface{}{"token": ""}},
+	}
+	want := map[string]interface{}{
+		"encryption": map[string]interface{}{"ipsec": map[string]interface{}{"secretName": "cilium-ipsec-keys"}},
+		"clustermesh": map[string]interface{}{"apiserver": map[string]interface{}{"tls": map[string]interface{}{
+			"ca": map[string]interface{}{"key": redacted, "cert": "LS0u"},
+		}}},
+		"hubble": map[string]interface{}{"relay": map[string]interface{}{"token": ""}},
+	}
+	if got := redactValues(values); !reflect.DeepEqual(got, want) {
+		t.Errorf("redacted values = %v, want %v", got, want)
+	}
+}
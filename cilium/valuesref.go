@@ -0,0 +1,155 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cilium
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultValuesKey is the key of the values in a ConfigMap reference
+	// which does not name one
+	defaultValuesKey = "values.yaml"
+
+	// maxValuesRefSize caps the size of referenced values files
+	maxValuesRefSize = 1 << 20
+)
+
+// valuesRefOptions read the values of the chart from a file kept outside
+// of the request. They are part of the custom body of the install and
+// upgrade requests.
+type valuesRefOptions struct {
+	// ValuesRef is either the https url of a values file or a ConfigMap
+	// key as namespace/name/key, the key being values.yaml by default.
+	// The values are merged beneath the options and the values of the
+	// request.
+	ValuesRef string `yaml:"valuesRef"`
+}
+
+// referencedValues are the values read from a valuesRef
+type referencedValues struct {
+	values map[string]interface{}
+
+	// source is the reference the values were read from and sum the
+	// sha256 of their content, for the operation result to record
+	source string
+	sum    string
+}
+
+// String describes where the values come from
+func (r referencedValues) String() string {
+	if r.source == "" {
+		return ""
+	}
+	return fmt.Sprintf("Values read from %s, sha256 %s.", r.source, r.sum)
+}
+
+// fetchValuesRef reads and parses the values referenced by the options,
+// nothing if they reference none
+func (h *Handler) fetchValuesRef(ctx context.Context, o valuesRefOptions) (referencedValues, error) {
+	ref := strings.TrimSpace(o.ValuesRef)
+	if ref == "" {
+		return referencedValues{}, nil
+	}
+
+	var content []byte
+	var err error
+	if strings.Contains(ref, "://") {
+		content, err = fetchValuesURL(ctx, ref)
+	} else {
+		content, err = h.fetchValuesConfigMap(ctx, ref)
+	}
+	if err != nil {
+		return referencedValues{}, ErrFetchValuesRef(ref, err)
+	}
+
+	values, err := parseHelmValues(string(content))
+	if err != nil {
+		return referencedValues{}, ErrFetchValuesRef(ref, err)
+	}
+	sum := sha256.Sum256(content)
+	return referencedValues{values: values, source: ref, sum: hex.EncodeToString(sum[:])}, nil
+}
+
+// fetchValuesURL downloads the values file of an https url
+func fetchValuesURL(ctx context.Context, ref string) ([]byte, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("only https urls are accepted")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := config.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxValuesRefSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxValuesRefSize {
+		return nil, fmt.Errorf("the values file is larger than %d bytes", maxValuesRefSize)
+	}
+	return content, nil
+}
+
+// fetchValuesConfigMap reads the values of a namespace/name/key ConfigMap
+// reference
+func (h *Handler) fetchValuesConfigMap(ctx context.Context, ref string) ([]byte, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) == 2 {
+		parts = append(parts, defaultValuesKey)
+	}
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("expected an https url or a ConfigMap key as namespace/name/key")
+	}
+	if err := validateNamespace(parts[0]); err != nil {
+		return nil, err
+	}
+	if h.KubeClient == nil {
+		return nil, ErrNilClient
+	}
+	cm, err := h.KubeClient.CoreV1().ConfigMaps(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	content, ok := cm.Data[parts[2]]
+	if !ok {
+		return nil, fmt.Errorf("the ConfigMap %s/%s has no key %s", parts[0], parts[1], parts[2])
+	}
+	return []byte(content), nil
+}
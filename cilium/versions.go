@@ -0,0 +1,78 @@
+package cilium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	internalconfig "github.com/layer5io/meshery-cilium/internal/config"
+)
+
+// versionsRequest is the custom body of the supported versions operation
+type versionsRequest struct {
+	// Refresh fetches the versions again, bypassing the caches
+	Refresh bool `yaml:"refresh"`
+
+	// Notes adds a summary of the release notes to each version
+	Notes bool `yaml:"notes"`
+}
+
+// releaseSummaryLength is the size in bytes of the release notes summary
+// shown next to each version
+const releaseSummaryLength = 280
+
+// listVersions streams the supported cilium versions and where they came
+// from, along with a summary of their release notes when requested
+func (h *Handler) listVersions(customBody string, e *adapter.Event) {
+	var req versionsRequest
+	if err := parseCustomBody(customBody, &req); err != nil {
+		e.Summary = "Error while listing the supported Cilium versions"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), internalconfig.DefaultReleaseTimeout)
+	defer cancel()
+
+	result, err := internalconfig.SupportedVersions(ctx, req.Refresh)
+	if err != nil {
+		e.Summary = "Error while listing the supported Cilium versions"
+		e.Details = err.Error()
+		h.StreamErr(e, err)
+		return
+	}
+
+	versions := make([]string, 0, len(result.Versions))
+	for _, v := range result.Versions {
+		versions = append(versions, string(v))
+	}
+	e.Summary = fmt.Sprintf("Supported Cilium versions (source: %s)", result.Source)
+	e.Details = strings.Join(versions, ", ")
+	if req.Notes {
+		e.Details = h.summarizeVersions(ctx, versions)
+	}
+	h.StreamInfo(e)
+}
+
+// summarizeVersions returns one line per version holding its release notes
+// summary. Versions whose notes cannot be fetched are listed without one.
+func (h *Handler) summarizeVersions(ctx context.Context, versions []string) string {
+	lines := make([]string, 0, len(versions))
+	for _, v := range versions {
+		notes, err := internalconfig.GetReleaseNotes(ctx, v, internalconfig.ReleaseNotesOptions{
+			MaxBytes: releaseSummaryLength,
+			Summary:  true,
+		})
+		if err != nil {
+			h.Log.Warn(err)
+		}
+		if notes == "" {
+			lines = append(lines, v)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", v, notes))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,52 @@
+// Command fallback-versions refreshes the list of cilium versions embedded
+// in the adapter, which is offered when github cannot be reached.
+//
+// Usage:
+//
+//	go generate ./internal/config/...
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+)
+
+func main() {
+	output := flag.String("o", "fallback_versions.json", "file to which the versions are written")
+	limit := flag.Int("n", 10, "number of versions to keep")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DefaultReleaseTimeout)
+	defer cancel()
+
+	versions, err := config.FetchVersions(ctx, *limit, config.DefaultVersionOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(versions) == 0 {
+		fmt.Fprintln(os.Stderr, "no cilium versions found, keeping the existing list")
+		os.Exit(1)
+	}
+
+	fallback := config.FallbackVersions{Versions: make([]string, 0, len(versions))}
+	for _, v := range versions {
+		fallback.Versions = append(fallback.Versions, string(v))
+	}
+
+	content, err := json.MarshalIndent(fallback, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*output, append(content, '\n'), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+// Command sample-manifests refreshes the sample manifests embedded in the
+// adapter, which are applied when github cannot be reached. The samples of
+// the latest patch of every recent cilium minor are fetched, and written
+// for the minors in which they changed only.
+//
+// Usage:
+//
+//	go generate ./internal/config/...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/layer5io/meshery-cilium/internal/config"
+)
+
+func main() {
+	output := flag.String("o", "samples", "directory to which the manifests are written")
+	limit := flag.Int("n", 10, "number of versions to look at")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DefaultReleaseTimeout)
+	defer cancel()
+
+	versions, err := config.FetchVersions(ctx, *limit, config.DefaultVersionOptions())
+	if err != nil {
+		fail(err)
+	}
+
+	// The versions come newest first, the first one of a minor being its
+	// latest patch
+	var minors []string
+	refs := make(map[string]string)
+	for _, version := range versions {
+		v, err := config.ParseVersion(string(version))
+		if err != nil || v.Prerelease() != "" {
+			continue
+		}
+		minor := fmt.Sprintf("%d.%d", v.Major(), v.Minor())
+		if _, ok := refs[minor]; !ok {
+			refs[minor] = string(version)
+			minors = append([]string{minor}, minors...)
+		}
+	}
+	if len(minors) == 0 {
+		fail(fmt.Errorf("no cilium versions found, keeping the existing manifests"))
+	}
+
+	// Everything is fetched before the existing manifests are replaced
+	manifests := make(map[string]map[string]string)
+	previous := make(map[string]string)
+	for _, minor := range minors {
+		ref := refs[minor]
+		paths, err := config.ResolveSampleManifests(ctx, ref)
+		if err != nil {
+			fail(err)
+		}
+		for sample, p := range paths {
+			files, err := config.GetFiles(ctx, "cilium", "cilium", path.Dir(p), ref, config.FileOptions{Pattern: path.Base(p)})
+			if err != nil {
+				fail(err)
+			}
+			if len(files) == 0 || files[0].Content == previous[sample] {
+				continue
+			}
+			previous[sample] = files[0].Content
+			if manifests[minor] == nil {
+				manifests[minor] = make(map[string]string)
+			}
+			manifests[minor][sample] = files[0].Content
+		}
+	}
+	if len(manifests) == 0 {
+		fail(fmt.Errorf("no sample manifests found, keeping the existing ones"))
+	}
+
+	if err := os.RemoveAll(*output); err != nil {
+		fail(err)
+	}
+	for minor, samples := range manifests {
+		dir := filepath.Join(*output, minor)
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			fail(err)
+		}
+		for sample, content := range samples {
+			if err := ioutil.WriteFile(filepath.Join(dir, config.SampleFileName(sample)), []byte(content), 0600); err != nil {
+				fail(err)
+			}
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// partialSuffix is appended to the destination of a download while it is
+// in progress, so that an interrupted download is never mistaken for a
+// complete one
+const partialSuffix = ".part"
+
+// DownloadAsset downloads the asset of the release matching namePattern
+// using the default client
+func DownloadAsset(ctx context.Context, release *Release, namePattern string, dest string) error {
+	rc, err := releaseClient()
+	if err != nil {
+		return err
+	}
+	return rc.DownloadAsset(ctx, release, namePattern, dest)
+}
+
+// DownloadAsset downloads the first asset of the release whose name matches
+// namePattern, a path.Match pattern like cilium-linux-*.tar.gz, to dest.
+//
+// The asset is streamed to dest.part, which is renamed to dest once it is
+// complete. A leftover dest.part from an interrupted download is resumed if
+// the server supports range requests and restarted otherwise. If the release
+// has a sha256sum(s) asset the download is verified against it, and removed
+// when the checksums do not match.
+func (rc *ReleaseClient) DownloadAsset(ctx context.Context, release *Release, namePattern string, dest string) error {
+	asset, err := findAsset(release, namePattern)
+	if err != nil {
+		return err
+	}
+
+	partial := dest + partialSuffix
+	if err := rc.download(ctx, asset.DownloadURL, partial); err != nil {
+		return err
+	}
+
+	if sums := checksumAsset(release, asset.Name); sums != nil {
+		want, err := rc.expectedChecksum(ctx, sums, asset.Name)
+		if err != nil {
+			return err
+		}
+		got, err := fileChecksum(partial)
+		if err != nil {
+			return ErrDownloadAsset(asset.Name, err)
+		}
+		if !strings.EqualFold(want, got) {
+			_ = os.Remove(partial)
+			return ErrAssetChecksumMismatch(asset.Name, want, got)
+		}
+	}
+
+	if err := os.Rename(partial, dest); err != nil {
+		return ErrDownloadAsset(asset.Name, err)
+	}
+	return nil
+}
+
+// findAsset returns the first asset of the release matching namePattern
+func findAsset(release *Release, namePattern string) (*Asset, error) {
+	if release == nil {
+		return nil, ErrNoMatchingAsset("", namePattern)
+	}
+	for _, asset := range release.Assets {
+		matched, err := path.Match(namePattern, asset.Name)
+		if err != nil {
+			return nil, ErrDownloadAsset(namePattern, err)
+		}
+		if matched {
+			return asset, nil
+		}
+	}
+	return nil, ErrNoMatchingAsset(string(release.TagName), namePattern)
+}
+
+// checksumAsset returns the asset holding the checksum of the asset called
+// name, preferring a dedicated name.sha256sum over a release wide sha256sums
+func checksumAsset(release *Release, name string) *Asset {
+	var sums *Asset
+	for _, asset := range release.Assets {
+		switch {
+		case asset.Name == name+".sha256sum", asset.Name == name+".sha256sums":
+			return asset
+		case strings.HasSuffix(asset.Name, ".sha256sums"), strings.HasSuffix(asset.Name, "sha256sums.txt"):
+			sums = asset
+		}
+	}
+	return sums
+}
+
+// expectedChecksum downloads the checksum asset and returns the checksum
+// listed for name. Both the "<sum>  <file>" sha256sum format and files
+// holding nothing but the sum are understood.
+func (rc *ReleaseClient) expectedChecksum(ctx context.Context, sums *Asset, name string) (string, error) {
+	resp, err := rc.fetchAsset(ctx, sums.DownloadURL, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1:
+			return fields[0], nil
+		case len(fields) >= 2 && path.Base(strings.TrimPrefix(fields[1], "*")) == name:
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", ErrDownloadAsset(sums.Name, err)
+	}
+	return "", ErrDownloadAsset(sums.Name, fmt.Errorf("no checksum is listed for %s", name))
+}
+
+// download streams url to dest, resuming from the current size of dest if
+// it already exists
+func (rc *ReleaseClient) download(ctx context.Context, url, dest string) error {
+	var offset int64
+	if info, err := os.Stat(dest); err == nil {
+		offset = info.Size()
+	}
+
+	resp, err := rc.fetchAsset(ctx, url, offset)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resp.StatusCode == http.StatusPartialContent {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	// #nosec G304 dest is chosen by the caller
+	out, err := os.OpenFile(dest, flags, 0600)
+	if err != nil {
+		return ErrDownloadAsset(url, err)
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		_ = out.Close()
+		if ctx.Err() != nil {
+			return ErrReleaseFetchCanceled(ctx.Err())
+		}
+		// The partial file is kept so that the next attempt can resume
+		return ErrDownloadAsset(url, err)
+	}
+	if err := out.Close(); err != nil {
+		return ErrDownloadAsset(url, err)
+	}
+	return nil
+}
+
+// fetchAsset requests url, asking for the bytes following offset if it is
+// positive. A 416 response to a range request means that the previous
+// download was complete and is reported as an empty partial response.
+func (rc *ReleaseClient) fetchAsset(ctx context.Context, url string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, ErrDownloadAsset(url, err)
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// Assets can take much longer than API calls, hence only the transport
+	// of the client is reused and not its timeout
+	client := &http.Client{Transport: rc.httpClient().Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrReleaseFetchCanceled(ctx.Err())
+		}
+		return nil, ErrDownloadAsset(url, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK,
+		resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		resp.StatusCode = http.StatusPartialContent
+		resp.Body = http.NoBody
+		return resp, nil
+	default:
+		_ = resp.Body.Close()
+		return nil, ErrDownloadAsset(url, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+	}
+}
+
+// fileChecksum returns the hex encoded sha256 of the file at name
+func fileChecksum(name string) (string, error) {
+	// #nosec G304 name is the file which was just downloaded
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+const (
+	// ChannelStable offers the newest patch release of each of the latest
+	// minor series, like v1.12.3, v1.11.10 and v1.10.15
+	ChannelStable = "stable"
+
+	// ChannelEdge offers every release of the newest minor series,
+	// release candidates included
+	ChannelEdge = "edge"
+
+	// ReleaseChannelEnv is the environment variable selecting the channel
+	// whose versions are offered by the adapter, stable by default
+	ReleaseChannelEnv = "CILIUM_RELEASE_CHANNEL"
+)
+
+// GetVersionsForChannel returns at most limit versions of the channel,
+// latest first
+func GetVersionsForChannel(ctx context.Context, channel string, limit int) ([]adapter.Version, error) {
+	opts, err := ChannelVersionOptions(channel)
+	if err != nil {
+		return nil, err
+	}
+	return getLatestReleaseNames(ctx, limit, opts)
+}
+
+// ChannelVersionOptions returns the default version options restricted to
+// the channel. An error is returned for unknown channels.
+func ChannelVersionOptions(channel string) (VersionOptions, error) {
+	if err := validateChannel(channel); err != nil {
+		return VersionOptions{}, err
+	}
+	opts := DefaultVersionOptions()
+	opts.Channel = channel
+	if channel == ChannelEdge {
+		opts.IncludePrereleases = true
+	}
+	return opts, nil
+}
+
+// ReleaseChannel returns the channel set in the CILIUM_RELEASE_CHANNEL
+// environment variable, or ChannelStable if it is unset
+func ReleaseChannel() (string, error) {
+	channel := os.Getenv(ReleaseChannelEnv)
+	if channel == "" {
+		return ChannelStable, nil
+	}
+	return channel, validateChannel(channel)
+}
+
+func validateChannel(channel string) error {
+	switch channel {
+	case "", ChannelStable, ChannelEdge:
+		return nil
+	default:
+		return ErrUnknownChannel(channel)
+	}
+}
+
+// selectChannel returns the versions of the channel out of the sorted
+// versions, latest first. Every version is returned if channel is empty.
+// The second value reports whether no older release can be part of the
+// selection anymore, for the edge channel once an older minor is reached.
+func selectChannel(channel string, sorted []string) ([]string, bool) {
+	switch channel {
+	case ChannelStable:
+		var selected []string
+		seen := map[string]bool{}
+		for _, name := range sorted {
+			v, err := semver.NewVersion(name)
+			if err != nil || v.Prerelease() != "" {
+				continue
+			}
+			minor := fmt.Sprintf("%d.%d", v.Major(), v.Minor())
+			if !seen[minor] {
+				seen[minor] = true
+				selected = append(selected, name)
+			}
+		}
+		return selected, false
+	case ChannelEdge:
+		var (
+			selected []string
+			newest   *semver.Version
+			complete bool
+		)
+		for _, name := range sorted {
+			v, err := semver.NewVersion(name)
+			if err != nil {
+				continue
+			}
+			if newest == nil {
+				newest = v
+			}
+			if v.Major() != newest.Major() || v.Minor() != newest.Minor() {
+				complete = true
+				continue
+			}
+			selected = append(selected, name)
+		}
+		return selected, complete
+	default:
+		return sorted, false
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	_ "embed" // compatibility.json is embedded
+	"encoding/json"
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// compatibilityJSON maps every cilium minor to the range of kubernetes
+// minors it supports. Supporting a new cilium minor only takes adding its
+// entry to compatibility.json.
+//
+//go:embed compatibility.json
+var compatibilityJSON []byte
+
+// KubernetesRange is the range of kubernetes minors, bounds included,
+// supported by a cilium minor
+type KubernetesRange struct {
+	MinKubernetes string `json:"minKubernetes"`
+	MaxKubernetes string `json:"maxKubernetes"`
+}
+
+// CompatibilityMatrix returns the kubernetes versions supported by each
+// cilium minor, keyed by the cilium minor like 1.12
+func CompatibilityMatrix() (map[string]KubernetesRange, error) {
+	matrix := map[string]KubernetesRange{}
+	if err := json.Unmarshal(compatibilityJSON, &matrix); err != nil {
+		return nil, ErrIncompatibleKubernetes(err)
+	}
+	return matrix, nil
+}
+
+// CheckCompatibility returns an error if the cilium version does not support
+// the kubernetes version. Cilium minors missing from the matrix, usually
+// newer than the adapter, are assumed to be compatible.
+func CheckCompatibility(ciliumVersion, k8sVersion string) error {
+	cilium, err := ParseVersion(ciliumVersion)
+	if err != nil {
+		return err
+	}
+	k8s, err := semver.NewVersion(k8sVersion)
+	if err != nil {
+		return ErrInvalidVersion(k8sVersion, err)
+	}
+
+	matrix, err := CompatibilityMatrix()
+	if err != nil {
+		return err
+	}
+	minor := fmt.Sprintf("%d.%d", cilium.Major(), cilium.Minor())
+	supported, ok := matrix[minor]
+	if !ok {
+		logDebug(fmt.Sprintf("No kubernetes compatibility data for cilium %s, skipping the check", minor))
+		return nil
+	}
+
+	// Only the minors are compared, every patch of a supported minor is supported
+	k8sMinor, _ := semver.NewVersion(fmt.Sprintf("%d.%d", k8s.Major(), k8s.Minor()))
+	constraint, err := semver.NewConstraint(fmt.Sprintf(">= %s, <= %s", supported.MinKubernetes, supported.MaxKubernetes))
+	if err != nil {
+		return ErrIncompatibleKubernetes(err)
+	}
+	if !constraint.Check(k8sMinor) {
+		return ErrIncompatibleKubernetes(fmt.Errorf("cilium %s supports kubernetes %s to %s, the cluster runs %s", ciliumVersion, supported.MinKubernetes, supported.MaxKubernetes, k8sVersion))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"path"
 	"strings"
 
@@ -47,11 +48,18 @@ var (
 		configprovider.FileType: "yaml",
 		configprovider.FileName: "kubeconfig",
 	}
-
-	Operations = getOperations(common.Operations)
 )
 
-func New(provider string) (h config.Handler, err error) {
+// New returns the config handler for the given provider. The context is used
+// for discovering the supported cilium versions, which are refreshed in the
+// background until the context is done.
+func New(ctx context.Context, provider string) (h config.Handler, err error) {
+	// Surface a broken github configuration, like an unreadable CA bundle,
+	// right away instead of failing every release lookup later on
+	if _, err := releaseClient(); err != nil {
+		return nil, err
+	}
+
 	opts := configprovider.Options{
 		FilePath: configRootPath,
 		FileName: "cilium",
@@ -82,13 +90,42 @@ func New(provider string) (h config.Handler, err error) {
 	}
 
 	// Setup Operations Config
-	if err := h.SetObject(adapter.OperationsKey, Operations); err != nil {
+	// The operations default to the head of the release channel
+	channel, err := ReleaseChannel()
+	if err != nil {
+		return nil, err
+	}
+	versionOpts, err := ChannelVersionOptions(channel)
+	if err != nil {
+		return nil, err
+	}
+	watcher := NewVersionWatcher(supportedVersions, VersionRefreshInterval(), versionOpts)
+	watcher.Refresh(ctx)
+	if err := h.SetObject(adapter.OperationsKey, getOperations(watcher.Get(), common.Operations)); err != nil {
 		return nil, adapter.ErrClientConfig(err)
 	}
+	watchVersions(ctx, h, watcher)
+	versionWatcher = watcher
 
 	return h, nil
 }
 
+// watchVersions keeps the versions of the operations stored in h up to date
+// until ctx is done
+func watchVersions(ctx context.Context, h config.Handler, watcher *VersionWatcher) {
+	updates := watcher.Subscribe()
+	go watcher.Run(ctx)
+	go func() {
+		for versions := range updates {
+			if err := h.SetObject(adapter.OperationsKey, getOperations(versions, common.Operations)); err != nil {
+				logWarn(adapter.ErrClientConfig(err))
+				continue
+			}
+			logInfo("Supported cilium versions changed to ", versions)
+		}
+	}()
+}
+
 func NewKubeconfigBuilder(provider string) (config.Handler, error) {
 
 	opts := configprovider.Options{
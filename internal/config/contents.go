@@ -0,0 +1,312 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	pathpkg "path"
+	"strings"
+	"sync"
+
+	"github.com/layer5io/meshkit/utils/walker"
+)
+
+// content is an entry of a directory as returned by the github contents API
+type content struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size"`
+	DownloadURL string `json:"download_url"`
+
+	// URL is the contents API url of the entry, which serves the files
+	// base64 encoded when they have no DownloadURL
+	URL string `json:"url"`
+
+	// Content and Encoding are only set when a file is read through URL
+	Content  string `json:"content,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// DefaultFileConcurrency is the number of file contents fetched in parallel by GetFiles by default
+const DefaultFileConcurrency = 4
+
+// FileOptions select the files returned by GetFilesMatching
+type FileOptions struct {
+	// Pattern is a path.Match pattern, like *.yaml, matched against the
+	// file names. Every file matches if it is empty.
+	Pattern string
+
+	// MaxDepth is how many levels of subdirectories are walked, only the
+	// directory itself is read if it is 0 and every subdirectory is walked
+	// if it is negative
+	MaxDepth int
+
+	// MaxFileSize skips, in GetFiles, the files larger than it in bytes.
+	// No file is skipped if it is 0.
+	MaxFileSize int64
+
+	// Concurrency is the number of file contents GetFiles fetches in
+	// parallel, DefaultFileConcurrency is used if it is not set
+	Concurrency int
+}
+
+// GetFileNames takes the url of a github repo and the path to a directory. Then returns all the filenames from that directory.
+// The files are read at ref, which can be a branch, a tag or a commit, or from the default branch of the repo if ref is empty.
+func GetFileNames(ctx context.Context, owner string, repo string, path string, ref string) ([]string, error) {
+	return GetFilesMatching(ctx, owner, repo, path, ref, FileOptions{})
+}
+
+// GetFilesMatching is GetFileNames returning only the files selected by opts. The files
+// found in subdirectories are returned with their path relative to path, like v2/a.yaml.
+func GetFilesMatching(ctx context.Context, owner string, repo string, path string, ref string, opts FileOptions) ([]string, error) {
+	rc, err := releaseClient()
+	if err != nil {
+		return nil, err
+	}
+	return rc.GetFilesMatching(ctx, owner, repo, path, ref, opts)
+}
+
+// GetFilesMatching lists the files of the repo like the package level
+// GetFilesMatching, through the API rc points at
+func (rc *ReleaseClient) GetFilesMatching(ctx context.Context, owner string, repo string, path string, ref string, opts FileOptions) ([]string, error) {
+	if _, err := pathpkg.Match(opts.Pattern, ""); err != nil {
+		return nil, ErrInvalidFilePattern(opts.Pattern, err)
+	}
+
+	var names []string
+	err := rc.walkDirectory(ctx, owner, repo, path, ref, opts.MaxDepth, func(relPath string, entry *content) {
+		if opts.matches(entry) {
+			names = append(names, relPath)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// GetFiles is GetFilesMatching returning the contents of the files along with their names. The Path of
+// every file is its path in the repo. At most opts.Concurrency files are downloaded at once.
+func GetFiles(ctx context.Context, owner string, repo string, path string, ref string, opts FileOptions) ([]walker.File, error) {
+	rc, err := releaseClient()
+	if err != nil {
+		return nil, err
+	}
+	return rc.GetFiles(ctx, owner, repo, path, ref, opts)
+}
+
+// GetFiles reads the files of the repo like the package level GetFiles,
+// through the API rc points at
+func (rc *ReleaseClient) GetFiles(ctx context.Context, owner string, repo string, path string, ref string, opts FileOptions) ([]walker.File, error) {
+	if _, err := pathpkg.Match(opts.Pattern, ""); err != nil {
+		return nil, ErrInvalidFilePattern(opts.Pattern, err)
+	}
+
+	var entries []*content
+	err := rc.walkDirectory(ctx, owner, repo, path, ref, opts.MaxDepth, func(_ string, entry *content) {
+		if opts.MaxFileSize > 0 && entry.Size > opts.MaxFileSize {
+			logDebug(fmt.Sprintf("Skipped %s, it is larger than %d bytes", entry.Path, opts.MaxFileSize))
+			return
+		}
+		if opts.matches(entry) {
+			entries = append(entries, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultFileConcurrency
+	}
+
+	files := make([]walker.File, len(entries))
+	errs := make([]error, len(entries))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ErrWalkCanceled(ctx.Err())
+		}
+		wg.Add(1)
+		go func(i int, entry *content) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			body, err := rc.fileContent(ctx, entry)
+			files[i] = walker.File{Name: entry.Name, Path: entry.Path, Content: body}
+			errs[i] = err
+		}(i, entry)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ErrWalkCanceled(ctx.Err())
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// matches reports whether the name of the file entry matches the pattern
+func (o FileOptions) matches(entry *content) bool {
+	if o.Pattern == "" {
+		return true
+	}
+	matched, _ := pathpkg.Match(o.Pattern, entry.Name)
+	return matched
+}
+
+// fileContent downloads the content of the file entry, through the
+// contents API if it has no download url, like on some mirrors
+func (rc *ReleaseClient) fileContent(ctx context.Context, entry *content) (string, error) {
+	if entry.DownloadURL == "" {
+		return rc.encodedFileContent(ctx, entry)
+	}
+	resp, err := rc.get(ctx, entry.DownloadURL, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	limit := rc.MaxResponseSize
+	if limit <= 0 {
+		limit = DefaultMaxResponseSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", ErrGetLatestReleases(err)
+	}
+	if int64(len(body)) > limit {
+		return "", ErrResponseTooLarge(limit)
+	}
+	return string(body), nil
+}
+
+// encodedFileContent reads the content of the file entry from the contents
+// API, which serves it base64 encoded
+func (rc *ReleaseClient) encodedFileContent(ctx context.Context, entry *content) (string, error) {
+	if entry.URL == "" {
+		return "", ErrGetManifestNames(fmt.Errorf("%s has neither a download url nor a contents url", entry.Path))
+	}
+	resp, err := rc.get(ctx, entry.URL, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var file content
+	if err := rc.decode(resp.Body, &file); err != nil {
+		return "", err
+	}
+	if file.Encoding != "base64" {
+		return "", ErrGetManifestNames(fmt.Errorf("%s is served with the unsupported encoding %q", entry.Path, file.Encoding))
+	}
+	// github wraps the encoded content every 60 characters
+	body, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(file.Content, "\n", ""))
+	if err != nil {
+		return "", ErrGetManifestNames(fmt.Errorf("%s: %w", entry.Path, err))
+	}
+	return string(body), nil
+}
+
+// walkDirectory calls fn with every file under dir, descending at most
+// depth levels into its subdirectories, or into all of them if depth is
+// negative. The walk stops with ErrWalkCanceled as soon as ctx is done.
+func (rc *ReleaseClient) walkDirectory(ctx context.Context, owner, repo, dir, ref string, depth int, fn func(relPath string, entry *content)) error {
+	var walk func(dir, prefix string, depth int) error
+	walk = func(dir, prefix string, depth int) error {
+		entries, err := rc.listDirectory(ctx, owner, repo, dir, ref)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrWalkCanceled(ctx.Err())
+			}
+			return err
+		}
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				return ErrWalkCanceled(ctx.Err())
+			}
+			switch entry.Type {
+			case "file":
+				fn(prefix+entry.Name, entry)
+			case "dir":
+				if depth == 0 {
+					continue
+				}
+				if err := walk(entry.Path, prefix+entry.Name+"/", depth-1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(dir, "", depth)
+}
+
+// listDirectory returns the entries of the directory at path of the repo,
+// from defaultContentsCache if it was listed before
+func (rc *ReleaseClient) listDirectory(ctx context.Context, owner, repo, path, ref string) ([]*content, error) {
+	if entries, ok := defaultContentsCache.get(rc.BaseURL, owner, repo, ref, path); ok {
+		return entries, nil
+	}
+
+	contentsURL := fmt.Sprintf("%s/repos/%s/%s/contents/%s", rc.BaseURL, owner, repo, escapePath(path))
+	if ref != "" {
+		contentsURL += "?ref=" + url.QueryEscape(ref)
+	}
+
+	resp, err := rc.get(ctx, contentsURL, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var entries []*content
+	if err := rc.decode(resp.Body, &entries); err != nil {
+		return nil, err
+	}
+	defaultContentsCache.put(rc.BaseURL, owner, repo, ref, path, entries)
+	return entries, nil
+}
+
+// escapePath escapes every segment of a slash separated repository path
+func escapePath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// DefaultContentsCacheTTL is how long the directory listings of a branch
+// are reused. The listings of tags and commits never expire since they
+// cannot change.
+const DefaultContentsCacheTTL = 10 * time.Minute
+
+var commitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ContentsCache caches the directory listings of github repositories, keyed
+// by API url and owner/repo/ref/path, so that clients pointed at different
+// hosts do not share listings. It is safe for concurrent use.
+type ContentsCache struct {
+	// TTL is how long the listings of branches are reused
+	TTL time.Duration
+
+	mu      sync.RWMutex
+	entries map[contentsKey]*contentsEntry
+}
+
+// contentsKey identifies the listing of path in repo, an owner/repo@ref,
+// as read from the API at baseURL
+type contentsKey struct {
+	baseURL string
+	repo    string
+	path    string
+}
+
+func newContentsKey(baseURL, owner, repo, ref, path string) contentsKey {
+	return contentsKey{baseURL: baseURL, repo: owner + "/" + repo + "@" + ref, path: strings.Trim(path, "/")}
+}
+
+type contentsEntry struct {
+	entries   []*content
+	fetchedAt time.Time
+	immutable bool
+}
+
+// NewContentsCache returns an empty cache whose branch listings expire
+// after ttl
+func NewContentsCache(ttl time.Duration) *ContentsCache {
+	return &ContentsCache{
+		TTL:     ttl,
+		entries: map[contentsKey]*contentsEntry{},
+	}
+}
+
+// defaultContentsCache is used by the package level helpers
+var defaultContentsCache = NewContentsCache(DefaultContentsCacheTTL)
+
+// InvalidateFileNames drops the cached listings of the directory at path of
+// owner/repo at ref, along with the ones of its subdirectories. Every
+// listing of owner/repo at ref is dropped if path is empty.
+func InvalidateFileNames(owner, repo, ref, path string) {
+	defaultContentsCache.Invalidate(owner, repo, ref, path)
+}
+
+func (c *ContentsCache) get(baseURL, owner, repo, ref, path string) ([]*content, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[newContentsKey(baseURL, owner, repo, ref, path)]
+	if !ok || (!entry.immutable && time.Since(entry.fetchedAt) > c.TTL) {
+		return nil, false
+	}
+	return entry.entries, true
+}
+
+func (c *ContentsCache) put(baseURL, owner, repo, ref, path string, entries []*content) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[newContentsKey(baseURL, owner, repo, ref, path)] = &contentsEntry{
+		entries:   entries,
+		fetchedAt: time.Now(),
+		immutable: isImmutableRef(ref),
+	}
+}
+
+// Invalidate drops the cached listings of the directory at path of
+// owner/repo at ref, along with the ones of its subdirectories, whatever
+// the API they were read from. Every listing of owner/repo at ref is
+// dropped if path is empty.
+func (c *ContentsCache) Invalidate(owner, repo, ref, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := newContentsKey("", owner, repo, ref, path)
+	for key := range c.entries {
+		if key.repo != dir.repo {
+			continue
+		}
+		if dir.path == "" || key.path == dir.path || strings.HasPrefix(key.path, dir.path+"/") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// isImmutableRef reports whether ref is a release tag or a commit, whose
+// contents never change, rather than a branch
+func isImmutableRef(ref string) bool {
+	if commitRegex.MatchString(ref) {
+		return true
+	}
+	_, err := semver.StrictNewVersion(strings.TrimPrefix(ref, "v"))
+	return err == nil
+}
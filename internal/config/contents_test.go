@@ -0,0 +1,265 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// repoServer serves the contents API of a repository holding files, by
+// path, along with the raw files. The files ending in .b64 are only
+// served base64 encoded through the contents API, like on mirrors which
+// have no raw downloads.
+func repoServer(t *testing.T, owner, repo string, files map[string]string, hits map[string]int) *httptest.Server {
+	var srv *httptest.Server
+	prefix := "/repos/" + owner + "/" + repo + "/contents/"
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		if strings.HasPrefix(r.URL.Path, "/raw/") {
+			_, _ = w.Write([]byte(files[strings.TrimPrefix(r.URL.Path, "/raw/")]))
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("ref") != "v1.14.3" {
+			t.Errorf("%s read at ref %q, want v1.14.3", r.URL.Path, r.URL.Query().Get("ref"))
+		}
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		if body, ok := files[path]; ok {
+			_ = json.NewEncoder(w).Encode(content{Name: path, Path: path, Type: "file", Encoding: "base64", Content: wrap(base64.StdEncoding.EncodeToString([]byte(body)))})
+			return
+		}
+
+		var entries []content
+		seen := map[string]bool{}
+		for name, body := range files {
+			if !strings.HasPrefix(name, path+"/") {
+				continue
+			}
+			rest := strings.TrimPrefix(name, path+"/")
+			entry := content{Name: rest, Path: name, Type: "file", Size: int64(len(body)), URL: srv.URL + prefix + name + "?ref=v1.14.3"}
+			if i := strings.Index(rest, "/"); i >= 0 {
+				entry = content{Name: rest[:i], Path: path + "/" + rest[:i], Type: "dir"}
+			} else if !strings.HasSuffix(name, ".b64") {
+				entry.DownloadURL = srv.URL + "/raw/" + name
+			}
+			if !seen[entry.Path] {
+				seen[entry.Path] = true
+				entries = append(entries, entry)
+			}
+		}
+		if len(entries) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+		_ = json.NewEncoder(w).Encode(entries)
+	}))
+	return srv
+}
+
+// wrap breaks s every 60 characters like github does
+func wrap(s string) string {
+	var lines []string
+	for len(s) > 60 {
+		lines = append(lines, s[:60])
+		s = s[60:]
+	}
+	return strings.Join(append(lines, s), "\n")
+}
+
+func TestGetFilesMatching(t *testing.T) {
+	files := map[string]string{
+		"crds/a.yaml":    "kind: A",
+		"crds/b.json":    "{}",
+		"crds/v2/c.yaml": "kind: C",
+	}
+	srv := repoServer(t, "cilium", "list-test", files, map[string]int{})
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	tests := []struct {
+		name string
+		opts FileOptions
+		want []string
+	}{
+		{name: "directory", want: []string{"a.yaml", "b.json"}},
+		{name: "pattern", opts: FileOptions{Pattern: "*.yaml"}, want: []string{"a.yaml"}},
+		{name: "subdirectories", opts: FileOptions{Pattern: "*.yaml", MaxDepth: -1}, want: []string{"a.yaml", "v2/c.yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := rc.GetFilesMatching(context.Background(), "cilium", "list-test", "crds", "v1.14.3", tt.opts)
+			if err != nil {
+				t.Fatalf("GetFilesMatching: %v", err)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("names = %v, want %v", names, tt.want)
+			}
+		})
+	}
+
+	if _, err := rc.GetFilesMatching(context.Background(), "cilium", "list-test", "crds", "v1.14.3", FileOptions{Pattern: "["}); errorCode(err) != ErrInvalidFilePatternCode {
+		t.Errorf("invalid pattern error = %v, want %s", err, ErrInvalidFilePatternCode)
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+	long := strings.Repeat("spec: {}\n", 20)
+	files := map[string]string{
+		"crds/a.yaml":     "kind: A",
+		"crds/b.yaml.b64": long,
+		"crds/huge.yaml":  strings.Repeat("#", 2048),
+	}
+	srv := repoServer(t, "cilium", "files-test", files, map[string]int{})
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	got, err := rc.GetFiles(context.Background(), "cilium", "files-test", "crds", "v1.14.3", FileOptions{MaxFileSize: 1024, Concurrency: 1})
+	if err != nil {
+		t.Fatalf("GetFiles: %v", err)
+	}
+	contents := map[string]string{}
+	for _, file := range got {
+		contents[file.Path] = file.Content
+	}
+	want := map[string]string{"crds/a.yaml": "kind: A", "crds/b.yaml.b64": long}
+	if !reflect.DeepEqual(contents, want) {
+		t.Errorf("files = %q, want %q", contents, want)
+	}
+}
+
+func TestContentsCache(t *testing.T) {
+	firstHits, secondHits := map[string]int{}, map[string]int{}
+	first := repoServer(t, "cilium", "cache-test", map[string]string{"crds/a.yaml": "kind: A"}, firstHits)
+	defer first.Close()
+	second := repoServer(t, "cilium", "cache-test", map[string]string{"crds/b.yaml": "kind: B"}, secondHits)
+	defer second.Close()
+	listing := "/repos/cilium/cache-test/contents/crds"
+
+	list := func(srv *httptest.Server) []string {
+		t.Helper()
+		names, err := newTestClient(t, srv).GetFilesMatching(context.Background(), "cilium", "cache-test", "crds", "v1.14.3", FileOptions{})
+		if err != nil {
+			t.Fatalf("GetFilesMatching: %v", err)
+		}
+		return names
+	}
+
+	for i := 0; i < 2; i++ {
+		if names := list(first); !reflect.DeepEqual(names, []string{"a.yaml"}) {
+			t.Errorf("names = %v, want [a.yaml]", names)
+		}
+	}
+	if firstHits[listing] != 1 {
+		t.Errorf("directory listed %d times, want 1", firstHits[listing])
+	}
+
+	if names := list(second); !reflect.DeepEqual(names, []string{"b.yaml"}) {
+		t.Errorf("names from another host = %v, want [b.yaml]", names)
+	}
+	if secondHits[listing] != 1 {
+		t.Errorf("directory listed %d times on another host, want 1", secondHits[listing])
+	}
+
+	InvalidateFileNames("cilium", "cache-test", "v1.14.3", "")
+	list(first)
+	list(second)
+	if firstHits[listing] != 2 || secondHits[listing] != 2 {
+		t.Errorf("directory listed %d and %d times after invalidation, want 2 and 2", firstHits[listing], secondHits[listing])
+	}
+}
+
+func TestContentsCacheExpiry(t *testing.T) {
+	cache := NewContentsCache(0)
+	entries := []*content{{Name: "a.yaml"}}
+	for _, ref := range []string{"main", "v1.14.3", strings.Repeat("a", 40)} {
+		cache.put("https://api.github.com/", "cilium", "cilium", ref, "crds", entries)
+	}
+
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{ref: "main", want: false},
+		{ref: "v1.14.3", want: true},
+		{ref: strings.Repeat("a", 40), want: true},
+	}
+	for _, tt := range tests {
+		if _, ok := cache.get("https://api.github.com/", "cilium", "cilium", tt.ref, "crds"); ok != tt.want {
+			t.Errorf("cached listing at %s reused = %v, want %v", tt.ref, ok, tt.want)
+		}
+	}
+	if _, ok := cache.get("https://github.example.com/api/v3/", "cilium", "cilium", "v1.14.3", "crds"); ok {
+		t.Error("cached listing reused for another API url")
+	}
+}
+
+func TestWalkDirectoryCanceled(t *testing.T) {
+	files := map[string]string{}
+	for _, dir := range []string{"a", "b", "c", "d"} {
+		for _, name := range []string{"x.yaml", "y.yaml"} {
+			files["crds/"+dir+"/"+name] = "kind: " + dir
+		}
+	}
+	hits := map[string]int{}
+	srv := repoServer(t, "cilium", "cancel-test", files, hits)
+	rc := newTestClient(t, srv)
+
+	// The walk is canceled as soon as the listing of crds is served
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listing := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listing.ServeHTTP(w, r)
+		cancel()
+	})
+
+	var walked []string
+	start := time.Now()
+	err := rc.walkDirectory(ctx, "cilium", "cancel-test", "crds", "v1.14.3", -1, func(relPath string, _ *content) {
+		walked = append(walked, relPath)
+	})
+	elapsed := time.Since(start)
+	srv.Close()
+
+	if errorCode(err) != ErrWalkCanceledCode {
+		t.Fatalf("walkDirectory error = %v, want %s", err, ErrWalkCanceledCode)
+	}
+	if elapsed > time.Second {
+		t.Errorf("walkDirectory returned %s after the cancellation", elapsed)
+	}
+	if len(walked) > 0 {
+		t.Errorf("walked %v after the cancellation", walked)
+	}
+	requests := 0
+	for _, n := range hits {
+		requests += n
+	}
+	if requests != 1 {
+		t.Errorf("%d requests served, want only the listing of crds: %v", requests, hits)
+	}
+}
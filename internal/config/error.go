@@ -15,6 +15,10 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/layer5io/meshkit/errors"
 )
 
@@ -32,6 +36,118 @@ const (
 	ErrGetLatestReleaseNamesCode = "1023"
 
 	ErrGetManifestNamesCode = "1024"
+
+	// ErrInvalidGithubTokenCode represents the error which occurs when github
+	// rejects the token used for fetching releases
+	ErrInvalidGithubTokenCode = "1031"
+
+	// ErrReleaseFetchCanceledCode represents the error which occurs when fetching
+	// releases is canceled or exceeds its deadline
+	ErrReleaseFetchCanceledCode = "1032"
+
+	// ErrReleaseFetchRetriesExhaustedCode represents the error which occurs when
+	// fetching releases keeps failing after all of the retries
+	ErrReleaseFetchRetriesExhaustedCode = "1033"
+
+	// ErrInvalidVersionCode represents the error which occurs when a release
+	// tag is not a valid semantic version
+	ErrInvalidVersionCode = "1034"
+
+	// ErrInvalidGithubURLCode represents the error which occurs when the
+	// configured github url or repository is invalid
+	ErrInvalidGithubURLCode = "1036"
+
+	// ErrLoadCABundleCode represents the error which occurs when the
+	// configured CA bundle cannot be loaded
+	ErrLoadCABundleCode = "1037"
+
+	// ErrGithubNotFoundCode represents the error which occurs when github
+	// responds with 404 Not Found
+	ErrGithubNotFoundCode = "1038"
+
+	// ErrReleaseNotFoundCode represents the error which occurs when there
+	// is no release with the requested tag
+	ErrReleaseNotFoundCode = "1039"
+
+	// ErrInvalidReleaseTagCode represents the error which occurs when a
+	// release tag cannot be part of a github url
+	ErrInvalidReleaseTagCode = "1040"
+
+	// ErrNoMatchingAssetCode represents the error which occurs when no
+	// asset of a release matches the requested name
+	ErrNoMatchingAssetCode = "1041"
+
+	// ErrDownloadAssetCode represents the error which occurs when a
+	// release asset cannot be downloaded
+	ErrDownloadAssetCode = "1042"
+
+	// ErrAssetChecksumMismatchCode represents the error which occurs when
+	// a downloaded asset does not match its published checksum
+	ErrAssetChecksumMismatchCode = "1043"
+
+	// ErrResponseTooLargeCode represents the error which occurs when a
+	// github response exceeds the size cap
+	ErrResponseTooLargeCode = "1044"
+
+	// ErrInvalidRefreshIntervalCode represents the error which occurs when
+	// the version refresh interval cannot be parsed
+	ErrInvalidRefreshIntervalCode = "1045"
+
+	// ErrFetchHelmIndexCode represents the error which occurs when the
+	// index of the cilium helm repository cannot be fetched
+	ErrFetchHelmIndexCode = "1046"
+
+	// ErrInvalidFilePatternCode represents the error which occurs when a
+	// file name pattern is malformed
+	ErrInvalidFilePatternCode = "1047"
+
+	// ErrWalkCanceledCode represents the error which occurs when walking
+	// a repository is aborted by its context
+	ErrWalkCanceledCode = "1048"
+
+	// ErrRateLimitedCode represents the error which occurs when github
+	// rejects the requests because of its rate limit
+	ErrRateLimitedCode = "1049"
+
+	// ErrUnknownChannelCode represents the error which occurs when an
+	// unknown release channel is requested
+	ErrUnknownChannelCode = "1050"
+
+	// ErrIncompatibleKubernetesCode represents the error which occurs when
+	// a cilium version does not support the kubernetes version
+	ErrIncompatibleKubernetesCode = "1052"
+
+	// ErrInvalidReleaseNotesLimitCode represents the error which occurs when
+	// the release notes size limit cannot be parsed
+	ErrInvalidReleaseNotesLimitCode = "1053"
+
+	// ErrUnknownVersionCode represents the error which occurs when the
+	// requested version has no cilium release
+	ErrUnknownVersionCode = "1098"
+
+	// ErrDraftVersionCode represents the error which occurs when the
+	// requested version is a draft release
+	ErrDraftVersionCode = "1099"
+
+	// ErrInvalidHelmRepoCode represents the error which occurs when the
+	// url of the helm repository is malformed
+	ErrInvalidHelmRepoCode = "1107"
+
+	// ErrChartVersionNotFoundCode represents the error which occurs when
+	// the helm repository does not publish the requested chart version
+	ErrChartVersionNotFoundCode = "1108"
+
+	// ErrFetchOCIChartCode represents the error which occurs when a chart
+	// cannot be listed or pulled from an OCI registry
+	ErrFetchOCIChartCode = "1112"
+
+	// ErrChartDigestMismatchCode represents the error which occurs when
+	// the chart fetched does not have the requested digest
+	ErrChartDigestMismatchCode = "1113"
+
+	// ErrInvalidChartDigestCode represents the error which occurs when
+	// the requested digest of the chart is malformed
+	ErrInvalidChartDigestCode = "1114"
 )
 
 var (
@@ -53,3 +169,168 @@ func ErrGetLatestReleaseNames(err error) error {
 func ErrGetManifestNames(err error) error {
 	return errors.New(ErrGetManifestNamesCode, errors.Alert, []string{"Unable to fetch manifest names from github"}, []string{err.Error()}, []string{}, []string{})
 }
+
+// ErrInvalidGithubToken is the error when github rejects the configured token
+func ErrInvalidGithubToken(err error) error {
+	return errors.New(ErrInvalidGithubTokenCode, errors.Alert, []string{"Github rejected the configured token"}, []string{err.Error()}, []string{"The token set in GITHUB_TOKEN is invalid, expired or revoked"}, []string{"Update GITHUB_TOKEN with a valid token or unset it to fetch releases anonymously"})
+}
+
+// ErrReleaseFetchCanceled is the error when fetching releases is aborted by its context
+func ErrReleaseFetchCanceled(err error) error {
+	return errors.New(ErrReleaseFetchCanceledCode, errors.Alert, []string{"Fetching release info was canceled"}, []string{err.Error()}, []string{"The adapter is shutting down", "The request to github exceeded its deadline"}, []string{"Retry the operation once github is reachable"})
+}
+
+// ErrReleaseFetchRetriesExhausted is the error when fetching releases failed on every attempt
+func ErrReleaseFetchRetriesExhausted(attempts, lastStatus int, err error) error {
+	return errors.New(ErrReleaseFetchRetriesExhaustedCode, errors.Alert, []string{"Unable to fetch release info"}, []string{fmt.Sprintf("Giving up after %d attempts, last status code: %d", attempts, lastStatus), err.Error()}, []string{"Github API is unavailable", "Network connectivity to github is flaky"}, []string{"Verify network connectivity.", "Retry the operation later."})
+}
+
+// ErrInvalidVersion is the error when a release tag cannot be parsed as a version
+func ErrInvalidVersion(tag string, err error) error {
+	return errors.New(ErrInvalidVersionCode, errors.Alert, []string{"Invalid cilium version"}, []string{fmt.Sprintf("Release tag %q is not a valid semantic version", tag), err.Error()}, []string{"The release tag does not follow the vMAJOR.MINOR.PATCH format"}, []string{"Use a version of the form vMAJOR.MINOR.PATCH"})
+}
+
+// ErrInvalidGithubURL is the error when the configured github url or repository is invalid
+func ErrInvalidGithubURL(err error) error {
+	return errors.New(ErrInvalidGithubURLCode, errors.Alert, []string{"Invalid github configuration"}, []string{err.Error()}, []string{"CILIUM_GITHUB_API_URL or CILIUM_GITHUB_REPO is malformed"}, []string{"Set the url to an absolute http(s) url and the repository to the owner/repo form"})
+}
+
+// ErrLoadCABundle is the error when the CA bundle at path cannot be loaded
+func ErrLoadCABundle(path string, err error) error {
+	return errors.New(ErrLoadCABundleCode, errors.Alert, []string{"Unable to load the CA bundle"}, []string{fmt.Sprintf("Could not load the CA certificates from %s", path), err.Error()}, []string{"The file set in CILIUM_CA_BUNDLE does not exist, is not readable or does not contain PEM encoded certificates"}, []string{"Point CILIUM_CA_BUNDLE to a readable PEM file or unset it"})
+}
+
+// ErrGithubNotFound is the error when github responds with 404 for url
+func ErrGithubNotFound(url string) error {
+	return errors.New(ErrGithubNotFoundCode, errors.Alert, []string{"Resource not found on github"}, []string{fmt.Sprintf("Github responded with 404 Not Found for %s", url)}, []string{"The repository or the requested resource does not exist or is private"}, []string{"Verify CILIUM_GITHUB_REPO and the github token"})
+}
+
+// ErrReleaseNotFound is the error when there is no release tagged tag
+func ErrReleaseNotFound(tag string) error {
+	return errors.New(ErrReleaseNotFoundCode, errors.Alert, []string{"Release not found"}, []string{fmt.Sprintf("There is no cilium release with the tag %s", tag)}, []string{"The version does not exist or has not been released yet"}, []string{"Pick a version from the supported versions list"})
+}
+
+// ErrInvalidReleaseTag is the error when tag is not a valid release tag
+func ErrInvalidReleaseTag(tag string) error {
+	return errors.New(ErrInvalidReleaseTagCode, errors.Alert, []string{"Invalid release tag"}, []string{fmt.Sprintf("%q is not a valid release tag", tag)}, []string{"The tag is empty or contains whitespace or url reserved characters"}, []string{"Use a tag of the form v1.11.0"})
+}
+
+// ErrNoMatchingAsset is the error when no asset of the release tagged tag matches pattern
+func ErrNoMatchingAsset(tag, pattern string) error {
+	return errors.New(ErrNoMatchingAssetCode, errors.Alert, []string{"No matching release asset"}, []string{fmt.Sprintf("No asset of the release %s matches %s", tag, pattern)}, []string{"The release does not publish an asset for this platform"}, []string{"Check the assets of the release on github"})
+}
+
+// ErrDownloadAsset is the error when downloading the asset name fails
+func ErrDownloadAsset(name string, err error) error {
+	return errors.New(ErrDownloadAssetCode, errors.Alert, []string{"Error downloading release asset"}, []string{fmt.Sprintf("Could not download %s", name), err.Error()}, []string{"Github might not be reachable or the destination is not writable"}, []string{"Retry the operation, interrupted downloads are resumed"})
+}
+
+// ErrAssetChecksumMismatch is the error when the asset name does not match its checksum
+func ErrAssetChecksumMismatch(name, want, got string) error {
+	return errors.New(ErrAssetChecksumMismatchCode, errors.Alert, []string{"Release asset checksum mismatch"}, []string{fmt.Sprintf("The sha256 of %s is %s, expected %s", name, got, want)}, []string{"The download was corrupted or tampered with"}, []string{"Retry the operation, the corrupted download has been removed"})
+}
+
+// ErrResponseTooLarge is the error when a github response is larger than limit bytes
+func ErrResponseTooLarge(limit int64) error {
+	return errors.New(ErrResponseTooLargeCode, errors.Alert, []string{"Response too large"}, []string{fmt.Sprintf("The response from github is larger than %d bytes", limit)}, []string{"A proxy between the adapter and github returned an unexpected body, or too many releases were requested per page"}, []string{"Check the proxy configuration or raise the cap on the response size"})
+}
+
+// ErrInvalidRefreshInterval is the error when the version refresh interval is invalid
+func ErrInvalidRefreshInterval(interval string) error {
+	return errors.New(ErrInvalidRefreshIntervalCode, errors.Alert, []string{"Invalid version refresh interval"}, []string{fmt.Sprintf("%q is not a positive duration, the default interval is used", interval)}, []string{"CILIUM_VERSION_REFRESH_INTERVAL is malformed"}, []string{"Set CILIUM_VERSION_REFRESH_INTERVAL to a duration like 30m or 6h"})
+}
+
+// ErrFetchHelmIndex is the error when the cilium helm repository index cannot be fetched
+func ErrFetchHelmIndex(err error) error {
+	return errors.New(ErrFetchHelmIndexCode, errors.Alert, []string{"Unable to fetch the cilium helm repository index"}, []string{err.Error(), "The versions are not checked against the published charts"}, []string{"The helm repository might not be reachable"}, []string{"Set CILIUM_SKIP_CHART_CHECK to true in offline environments"})
+}
+
+// ErrInvalidFilePattern is the error when the file name pattern is malformed
+func ErrInvalidFilePattern(pattern string, err error) error {
+	return errors.New(ErrInvalidFilePatternCode, errors.Alert, []string{"Invalid file pattern"}, []string{fmt.Sprintf("%q is not a valid file name pattern", pattern), err.Error()}, []string{"The pattern has unbalanced brackets or a trailing backslash"}, []string{"Use a pattern like *.yaml"})
+}
+
+// ErrWalkCanceled is the error when walking a repository is aborted by its context
+func ErrWalkCanceled(err error) error {
+	return errors.New(ErrWalkCanceledCode, errors.Alert, []string{"Reading the repository files was canceled"}, []string{err.Error()}, []string{"The operation was aborted", "The adapter is shutting down"}, []string{"Retry the operation"})
+}
+
+// ErrRateLimited is the error when github rate limits the requests until reset
+func ErrRateLimited(reset time.Time) error {
+	return errors.New(ErrRateLimitedCode, errors.Alert, []string{"Github rate limit exceeded"}, []string{fmt.Sprintf("Github rejected the request because of its rate limit, retry after %s", reset.UTC().Format("15:04 MST"))}, []string{"Too many requests were made to github, anonymous requests are limited to 60 per hour"}, []string{"Retry after the rate limit resets", "Set GITHUB_TOKEN for a much higher rate limit"})
+}
+
+// ErrUnknownChannel is the error when channel is not a known release channel
+func ErrUnknownChannel(channel string) error {
+	return errors.New(ErrUnknownChannelCode, errors.Alert, []string{"Unknown release channel"}, []string{fmt.Sprintf("%q is not a release channel", channel)}, []string{"The channel name is misspelled"}, []string{"Use either the stable or the edge channel"})
+}
+
+// ErrIncompatibleKubernetes is the error when a cilium version does not support the kubernetes version
+func ErrIncompatibleKubernetes(err error) error {
+	return errors.New(ErrIncompatibleKubernetesCode, errors.Alert, []string{"Cilium version incompatible with the cluster"}, []string{err.Error()}, []string{"The selected cilium version does not support the kubernetes version of the cluster"}, []string{"Pick a cilium version supporting the cluster", "Set skipCompatibilityCheck to true to install anyway"})
+}
+
+// ErrInvalidReleaseNotesLimit is the error when the release notes size limit is invalid
+func ErrInvalidReleaseNotesLimit(limit string) error {
+	return errors.New(ErrInvalidReleaseNotesLimitCode, errors.Alert, []string{"Invalid release notes limit"}, []string{fmt.Sprintf("%q is not a positive number of bytes, the default limit is used", limit)}, []string{"CILIUM_RELEASE_NOTES_LIMIT is malformed"}, []string{"Set CILIUM_RELEASE_NOTES_LIMIT to a number of bytes like 4096"})
+}
+
+// IsReleaseNotFound reports whether err was returned because the requested
+// release does not exist
+func IsReleaseNotFound(err error) bool {
+	e, ok := errors.Is(err)
+	return ok && e.Code == ErrReleaseNotFoundCode
+}
+
+// IsGithubNotFound reports whether err was returned because github has
+// no such repository, path or ref
+func IsGithubNotFound(err error) bool {
+	e, ok := errors.Is(err)
+	return ok && e.Code == ErrGithubNotFoundCode
+}
+
+// IsReleaseFetchCanceled reports whether err was returned because fetching
+// releases was aborted by its context rather than by an HTTP failure
+func IsReleaseFetchCanceled(err error) bool {
+	e, ok := errors.Is(err)
+	return ok && e.Code == ErrReleaseFetchCanceledCode
+}
+
+// ErrUnknownVersion is the error when there is no release tagged tag, near being the closest releases
+func ErrUnknownVersion(tag string, near []string) error {
+	remedy := []string{"Pick a version from the supported versions list"}
+	if len(near) > 0 {
+		remedy = append(remedy, fmt.Sprintf("Did you mean one of %s?", strings.Join(near, ", ")))
+	}
+	return errors.New(ErrUnknownVersionCode, errors.Alert, []string{"Unknown Cilium version"}, []string{fmt.Sprintf("There is no cilium release with the tag %s", tag)}, []string{"The version is misspelled or has not been released yet"}, remedy)
+}
+
+// ErrDraftVersion is the error when the release tagged tag is a draft
+func ErrDraftVersion(tag string) error {
+	return errors.New(ErrDraftVersionCode, errors.Alert, []string{"Cilium version not released"}, []string{fmt.Sprintf("The cilium release %s is a draft", tag)}, []string{"The release is being prepared and its artifacts are not published"}, []string{"Wait for the release to be published or pick a released version"})
+}
+
+// ErrInvalidHelmRepo is the error when the url of the helm repository is malformed
+func ErrInvalidHelmRepo(repoURL string, err error) error {
+	return errors.New(ErrInvalidHelmRepoCode, errors.Alert, []string{"Invalid helm repository"}, []string{fmt.Sprintf("%q is not a valid helm repository url", repoURL), err.Error()}, []string{"CILIUM_HELM_REPO_URL or the helmRepo of the request is malformed"}, []string{"Use a url like https://charts.internal/cilium/ or oci://registry.internal/charts"})
+}
+
+// ErrChartVersionNotFound is the error when the helm repository repoURL does not publish version of chart
+func ErrChartVersionNotFound(repoURL, chart, version string) error {
+	return errors.New(ErrChartVersionNotFoundCode, errors.Alert, []string{"Chart version not found"}, []string{fmt.Sprintf("The helm repository %s does not publish version %s of the %s chart", repoURL, version, chart)}, []string{"The mirror is not synchronized with the upstream repository", "The version does not exist"}, []string{"Mirror the chart version into the repository", "Pick a version the repository publishes"})
+}
+
+// ErrFetchOCIChart is the error when the chart ref cannot be listed or pulled from its OCI registry
+func ErrFetchOCIChart(ref string, err error) error {
+	return errors.New(ErrFetchOCIChartCode, errors.Alert, []string{"Unable to fetch the chart from the OCI registry"}, []string{fmt.Sprintf("%s: %s", ref, err.Error())}, []string{"The registry might not be reachable", "The credentials of the registry are missing or wrong"}, []string{"Check the url of the registry", "Set the credentials of the registry, with CILIUM_HELM_REPO_USERNAME and CILIUM_HELM_REPO_PASSWORD or the helmRepoSecret of the request"})
+}
+
+// ErrChartDigestMismatch is the error when the chart ref has the digest got instead of want
+func ErrChartDigestMismatch(ref, want, got string) error {
+	return errors.New(ErrChartDigestMismatchCode, errors.Alert, []string{"Chart verification failed"}, []string{fmt.Sprintf("The chart %s has the digest %s instead of %s", ref, got, want)}, []string{"The chart was republished under the same version", "The repository serves a tampered chart"}, []string{"Check the digest of the chart in the repository", "Do not install a chart whose origin is not known"})
+}
+
+// ErrInvalidChartDigest is the error when the requested digest of the chart is malformed
+func ErrInvalidChartDigest(digest string) error {
+	return errors.New(ErrInvalidChartDigestCode, errors.Alert, []string{"Invalid chart digest"}, []string{fmt.Sprintf("%q is not a sha256 digest", digest)}, []string{"The chartDigest of the request is malformed"}, []string{"Use a digest like sha256: followed by 64 hexadecimal digits"})
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	_ "embed" // fallback_versions.json is embedded
+	"encoding/json"
+)
+
+//go:generate go run ../../cmd/fallback-versions -o fallback_versions.json
+
+// fallbackVersionsJSON holds the cilium versions known at build time, which
+// are offered when github cannot be reached
+//
+//go:embed fallback_versions.json
+var fallbackVersionsJSON []byte
+
+// FallbackVersions is the format of the embedded list of versions
+type FallbackVersions struct {
+	Versions []string `json:"versions"`
+}
+
+// fallbackReleases returns the embedded versions as releases so that they
+// go through the same filters as the ones fetched from github
+func fallbackReleases() []*Release {
+	var fallback FallbackVersions
+	if err := json.Unmarshal(fallbackVersionsJSON, &fallback); err != nil {
+		logWarn(ErrGetLatestReleaseNames(err))
+		return nil
+	}
+
+	releases := make([]*Release, 0, len(fallback.Versions))
+	for _, version := range fallback.Versions {
+		releases = append(releases, &Release{TagName: version})
+	}
+	return releases
+}
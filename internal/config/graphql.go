@@ -0,0 +1,208 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+// releasesQuery requests only the fields of Release and Asset, latest
+// release first like the REST API
+const releasesQuery = `query($owner: String!, $repo: String!, $first: Int!, $after: String) {
+  repository(owner: $owner, name: $repo) {
+    releases(first: $first, after: $after, orderBy: {field: CREATED_AT, direction: DESC}) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        databaseId
+        tagName
+        name
+        isDraft
+        isPrerelease
+        description
+        releaseAssets(first: 100) { nodes { name downloadUrl } }
+      }
+    }
+  }
+}`
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type graphQLReleases struct {
+	Data struct {
+		Repository *struct {
+			Releases struct {
+				PageInfo struct {
+					HasNextPage bool   `json:"hasNextPage"`
+					EndCursor   string `json:"endCursor"`
+				} `json:"pageInfo"`
+				Nodes []struct {
+					DatabaseID    int    `json:"databaseId"`
+					TagName       string `json:"tagName"`
+					Name          string `json:"name"`
+					IsDraft       bool   `json:"isDraft"`
+					IsPrerelease  bool   `json:"isPrerelease"`
+					Description   string `json:"description"`
+					ReleaseAssets struct {
+						Nodes []struct {
+							Name        string `json:"name"`
+							DownloadURL string `json:"downloadUrl"`
+						} `json:"nodes"`
+					} `json:"releaseAssets"`
+				} `json:"nodes"`
+			} `json:"releases"`
+		} `json:"repository"`
+	} `json:"data"`
+	Errors []struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// graphQLRateLimited is the type of the errors of the GraphQL API when its
+// rate limit is exceeded, which comes with a 200 status code
+const graphQLRateLimited = "RATE_LIMITED"
+
+// useGraphQL reports whether the releases are fetched through the GraphQL
+// API, which requires a token
+func (rc *ReleaseClient) useGraphQL() bool {
+	return rc.Token != "" && !rc.DisableGraphQL
+}
+
+// graphQLURL returns the GraphQL endpoint matching BaseURL, which is
+// /api/graphql on GitHub Enterprise and /graphql on github.com
+func (rc *ReleaseClient) graphQLURL() string {
+	if strings.HasSuffix(rc.BaseURL, "/api/v3") {
+		return strings.TrimSuffix(rc.BaseURL, "/v3") + "/graphql"
+	}
+	return rc.BaseURL + "/graphql"
+}
+
+// listReleasesGraphQL is listReleases through the GraphQL API. The releases
+// are the same as the ones returned by the REST API.
+func (rc *ReleaseClient) listReleasesGraphQL(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error) {
+	maxPages := rc.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	if perPage == 0 || perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	var (
+		releaseList []*Release
+		after       *string
+	)
+	for page := 0; page < maxPages; page++ {
+		rels, next, err := rc.getGraphQLPage(ctx, perPage, after)
+		if err != nil {
+			return nil, err
+		}
+
+		releaseList = append(releaseList, rels...)
+		if next == nil || (done != nil && done(releaseList)) {
+			break
+		}
+		after = next
+	}
+
+	return releaseList, nil
+}
+
+// getGraphQLPage returns a page of releases along with the cursor of the
+// next page, which is nil on the last page
+func (rc *ReleaseClient) getGraphQLPage(ctx context.Context, perPage uint, after *string) ([]*Release, *string, error) {
+	body, err := json.Marshal(graphQLRequest{
+		Query: releasesQuery,
+		Variables: map[string]interface{}{
+			"owner": rc.Owner,
+			"repo":  rc.Repo,
+			"first": perPage,
+			"after": after,
+		},
+	})
+	if err != nil {
+		return nil, nil, ErrGetLatestReleases(err)
+	}
+
+	resp, err := rc.do(ctx, http.MethodPost, rc.graphQLURL(), body, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var result graphQLReleases
+	if err := rc.decode(resp.Body, &result); err != nil {
+		return nil, nil, err
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			if e.Type == graphQLRateLimited {
+				// The headers tell when the limit resets, as with the REST API
+				reset, limited := rateLimitReset(resp.Header, time.Now())
+				if !limited {
+					reset = time.Now().Add(time.Minute)
+				}
+				rc.setRateLimitReset(reset)
+				return nil, nil, ErrRateLimited(reset)
+			}
+			messages = append(messages, e.Message)
+		}
+		return nil, nil, ErrGetLatestReleases(fmt.Errorf("graphql: %s", strings.Join(messages, "; ")))
+	}
+	if result.Data.Repository == nil {
+		return nil, nil, ErrGithubNotFound(fmt.Sprintf("%s/%s", rc.Owner, rc.Repo))
+	}
+
+	releases := result.Data.Repository.Releases
+	releaseList := make([]*Release, 0, len(releases.Nodes))
+	for _, node := range releases.Nodes {
+		release := &Release{
+			ID:         node.DatabaseID,
+			TagName:    node.TagName,
+			Name:       adapter.Version(node.Name),
+			Draft:      node.IsDraft,
+			Prerelease: node.IsPrerelease,
+			Body:       node.Description,
+		}
+		for _, asset := range node.ReleaseAssets.Nodes {
+			// The GraphQL API has no state for the assets, which is
+			// left unknown rather than guessed
+			release.Assets = append(release.Assets, &Asset{
+				Name:        asset.Name,
+				DownloadURL: asset.DownloadURL,
+			})
+		}
+		releaseList = append(releaseList, release)
+	}
+
+	if !releases.PageInfo.HasNextPage {
+		return releaseList, nil, nil
+	}
+	next := releases.PageInfo.EndCursor
+	return releaseList, &next, nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultHelmRepoURL is the helm repository from which cilium is
+	// installed unless HelmRepoURLEnv or the request points to a mirror
+	DefaultHelmRepoURL = "https://helm.cilium.io/"
+
+	// HelmChartName is the name of the cilium chart in the helm repository
+	HelmChartName = "cilium"
+
+	// HelmRepoURLEnv is the environment variable holding the url of a
+	// mirror of the helm repository, like https://charts.internal/cilium/,
+	// or of an OCI registry holding the charts, like
+	// oci://registry.internal/charts
+	HelmRepoURLEnv = "CILIUM_HELM_REPO_URL"
+
+	// HelmRepoUsernameEnv and HelmRepoPasswordEnv are the environment
+	// variables holding the basic auth credentials of the mirror
+	HelmRepoUsernameEnv = "CILIUM_HELM_REPO_USERNAME"
+	HelmRepoPasswordEnv = "CILIUM_HELM_REPO_PASSWORD"
+
+	// SkipChartCheckEnv is the environment variable which, when set to
+	// true, stops dropping the versions without a published helm chart.
+	// It is meant for offline environments where the helm repository
+	// cannot be reached.
+	SkipChartCheckEnv = "CILIUM_SKIP_CHART_CHECK"
+
+	// maxIndexSize caps the size of the helm repository index, which
+	// lists every chart ever published and is much larger than the
+	// github responses
+	maxIndexSize = 64 << 20
+)
+
+// HelmRepository is a helm repository the charts are fetched from
+type HelmRepository struct {
+	// URL of the repository, like https://helm.cilium.io/, or of an OCI
+	// registry, like oci://registry.internal/charts
+	URL string
+
+	// Username and Password authenticate to the repository with basic
+	// auth, or to the OCI registry, if set
+	Username string
+	Password string
+}
+
+// DefaultHelmRepository returns the repository of HelmRepoURLEnv, along
+// with its credentials, or else DefaultHelmRepoURL
+func DefaultHelmRepository() HelmRepository {
+	repo := HelmRepository{URL: DefaultHelmRepoURL}
+	if repoURL := os.Getenv(HelmRepoURLEnv); repoURL != "" {
+		repo.URL = repoURL
+		repo.Username = os.Getenv(HelmRepoUsernameEnv)
+		repo.Password = os.Getenv(HelmRepoPasswordEnv)
+	}
+	return repo
+}
+
+// Validate fails unless the url of the repository is an absolute http,
+// https or oci url
+func (r HelmRepository) Validate() error {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return ErrInvalidHelmRepo(r.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "oci") || u.Host == "" {
+		return ErrInvalidHelmRepo(r.URL, fmt.Errorf("expected an http, https or oci url"))
+	}
+	return nil
+}
+
+// helmIndex is the part of a helm repository index.yaml used for
+// verifying that a chart has been published for a version
+type helmIndex struct {
+	Entries map[string][]struct {
+		Version string `yaml:"version"`
+	} `yaml:"entries"`
+}
+
+// chartIndex caches the chart versions published in the helm
+// repositories, by repository
+type chartIndex struct {
+	mu    sync.Mutex
+	repos map[HelmRepository]*repoIndex
+}
+
+// repoIndex are the versions of every chart of a repository, normalized
+// with ChartVersion
+type repoIndex struct {
+	charts    map[string]map[string]bool
+	fetchedAt time.Time
+}
+
+var defaultChartIndex = &chartIndex{}
+
+// chartVersions returns the set of published versions of chart in repo,
+// normalized with ChartVersion. The index of a repository is downloaded
+// at most once per DefaultReleaseCacheTTL. An OCI registry has no index,
+// the tags of every chart are listed on their own instead.
+func (c *chartIndex) chartVersions(ctx context.Context, repo HelmRepository, chart string) (map[string]bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index, ok := c.repos[repo]
+	if ok && time.Since(index.fetchedAt) < DefaultReleaseCacheTTL {
+		if versions, ok := index.charts[chart]; ok || !repo.IsOCI() {
+			return versions, nil
+		}
+	} else {
+		index = nil
+	}
+
+	if c.repos == nil {
+		c.repos = make(map[HelmRepository]*repoIndex)
+	}
+	if repo.IsOCI() {
+		versions, err := fetchOCIChartVersions(repo, chart)
+		if err != nil {
+			return nil, err
+		}
+		if index == nil {
+			index = &repoIndex{charts: make(map[string]map[string]bool), fetchedAt: time.Now()}
+			c.repos[repo] = index
+		}
+		index.charts[chart] = versions
+		return versions, nil
+	}
+
+	charts, err := fetchChartVersions(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	c.repos[repo] = &repoIndex{charts: charts, fetchedAt: time.Now()}
+	return charts[chart], nil
+}
+
+// CheckChartVersion fails unless repo publishes version of chart. The
+// index of repo is cached like for the version listing.
+func CheckChartVersion(ctx context.Context, repo HelmRepository, chart, version string) error {
+	versions, err := defaultChartIndex.chartVersions(ctx, repo, chart)
+	if err != nil {
+		return err
+	}
+	if !versions[ChartVersion(version)] {
+		return ErrChartVersionNotFound(repo.URL, chart, ChartVersion(version))
+	}
+	return nil
+}
+
+func fetchChartVersions(ctx context.Context, repo HelmRepository) (map[string]map[string]bool, error) {
+	indexURL := strings.TrimSuffix(repo.URL, "/") + "/index.yaml"
+	fail := func(err error) error {
+		return ErrFetchHelmIndex(fmt.Errorf("%s: %w", indexURL, err))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, indexURL, nil)
+	if err != nil {
+		return nil, fail(err)
+	}
+	if repo.Username != "" || repo.Password != "" {
+		req.SetBasicAuth(repo.Username, repo.Password)
+	}
+
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return nil, fail(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fail(fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIndexSize+1))
+	if err != nil {
+		return nil, fail(err)
+	}
+	if len(body) > maxIndexSize {
+		return nil, ErrResponseTooLarge(maxIndexSize)
+	}
+
+	var index helmIndex
+	if err := yaml.Unmarshal(body, &index); err != nil {
+		return nil, fail(err)
+	}
+
+	charts := make(map[string]map[string]bool, len(index.Entries))
+	for chart, entries := range index.Entries {
+		versions := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			versions[ChartVersion(entry.Version)] = true
+		}
+		charts[chart] = versions
+	}
+	return charts, nil
+}
+
+// ChartVersion returns the version of the cilium chart matching a release
+// tag, for example 1.12.0 for v1.12.0
+func ChartVersion(version string) string {
+	if v, err := semver.NewVersion(version); err == nil {
+		return v.String()
+	}
+	return strings.TrimPrefix(version, "v")
+}
+
+// withCharts returns the names which have a published chart along with the
+// ones which do not. Every name is kept if charts is nil.
+func withCharts(names []string, charts map[string]bool) ([]string, []string) {
+	if charts == nil {
+		return names, nil
+	}
+	var kept, missing []string
+	for _, name := range names {
+		if charts[ChartVersion(name)] {
+			kept = append(kept, name)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	return kept, missing
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// CABundleEnv is the environment variable holding the path of a PEM file
+// with additional CA certificates trusted when talking to github, which is
+// needed behind TLS intercepting proxies
+const CABundleEnv = "CILIUM_CA_BUNDLE"
+
+// NewHTTPClient returns an http client which honors the HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables and trusts the CA
+// certificates in the PEM file at caBundlePath, in addition to the system
+// ones. No additional certificates are loaded if caBundlePath is empty.
+func NewHTTPClient(caBundlePath string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if caBundlePath != "" {
+		pool, err := loadCABundle(caBundlePath)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   DefaultReleaseTimeout,
+	}, nil
+}
+
+// loadCABundle returns the system cert pool extended with the certificates
+// in the PEM file at path
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, ErrLoadCABundle(path, err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrLoadCABundle(path, fmt.Errorf("no PEM encoded certificates found"))
+	}
+	return pool, nil
+}
+
+// HTTPClient returns an http client sharing the transport, and so the proxy
+// and CA configuration, of the client used for fetching releases. It has no
+// timeout since it is meant for downloading release assets, which can take a
+// while on slow links.
+func HTTPClient() *http.Client {
+	if defaultReleaseClient == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: defaultReleaseClient.httpClient().Transport}
+}
+
+// newDefaultHTTPClient builds the client shared by the release helpers, an
+// error is returned if the configured CA bundle cannot be loaded
+func newDefaultHTTPClient() (*http.Client, error) {
+	return NewHTTPClient(os.Getenv(CABundleEnv))
+}
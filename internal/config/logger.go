@@ -0,0 +1,32 @@
+package config
+
+import (
+	"github.com/layer5io/meshkit/logger"
+)
+
+// log reports what happens during version discovery. Nothing is
+// logged until SetLogger is called.
+var log logger.Handler
+
+// SetLogger sets the logger used by the config package
+func SetLogger(l logger.Handler) {
+	log = l
+}
+
+func logWarn(err error) {
+	if log != nil {
+		log.Warn(err)
+	}
+}
+
+func logInfo(description ...interface{}) {
+	if log != nil {
+		log.Info(description...)
+	}
+}
+
+func logDebug(description ...interface{}) {
+	if log != nil {
+		log.Debug(description...)
+	}
+}
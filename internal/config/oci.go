@@ -0,0 +1,150 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// IsOCI reports whether the repository is an OCI registry, like
+// oci://registry.internal/charts, rather than a classic helm repository
+func (r HelmRepository) IsOCI() bool {
+	return registry.IsOCI(r.URL)
+}
+
+// ociReference returns the reference of chart in the registry, without
+// the oci:// scheme, at version if one is given
+func (r HelmRepository) ociReference(chart, version string) string {
+	ref := strings.TrimSuffix(strings.TrimPrefix(r.URL, "oci://"), "/") + "/" + chart
+	if version != "" {
+		ref += ":" + ChartVersion(version)
+	}
+	return ref
+}
+
+// registryClient returns a client of the OCI registry of the repository,
+// authenticated with its credentials if it has some. The credentials are
+// written to a file of their own, removed by the returned cleanup, so that
+// concurrent operations do not share them.
+func (r HelmRepository) registryClient() (*registry.Client, func(), error) {
+	if r.Username == "" && r.Password == "" {
+		client, err := registry.NewClient()
+		return client, func() {}, err
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(r.Username + ":" + r.Password))
+	config, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{u.Host: map[string]string{"auth": auth}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := ioutil.TempFile("", "cilium-registry-*.json")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		_ = os.Remove(file.Name())
+	}
+	_, err = file.Write(config)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	client, err := registry.NewClient(registry.ClientOptCredentialsFile(file.Name()))
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return client, cleanup, nil
+}
+
+// fetchOCIChartVersions returns the versions of chart the OCI registry of
+// repo holds, normalized with ChartVersion
+func fetchOCIChartVersions(repo HelmRepository, chart string) (map[string]bool, error) {
+	ref := repo.ociReference(chart, "")
+	client, cleanup, err := repo.registryClient()
+	if err != nil {
+		return nil, ErrFetchOCIChart(ref, err)
+	}
+	defer cleanup()
+
+	tags, err := client.Tags(ref)
+	if err != nil {
+		return nil, ErrFetchOCIChart(ref, err)
+	}
+	versions := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		versions[ChartVersion(tag)] = true
+	}
+	return versions, nil
+}
+
+// PullOCIChart pulls version of chart from the OCI registry of repo into
+// dir and returns the path of the archive along with the digest of its
+// manifest. When digest is set, the manifest must have that digest, like
+// sha256:6d3f..., else nothing is written.
+func PullOCIChart(repo HelmRepository, chart, version, digest, dir string) (string, string, error) {
+	ref := repo.ociReference(chart, version)
+	client, cleanup, err := repo.registryClient()
+	if err != nil {
+		return "", "", ErrFetchOCIChart(ref, err)
+	}
+	defer cleanup()
+
+	result, err := client.Pull(ref)
+	if err != nil {
+		return "", "", ErrFetchOCIChart(ref, err)
+	}
+	if digest != "" && result.Manifest.Digest != digest {
+		return "", "", ErrChartDigestMismatch(ref, digest, result.Manifest.Digest)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", "", ErrFetchOCIChart(ref, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", chart, ChartVersion(version)))
+	if err := ioutil.WriteFile(path, result.Chart.Data, 0o644); err != nil {
+		return "", "", ErrFetchOCIChart(ref, err)
+	}
+	return path, result.Manifest.Digest, nil
+}
+
+// ValidateDigest fails unless digest is a sha256 digest, like
+// sha256:6d3f...
+func ValidateDigest(digest string) error {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if hex == digest || len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return ErrInvalidChartDigest(digest)
+	}
+	return nil
+}
@@ -3,27 +3,443 @@ package config
 import (
 	"github.com/layer5io/meshery-adapter-library/adapter"
 	"github.com/layer5io/meshery-adapter-library/meshes"
-	"github.com/layer5io/meshkit/utils"
 )
 
 var (
 	ServiceName = "service_name"
+
+	// CiliumVersionsOperation reports the supported cilium versions,
+	// fetching them again when the request body sets refresh to true
+	CiliumVersionsOperation = "cilium_supported_versions"
+
+	// CiliumUninstallOperation removes cilium, along with its CRDs,
+	// ConfigMaps and namespaces when the request body asks for it
+	CiliumUninstallOperation = "cilium_uninstall"
+
+	// CiliumUpgradeOperation upgrades cilium in place to the version of
+	// the request body, the latest supported one by default
+	CiliumUpgradeOperation = "cilium_upgrade"
+
+	// CiliumImagesOperation lists the images the latest supported version
+	// pulls, with the registry overrides of the request body applied
+	CiliumImagesOperation = "cilium_images"
+
+	// CiliumEncryptionOperation enables WireGuard or IPsec encryption on
+	// the installed release, or disables it when deleted
+	CiliumEncryptionOperation = "cilium_encryption"
+
+	// CiliumRotateIPsecKeyOperation replaces the IPsec key with one of the
+	// next SPI and restarts the agents
+	CiliumRotateIPsecKeyOperation = "cilium_ipsec_rotate_key"
+
+	// CiliumHubbleOperation enables Hubble on the installed release, or
+	// disables it when deleted
+	CiliumHubbleOperation = "cilium_hubble"
+
+	// CiliumHubbleRelayOperation installs Hubble Relay on the installed
+	// release, or removes it when deleted
+	CiliumHubbleRelayOperation = "cilium_hubble_relay"
+
+	// CiliumHubbleUIOperation deploys Hubble UI on the installed release,
+	// or removes it along with its ingress when deleted
+	CiliumHubbleUIOperation = "cilium_hubble_ui"
+
+	// CiliumClusterMeshOperation connects two clusters of the kubeconfig
+	// with cluster mesh, or disconnects them when deleted
+	CiliumClusterMeshOperation = "cilium_clustermesh"
+
+	// CiliumBGPOperation enables the BGP control plane and applies the
+	// peering policies of the request body, or removes them when deleted
+	CiliumBGPOperation = "cilium_bgp"
+
+	// CiliumEgressGatewayOperation enables the egress gateway and applies
+	// the egress policies of the request body, or removes them when
+	// deleted
+	CiliumEgressGatewayOperation = "cilium_egress_gateway"
+
+	// CiliumBandwidthManagerOperation enables, or disables when deleted,
+	// the bandwidth manager, optionally with BBR
+	CiliumBandwidthManagerOperation = "cilium_bandwidth_manager"
+
+	// CiliumHostFirewallOperation enables the host firewall along with a
+	// baseline host policy, or disables it when deleted
+	CiliumHostFirewallOperation = "cilium_host_firewall"
+
+	// CiliumL2AnnouncementsOperation enables the L2 announcements and
+	// applies the announcement policies of the request body, or removes
+	// them when deleted
+	CiliumL2AnnouncementsOperation = "cilium_l2_announcements"
+
+	// CiliumLBIPAMOperation applies the load balancer IP pools of the
+	// request body, or removes them when deleted, and reports their
+	// utilization
+	CiliumLBIPAMOperation = "cilium_lb_ipam"
+
+	// CiliumTetragonOperation installs the tetragon addon, or uninstalls
+	// it when deleted
+	CiliumTetragonOperation = "cilium_tetragon"
+
+	// CiliumPreflightOperation checks whether the nodes are ready for the
+	// latest supported version, or the one of the request body
+	CiliumPreflightOperation = "cilium_preflight"
+
+	// CiliumConnectivityTestOperation checks the datapath of cilium in a
+	// namespace created for the test
+	CiliumConnectivityTestOperation = "cilium_connectivity_test"
+
+	// CiliumStatusOperation reports the status of the agents and of the
+	// operator as JSON
+	CiliumStatusOperation = "cilium_status"
+
+	// CiliumDetectOperation reports the version of the cilium found in the
+	// cluster and how it was installed
+	CiliumDetectOperation = "cilium_detect"
+
+	// CiliumNodeCleanupOperation clears what cilium left on the nodes
+	// after an uninstall
+	CiliumNodeCleanupOperation = "cilium_node_cleanup"
+
+	// CiliumIngressControllerOperation enables the ingress controller of
+	// cilium
+	CiliumIngressControllerOperation = "cilium_ingress_controller"
+
+	// CiliumMutualAuthOperation enables the mutual authentication of the
+	// workloads with SPIRE
+	CiliumMutualAuthOperation = "cilium_mutual_auth"
+
+	// CiliumStarWarsOperation deploys the Star Wars demo of the cilium
+	// tutorials, or removes it when deleted
+	CiliumStarWarsOperation = "cilium_starwars_app"
+
+	// CiliumStarWarsPolicyOperation applies the L7 policy of the Star Wars
+	// demo and checks that it is enforced, or removes it when deleted
+	CiliumStarWarsPolicyOperation = "cilium_starwars_l7_policy"
+
+	// CiliumFQDNPolicyOperation deploys a pod whose egress a DNS-aware
+	// policy restricts and checks the names it reaches, or removes both
+	// when deleted
+	CiliumFQDNPolicyOperation = "cilium_fqdn_policy"
+
+	// CiliumExportPoliciesOperation exports the CiliumNetworkPolicies and
+	// the CiliumClusterwideNetworkPolicies of the cluster as manifests
+	CiliumExportPoliciesOperation = "cilium_export_policies"
+
+	// CiliumValidatePoliciesOperation validates cilium policies offline
+	// and reports the endpoints they would select, without applying them
+	CiliumValidatePoliciesOperation = "cilium_validate_policies"
+
+	// CiliumSMIPoliciesOperation converts SMI TrafficTargets and their
+	// routes into CiliumNetworkPolicies and applies them
+	CiliumSMIPoliciesOperation = "cilium_smi_policies"
+
+	// CiliumConvertNetworkPoliciesOperation converts NetworkPolicies into
+	// CiliumNetworkPolicies, reporting or applying them
+	CiliumConvertNetworkPoliciesOperation = "cilium_convert_network_policies"
+
+	// CiliumListEndpointsOperation lists the CiliumEndpoints with their
+	// identity, policy enforcement and health, a page at a time
+	CiliumListEndpointsOperation = "cilium_list_endpoints"
+
+	// CiliumNodeIPAMOperation reports the pod CIDRs and the IP utilization
+	// of the CiliumNodes
+	CiliumNodeIPAMOperation = "cilium_node_ipam"
+
+	// CiliumIdentitiesOperation looks up the cilium identities by numeric
+	// identity, by labels or by pod
+	CiliumIdentitiesOperation = "cilium_identities"
 )
 
-func getOperations(dev adapter.Operations) adapter.Operations {
-	var adapterVersions []adapter.Version
-	versions, _ := utils.GetLatestReleaseTagsSorted("cilium", "cilium")
-	for _, v := range versions {
-		adapterVersions = append(adapterVersions, adapter.Version(v))
+// supportedVersions is the number of cilium versions offered for install
+const supportedVersions = 3
+
+// getOperations returns a copy of dev along with the cilium operations,
+// offering the given versions
+func getOperations(versions []adapter.Version, dev adapter.Operations) adapter.Operations {
+	ops := make(adapter.Operations)
+	for name, op := range dev {
+		ops[name] = op
 	}
 
-	dev[CiliumOperation] = &adapter.Operation{
+	ops[CiliumOperation] = &adapter.Operation{
 		Type:                 int32(meshes.OpCategory_INSTALL),
 		Description:          "Cilium Service Mesh",
-		Versions:             adapterVersions,
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumVersionsOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "List supported Cilium versions",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumUninstallOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Uninstall Cilium",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumUpgradeOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Upgrade Cilium",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumImagesOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "List Cilium images",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumEncryptionOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Enable encryption",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumRotateIPsecKeyOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Rotate the IPsec key",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumHubbleOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Enable Hubble",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumHubbleRelayOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Install Hubble Relay",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumHubbleUIOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Deploy Hubble UI",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumClusterMeshOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Connect two clusters with Cluster Mesh",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumBGPOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Configure BGP peering",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumEgressGatewayOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Configure the egress gateway",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumBandwidthManagerOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Enable the bandwidth manager",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumHostFirewallOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Enable the host firewall",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumL2AnnouncementsOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Configure L2 announcements",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumLBIPAMOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Manage load balancer IP pools",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	// The tetragon versions are discovered when the operation runs
+	ops[CiliumTetragonOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Tetragon",
+		Versions:             []adapter.Version{},
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumPreflightOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_VALIDATE),
+		Description:          "Run preflight checks",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumConnectivityTestOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_VALIDATE),
+		Description:          "Run the connectivity test",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumStatusOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_VALIDATE),
+		Description:          "Cilium status",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumDetectOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_VALIDATE),
+		Description:          "Detect the installed Cilium",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumNodeCleanupOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Clean up the Cilium state of the nodes",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumIngressControllerOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Cilium ingress controller",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumMutualAuthOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Mutual authentication with SPIRE",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumStarWarsOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_SAMPLE_APPLICATION),
+		Description:          "Star Wars demo application",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumStarWarsPolicyOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Star Wars L7 policy demo",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumFQDNPolicyOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "DNS-aware policy demo",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumExportPoliciesOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Export Cilium policies",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumValidatePoliciesOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Validate Cilium policies",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumSMIPoliciesOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Convert SMI traffic targets into Cilium policies",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumConvertNetworkPoliciesOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Convert NetworkPolicies into Cilium policies",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumListEndpointsOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "List Cilium endpoints",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumNodeIPAMOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Cilium node IPAM report",
+		Versions:             versions,
+		Templates:            []adapter.Template{},
+		AdditionalProperties: map[string]string{},
+	}
+
+	ops[CiliumIdentitiesOperation] = &adapter.Operation{
+		Type:                 int32(meshes.OpCategory_CUSTOM),
+		Description:          "Look up Cilium identities",
+		Versions:             versions,
 		Templates:            []adapter.Template{},
 		AdditionalProperties: map[string]string{},
 	}
 
-	return dev
+	return ops
 }
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultReleaseCacheTTL is the duration for which the releases
+	// cached on the disk are used without asking github
+	DefaultReleaseCacheTTL = time.Hour
+
+	releaseCacheFile = "releases.json"
+)
+
+// releaseCache is the on disk representation of the fetched releases
+type releaseCache struct {
+	FetchedAt time.Time  `json:"fetched_at"`
+	Releases  []*Release `json:"releases"`
+}
+
+// readReleaseCache reads the releases cached in dir. A missing, unreadable
+// or corrupt cache file is treated as if there is no cache at all.
+func readReleaseCache(dir string) *releaseCache {
+	if dir == "" {
+		return nil
+	}
+
+	byt, err := ioutil.ReadFile(filepath.Join(dir, releaseCacheFile))
+	if err != nil {
+		return nil
+	}
+
+	var rc releaseCache
+	if err := json.Unmarshal(byt, &rc); err != nil || len(rc.Releases) == 0 {
+		return nil
+	}
+	return &rc
+}
+
+// writeReleaseCache overwrites the releases cached in dir. The file is
+// written to a temporary location first so that a reader never observes
+// a partially written cache.
+func writeReleaseCache(dir string, releases []*Release) error {
+	if dir == "" {
+		return nil
+	}
+
+	byt, err := json.Marshal(releaseCache{
+		FetchedAt: time.Now(),
+		Releases:  releases,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, releaseCacheFile+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(byt); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, releaseCacheFile))
+}
+
+// fresh reports whether the cache is younger than ttl
+func (c *releaseCache) fresh(ttl time.Duration) bool {
+	return c != nil && time.Since(c.FetchedAt) < ttl
+}
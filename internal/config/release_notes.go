@@ -0,0 +1,181 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultReleaseNotesLimit is the size in bytes past which release
+	// notes are truncated
+	DefaultReleaseNotesLimit = 16 << 10
+
+	// ReleaseNotesLimitEnv is the environment variable overriding
+	// DefaultReleaseNotesLimit
+	ReleaseNotesLimitEnv = "CILIUM_RELEASE_NOTES_LIMIT"
+
+	// truncatedSuffix marks the release notes which have been truncated
+	truncatedSuffix = "..."
+)
+
+// ReleaseNotesOptions controls how release notes are returned
+type ReleaseNotesOptions struct {
+	// MaxBytes is the size past which the notes are truncated. Zero means
+	// ReleaseNotesLimit and a negative value disables truncation.
+	MaxBytes int
+
+	// Plain strips the markdown formatting from the notes
+	Plain bool
+
+	// Summary puts the notes on a single line, implying Plain, which suits
+	// a short description next to each version
+	Summary bool
+}
+
+var (
+	markdownComment  = regexp.MustCompile(`(?s)<!--.*?-->`)
+	markdownImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	markdownHeading  = regexp.MustCompile(`(?m)^[ \t]*#{1,6}[ \t]+`)
+	markdownRule     = regexp.MustCompile(`(?m)^[ \t]*[-=*_]{3,}[ \t]*$`)
+	markdownBullet   = regexp.MustCompile(`(?m)^([ \t]*)[*+][ \t]+`)
+	markdownEmphasis = regexp.MustCompile("\\*\\*|__|~~|`")
+	blankLines       = regexp.MustCompile(`\n{3,}`)
+)
+
+// ReleaseNotesLimit returns the size in bytes past which release notes are
+// truncated, which is CILIUM_RELEASE_NOTES_LIMIT if set and
+// DefaultReleaseNotesLimit otherwise
+func ReleaseNotesLimit() int {
+	raw := os.Getenv(ReleaseNotesLimitEnv)
+	if raw == "" {
+		return DefaultReleaseNotesLimit
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 {
+		logWarn(ErrInvalidReleaseNotesLimit(raw))
+		return DefaultReleaseNotesLimit
+	}
+	return limit
+}
+
+// GetReleaseNotes returns the release notes of the given cilium version
+// using the default client
+func GetReleaseNotes(ctx context.Context, version string, opts ReleaseNotesOptions) (string, error) {
+	rc, err := releaseClient()
+	if err != nil {
+		return "", err
+	}
+	return rc.GetReleaseNotes(ctx, version, opts)
+}
+
+// GetReleaseNotes returns the release notes of the given cilium version,
+// for example v1.14.3. The notes of the releases already listed are reused,
+// and the release is fetched from github otherwise.
+func (rc *ReleaseClient) GetReleaseNotes(ctx context.Context, version string, opts ReleaseNotesOptions) (string, error) {
+	v, err := ParseVersion(version)
+	if err != nil {
+		return "", err
+	}
+	tag := canonicalVersion(v)
+
+	release := rc.fetchedRelease(tag)
+	if release == nil {
+		release, err = rc.GetReleaseByTag(ctx, tag)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	notes := release.Body
+	if opts.Plain || opts.Summary {
+		notes = stripMarkdown(notes)
+	}
+	if opts.Summary {
+		notes = strings.Join(strings.Fields(notes), " ")
+	}
+
+	limit := opts.MaxBytes
+	if limit == 0 {
+		limit = ReleaseNotesLimit()
+	}
+	return truncateNotes(notes, limit), nil
+}
+
+// fetchedRelease returns the release with the given tag among the pages
+// fetched so far and the disk cache, or nil if it has not been fetched.
+// Releases synthesized from tags carry no notes and are ignored.
+func (rc *ReleaseClient) fetchedRelease(tag string) *Release {
+	find := func(releases []*Release) *Release {
+		for _, release := range releases {
+			if release.TagName == tag && !release.FromTag {
+				return release
+			}
+		}
+		return nil
+	}
+
+	rc.mu.Lock()
+	for _, page := range rc.pages {
+		if release := find(page.releases); release != nil {
+			rc.mu.Unlock()
+			return release
+		}
+	}
+	rc.mu.Unlock()
+
+	if cache := readReleaseCache(rc.CacheDir); cache != nil {
+		return find(cache.Releases)
+	}
+	return nil
+}
+
+// stripMarkdown removes the markdown formatting commonly found in release
+// notes, keeping the text of links and the list structure
+func stripMarkdown(notes string) string {
+	notes = strings.ReplaceAll(notes, "\r\n", "\n")
+	notes = markdownComment.ReplaceAllString(notes, "")
+	notes = markdownImage.ReplaceAllString(notes, "$1")
+	notes = markdownLink.ReplaceAllString(notes, "$1")
+	notes = markdownRule.ReplaceAllString(notes, "")
+	notes = markdownHeading.ReplaceAllString(notes, "")
+	notes = markdownBullet.ReplaceAllString(notes, "$1- ")
+	notes = markdownEmphasis.ReplaceAllString(notes, "")
+	notes = blankLines.ReplaceAllString(notes, "\n\n")
+	return strings.TrimSpace(notes)
+}
+
+// truncateNotes cuts notes down to at most limit bytes, without splitting
+// a character, and marks them as truncated. A limit of zero or less keeps
+// the notes whole.
+func truncateNotes(notes string, limit int) string {
+	if limit <= 0 || len(notes) <= limit {
+		return notes
+	}
+	cut := limit - len(truncatedSuffix)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(notes[cut]) {
+		cut--
+	}
+	return strings.TrimRight(notes[:cut], " \t\n") + truncatedSuffix
+}
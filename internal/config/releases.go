@@ -15,42 +15,712 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
 
 	"github.com/layer5io/meshery-adapter-library/adapter"
-	"github.com/layer5io/meshkit/utils/walker"
+	"github.com/layer5io/meshkit/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// GithubTokenEnv is the environment variable from which the
+	// github token used for fetching releases is read
+	GithubTokenEnv = "GITHUB_TOKEN"
+
+	// GithubAPIURLEnv is the environment variable which overrides the base
+	// url of the github API used for fetching releases, for example
+	// https://github.example.com/api/v3 for a GitHub Enterprise instance
+	GithubAPIURLEnv = "CILIUM_GITHUB_API_URL"
+
+	// GithubRepoEnv is the environment variable which overrides the
+	// repository, in the owner/repo form, from which releases are fetched
+	GithubRepoEnv = "CILIUM_GITHUB_REPO"
+
+	// DefaultGithubAPIURL is the default base url of the github API
+	DefaultGithubAPIURL = "https://api.github.com"
+
+	defaultOwner = "cilium"
+	defaultRepo  = "cilium"
+
+	// github does not serve more than 100 releases per page
+	maxPerPage      = 100
+	defaultMaxPages = 5
+
+	defaultMaxAttempts = 3
+	defaultBaseDelay   = 500 * time.Millisecond
+
+	// DefaultMaxResponseSize is the default cap on the size of the
+	// responses read from the github API
+	DefaultMaxResponseSize int64 = 4 << 20
+
+	// DefaultReleaseTimeout bounds every request made by the default
+	// ReleaseClient so that a hung connection cannot block the adapter
+	DefaultReleaseTimeout = 30 * time.Second
 )
 
 // Release is used to save the release informations
 type Release struct {
-	ID      int             `json:"id,omitempty"`
-	TagName string          `json:"tag_name,omitempty"`
-	Name    adapter.Version `json:"name,omitempty"`
-	Draft   bool            `json:"draft,omitempty"`
-	Assets  []*Asset        `json:"assets,omitempty"`
+	ID         int             `json:"id,omitempty"`
+	TagName    string          `json:"tag_name,omitempty"`
+	Name       adapter.Version `json:"name,omitempty"`
+	Draft      bool            `json:"draft,omitempty"`
+	Prerelease bool            `json:"prerelease,omitempty"`
+	Assets     []*Asset        `json:"assets,omitempty"`
+
+	// Body holds the release notes, in markdown
+	Body string `json:"body,omitempty"`
+
+	// FromTag is set on the releases synthesized from git tags, which have
+	// neither assets nor draft and prerelease metadata
+	FromTag bool `json:"from_tag,omitempty"`
 }
 
 // Asset describes the github release asset object
 type Asset struct {
-	Name        string `json:"name,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	// State is the upload state reported by the REST API, empty for the
+	// assets listed through the GraphQL API which does not report it
 	State       string `json:"state,omitempty"`
 	DownloadURL string `json:"browser_download_url,omitempty"`
 }
 
-func appendThreadSafe(arr *[]string, s string, m *sync.RWMutex) {
-	m.Lock()
-	defer m.Unlock()
-	*arr = append((*arr), s)
+// ReleaseClient fetches the cilium releases from the github API
+type ReleaseClient struct {
+	// BaseURL is the base url of the github API, without a trailing slash
+	BaseURL string
+
+	// Owner and Repo identify the repository whose releases are fetched
+	Owner string
+	Repo  string
+
+	// Token is attached as the Authorization header to every request
+	// if it is not empty. Authenticated requests are subject to a much
+	// higher rate limit than the anonymous ones.
+	Token string
+
+	// MaxPages caps the number of pages walked while looking
+	// for releases
+	MaxPages int
+
+	// HTTPClient is used for making the requests. Callers can replace it,
+	// or its Transport, to route the requests through a custom proxy or
+	// to change the Timeout.
+	HTTPClient *http.Client
+
+	// DisableGraphQL keeps fetching the releases through the REST API
+	// when a Token is set. The GraphQL API, which needs a token, is used
+	// otherwise since it only returns the fields of Release and Asset.
+	DisableGraphQL bool
+
+	// MaxResponseSize is the largest response body, in bytes, which is
+	// read from github. DefaultMaxResponseSize is used if it is not set.
+	MaxResponseSize int64
+
+	// MaxAttempts is the number of times a request is tried before
+	// giving up on transient failures
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry, it doubles
+	// with every subsequent retry
+	BaseDelay time.Duration
+
+	// CacheDir is the directory in which the fetched releases are
+	// persisted. The persisted releases are used when they are younger
+	// than CacheTTL or when github cannot be reached. Caching on the
+	// disk is disabled if it is empty.
+	CacheDir string
+
+	// CacheTTL is the duration for which the persisted releases are
+	// used without asking github
+	CacheTTL time.Duration
+
+	// pages caches the release pages along with their ETags, keyed by
+	// the page url, so that unchanged pages are not downloaded again
+	pages map[string]*releasePage
+	mu    sync.Mutex
+
+	// group deduplicates the concurrent fetches of the same releases
+	group singleflight.Group
+
+	// rateLimitedUntil is when the github rate limit hit last resets
+	rateLimitedUntil time.Time
+}
+
+// releasePage is a page of releases as returned by github
+type releasePage struct {
+	etag     string
+	releases []*Release
+	next     string
 }
 
-// GetFileNames takes the url of a github repo and the path to a directory. Then returns all the filenames from that directory
-func GetFileNames(owner string, repo string, path string) ([]string, error) {
-	g := walker.NewGit()
-	var fs []string
-	var m sync.RWMutex
-	err := g.Owner(owner).Repo(repo).Branch("master").Root(path).RegisterFileInterceptor(func(f walker.File) error {
-		appendThreadSafe(&fs, f.Name, &m)
+// defaultReleaseClient is shared by the package level helpers so that
+// its ETag cache is reused across calls
+var defaultReleaseClient, errDefaultReleaseClient = NewReleaseClient()
+
+// NewReleaseClient returns a ReleaseClient for the cilium/cilium repository
+// on github.com. The token, the API url and the repository can be overridden
+// with the GITHUB_TOKEN, CILIUM_GITHUB_API_URL and CILIUM_GITHUB_REPO
+// environment variables respectively. Requests go through the proxy set in
+// the environment and additionally trust the CA bundle at CILIUM_CA_BUNDLE.
+// An error is returned if the overrides are invalid, along with a client
+// which uses the defaults.
+func NewReleaseClient() (*ReleaseClient, error) {
+	rc := newReleaseClient(DefaultGithubAPIURL, defaultOwner, defaultRepo)
+
+	client, err := newDefaultHTTPClient()
+	if err != nil {
+		return rc, err
+	}
+	rc.HTTPClient = client
+
+	if apiURL := os.Getenv(GithubAPIURLEnv); apiURL != "" {
+		if err := rc.SetBaseURL(apiURL); err != nil {
+			return rc, err
+		}
+	}
+
+	if repo := os.Getenv(GithubRepoEnv); repo != "" {
+		parts := strings.Split(strings.Trim(repo, "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return rc, ErrInvalidGithubURL(fmt.Errorf("%s must be of the form owner/repo, got %q", GithubRepoEnv, repo))
+		}
+		rc.Owner, rc.Repo = parts[0], parts[1]
+		rc.CacheDir = releaseCacheDir(rc.BaseURL, rc.Owner, rc.Repo)
+	}
+
+	return rc, nil
+}
+
+func newReleaseClient(baseURL, owner, repo string) *ReleaseClient {
+	return &ReleaseClient{
+		BaseURL:  baseURL,
+		Owner:    owner,
+		Repo:     repo,
+		Token:    os.Getenv(GithubTokenEnv),
+		MaxPages: defaultMaxPages,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+			Timeout:   DefaultReleaseTimeout,
+		},
+		MaxResponseSize: DefaultMaxResponseSize,
+		MaxAttempts:     defaultMaxAttempts,
+		BaseDelay:       defaultBaseDelay,
+		CacheDir:        releaseCacheDir(baseURL, owner, repo),
+		CacheTTL:        DefaultReleaseCacheTTL,
+	}
+}
+
+// SetBaseURL validates the base url of the github API and sets it on the
+// client. A trailing slash is dropped. The releases are then persisted in
+// the cache directory of the new host, unless caching on the disk is
+// disabled.
+func (rc *ReleaseClient) SetBaseURL(baseURL string) error {
+	normalized, err := normalizeBaseURL(baseURL)
+	if err != nil {
+		return err
+	}
+	rc.BaseURL = normalized
+	if rc.CacheDir != "" {
+		rc.CacheDir = releaseCacheDir(rc.BaseURL, rc.Owner, rc.Repo)
+	}
+	return nil
+}
+
+// releaseCacheDir is the directory in which the releases of owner/repo
+// fetched from the github API at baseURL are persisted, so that the
+// clients of other hosts or repositories never read each other's releases
+func releaseCacheDir(baseURL, owner, repo string) string {
+	host := baseURL
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return filepath.Join(configRootPath, "releases", strings.ReplaceAll(host, ":", "_"), owner, repo)
+}
+
+// normalizeBaseURL verifies that baseURL is an absolute http(s) url and
+// strips its trailing slashes
+func normalizeBaseURL(baseURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(baseURL))
+	if err != nil {
+		return "", ErrInvalidGithubURL(err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", ErrInvalidGithubURL(fmt.Errorf("%q is not an absolute http(s) url", baseURL))
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", ErrInvalidGithubURL(fmt.Errorf("%q must not have a query or a fragment", baseURL))
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// releaseClient returns the client used by the package level helpers
+func releaseClient() (*ReleaseClient, error) {
+	if errDefaultReleaseClient != nil {
+		return nil, errDefaultReleaseClient
+	}
+	return defaultReleaseClient, nil
+}
+
+// ReleaseLister lists releases, it is implemented by ReleaseClient and lets
+// the version discovery work on releases coming from elsewhere than github
+type ReleaseLister interface {
+	// ListReleases returns the releases latest first, perPage at a time,
+	// until done reports that enough releases were collected
+	ListReleases(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error)
+}
+
+var _ ReleaseLister = (*ReleaseClient)(nil)
+
+// defaultReleaseLister returns the client used by the package level helpers
+// as a ReleaseLister
+func defaultReleaseLister() (ReleaseLister, error) {
+	return releaseClient()
+}
+
+// GetLatestReleases fetches the latest releases from the cilium repository
+// using the default ReleaseClient
+func GetLatestReleases(ctx context.Context, releases uint) ([]*Release, error) {
+	rc, err := releaseClient()
+	if err != nil {
+		return nil, err
+	}
+	return rc.GetLatestReleases(ctx, releases)
+}
+
+// GetLatestReleases fetches the latest releases from the cilium repository
+//
+// Concurrent calls asking for the same number of releases share a single
+// fetch, and so the context of the call which started it.
+func (rc *ReleaseClient) GetLatestReleases(ctx context.Context, releases uint) ([]*Release, error) {
+	shared, err, _ := rc.group.Do(fmt.Sprintf("latest/%d", releases), func() (interface{}, error) {
+		releaseList, err := rc.ListReleases(ctx, releases, func(rels []*Release) bool {
+			return uint(len(rels)) >= releases
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if uint(len(releaseList)) > releases {
+			releaseList = releaseList[:releases]
+		}
+		return releaseList, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyReleases(shared.([]*Release)), nil
+}
+
+// copyReleases deep copies the releases so that callers sharing a fetch
+// cannot see each other's modifications
+func copyReleases(releases []*Release) []*Release {
+	copied := make([]*Release, 0, len(releases))
+	for _, release := range releases {
+		r := *release
+		r.Assets = make([]*Asset, 0, len(release.Assets))
+		for _, asset := range release.Assets {
+			a := *asset
+			r.Assets = append(r.Assets, &a)
+		}
+		copied = append(copied, &r)
+	}
+	return copied
+}
+
+// GetReleaseByTag returns the release with the given tag using the
+// default client
+func GetReleaseByTag(ctx context.Context, tag string) (*Release, error) {
+	rc, err := releaseClient()
+	if err != nil {
+		return nil, err
+	}
+	return rc.GetReleaseByTag(ctx, tag)
+}
+
+// GetReleaseByTag returns the release with the given tag, for example
+// v1.11.0. An error satisfying IsReleaseNotFound is returned if github
+// has no such release.
+func (rc *ReleaseClient) GetReleaseByTag(ctx context.Context, tag string) (*Release, error) {
+	if tag == "" || strings.ContainsAny(tag, "/?#%") || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return nil, ErrInvalidReleaseTag(tag)
+	}
+
+	resp, err := rc.get(ctx, fmt.Sprintf("%s/tags/%s", rc.releasesURL(), url.PathEscape(tag)), "")
+	if err != nil {
+		if e, ok := errors.Is(err); ok && e.Code == ErrGithubNotFoundCode {
+			return nil, ErrReleaseNotFound(tag)
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var release Release
+	if err := rc.decode(resp.Body, &release); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// ListReleases walks the release pages, perPage releases at a time, until
+// either done reports that enough releases were collected, github runs out
+// of releases or MaxPages pages have been fetched.
+//
+// The releases persisted in CacheDir are returned instead if they are still
+// fresh and satisfy done, or if github cannot be reached.
+func (rc *ReleaseClient) ListReleases(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error) {
+	releaseList, _, err := rc.listReleasesFrom(ctx, perPage, done, false)
+	return releaseList, err
+}
+
+// RefreshReleases is ListReleases bypassing both the releases persisted in
+// CacheDir and the ETags of the previously fetched pages. The persisted
+// releases are still returned if github cannot be reached.
+func (rc *ReleaseClient) RefreshReleases(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error) {
+	releaseList, _, err := rc.listReleasesFrom(ctx, perPage, done, true)
+	return releaseList, err
+}
+
+// listReleasesFrom is ListReleases, or RefreshReleases if refresh is set,
+// reporting where the releases came from
+func (rc *ReleaseClient) listReleasesFrom(ctx context.Context, perPage uint, done func([]*Release) bool, refresh bool) ([]*Release, VersionSource, error) {
+	cache := readReleaseCache(rc.CacheDir)
+	if !refresh && cache.fresh(rc.CacheTTL) && (done == nil || done(cache.Releases)) {
+		return cache.Releases, SourceCache, nil
+	}
+
+	releaseList, err := rc.listReleases(ctx, perPage, done, refresh)
+	if err != nil {
+		if cache != nil && !IsReleaseFetchCanceled(err) {
+			return cache.Releases, SourceCache, nil
+		}
+		return nil, "", err
+	}
+
+	// Failing to persist the releases only costs a request to github
+	// next time, hence the error is ignored
+	_ = writeReleaseCache(rc.CacheDir, releaseList)
+
+	return releaseList, SourceLive, nil
+}
+
+// releasesURL is the url of the releases of the repository
+func (rc *ReleaseClient) releasesURL() string {
+	return fmt.Sprintf("%s/repos/%s/%s/releases", rc.BaseURL, rc.Owner, rc.Repo)
+}
+
+func (rc *ReleaseClient) listReleases(ctx context.Context, perPage uint, done func([]*Release) bool, refresh bool) ([]*Release, error) {
+	if rc.useGraphQL() {
+		return rc.listReleasesGraphQL(ctx, perPage, done)
+	}
+
+	maxPages := rc.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	if perPage == 0 || perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	var releaseList []*Release
+	pageURL := fmt.Sprintf("%s?per_page=%d", rc.releasesURL(), perPage)
+	for page := 0; page < maxPages && pageURL != ""; page++ {
+		rels, next, err := rc.getReleasePage(ctx, pageURL, refresh)
+		if err != nil {
+			return nil, err
+		}
+
+		releaseList = append(releaseList, rels...)
+		if done != nil && done(releaseList) {
+			break
+		}
+		pageURL = next
+	}
+
+	return releaseList, nil
+}
+
+// getReleasePage fetches a single page of releases and returns it along
+// with the url of the next page, which is empty on the last page.
+//
+// If the page was fetched before, the request is made conditional on its
+// ETag and the cached releases are returned when github reports that the
+// page has not been modified.
+func (rc *ReleaseClient) getReleasePage(ctx context.Context, pageURL string, refresh bool) ([]*Release, string, error) {
+	cached := rc.cachedPage(pageURL)
+	etag := ""
+	if cached != nil && !refresh {
+		etag = cached.etag
+	}
+
+	resp, err := rc.get(ctx, pageURL, etag)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return cached.releases, cached.next, nil
+	}
+
+	var releaseList []*Release
+	if err := rc.decode(resp.Body, &releaseList); err != nil {
+		return nil, "", err
+	}
+
+	next := nextPageURL(resp.Header.Get("Link"))
+	if newEtag := resp.Header.Get("ETag"); newEtag != "" {
+		rc.cachePage(pageURL, &releasePage{
+			etag:     newEtag,
+			releases: releaseList,
+			next:     next,
+		})
+	}
+
+	return releaseList, next, nil
+}
+
+func (rc *ReleaseClient) cachedPage(pageURL string) *releasePage {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.pages[pageURL]
+}
+
+func (rc *ReleaseClient) cachePage(pageURL string, page *releasePage) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.pages == nil {
+		rc.pages = make(map[string]*releasePage)
+	}
+	rc.pages[pageURL] = page
+}
+
+// get performs a GET request against the github API and returns the response
+// if github answered with 200, or with 304 when an etag was passed. Network
+// errors, 429 and 5xx responses are retried with an exponential backoff, at
+// most MaxAttempts times.
+func (rc *ReleaseClient) get(ctx context.Context, url, etag string) (*http.Response, error) {
+	return rc.do(ctx, http.MethodGet, url, nil, etag)
+}
+
+// do is get for any method, sending body if it is not nil
+func (rc *ReleaseClient) do(ctx context.Context, method, url string, body []byte, etag string) (*http.Response, error) {
+	maxAttempts := rc.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+
+	var (
+		lastErr    error
+		lastStatus int
+	)
+	// Requests made before the rate limit resets would only be rejected
+	if reset := rc.RateLimitReset(); time.Now().Before(reset) {
+		return nil, ErrRateLimited(reset)
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := rc.backoff(ctx, attempt-1); err != nil {
+				return nil, ErrReleaseFetchCanceled(err)
+			}
+		}
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+		if err != nil {
+			return nil, ErrGetLatestReleases(err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		if rc.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+rc.Token)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		resp, err := rc.httpClient().Do(req)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ErrReleaseFetchCanceled(ctxErr)
+			}
+			lastErr = err
+			continue
+		}
+
+		lastStatus = resp.StatusCode
+		switch {
+		case resp.StatusCode == http.StatusOK,
+			resp.StatusCode == http.StatusNotModified && etag != "":
+			return resp, nil
+		case resp.StatusCode == http.StatusUnauthorized && rc.Token != "":
+			_ = resp.Body.Close()
+			return nil, ErrInvalidGithubToken(fmt.Errorf("github responded with status code: %d", resp.StatusCode))
+		case resp.StatusCode == http.StatusNotFound:
+			_ = resp.Body.Close()
+			return nil, ErrGithubNotFound(url)
+		case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+			reset, limited := rateLimitReset(resp.Header, time.Now())
+			_ = resp.Body.Close()
+			if limited {
+				rc.setRateLimitReset(reset)
+				return nil, ErrRateLimited(reset)
+			}
+			if resp.StatusCode == http.StatusForbidden {
+				return nil, ErrGetLatestReleases(fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+			}
+			lastErr = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		case resp.StatusCode >= http.StatusInternalServerError:
+			_ = resp.Body.Close()
+			lastErr = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		default:
+			_ = resp.Body.Close()
+			return nil, ErrGetLatestReleases(fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+		}
+	}
+
+	if maxAttempts == 1 {
+		return nil, ErrGetLatestReleases(lastErr)
+	}
+	return nil, ErrReleaseFetchRetriesExhausted(maxAttempts, lastStatus, lastErr)
+}
+
+// RateLimitReset returns when the github rate limit resets if it was hit,
+// and the zero time otherwise
+func (rc *ReleaseClient) RateLimitReset() time.Time {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if time.Now().After(rc.rateLimitedUntil) {
+		return time.Time{}
+	}
+	return rc.rateLimitedUntil
+}
+
+func (rc *ReleaseClient) setRateLimitReset(reset time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rateLimitedUntil = reset
+}
+
+// RateLimitReset returns when the github rate limit of the default client
+// resets if it was hit, and the zero time otherwise
+func RateLimitReset() time.Time {
+	rc, err := releaseClient()
+	if err != nil {
+		return time.Time{}
+	}
+	return rc.RateLimitReset()
+}
+
+// rateLimitReset reports whether the response headers denote a rate limited
+// response and when the limit resets. Both the primary rate limit, with no
+// X-RateLimit-Remaining left, and the secondary one, with a Retry-After, are
+// recognized.
+func rateLimitReset(header http.Header, now time.Time) (time.Time, bool) {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return at, true
+		}
+	}
+
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		reset := now.Add(time.Minute)
+		if epoch, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			reset = time.Unix(epoch, 0)
+		}
+		return reset, true
+	}
+	return time.Time{}, false
+}
+
+// backoff sleeps for BaseDelay * 2^(retry-1) with a random jitter of up to
+// the same amount, returning early if ctx is done
+func (rc *ReleaseClient) backoff(ctx context.Context, retry int) error {
+	base := rc.BaseDelay
+	if base <= 0 {
+		base = defaultBaseDelay
+	}
+	delay := base << (retry - 1)
+	// #nosec G404 jitter does not need a cryptographically secure source
+	delay += time.Duration(rand.Int63n(int64(delay)))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
 		return nil
-	}).Walk()
-	return fs, err
+	}
+}
+
+// decode decodes the JSON body into v, failing with ErrResponseTooLarge
+// instead of reading more than MaxResponseSize bytes
+func (rc *ReleaseClient) decode(body io.Reader, v interface{}) error {
+	limit := rc.MaxResponseSize
+	if limit <= 0 {
+		limit = DefaultMaxResponseSize
+	}
+
+	// One byte past the limit is allowed through to tell a body of exactly
+	// limit bytes apart from a larger one
+	lr := &io.LimitedReader{R: body, N: limit + 1}
+	err := json.NewDecoder(lr).Decode(v)
+	if lr.N <= 0 {
+		return ErrResponseTooLarge(limit)
+	}
+	if err != nil {
+		return ErrGetLatestReleases(err)
+	}
+	return nil
+}
+
+func (rc *ReleaseClient) httpClient() *http.Client {
+	if rc.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return rc.HTTPClient
+}
+
+// nextPageURL extracts the url with rel="next" from a github Link header
+func nextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		segments := strings.Split(part, ";")
+		if len(segments) < 2 {
+			continue
+		}
+		for _, param := range segments[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(segments[0]), "<>")
+			}
+		}
+	}
+	return ""
 }
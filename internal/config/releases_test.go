@@ -0,0 +1,668 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/layer5io/meshkit/errors"
+)
+
+// newTestClient returns a ReleaseClient of the cilium/cilium repository
+// served by srv, without token, disk cache nor backoff delay
+func newTestClient(t *testing.T, srv *httptest.Server) *ReleaseClient {
+	t.Helper()
+	rc := newReleaseClient(DefaultGithubAPIURL, defaultOwner, defaultRepo)
+	if err := rc.SetBaseURL(srv.URL + "/"); err != nil {
+		t.Fatalf("SetBaseURL(%q): %v", srv.URL, err)
+	}
+	rc.Token = ""
+	rc.CacheDir = ""
+	rc.HTTPClient = srv.Client()
+	rc.BaseDelay = 1
+	return rc
+}
+
+// errorCode returns the meshkit code of err, empty if it has none
+func errorCode(err error) string {
+	if e, ok := errors.Is(err); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// releasesJSON returns a page of releases with the given tags
+func releasesJSON(tags ...string) string {
+	page := "["
+	for i, tag := range tags {
+		if i > 0 {
+			page += ","
+		}
+		page += fmt.Sprintf(`{"tag_name":%q}`, tag)
+	}
+	return page + "]"
+}
+
+func TestReleaseClientToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		wantAuth string
+		status   int
+		wantCode string
+	}{
+		{name: "anonymous", status: http.StatusOK},
+		{name: "token", token: "secret", wantAuth: "Bearer secret", status: http.StatusOK},
+		{name: "invalid token", token: "stale", wantAuth: "Bearer stale", status: http.StatusUnauthorized, wantCode: ErrInvalidGithubTokenCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAuth string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAuth = r.Header.Get("Authorization")
+				w.WriteHeader(tt.status)
+				_, _ = fmt.Fprint(w, releasesJSON("v1.14.3"))
+			}))
+			defer srv.Close()
+			rc := newTestClient(t, srv)
+			rc.Token = tt.token
+			rc.DisableGraphQL = true
+
+			releases, err := rc.GetLatestReleases(context.Background(), 1)
+			if gotAuth != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", gotAuth, tt.wantAuth)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(err); code != tt.wantCode {
+					t.Fatalf("error code = %q (%v), want %q", code, err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetLatestReleases: %v", err)
+			}
+			if len(releases) != 1 || releases[0].TagName != "v1.14.3" {
+				t.Errorf("releases = %v, want v1.14.3", releases)
+			}
+		})
+	}
+}
+
+func TestReleaseClientNotModified(t *testing.T) {
+	var hits, conditional int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = fmt.Fprint(w, releasesJSON("v1.14.3", "v1.14.2"))
+	}))
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	first, err := rc.ListReleases(context.Background(), 2, nil)
+	if err != nil {
+		t.Fatalf("first ListReleases: %v", err)
+	}
+	second, err := rc.ListReleases(context.Background(), 2, nil)
+	if err != nil {
+		t.Fatalf("second ListReleases: %v", err)
+	}
+	if hits != 2 || conditional != 1 {
+		t.Fatalf("hits = %d, conditional = %d, want 2 and 1", hits, conditional)
+	}
+	if len(second) != len(first) || second[0] != first[0] {
+		t.Errorf("the 304 did not reuse the cached page: %v, want %v", second, first)
+	}
+
+	// A refresh asks for the page unconditionally
+	if _, err := rc.RefreshReleases(context.Background(), 2, nil); err != nil {
+		t.Fatalf("RefreshReleases: %v", err)
+	}
+	if conditional != 1 {
+		t.Errorf("RefreshReleases sent If-None-Match")
+	}
+
+	// The pages are cached by url, another page size is another page
+	if _, err := rc.ListReleases(context.Background(), 1, nil); err != nil {
+		t.Fatalf("ListReleases: %v", err)
+	}
+	if conditional != 1 {
+		t.Errorf("a page of another size was requested with the ETag of the cached one")
+	}
+}
+
+func TestSetBaseURL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "https://github.example.com/api/v3/", want: "https://github.example.com/api/v3"},
+		{in: "http://localhost:8080", want: "http://localhost:8080"},
+		{in: "github.example.com", wantErr: true},
+		{in: "ftp://github.example.com", wantErr: true},
+		{in: "https://github.example.com/api?x=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		rc := &ReleaseClient{}
+		err := rc.SetBaseURL(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetBaseURL(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && rc.BaseURL != tt.want {
+			t.Errorf("SetBaseURL(%q) = %q, want %q", tt.in, rc.BaseURL, tt.want)
+		}
+	}
+}
+
+func TestReleaseCacheDir(t *testing.T) {
+	rc := newReleaseClient(DefaultGithubAPIURL, defaultOwner, defaultRepo)
+	if want := filepath.Join(configRootPath, "releases", "api.github.com", "cilium", "cilium"); rc.CacheDir != want {
+		t.Errorf("CacheDir = %q, want %q", rc.CacheDir, want)
+	}
+	if err := rc.SetBaseURL("https://github.example.com:8443/api/v3"); err != nil {
+		t.Fatalf("SetBaseURL: %v", err)
+	}
+	if want := filepath.Join(configRootPath, "releases", "github.example.com_8443", "cilium", "cilium"); rc.CacheDir != want {
+		t.Errorf("CacheDir after SetBaseURL = %q, want %q", rc.CacheDir, want)
+	}
+
+	// A fork of another owner does not share the releases of cilium
+	t.Setenv(GithubAPIURLEnv, "")
+	t.Setenv(GithubRepoEnv, "example/cilium")
+	fork, err := NewReleaseClient()
+	if err != nil {
+		t.Fatalf("NewReleaseClient: %v", err)
+	}
+	if want := filepath.Join(configRootPath, "releases", "api.github.com", "example", "cilium"); fork.CacheDir != want {
+		t.Errorf("CacheDir of the fork = %q, want %q", fork.CacheDir, want)
+	}
+
+	// SetBaseURL keeps the disk cache disabled
+	rc.CacheDir = ""
+	if err := rc.SetBaseURL(DefaultGithubAPIURL); err != nil {
+		t.Fatalf("SetBaseURL: %v", err)
+	}
+	if rc.CacheDir != "" {
+		t.Errorf("CacheDir = %q, want the disk cache to stay disabled", rc.CacheDir)
+	}
+}
+
+// pagedServer serves pages of one release each, v1.<page>.0, linking
+// every page to the next one
+func pagedServer(t *testing.T, pages int, hits *int) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		if r.URL.Path != "/repos/cilium/cilium/releases" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < pages {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=1&page=%d>; rel="next", <%s%s?page=%d>; rel="last"`, srv.URL, r.URL.Path, page+1, srv.URL, r.URL.Path, pages))
+		}
+		_, _ = fmt.Fprint(w, releasesJSON(fmt.Sprintf("v1.%d.0", page)))
+	}))
+	return srv
+}
+
+func TestReleaseClientPagination(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    int
+		maxPages int
+		want     int
+	}{
+		{name: "every page", pages: 3, maxPages: 5, want: 3},
+		{name: "capped", pages: 10, maxPages: 4, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			srv := pagedServer(t, tt.pages, &hits)
+			defer srv.Close()
+			rc := newTestClient(t, srv)
+			rc.MaxPages = tt.maxPages
+
+			releases, err := rc.ListReleases(context.Background(), 1, nil)
+			if err != nil {
+				t.Fatalf("ListReleases: %v", err)
+			}
+			if len(releases) != tt.want || hits != tt.want {
+				t.Fatalf("got %d releases in %d requests, want %d", len(releases), hits, tt.want)
+			}
+			for i, release := range releases {
+				if want := fmt.Sprintf("v1.%d.0", i+1); release.TagName != want {
+					t.Errorf("release %d = %s, want %s", i, release.TagName, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseClientStopsWhenDone(t *testing.T) {
+	hits := 0
+	srv := pagedServer(t, 10, &hits)
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	releases, err := rc.ListReleases(context.Background(), 1, func(rels []*Release) bool { return len(rels) >= 2 })
+	if err != nil {
+		t.Fatalf("ListReleases: %v", err)
+	}
+	if len(releases) != 2 || hits != 2 {
+		t.Errorf("got %d releases in %d requests, want 2", len(releases), hits)
+	}
+}
+
+func TestReleaseClientRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int
+		wantHits    int
+		wantCode    string
+	}{
+		{name: "recovers from 5xx", statuses: []int{500, 502, 200}, maxAttempts: 3, wantHits: 3},
+		{name: "recovers from 429", statuses: []int{429, 200}, maxAttempts: 3, wantHits: 2},
+		{name: "gives up", statuses: []int{503, 503, 503, 200}, maxAttempts: 3, wantHits: 3, wantCode: ErrReleaseFetchRetriesExhaustedCode},
+		{name: "single attempt", statuses: []int{500, 200}, maxAttempts: 1, wantHits: 1, wantCode: ErrGetLatestReleasesCode},
+		{name: "no retry on 4xx", statuses: []int{400, 200}, maxAttempts: 3, wantHits: 1, wantCode: ErrGetLatestReleasesCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[hits]
+				hits++
+				w.WriteHeader(status)
+				_, _ = fmt.Fprint(w, releasesJSON("v1.14.3"))
+			}))
+			defer srv.Close()
+			rc := newTestClient(t, srv)
+			rc.MaxAttempts = tt.maxAttempts
+
+			_, err := rc.ListReleases(context.Background(), 1, nil)
+			if hits != tt.wantHits {
+				t.Errorf("%d requests, want %d", hits, tt.wantHits)
+			}
+			if code := errorCode(err); code != tt.wantCode {
+				t.Errorf("error code = %q (%v), want %q", code, err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestGetReleaseByTag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/cilium/cilium/releases/tags/v1.14.3" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"tag_name":"v1.14.3","assets":[{"name":"cilium-linux-amd64.tar.gz"}]}`)
+	}))
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	release, err := rc.GetReleaseByTag(context.Background(), "v1.14.3")
+	if err != nil {
+		t.Fatalf("GetReleaseByTag: %v", err)
+	}
+	if release.TagName != "v1.14.3" || len(release.Assets) != 1 {
+		t.Errorf("release = %+v, want v1.14.3 with one asset", release)
+	}
+
+	tests := []struct {
+		tag      string
+		wantCode string
+	}{
+		{tag: "v1.99.0", wantCode: ErrReleaseNotFoundCode},
+		{tag: "", wantCode: ErrInvalidReleaseTagCode},
+		{tag: "v1.14.3/assets", wantCode: ErrInvalidReleaseTagCode},
+		{tag: "v1.14 .3", wantCode: ErrInvalidReleaseTagCode},
+	}
+	for _, tt := range tests {
+		_, err := rc.GetReleaseByTag(context.Background(), tt.tag)
+		if code := errorCode(err); code != tt.wantCode {
+			t.Errorf("GetReleaseByTag(%q) error code = %q (%v), want %q", tt.tag, code, err, tt.wantCode)
+		}
+	}
+}
+
+func TestReleaseClientNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	_, err := rc.ListReleases(context.Background(), 1, nil)
+	if code := errorCode(err); code != ErrGithubNotFoundCode {
+		t.Errorf("error code = %q (%v), want %q", code, err, ErrGithubNotFoundCode)
+	}
+}
+
+func TestReleaseClientResponseTooLarge(t *testing.T) {
+	body := releasesJSON("v1.14.3", "v1.14.2", "v1.14.1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		limit    int64
+		wantCode string
+	}{
+		{name: "oversized", limit: int64(len(body)) - 10, wantCode: ErrResponseTooLargeCode},
+		{name: "exactly the limit", limit: int64(len(body))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newTestClient(t, srv)
+			rc.MaxResponseSize = tt.limit
+
+			releases, err := rc.ListReleases(context.Background(), 3, nil)
+			if code := errorCode(err); code != tt.wantCode {
+				t.Fatalf("error code = %q (%v), want %q", code, err, tt.wantCode)
+			}
+			if tt.wantCode == "" && len(releases) != 3 {
+				t.Errorf("got %d releases, want 3", len(releases))
+			}
+		})
+	}
+}
+
+func TestReleaseClientRateLimited(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name      string
+		status    int
+		header    map[string]string
+		wantReset time.Time
+	}{
+		{
+			name:      "primary",
+			status:    http.StatusForbidden,
+			header:    map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": strconv.FormatInt(reset.Unix(), 10)},
+			wantReset: reset,
+		},
+		{
+			name:      "secondary",
+			status:    http.StatusForbidden,
+			header:    map[string]string{"Retry-After": "3600"},
+			wantReset: reset,
+		},
+		{
+			name:      "too many requests",
+			status:    http.StatusTooManyRequests,
+			header:    map[string]string{"Retry-After": reset.UTC().Format(http.TimeFormat)},
+			wantReset: reset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			rc := newTestClient(t, srv)
+
+			_, err := rc.ListReleases(context.Background(), 1, nil)
+			if code := errorCode(err); code != ErrRateLimitedCode {
+				t.Fatalf("error code = %q (%v), want %q", code, err, ErrRateLimitedCode)
+			}
+			if got := rc.RateLimitReset(); got.Before(tt.wantReset.Add(-2*time.Second)) || got.After(tt.wantReset.Add(2*time.Second)) {
+				t.Errorf("RateLimitReset() = %v, want %v", got, tt.wantReset)
+			}
+
+			// No request is made until the limit resets
+			if _, err := rc.ListReleases(context.Background(), 1, nil); errorCode(err) != ErrRateLimitedCode || hits != 1 {
+				t.Errorf("second ListReleases made %d requests (%v), want the rate limit error without request", hits, err)
+			}
+		})
+	}
+}
+
+func TestReleaseClientForbidden(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "42")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	_, err := rc.ListReleases(context.Background(), 1, nil)
+	if code := errorCode(err); code != ErrGetLatestReleasesCode {
+		t.Errorf("error code = %q (%v), want %q", code, err, ErrGetLatestReleasesCode)
+	}
+	if !rc.RateLimitReset().IsZero() {
+		t.Errorf("a 403 with requests left was taken for a rate limit")
+	}
+}
+
+func TestGetLatestReleasesSharesFetch(t *testing.T) {
+	const callers = 10
+	var hits int32
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-unblock
+		_, _ = fmt.Fprint(w, releasesJSON("v1.14.3", "v1.14.2"))
+	}))
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+
+	var started, finished sync.WaitGroup
+	results := make([][]*Release, callers)
+	errs := make([]error, callers)
+	started.Add(callers)
+	finished.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer finished.Done()
+			started.Done()
+			results[i], errs[i] = rc.GetLatestReleases(context.Background(), 2)
+		}(i)
+	}
+	started.Wait()
+	// Leave the callers the time to join the fetch in flight
+	time.Sleep(100 * time.Millisecond)
+	close(unblock)
+	finished.Wait()
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("%d requests made by %d concurrent callers, want 1", n, callers)
+	}
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: %v", i, errs[i])
+		}
+		if len(results[i]) != 2 {
+			t.Fatalf("caller %d got %d releases, want 2", i, len(results[i]))
+		}
+	}
+
+	// Every caller owns its releases
+	results[0][0].TagName = "mutated"
+	results[0] = append(results[0][:1], &Release{TagName: "appended"})
+	for i := 1; i < callers; i++ {
+		if results[i][0] == results[0][0] || results[i][0].TagName != "v1.14.3" || results[i][1].TagName != "v1.14.2" {
+			t.Errorf("caller %d sees the changes of caller 0: %v", i, results[i])
+		}
+	}
+}
+
+// fixtureReleases are served by fixtureServer through both APIs. The
+// GraphQL API reports no state for the assets, hence they have none.
+var fixtureReleases = []*Release{
+	{ID: 3, TagName: "v1.15.0-rc.1", Name: "1.15.0-rc.1", Prerelease: true, Body: "Release candidate", Assets: []*Asset{
+		{Name: "cilium-linux-amd64.tar.gz", DownloadURL: "https://github.com/cilium/cilium/releases/download/v1.15.0-rc.1/cilium-linux-amd64.tar.gz"},
+	}},
+	{ID: 2, TagName: "v1.14.5", Name: "1.14.5", Body: "Bug fixes", Assets: []*Asset{
+		{Name: "cilium-linux-amd64.tar.gz", DownloadURL: "https://github.com/cilium/cilium/releases/download/v1.14.5/cilium-linux-amd64.tar.gz"},
+		{Name: "cilium-linux-amd64.tar.gz.sha256sum", DownloadURL: "https://github.com/cilium/cilium/releases/download/v1.14.5/cilium-linux-amd64.tar.gz.sha256sum"},
+	}},
+	{ID: 1, TagName: "v1.14.4", Name: "1.14.4", Draft: true},
+}
+
+// fixtureServer serves fixtureReleases perPage at a time, through the REST
+// API and the GraphQL API
+func fixtureServer(t *testing.T, perPage int) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/cilium/cilium/releases":
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			if page == 0 {
+				page = 1
+			}
+			start, end := (page-1)*perPage, page*perPage
+			if end < len(fixtureReleases) {
+				w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=%d&page=%d>; rel="next"`, srv.URL, r.URL.Path, perPage, page+1))
+			} else {
+				end = len(fixtureReleases)
+			}
+			_ = json.NewEncoder(w).Encode(fixtureReleases[start:end])
+		case "/graphql":
+			var req graphQLRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("decoding the GraphQL request: %v", err)
+			}
+			start := 0
+			if after, ok := req.Variables["after"].(string); ok {
+				start, _ = strconv.Atoi(after)
+			}
+			end := start + perPage
+			if end > len(fixtureReleases) {
+				end = len(fixtureReleases)
+			}
+			_, _ = fmt.Fprint(w, graphQLPage(fixtureReleases[start:end], end < len(fixtureReleases), strconv.Itoa(end)))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+// graphQLPage renders releases as a page of the GraphQL API
+func graphQLPage(releases []*Release, hasNext bool, cursor string) string {
+	nodes := make([]map[string]interface{}, 0, len(releases))
+	for _, release := range releases {
+		assets := make([]map[string]interface{}, 0, len(release.Assets))
+		for _, asset := range release.Assets {
+			assets = append(assets, map[string]interface{}{"name": asset.Name, "downloadUrl": asset.DownloadURL})
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"databaseId":    release.ID,
+			"tagName":       release.TagName,
+			"name":          release.Name,
+			"isDraft":       release.Draft,
+			"isPrerelease":  release.Prerelease,
+			"description":   release.Body,
+			"releaseAssets": map[string]interface{}{"nodes": assets},
+		})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"repository": map[string]interface{}{
+				"releases": map[string]interface{}{
+					"pageInfo": map[string]interface{}{"hasNextPage": hasNext, "endCursor": cursor},
+					"nodes":    nodes,
+				},
+			},
+		},
+	})
+	return string(body)
+}
+
+func TestReleaseClientGraphQLMatchesREST(t *testing.T) {
+	srv := fixtureServer(t, 2)
+	defer srv.Close()
+
+	list := func(graphQL bool) []*Release {
+		t.Helper()
+		rc := newTestClient(t, srv)
+		rc.Token = "secret"
+		rc.DisableGraphQL = !graphQL
+		releases, err := rc.ListReleases(context.Background(), 2, nil)
+		if err != nil {
+			t.Fatalf("ListReleases (graphql %v): %v", graphQL, err)
+		}
+		return releases
+	}
+
+	rest, graphQL := list(false), list(true)
+	if !reflect.DeepEqual(rest, fixtureReleases) {
+		t.Errorf("REST releases = %s, want %s", releasesString(rest), releasesString(fixtureReleases))
+	}
+	if !reflect.DeepEqual(graphQL, rest) {
+		t.Errorf("GraphQL releases = %s, want the REST ones %s", releasesString(graphQL), releasesString(rest))
+	}
+}
+
+// releasesString renders releases for the failure messages
+func releasesString(releases []*Release) string {
+	body, _ := json.Marshal(releases)
+	return string(body)
+}
+
+func TestReleaseClientGraphQLRateLimited(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		_, _ = fmt.Fprint(w, `{"data":null,"errors":[{"type":"RATE_LIMITED","message":"API rate limit exceeded for user ID 1."}]}`)
+	}))
+	defer srv.Close()
+	rc := newTestClient(t, srv)
+	rc.Token = "secret"
+
+	_, err := rc.ListReleases(context.Background(), 1, nil)
+	if code := errorCode(err); code != ErrRateLimitedCode {
+		t.Fatalf("error code = %q (%v), want %q", code, err, ErrRateLimitedCode)
+	}
+	if got := rc.RateLimitReset(); !got.Equal(reset) {
+		t.Errorf("RateLimitReset() = %v, want %v", got, reset)
+	}
+	if _, err := rc.ListReleases(context.Background(), 1, nil); errorCode(err) != ErrRateLimitedCode || hits != 1 {
+		t.Errorf("second ListReleases made %d requests (%v), want the rate limit error without request", hits, err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+// maxNearVersions is the number of versions suggested when a requested
+// version does not exist
+const maxNearVersions = 5
+
+// ResolveVersion resolves a version typed by the user, like 1.14.5 or
+// v1.14.5, to the tag of its github release. The versions closest to it
+// among known are suggested if there is no such release.
+//
+// The version is accepted unverified, with verified unset, rather than
+// failing when github cannot be reached.
+func ResolveVersion(ctx context.Context, version string, known []adapter.Version) (tag string, verified bool, err error) {
+	v, err := ParseVersion(version)
+	if err != nil {
+		return "", false, err
+	}
+	tag = canonicalVersion(v)
+
+	release, err := GetReleaseByTag(ctx, tag)
+	switch {
+	case IsReleaseNotFound(err):
+		return "", false, ErrUnknownVersion(tag, nearVersions(v, known))
+	case err != nil:
+		return tag, false, nil
+	case release.Draft:
+		return "", false, ErrDraftVersion(tag)
+	}
+	if release.TagName != "" {
+		tag = release.TagName
+	}
+	return tag, true, nil
+}
+
+// nearVersions returns the versions of known closest to v, those of the
+// same minor version first, then the nearest minor versions
+func nearVersions(v *semver.Version, known []adapter.Version) []string {
+	type candidate struct {
+		name           string
+		minor, patches int64
+	}
+	distance := func(a, b uint64) int64 {
+		if a > b {
+			return int64(a - b)
+		}
+		return int64(b - a)
+	}
+
+	var candidates []candidate
+	for _, k := range known {
+		kv, err := ParseVersion(string(k))
+		if err != nil || kv.Major() != v.Major() {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			name:    canonicalVersion(kv),
+			minor:   distance(kv.Minor(), v.Minor()),
+			patches: distance(kv.Patch(), v.Patch()),
+		})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].minor != candidates[j].minor {
+			return candidates[i].minor < candidates[j].minor
+		}
+		return candidates[i].patches < candidates[j].patches
+	})
+
+	near := make([]string, 0, maxNearVersions)
+	for _, c := range candidates {
+		if len(near) == maxNearVersions {
+			break
+		}
+		near = append(near, c.name)
+	}
+	return near
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshkit/utils/walker"
+)
+
+//go:generate go run ../../cmd/sample-manifests -o samples
+
+// embeddedSamples holds the sample manifests known at build time, one
+// directory per cilium minor in which they changed, which are applied when
+// github cannot be reached
+//
+//go:embed samples
+var embeddedSamples embed.FS
+
+// EmbeddedSamplePrefix prefixes the path of the embedded sample manifests
+const EmbeddedSamplePrefix = "embedded:"
+
+const (
+	// SampleStarWars is the Star Wars demo of the cilium tutorials
+	SampleStarWars = "starwars"
+
+	// SampleStarWarsL3L4Policy and SampleStarWarsL7Policy are the policies
+	// of the Star Wars demo
+	SampleStarWarsL3L4Policy = "starwars-l3-l4-policy"
+	SampleStarWarsL7Policy   = "starwars-l7-policy"
+)
+
+// sampleManifestNames are the file names each sample of the cilium repo
+// was published under, the current one first
+var sampleManifestNames = map[string][]string{
+	SampleStarWars:           {"http-sw-app.yaml"},
+	SampleStarWarsL3L4Policy: {"sw_l3_l4_policy.yaml"},
+	SampleStarWarsL7Policy:   {"sw_l3_l4_l7_policy.yaml"},
+}
+
+// sampleManifestDirs are the directories of the cilium repo the samples
+// are searched in, in order. They moved between the versions.
+var sampleManifestDirs = []string{"examples/minikube", "examples/kubernetes", "examples/policies/l7", "examples"}
+
+// SampleNames returns the names of the known samples, sorted
+func SampleNames() []string {
+	names := make([]string, 0, len(sampleManifestNames))
+	for name := range sampleManifestNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveSampleManifests returns the path in the cilium repo at ref of
+// every sample found there, by sample. The directories which do not exist
+// at ref are skipped.
+func ResolveSampleManifests(ctx context.Context, ref string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, dir := range sampleManifestDirs {
+		names, err := GetFileNames(ctx, "cilium", "cilium", dir, ref)
+		if IsGithubNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]bool, len(names))
+		for _, name := range names {
+			found[name] = true
+		}
+		for sample, candidates := range sampleManifestNames {
+			if _, ok := paths[sample]; ok {
+				continue
+			}
+			for _, name := range candidates {
+				if found[name] {
+					paths[sample] = path.Join(dir, name)
+					break
+				}
+			}
+		}
+		if len(paths) == len(sampleManifestNames) {
+			break
+		}
+	}
+	return paths, nil
+}
+
+// SampleFileName is the name under which sample is embedded
+func SampleFileName(sample string) string {
+	return sample + ".yaml"
+}
+
+// EmbeddedSample returns the embedded manifest of sample for the cilium
+// version ref: the copy of the newest minor up to the one of ref, else the
+// oldest copy if ref is older than all of them, else the newest copy if ref
+// is not a version, like a branch or a commit.
+func EmbeddedSample(sample, ref string) (walker.File, error) {
+	dirs, err := fs.ReadDir(embeddedSamples, "samples")
+	if err != nil {
+		return walker.File{}, err
+	}
+	var minors []*semver.Version
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if _, err := fs.Stat(embeddedSamples, path.Join("samples", dir.Name(), SampleFileName(sample))); err != nil {
+			continue
+		}
+		if v, err := semver.NewVersion(dir.Name()); err == nil {
+			minors = append(minors, v)
+		}
+	}
+	if len(minors) == 0 {
+		return walker.File{}, fmt.Errorf("no %s manifest is embedded in the adapter", sample)
+	}
+	sort.Sort(semver.Collection(minors))
+
+	picked := minors[len(minors)-1]
+	if v, err := ParseVersion(ref); err == nil {
+		picked = minors[0]
+		minor, _ := semver.NewVersion(fmt.Sprintf("%d.%d", v.Major(), v.Minor()))
+		for _, m := range minors {
+			if !m.GreaterThan(minor) {
+				picked = m
+			}
+		}
+	}
+
+	p := path.Join("samples", fmt.Sprintf("%d.%d", picked.Major(), picked.Minor()), SampleFileName(sample))
+	content, err := embeddedSamples.ReadFile(p)
+	if err != nil {
+		return walker.File{}, err
+	}
+	return walker.File{Name: SampleFileName(sample), Path: EmbeddedSamplePrefix + p, Content: string(content)}, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+// tag is a git tag as returned by the github tags API
+type tag struct {
+	Name string `json:"name"`
+}
+
+// tagLister is implemented by the listers which can list the git tags of
+// the repository as releases
+type tagLister interface {
+	ListTags(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error)
+}
+
+var _ tagLister = (*ReleaseClient)(nil)
+
+// ListTags walks the git tags of the repository, perPage at a time, and
+// returns those which are semantic versions as releases flagged FromTag.
+// It stops when done reports that enough releases were collected, github
+// runs out of tags or MaxPages pages have been fetched.
+func (rc *ReleaseClient) ListTags(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error) {
+	maxPages := rc.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	if perPage == 0 || perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	var releaseList []*Release
+	pageURL := fmt.Sprintf("%s/repos/%s/%s/tags?per_page=%d", rc.BaseURL, rc.Owner, rc.Repo, perPage)
+	for page := 0; page < maxPages && pageURL != ""; page++ {
+		tags, next, err := rc.getTagPage(ctx, pageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range tags {
+			// The repository also holds tags of other projects, like hubble
+			if _, err := ParseVersion(t.Name); err != nil {
+				continue
+			}
+			releaseList = append(releaseList, &Release{
+				TagName: t.Name,
+				Name:    adapter.Version(t.Name),
+				FromTag: true,
+			})
+		}
+		if done != nil && done(releaseList) {
+			break
+		}
+		pageURL = next
+	}
+
+	return releaseList, nil
+}
+
+func (rc *ReleaseClient) getTagPage(ctx context.Context, pageURL string) ([]*tag, string, error) {
+	resp, err := rc.get(ctx, pageURL, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var tags []*tag
+	if err := rc.decode(resp.Body, &tags); err != nil {
+		return nil, "", err
+	}
+	return tags, nextPageURL(resp.Header.Get("Link")), nil
+}
+
+// withTags adds the releases synthesized from tags to the releases, skipping
+// the tags which already have a release
+func withTags(releases, tagReleases []*Release) []*Release {
+	seen := make(map[string]bool, len(releases))
+	for _, release := range releases {
+		seen[release.TagName] = true
+	}
+	merged := append([]*Release{}, releases...)
+	for _, release := range tagReleases {
+		if !seen[release.TagName] {
+			merged = append(merged, release)
+		}
+	}
+	return merged
+}
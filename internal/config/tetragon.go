@@ -0,0 +1,62 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"os"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+const (
+	// TetragonChartName is the name of the tetragon chart in the helm repository,
+	// which is also the name of its release
+	TetragonChartName = "tetragon"
+
+	// tetragonRepo is the repository of the tetragon releases, under the
+	// cilium organization
+	tetragonRepo = "tetragon"
+)
+
+// NewTetragonReleaseClient returns a ReleaseClient for the cilium/tetragon
+// repository. The token and the API url are overridden the same way as for
+// NewReleaseClient, CILIUM_GITHUB_REPO only applies to cilium.
+func NewTetragonReleaseClient() (*ReleaseClient, error) {
+	rc := newReleaseClient(DefaultGithubAPIURL, defaultOwner, tetragonRepo)
+
+	client, err := newDefaultHTTPClient()
+	if err != nil {
+		return rc, err
+	}
+	rc.HTTPClient = client
+
+	if apiURL := os.Getenv(GithubAPIURLEnv); apiURL != "" {
+		if err := rc.SetBaseURL(apiURL); err != nil {
+			return rc, err
+		}
+	}
+	return rc, nil
+}
+
+// GetTetragonVersions returns at most limit stable tetragon versions
+// published on github, latest first
+func GetTetragonVersions(ctx context.Context, limit int) ([]adapter.Version, error) {
+	rc, err := NewTetragonReleaseClient()
+	if err != nil {
+		return nil, err
+	}
+	return ListVersions(ctx, rc, limit, VersionOptions{})
+}
@@ -0,0 +1,401 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/layer5io/meshery-adapter-library/adapter"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultMinVersion is the oldest cilium version offered by the adapter,
+	// the helm values used by the operations do not exist before it
+	DefaultMinVersion = "v1.9.0"
+
+	// MinVersionEnv is the environment variable which overrides the
+	// oldest cilium version offered by the adapter
+	MinVersionEnv = "CILIUM_MIN_VERSION"
+)
+
+// versionsGroup deduplicates the concurrent version lookups
+var versionsGroup singleflight.Group
+
+var (
+	// The whole tag must be a version so that tags of other projects, like
+	// chart-1.14.3 or hubble-v0.11.0, are not taken for cilium versions
+	stableTagRegex     = regexp.MustCompile(`^v?\d+\.\d+\.\d+$`)
+	prereleaseTagRegex = regexp.MustCompile(`^v?\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?$`)
+)
+
+// VersionOptions control which releases are turned into versions
+type VersionOptions struct {
+	// IncludePrereleases keeps the release candidates, like v1.15.0-rc.2,
+	// and the releases marked as prerelease on github. Only the stable
+	// releases are kept by default.
+	IncludePrereleases bool
+
+	// MinVersion drops the versions older than it. No version is dropped
+	// if it is empty.
+	MinVersion string
+
+	// CheckCharts drops the versions for which no chart has been published
+	// in the helm repository
+	CheckCharts bool
+
+	// Channel restricts the versions to those of a release channel,
+	// ChannelStable or ChannelEdge. Every version is kept if it is empty.
+	Channel string
+}
+
+// DefaultVersionOptions returns the options used for listing the versions
+// offered by the adapter. The version floor defaults to DefaultMinVersion
+// and can be overridden with the CILIUM_MIN_VERSION environment variable.
+// The versions are checked against the helm repository unless
+// CILIUM_SKIP_CHART_CHECK is set to true.
+func DefaultVersionOptions() VersionOptions {
+	opts := VersionOptions{
+		MinVersion:  DefaultMinVersion,
+		CheckCharts: !strings.EqualFold(os.Getenv(SkipChartCheckEnv), "true"),
+	}
+	if floor := os.Getenv(MinVersionEnv); floor != "" {
+		if _, err := ParseVersion(floor); err != nil {
+			logWarn(err)
+		} else {
+			opts.MinVersion = floor
+		}
+	}
+	return opts
+}
+
+// ParseVersion parses a cilium version of the form v1.14.3, or 1.14.3,
+// with an optional pre-release suffix like -rc.2. Versions missing a
+// component, like v1.14, or carrying anything else are rejected.
+func ParseVersion(version string) (*semver.Version, error) {
+	if !prereleaseTagRegex.MatchString(version) {
+		return nil, ErrInvalidVersion(version, fmt.Errorf("expected a version of the form v1.14.3"))
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, ErrInvalidVersion(version, err)
+	}
+	return v, nil
+}
+
+// matches reports whether the release is to be turned into a version.
+// Draft releases never match since their assets are not published.
+func (o VersionOptions) matches(release *Release) bool {
+	if release.Draft {
+		return false
+	}
+	if o.IncludePrereleases {
+		return prereleaseTagRegex.MatchString(release.TagName)
+	}
+	return !release.Prerelease && stableTagRegex.MatchString(release.TagName)
+}
+
+// names returns the tag names of the releases which match the options,
+// along with the number of releases excluded for being older than
+// MinVersion
+func (o VersionOptions) names(releases []*Release) ([]string, int) {
+	var floor *semver.Version
+	if o.MinVersion != "" {
+		// An invalid floor does not exclude anything
+		floor, _ = ParseVersion(o.MinVersion)
+	}
+
+	var names []string
+	belowFloor := 0
+	for _, release := range releases {
+		if !o.matches(release) {
+			continue
+		}
+		if floor != nil {
+			if v, err := ParseVersion(release.TagName); err == nil && v.LessThan(floor) {
+				belowFloor++
+				continue
+			}
+		}
+		names = append(names, release.TagName)
+	}
+	return names, belowFloor
+}
+
+// VersionSource tells where a list of versions came from
+type VersionSource string
+
+const (
+	// SourceLive versions were fetched from github
+	SourceLive VersionSource = "live"
+
+	// SourceCache versions come from the releases persisted on the disk
+	SourceCache VersionSource = "cache"
+
+	// SourceFallback versions come from the list embedded in the binary
+	SourceFallback VersionSource = "fallback"
+)
+
+// VersionResult is a list of versions along with where it came from
+type VersionResult struct {
+	Versions []adapter.Version
+	Source   VersionSource
+}
+
+// sourceLister is implemented by the listers which can tell where the
+// releases came from and can bypass their caches
+type sourceLister interface {
+	listReleasesFrom(ctx context.Context, perPage uint, done func([]*Release) bool, refresh bool) ([]*Release, VersionSource, error)
+}
+
+// getLatestReleaseNames returns the names of at most limit releases
+// matching opts, latest first. The returned slice never contains empty
+// versions, and it is shorter than limit if fewer releases match.
+//
+// The versions embedded in the binary are used when github cannot be
+// reached. They are not added to the live versions, which would advertise
+// versions whose charts were not checked.
+func getLatestReleaseNames(ctx context.Context, limit int, opts VersionOptions) ([]adapter.Version, error) {
+	result, err := LookupVersions(ctx, limit, opts, false)
+	if err != nil {
+		return nil, err
+	}
+	return result.Versions, nil
+}
+
+// LookupVersions is getLatestReleaseNames reporting where the versions came
+// from. The caches are bypassed if refresh is set.
+//
+// Concurrent calls with the same arguments share a single lookup, and so
+// the context of the call which started it.
+func LookupVersions(ctx context.Context, limit int, opts VersionOptions, refresh bool) (VersionResult, error) {
+	shared, err, _ := versionsGroup.Do(fmt.Sprintf("%d/%+v/%t", limit, opts, refresh), func() (interface{}, error) {
+		return latestReleaseNames(ctx, defaultReleaseLister, limit, opts, refresh)
+	})
+	if err != nil {
+		return VersionResult{}, err
+	}
+	result := shared.(VersionResult)
+	result.Versions = append([]adapter.Version{}, result.Versions...)
+	return result, nil
+}
+
+// latestReleaseNames is LookupVersions with the releases listed by the
+// lister returned by newLister
+func latestReleaseNames(ctx context.Context, newLister func() (ReleaseLister, error), limit int, opts VersionOptions, refresh bool) (VersionResult, error) {
+	// An unknown channel is a mistake of the caller, not a reason to fall back
+	if err := validateChannel(opts.Channel); err != nil {
+		return VersionResult{}, err
+	}
+
+	live, source, err := listVersions(ctx, newLister, limit, opts, refresh)
+	if err != nil {
+		if IsReleaseFetchCanceled(err) {
+			return VersionResult{}, err
+		}
+		logInfo(fmt.Sprintf("Using the offline list of cilium versions since github could not be reached: %s", err.Error()))
+		return VersionResult{Versions: fallbackVersions(fallbackReleases(), limit, opts), Source: SourceFallback}, nil
+	}
+	return VersionResult{Versions: live, Source: source}, nil
+}
+
+// FetchVersions returns the names of at most limit releases published on
+// github matching opts, latest first, without falling back to the versions
+// embedded in the binary
+func FetchVersions(ctx context.Context, limit int, opts VersionOptions) ([]adapter.Version, error) {
+	versions, _, err := listVersions(ctx, defaultReleaseLister, limit, opts, false)
+	return versions, err
+}
+
+// ListVersions returns the names of at most limit releases listed by lister
+// matching opts, latest first
+func ListVersions(ctx context.Context, lister ReleaseLister, limit int, opts VersionOptions) ([]adapter.Version, error) {
+	versions, _, err := listVersions(ctx, func() (ReleaseLister, error) { return lister, nil }, limit, opts, false)
+	return versions, err
+}
+
+func listVersions(ctx context.Context, newLister func() (ReleaseLister, error), limit int, opts VersionOptions, refresh bool) ([]adapter.Version, VersionSource, error) {
+	if limit <= 0 {
+		return []adapter.Version{}, SourceLive, nil
+	}
+
+	if err := validateChannel(opts.Channel); err != nil {
+		return nil, "", err
+	}
+
+	lister, err := newLister()
+	if err != nil {
+		return nil, "", ErrGetLatestReleaseNames(err)
+	}
+
+	var charts map[string]bool
+	if opts.CheckCharts {
+		charts, err = defaultChartIndex.chartVersions(ctx, DefaultHelmRepository(), HelmChartName)
+		if err != nil {
+			// Not being able to verify the charts must not hide every version
+			logWarn(err)
+		}
+	}
+
+	done := func(rels []*Release) bool {
+		names, _ := opts.names(rels)
+		names, _ = withCharts(names, charts)
+		names, complete := selectChannel(opts.Channel, sortVersionsWith(names, nil))
+		return complete || len(names) >= limit
+	}
+
+	var (
+		releases []*Release
+		source   = SourceLive
+	)
+	if sl, ok := lister.(sourceLister); ok {
+		releases, source, err = sl.listReleasesFrom(ctx, 30, done, refresh)
+	} else {
+		releases, err = lister.ListReleases(ctx, 30, done)
+	}
+	if err != nil {
+		if IsReleaseFetchCanceled(err) {
+			return nil, "", err
+		}
+		return nil, "", ErrGetLatestReleaseNames(err)
+	}
+
+	result := selectVersions(releases, limit, opts, charts)
+
+	if tl, ok := lister.(tagLister); ok && len(result) < limit {
+		logInfo(fmt.Sprintf("Github releases yielded %d of %d cilium versions, falling back to the git tags", len(result), limit))
+		tagReleases, err := tl.ListTags(ctx, 100, func(rels []*Release) bool {
+			return done(withTags(releases, rels))
+		})
+		if err != nil {
+			// The versions found in the releases are still worth offering
+			logWarn(err)
+			return result, source, nil
+		}
+		result = selectVersions(withTags(releases, tagReleases), limit, opts, charts)
+	}
+
+	return result, source, nil
+}
+
+// selectVersions returns the names of at most limit releases matching opts
+// and having a chart in charts, latest first
+func selectVersions(releases []*Release, limit int, opts VersionOptions, charts map[string]bool) []adapter.Version {
+	if drafts := countDrafts(releases); drafts > 0 {
+		logDebug(fmt.Sprintf("Skipped %d draft releases while listing cilium versions", drafts))
+	}
+	if invalid := invalidTags(releases); len(invalid) > 0 {
+		logDebug(fmt.Sprintf("Skipped releases whose tags are not cilium versions: %s", strings.Join(invalid, ", ")))
+	}
+
+	matching, belowFloor := opts.names(releases)
+	if belowFloor > 0 {
+		logDebug(fmt.Sprintf("Excluded %d cilium releases older than %s", belowFloor, opts.MinVersion))
+	}
+
+	matching, missing := withCharts(matching, charts)
+	if len(missing) > 0 {
+		logDebug(fmt.Sprintf("Excluded cilium releases without a helm chart: %s", strings.Join(missing, ", ")))
+	}
+
+	names, _ := selectChannel(opts.Channel, sortVersions(matching))
+	result := make([]adapter.Version, 0, limit)
+	for _, name := range names {
+		if len(result) == limit {
+			break
+		}
+		if name == "" {
+			continue
+		}
+		result = append(result, adapter.Version(name))
+	}
+	return result
+}
+
+// fallbackVersions returns the versions of at most limit fallback releases
+// matching opts, latest first and without duplicates
+func fallbackVersions(fallback []*Release, limit int, opts VersionOptions) []adapter.Version {
+	names, _ := opts.names(fallback)
+	selected, _ := selectChannel(opts.Channel, sortVersions(names))
+	result := make([]adapter.Version, 0, limit)
+	for _, name := range selected {
+		if len(result) == limit {
+			break
+		}
+		result = append(result, adapter.Version(name))
+	}
+	return result
+}
+
+// invalidTags returns the tags of the releases which are not of the form
+// of a cilium version
+func invalidTags(releases []*Release) []string {
+	var invalid []string
+	for _, release := range releases {
+		if !release.Draft && !prereleaseTagRegex.MatchString(release.TagName) {
+			invalid = append(invalid, release.TagName)
+		}
+	}
+	return invalid
+}
+
+func countDrafts(releases []*Release) int {
+	drafts := 0
+	for _, release := range releases {
+		if release.Draft {
+			drafts++
+		}
+	}
+	return drafts
+}
+
+// sortVersions parses the names as semantic versions, optionally prefixed
+// with a "v", and returns them latest first in the canonical form given by
+// canonicalVersion. Names which normalize to the same version are kept
+// once. Release candidates sort before their final release. Names which
+// are not valid versions are dropped with a warning.
+func sortVersions(names []string) []string {
+	return sortVersionsWith(names, func(name string, err error) {
+		logWarn(err)
+	})
+}
+
+// sortVersionsWith is sortVersions calling onInvalid, if it is not nil,
+// for the dropped names instead of warning about them
+func sortVersionsWith(names []string, onInvalid func(name string, err error)) []string {
+	versions := make([]*semver.Version, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		v, err := ParseVersion(name)
+		if err != nil {
+			if onInvalid != nil {
+				onInvalid(name, err)
+			}
+			continue
+		}
+		if canonical := canonicalVersion(v); !seen[canonical] {
+			seen[canonical] = true
+			versions = append(versions, v)
+		}
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].GreaterThan(versions[j])
+	})
+
+	sorted := make([]string, 0, len(versions))
+	for _, v := range versions {
+		sorted = append(sorted, canonicalVersion(v))
+	}
+	return sorted
+}
+
+// canonicalVersion formats v with a leading "v" and all of its numeric
+// components, like v1.14.3 for both 1.14.3 and v1.14.3
+func canonicalVersion(v *semver.Version) string {
+	return "v" + v.String()
+}
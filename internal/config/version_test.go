@@ -0,0 +1,265 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+// fakeLister serves releases perPage at a time like github would, or err
+type fakeLister struct {
+	releases []*Release
+	err      error
+	pages    int
+}
+
+func (f *fakeLister) ListReleases(ctx context.Context, perPage uint, done func([]*Release) bool) ([]*Release, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var listed []*Release
+	for start := 0; start < len(f.releases); start += int(perPage) {
+		end := start + int(perPage)
+		if end > len(f.releases) {
+			end = len(f.releases)
+		}
+		f.pages++
+		listed = append(listed, f.releases[start:end]...)
+		if done != nil && done(listed) {
+			break
+		}
+	}
+	return listed, nil
+}
+
+// newFakeLister returns a lister of the releases tagged tags, the tags
+// ending in -rc.N being marked as prereleases
+func newFakeLister(tags ...string) *fakeLister {
+	f := &fakeLister{}
+	for _, tag := range tags {
+		v, err := ParseVersion(tag)
+		f.releases = append(f.releases, &Release{TagName: tag, Prerelease: err == nil && v.Prerelease() != ""})
+	}
+	return f
+}
+
+func listerOf(lister ReleaseLister) func() (ReleaseLister, error) {
+	return func() (ReleaseLister, error) { return lister, nil }
+}
+
+func versionNames(versions []adapter.Version) []string {
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		names = append(names, string(v))
+	}
+	return names
+}
+
+func TestListVersions(t *testing.T) {
+	tags := []string{"v1.15.0-rc.2", "v1.15.0-rc.1", "v1.14.3", "v1.14.2", "v1.13.9"}
+	tests := []struct {
+		name  string
+		limit int
+		opts  VersionOptions
+		want  []string
+	}{
+		{name: "stable only", limit: 3, want: []string{"v1.14.3", "v1.14.2", "v1.13.9"}},
+		{name: "release candidates", limit: 3, opts: VersionOptions{IncludePrereleases: true}, want: []string{"v1.15.0-rc.2", "v1.15.0-rc.1", "v1.14.3"}},
+		{name: "limit larger than the releases", limit: 10, want: []string{"v1.14.3", "v1.14.2", "v1.13.9"}},
+		{name: "floor", limit: 10, opts: VersionOptions{MinVersion: "v1.14.0"}, want: []string{"v1.14.3", "v1.14.2"}},
+		{name: "stable channel", limit: 10, opts: VersionOptions{Channel: ChannelStable}, want: []string{"v1.14.3", "v1.13.9"}},
+		{name: "no limit", limit: 0, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, source, err := listVersions(context.Background(), listerOf(newFakeLister(tags...)), tt.limit, tt.opts, false)
+			if err != nil {
+				t.Fatalf("listVersions: %v", err)
+			}
+			if source != SourceLive {
+				t.Errorf("source = %s, want %s", source, SourceLive)
+			}
+			if got := versionNames(versions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("versions = %v, want %v", got, tt.want)
+			}
+			for i, v := range versions {
+				if v == "" {
+					t.Errorf("version %d is empty", i)
+				}
+			}
+		})
+	}
+}
+
+func TestListVersionsStopsListing(t *testing.T) {
+	var tags []string
+	for patch := 20; patch > 0; patch-- {
+		tags = append(tags, fmt.Sprintf("v1.14.%d", patch))
+	}
+	lister := newFakeLister(tags...)
+	if _, _, err := listVersions(context.Background(), listerOf(lister), 3, VersionOptions{}, false); err != nil {
+		t.Fatalf("listVersions: %v", err)
+	}
+	// The versions are listed 30 at a time, the first page is enough
+	if lister.pages != 1 {
+		t.Errorf("%d pages listed, want 1", lister.pages)
+	}
+}
+
+func TestLatestReleaseNames(t *testing.T) {
+	versions, err := latestReleaseNames(context.Background(), listerOf(newFakeLister("v1.14.3", "v1.14.2")), 10, VersionOptions{}, false)
+	if err != nil {
+		t.Fatalf("latestReleaseNames: %v", err)
+	}
+	// The live versions are not padded with the embedded ones
+	if got, want := versionNames(versions.Versions), []string{"v1.14.3", "v1.14.2"}; !reflect.DeepEqual(got, want) || versions.Source != SourceLive {
+		t.Errorf("versions = %v from %s, want %v from %s", got, versions.Source, want, SourceLive)
+	}
+}
+
+func TestLatestReleaseNamesErrors(t *testing.T) {
+	failing := func(err error) func() (ReleaseLister, error) {
+		return listerOf(&fakeLister{err: err})
+	}
+	tests := []struct {
+		name         string
+		newLister    func() (ReleaseLister, error)
+		opts         VersionOptions
+		wantCode     string
+		wantFallback bool
+	}{
+		{name: "lister failure", newLister: failing(fmt.Errorf("connection refused")), wantCode: ErrGetLatestReleaseNamesCode, wantFallback: true},
+		{name: "lister construction failure", newLister: func() (ReleaseLister, error) { return nil, fmt.Errorf("invalid url") }, wantCode: ErrGetLatestReleaseNamesCode, wantFallback: true},
+		{name: "canceled", newLister: failing(ErrReleaseFetchCanceled(context.Canceled)), wantCode: ErrReleaseFetchCanceledCode},
+		{name: "unknown channel", newLister: listerOf(newFakeLister("v1.14.3")), opts: VersionOptions{Channel: "nightly"}, wantCode: ErrUnknownChannelCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := listVersions(context.Background(), tt.newLister, 3, tt.opts, false)
+			if code := errorCode(err); code != tt.wantCode {
+				t.Fatalf("listVersions error code = %q (%v), want %q", code, err, tt.wantCode)
+			}
+
+			result, err := latestReleaseNames(context.Background(), tt.newLister, 3, tt.opts, false)
+			if !tt.wantFallback {
+				if code := errorCode(err); code != tt.wantCode {
+					t.Errorf("latestReleaseNames error code = %q (%v), want %q", code, err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("latestReleaseNames: %v", err)
+			}
+			if result.Source != SourceFallback || len(result.Versions) == 0 {
+				t.Errorf("got %d versions from %s, want the embedded versions", len(result.Versions), result.Source)
+			}
+		})
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{name: "two digit patch", names: []string{"v1.9.9", "v1.9.10", "v1.9.2"}, want: []string{"v1.9.10", "v1.9.9", "v1.9.2"}},
+		{name: "two digit minor", names: []string{"v1.9.0", "v1.10.0", "v1.11.1"}, want: []string{"v1.11.1", "v1.10.0", "v1.9.0"}},
+		{name: "mixed prefixes", names: []string{"1.14.2", "v1.14.3", "1.13.0"}, want: []string{"v1.14.3", "v1.14.2", "v1.13.0"}},
+		{name: "duplicates", names: []string{"1.14.3", "v1.14.3"}, want: []string{"v1.14.3"}},
+		{name: "release candidates", names: []string{"v1.15.0", "v1.15.0-rc.1", "v1.15.0-rc.10", "v1.15.0-rc.2"}, want: []string{"v1.15.0", "v1.15.0-rc.10", "v1.15.0-rc.2", "v1.15.0-rc.1"}},
+		{name: "invalid dropped", names: []string{"v1.14", "chart-1.14.3", "latest", "v1.14.3"}, want: []string{"v1.14.3"}},
+		{name: "empty", names: nil, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortVersions(tt.names); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortVersions(%v) = %v, want %v", tt.names, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectVersionsNeverEmpty(t *testing.T) {
+	releases := newFakeLister("v1.14.3", "", "v1.14.2").releases
+	versions := selectVersions(releases, 5, VersionOptions{}, nil)
+	if got, want := versionNames(versions), []string{"v1.14.3", "v1.14.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("selectVersions = %v, want %v", got, want)
+	}
+	if got := selectVersions(releases, 1, VersionOptions{}, nil); len(got) != 1 || got[0] != "v1.14.3" {
+		t.Errorf("selectVersions with limit 1 = %v, want [v1.14.3]", got)
+	}
+}
+
+func TestVersionOptionsNames(t *testing.T) {
+	releases := []*Release{
+		{TagName: "v1.15.0", Draft: true},
+		{TagName: "v1.15.0-rc.1", Prerelease: true},
+		{TagName: "v1.14.4", Prerelease: true},
+		{TagName: "v1.14.3"},
+		{TagName: "hubble-v0.11.0"},
+		{TagName: "v1.9.0"},
+		{TagName: "v1.8.13"},
+	}
+	tests := []struct {
+		name           string
+		opts           VersionOptions
+		want           []string
+		wantBelowFloor int
+	}{
+		{name: "published stable", want: []string{"v1.14.3", "v1.9.0", "v1.8.13"}},
+		{name: "prereleases", opts: VersionOptions{IncludePrereleases: true}, want: []string{"v1.15.0-rc.1", "v1.14.4", "v1.14.3", "v1.9.0", "v1.8.13"}},
+		{name: "floor", opts: VersionOptions{MinVersion: "v1.9.0"}, want: []string{"v1.14.3", "v1.9.0"}, wantBelowFloor: 1},
+		{name: "invalid floor", opts: VersionOptions{MinVersion: "nine"}, want: []string{"v1.14.3", "v1.9.0", "v1.8.13"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, belowFloor := tt.opts.names(releases)
+			if !reflect.DeepEqual(got, tt.want) || belowFloor != tt.wantBelowFloor {
+				t.Errorf("names = %v, %d below the floor, want %v, %d", got, belowFloor, tt.want, tt.wantBelowFloor)
+			}
+		})
+	}
+	if drafts := countDrafts(releases); drafts != 1 {
+		t.Errorf("countDrafts = %d, want 1", drafts)
+	}
+}
+
+func TestSelectChannel(t *testing.T) {
+	sorted := []string{"v1.15.0-rc.2", "v1.15.0-rc.1", "v1.14.3", "v1.14.2", "v1.13.9", "v1.13.8"}
+	tests := []struct {
+		channel      string
+		sorted       []string
+		want         []string
+		wantComplete bool
+	}{
+		{channel: "", sorted: sorted, want: sorted},
+		{channel: ChannelStable, sorted: sorted, want: []string{"v1.14.3", "v1.13.9"}},
+		{channel: ChannelEdge, sorted: sorted, want: []string{"v1.15.0-rc.2", "v1.15.0-rc.1"}, wantComplete: true},
+		{channel: ChannelEdge, sorted: []string{"v1.15.0-rc.2", "v1.15.0-rc.1"}, want: []string{"v1.15.0-rc.2", "v1.15.0-rc.1"}},
+		{channel: ChannelStable, sorted: []string{"v1.15.0-rc.1"}, want: nil},
+	}
+	for _, tt := range tests {
+		got, complete := selectChannel(tt.channel, tt.sorted)
+		if !reflect.DeepEqual(got, tt.want) || complete != tt.wantComplete {
+			t.Errorf("selectChannel(%q, %v) = %v, %t, want %v, %t", tt.channel, tt.sorted, got, complete, tt.want, tt.wantComplete)
+		}
+	}
+}
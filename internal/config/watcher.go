@@ -0,0 +1,214 @@
+// Copyright 2020 Layer5, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/layer5io/meshery-adapter-library/adapter"
+)
+
+const (
+	// DefaultVersionRefreshInterval is how often the supported versions are
+	// refreshed by default
+	DefaultVersionRefreshInterval = 6 * time.Hour
+
+	// VersionRefreshIntervalEnv is the environment variable which overrides
+	// how often the supported versions are refreshed, for example 30m
+	VersionRefreshIntervalEnv = "CILIUM_VERSION_REFRESH_INTERVAL"
+)
+
+// VersionWatcher keeps the list of supported cilium versions up to date by
+// refreshing it periodically, so that a long running adapter learns about
+// new cilium releases without being restarted
+type VersionWatcher struct {
+	limit    int
+	interval time.Duration
+	opts     VersionOptions
+
+	mu          sync.RWMutex
+	versions    []adapter.Version
+	source      VersionSource
+	subscribers []chan []adapter.Version
+}
+
+// versionWatcher keeps the versions offered by the adapter, it is set up by New
+var versionWatcher *VersionWatcher
+
+// SupportedVersions returns the cilium versions offered by the adapter along
+// with where they came from. They are fetched again, bypassing the caches,
+// if refresh is set.
+func SupportedVersions(ctx context.Context, refresh bool) (VersionResult, error) {
+	if versionWatcher == nil {
+		return VersionResult{}, ErrGetLatestReleaseNames(fmt.Errorf("the adapter configuration is not initialized"))
+	}
+	if refresh {
+		return versionWatcher.ForceRefresh(ctx)
+	}
+	return versionWatcher.Current(), nil
+}
+
+// NewVersionWatcher returns a watcher keeping at most limit versions
+// matching opts, refreshed every interval
+func NewVersionWatcher(limit int, interval time.Duration, opts VersionOptions) *VersionWatcher {
+	if interval <= 0 {
+		interval = DefaultVersionRefreshInterval
+	}
+	return &VersionWatcher{
+		limit:    limit,
+		interval: interval,
+		opts:     opts,
+	}
+}
+
+// VersionRefreshInterval returns the refresh interval set in the
+// CILIUM_VERSION_REFRESH_INTERVAL environment variable, falling back to
+// DefaultVersionRefreshInterval when it is unset or invalid
+func VersionRefreshInterval() time.Duration {
+	raw := os.Getenv(VersionRefreshIntervalEnv)
+	if raw == "" {
+		return DefaultVersionRefreshInterval
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		logWarn(ErrInvalidRefreshInterval(raw))
+		return DefaultVersionRefreshInterval
+	}
+	return interval
+}
+
+// Get returns a snapshot of the current versions, latest first
+func (w *VersionWatcher) Get() []adapter.Version {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return append([]adapter.Version(nil), w.versions...)
+}
+
+// Subscribe returns a channel receiving the new versions every time they
+// change. A slow subscriber only misses the intermediate lists, it always
+// receives the latest one. The channel is closed when Run returns.
+func (w *VersionWatcher) Subscribe() <-chan []adapter.Version {
+	ch := make(chan []adapter.Version, 1)
+	w.mu.Lock()
+	w.subscribers = append(w.subscribers, ch)
+	w.mu.Unlock()
+	return ch
+}
+
+// Refresh fetches the versions once and notifies the subscribers if they
+// changed. The previous versions are kept if none could be found.
+func (w *VersionWatcher) Refresh(ctx context.Context) {
+	if _, err := w.refresh(ctx, false); err != nil && !IsReleaseFetchCanceled(err) {
+		logWarn(err)
+	}
+}
+
+// ForceRefresh is Refresh bypassing the caches, it returns the versions in
+// use afterwards along with where they came from
+func (w *VersionWatcher) ForceRefresh(ctx context.Context) (VersionResult, error) {
+	return w.refresh(ctx, true)
+}
+
+func (w *VersionWatcher) refresh(ctx context.Context, force bool) (VersionResult, error) {
+	result, err := LookupVersions(ctx, w.limit, w.opts, force)
+	if err != nil {
+		return w.Current(), err
+	}
+	if len(result.Versions) == 0 {
+		return w.Current(), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.source = result.Source
+	if sameVersions(w.versions, result.Versions) {
+		return result, nil
+	}
+	w.versions = result.Versions
+	for _, ch := range w.subscribers {
+		// Replace the pending list, if any, with the latest one
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- append([]adapter.Version(nil), result.Versions...)
+	}
+	return result, nil
+}
+
+// Current returns a snapshot of the current versions along with where they
+// came from
+func (w *VersionWatcher) Current() VersionResult {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return VersionResult{
+		Versions: append([]adapter.Version(nil), w.versions...),
+		Source:   w.source,
+	}
+}
+
+// Run refreshes the versions every interval until ctx is done, then closes
+// the subscriber channels
+//
+// The next refresh is postponed past the reset of the github rate limit if
+// it was hit.
+func (w *VersionWatcher) Run(ctx context.Context) {
+	defer w.closeSubscribers()
+
+	timer := time.NewTimer(w.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			w.Refresh(ctx)
+			timer.Reset(w.nextRefresh())
+		}
+	}
+}
+
+// nextRefresh returns the delay before the next refresh
+func (w *VersionWatcher) nextRefresh() time.Duration {
+	if untilReset := time.Until(RateLimitReset()); untilReset > w.interval {
+		return untilReset
+	}
+	return w.interval
+}
+
+func (w *VersionWatcher) closeSubscribers() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.subscribers {
+		close(ch)
+	}
+	w.subscribers = nil
+}
+
+func sameVersions(a, b []adapter.Version) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
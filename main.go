@@ -14,21 +14,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"path"
-	"strings"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
 	"github.com/layer5io/meshery-adapter-library/adapter"
 	"github.com/layer5io/meshery-adapter-library/api/grpc"
+	"github.com/layer5io/meshery-adapter-library/meshes"
+	"github.com/layer5io/meshery-cilium/build"
 	"github.com/layer5io/meshery-cilium/cilium"
 	"github.com/layer5io/meshery-cilium/cilium/oam"
 	"github.com/layer5io/meshery-cilium/internal/config"
 	configprovider "github.com/layer5io/meshkit/config/provider"
 	"github.com/layer5io/meshkit/logger"
-	"github.com/layer5io/meshery-cilium/build"
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 )
 
 var (
@@ -58,6 +66,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	config.SetLogger(log)
+
 	err = os.Setenv("KUBECONFIG", path.Join(
 		config.KubeConfigDefaults[configprovider.FilePath],
 		fmt.Sprintf("%s.%s", config.KubeConfigDefaults[configprovider.FileName], config.KubeConfigDefaults[configprovider.FileType])),
@@ -68,9 +78,13 @@ func main() {
 		log.Warn(err)
 	}
 
+	// ctx is canceled when the adapter is asked to shut down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize application specific configs and dependencies
 	// App and request config
-	cfg, err := config.New(configprovider.ViperKey)
+	cfg, err := config.New(ctx, configprovider.ViperKey)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
@@ -110,11 +124,36 @@ func main() {
 
 	// Server Initialization
 	log.Info("Adaptor Listening at port: ", service.Port)
-	err = grpc.Start(service, nil)
+	err = serve(ctx, service)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
+	log.Info("Shutting down the adapter")
+}
+
+// serve serves the adapter on the port of s as grpc.Start does, until ctx
+// is canceled. The requests in flight are then finished before returning.
+func serve(ctx context.Context, s *grpc.Service) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", s.Port))
+	if err != nil {
+		return grpc.ErrGrpcListener(err)
+	}
+	server := gogrpc.NewServer(gogrpc.UnaryInterceptor(grpc_recovery.UnaryServerInterceptor(
+		grpc_recovery.WithRecoveryHandler(grpc.ErrPanic),
+	)))
+	// Reflection is enabled to simplify accessing the service using grpcurl
+	reflection.Register(server)
+	meshes.RegisterMeshServiceServer(server, s)
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	if err := server.Serve(listener); err != nil && ctx.Err() == nil {
+		return grpc.ErrGrpcServer(err)
+	}
+	return nil
 }
 
 func isDebug() bool {
@@ -188,16 +227,24 @@ func registerWorkloads(port string, log logger.Handler) {
 	}
 
 	log.Info("Registering latest workload components for version ", version)
-	for _, crd := range build.CRDNames {
-		crdurl := url + crd
+	for _, crd := range build.CRDFiles {
+		crdurl := url + crd.Name
 		log.Info("Registering ", crdurl)
-		if err := adapter.CreateComponents(adapter.StaticCompConfig{
+		scfg := adapter.StaticCompConfig{
 			URL:     crdurl,
 			Method:  gm,
 			Path:    build.WorkloadPath,
 			DirName: version,
 			Config:  build.NewConfig(version),
-		}); err != nil {
+		}
+		var err error
+		if url == build.DefaultURL {
+			// The CRDs were already fetched along with their names
+			err = build.CreateComponentsFromManifest(crd.Content, scfg)
+		} else {
+			err = adapter.CreateComponents(scfg)
+		}
+		if err != nil {
 			log.Info(err.Error())
 			return
 		}